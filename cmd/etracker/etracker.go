@@ -2,74 +2,133 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"flag"
 	"log"
-	"net/http"
-	"path/filepath"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/dmoerner/etracker/internal/api"
 	"github.com/dmoerner/etracker/internal/config"
 	"github.com/dmoerner/etracker/internal/handler"
-	"github.com/dmoerner/etracker/internal/prune"
-	"github.com/dmoerner/etracker/internal/scrape"
+	"github.com/dmoerner/etracker/internal/server"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-// serveFrontend provides the basic routing logic for the SPA.
-func serveFrontend(frontendPath string) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		fs := http.Dir(frontendPath)
-		path := filepath.Join(r.URL.Path)
-
-		// Serve static assets, if they exist.
-		if _, err := fs.Open(path); err == nil {
-			http.FileServer(fs).ServeHTTP(w, r)
-			return
+// rotateJob rotates the access log every interval, in addition to the
+// rotation by size. Failures are logged but do not stop the tracker.
+func rotateJob(w *lumberjack.Logger, interval time.Duration) server.Job {
+	return func(ctx context.Context, _ config.Config) error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				if err := w.Rotate(); err != nil {
+					log.Printf("Error rotating access log: %v", err)
+				}
+			}
 		}
-
-		// Route everything else through index.html.
-		http.ServeFile(w, r, filepath.Join(frontendPath, "index.html"))
 	}
 }
 
 func main() {
-	ctx := context.Background()
-
-	conf := config.BuildConfig(ctx, handler.DefaultAlgorithm)
-
-	// On startup, prune unused announce keys. This cannot be done
-	// in the config package because it would be a circular dependency.
-	err := prune.PruneAnnounceKeys(ctx, conf)
-	if err != nil {
-		log.Fatalf("Error pruning unused announce keys: %v", err)
+	addr := flag.String("addr", "", "address to listen on (default localhost:$ETRACKER_BACKEND_PORT)")
+	frontendPath := flag.String("frontend", server.DefaultFrontendPath, "directory containing the built frontend")
+	notFoundPage := flag.String("frontend-404", "", "file in the frontend directory to serve for missing assets, such as 404.html")
+	certFile := flag.String("cert", "", "TLS certificate file; serves HTTPS when set together with -key")
+	keyFile := flag.String("key", "", "TLS key file")
+	noHTTP2 := flag.Bool("no-http2", false, "disable HTTP/2 on the TLS listener")
+	http3 := flag.Bool("http3", false, "also serve HTTP/3 over QUIC on the same port (experimental)")
+	autocertHosts := flag.String("autocert", "", "comma-separated hostnames to obtain certificates for from Let's Encrypt; serves HTTPS without -cert and -key")
+	autocertCache := flag.String("autocert-cache", "autocert", "directory to cache certificates from Let's Encrypt in")
+	autocertEmail := flag.String("autocert-email", "", "contact email for Let's Encrypt expiry notices")
+	autocertHTTP := flag.String("autocert-http", "", "also answer ACME challenges and redirect to HTTPS on this address, such as :80")
+	clientCA := flag.String("client-ca", "", "CA certificates for client certificates; clients with a mapped certificate announce at /announce without a key")
+	accessLog := flag.String("access-log", "", "write announces and scrapes to this file in common or combined log format")
+	accessLogFormat := flag.String("access-log-format", string(server.CombinedLog), "access log format: common or combined")
+	accessLogMaxSize := flag.Int("access-log-max-size", 100, "size in megabytes at which the access log is rotated")
+	accessLogMaxAge := flag.Int("access-log-max-age", 0, "days to keep rotated access logs; 0 keeps them forever")
+	accessLogMaxBackups := flag.Int("access-log-max-backups", 0, "number of rotated access logs to keep; 0 keeps them all")
+	accessLogRotate := flag.Duration("access-log-rotate", 0, "also rotate the access log at this interval, such as 24h")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	algorithm := handler.DefaultAlgorithm
+	if name := os.Getenv("ETRACKER_ALGORITHM"); name != "" {
+		var ok bool
+		algorithm, ok = handler.Algorithms[name]
+		if !ok {
+			log.Fatalf("Unknown ETRACKER_ALGORITHM %q", name)
+		}
 	}
 
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/", serveFrontend("./frontend/dist"))
-
-	api.MuxAPIRoutes(ctx, conf, mux)
-
-	mux.HandleFunc("GET /{id}/announce", handler.PeerHandler(ctx, conf))
-	mux.HandleFunc("GET /{id}/scrape", scrape.ScrapeHandler(ctx, conf))
+	conf := config.BuildConfig(ctx, algorithm)
 
-	s := &http.Server{
-		Addr:              fmt.Sprintf("localhost:%d", conf.BackendPort),
-		ReadHeaderTimeout: 5 * time.Second,
-		ReadTimeout:       5 * time.Second,
-		Handler:           http.TimeoutHandler(mux, time.Second, "Timeout"),
+	opts := []server.Option{server.WithFrontendPath(*frontendPath), server.WithNotFoundPage(*notFoundPage)}
+	if *addr != "" {
+		opts = append(opts, server.WithAddr(*addr))
 	}
-
-	if err := s.ListenAndServe(); err != nil {
-		log.Fatalf("Unable to start HTTP server: %v", err)
+	var hosts []string
+	for _, host := range strings.Split(*autocertHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	switch {
+	case len(hosts) > 0 && (*certFile != "" || *keyFile != ""):
+		log.Fatal("Only one of -autocert and -cert and -key may be set")
+	case len(hosts) > 0:
+		opts = append(opts, server.WithTLS(config.TLSConfig{
+			// The canary announces to the first hostname, since the
+			// listener has no certificate for any other.
+			TlsHostname:      hosts[0],
+			DisableHTTP2:     *noHTTP2,
+			HTTP3:            *http3,
+			ClientCAFile:     *clientCA,
+			AutocertHosts:    hosts,
+			AutocertCacheDir: *autocertCache,
+			AutocertEmail:    *autocertEmail,
+			AutocertHTTPAddr: *autocertHTTP,
+		}))
+	case *certFile != "" && *keyFile != "":
+		opts = append(opts, server.WithTLS(config.TLSConfig{
+			CertFile:     *certFile,
+			KeyFile:      *keyFile,
+			DisableHTTP2: *noHTTP2,
+			HTTP3:        *http3,
+			ClientCAFile: *clientCA,
+		}))
 	}
 
-	// Prune old announce keys and announces on a timer.
-	pruneErrCh := make(chan error)
-	prune.PruneTimer(ctx, conf, pruneErrCh)
+	if *accessLog != "" {
+		format, err := server.ParseAccessLogFormat(*accessLogFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Rotated logs are named with their rotation time, and compressed.
+		w := &lumberjack.Logger{
+			Filename:   *accessLog,
+			MaxSize:    *accessLogMaxSize,
+			MaxAge:     *accessLogMaxAge,
+			MaxBackups: *accessLogMaxBackups,
+			LocalTime:  true,
+			Compress:   true,
+		}
+		defer w.Close()
+		opts = append(opts, server.WithAccessLog(w, format))
+		if *accessLogRotate > 0 {
+			opts = append(opts, server.WithJob(rotateJob(w, *accessLogRotate)))
+		}
+	}
 
-	err = <-pruneErrCh
-	if err != nil {
-		log.Fatalf("Error while pruning on timer: %v", err)
+	if err := server.New(ctx, conf, opts...).Run(ctx); err != nil {
+		log.Fatalf("Error running tracker: %v", err)
 	}
 }
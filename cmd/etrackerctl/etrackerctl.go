@@ -0,0 +1,886 @@
+// etrackerctl manages a running tracker through its REST API. The tracker
+// URL and API key are read from $ETRACKER_URL and $ETRACKER_AUTHORIZATION.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dmoerner/etracker/pkg/client"
+)
+
+const defaultURL = "http://localhost:3000"
+
+const usage = `usage: etrackerctl [-url URL] command [arguments]
+
+commands:
+  stats                       show global swarm statistics
+  history [RANGE]             show global swarm statistics over time, such
+                              as over 24h or 30d
+  countries                   show swarm statistics per country
+  asns                        show swarm statistics per ASN
+  infohashes                  list tracked infohashes
+  generate [captcha]          generate an announce key
+  redeem INVITE [captcha]     generate an announce key with an invite code
+  torrent KEY INFOHASH        download a torrent file to stdout
+  torrentinfo INFOHASH        show the files and metadata of a torrent file
+  verify KEY                  solve a proof of work so that an older key may
+                              announce
+  rotate KEY [SESSION]        replace a leaked announce key with a new one,
+                              with a session token if a user owns the key
+  url KEY                     show the announce URL for a key
+  qr KEY                      write the announce URL as a QR code PNG to stdout
+  add [-category CATEGORY] [-tags TAG,...] FILE...
+                              upload torrent files, or zip archives of them
+  add-infohash INFOHASH NAME [CATEGORY [TAG,...]]
+                              add an infohash to the allowlist
+  delete INFOHASH             remove an infohash from the allowlist
+  import FILE                 add the infohashes in a JSON array or hex list
+  export                      dump every infohash as JSON
+  merge DEPRECATED CANONICAL  merge a duplicate infohash into the canonical one
+  retire INFOHASH             refuse announces for an infohash, keeping its stats
+  restore INFOHASH            accept announces for a retired infohash again
+  snatches INFOHASH           list which keys completed an infohash and when
+  keyusage KEY                show usage analytics for an announce key
+  keys [LIMIT [OFFSET]]       list announce keys, oldest first
+  keystats KEY                show statistics for an announce key
+  revoke KEY                  revoke an announce key, erasing its data
+  wanted [LIMIT]              list the most requested missing infohashes
+  recent [OUTCOME|all [LIMIT]]
+                              show decisions for the most recent announces
+  runtime                     show goroutines, memory, pools, and cache sizes
+  maintenance [on [RETRY]|off]
+                              show or set maintenance mode
+  readonly [on|off]           show or set read-only mode
+  algorithm [NAME]            show or switch the peering algorithm
+  erase KEY                   erase all data for an announce key
+  indexers                    list indexers with catalog keys
+  add-indexer NAME            add an indexer and print its catalog key
+  delete-indexer NAME         revoke an indexer's catalog key
+  bans                        export every ban as JSON
+  import-bans FILE [replace]  import bans exported by bans, optionally
+                              removing bans not in the file
+  unban KIND VALUE            lift a key, cidr, or client ban
+  acls                        list infohash access control entries
+  allow INFOHASH KIND VALUE   restrict INFOHASH to a key or group, among
+                              any others already allowed
+  disallow INFOHASH KIND VALUE
+                              remove an access control entry
+  groups                      list group memberships
+  add-group USER GROUP        add a user to a group
+  delete-group USER GROUP     remove a user from a group
+  promotions                  list promotions which have not ended
+  promote INFOHASH|all DURATION [freeleech] [MULTIPLIER]
+                              make downloads freeleech or multiply uploads
+                              for one or every infohash, starting now
+  unpromote ID                remove a promotion
+  tiers                       list account tiers and the users in them
+  set-tier USER TIER [DURATION]
+                              put a user in a tier, optionally for a time
+  clear-tier USER             remove a user from their tier
+  features                    show which features are enabled
+  rotation                    show the progress of the key rotation campaign
+  start-rotation DURATION     require every key to be rotated within DURATION
+  cancel-rotation             stop requiring keys to be rotated
+  invites                     list invites and the keys they were used for
+  add-invite [NOTE]           create an invite and print its code
+  delete-invite ID            revoke an unused invite
+  clientcerts                 list client certificates mapped to keys
+  add-clientcert KEY FILE     let the PEM certificate in FILE announce as KEY
+  delete-clientcert FINGERPRINT
+                              remove a client certificate's mapping
+  agents                      list seedbox agents with keys
+  add-agent NAME              add a seedbox agent and print its key
+  delete-agent NAME           revoke a seedbox agent's key
+
+Infohashes are hex-encoded.
+`
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// decodeInfohash decodes a hex-encoded infohash.
+func decodeInfohash(s string) ([]byte, error) {
+	infoHash, err := hex.DecodeString(s)
+	if err != nil || len(infoHash) != 20 {
+		return nil, fmt.Errorf("invalid infohash %q", s)
+	}
+	return infoHash, nil
+}
+
+// splitTags splits a comma-separated list of tags.
+func splitTags(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func run(ctx context.Context, c *client.Client, args []string) error {
+	cmd, args := args[0], args[1:]
+
+	need := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("%s: expected %d arguments, got %d", cmd, n, len(args))
+		}
+		return nil
+	}
+
+	switch cmd {
+	case "stats":
+		stats, err := c.Stats(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(stats)
+
+	case "history":
+		var historyRange string
+		if len(args) > 0 {
+			historyRange = args[0]
+		}
+		points, err := c.StatsHistory(ctx, historyRange)
+		if err != nil {
+			return err
+		}
+		return printJSON(points)
+
+	case "countries":
+		stats, err := c.CountryStats(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(stats)
+
+	case "asns":
+		stats, err := c.AsnStats(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(stats)
+
+	case "infohashes":
+		infohashes, err := c.Infohashes(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(infohashes)
+
+	case "generate":
+		var captcha string
+		if len(args) > 0 {
+			captcha = args[0]
+		}
+		key, err := c.GenerateKey(ctx, captcha)
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+
+	case "redeem":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("redeem: expected INVITE [captcha]")
+		}
+		var captcha string
+		if len(args) > 1 {
+			captcha = args[1]
+		}
+		key, err := c.GenerateInvitedKey(ctx, "", captcha, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+
+	case "torrent":
+		if err := need(2); err != nil {
+			return err
+		}
+		infoHash, err := decodeInfohash(args[1])
+		if err != nil {
+			return err
+		}
+		file, err := c.TorrentFile(ctx, args[0], infoHash)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(file)
+		return err
+
+	case "torrentinfo":
+		if err := need(1); err != nil {
+			return err
+		}
+		infoHash, err := decodeInfohash(args[0])
+		if err != nil {
+			return err
+		}
+		info, err := c.TorrentInfo(ctx, infoHash)
+		if err != nil {
+			return err
+		}
+		return printJSON(info)
+
+	case "url":
+		if err := need(1); err != nil {
+			return err
+		}
+		announceURL, err := c.AnnounceURL(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(announceURL)
+		return nil
+
+	case "qr":
+		if err := need(1); err != nil {
+			return err
+		}
+		png, err := c.AnnounceQR(ctx, args[0], 0)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(png)
+		return err
+
+	case "add":
+		flags := flag.NewFlagSet("add", flag.ContinueOnError)
+		category := flags.String("category", "", "category of the torrents")
+		tags := flags.String("tags", "", "comma-separated tags of the torrents")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			return fmt.Errorf("add: no files given")
+		}
+		for _, name := range flags.Args() {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			if strings.HasSuffix(name, ".zip") {
+				var results []client.TorrentUpload
+				results, err = c.AddTorrentArchive(ctx, filepath.Base(name), f, *category, splitTags(*tags))
+				if err == nil {
+					err = printJSON(results)
+				}
+			} else {
+				err = c.AddTorrentTagged(ctx, filepath.Base(name), f, *category, splitTags(*tags))
+			}
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		return nil
+
+	case "add-infohash":
+		if len(args) < 2 || len(args) > 4 {
+			return fmt.Errorf("add-infohash: expected 2 to 4 arguments, got %d", len(args))
+		}
+		infoHash, err := decodeInfohash(args[0])
+		if err != nil {
+			return err
+		}
+		var category string
+		var tags []string
+		if len(args) > 2 {
+			category = args[2]
+		}
+		if len(args) > 3 {
+			tags = splitTags(args[3])
+		}
+		return c.AddInfohashTagged(ctx, infoHash, args[1], category, tags)
+
+	case "import":
+		if err := need(1); err != nil {
+			return err
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var result client.BulkImport
+		if strings.HasSuffix(args[0], ".json") {
+			var infohashes []client.InfohashPost
+			if err = json.NewDecoder(f).Decode(&infohashes); err != nil {
+				return fmt.Errorf("%s: %w", args[0], err)
+			}
+			result, err = c.ImportInfohashes(ctx, infohashes)
+		} else {
+			result, err = c.ImportInfohashList(ctx, f)
+		}
+		if err != nil {
+			return err
+		}
+		return printJSON(result)
+
+	case "export":
+		infohashes, err := c.ExportInfohashes(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(infohashes)
+
+	case "delete":
+		if err := need(1); err != nil {
+			return err
+		}
+		infoHash, err := decodeInfohash(args[0])
+		if err != nil {
+			return err
+		}
+		return c.DeleteInfohash(ctx, infoHash)
+
+	case "merge":
+		if err := need(2); err != nil {
+			return err
+		}
+		deprecated, err := decodeInfohash(args[0])
+		if err != nil {
+			return err
+		}
+		canonical, err := decodeInfohash(args[1])
+		if err != nil {
+			return err
+		}
+		return c.MergeInfohash(ctx, deprecated, canonical)
+
+	case "retire", "restore":
+		if err := need(1); err != nil {
+			return err
+		}
+		infoHash, err := decodeInfohash(args[0])
+		if err != nil {
+			return err
+		}
+		if cmd == "retire" {
+			return c.RetireInfohash(ctx, infoHash)
+		}
+		return c.RestoreInfohash(ctx, infoHash)
+
+	case "snatches":
+		if err := need(1); err != nil {
+			return err
+		}
+		infoHash, err := decodeInfohash(args[0])
+		if err != nil {
+			return err
+		}
+		snatches, err := c.Snatches(ctx, infoHash)
+		if err != nil {
+			return err
+		}
+		return printJSON(snatches)
+
+	case "keyusage":
+		if err := need(1); err != nil {
+			return err
+		}
+		usage, err := c.KeyUsage(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		return printJSON(usage)
+
+	case "keys":
+		if len(args) > 2 {
+			return fmt.Errorf("keys: expected at most 2 arguments, got %d", len(args))
+		}
+		var page [2]int
+		for i, arg := range args {
+			var err error
+			page[i], err = strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("keys: invalid number %q", arg)
+			}
+		}
+		keys, err := c.Keys(ctx, page[0], page[1])
+		if err != nil {
+			return err
+		}
+		return printJSON(keys)
+
+	case "keystats":
+		if err := need(1); err != nil {
+			return err
+		}
+		stats, err := c.KeyStats(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		return printJSON(stats)
+
+	case "verify":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.VerifyKey(ctx, args[0])
+
+	case "rotate":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("rotate: expected KEY [SESSION]")
+		}
+		var token string
+		if len(args) > 1 {
+			token = args[1]
+		}
+		key, err := c.RotateKey(ctx, args[0], token)
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+
+	case "revoke":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.RevokeKey(ctx, args[0])
+
+	case "wanted":
+		var limit int
+		if len(args) > 0 {
+			var err error
+			limit, err = strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("wanted: invalid limit %q", args[0])
+			}
+		}
+		wanted, err := c.Wanted(ctx, limit)
+		if err != nil {
+			return err
+		}
+		return printJSON(wanted)
+
+	case "recent":
+		if len(args) > 2 {
+			return fmt.Errorf("recent: expected [OUTCOME|all [LIMIT]]")
+		}
+		var outcome string
+		var limit int
+		if len(args) > 0 && args[0] != "all" {
+			outcome = args[0]
+		}
+		if len(args) > 1 {
+			var err error
+			limit, err = strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("recent: invalid limit %q", args[1])
+			}
+		}
+		decisions, err := c.RecentAnnounces(ctx, outcome, limit)
+		if err != nil {
+			return err
+		}
+		return printJSON(decisions)
+
+	case "runtime":
+		if err := need(0); err != nil {
+			return err
+		}
+		status, err := c.Runtime(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(status)
+
+	case "maintenance":
+		var status *client.Maintenance
+		var err error
+		switch {
+		case len(args) == 0:
+			status, err = c.Maintenance(ctx)
+		case args[0] == "off":
+			status, err = c.SetMaintenance(ctx, 0)
+		case args[0] == "on":
+			retry := time.Hour
+			if len(args) > 1 {
+				retry, err = time.ParseDuration(args[1])
+				if err != nil || retry <= 0 {
+					return fmt.Errorf("maintenance: invalid retry %q", args[1])
+				}
+			}
+			status, err = c.SetMaintenance(ctx, retry)
+		default:
+			return fmt.Errorf("maintenance: expected on or off, got %q", args[0])
+		}
+		if err != nil {
+			return err
+		}
+		return printJSON(status)
+
+	case "algorithm":
+		var status *client.Algorithm
+		var err error
+		switch len(args) {
+		case 0:
+			status, err = c.Algorithm(ctx)
+		case 1:
+			status, err = c.SetAlgorithm(ctx, args[0])
+		default:
+			return fmt.Errorf("algorithm: expected at most 1 argument, got %d", len(args))
+		}
+		if err != nil {
+			return err
+		}
+		return printJSON(status)
+
+	case "readonly":
+		var status *client.ReadOnly
+		var err error
+		switch {
+		case len(args) == 0:
+			status, err = c.ReadOnly(ctx)
+		case args[0] == "on" || args[0] == "off":
+			status, err = c.SetReadOnly(ctx, args[0] == "on")
+		default:
+			return fmt.Errorf("readonly: expected on or off, got %q", args[0])
+		}
+		if err != nil {
+			return err
+		}
+		return printJSON(status)
+
+	case "erase":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.ErasePeerData(ctx, args[0])
+
+	case "indexers":
+		indexers, err := c.Indexers(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(indexers)
+
+	case "add-indexer":
+		if err := need(1); err != nil {
+			return err
+		}
+		key, err := c.AddIndexer(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+
+	case "delete-indexer":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.DeleteIndexer(ctx, args[0])
+
+	case "bans":
+		bans, err := c.Bans(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(bans)
+
+	case "import-bans":
+		if len(args) < 1 || len(args) > 2 || (len(args) == 2 && args[1] != "replace") {
+			return fmt.Errorf("import-bans: expected FILE [replace]")
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var bans client.BanList
+		if err = json.NewDecoder(f).Decode(&bans); err != nil {
+			return fmt.Errorf("import-bans: invalid ban list: %w", err)
+		}
+		added, removed, err := c.ImportBans(ctx, &bans, len(args) == 2)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d added, %d removed\n", added, removed)
+		return nil
+
+	case "unban":
+		if err := need(2); err != nil {
+			return err
+		}
+		return c.DeleteBan(ctx, args[0], args[1])
+
+	case "acls":
+		entries, err := c.ACLs(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(entries)
+
+	case "allow", "disallow":
+		if err := need(3); err != nil {
+			return err
+		}
+		infoHash, err := decodeInfohash(args[0])
+		if err != nil {
+			return err
+		}
+		if cmd == "allow" {
+			return c.AddACL(ctx, infoHash, args[1], args[2])
+		}
+		return c.DeleteACL(ctx, infoHash, args[1], args[2])
+
+	case "groups":
+		groups, err := c.Groups(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(groups)
+
+	case "add-group":
+		if err := need(2); err != nil {
+			return err
+		}
+		return c.AddGroupMember(ctx, args[0], args[1])
+
+	case "delete-group":
+		if err := need(2); err != nil {
+			return err
+		}
+		return c.DeleteGroupMember(ctx, args[0], args[1])
+
+	case "promotions":
+		promotions, err := c.Promotions(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(promotions)
+
+	case "promote":
+		if len(args) < 3 || len(args) > 4 {
+			return fmt.Errorf("promote: expected INFOHASH|all DURATION [freeleech] [MULTIPLIER]")
+		}
+		promotion := client.Promotion{Upload_multiplier: 1}
+		if args[0] != "all" {
+			infoHash, err := decodeInfohash(args[0])
+			if err != nil {
+				return err
+			}
+			promotion.Info_hash = infoHash
+		}
+		duration, err := time.ParseDuration(args[1])
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("promote: invalid duration %q", args[1])
+		}
+		promotion.Start_time = time.Now()
+		promotion.End_time = promotion.Start_time.Add(duration)
+		for _, arg := range args[2:] {
+			if arg == "freeleech" {
+				promotion.Freeleech = true
+				continue
+			}
+			promotion.Upload_multiplier, err = strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return fmt.Errorf("promote: expected freeleech or a multiplier, got %q", arg)
+			}
+		}
+		added, err := c.AddPromotion(ctx, promotion)
+		if err != nil {
+			return err
+		}
+		return printJSON(added)
+
+	case "unpromote":
+		if err := need(1); err != nil {
+			return err
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("unpromote: invalid id %q", args[0])
+		}
+		return c.DeletePromotion(ctx, id)
+
+	case "tiers":
+		tiers, err := c.Tiers(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(tiers)
+
+	case "set-tier":
+		if len(args) < 2 || len(args) > 3 {
+			return fmt.Errorf("set-tier: expected USER TIER [DURATION]")
+		}
+		var expires *time.Time
+		if len(args) == 3 {
+			duration, err := time.ParseDuration(args[2])
+			if err != nil || duration <= 0 {
+				return fmt.Errorf("set-tier: invalid duration %q", args[2])
+			}
+			end := time.Now().Add(duration)
+			expires = &end
+		}
+		return c.SetTier(ctx, args[0], args[1], expires)
+
+	case "clear-tier":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.SetTier(ctx, args[0], "", nil)
+
+	case "features":
+		features, err := c.Features(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(features)
+
+	case "rotation":
+		status, err := c.Rotation(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(status)
+
+	case "start-rotation":
+		if err := need(1); err != nil {
+			return err
+		}
+		duration, err := time.ParseDuration(args[0])
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("start-rotation: invalid duration %q", args[0])
+		}
+		status, err := c.StartRotation(ctx, time.Now().Add(duration))
+		if err != nil {
+			return err
+		}
+		return printJSON(status)
+
+	case "cancel-rotation":
+		return c.CancelRotation(ctx)
+
+	case "invites":
+		invites, err := c.Invites(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(invites)
+
+	case "add-invite":
+		if len(args) > 1 {
+			return fmt.Errorf("add-invite: expected [NOTE]")
+		}
+		var note string
+		if len(args) > 0 {
+			note = args[0]
+		}
+		code, err := c.AddInvite(ctx, note)
+		if err != nil {
+			return err
+		}
+		fmt.Println(code)
+		return nil
+
+	case "delete-invite":
+		if err := need(1); err != nil {
+			return err
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("delete-invite: invalid id %q", args[0])
+		}
+		return c.DeleteInvite(ctx, id)
+
+	case "clientcerts":
+		certs, err := c.ClientCerts(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(certs)
+
+	case "add-clientcert":
+		if err := need(2); err != nil {
+			return err
+		}
+		certPEM, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		added, err := c.AddClientCert(ctx, args[0], certPEM)
+		if err != nil {
+			return err
+		}
+		return printJSON(added)
+
+	case "delete-clientcert":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.DeleteClientCert(ctx, args[0])
+
+	case "agents":
+		agents, err := c.Agents(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(agents)
+
+	case "add-agent":
+		if err := need(1); err != nil {
+			return err
+		}
+		key, err := c.AddAgent(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+
+	case "delete-agent":
+		if err := need(1); err != nil {
+			return err
+		}
+		return c.DeleteAgent(ctx, args[0])
+	}
+
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+func main() {
+	log.SetFlags(0)
+
+	baseURL := os.Getenv("ETRACKER_URL")
+	if baseURL == "" {
+		baseURL = defaultURL
+	}
+
+	flag.StringVar(&baseURL, "url", baseURL, "tracker URL")
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c := client.New(baseURL, client.WithAPIKey(os.Getenv("ETRACKER_AUTHORIZATION")))
+
+	if err := run(ctx, c, flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,216 @@
+// Package etracker is the stable API for embedding the tracker in other Go
+// programs, for example inside a seedbox manager:
+//
+//	tracker := etracker.New(etracker.Config{
+//		Storage:       etracker.NewStorage(dbpool, rdb),
+//		Authorization: "mysupersecretapikey",
+//	})
+//	err := tracker.Run(ctx)
+//
+// This package is a thin wrapper with no tracker logic of its own: announce,
+// scrape, bencode, and API handling live only in the internal packages, and
+// cmd/etracker is built from the same code path.
+//
+// Everything under internal/ may change without notice; the types and
+// functions in this package will not.
+package etracker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/server"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// Announce is a parsed client announce, as seen by an Algorithm.
+type Announce = config.Announce
+
+// Event is the optional event key of an announce.
+type Event = config.Event
+
+const (
+	Started   = config.Started
+	Stopped   = config.Stopped
+	Completed = config.Completed
+	Paused    = config.Paused
+)
+
+var ErrNoStorage = errors.New("etracker: no storage configured")
+
+// Storage provides the Postgres pool and Redis cache used by the tracker.
+// The tracker creates its tables in the pool on Run if they do not exist.
+type Storage interface {
+	Pool() *pgxpool.Pool
+	Cache() *redis.Client
+}
+
+type storage struct {
+	pool  *pgxpool.Pool
+	cache *redis.Client
+}
+
+func (s storage) Pool() *pgxpool.Pool  { return s.pool }
+func (s storage) Cache() *redis.Client { return s.cache }
+
+// NewStorage returns a Storage backed by an existing pool and client.
+func NewStorage(pool *pgxpool.Pool, cache *redis.Client) Storage {
+	return storage{pool: pool, cache: cache}
+}
+
+// Algorithm decides how many peers to return in reply to an announce. The
+// number returned should be at most a.Numwant.
+type Algorithm interface {
+	PeersToGive(ctx context.Context, s Storage, a *Announce) (int, error)
+}
+
+// AlgorithmFunc adapts an ordinary function to the Algorithm interface.
+type AlgorithmFunc func(ctx context.Context, s Storage, a *Announce) (int, error)
+
+func (f AlgorithmFunc) PeersToGive(ctx context.Context, s Storage, a *Announce) (int, error) {
+	return f(ctx, s, a)
+}
+
+// builtin adapts one of the tracker's own peering algorithms.
+func builtin(algorithm config.PeeringAlgorithm) Algorithm {
+	return AlgorithmFunc(func(ctx context.Context, s Storage, a *Announce) (int, error) {
+		return algorithm(ctx, config.New(config.WithStorage(s.Pool(), s.Cache())), a)
+	})
+}
+
+// The built-in peering algorithms. See the internal handler package for a
+// description of each.
+var (
+	PeersForRatio     = builtin(handler.PeersForRatio)
+	PeersForGoodSeeds = builtin(handler.PeersForGoodSeeds)
+	PeersForSeeds     = builtin(handler.PeersForSeeds)
+	PeersForAnnounces = builtin(handler.PeersForAnnounces)
+	DefaultAlgorithm  = builtin(handler.DefaultAlgorithm)
+)
+
+// Config configures an embedded tracker. Only Storage is required.
+type Config struct {
+	// Storage is the Postgres pool and Redis cache used by the tracker.
+	Storage Storage
+	// Algorithm defaults to DefaultAlgorithm.
+	Algorithm Algorithm
+	// Authorization is the API key for restricted endpoints. If empty,
+	// the restricted API is disabled.
+	Authorization string
+	// Addr is the address to listen on. Defaults to localhost on
+	// BackendPort.
+	Addr string
+	// BackendPort defaults to 3000.
+	BackendPort int
+	// DisableAllowlist tracks every infohash announced.
+	DisableAllowlist bool
+	// FrontendHostname is used for CORS headers on the frontend API.
+	FrontendHostname string
+	// PublicURL is the base of announce URLs given to users, such as
+	// https://tracker.example.com. Defaults to the host of each request.
+	PublicURL string
+	// FrontendPath is the directory the frontend is served from.
+	FrontendPath string
+	// NotFoundPage is a file in FrontendPath, such as 404.html, served
+	// as the body of 404 replies for missing assets.
+	NotFoundPage string
+	// PrivacySalt enables privacy mode, in which only salted hashes of
+	// peer IPs are stored in Postgres.
+	PrivacySalt string
+	// CertFile and KeyFile serve HTTPS instead of HTTP when both are set.
+	CertFile string
+	KeyFile  string
+}
+
+// Tracker is an embedded tracker instance.
+type Tracker struct {
+	cfg Config
+}
+
+// New returns a Tracker for the given configuration. Configuration errors
+// are reported by Run.
+func New(cfg Config) *Tracker {
+	return &Tracker{cfg: cfg}
+}
+
+// internalConfig converts the public configuration to the internal one.
+func (t *Tracker) internalConfig() config.Config {
+	algorithm := t.cfg.Algorithm
+	if algorithm == nil {
+		algorithm = DefaultAlgorithm
+	}
+	s := t.cfg.Storage
+
+	backendPort := t.cfg.BackendPort
+	if backendPort == 0 {
+		backendPort = config.DefaultBackendPort
+	}
+
+	frontendHostname := t.cfg.FrontendHostname
+	if frontendHostname == "" {
+		frontendHostname = config.DefaultFrontendHostname
+	}
+
+	return config.New(
+		config.WithAlgorithm(func(ctx context.Context, _ config.Config, a *config.Announce) (int, error) {
+			return algorithm.PeersToGive(ctx, s, a)
+		}),
+		config.WithAuthorization(t.cfg.Authorization),
+		config.WithStorage(s.Pool(), s.Cache()),
+		config.WithDisableAllowlist(t.cfg.DisableAllowlist),
+		config.WithBackendPort(backendPort),
+		config.WithFrontendHostname(frontendHostname),
+		config.WithPublicURL(t.cfg.PublicURL),
+		config.WithPrivacySalt(t.cfg.PrivacySalt),
+	)
+}
+
+// options converts the public configuration to server options.
+func (t *Tracker) options() []server.Option {
+	var opts []server.Option
+	if t.cfg.Addr != "" {
+		opts = append(opts, server.WithAddr(t.cfg.Addr))
+	}
+	if t.cfg.FrontendPath != "" {
+		opts = append(opts, server.WithFrontendPath(t.cfg.FrontendPath))
+	}
+	if t.cfg.NotFoundPage != "" {
+		opts = append(opts, server.WithNotFoundPage(t.cfg.NotFoundPage))
+	}
+	if t.cfg.CertFile != "" && t.cfg.KeyFile != "" {
+		opts = append(opts, server.WithTLS(config.TLSConfig{CertFile: t.cfg.CertFile, KeyFile: t.cfg.KeyFile}))
+	}
+	return opts
+}
+
+// Handler returns the tracker's routes without starting a listener or any
+// background jobs, so that they can be mounted on an existing http.Server.
+// The caller is responsible for ensuring the tables exist, for example by
+// calling Run once.
+func (t *Tracker) Handler(ctx context.Context) (http.Handler, error) {
+	if t.cfg.Storage == nil {
+		return nil, ErrNoStorage
+	}
+	return server.New(ctx, t.internalConfig(), append(t.options(), server.WithoutJobs())...).Handler(), nil
+}
+
+// Run initializes the database, then serves the tracker until the context is
+// cancelled or a fatal error occurs.
+func (t *Tracker) Run(ctx context.Context) error {
+	if t.cfg.Storage == nil {
+		return ErrNoStorage
+	}
+
+	err := db.DbInitialize(ctx, t.cfg.Storage.Pool())
+	if err != nil {
+		return err
+	}
+
+	return server.New(ctx, t.internalConfig(), t.options()...).Run(ctx)
+}
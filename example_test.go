@@ -0,0 +1,36 @@
+package etracker_test
+
+import (
+	"context"
+	"log"
+
+	"github.com/dmoerner/etracker"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+func Example() {
+	ctx := context.Background()
+
+	dbpool, err := pgxpool.New(ctx, "postgres://etracker@localhost/etracker")
+	if err != nil {
+		log.Fatal(err)
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+
+	// Give every peer exactly what it asks for.
+	numwant := etracker.AlgorithmFunc(func(ctx context.Context, s etracker.Storage, a *etracker.Announce) (int, error) {
+		return a.Numwant, nil
+	})
+
+	tracker := etracker.New(etracker.Config{
+		Storage:   etracker.NewStorage(dbpool, rdb),
+		Algorithm: numwant,
+		Addr:      "localhost:8080",
+	})
+
+	if err := tracker.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
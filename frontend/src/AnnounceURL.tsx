@@ -1,21 +1,132 @@
 import { useEffect, useState } from "react";
+import { Link } from 'react-router-dom';
 
-function keyToURL(key: string): string {
-  const url = window.location.href;
-  return url + key + '/announce';
+function announceURLEndpoint(key: string): URL {
+  const endpoint = new URL(window.location.origin + "/api/announceurl");
+  endpoint.searchParams.set('announce_key', key);
+  return endpoint;
+}
+
+function qrURL(key: string): string {
+  const endpoint = announceURLEndpoint(key);
+  endpoint.searchParams.set('qr', '1');
+  return endpoint.toString();
+}
+
+function leadingZeroBits(hash: Uint8Array): number {
+  let count = 0;
+  for (const b of hash) {
+    if (b !== 0) {
+      return count + Math.clz32(b) - 24;
+    }
+    count += 8;
+  }
+  return count;
+}
+
+// solveChallenge finds a nonce such that SHA-256 of "challenge:nonce" has at
+// least difficulty leading zero bits.
+async function solveChallenge(challenge: string, difficulty: number): Promise<string> {
+  const encoder = new TextEncoder();
+  for (let nonce = 0; ; nonce++) {
+    const data = encoder.encode(challenge + ':' + nonce);
+    const hash = new Uint8Array(await crypto.subtle.digest('SHA-256', data));
+    if (leadingZeroBits(hash) >= difficulty) {
+      return nonce.toString();
+    }
+  }
+}
+
+// generateURL builds the key generation request, solving a proof-of-work
+// challenge first if the tracker requires one.
+async function generateURL(): Promise<string> {
+  const generate = new URL(window.location.origin + "/api/generate");
+  const response = await fetch(window.location.origin + "/api/challenge");
+  if (response.ok) {
+    const challenge = await response.json();
+    const nonce = await solveChallenge(challenge.challenge, challenge.difficulty);
+    generate.searchParams.set('challenge', challenge.challenge);
+    generate.searchParams.set('nonce', nonce);
+  }
+  return generate.toString();
+}
+
+function profileEndpoint(key: string): URL {
+  const endpoint = new URL(window.location.origin + "/api/profile");
+  endpoint.searchParams.set('announce_key', key);
+  return endpoint;
+}
+
+// PublicProfile lets the owner of an announce key opt in to a public
+// profile, which is identified by a random id rather than the key.
+function PublicProfile({ announce }: { announce: string }) {
+  const [profileID, setProfileID] = useState<string | null>(null);
+
+  useEffect(() => {
+    const fetchSettings = async () => {
+      try {
+        const response = await fetch(profileEndpoint(announce));
+        if (!response.ok) {
+          return;
+        }
+        const settings = await response.json();
+        setProfileID(settings.profile_id);
+      } catch (error) {
+        console.error('Error fetching data:', error);
+      }
+    };
+
+    fetchSettings();
+  }, [announce]);
+
+  const handleToggle = async () => {
+    try {
+      const response = await fetch(profileEndpoint(announce), {
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ public: profileID === null }),
+      });
+      if (!response.ok) {
+        return;
+      }
+      const settings = await response.json();
+      setProfileID(settings.profile_id);
+    } catch (error) {
+      console.error('Error updating profile:', error);
+    }
+  };
+
+  return (
+    <p>
+      <label>
+        <input type="checkbox" checked={profileID !== null} onChange={handleToggle} /> Show a public profile of my seeding
+      </label>
+      {profileID && <> (<Link to={`/profiles/${profileID}`}>view</Link>)</>}
+    </p>
+  )
 }
 
 function AnnounceURL() {
 
   const [announce, setAnnounce] = useState(localStorage.getItem('announce') || '');
-  const announce_url = keyToURL(announce);
+  const [announce_url, setAnnounceURL] = useState('');
+  const [error, setError] = useState('');
 
   const handleGenerate = () => {
     const fetchData = async () => {
       try {
-        const response = await fetch(window.location.origin + "/api/generate");
+        const response = await fetch(await generateURL());
+        if (response.status === 429) {
+          setError('Too many announce URLs generated, please try again later.');
+          return;
+        }
         const key = await response.json();
+        if (!response.ok) {
+          setError(key.message);
+          return;
+        }
 
+        setError('');
         setAnnounce(key.announce_key)
       } catch (error) {
         console.error('Error fetching data:', error);
@@ -27,20 +138,46 @@ function AnnounceURL() {
 
   useEffect(() => {
     localStorage.setItem('announce', announce);
+    if (!announce) {
+      setAnnounceURL('');
+      return;
+    }
+
+    const fetchURL = async () => {
+      try {
+        const response = await fetch(announceURLEndpoint(announce));
+        const result = await response.json();
+        if (!response.ok) {
+          setError(result.message);
+          setAnnounceURL('');
+          return;
+        }
+        setAnnounceURL(result.announce_url);
+      } catch (error) {
+        console.error('Error fetching data:', error);
+      }
+    };
+
+    fetchURL();
   }, [announce])
 
   return (
     <>
       <h2>Announce URL</h2>
 
-      <p>Each user of etracker must use their own announce URL to allow the tracker to track statistics across sessions. To accurately report stats, do not merge this announce URL with other announce URLs in the same torrent in your client. Custom announce URLs generated below are pruned 3 months after creation or 3 months after the last announce, whichever is longer.</p>
+      <p>Each user of etracker must use their own announce URL to allow the tracker to track statistics across sessions. To accurately report stats, do not merge this announce URL with other announce URLs in the same torrent in your client. Custom announce URLs generated below are pruned 3 months after creation or 3 months after the last announce, whichever is longer. Announce URLs which are never used are pruned after a week.</p>
 
-      {announce ? (
-        <p>Your saved announce URL: <a href={announce_url}>{announce_url}</a></p>
+      {announce_url ? (
+        <>
+          <p>Your saved announce URL: <a href={announce_url}>{announce_url}</a></p>
+          <p><img src={qrURL(announce)} alt="QR code of your announce URL" width={256} height={256} /></p>
+          <PublicProfile announce={announce} />
+        </>
       ) : (
         <p>No announce URL saved</p>
       )}
       <button onClick={handleGenerate}>Generate New Announce URL</button>
+      {error && <p>{error}</p>}
     </>
   )
 }
@@ -4,12 +4,17 @@ import { useState, useEffect } from "react";
 type InfohashesData = {
   name: string,
   info_hash: string,
-  downloads: number,
+  downloaded: number,
   seeders: number,
   leechers: number,
+  category?: string,
+  tags?: string[],
+  info_hash_hex?: string,
+  magnet?: string,
 }
 
 // The infohash is marshalled into b64 JSON, but the GET endpoint expects hex.
+// It is also sent as hex, unless the tracker is in legacy mode.
 function b64ToHex(b64: string): string {
   const bin = atob(b64);
   let hex = '';
@@ -21,7 +26,6 @@ function b64ToHex(b64: string): string {
 }
 
 function DownloadTorrent({ infohash, name, announce }: { infohash: string, name: string, announce: string }) {
-  infohash = b64ToHex(infohash);
 
   const handleClick = async (infohash: string) => {
     const fetchTorrent = async () => {
@@ -64,7 +68,47 @@ function DownloadTorrent({ infohash, name, announce }: { infohash: string, name:
 
 }
 
-function Table({ data }: { data: InfohashesData[] }) {
+type TorrentFile = {
+  path: string,
+  length: number,
+}
+
+// Files lists the files of a torrent, fetched when first shown. Infohashes
+// added without a torrent file have none.
+function Files({ infohash }: { infohash: string }) {
+  const [files, setFiles] = useState<TorrentFile[] | null | undefined>(undefined);
+
+  const toggle = async () => {
+    if (files !== undefined) {
+      setFiles(undefined);
+      return;
+    }
+    try {
+      const response = await fetch(window.location.origin + `/api/torrentinfo?info_hash=${infohash}`);
+      setFiles(response.ok ? (await response.json()).files : null);
+    } catch (error) {
+      console.error('Error fetching torrent info:', error);
+    }
+  }
+
+  return (
+    <>
+      <button onClick={toggle}>Files</button>
+      {files === null && <div>No torrent file</div>}
+      {files && <ul>
+        {files.map(f => <li key={f.path}>{f.path} ({f.length} bytes)</li>)}
+      </ul>}
+    </>
+  )
+}
+
+type TableProps = {
+  data: InfohashesData[],
+  onCategory: (category: string) => void,
+  onTag: (tag: string) => void,
+}
+
+function Table({ data, onCategory, onTag }: TableProps) {
   const [announce, _] = useState(localStorage.getItem('announce') || '');
 
   return (
@@ -72,7 +116,7 @@ function Table({ data }: { data: InfohashesData[] }) {
       <thead>
         <tr>
           {announce && <th key="download">download</th>}
-          {data.length > 0 && Object.keys(data[0]).map(key => (
+          {["name", "downloaded", "seeders", "leechers", "category", "tags", "info_hash", "files"].map(key => (
             <th key={key}>{key}</th>
           ))}
         </tr>
@@ -80,10 +124,17 @@ function Table({ data }: { data: InfohashesData[] }) {
       <tbody>
         {data.length > 0 && data.map((row, index) => (
           <tr key={index}>
-            <td key={`${index}_button`}><DownloadTorrent infohash={row.info_hash} name={row.name} announce={announce} /></td>
-            {Object.values(row).map((value, index2) => (
-              <td key={index2}>{value}</td>
-            ))}
+            {announce && <td key={`${index}_button`}><DownloadTorrent infohash={row.info_hash_hex || b64ToHex(row.info_hash)} name={row.name} announce={announce} /></td>}
+            <td>{row.magnet ? <a href={row.magnet}>{row.name}</a> : row.name}</td>
+            <td>{row.downloaded}</td>
+            <td>{row.seeders}</td>
+            <td>{row.leechers}</td>
+            <td>{row.category && <a href="#" onClick={e => { e.preventDefault(); onCategory(row.category!); }}>{row.category}</a>}</td>
+            <td>{row.tags?.map(tag => (
+              <a key={tag} href="#" onClick={e => { e.preventDefault(); onTag(tag); }}>{tag} </a>
+            ))}</td>
+            <td>{row.info_hash_hex || b64ToHex(row.info_hash)}</td>
+            <td><Files infohash={row.info_hash_hex || b64ToHex(row.info_hash)} /></td>
           </tr>
         ))}
       </tbody>
@@ -91,31 +142,58 @@ function Table({ data }: { data: InfohashesData[] }) {
   )
 }
 
+const PAGE_SIZE = 50;
+
 function Infohashes() {
   const [data, setData] = useState<InfohashesData[] | undefined>(undefined);
+  const [name, setName] = useState('');
+  const [category, setCategory] = useState('');
+  const [tag, setTag] = useState('');
+  const [sort, setSort] = useState('name');
+  const [offset, setOffset] = useState(0);
+  const [total, setTotal] = useState(0);
 
   useEffect(() => {
     const fetchData = async () => {
       try {
-        const response = await fetch(window.location.origin + "/api/infohashes");
+        const params = new URLSearchParams({ name, category, sort, limit: `${PAGE_SIZE}`, offset: `${offset}` });
+        if (tag) {
+          params.append('tag', tag);
+        }
+        const response = await fetch(window.location.origin + `/api/infohashes?${params}`);
         console.log('fetch stats response', response);
         const stats = await response.json();
 
         setData(stats);
+        setTotal(Number(response.headers.get('X-Total-Count')) || 0);
       } catch (error) {
         console.error('Error fetching data:', error);
       }
     };
 
     fetchData();
-  }, []);
+  }, [name, category, tag, sort, offset]);
 
   return (
     <>
       <Header />
 
       <h2>Tracked Infohashes</h2>
-      {data && <Table data={data} />}
+      <input placeholder="Search" value={name} onChange={e => { setName(e.target.value); setOffset(0); }} />
+      <select value={sort} onChange={e => { setSort(e.target.value); setOffset(0); }}>
+        <option value="name">name</option>
+        <option value="seeders">seeders</option>
+        <option value="leechers">leechers</option>
+        <option value="downloaded">downloaded</option>
+      </select>
+      {category && <button onClick={() => { setCategory(''); setOffset(0); }}>category: {category} &times;</button>}
+      {tag && <button onClick={() => { setTag(''); setOffset(0); }}>tag: {tag} &times;</button>}
+      {data && <Table data={data}
+        onCategory={c => { setCategory(c); setOffset(0); }}
+        onTag={t => { setTag(t); setOffset(0); }} />}
+      <button disabled={offset === 0} onClick={() => setOffset(Math.max(offset - PAGE_SIZE, 0))}>Previous</button>
+      <span> {total > 0 ? `${offset + 1}-${Math.min(offset + PAGE_SIZE, total)} of ${total}` : 'No infohashes'} </span>
+      <button disabled={offset + PAGE_SIZE >= total} onClick={() => setOffset(offset + PAGE_SIZE)}>Next</button>
     </>
   )
 }
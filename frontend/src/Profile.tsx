@@ -0,0 +1,91 @@
+import Header from "./Header";
+import { useState, useEffect } from "react";
+import { useParams } from "react-router-dom";
+
+type ProfileData = {
+  profile_id: string,
+  since: string,
+  seeding: number,
+  snatched: number,
+  uploaded: number,
+  badges: string[],
+  achievements: { name: string, description: string, earned_time: string }[],
+  snatches: { name: string, info_hash: string, last_seeded: string }[],
+}
+
+function Profile() {
+  const { id } = useParams();
+  const [data, setData] = useState<ProfileData | undefined>(undefined);
+  const [error, setError] = useState('');
+
+  useEffect(() => {
+    const fetchData = async () => {
+      try {
+        const response = await fetch(window.location.origin + `/api/profiles/${encodeURIComponent(id || '')}`);
+        const profile = await response.json();
+        if (!response.ok) {
+          setError(profile.message);
+          return;
+        }
+
+        setData(profile);
+      } catch (error) {
+        console.error('Error fetching data:', error);
+      }
+    };
+
+    fetchData();
+  }, [id]);
+
+  return (
+    <>
+      <Header />
+
+      <h2>Profile {id}</h2>
+      {error && <p>{error}</p>}
+      {data && (
+        <>
+          <ul>
+            <li>Member since: {new Date(data.since).toLocaleDateString()}</li>
+            <li>Seeding: {data.seeding}</li>
+            <li>Snatched: {data.snatched}</li>
+            <li>Badges: {data.badges.length > 0 ? data.badges.join(', ') : 'none yet'}</li>
+          </ul>
+
+          {data.achievements.length > 0 && (
+            <>
+              <h3>Achievements</h3>
+              <ul>
+                {data.achievements.map(achievement => (
+                  <li key={achievement.name}>
+                    {achievement.name}: {achievement.description} ({new Date(achievement.earned_time).toLocaleDateString()})
+                  </li>
+                ))}
+              </ul>
+            </>
+          )}
+
+          <h3>Snatches</h3>
+          <table>
+            <thead>
+              <tr>
+                <th>name</th>
+                <th>last seeded</th>
+              </tr>
+            </thead>
+            <tbody>
+              {data.snatches.map(snatch => (
+                <tr key={snatch.info_hash}>
+                  <td>{snatch.name}</td>
+                  <td>{new Date(snatch.last_seeded).toLocaleDateString()}</td>
+                </tr>
+              ))}
+            </tbody>
+          </table>
+        </>
+      )}
+    </>
+  )
+}
+
+export default Profile;
@@ -0,0 +1,53 @@
+import Header from "./Header";
+import { useState } from "react";
+import { Link, useSearchParams } from "react-router-dom";
+
+// Rotate is the self-service rotation page linked from the warning sent to
+// announce keys which must be rotated. It replaces the key with a new one
+// and saves it, as the announce URL page does.
+function Rotate() {
+  const [searchParams] = useSearchParams();
+  const key = searchParams.get('announce_key') || '';
+  const [announce_url, setAnnounceURL] = useState('');
+  const [error, setError] = useState('');
+
+  const handleRotate = async () => {
+    try {
+      const rotate = new URL(window.location.origin + "/api/rotate");
+      rotate.searchParams.set('announce_key', key);
+      const response = await fetch(rotate, { method: 'POST' });
+      const result = await response.json();
+      if (!response.ok) {
+        setError(result.message);
+        return;
+      }
+      localStorage.setItem('announce', result.announce_key);
+
+      const endpoint = new URL(window.location.origin + "/api/announceurl");
+      endpoint.searchParams.set('announce_key', result.announce_key);
+      const url = await (await fetch(endpoint)).json();
+      setError('');
+      setAnnounceURL(url.announce_url);
+    } catch (error) {
+      console.error('Error rotating key:', error);
+    }
+  };
+
+  return (
+    <>
+      <Header />
+
+      <h2>Rotate Announce URL</h2>
+      <p>Your announce URL must be replaced with a new one. Your statistics carry over to the new announce URL, and the old one stops working immediately, so you must update every torrent in your client which uses it.</p>
+
+      {announce_url ? (
+        <p>Your new announce URL: <a href={announce_url}>{announce_url}</a> (<Link to="/">saved</Link>)</p>
+      ) : (
+        <button onClick={handleRotate} disabled={!key}>Rotate Announce URL</button>
+      )}
+      {error && <p>{error}</p>}
+    </>
+  )
+}
+
+export default Rotate;
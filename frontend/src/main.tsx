@@ -4,6 +4,8 @@ import { createBrowserRouter, RouterProvider } from "react-router-dom";
 import './index.css'
 import App from './App.tsx'
 import Infohashes from './Infohashes.tsx';
+import Profile from './Profile.tsx';
+import Rotate from './Rotate.tsx';
 
 const router = createBrowserRouter([
   {
@@ -14,6 +16,14 @@ const router = createBrowserRouter([
     path: "infohashes",
     element: <Infohashes />,
   },
+  {
+    path: "profiles/:id",
+    element: <Profile />,
+  },
+  {
+    path: "rotate",
+    element: <Rotate />,
+  },
 ]);
 
 createRoot(document.getElementById('root')!).render(
@@ -0,0 +1,155 @@
+// Package achievements awards achievements to announce keys. Each Rule is a
+// query for the keys which have earned it, evaluated by a background job, so
+// that the announce path only records the inputs to the rules. An
+// achievement once earned is kept, even if the key later falls below the
+// rule, and is erased with its key.
+package achievements
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+	"github.com/dmoerner/etracker/internal/handler"
+)
+
+// Interval is how often the rules are evaluated.
+const Interval = time.Hour
+
+// Names of the achievements.
+const (
+	DedicatedSeeder  = "dedicated seeder"
+	FirstSnatcher    = "first snatcher"
+	TerabyteUploader = "terabyte uploader"
+)
+
+const (
+	// DedicatedSeeds is the number of infohashes which must each have been
+	// seeded for DedicatedSeedDays to earn DedicatedSeeder.
+	DedicatedSeeds    = 10
+	DedicatedSeedDays = 30
+
+	// TerabyteUpload is the lifetime upload in bytes for TerabyteUploader.
+	TerabyteUpload int64 = 1 << 40
+)
+
+// Rule is an achievement and the query which finds the keys earning it.
+type Rule struct {
+	Name        string
+	Description string
+	// earners returns a query for the peers ids of the keys which have
+	// earned the achievement, and its arguments.
+	earners func(conf config.Config) (string, []any)
+}
+
+// Rules are the achievements which can be earned, in display order.
+var Rules = []Rule{
+	{
+		Name:        DedicatedSeeder,
+		Description: fmt.Sprintf("Seeded %d torrents for %d days", DedicatedSeeds, DedicatedSeedDays),
+		earners: func(conf config.Config) (string, []any) {
+			return `
+				WITH ` + db.RecentAnnounces(1, 2, "amount_left", "seeding_since") + `
+				SELECT
+				    peers_id
+				FROM
+				    recent_announces
+				WHERE
+				    amount_left = 0
+				    AND seeding_since <= $3
+				GROUP BY
+				    peers_id
+				HAVING
+				    COUNT(*) >= $4
+				`,
+				[]any{config.Stopped, conf.StaleCutoff(), conf.Now().AddDate(0, 0, -DedicatedSeedDays), DedicatedSeeds}
+		},
+	},
+	{
+		Name:        FirstSnatcher,
+		Description: "First to complete a torrent",
+		earners: func(conf config.Config) (string, []any) {
+			return `
+				SELECT DISTINCT
+				    first_snatcher
+				FROM
+				    infohashes
+				WHERE
+				    first_snatcher IS NOT NULL
+				`,
+				nil
+		},
+	},
+	{
+		Name:        TerabyteUploader,
+		Description: "Uploaded 1 TiB",
+		earners: func(conf config.Config) (string, []any) {
+			return `
+				SELECT
+				    id
+				FROM
+				    peers
+				WHERE
+				    uploaded >= $1
+				`,
+				[]any{TerabyteUpload}
+		},
+	},
+}
+
+// Run evaluates every rule once, and returns the number of achievements
+// newly earned for each rule which awarded any.
+func Run(ctx context.Context, conf config.Config) (map[string]int, error) {
+	awarded := make(map[string]int)
+	for _, rule := range Rules {
+		query, args := rule.earners(conf)
+		n := len(args)
+		tag, err := conf.Dbpool.Exec(ctx, fmt.Sprintf(`
+			INSERT INTO achievements (peers_id, achievement, earned_time)
+			SELECT
+			    earners.id,
+			    $%d,
+			    $%d
+			FROM (%s) AS earners (id)
+			ON CONFLICT (peers_id,
+			    achievement)
+			    DO NOTHING
+			`, n+1, n+2, query),
+			append(args, rule.Name, conf.Now())...)
+		if err != nil {
+			return nil, fmt.Errorf("error evaluating achievement %q: %w", rule.Name, err)
+		}
+		if earned := int(tag.RowsAffected()); earned > 0 {
+			awarded[rule.Name] = earned
+		}
+	}
+	return awarded, nil
+}
+
+// Job evaluates the rules at startup and then every Interval, skipping while
+// read-only. Failures are logged and retried on the next run.
+func Job(ctx context.Context, conf config.Config) error {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+
+	for {
+		if enabled, err := handler.ReadOnly(ctx, conf); err == nil && !enabled {
+			awarded, err := Run(ctx, conf)
+			if err != nil && ctx.Err() == nil {
+				log.Print(err)
+			}
+			for name, n := range awarded {
+				log.Printf("Achievement %q earned by %d announce keys", name, n)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
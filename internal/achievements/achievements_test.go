@@ -0,0 +1,64 @@
+package achievements
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	for _, key := range []string{testutils.AnnounceKeys[1], testutils.AnnounceKeys[2]} {
+		peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: key,
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Event:       config.Completed,
+		}))
+	}
+
+	_, err := conf.Dbpool.Exec(ctx, `
+		UPDATE peers
+		SET uploaded = $1
+		WHERE announce_key = $2
+		`,
+		TerabyteUpload, testutils.AnnounceKeys[3])
+	if err != nil {
+		t.Fatalf("error setting upload: %v", err)
+	}
+
+	awarded, err := Run(ctx, conf)
+	if err != nil {
+		t.Fatalf("error running rules: %v", err)
+	}
+	if awarded[FirstSnatcher] != 1 || awarded[TerabyteUploader] != 1 || len(awarded) != 2 {
+		t.Errorf("expected one first snatcher and one terabyte uploader, got %v", awarded)
+	}
+
+	var earned bool
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT EXISTS (
+		    SELECT FROM achievements
+		    JOIN peers ON achievements.peers_id = peers.id
+		    WHERE announce_key = $1 AND achievement = $2)
+		`,
+		testutils.AnnounceKeys[1], FirstSnatcher).Scan(&earned)
+	if err != nil {
+		t.Fatalf("error querying achievements: %v", err)
+	}
+	if !earned {
+		t.Errorf("expected the first key to complete to be the first snatcher")
+	}
+
+	// Achievements are only awarded once.
+	if awarded, err = Run(ctx, conf); err != nil || len(awarded) != 0 {
+		t.Errorf("expected nothing awarded again, got %v, %v", awarded, err)
+	}
+}
@@ -0,0 +1,249 @@
+// Package anomaly detects sharp changes in tracker traffic. Requests and
+// server errors are counted per endpoint over fixed windows, and compared to
+// a rolling baseline of previous windows. A scrape storm shows up as a
+// spike, and DNS or port breakage as a sudden drop. Changes in state are
+// reported through expvar and published on the event bus.
+package anomaly
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/events"
+)
+
+const (
+	// DefaultFactor is how many times above or below its baseline a window
+	// must be to be anomalous.
+	DefaultFactor = 5.0
+
+	// Warmup is the number of windows needed to establish a baseline
+	// before any alerts are raised.
+	Warmup = 10
+
+	// MinRequests is the number of requests below which a window is too
+	// quiet to judge. Spikes and error rates need this many requests in
+	// the window, and drops need this many in the baseline.
+	MinRequests = 10
+
+	// MinErrorRate is the error rate below which errors are never
+	// anomalous, however low the baseline.
+	MinErrorRate = 0.05
+
+	// Smoothing is the weight of each new window in the exponentially
+	// weighted baseline. Sustained changes in traffic are absorbed into
+	// the baseline after a few dozen windows.
+	Smoothing = 0.1
+)
+
+// Kind is the state of an endpoint. The zero value is normal.
+type Kind string
+
+const (
+	Normal Kind = ""
+	Spike  Kind = "spike"
+	Drop   Kind = "drop"
+	Errors Kind = "errors"
+)
+
+var (
+	baselines      = expvar.NewMap("anomaly_baseline")
+	errorBaselines = expvar.NewMap("anomaly_error_baseline")
+	alerts         = expvar.NewMap("anomaly_alerts")
+	active         = expvar.NewMap("anomaly_active")
+)
+
+// Alert is the Detail of the events.AnomalyAlert event published when an
+// endpoint becomes anomalous or recovers.
+type Alert struct {
+	Endpoint      string  `json:"endpoint"`
+	Status        string  `json:"status"`
+	Requests      int64   `json:"requests"`
+	Baseline      float64 `json:"baseline"`
+	ErrorRate     float64 `json:"error_rate"`
+	ErrorBaseline float64 `json:"error_baseline"`
+}
+
+type counts struct {
+	requests int64
+	errors   int64
+}
+
+type baseline struct {
+	requests  float64
+	errorRate float64
+	windows   int
+	state     Kind
+}
+
+// Detector counts requests per endpoint and compares each window to the
+// endpoint's baseline. It is safe for concurrent use.
+type Detector struct {
+	factor float64
+
+	mu        sync.Mutex
+	counts    map[string]*counts
+	baselines map[string]*baseline
+}
+
+// NewDetector returns a Detector which treats windows factor times above or
+// below the baseline as anomalous. A factor of at most one uses
+// DefaultFactor.
+func NewDetector(factor float64) *Detector {
+	if factor <= 1 {
+		factor = DefaultFactor
+	}
+	return &Detector{
+		factor:    factor,
+		counts:    make(map[string]*counts),
+		baselines: make(map[string]*baseline),
+	}
+}
+
+// Record counts a request to endpoint in the current window.
+func (d *Detector) Record(endpoint string, isError bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.counts[endpoint]
+	if !ok {
+		c = &counts{}
+		d.counts[endpoint] = c
+	}
+	c.requests++
+	if isError {
+		c.errors++
+	}
+}
+
+// classify returns the state of a window against its baseline.
+func (d *Detector) classify(c counts, b *baseline) Kind {
+	if b.windows < Warmup {
+		return Normal
+	}
+
+	var errorRate float64
+	if c.requests > 0 {
+		errorRate = float64(c.errors) / float64(c.requests)
+	}
+
+	switch {
+	case c.requests >= MinRequests && float64(c.requests) > d.factor*b.requests:
+		return Spike
+	case b.requests >= MinRequests && float64(c.requests) < b.requests/d.factor:
+		return Drop
+	case c.requests >= MinRequests && errorRate > max(d.factor*b.errorRate, MinErrorRate):
+		return Errors
+	}
+	return Normal
+}
+
+// Evaluate closes the current window, compares it to the baseline of each
+// endpoint, and folds it into the baseline. It returns an Alert for every
+// endpoint whose state changed, in order of endpoint.
+func (d *Detector) Evaluate() []Alert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Endpoints with a baseline but no requests in this window are
+	// evaluated too, since they may have dropped to nothing.
+	for endpoint := range d.counts {
+		if _, ok := d.baselines[endpoint]; !ok {
+			d.baselines[endpoint] = &baseline{}
+		}
+	}
+	endpoints := make([]string, 0, len(d.baselines))
+	for endpoint := range d.baselines {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	var changed []Alert
+	for _, endpoint := range endpoints {
+		b := d.baselines[endpoint]
+		var c counts
+		if window, ok := d.counts[endpoint]; ok {
+			c = *window
+		}
+
+		var errorRate float64
+		if c.requests > 0 {
+			errorRate = float64(c.errors) / float64(c.requests)
+		}
+
+		if state := d.classify(c, b); state != b.state {
+			a := Alert{
+				Endpoint:      endpoint,
+				Status:        string(state),
+				Requests:      c.requests,
+				Baseline:      b.requests,
+				ErrorRate:     errorRate,
+				ErrorBaseline: b.errorRate,
+			}
+			if state == Normal {
+				a.Status = "recovered"
+				active.Set(endpoint, new(expvar.Int))
+			} else {
+				alerts.Add(endpoint, 1)
+				one := new(expvar.Int)
+				one.Set(1)
+				active.Set(endpoint, one)
+			}
+			b.state = state
+			changed = append(changed, a)
+		}
+
+		if b.windows == 0 {
+			b.requests = float64(c.requests)
+			b.errorRate = errorRate
+		} else {
+			b.requests += Smoothing * (float64(c.requests) - b.requests)
+			b.errorRate += Smoothing * (errorRate - b.errorRate)
+		}
+		b.windows++
+
+		baselineVar, errorBaselineVar := new(expvar.Float), new(expvar.Float)
+		baselineVar.Set(b.requests)
+		errorBaselineVar.Set(b.errorRate)
+		baselines.Set(endpoint, baselineVar)
+		errorBaselines.Set(endpoint, errorBaselineVar)
+	}
+
+	clear(d.counts)
+
+	return changed
+}
+
+// Job returns a background job which evaluates the detector every
+// conf.AnomalyWindow. Whenever an endpoint becomes anomalous or recovers,
+// the Alert is logged, and published as events.AnomalyAlert, which the
+// server posts to conf.AnomalyWebhook if set.
+func (d *Detector) Job() func(ctx context.Context, conf config.Config) error {
+	return func(ctx context.Context, conf config.Config) error {
+		ticker := time.NewTicker(conf.AnomalyWindow)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+
+			for _, a := range d.Evaluate() {
+				if a.Status == "recovered" {
+					log.Printf("Traffic to %s recovered: %d requests, baseline %.1f", a.Endpoint, a.Requests, a.Baseline)
+				} else {
+					log.Printf("Traffic anomaly (%s) on %s: %d requests, baseline %.1f, error rate %.2f", a.Status, a.Endpoint, a.Requests, a.Baseline, a.ErrorRate)
+				}
+
+				conf.Publish(events.Event{Kind: events.AnomalyAlert, Detail: a})
+			}
+		}
+	}
+}
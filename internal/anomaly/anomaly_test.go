@@ -0,0 +1,109 @@
+package anomaly
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/events"
+)
+
+// window records requests to endpoint, of which errors fail, and evaluates
+// the detector.
+func window(d *Detector, endpoint string, requests, errors int) []Alert {
+	for i := range requests {
+		d.Record(endpoint, i < errors)
+	}
+	return d.Evaluate()
+}
+
+func TestEvaluate(t *testing.T) {
+	data := []struct {
+		name     string
+		requests int
+		errors   int
+		expected string
+	}{
+		{"spike", 600, 0, "spike"},
+		{"drop", 5, 0, "drop"},
+		{"errors", 100, 20, "errors"},
+		{"normal", 110, 1, ""},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			detector := NewDetector(DefaultFactor)
+			for range Warmup {
+				if changed := window(detector, "announce", 100, 1); len(changed) != 0 {
+					t.Fatalf("unexpected alert during warmup: %v", changed)
+				}
+			}
+
+			changed := window(detector, "announce", d.requests, d.errors)
+			if d.expected == "" {
+				if len(changed) != 0 {
+					t.Errorf("expected no alert, got %v", changed)
+				}
+				return
+			}
+			if len(changed) != 1 || changed[0].Status != d.expected || changed[0].Endpoint != "announce" {
+				t.Fatalf("expected %s alert, got %v", d.expected, changed)
+			}
+
+			changed = window(detector, "announce", 100, 1)
+			if len(changed) != 1 || changed[0].Status != "recovered" {
+				t.Errorf("expected recovery, got %v", changed)
+			}
+		})
+	}
+}
+
+func TestEvaluateSilentEndpoint(t *testing.T) {
+	detector := NewDetector(DefaultFactor)
+	for range Warmup {
+		window(detector, "scrape", 50, 0)
+	}
+
+	// An endpoint which stops receiving requests entirely is a drop.
+	changed := detector.Evaluate()
+	if len(changed) != 1 || changed[0].Status != "drop" || changed[0].Endpoint != "scrape" {
+		t.Errorf("expected drop alert, got %v", changed)
+	}
+}
+
+func TestJob(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bus := events.NewLocal(events.DefaultBuffer)
+	received := make(chan events.Event, 1)
+	bus.Subscribe(ctx, "alerts", func(_ context.Context, e events.Event) {
+		// Later windows are empty, and alert as drops.
+		select {
+		case received <- e:
+		default:
+		}
+	}, events.AnomalyAlert)
+
+	detector := NewDetector(DefaultFactor)
+	for range Warmup {
+		window(detector, "scrape", 50, 0)
+	}
+	for range 1000 {
+		detector.Record("scrape", false)
+	}
+
+	conf := config.Config{AnomalyWindow: time.Millisecond, Events: bus}
+	go detector.Job()(ctx, conf)
+
+	select {
+	case e := <-received:
+		a, ok := e.Detail.(Alert)
+		if !ok || a.Status != "spike" || a.Endpoint != "scrape" || a.Requests != 1000 {
+			t.Errorf("unexpected alert %+v", e.Detail)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for alert")
+	}
+}
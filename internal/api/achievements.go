@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/achievements"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+)
+
+// Achievement is an achievement rule, with when it was earned if it was
+// requested for an announce key which has earned it.
+type Achievement struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Earned_time *time.Time `json:"earned_time"`
+}
+
+// keyAchievements returns every achievement rule, in display order, with
+// the times at which the announce key whose column has the given value
+// earned them. The column is announce_key or profile_id.
+func keyAchievements(ctx context.Context, conf config.Config, column string, value string) ([]Achievement, error) {
+	rows, err := conf.Dbpool.Query(ctx, `
+		SELECT
+		    achievement,
+		    earned_time
+		FROM
+		    achievements
+		    JOIN peers ON achievements.peers_id = peers.id
+		WHERE
+		    peers.`+column+` = $1
+		`,
+		value)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	earned := make(map[string]time.Time)
+	for rows.Next() {
+		var name string
+		var t time.Time
+		if err := rows.Scan(&name, &t); err != nil {
+			return nil, err
+		}
+		earned[name] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	all := make([]Achievement, 0, len(achievements.Rules))
+	for _, rule := range achievements.Rules {
+		a := Achievement{Name: rule.Name, Description: rule.Description}
+		if t, ok := earned[rule.Name]; ok {
+			a.Earned_time = &t
+		}
+		all = append(all, a)
+	}
+	return all, nil
+}
+
+// AchievementsHandler takes a GET request with an optional announce_key
+// query field, and returns every achievement which can be earned. With an
+// announce key, each achievement the key has earned has its earned_time.
+// Achievements are awarded by the achievements job, so are not earned the
+// moment a rule is met.
+func AchievementsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		announce_key := r.URL.Query().Get("announce_key")
+		if announce_key != "" {
+			tracked, err := handler.KeyTracked(ctx, conf, announce_key)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+				return
+			}
+			if !tracked {
+				writeError(w, http.StatusNotFound, MessageJSON{"error: invalid announce key"})
+				return
+			}
+		}
+
+		all, err := keyAchievements(ctx, conf, "announce_key", announce_key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		response, err := json.Marshal(all)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
@@ -0,0 +1,351 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ACLEntry allows an announce key, or the announce keys of every user in a
+// group, to announce a restricted infohash, see handler.ValidateACL. An
+// infohash with at least one entry is restricted.
+type ACLEntry struct {
+	Info_hash    []byte    `json:"info_hash"`
+	Kind         string    `json:"kind"`
+	Value        string    `json:"value"`
+	Created_time time.Time `json:"created_time"`
+}
+
+// UserGroup is the membership of a user in a group.
+type UserGroup struct {
+	Username string `json:"username"`
+	Group    string `json:"group"`
+}
+
+// decodeACLEntry decodes and validates an ACLEntry request body.
+func decodeACLEntry(r *http.Request) (ACLEntry, error) {
+	var entry ACLEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil || len(entry.Info_hash) != 20 {
+		return entry, errors.New("did not receive valid acl entry")
+	}
+	if err := handler.ValidateACL(entry.Kind, entry.Value); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+// GetACLsHandler lists every ACL entry, grouped by infohash.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetACLsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT
+			    info_hash,
+			    kind,
+			    value,
+			    infohash_acls.created_time
+			FROM
+			    infohash_acls
+			    JOIN infohashes ON infohash_acls.info_hash_id = infohashes.id
+			ORDER BY
+			    info_hash,
+			    kind,
+			    value
+			`)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		entries, err := pgx.CollectRows(rows, pgx.RowToStructByPos[ACLEntry])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+		if entries == nil {
+			entries = []ACLEntry{}
+		}
+
+		response, err := json.Marshal(entries)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PostACLHandler takes a POST request with an ACLEntry body, and allows the
+// key or group to announce the infohash. Adding the first entry for an
+// infohash restricts it to that entry, so that other keys can no longer
+// announce it.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PostACLHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry, err := decodeACLEntry(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
+		entry.Created_time = conf.Now()
+
+		tag, err := conf.Dbpool.Exec(ctx, `
+			INSERT INTO infohash_acls (info_hash_id, kind, value, created_time)
+			SELECT
+			    id,
+			    $2,
+			    $3,
+			    $4
+			FROM
+			    infohashes
+			WHERE
+			    info_hash = $1
+			ON CONFLICT (info_hash_id, kind, value)
+			    DO NOTHING
+			`,
+			entry.Info_hash, entry.Kind, entry.Value, entry.Created_time)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not add acl entry"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			var exists bool
+			err = conf.Dbpool.QueryRow(ctx, `
+				SELECT EXISTS (SELECT FROM infohashes WHERE info_hash = $1)
+				`,
+				entry.Info_hash).Scan(&exists)
+			if err == nil && !exists {
+				writeError(w, http.StatusNotFound, MessageJSON{"error: unknown infohash"})
+				return
+			}
+		}
+
+		if err = handler.ACLsChanged(ctx, conf); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: added acl entry, but could not update cache"})
+			return
+		}
+
+		response, err := json.Marshal(entry)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success adding, but error making response"})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// DeleteACLHandler takes a DELETE request with a hex-encoded info_hash, kind,
+// and value as query fields, and removes that entry. Removing the last entry
+// for an infohash opens it to every key again.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func DeleteACLHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info_hash, err := hex.DecodeString(r.URL.Query().Get("info_hash"))
+		if err != nil || len(info_hash) != 20 {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid info_hash"})
+			return
+		}
+		entry := ACLEntry{Info_hash: info_hash, Kind: r.URL.Query().Get("kind"), Value: r.URL.Query().Get("value")}
+		if err = handler.ValidateACL(entry.Kind, entry.Value); err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
+
+		tag, err := conf.Dbpool.Exec(ctx, `
+			DELETE FROM infohash_acls
+			WHERE info_hash_id = (
+			        SELECT
+			            id
+			        FROM
+			            infohashes
+			        WHERE
+			            info_hash = $1)
+			    AND kind = $2
+			    AND value = $3
+			`,
+			entry.Info_hash, entry.Kind, entry.Value)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not delete acl entry"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: unknown acl entry"})
+			return
+		}
+
+		if err = handler.ACLsChanged(ctx, conf); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: deleted acl entry, but could not update cache"})
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// GetGroupsHandler lists the group memberships of every user.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetGroupsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT
+			    username,
+			    group_name
+			FROM
+			    user_groups
+			    JOIN users ON user_groups.users_id = users.id
+			ORDER BY
+			    group_name,
+			    username
+			`)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		groups, err := pgx.CollectRows(rows, pgx.RowToStructByPos[UserGroup])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+		if groups == nil {
+			groups = []UserGroup{}
+		}
+
+		response, err := json.Marshal(groups)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// validateUserGroup normalizes the username of a membership and validates
+// its group.
+func validateUserGroup(membership UserGroup) (UserGroup, error) {
+	username, err := normalizeUsername(membership.Username)
+	if err != nil {
+		return membership, err
+	}
+	membership.Username = username
+	if err = handler.ValidateACL(handler.ACLGroup, membership.Group); err != nil {
+		return membership, err
+	}
+	return membership, nil
+}
+
+// PostGroupHandler takes a POST request with a UserGroup body, and adds the
+// user to the group.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PostGroupHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var membership UserGroup
+		if err := json.NewDecoder(r.Body).Decode(&membership); err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid group membership"})
+			return
+		}
+		membership, err := validateUserGroup(membership)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
+
+		var users_id int
+		err = conf.Dbpool.QueryRow(ctx, `
+			SELECT id FROM users WHERE username = $1
+			`,
+			membership.Username).Scan(&users_id)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeError(w, http.StatusNotFound, MessageJSON{"error: unknown user"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		_, err = conf.Dbpool.Exec(ctx, `
+			INSERT INTO user_groups (users_id, group_name)
+			    VALUES ($1, $2)
+			ON CONFLICT (users_id, group_name)
+			    DO NOTHING
+			`,
+			users_id, membership.Group)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not add user to group"})
+			return
+		}
+
+		if err = handler.ACLsChanged(ctx, conf); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: added user to group, but could not update cache"})
+			return
+		}
+
+		response, err := json.Marshal(membership)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success adding, but error making response"})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// DeleteGroupHandler takes a DELETE request with username and group query
+// fields, and removes the user from the group.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func DeleteGroupHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		membership, err := validateUserGroup(UserGroup{Username: r.URL.Query().Get("username"), Group: r.URL.Query().Get("group")})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
+
+		tag, err := conf.Dbpool.Exec(ctx, `
+			DELETE FROM user_groups
+			WHERE users_id = (
+			        SELECT
+			            id
+			        FROM
+			            users
+			        WHERE
+			            username = $1)
+			    AND group_name = $2
+			`,
+			membership.Username, membership.Group)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not remove user from group"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: unknown group membership"})
+			return
+		}
+
+		if err = handler.ACLsChanged(ctx, conf); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: removed user from group, but could not update cache"})
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
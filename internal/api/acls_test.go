@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestACLs(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	mux := http.NewServeMux()
+	identity := func(h http.Handler) http.Handler { return h }
+	MuxAPIRoutes(ctx, conf, mux, identity, identity, identity)
+
+	request := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	restricted := func(key string) bool {
+		w := httptest.NewRecorder()
+		peerHandler(w, testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: key,
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+		}))
+		return strings.Contains(w.Body.String(), "restricted")
+	}
+
+	// alice owns a key, and is added to the staff group below.
+	w := request("POST", "http://example.com/api/user/register", "", `{"username": "alice", "password": "correct horse"}`)
+	var session UserSession
+	if err := json.NewDecoder(w.Body).Decode(&session); err != nil {
+		t.Fatalf("error decoding session: %v", err)
+	}
+	var key Key
+	if err := json.NewDecoder(request("GET", "http://example.com/api/generate", session.Token, "").Body).Decode(&key); err != nil {
+		t.Fatalf("error decoding key: %v", err)
+	}
+
+	if restricted(testutils.AnnounceKeys[1]) || restricted(key.Announce_key) {
+		t.Fatalf("expected announces to be allowed before acls")
+	}
+
+	info_hash := base64.StdEncoding.EncodeToString([]byte(testutils.AllowedInfoHashes["a"]))
+	entry := func(kind, value string) string {
+		return `{"info_hash": "` + info_hash + `", "kind": "` + kind + `", "value": "` + value + `"}`
+	}
+
+	if w := request("POST", "http://example.com/api/acls", "", entry(handler.ACLKey, testutils.AnnounceKeys[1])); w.Code != http.StatusCreated {
+		t.Fatalf("expected %d adding acl entry, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	if w := request("POST", "http://example.com/api/acls", "", entry(handler.ACLGroup, "staff")); w.Code != http.StatusCreated {
+		t.Fatalf("expected %d adding acl entry, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	if w := request("POST", "http://example.com/api/acls", "", entry("unknown", "staff")); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an invalid entry, got %d", http.StatusBadRequest, w.Code)
+	}
+	unknown := base64.StdEncoding.EncodeToString([]byte("zzzzzzzzzzzzzzzzzzzz"))
+	if w := request("POST", "http://example.com/api/acls", "", `{"info_hash": "`+unknown+`", "kind": "group", "value": "staff"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d for an unknown infohash, got %d", http.StatusNotFound, w.Code)
+	}
+
+	if restricted(testutils.AnnounceKeys[1]) {
+		t.Errorf("expected listed key to be allowed")
+	}
+	if !restricted(testutils.AnnounceKeys[2]) || !restricted(key.Announce_key) {
+		t.Errorf("expected unlisted keys to be refused")
+	}
+
+	// Torrent files are refused to unlisted keys, and the infohash is left
+	// out of public listings. No torrent file was uploaded, so the listed
+	// key gets as far as not finding one.
+	hex_hash := hex.EncodeToString([]byte(testutils.AllowedInfoHashes["a"]))
+	if w := request("GET", "http://example.com/api/torrentfile?announce_key="+testutils.AnnounceKeys[2]+"&info_hash="+hex_hash, "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected %d downloading restricted torrent file, got %d", http.StatusForbidden, w.Code)
+	}
+	if w := request("GET", "http://example.com/api/torrentfile?announce_key="+testutils.AnnounceKeys[1]+"&info_hash="+hex_hash, "", ""); w.Code == http.StatusForbidden {
+		t.Errorf("expected listed key to be allowed to download torrent file")
+	}
+	var listed []InfohashStats
+	if err := json.NewDecoder(request("GET", "http://example.com/api/infohashes", "", "").Body).Decode(&listed); err != nil {
+		t.Fatalf("error decoding infohashes: %v", err)
+	}
+	if len(listed) != len(testutils.AllowedInfoHashes)-1 {
+		t.Errorf("expected %d listed infohashes, got %d", len(testutils.AllowedInfoHashes)-1, len(listed))
+	}
+	for _, i := range listed {
+		if string(i.Info_hash) == testutils.AllowedInfoHashes["a"] {
+			t.Errorf("expected restricted infohash not to be listed")
+		}
+	}
+
+	if w := request("POST", "http://example.com/api/groups", "", `{"username": "Alice", "group": "staff"}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected %d adding group member, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	if w := request("POST", "http://example.com/api/groups", "", `{"username": "nobody", "group": "staff"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d for an unknown user, got %d", http.StatusNotFound, w.Code)
+	}
+	if restricted(key.Announce_key) {
+		t.Errorf("expected key of group member to be allowed")
+	}
+
+	var entries []ACLEntry
+	if err := json.NewDecoder(request("GET", "http://example.com/api/acls", "", "").Body).Decode(&entries); err != nil {
+		t.Fatalf("error decoding acls: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Kind != handler.ACLGroup || entries[1].Value != testutils.AnnounceKeys[1] {
+		t.Errorf("expected two acl entries, got %+v", entries)
+	}
+
+	if w := request("DELETE", "http://example.com/api/groups?username=alice&group=staff", "", ""); w.Code != http.StatusOK {
+		t.Errorf("expected %d removing group member, got %d", http.StatusOK, w.Code)
+	}
+	if !restricted(key.Announce_key) {
+		t.Errorf("expected key of former group member to be refused")
+	}
+
+	// Removing every entry opens the infohash again.
+	for _, query := range []string{"kind=key&value=" + testutils.AnnounceKeys[1], "kind=group&value=staff"} {
+		if w := request("DELETE", "http://example.com/api/acls?info_hash="+hex_hash+"&"+query, "", ""); w.Code != http.StatusOK {
+			t.Errorf("expected %d removing acl entry, got %d", http.StatusOK, w.Code)
+		}
+	}
+	if w := request("DELETE", "http://example.com/api/acls?info_hash="+hex_hash+"&kind=group&value=staff", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d removing unknown acl entry, got %d", http.StatusNotFound, w.Code)
+	}
+	if restricted(testutils.AnnounceKeys[2]) {
+		t.Errorf("expected infohash without acl entries to be open")
+	}
+}
@@ -0,0 +1,496 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/events"
+	"github.com/dmoerner/etracker/internal/handler"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// MaxReportPeers is the most peers a single agent report may describe.
+const MaxReportPeers = 1000
+
+const (
+	// MaxNewInfohashes is the most infohashes returned to an agent at once.
+	MaxNewInfohashes = 100
+	// AgentPollTimeout is how long a request for new infohashes waits for
+	// one to be added before returning none.
+	AgentPollTimeout = 30 * time.Second
+	// agentPollInterval is how often a waiting request checks for new
+	// infohashes, in case one was added through another tracker instance.
+	agentPollInterval = 5 * time.Second
+)
+
+// Agent is a trusted seedbox agent which reports peer health. The key itself
+// is only returned when the agent is added, as an AgentKey.
+type Agent struct {
+	Name         string     `json:"name"`
+	Created_time time.Time  `json:"created_time"`
+	Last_used    *time.Time `json:"last_used"`
+}
+
+type AgentKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// PeerHealth is what an agent observed about one peer in one swarm. Fields
+// the agent could not observe are left out and are not changed. Rates are
+// in bytes per second.
+type PeerHealth struct {
+	Info_hash     []byte `json:"info_hash"`
+	Ip            string `json:"ip"`
+	Port          int    `json:"port"`
+	Connectable   *bool  `json:"connectable,omitempty"`
+	Client        string `json:"client,omitempty"`
+	Upload_rate   *int64 `json:"upload_rate,omitempty"`
+	Download_rate *int64 `json:"download_rate,omitempty"`
+}
+
+type AgentReport struct {
+	Peers []PeerHealth `json:"peers"`
+}
+
+// NewInfohash is an infohash added to the tracker, for seedbox agents to
+// seed. Ids increase as infohashes are added. Torrent_file is whether its
+// torrent file can be fetched, see AgentTorrentFileHandler.
+type NewInfohash struct {
+	Id           int    `json:"id"`
+	Info_hash    []byte `json:"info_hash"`
+	Name         string `json:"name"`
+	Length       *int64 `json:"length"`
+	Torrent_file bool   `json:"torrent_file"`
+}
+
+// NewInfohashes are the infohashes added after an id. Last is the id to
+// wait after next.
+type NewInfohashes struct {
+	Last       int           `json:"last"`
+	Infohashes []NewInfohash `json:"infohashes"`
+}
+
+// AgentReportResult counts the reported peers which matched a current
+// announce. Reports about unknown peers are ignored.
+type AgentReportResult struct {
+	Updated int `json:"updated"`
+}
+
+// WithAgentAuthorization is middleware which rejects any request without a
+// valid agent key in the Authorization header, and records when each key
+// was last used.
+func WithAgentAuthorization(ctx context.Context, conf config.Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Authorization")
+			if key == "" {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: agent request with empty authorization header"})
+				return
+			}
+
+			var name string
+			err := conf.Dbpool.QueryRow(ctx, `
+				UPDATE agent_keys
+				SET last_used = $2
+				WHERE key_hash = $1
+				RETURNING name
+				`,
+				hashIndexerKey(key), conf.Now()).Scan(&name)
+			if err != nil {
+				if errors.Is(err, pgx.ErrNoRows) {
+					writeError(w, http.StatusForbidden, MessageJSON{"error: invalid agent key"})
+					return
+				}
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to validate agent key"})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AgentReportHandler takes a POST request with a JSON AgentReport from a
+// seedbox agent, and records the health of each reported peer on its
+// current announces for that infohash. Peers are matched by IP and port, as
+// stored at rest, so reports work in privacy mode as well. Peers reported
+// as not connectable are not given to other peers until the report is
+// stale, see handler.sendReply.
+//
+// This endpoint requires an agent key, see WithAgentAuthorization.
+func AgentReportHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var report AgentReport
+		err := json.NewDecoder(r.Body).Decode(&report)
+		if err != nil || len(report.Peers) == 0 {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid report"})
+			return
+		}
+		if len(report.Peers) > MaxReportPeers {
+			writeError(w, http.StatusBadRequest, MessageJSON{fmt.Sprintf("error: report has more than %d peers", MaxReportPeers)})
+			return
+		}
+
+		ip_ports := make([][]byte, len(report.Peers))
+		for i, p := range report.Peers {
+			if len(p.Info_hash) != 20 || p.Port <= 0 || p.Port > 65535 {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid peer"})
+				return
+			}
+			ip_ports[i], err = handler.IpPortAtRest(conf, p.Ip, p.Port)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid peer"})
+				return
+			}
+		}
+
+		tx, err := conf.Dbpool.Begin(ctx)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not record report"})
+			return
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
+
+		// cachedPeer is a peer to drop from the swarm cache once the report
+		// is committed.
+		type cachedPeer struct {
+			info_hash    []byte
+			announce_key string
+			peer_id      []byte
+			ip_port      []byte
+		}
+		var unconnectable []cachedPeer
+
+		// A report is not an announce, so last_announce is left alone, and
+		// a peer which stops announcing goes stale even while reported.
+		var result AgentReportResult
+		for i, p := range report.Peers {
+			rows, _ := tx.Query(ctx, `
+				UPDATE announces
+				SET
+				    connectable = COALESCE($3, connectable),
+				    agent_client = COALESCE(NULLIF($4, ''), agent_client),
+				    upload_rate = COALESCE($5, upload_rate),
+				    download_rate = COALESCE($6, download_rate),
+				    health_time = $7
+				FROM infohashes, peers
+				WHERE announces.info_hash_id = infohashes.id
+				    AND announces.peers_id = peers.id
+				    AND info_hash = $1
+				    AND ip_port = $2
+				RETURNING
+				    announce_key,
+				    peer_id
+				`,
+				p.Info_hash, ip_ports[i], p.Connectable, p.Client, p.Upload_rate, p.Download_rate, conf.Now())
+			updated, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (cachedPeer, error) {
+				peer := cachedPeer{info_hash: p.Info_hash, ip_port: ip_ports[i]}
+				err := row.Scan(&peer.announce_key, &peer.peer_id)
+				return peer, err
+			})
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not record report"})
+				return
+			}
+			if len(updated) > 0 {
+				result.Updated++
+			}
+			if p.Connectable != nil && !*p.Connectable {
+				unconnectable = append(unconnectable, updated...)
+			}
+		}
+
+		if err = tx.Commit(ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not record report"})
+			return
+		}
+
+		// Announces are answered from the swarm cache first, so peers which
+		// are not connectable must be dropped from it as well.
+		for _, peer := range unconnectable {
+			err = handler.DropCachedPeer(ctx, conf, peer.info_hash, peer.announce_key, peer.peer_id, peer.ip_port)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: recorded report, but could not update cache"})
+				return
+			}
+		}
+
+		response, err := json.Marshal(result)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success recording report, but error making response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// AgentInfohashesHandler takes a GET request with an optional after query
+// field, and returns the infohashes added after that id, oldest first. If
+// there are none, it waits up to AgentPollTimeout for one to be added, so
+// that an agent can long-poll by passing the Last id of each response to
+// the next request, and start seeding every new upload as soon as it is
+// added. Without after, it only waits for infohashes added from now on.
+//
+// This endpoint requires an agent key, see WithAgentAuthorization. It
+// must not be subject to a timeout shorter than AgentPollTimeout.
+func AgentInfohashesHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Subscribe before the first query, so that no infohash is added
+		// unnoticed in between.
+		added := make(chan struct{}, 1)
+		if conf.Events != nil {
+			subscription, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			conf.Events.Subscribe(subscription, "agents", func(_ context.Context, _ events.Event) {
+				select {
+				case added <- struct{}{}:
+				default:
+				}
+			}, events.InfohashAdded)
+		}
+
+		var result NewInfohashes
+		var err error
+		if afterString := r.URL.Query().Get("after"); afterString != "" {
+			result.Last, err = strconv.Atoi(afterString)
+			if err != nil || result.Last < 0 {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid after"})
+				return
+			}
+		} else {
+			err = conf.Dbpool.QueryRow(ctx, `
+				SELECT COALESCE(MAX(id), 0) FROM infohashes
+				`).Scan(&result.Last)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+				return
+			}
+		}
+
+		timeout := time.NewTimer(AgentPollTimeout)
+		defer timeout.Stop()
+		ticker := time.NewTicker(agentPollInterval)
+		defer ticker.Stop()
+
+	poll:
+		for {
+			rows, _ := conf.Dbpool.Query(ctx, `
+				SELECT
+				    id,
+				    info_hash,
+				    name,
+				    length,
+				    file IS NOT NULL AS torrent_file
+				FROM
+				    infohashes
+				WHERE
+				    id > $1
+				ORDER BY
+				    id
+				LIMIT $2
+				`,
+				result.Last, MaxNewInfohashes)
+			result.Infohashes, err = pgx.CollectRows(rows, pgx.RowToStructByName[NewInfohash])
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+				return
+			}
+			if len(result.Infohashes) > 0 {
+				result.Last = result.Infohashes[len(result.Infohashes)-1].Id
+				break
+			}
+
+			select {
+			case <-added:
+			case <-ticker.C:
+			case <-timeout.C:
+				result.Infohashes = []NewInfohash{}
+				break poll
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		response, err := json.Marshal(result)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// AgentTorrentFileHandler takes a GET request with a hex-encoded info_hash
+// query field, and returns its stored torrent file with the announce URL of
+// the agent's own announce key, so that the agent's seeding is credited to
+// it. The announce key is created the first time the agent fetches a
+// torrent file, and again if it has been deleted.
+//
+// This endpoint requires an agent key, see WithAgentAuthorization.
+func AgentTorrentFileHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key_hash := hashIndexerKey(r.Header.Get("Authorization"))
+
+		var announce_key *string
+		err := conf.Dbpool.QueryRow(ctx, `
+			SELECT
+			    peers.announce_key
+			FROM
+			    agent_keys
+			    LEFT JOIN peers ON peers.announce_key = agent_keys.announce_key
+			WHERE
+			    key_hash = $1
+			`,
+			key_hash).Scan(&announce_key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to fetch agent announce key"})
+			return
+		}
+
+		if announce_key == nil {
+			key, err := config.GenerateAnnounceKey(ctx, conf)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to generate agent announce key"})
+				return
+			}
+			// Agents are trusted, so their key needs no proof of work.
+			if err = handler.VerifyKey(ctx, conf, key); err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to generate agent announce key"})
+				return
+			}
+			_, err = conf.Dbpool.Exec(ctx, `
+				UPDATE agent_keys
+				SET announce_key = $2
+				WHERE key_hash = $1
+				`,
+				key_hash, key)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to record agent announce key"})
+				return
+			}
+			announce_key = &key
+		}
+
+		writeTorrentFile(ctx, conf, w, r, *announce_key, r.URL.Query().Get("info_hash"))
+	}
+}
+
+// GetAgentsHandler lists the seedbox agents which have keys.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetAgentsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT name, created_time, last_used
+			FROM agent_keys
+			ORDER BY name
+			`)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		agents, err := pgx.CollectRows(rows, pgx.RowToStructByName[Agent])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+		if agents == nil {
+			agents = []Agent{}
+		}
+
+		response, err := json.Marshal(agents)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PostAgentHandler takes a POST request with a JSON body naming a new
+// seedbox agent, and returns a new agent key for it. Only a hash of the key
+// is stored, so it cannot be shown again.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PostAgentHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var agent Agent
+		err := json.NewDecoder(r.Body).Decode(&agent)
+		if err != nil || agent.Name == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid agent name"})
+			return
+		}
+
+		randomBytes := make([]byte, IndexerKeyLength/2)
+		_, _ = rand.Read(randomBytes)
+		key := hex.EncodeToString(randomBytes)
+
+		_, err = conf.Dbpool.Exec(ctx, `
+			INSERT INTO agent_keys (name, key_hash, created_time)
+			    VALUES ($1, $2, $3)
+			`,
+			agent.Name, hashIndexerKey(key), conf.Now())
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: agent already exists"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error inserting agent"})
+			return
+		}
+
+		response, err := json.Marshal(AgentKey{Name: agent.Name, Key: key})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success adding agent, but error making response"})
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// DeleteAgentHandler takes a DELETE request with a name query field, and
+// revokes that agent's key. Health it already reported is kept.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func DeleteAgentHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: no agent name provided in query"})
+			return
+		}
+
+		tag, err := conf.Dbpool.Exec(ctx, `
+			DELETE FROM agent_keys
+			WHERE name = $1
+			`,
+			name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not delete agent"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: unknown agent"})
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
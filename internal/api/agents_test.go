@@ -0,0 +1,264 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/events"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+	bencode_go "github.com/jackpal/bencode-go"
+)
+
+func TestAgentReport(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.NumwantPeers, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	w := httptest.NewRecorder()
+	PostAgentHandler(ctx, conf)(w, httptest.NewRequest("POST", "http://example.com/api/agents", strings.NewReader(`{"name": "seedbox"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected %d adding agent, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	var key AgentKey
+	if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+		t.Fatalf("error decoding agent key: %v", err)
+	}
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	announce := func(announceKey string, host int) int {
+		w := httptest.NewRecorder()
+		peerHandler(w, testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: announceKey,
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			RemoteAddr:  testutils.IPv4Addr(0, host),
+			Port:        6881,
+			Numwant:     50,
+		}))
+		data, err := bencode_go.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("error decoding announce reply: %v", err)
+		}
+		return len(data.(map[string]any)["peers"].(string)) / 6
+	}
+
+	announce(testutils.AnnounceKeys[1], 1)
+	if n := announce(testutils.AnnounceKeys[2], 2); n != 1 {
+		t.Fatalf("expected 1 peer before report, got %d", n)
+	}
+
+	reportHandler := WithAgentAuthorization(ctx, conf)(http.HandlerFunc(AgentReportHandler(ctx, conf)))
+	report := func(key string, peers []PeerHealth) *httptest.ResponseRecorder {
+		body, err := json.Marshal(AgentReport{Peers: peers})
+		if err != nil {
+			t.Fatalf("error marshaling report: %v", err)
+		}
+		r := httptest.NewRequest("POST", "http://example.com/api/agents/report", bytes.NewReader(body))
+		r.Header.Set("Authorization", key)
+		w := httptest.NewRecorder()
+		reportHandler.ServeHTTP(w, r)
+		return w
+	}
+
+	notConnectable := false
+	rate := int64(1 << 20)
+	peers := []PeerHealth{
+		{Info_hash: []byte(testutils.AllowedInfoHashes["a"]), Ip: "10.0.0.1", Port: 6881, Connectable: &notConnectable, Client: "qBittorrent 5.0.0", Upload_rate: &rate},
+		{Info_hash: []byte(testutils.AllowedInfoHashes["a"]), Ip: "10.0.0.9", Port: 6881},
+	}
+
+	if w := report("wrong", peers); w.Code != http.StatusForbidden {
+		t.Errorf("expected %d with wrong key, got %d", http.StatusForbidden, w.Code)
+	}
+	if w := report(key.Key, []PeerHealth{{Info_hash: []byte("short"), Ip: "10.0.0.1", Port: 6881}}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d with invalid peer, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = report(key.Key, peers)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var result AgentReportResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("error decoding report result: %v", err)
+	}
+	if result.Updated != 1 {
+		t.Errorf("expected 1 peer updated, got %d", result.Updated)
+	}
+
+	var client string
+	var uploadRate int64
+	err := conf.Dbpool.QueryRow(ctx, `
+		SELECT agent_client, upload_rate FROM announces WHERE connectable IS FALSE
+		`).Scan(&client, &uploadRate)
+	if err != nil {
+		t.Fatalf("error querying db: %v", err)
+	}
+	if client != "qBittorrent 5.0.0" || uploadRate != rate {
+		t.Errorf("expected reported health to be stored, got %q and %d", client, uploadRate)
+	}
+
+	if n := announce(testutils.AnnounceKeys[2], 2); n != 0 {
+		t.Errorf("expected unconnectable peer to be left out, got %d peers", n)
+	}
+}
+
+func TestAgentReportStalePeer(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	w := httptest.NewRecorder()
+	PostAgentHandler(ctx, conf)(w, httptest.NewRequest("POST", "http://example.com/api/agents", strings.NewReader(`{"name": "seedbox"}`)))
+	var key AgentKey
+	if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+		t.Fatalf("error decoding agent key: %v", err)
+	}
+
+	handler.PeerHandler(ctx, conf)(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		RemoteAddr:  testutils.IPv4Addr(0, 1),
+		Port:        6881,
+	}))
+
+	// The peer stops announcing, but an agent still reports it.
+	_, err := conf.Dbpool.Exec(ctx, `
+		UPDATE announces SET last_announce = $1
+		`,
+		conf.StaleCutoff().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("error aging announce: %v", err)
+	}
+
+	connectable := true
+	body, err := json.Marshal(AgentReport{Peers: []PeerHealth{
+		{Info_hash: []byte(testutils.AllowedInfoHashes["a"]), Ip: "10.0.0.1", Port: 6881, Connectable: &connectable},
+	}})
+	if err != nil {
+		t.Fatalf("error marshaling report: %v", err)
+	}
+	r := httptest.NewRequest("POST", "http://example.com/api/agents/report", bytes.NewReader(body))
+	r.Header.Set("Authorization", key.Key)
+	w = httptest.NewRecorder()
+	WithAgentAuthorization(ctx, conf)(http.HandlerFunc(AgentReportHandler(ctx, conf))).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var stale bool
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT last_announce < $1 FROM announces WHERE connectable IS TRUE
+		`,
+		conf.StaleCutoff()).Scan(&stale)
+	if err != nil {
+		t.Fatalf("error querying db: %v", err)
+	}
+	if !stale {
+		t.Errorf("expected reported peer to stay stale")
+	}
+}
+
+func TestAgentInfohashes(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+	conf.Events = events.NewLocal(events.DefaultBuffer)
+
+	w := httptest.NewRecorder()
+	PostAgentHandler(ctx, conf)(w, httptest.NewRequest("POST", "http://example.com/api/agents", strings.NewReader(`{"name": "seedbox"}`)))
+	var key AgentKey
+	if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+		t.Fatalf("error decoding agent key: %v", err)
+	}
+
+	infohashesHandler := WithAgentAuthorization(ctx, conf)(http.HandlerFunc(AgentInfohashesHandler(ctx, conf)))
+	poll := func(after int) NewInfohashes {
+		r := httptest.NewRequest("GET", fmt.Sprintf("http://example.com/api/agents/infohashes?after=%d", after), nil)
+		r.Header.Set("Authorization", key.Key)
+		w := httptest.NewRecorder()
+		infohashesHandler.ServeHTTP(w, r)
+		var result NewInfohashes
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Errorf("error decoding new infohashes: %v", err)
+		}
+		return result
+	}
+
+	existing := poll(0)
+	if len(existing.Infohashes) != len(testutils.AllowedInfoHashes) {
+		t.Fatalf("expected %d existing infohashes, got %d", len(testutils.AllowedInfoHashes), len(existing.Infohashes))
+	}
+
+	polled := make(chan NewInfohashes)
+	go func() { polled <- poll(existing.Last) }()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	filePart, err := writer.CreateFormFile("file", "singlefile.txt.torrent")
+	if err != nil {
+		t.Fatalf("could not create multipart writer: %v", err)
+	}
+	torrent, err := os.ReadFile("./test_files/post/singlefile.txt.torrent")
+	if err != nil {
+		t.Fatalf("could not read torrent file: %v", err)
+	}
+	_, _ = filePart.Write(torrent)
+	_ = writer.Close()
+	r := httptest.NewRequest("POST", "http://example.com/api/torrentfile", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	w = httptest.NewRecorder()
+	PostTorrentFileHandler(ctx, conf)(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected %d uploading torrent file, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+
+	added := <-polled
+	if len(added.Infohashes) != 1 || !added.Infohashes[0].Torrent_file {
+		t.Fatalf("expected the uploaded infohash with its torrent file, got %v", added.Infohashes)
+	}
+	if added.Last != added.Infohashes[0].Id {
+		t.Errorf("expected last %d, got %d", added.Infohashes[0].Id, added.Last)
+	}
+
+	torrentHandler := WithAgentAuthorization(ctx, conf)(http.HandlerFunc(AgentTorrentFileHandler(ctx, conf)))
+	fetch := func() string {
+		r := httptest.NewRequest("GET", "http://example.com/api/agents/torrentfile?info_hash="+hex.EncodeToString(added.Infohashes[0].Info_hash), nil)
+		r.Header.Set("Authorization", key.Key)
+		w := httptest.NewRecorder()
+		torrentHandler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d fetching torrent file, got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+		data, err := bencode_go.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("error decoding torrent file: %v", err)
+		}
+		return data.(map[string]any)["announce"].(string)
+	}
+
+	var announceKey string
+	first := fetch()
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT announce_key FROM agent_keys WHERE name = 'seedbox'
+		`).Scan(&announceKey)
+	if err != nil {
+		t.Fatalf("error querying agent announce key: %v", err)
+	}
+	if !strings.Contains(first, announceKey) {
+		t.Errorf("expected announce URL with agent announce key %s, got %s", announceKey, first)
+	}
+	if second := fetch(); second != first {
+		t.Errorf("expected the same announce URL on every fetch, got %s and %s", first, second)
+	}
+}
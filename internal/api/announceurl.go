@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	DefaultQRSize = 256
+	MaxQRSize     = 1024
+)
+
+type AnnounceURL struct {
+	Announce_url string `json:"announce_url"`
+}
+
+// announceURL builds the complete announce URL for a key. It is based on the
+// configured PublicURL, or else on the host the request was made to.
+func announceURL(conf config.Config, r *http.Request, announce_key string) string {
+	base, err := url.Parse(conf.PublicURL)
+	if conf.PublicURL == "" || err != nil {
+		base = &url.URL{
+			Scheme: "http",
+			Host:   r.Host,
+		}
+		if r.TLS != nil {
+			base.Scheme = "https"
+		}
+	}
+
+	return base.JoinPath(announce_key, "announce").String()
+}
+
+// announceList builds the BEP 12 announce-list for a key: a tier with the
+// announce URL, see announceURL, followed by a tier for each of the
+// configured BackupURLs, which clients only try if the tiers before fail.
+// It is nil if there are no BackupURLs.
+func announceList(conf config.Config, r *http.Request, announce_key string) [][]string {
+	if len(conf.BackupURLs) == 0 {
+		return nil
+	}
+	tiers := [][]string{{announceURL(conf, r, announce_key)}}
+	for _, backup := range conf.BackupURLs {
+		base, err := url.Parse(backup)
+		if err != nil {
+			continue
+		}
+		tiers = append(tiers, []string{base.JoinPath(announce_key, "announce").String()})
+	}
+	return tiers
+}
+
+// AnnounceURLHandler takes a GET request with an announce_key query field,
+// and returns the complete announce URL for the key, ready to paste into a
+// client. If the qr query field is set, it instead returns the URL as a QR
+// code PNG, for configuring clients on mobile devices. The size query field
+// sets the width of the PNG in pixels.
+func AnnounceURLHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		announce_key := query.Get("announce_key")
+		if announce_key == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: no announce key provided in query"})
+			return
+		}
+
+		tracked, err := handler.KeyTracked(ctx, conf, announce_key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to validate announce key"})
+			log.Print(err)
+			return
+		}
+		if !tracked {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid announce key"})
+			return
+		}
+
+		announce_url := announceURL(conf, r, announce_key)
+
+		if query.Get("qr") == "" {
+			result, err := json.Marshal(AnnounceURL{Announce_url: announce_url})
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+				return
+			}
+			fmt.Fprintf(w, "%s", result)
+			return
+		}
+
+		size := DefaultQRSize
+		if sizeString := query.Get("size"); sizeString != "" {
+			size, err = strconv.Atoi(sizeString)
+			if err != nil || size <= 0 || size > MaxQRSize {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid size"})
+				return
+			}
+		}
+
+		png, err := qrcode.Encode(announce_url, qrcode.Medium, size)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to generate QR code"})
+			log.Print(err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(png)
+	}
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/google/go-cmp/cmp"
+	bencode "github.com/jackpal/bencode-go"
+)
+
+func TestAnnounceList(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://tracker.example.com/api/torrentfile", nil)
+
+	if tiers := announceList(config.Config{}, r, "key"); tiers != nil {
+		t.Errorf("expected no announce-list without backup URLs, got %v", tiers)
+	}
+
+	conf := config.Config{
+		PublicURL:  "https://tracker.example.com",
+		BackupURLs: []string{"udp://tracker.example.com:6969", "http://backup.example.com/tracker"},
+	}
+	tiers := announceList(conf, r, "key")
+	expected := [][]string{
+		{"https://tracker.example.com/key/announce"},
+		{"udp://tracker.example.com:6969/key/announce"},
+		{"http://backup.example.com/tracker/key/announce"},
+	}
+	if diff := cmp.Diff(expected, tiers); diff != "" {
+		t.Errorf("unexpected announce-list (-expected +received):\n%s", diff)
+	}
+
+	var b bytes.Buffer
+	if err := bencode.Marshal(&b, map[string]any{"announce-list": tiers[:2]}); err != nil {
+		t.Fatalf("could not encode announce-list: %v", err)
+	}
+	encoded := "d13:announce-listll40:https://tracker.example.com/key/announceel43:udp://tracker.example.com:6969/key/announceeee"
+	if b.String() != encoded {
+		t.Errorf("expected %q, got %q", encoded, b.String())
+	}
+}
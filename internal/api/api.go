@@ -3,17 +3,26 @@ package api
 import (
 	"bytes"
 	"context"
-	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+	"github.com/dmoerner/etracker/internal/events"
+	"github.com/dmoerner/etracker/internal/handler"
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
@@ -21,10 +30,30 @@ import (
 	bencode "github.com/jackpal/bencode-go"
 )
 
+// GlobalStats and the other stats count BEP 21 partial seeds, see
+// db.PartialSeed, apart from leechers.
 type GlobalStats struct {
-	Hashcount int `json:"hashcount"`
-	Seeders   int `json:"seeders"`
-	Leechers  int `json:"leechers"`
+	Hashcount      int `json:"hashcount"`
+	Seeders        int `json:"seeders"`
+	Leechers       int `json:"leechers"`
+	PartialSeeders int `json:"partial_seeders" db:"partial_seeders"`
+}
+
+type CountryStats struct {
+	Country        string `json:"country"`
+	Swarms         int    `json:"swarms"`
+	Seeders        int    `json:"seeders"`
+	Leechers       int    `json:"leechers"`
+	PartialSeeders int    `json:"partial_seeders" db:"partial_seeders"`
+}
+
+type AsnStats struct {
+	Asn            int    `json:"asn"`
+	Asn_org        string `json:"asn_org"`
+	Swarms         int    `json:"swarms"`
+	Seeders        int    `json:"seeders"`
+	Leechers       int    `json:"leechers"`
+	PartialSeeders int    `json:"partial_seeders" db:"partial_seeders"`
 }
 
 type Key struct {
@@ -36,16 +65,74 @@ type Infohash struct {
 }
 
 type InfohashPost struct {
-	Info_hash []byte `json:"info_hash"`
-	Name      string `json:"name"`
+	Info_hash []byte   `json:"info_hash"`
+	Name      string   `json:"name"`
+	Category  string   `json:"category,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// InfohashMerge names a deprecated infohash to be merged into a canonical
+// infohash for the same content.
+type InfohashMerge struct {
+	Deprecated []byte `json:"deprecated"`
+	Canonical  []byte `json:"canonical"`
 }
 
 type InfohashStats struct {
-	Name       string `json:"name"`
-	Downloaded int    `json:"downloaded"`
-	Seeders    int    `json:"seeders"`
-	Leechers   int    `json:"leechers"`
-	Info_hash  []byte `json:"info_hash"`
+	Name           string   `json:"name"`
+	Downloaded     int      `json:"downloaded"`
+	Seeders        int      `json:"seeders"`
+	Leechers       int      `json:"leechers"`
+	PartialSeeders int      `json:"partial_seeders" db:"partial_seeders"`
+	Info_hash      []byte   `json:"info_hash"`
+	Category       string   `json:"category,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+
+	// Info_hash_hex and Magnet are left out if conf.LegacyInfohashes is
+	// set. The magnet link has no tracker, since announce URLs are
+	// personal.
+	Info_hash_hex string `json:"info_hash_hex,omitempty" db:"-"`
+	Magnet        string `json:"magnet,omitempty" db:"-"`
+}
+
+type DailyAnnounces struct {
+	Day       time.Time `json:"day"`
+	Announces int       `json:"announces"`
+}
+
+type KeyUsage struct {
+	Announce_key     string           `json:"announce_key"`
+	Distinct_ips     int              `json:"distinct_ips"`
+	Distinct_clients int              `json:"distinct_clients"`
+	Distinct_peers   int              `json:"distinct_peers"`
+	Ip_changes       int              `json:"ip_changes"`
+	First_activity   *time.Time       `json:"first_activity"`
+	Last_activity    *time.Time       `json:"last_activity"`
+	Daily            []DailyAnnounces `json:"daily"`
+}
+
+type WantedInfohash struct {
+	Info_hash  []byte    `json:"info_hash"`
+	Requests   int       `json:"requests"`
+	First_seen time.Time `json:"first_seen"`
+	Last_seen  time.Time `json:"last_seen"`
+}
+
+type MaintenanceStatus struct {
+	Enabled       bool `json:"enabled"`
+	Retry_seconds int  `json:"retry_seconds"`
+}
+
+type ReadOnlyStatus struct {
+	Enabled  bool  `json:"enabled"`
+	Buffered int64 `json:"buffered"`
+}
+
+// AlgorithmStatus is the current peering algorithm, with the names of every
+// algorithm it can be switched to.
+type AlgorithmStatus struct {
+	Algorithm string   `json:"algorithm"`
+	Available []string `json:"available,omitempty"`
 }
 
 type MessageJSON struct {
@@ -63,12 +150,35 @@ func enableCors(conf config.Config, w *http.ResponseWriter, _ *http.Request) {
 	// allowed := []string{conf.FrontendHostname}
 	// origin := r.Header.Get("Origin")
 	(*w).Header().Set("Access-Control-Allow-Origin", conf.FrontendHostname)
-	(*w).Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	(*w).Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT")
 	(*w).Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 }
 
-// validateAPIKey is a helper function which should be used at the start of any restricted
-// API paths.
+// WithCors is middleware which sets the CORS headers for the frontend API.
+func WithCors(conf config.Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			enableCors(conf, &w, r)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WithAuthorization is middleware which rejects any request without a valid
+// API key. It wraps all restricted API paths.
+func WithAuthorization(conf config.Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !validateAPIKey(conf, w, r) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// validateAPIKey is a helper function used by WithAuthorization to check the
+// Authorization header of restricted API requests.
 func validateAPIKey(conf config.Config, w http.ResponseWriter, r *http.Request) bool {
 	// The API key must be set in the configuration.
 	if conf.Authorization == "" {
@@ -91,41 +201,143 @@ func validateAPIKey(conf config.Config, w http.ResponseWriter, r *http.Request)
 	return true
 }
 
-// MuxAPIRoutes adds all the REST API routes to a mux.
-func MuxAPIRoutes(ctx context.Context, conf config.Config, mux *http.ServeMux) {
-	mux.HandleFunc("GET /api/stats", StatsHandler(ctx, conf))
-	mux.HandleFunc("GET /api/generate", GenerateHandler(ctx, conf))
-	mux.HandleFunc("GET /api/infohashes", InfohashesHandler(ctx, conf))
-	mux.HandleFunc("POST /api/infohash", PostInfohashHandler(ctx, conf))
-	mux.HandleFunc("POST /api/torrentfile", PostTorrentFileHandler(ctx, conf))
-	mux.HandleFunc("GET /api/torrentfile", GetTorrentFileHandler(ctx, conf))
-	mux.HandleFunc("DELETE /api/infohash", DeleteInfohashHandler(ctx, conf))
+// MuxAPIRoutes adds all the REST API routes to a mux. Public routes are
+// wrapped with the frontend middleware, and restricted routes with the admin
+// middleware. Restricted routes always require authorization, regardless of
+// the admin middleware passed in, and user routes a session token.
+// Long-polling routes are wrapped with the longpoll middleware, which must
+// not time out before AgentPollTimeout.
+func MuxAPIRoutes(ctx context.Context, conf config.Config, mux *http.ServeMux, frontend, admin, longpoll func(http.Handler) http.Handler) {
+	public := func(h http.HandlerFunc) http.Handler {
+		return frontend(h)
+	}
+	restricted := func(h http.HandlerFunc) http.Handler {
+		return admin(WithAuthorization(conf)(h))
+	}
+	user := func(h http.HandlerFunc) http.Handler {
+		return frontend(WithUserAuthorization(ctx, conf)(h))
+	}
+
+	mux.Handle("GET /api/stats", public(StatsHandler(ctx, conf)))
+	mux.Handle("GET /api/features", public(FeaturesHandler(conf)))
+	mux.Handle("GET /api/stats/countries", public(CountryStatsHandler(ctx, conf)))
+	mux.Handle("GET /api/stats/asns", public(AsnStatsHandler(ctx, conf)))
+	mux.Handle("GET /api/stats/history", public(StatsHistoryHandler(ctx, conf)))
+	mux.Handle("GET /api/generate", public(GenerateHandler(ctx, conf)))
+	mux.Handle("GET /api/challenge", public(ChallengeHandler(ctx, conf)))
+	mux.Handle("POST /api/verify", public(VerifyKeyHandler(ctx, conf)))
+	mux.Handle("GET /api/infohashes", public(InfohashesHandler(ctx, conf)))
+	mux.Handle("GET /api/torrentfile", public(GetTorrentFileHandler(ctx, conf)))
+	mux.Handle("GET /api/torrentinfo", public(TorrentInfoHandler(ctx, conf)))
+	mux.Handle("GET /api/announceurl", public(AnnounceURLHandler(ctx, conf)))
+	mux.Handle("GET /api/profile", public(ProfileHandler(ctx, conf)))
+	mux.Handle("PUT /api/profile", public(PutProfileHandler(ctx, conf)))
+	mux.Handle("GET /api/profiles/{id}", public(PublicProfileHandler(ctx, conf)))
+	mux.Handle("GET /api/achievements", public(AchievementsHandler(ctx, conf)))
+	mux.Handle("POST /api/rotate", public(RotateKeyHandler(ctx, conf)))
+	mux.Handle("POST /api/tiers/webhook", public(TierWebhookHandler(ctx, conf)))
+	mux.Handle("POST /api/user/register", public(RegisterHandler(ctx, conf)))
+	mux.Handle("POST /api/user/login", public(LoginHandler(ctx, conf)))
+	mux.Handle("POST /api/user/logout", user(LogoutHandler(ctx, conf)))
+	mux.Handle("GET /api/user/stats", user(UserStatsHandler(ctx, conf)))
+	mux.Handle("GET /api/user/traffic", user(UserTrafficHandler(ctx, conf)))
+	mux.Handle("POST /api/user/passkeys/options", user(PasskeyCreationOptionsHandler(ctx, conf)))
+	mux.Handle("POST /api/user/passkeys", user(RegisterPasskeyHandler(ctx, conf)))
+	mux.Handle("GET /api/user/passkeys", user(PasskeysHandler(ctx, conf)))
+	mux.Handle("DELETE /api/user/passkeys/{id}", user(DeletePasskeyHandler(ctx, conf)))
+	mux.Handle("POST /api/user/login/passkey/options", public(PasskeyRequestOptionsHandler(ctx, conf)))
+	mux.Handle("POST /api/user/login/passkey", public(PasskeyLoginHandler(ctx, conf)))
+	provider := NewOIDCProvider(conf)
+	mux.Handle("GET /api/user/oidc/login", public(OIDCLoginHandler(ctx, conf, provider)))
+	mux.Handle("GET /api/user/oidc/callback", public(OIDCCallbackHandler(ctx, conf, provider)))
+	mux.Handle("POST /api/infohash", restricted(PostInfohashHandler(ctx, conf)))
+	mux.Handle("POST /api/torrentfile", restricted(PostTorrentFileHandler(ctx, conf)))
+	mux.Handle("DELETE /api/infohash", restricted(DeleteInfohashHandler(ctx, conf)))
+	mux.Handle("POST /api/infohash/merge", restricted(MergeInfohashHandler(ctx, conf)))
+	mux.Handle("POST /api/infohash/retire", restricted(RetireInfohashHandler(ctx, conf)))
+	mux.Handle("POST /api/infohash/restore", restricted(RestoreInfohashHandler(ctx, conf)))
+	mux.Handle("POST /api/infohashes/bulk", restricted(BulkInfohashesHandler(ctx, conf)))
+	mux.Handle("GET /api/infohashes/export", restricted(ExportInfohashesHandler(ctx, conf)))
+	mux.Handle("GET /api/infohash/{hex}/snatches", restricted(SnatchesHandler(ctx, conf)))
+	mux.Handle("GET /api/keyusage", restricted(KeyUsageHandler(ctx, conf)))
+	mux.Handle("DELETE /api/peerdata", restricted(ErasePeerDataHandler(ctx, conf)))
+	mux.Handle("GET /api/keys", restricted(GetKeysHandler(ctx, conf)))
+	mux.Handle("DELETE /api/keys/{key}", restricted(DeleteKeyHandler(ctx, conf)))
+	mux.Handle("GET /api/keys/{key}/stats", restricted(KeyStatsHandler(ctx, conf)))
+	mux.Handle("GET /api/wanted", restricted(WantedHandler(ctx, conf)))
+	mux.Handle("GET /api/algorithm", restricted(GetAlgorithmHandler(conf)))
+	mux.Handle("POST /api/algorithm", restricted(PostAlgorithmHandler(conf)))
+	mux.Handle("GET /api/maintenance", restricted(GetMaintenanceHandler(ctx, conf)))
+	mux.Handle("PUT /api/maintenance", restricted(PutMaintenanceHandler(ctx, conf)))
+	mux.Handle("GET /api/readonly", restricted(GetReadOnlyHandler(ctx, conf)))
+	mux.Handle("PUT /api/readonly", restricted(PutReadOnlyHandler(ctx, conf)))
+	mux.Handle("GET /api/debug/recent", restricted(RecentAnnouncesHandler(conf)))
+	mux.Handle("GET /api/debug/runtime", restricted(RuntimeHandler(ctx, conf)))
+	mux.Handle("GET /api/catalog/publickey", public(CatalogPublicKeyHandler(conf)))
+	mux.Handle("GET /api/indexers", restricted(GetIndexersHandler(ctx, conf)))
+	mux.Handle("POST /api/indexers", restricted(PostIndexerHandler(ctx, conf)))
+	mux.Handle("DELETE /api/indexers", restricted(DeleteIndexerHandler(ctx, conf)))
+	mux.Handle("GET /api/bans", restricted(GetBansHandler(ctx, conf)))
+	mux.Handle("POST /api/bans", restricted(PostBansHandler(ctx, conf)))
+	mux.Handle("DELETE /api/bans", restricted(DeleteBanHandler(ctx, conf)))
+	mux.Handle("GET /api/acls", restricted(GetACLsHandler(ctx, conf)))
+	mux.Handle("POST /api/acls", restricted(PostACLHandler(ctx, conf)))
+	mux.Handle("DELETE /api/acls", restricted(DeleteACLHandler(ctx, conf)))
+	mux.Handle("GET /api/groups", restricted(GetGroupsHandler(ctx, conf)))
+	mux.Handle("POST /api/groups", restricted(PostGroupHandler(ctx, conf)))
+	mux.Handle("DELETE /api/groups", restricted(DeleteGroupHandler(ctx, conf)))
+	mux.Handle("GET /api/tiers", restricted(GetTiersHandler(ctx, conf)))
+	mux.Handle("PUT /api/tiers", restricted(PutTierHandler(ctx, conf)))
+	mux.Handle("GET /api/rotation", restricted(GetRotationHandler(ctx, conf)))
+	mux.Handle("POST /api/rotation", restricted(PostRotationHandler(ctx, conf)))
+	mux.Handle("DELETE /api/rotation", restricted(DeleteRotationHandler(ctx, conf)))
+	mux.Handle("GET /api/invites", restricted(GetInvitesHandler(ctx, conf)))
+	mux.Handle("POST /api/invites", restricted(PostInviteHandler(ctx, conf)))
+	mux.Handle("DELETE /api/invites/{id}", restricted(DeleteInviteHandler(ctx, conf)))
+	mux.Handle("GET /api/promotions", restricted(GetPromotionsHandler(ctx, conf)))
+	mux.Handle("POST /api/promotions", restricted(PostPromotionHandler(ctx, conf)))
+	mux.Handle("DELETE /api/promotions/{id}", restricted(DeletePromotionHandler(ctx, conf)))
+	mux.Handle("GET /api/clientcerts", restricted(GetClientCertsHandler(ctx, conf)))
+	mux.Handle("POST /api/clientcerts", restricted(PostClientCertHandler(ctx, conf)))
+	mux.Handle("DELETE /api/clientcerts/{fingerprint}", restricted(DeleteClientCertHandler(ctx, conf)))
+	mux.Handle("GET /api/agents", restricted(GetAgentsHandler(ctx, conf)))
+	mux.Handle("POST /api/agents", restricted(PostAgentHandler(ctx, conf)))
+	mux.Handle("DELETE /api/agents", restricted(DeleteAgentHandler(ctx, conf)))
+	// Indexers and agents authenticate with their own keys, and are subject
+	// to the admin quotas per key.
+	mux.Handle("GET /api/catalog", admin(WithIndexerAuthorization(ctx, conf)(http.HandlerFunc(CatalogHandler(ctx, conf)))))
+	mux.Handle("POST /api/agents/report", admin(WithAgentAuthorization(ctx, conf)(http.HandlerFunc(AgentReportHandler(ctx, conf)))))
+	mux.Handle("GET /api/agents/torrentfile", admin(WithAgentAuthorization(ctx, conf)(http.HandlerFunc(AgentTorrentFileHandler(ctx, conf)))))
+	mux.Handle("GET /api/agents/infohashes", longpoll(WithAgentAuthorization(ctx, conf)(http.HandlerFunc(AgentInfohashesHandler(ctx, conf)))))
+	mux.Handle("GET /api/openapi.json", admin(WithDocsAuthorization(conf)(http.HandlerFunc(OpenAPIHandler))))
+	mux.Handle("GET /api/docs", admin(WithDocsAuthorization(conf)(http.HandlerFunc(DocsHandler))))
 }
 
 // PostInfohashHandler takes a POST request to the /api/infohash endpoint, with
-// the body as a JSON object with a base64-encoded infohash and a name for the
-// infohash. It inserts it into the database and returns an appropriate JSON
-// message on success or failure.
+// the body as a JSON object with a base64-encoded infohash, a name for the
+// infohash, and an optional category and tags. It inserts it into the
+// database and returns an appropriate JSON message on success or failure.
 //
-// This is an authorization-only endpoint.
+// This is an authorization-only endpoint, see WithAuthorization.
 func PostInfohashHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !validateAPIKey(conf, w, r) {
-			return
-		}
-
 		var infohash InfohashPost
 		err := json.NewDecoder(r.Body).Decode(&infohash)
 		if err != nil || len(infohash.Info_hash) != 20 {
 			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid infohash"})
 			return
 		}
+		category, tags, err := normalizeLabels(infohash.Category, infohash.Tags)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
 
 		_, err = conf.Dbpool.Exec(ctx, `
-		INSERT INTO infohashes (info_hash, name)
-		    VALUES ($1, $2)
+		INSERT INTO infohashes (info_hash, name, category, tags)
+		    VALUES ($1, $2, $3, $4)
 		`,
-			infohash.Info_hash, infohash.Name)
+			infohash.Info_hash, infohash.Name, category, tags)
 		if err != nil {
 			var pgErr *pgconn.PgError
 			// 23505: duplicate key insertion error code
@@ -136,6 +348,7 @@ func PostInfohashHandler(ctx context.Context, conf config.Config) func(w http.Re
 			writeError(w, http.StatusInternalServerError, MessageJSON{"error inserting infohash"})
 			return
 		}
+		conf.Publish(events.Event{Kind: events.InfohashAdded, Info_hash: infohash.Info_hash, Name: infohash.Name})
 
 		response, err := json.Marshal(MessageJSON{"success"})
 		if err != nil {
@@ -148,85 +361,76 @@ func PostInfohashHandler(ctx context.Context, conf config.Config) func(w http.Re
 }
 
 // PostTorrentFileHandler takes a POST request to the /api/torrentfile endpoint, with
-// the body as a torrent file. It strips out any current announce url and
-// inserts it into the database and returns an appropriate JSON message on
-// success or failure.
+// the body as a torrent file, and optional category and comma-separated tags
+// form fields. Bodies larger than MaxUploadSize are refused. It rejects
+// corrupt torrent files, see parseTorrent, strips out
+// any current announce url and inserts it into the database and returns an
+// appropriate JSON message on success or failure.
 //
-// This is an authorization-only endpoint.
+// Several torrent files may be uploaded at once, either as a zip archive of
+// torrent files or as several file fields, up to MaxArchiveTorrents. They
+// are inserted in one transaction, and the response is a JSON array with a
+// TorrentUpload result for each file, see postTorrentFiles.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
 //
 // Both the PostInfohashHandler and PostTorrentFileHandler endpoints are supported because
 // the former makes testing easier, and may sometimes be convenient for public torrents.
 func PostTorrentFileHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !validateAPIKey(conf, w, r) {
-			return
+		if conf.MaxUploadSize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, conf.MaxUploadSize)
 		}
-
 		file, _, err := r.FormFile("file")
 		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeError(w, http.StatusRequestEntityTooLarge, MessageJSON{fmt.Sprintf("error: posted file larger than %d bytes", maxBytesErr.Limit)})
+				return
+			}
 			writeError(w, http.StatusBadRequest, MessageJSON{"error: could not process posted file"})
 			return
 		}
 		defer file.Close()
 
-		data, err := bencode.Decode(file)
+		category, tags, err := normalizeLabels(r.FormValue("category"), splitTags(r.FormValue("tags")))
 		if err != nil {
-			writeError(w, http.StatusBadRequest, MessageJSON{"error: could not decode posted file"})
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
 			return
 		}
 
-		// Strip out announce url.
-		data.(map[string]any)["announce"] = ""
-
-		// Ensure private flag is set.
-		data.(map[string]any)["info"].(map[string]any)["private"] = int64(1)
-
-		// Extract name and length.
-		name := data.(map[string]any)["info"].(map[string]any)["name"].(string)
-
-		var length int64
-		if l, ok := data.(map[string]any)["info"].(map[string]any)["length"]; ok {
-			length = l.(int64)
-		} else {
-			for _, f := range data.(map[string]any)["info"].(map[string]any)["files"].([]any) {
-				length += f.(map[string]any)["length"].(int64)
-			}
-		}
-
-		// Calculate info_hash.
-		var b bytes.Buffer
-		err = bencode.Marshal(&b, data.(map[string]any)["info"])
+		data, err := io.ReadAll(file)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not calculate infohash"})
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: could not process posted file"})
+			return
+		}
+		if headers := r.MultipartForm.File["file"]; len(headers) > 1 || bytes.HasPrefix(data, zipMagic) {
+			postTorrentFiles(ctx, conf, w, headers, category, tags)
 			return
 		}
-		info_hash := sha1.Sum(b.Bytes())
-
-		// Re-encode stripped torrent file.
-		var torrentFile bytes.Buffer
 
-		err = bencode.Marshal(&torrentFile, data)
+		torrent, err := prepareTorrent(bytes.NewReader(data))
+		var uploadErr uploadError
+		if errors.As(err, &uploadErr) {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not construct new torrent file"})
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: " + err.Error()})
 			return
 		}
 
-		// Write to db.
-		_, err = conf.Dbpool.Exec(ctx, `
-		INSERT INTO infohashes (info_hash, name, file, length)
-		    VALUES ($1, $2, $3, $4)
-		`,
-			info_hash[:], name, torrentFile.Bytes(), length)
+		// Write to db, with the metadata of the torrent file.
+		inserted, err := insertTorrent(ctx, conf.Dbpool, torrent, category, tags)
 		if err != nil {
-			var pgErr *pgconn.PgError
-			// 23505: duplicate key insertion error code
-			if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
-				writeError(w, http.StatusBadRequest, MessageJSON{"error: infohash already inserted"})
-				return
-			}
 			writeError(w, http.StatusInternalServerError, MessageJSON{"error inserting infohash"})
 			return
 		}
+		if !inserted {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: infohash already inserted"})
+			return
+		}
+		conf.Publish(events.Event{Kind: events.InfohashAdded, Info_hash: torrent.info_hash, Name: torrent.info.name})
 
 		response, err := json.Marshal(MessageJSON{"success"})
 		if err != nil {
@@ -243,13 +447,9 @@ func PostTorrentFileHandler(ctx context.Context, conf config.Config) func(w http
 // infohash. It removes it from the database and returns an appropriate JSON
 // message on success or failure.
 //
-// This is an authorization-only endpoint.
+// This is an authorization-only endpoint, see WithAuthorization.
 func DeleteInfohashHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !validateAPIKey(conf, w, r) {
-			return
-		}
-
 		var infohash Infohash
 		err := json.NewDecoder(r.Body).Decode(&infohash)
 		if err != nil || len(infohash.Info_hash) != 20 {
@@ -257,16 +457,37 @@ func DeleteInfohashHandler(ctx context.Context, conf config.Config) func(w http.
 			return
 		}
 
-		_, err = conf.Dbpool.Exec(ctx, `
-		DELETE FROM infohashes
-		WHERE info_hash = $1
+		// Infohashes merged into this one are no longer redirected, so
+		// their cached redirects are cleared as well.
+		rows, _ := conf.Dbpool.Query(ctx, `
+		WITH deleted AS (
+		    DELETE FROM infohashes
+		    WHERE info_hash = $1
+		    RETURNING
+		        id
+		)
+		SELECT
+		    info_hash
+		FROM
+		    infohashes
+		    JOIN deleted ON infohashes.merged_into = deleted.id
 		`,
 			infohash.Info_hash)
+		merged, err := pgx.CollectRows(rows, pgx.RowTo[[]byte])
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, MessageJSON{"error deleting infohash"})
 			return
 		}
 
+		keys := []string{"merged:" + string(infohash.Info_hash)}
+		for _, info_hash := range merged {
+			keys = append(keys, "merged:"+string(info_hash))
+		}
+		if err = conf.Rdb.Unlink(ctx, keys...).Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"deleted infohash, but could not clear cache"})
+			return
+		}
+
 		response, err := json.Marshal(MessageJSON{"success"})
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, MessageJSON{"success deleting, but error making response"})
@@ -276,244 +497,1376 @@ func DeleteInfohashHandler(ctx context.Context, conf config.Config) func(w http.
 	}
 }
 
-// ServeFrontend provides the basic routing logic for the SPA.
-func ServeFrontend(frontendPath string) func(w http.ResponseWriter, r *http.Request) {
+// MergeInfohashHandler takes a POST request to the /api/infohash/merge
+// endpoint, with the body as a JSON object with base64-encoded deprecated
+// and canonical infohashes for the same content, such as the private and
+// public variants of a torrent. The announces, snatches, and download count
+// of the deprecated infohash are moved to the canonical one, and later
+// announces for the deprecated infohash are recorded under the canonical one
+// with a warning to the client, see handler.MergedWarning. The deprecated
+// infohash is hidden from stats and the catalog until it is deleted.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func MergeInfohashHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fs := http.Dir(frontendPath)
-		path := filepath.Join(r.URL.Path)
-
-		// Serve static assets, if they exist.
-		if _, err := fs.Open(path); err == nil {
-			http.FileServer(fs).ServeHTTP(w, r)
+		var merge InfohashMerge
+		err := json.NewDecoder(r.Body).Decode(&merge)
+		if err != nil || len(merge.Deprecated) != 20 || len(merge.Canonical) != 20 {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid infohashes"})
+			return
+		}
+		if bytes.Equal(merge.Deprecated, merge.Canonical) {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: cannot merge an infohash into itself"})
 			return
 		}
 
-		// Route everything else through index.html.
-		http.ServeFile(w, r, filepath.Join(frontendPath, "index.html"))
-	}
-}
+		tx, err := conf.Dbpool.Begin(ctx)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not merge infohashes"})
+			return
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
 
-// InfohashesHandler presets a REST API on /frontend/infohashes which returns
-// an object including information on each tracked infohash.
-func InfohashesHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		enableCors(conf, &w, r)
-
-		query := fmt.Sprintf(`
-			WITH recent_announces AS (
-			    SELECT DISTINCT ON (peers_id, info_hash_id)
-				amount_left,
-				info_hash_id
-			    FROM
-				announces
-			    WHERE
-				last_announce >= NOW() - INTERVAL '%d seconds'
-				AND event <> $1
-			    ORDER BY
-				peers_id,
-				info_hash_id,
-				last_announce DESC
-			)
+		var deprecated_id, canonical_id int
+		var deprecated_merged, canonical_merged bool
+		err = tx.QueryRow(ctx, `
 			SELECT
-			    name,
-			    downloaded,
-			    COUNT(*) FILTER (WHERE recent_announces.amount_left = 0) AS seeders,
-			    COUNT(*) FILTER (WHERE recent_announces.amount_left > 0) AS leechers,
-			    info_hash
+			    deprecated.id,
+			    deprecated.merged_into IS NOT NULL,
+			    canonical.id,
+			    canonical.merged_into IS NOT NULL
 			FROM
-			    infohashes
-			    LEFT JOIN recent_announces ON infohashes.id = recent_announces.info_hash_id
-			GROUP BY
-			    info_hash,
-			    name,
-			    downloaded
-			ORDER BY
-			    name
+			    infohashes deprecated,
+			    infohashes canonical
+			WHERE
+			    deprecated.info_hash = $1
+			    AND canonical.info_hash = $2
+			FOR UPDATE
 			`,
-			config.StaleInterval)
-
-		rows, err := conf.Dbpool.Query(ctx, query, config.Stopped)
+			merge.Deprecated, merge.Canonical).Scan(&deprecated_id, &deprecated_merged, &canonical_id, &canonical_merged)
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: infohash not tracked"})
+			return
+		}
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not merge infohashes"})
+			return
+		}
+		if deprecated_merged {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: deprecated infohash already merged"})
+			return
+		}
+		if canonical_merged {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: canonical infohash is itself merged"})
 			return
 		}
 
-		infohashes, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[InfohashStats])
+		// A peer in both swarms keeps only its latest announce.
+		_, err = tx.Exec(ctx, `
+			DELETE FROM announces older USING announces newer
+			WHERE older.info_hash_id IN ($1, $2)
+			    AND newer.info_hash_id IN ($1, $2)
+			    AND older.info_hash_id <> newer.info_hash_id
+			    AND older.peers_id = newer.peers_id
+			    AND older.peer_id = newer.peer_id
+			    AND older.ipv6 IS NOT DISTINCT FROM newer.ipv6
+			    AND (older.last_announce, older.info_hash_id) < (newer.last_announce, newer.info_hash_id)
+			`,
+			deprecated_id, canonical_id)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not merge infohashes"})
 			return
 		}
 
-		result, err := json.Marshal(infohashes)
+		// Moved announces keep their last_announce, so that stale peers of
+		// the deprecated swarm stay stale in the canonical one.
+		_, err = tx.Exec(ctx, `
+			UPDATE announces
+			SET info_hash_id = $2
+			WHERE info_hash_id = $1
+			`,
+			deprecated_id, canonical_id)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not merge infohashes"})
 			return
 		}
-		fmt.Fprintf(w, "%s", result)
-	}
-}
 
-// StatsHandler presents a REST API on /frontendapi/stats which returns an object
-// including the total tracked infohashes, seeders, and leechers.
-func StatsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		enableCors(conf, &w, r)
-		query := fmt.Sprintf(`
-			WITH recent_announces AS (
-			    SELECT DISTINCT ON (info_hash_id, peers_id)
-				amount_left,
-				info_hash_id
-			    FROM
-				announces
-			    WHERE
-				last_announce >= NOW() - INTERVAL '%d seconds'
-				AND event <> $1
-			    ORDER BY
-				peers_id,
-				info_hash_id,
-				last_announce DESC
-			)
-			SELECT
-			    COUNT(DISTINCT info_hash) AS hashcount,
-			    COUNT(*) FILTER (WHERE recent_announces.amount_left = 0) AS seeders,
-			    COUNT(*) FILTER (WHERE recent_announces.amount_left > 0) AS leechers
-			FROM
-			    infohashes
-			    LEFT JOIN recent_announces ON infohashes.id = recent_announces.info_hash_id
+		_, err = tx.Exec(ctx, `
+			UPDATE snatches
+			SET info_hash_id = $2
+			WHERE info_hash_id = $1
 			`,
-			config.StaleInterval)
-
-		rows, err := conf.Dbpool.Query(ctx, query, config.Stopped)
+			deprecated_id, canonical_id)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not merge infohashes"})
 			return
 		}
-		stats, err := pgx.CollectRows(rows, pgx.RowToStructByName[GlobalStats])
+
+		// Anything already merged into the deprecated infohash now points
+		// to the canonical one, so redirects are never chained.
+		rows, _ := tx.Query(ctx, `
+			UPDATE infohashes
+			SET merged_into = $2
+			WHERE merged_into = $1
+			RETURNING
+			    info_hash
+			`,
+			deprecated_id, canonical_id)
+		remerged, err := pgx.CollectRows(rows, pgx.RowTo[[]byte])
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not merge infohashes"})
 			return
 		}
 
-		result, err := json.Marshal(stats[0])
+		_, err = tx.Exec(ctx, `
+			UPDATE infohashes
+			SET downloaded = infohashes.downloaded + deprecated.downloaded
+			FROM infohashes deprecated
+			WHERE infohashes.id = $2
+			    AND deprecated.id = $1
+			`,
+			deprecated_id, canonical_id)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not merge infohashes"})
 			return
 		}
-		fmt.Fprintf(w, "%s", result)
-	}
-}
 
-// GenerateHandler returns a new announce key.
-func GenerateHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		enableCors(conf, &w, r)
-		announce_key, err := config.GenerateAnnounceKey(ctx, conf)
+		_, err = tx.Exec(ctx, `
+			UPDATE infohashes
+			SET downloaded = 0, merged_into = $2
+			WHERE id = $1
+			`,
+			deprecated_id, canonical_id)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not generate announce key"})
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not merge infohashes"})
 			return
 		}
-		key := Key{Announce_key: announce_key}
 
-		result, err := json.Marshal(key)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+		if err = tx.Commit(ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not merge infohashes"})
 			return
 		}
-		fmt.Fprintf(w, "%s", result)
+
+		keys := []string{"merged:" + string(merge.Deprecated)}
+		for _, info_hash := range remerged {
+			keys = append(keys, "merged:"+string(info_hash))
+		}
+		if err = conf.Rdb.Unlink(ctx, keys...).Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: merged infohashes, but could not clear cache"})
+			return
+		}
+
+		response, err := json.Marshal(MessageJSON{"success"})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success merging, but error making response"})
+		}
+
+		fmt.Fprintf(w, "%s", response)
 	}
 }
 
-// GetTorrentFileHandler takes a GET request with an announce_key and info_hash query fields.
-// If the announce_key is registered and the info_hash is present in the database,
-// it returns a new torrent file with the appropriate announce URL.
-//
-// The info_hash is expected to be hex-encoded.
-func GetTorrentFileHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+// isAPIPath reports whether path is under one of the API prefixes.
+func isAPIPath(path string) bool {
+	for _, prefix := range []string{"/api", "/frontendapi"} {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isNavigation reports whether a request is a browser navigating to a page
+// of the SPA, rather than fetching an asset. Browsers accept text/html when
+// navigating, and SPA routes have no file extension.
+func isNavigation(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html") || filepath.Ext(r.URL.Path) == ""
+}
+
+// ServeFrontend provides the basic routing logic for the SPA. Static assets
+// are served if they exist, and navigational routes are served index.html
+// so that the SPA can route them. Unknown API routes, such as typos, get a
+// JSON 404 instead of a blank page. Any other missing file gets a 404, with
+// the notFoundPage asset as the body if one is set.
+func ServeFrontend(frontendPath string, notFoundPage string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query()
+		fs := http.Dir(frontendPath)
+		path := filepath.Join(r.URL.Path)
 
-		// Validate announce_key
-		announce_key := query.Get("announce_key")
-		if announce_key == "" {
-			writeError(w, http.StatusBadRequest, MessageJSON{"error: no announce key provided in query"})
+		if isAPIPath(r.URL.Path) {
+			w.Header().Set("Content-Type", "application/json")
+			writeError(w, http.StatusNotFound, MessageJSON{"error: no such API endpoint"})
 			return
 		}
 
-		var ok bool
-		err := conf.Dbpool.QueryRow(ctx, `
-			SELECT EXISTS (SELECT FROM peers WHERE announce_key = $1)
-			`,
-			announce_key).Scan(&ok)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to validate announce key"})
+		// Serve static assets, if they exist.
+		if f, err := fs.Open(path); err == nil {
+			f.Close()
+			http.FileServer(fs).ServeHTTP(w, r)
 			return
 		}
 
-		if !ok {
-			writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid announce key"})
+		// Route navigation through index.html.
+		if isNavigation(r) {
+			http.ServeFile(w, r, filepath.Join(frontendPath, "index.html"))
 			return
 		}
 
-		// Process info_hash
-		info_hash_hex := query.Get("info_hash")
+		serveNotFound(w, r, fs, notFoundPage)
+	}
+}
+
+// serveNotFound replies with a 404, using the page from fs as the body if it
+// is set and exists.
+func serveNotFound(w http.ResponseWriter, r *http.Request, fs http.FileSystem, page string) {
+	if page == "" {
+		http.NotFound(w, r)
+		return
+	}
 
-		if info_hash_hex == "" {
-			writeError(w, http.StatusBadRequest, MessageJSON{"error: no infohash provided in query"})
-			return
-		}
+	f, err := fs.Open(filepath.Join("/", page))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
 
-		info_hash, err := hex.DecodeString(info_hash_hex)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, MessageJSON{"error: could not decode hex info_hash"})
-		}
+	if contentType := mime.TypeByExtension(filepath.Ext(page)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = io.Copy(w, f)
+}
 
-		var stripped_torrent_file []byte
+// MaxInfohashesLimit is the most infohashes returned in one page by
+// InfohashesHandler.
+const MaxInfohashesLimit = 1000
 
-		err = conf.Dbpool.QueryRow(ctx, `
-			SELECT file FROM infohashes WHERE info_hash = $1 AND file IS NOT NULL
-			`,
-			info_hash).Scan(&stripped_torrent_file)
-		if err != nil {
-			if !errors.Is(err, pgx.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to fetch torrent file from db"})
-				return
-			}
-			writeError(w, http.StatusBadRequest, MessageJSON{"error: no matching infohash with stored torrent file"})
-			return
+// infohashSorts are the columns InfohashFilter may sort by.
+var infohashSorts = map[string]string{
+	"name":       "name",
+	"seeders":    "seeders",
+	"leechers":   "leechers",
+	"downloaded": "downloaded",
+}
+
+// noACL is the condition that an infohash is not restricted by an ACL, so
+// that it may be listed publicly.
+const noACL = `NOT EXISTS (
+		    SELECT
+		    FROM
+			infohash_acls
+		    WHERE
+			infohash_acls.info_hash_id = infohashes.id)`
+
+// InfohashFilter selects, orders, and pages the infohashes returned by
+// QueryInfohashStats. Name matches a case-insensitive substring of the name,
+// and an infohash must have the Category, if set, and every one of the Tags.
+// Sort is a key of infohashSorts, with ties ordered by name. A Limit of
+// zero returns every infohash. The zero value returns every infohash,
+// ordered by name.
+type InfohashFilter struct {
+	Name      string
+	Info_hash []byte
+	Category  string
+	Tags      []string
+	Sort      string
+	Desc      bool
+	Limit     int
+	Offset    int
+}
+
+// where returns the WHERE clause for the filter, binding its parameters
+// after the first n, and the parameters.
+func (f InfohashFilter) where(n int) (string, []any) {
+	conditions := []string{
+		"infohashes.archived_time IS NULL",
+		"infohashes.merged_into IS NULL",
+		noACL,
+	}
+	var params []any
+	if f.Name != "" {
+		params = append(params, f.Name)
+		conditions = append(conditions, fmt.Sprintf("strpos(lower(name), lower($%d)) > 0", n+len(params)))
+	}
+	if f.Info_hash != nil {
+		params = append(params, f.Info_hash)
+		conditions = append(conditions, fmt.Sprintf("info_hash = $%d", n+len(params)))
+	}
+	if f.Category != "" {
+		params = append(params, f.Category)
+		conditions = append(conditions, fmt.Sprintf("category = $%d", n+len(params)))
+	}
+	if len(f.Tags) > 0 {
+		params = append(params, f.Tags)
+		conditions = append(conditions, fmt.Sprintf("tags @> $%d", n+len(params)))
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), params
+}
+
+// QueryInfohashStats returns the name, downloads, seeders, leechers,
+// category, and tags of every tracked infohash which is not archived,
+// merged, or restricted by an ACL and matches the filter.
+func QueryInfohashStats(ctx context.Context, conf config.Config, filter InfohashFilter) ([]*InfohashStats, error) {
+	sort, ok := infohashSorts[filter.Sort]
+	if !ok {
+		sort = "name"
+	}
+	direction := "ASC"
+	if filter.Desc {
+		direction = "DESC"
+	}
+
+	where, params := filter.where(3)
+	query := `
+		WITH ` + db.RecentAnnounces(1, 2, "amount_left", "event") + `
+		SELECT
+		    name,
+		    downloaded,
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left = 0) AS seeders,
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left > 0
+			AND NOT ` + db.PartialSeed(3) + `) AS leechers,
+		    COUNT(*) FILTER (WHERE ` + db.PartialSeed(3) + `) AS partial_seeders,
+		    info_hash,
+		    category,
+		    tags
+		FROM
+		    infohashes
+		    LEFT JOIN recent_announces ON infohashes.id = recent_announces.info_hash_id
+		` + where + `
+		GROUP BY
+		    info_hash,
+		    name,
+		    downloaded,
+		    category,
+		    tags
+		ORDER BY
+		    ` + sort + ` ` + direction + `,
+		    name,
+		    info_hash
+		`
+	params = append([]any{config.Stopped, conf.StaleCutoff(), config.Paused}, params...)
+	if filter.Limit > 0 {
+		params = append(params, filter.Limit, filter.Offset)
+		query += fmt.Sprintf("LIMIT $%d OFFSET $%d", len(params)-1, len(params))
+	}
+
+	rows, err := conf.Dbpool.Query(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying infohash stats: %w", err)
+	}
+
+	infohashes, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[InfohashStats])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing infohash stats: %w", err)
+	}
+	if !conf.LegacyInfohashes {
+		for _, i := range infohashes {
+			i.Info_hash_hex = hex.EncodeToString(i.Info_hash)
+			i.Magnet = MagnetLink(i.Info_hash, i.Name)
 		}
+	}
 
-		data, err := bencode.Decode(bytes.NewReader(stripped_torrent_file))
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to decode torrent file in db"})
-			return
+	return infohashes, nil
+}
+
+// MagnetLink returns a BEP 9 magnet link for an infohash, with its name as
+// the display name.
+func MagnetLink(info_hash []byte, name string) string {
+	return "magnet:?xt=urn:btih:" + hex.EncodeToString(info_hash) + "&dn=" + url.QueryEscape(name)
+}
+
+// CountInfohashes returns the number of infohashes which match the filter,
+// ignoring its paging.
+func CountInfohashes(ctx context.Context, conf config.Config, filter InfohashFilter) (int, error) {
+	where, params := filter.where(0)
+
+	var count int
+	err := conf.Dbpool.QueryRow(ctx, `SELECT COUNT(*) FROM infohashes `+where, params...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting infohashes: %w", err)
+	}
+	return count, nil
+}
+
+// parseInfohashFilter parses the optional name, info_hash, category, tag,
+// sort, order, limit, and offset query fields. The info_hash is hex-encoded,
+// and tag may be given more than once. Names sort
+// ascending and counts descending, unless order is asc or desc.
+func parseInfohashFilter(r *http.Request) (InfohashFilter, error) {
+	query := r.URL.Query()
+	filter := InfohashFilter{Name: query.Get("name"), Sort: "name"}
+
+	if info_hash := query.Get("info_hash"); info_hash != "" {
+		decoded, err := hex.DecodeString(info_hash)
+		if err != nil || len(decoded) != 20 {
+			return InfohashFilter{}, errors.New("invalid info_hash")
 		}
+		filter.Info_hash = decoded
+	}
+
+	var err error
+	filter.Category, filter.Tags, err = normalizeLabels(query.Get("category"), query["tag"])
+	if err != nil {
+		return InfohashFilter{}, err
+	}
 
-		// Build a clean and complete announce URL.
-		u := &url.URL{
-			Scheme: "http",
-			Host:   r.Host,
+	if sort := query.Get("sort"); sort != "" {
+		if _, ok := infohashSorts[sort]; !ok {
+			return InfohashFilter{}, errors.New("invalid sort")
 		}
+		filter.Sort = sort
+	}
+	switch query.Get("order") {
+	case "":
+		filter.Desc = filter.Sort != "name"
+	case "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		return InfohashFilter{}, errors.New("invalid order")
+	}
 
-		if r.TLS != nil {
-			u.Scheme = "https"
+	if limitString := query.Get("limit"); limitString != "" {
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit <= 0 || limit > MaxInfohashesLimit {
+			return InfohashFilter{}, errors.New("invalid limit")
+		}
+		filter.Limit = limit
+	}
+	if offsetString := query.Get("offset"); offsetString != "" {
+		offset, err := strconv.Atoi(offsetString)
+		if err != nil || offset < 0 {
+			return InfohashFilter{}, errors.New("invalid offset")
 		}
+		filter.Offset = offset
+	}
 
-		announce_url := u.JoinPath(announce_key, "announce")
+	return filter, nil
+}
 
-		data.(map[string]any)["announce"] = announce_url.String()
+// InfohashesHandler presets a REST API on /frontend/infohashes which returns
+// an object including information on each tracked infohash. The infohashes
+// can be filtered, sorted, and paged, see parseInfohashFilter; without a
+// limit, every matching infohash is returned. The number of matching
+// infohashes is returned in the X-Total-Count header.
+func InfohashesHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseInfohashFilter(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
 
-		var torrent_file bytes.Buffer
-		err = bencode.Marshal(&torrent_file, data)
+		infohashes, err := QueryInfohashStats(ctx, conf, filter)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+		total, err := CountInfohashes(ctx, conf, filter)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not construct new torrent file"})
-			log.Print(err)
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
 			return
 		}
+		if infohashes == nil {
+			infohashes = []*InfohashStats{}
+		}
 
-		_, err = w.Write(torrent_file.Bytes())
+		result, err := json.Marshal(infohashes)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not send torrent file"})
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
 			return
 		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// QueryGlobalStats returns the total tracked infohashes, seeders, and
+// leechers. Archived and merged infohashes are not counted.
+func QueryGlobalStats(ctx context.Context, conf config.Config) (GlobalStats, error) {
+	query := `
+		WITH ` + db.RecentAnnounces(1, 2, "amount_left", "event") + `
+		SELECT
+		    COUNT(DISTINCT info_hash) AS hashcount,
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left = 0) AS seeders,
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left > 0
+			AND NOT ` + db.PartialSeed(3) + `) AS leechers,
+		    COUNT(*) FILTER (WHERE ` + db.PartialSeed(3) + `) AS partial_seeders
+		FROM
+		    infohashes
+		    LEFT JOIN recent_announces ON infohashes.id = recent_announces.info_hash_id
+		WHERE
+		    infohashes.archived_time IS NULL
+		    AND infohashes.merged_into IS NULL
+		`
+
+	rows, err := conf.Dbpool.Query(ctx, query, config.Stopped, conf.StaleCutoff(), config.Paused)
+	if err != nil {
+		return GlobalStats{}, fmt.Errorf("error querying stats: %w", err)
+	}
+	stats, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[GlobalStats])
+	if err != nil {
+		return GlobalStats{}, fmt.Errorf("error parsing stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+// StatsHandler presents a REST API on /frontendapi/stats which returns an object
+// including the total tracked infohashes, seeders, and leechers.
+func StatsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := QueryGlobalStats(ctx, conf)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		result, err := json.Marshal(stats)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// CountryStatsHandler presents a REST API on /api/stats/countries which
+// returns the number of swarms, seeders, and leechers per country. Only
+// aggregates are returned; individual IPs are never exposed. Peers without a
+// known country, including all peers when no GeoIP database is configured,
+// are counted under "unknown".
+func CountryStatsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := `
+			WITH ` + db.RecentAnnounces(1, 2, "amount_left", "event", "country") + `
+			SELECT
+			    COALESCE(country, 'unknown') AS country,
+			    COUNT(DISTINCT info_hash_id) AS swarms,
+			    COUNT(*) FILTER (WHERE amount_left = 0) AS seeders,
+			    COUNT(*) FILTER (WHERE amount_left > 0
+				AND NOT ` + db.PartialSeed(3) + `) AS leechers,
+			    COUNT(*) FILTER (WHERE ` + db.PartialSeed(3) + `) AS partial_seeders
+			FROM
+			    recent_announces
+			GROUP BY
+			    COALESCE(country, 'unknown')
+			ORDER BY
+			    seeders DESC,
+			    country
+			`
+
+		rows, err := conf.Dbpool.Query(ctx, query, config.Stopped, conf.StaleCutoff(), config.Paused)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		stats, err := pgx.CollectRows(rows, pgx.RowToStructByName[CountryStats])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+
+		result, err := json.Marshal(stats)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// AsnStatsHandler presents a REST API on /api/stats/asns which returns the
+// number of swarms, seeders, and leechers per autonomous system. Like
+// CountryStatsHandler, only aggregates are returned. Peers without a known
+// ASN are counted under ASN 0.
+func AsnStatsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := `
+			WITH ` + db.RecentAnnounces(1, 2, "amount_left", "event", "asn", "asn_org") + `
+			SELECT
+			    COALESCE(asn, 0) AS asn,
+			    COALESCE(MAX(asn_org), 'unknown') AS asn_org,
+			    COUNT(DISTINCT info_hash_id) AS swarms,
+			    COUNT(*) FILTER (WHERE amount_left = 0) AS seeders,
+			    COUNT(*) FILTER (WHERE amount_left > 0
+				AND NOT ` + db.PartialSeed(3) + `) AS leechers,
+			    COUNT(*) FILTER (WHERE ` + db.PartialSeed(3) + `) AS partial_seeders
+			FROM
+			    recent_announces
+			GROUP BY
+			    COALESCE(asn, 0)
+			ORDER BY
+			    seeders DESC,
+			    asn
+			`
+
+		rows, err := conf.Dbpool.Query(ctx, query, config.Stopped, conf.StaleCutoff(), config.Paused)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		stats, err := pgx.CollectRows(rows, pgx.RowToStructByName[AsnStats])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+
+		result, err := json.Marshal(stats)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// captchaClient is used to verify CAPTCHA tokens.
+var captchaClient = &http.Client{Timeout: 5 * time.Second}
+
+// verifyCaptcha checks a CAPTCHA token against a reCAPTCHA-compatible
+// siteverify API, which is shared by reCAPTCHA, hCaptcha, and Turnstile.
+func verifyCaptcha(ctx context.Context, conf config.Config, token string, remoteAddr string) (bool, error) {
+	form := url.Values{}
+	form.Set("secret", conf.CaptchaSecret)
+	form.Set("response", token)
+	if ip, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		form.Set("remoteip", ip)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.CaptchaVerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, fmt.Errorf("error building captcha request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := captchaClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error verifying captcha: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("error decoding captcha response: %w", err)
+	}
+
+	return result.Success, nil
+}
+
+// GenerateHandler returns a new announce key. If a CAPTCHA secret is
+// configured, the request must include a valid token in the captcha query
+// field. If proof of work is enabled, it must include a challenge from
+// ChallengeHandler and a solving nonce in the challenge and nonce fields. If
+// invites are required, it must include an unused invite code from
+// PostInviteHandler in the invite field. If the request has a session token
+// in the Authorization header, the new key is owned by that user, see
+// RegisterHandler.
+func GenerateHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var users_id *int
+		if token := r.Header.Get("Authorization"); token != "" {
+			id, err := sessionUser(ctx, conf, token)
+			if err != nil {
+				if errors.Is(err, ErrInvalidSession) {
+					writeError(w, http.StatusUnauthorized, MessageJSON{"error: invalid session token"})
+					return
+				}
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to validate session token"})
+				return
+			}
+			users_id = &id
+		}
+
+		if conf.CaptchaSecret != "" {
+			token := r.URL.Query().Get("captcha")
+			if token == "" {
+				writeError(w, http.StatusForbidden, MessageJSON{"error: captcha required"})
+				return
+			}
+			ok, err := verifyCaptcha(ctx, conf, token, r.RemoteAddr)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to verify captcha"})
+				log.Print(err)
+				return
+			}
+			if !ok {
+				writeError(w, http.StatusForbidden, MessageJSON{"error: invalid captcha"})
+				return
+			}
+		}
+
+		if conf.PowDifficulty > 0 {
+			query := r.URL.Query()
+			ok, err := redeemProofOfWork(ctx, conf, query.Get("challenge"), query.Get("nonce"))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to verify proof of work"})
+				log.Print(err)
+				return
+			}
+			if !ok {
+				writeError(w, http.StatusForbidden, MessageJSON{"error: invalid proof of work"})
+				return
+			}
+		}
+
+		// The invite is redeemed last, so that it is not used up by a
+		// request which fails another check.
+		var invite_id int
+		if conf.RequireInvite {
+			code := r.URL.Query().Get("invite")
+			if code == "" {
+				writeError(w, http.StatusForbidden, MessageJSON{"error: invite required"})
+				return
+			}
+			id, err := redeemInvite(ctx, conf, code)
+			if err != nil {
+				if errors.Is(err, ErrInvalidInvite) {
+					writeError(w, http.StatusForbidden, MessageJSON{"error: invalid invite"})
+					return
+				}
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to verify invite"})
+				log.Print(err)
+				return
+			}
+			invite_id = id
+		}
+
+		announce_key, err := config.GenerateUserAnnounceKey(ctx, conf, users_id)
+		if err != nil {
+			if conf.RequireInvite {
+				releaseInvite(ctx, conf, invite_id)
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not generate announce key"})
+			return
+		}
+		if conf.RequireInvite {
+			if err = bindInvite(ctx, conf, invite_id, announce_key); err != nil {
+				log.Print(err)
+			}
+		}
+		if conf.PowDifficulty > 0 {
+			if err = handler.VerifyKey(ctx, conf, announce_key); err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not verify announce key"})
+				log.Print(err)
+				return
+			}
+		}
+		// The key takes the tier of its owner, if any.
+		if users_id != nil {
+			if err = handler.TiersChanged(ctx, conf); err != nil {
+				log.Print(err)
+			}
+		}
+		key := Key{Announce_key: announce_key}
+
+		result, err := json.Marshal(key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// GetTorrentFileHandler takes a GET request with an announce_key and info_hash query fields.
+// If the announce_key is registered and the info_hash is present in the database,
+// it returns a new torrent file with the appropriate announce URL.
+//
+// The info_hash is expected to be hex-encoded.
+func GetTorrentFileHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		// Validate announce_key
+		announce_key := query.Get("announce_key")
+		if announce_key == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: no announce key provided in query"})
+			return
+		}
+
+		var ok bool
+		err := conf.Dbpool.QueryRow(ctx, `
+			SELECT EXISTS (SELECT FROM peers WHERE announce_key = $1)
+			`,
+			announce_key).Scan(&ok)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to validate announce key"})
+			return
+		}
+
+		if !ok {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid announce key"})
+			return
+		}
+
+		writeTorrentFile(ctx, conf, w, r, announce_key, query.Get("info_hash"))
+	}
+}
+
+// writeTorrentFile writes the stored torrent file for the hex-encoded
+// info_hash, with the announce URL for announce_key, unless the infohash is
+// restricted to other keys.
+func writeTorrentFile(ctx context.Context, conf config.Config, w http.ResponseWriter, r *http.Request, announce_key string, info_hash_hex string) {
+	if info_hash_hex == "" {
+		writeError(w, http.StatusBadRequest, MessageJSON{"error: no infohash provided in query"})
+		return
+	}
+
+	info_hash, err := hex.DecodeString(info_hash_hex)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, MessageJSON{"error: could not decode hex info_hash"})
+		return
+	}
+
+	err = handler.CheckACL(ctx, conf, announce_key, info_hash)
+	if errors.Is(err, handler.ErrRestricted) {
+		writeError(w, http.StatusForbidden, MessageJSON{"error: access to this torrent is restricted"})
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to check access to torrent"})
+		log.Print(err)
+		return
+	}
+
+	var stripped_torrent_file []byte
+
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT file FROM infohashes WHERE info_hash = $1 AND file IS NOT NULL
+		`,
+		info_hash).Scan(&stripped_torrent_file)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to fetch torrent file from db"})
+			return
+		}
+		writeError(w, http.StatusBadRequest, MessageJSON{"error: no matching infohash with stored torrent file"})
+		return
+	}
+
+	data, err := bencode.Decode(bytes.NewReader(stripped_torrent_file))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to decode torrent file in db"})
+		return
+	}
+
+	torrent := data.(map[string]any)
+	torrent["announce"] = announceURL(conf, r, announce_key)
+	// Clients prefer an announce-list to the announce URL, so one left in
+	// the uploaded torrent file must not be served.
+	delete(torrent, "announce-list")
+	if tiers := announceList(conf, r, announce_key); tiers != nil {
+		torrent["announce-list"] = tiers
+	}
+
+	var torrent_file bytes.Buffer
+	err = bencode.Marshal(&torrent_file, data)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not construct new torrent file"})
+		log.Print(err)
+		return
+	}
+
+	_, err = w.Write(torrent_file.Bytes())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not send torrent file"})
+	}
+}
+
+// TorrentInfoHandler takes a GET request with a hex-encoded info_hash query
+// field, and returns the TorrentMetadata of the torrent file uploaded for
+// it. Infohashes added without a torrent file, or restricted by an ACL,
+// have no metadata.
+func TorrentInfoHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info_hash, err := hex.DecodeString(r.URL.Query().Get("info_hash"))
+		if err != nil || len(info_hash) != 20 {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid info_hash"})
+			return
+		}
+
+		var metadata TorrentMetadata
+		err = conf.Dbpool.QueryRow(ctx, `
+			SELECT
+			    info_hash,
+			    name,
+			    length,
+			    piece_length,
+			    creation_date,
+			    files
+			FROM
+			    torrent_files
+			    JOIN infohashes ON torrent_files.info_hash_id = infohashes.id
+			WHERE
+			    info_hash = $1
+			    AND `+noACL+`
+			`,
+			info_hash).Scan(&metadata.Info_hash, &metadata.Name, &metadata.Length, &metadata.Piece_length, &metadata.Creation_date, &metadata.Files)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeError(w, http.StatusNotFound, MessageJSON{"error: no metadata for infohash"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		response, err := json.Marshal(metadata)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// KeyUsageHandler takes a GET request with an announce_key query field and
+// returns usage analytics for the key: the distinct IPs and clients it has
+// been announced from, the distinct peer_ids among its current announces, the
+// IP changes of its clients mid-session, its first and last activity, and
+// its announces per day. Activity is only kept for the retention period, so
+// the first activity is the earliest day announced within it, or null if
+// there is none. Many IPs, clients, or peer_ids on one key suggest it has
+// been shared or leaked.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func KeyUsageHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		announce_key := r.URL.Query().Get("announce_key")
+		if announce_key == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: no announce key provided in query"})
+			return
+		}
+
+		usage := KeyUsage{Announce_key: announce_key}
+
+		err := conf.Dbpool.QueryRow(ctx, `
+			SELECT
+			    MIN(key_activity.day),
+			    COUNT(DISTINCT key_activity.ip),
+			    COUNT(DISTINCT key_activity.client),
+			    (
+				SELECT
+				    COUNT(DISTINCT peer_id)
+				FROM
+				    announces
+				WHERE
+				    announces.peers_id = peers.id),
+			    (
+				SELECT
+				    COUNT(*)
+				FROM
+				    ip_changes
+				WHERE
+				    ip_changes.peers_id = peers.id),
+			    MAX(key_activity.last_announce)
+			FROM
+			    peers
+			    LEFT JOIN key_activity ON peers.id = key_activity.peers_id
+			WHERE
+			    announce_key = $1
+			GROUP BY
+			    peers.id
+			`,
+			announce_key).Scan(&usage.First_activity, &usage.Distinct_ips, &usage.Distinct_clients, &usage.Distinct_peers, &usage.Ip_changes, &usage.Last_activity)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeError(w, http.StatusNotFound, MessageJSON{"error: invalid announce key"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT
+			    day,
+			    SUM(announces)::integer AS announces
+			FROM
+			    key_activity
+			    JOIN peers ON key_activity.peers_id = peers.id
+			WHERE
+			    announce_key = $1
+			GROUP BY
+			    day
+			ORDER BY
+			    day
+			`,
+			announce_key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		usage.Daily, err = pgx.CollectRows(rows, pgx.RowToStructByName[DailyAnnounces])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+
+		result, err := json.Marshal(usage)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// erasedAnnounce is an announce deleted by ErasePeerDataHandler.
+type erasedAnnounce struct {
+	Info_hash []byte
+	Peer_id   []byte
+	Ip_port   []byte
+}
+
+// errUnknownKey is returned by eraseKey for an announce key which is not
+// tracked.
+var errUnknownKey = errors.New("invalid announce key")
+
+// errCacheNotCleared is returned by eraseKey when the key was erased from
+// the database but its cached entries could not be cleared from Redis.
+var errCacheNotCleared = errors.New("erased peer data, but could not clear cache")
+
+// eraseKey erases an announce key and all personal data associated with it:
+// its announces, its key activity, and any cached entries in Redis.
+// Anonymized aggregates, such as infohash download counts, are preserved.
+// Once erased, the key can no longer announce.
+func eraseKey(ctx context.Context, conf config.Config, announce_key string) error {
+	tx, err := conf.Dbpool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// Collect the erased announces first, so that their peers can be
+	// dropped from the swarm cache, and in privacy mode their ip_port
+	// cache entries can be erased as well.
+	rows, _ := tx.Query(ctx, `
+		DELETE FROM announces USING peers, infohashes
+		WHERE announces.peers_id = peers.id
+		    AND announces.info_hash_id = infohashes.id
+		    AND announce_key = $1
+		RETURNING
+		    info_hash,
+		    peer_id,
+		    ip_port
+		`,
+		announce_key)
+	erased, err := pgx.CollectRows(rows, pgx.RowToStructByPos[erasedAnnounce])
+	if err != nil {
+		return err
+	}
+
+	// Deleting the key cascades to any remaining personal data.
+	tag, err := tx.Exec(ctx, `
+		DELETE FROM peers
+		WHERE announce_key = $1
+		`,
+		announce_key)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errUnknownKey
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	keys := []string{"announce:" + announce_key}
+	if conf.PrivacySalt != "" {
+		for _, a := range erased {
+			keys = append(keys, "ip_port:"+string(a.Ip_port))
+		}
+	}
+	if err = conf.Rdb.Unlink(ctx, keys...).Err(); err != nil {
+		return errCacheNotCleared
+	}
+	for _, a := range erased {
+		err = handler.DropCachedPeer(ctx, conf, a.Info_hash, announce_key, a.Peer_id, a.Ip_port)
+		if err != nil {
+			return errCacheNotCleared
+		}
+	}
+
+	return nil
+}
+
+// writeEraseError writes the response for an error from eraseKey.
+func writeEraseError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnknownKey):
+		writeError(w, http.StatusNotFound, MessageJSON{"error: invalid announce key"})
+	case errors.Is(err, errCacheNotCleared):
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: erased peer data, but could not clear cache"})
+	default:
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not erase peer data"})
+	}
+}
+
+// ErasePeerDataHandler takes a DELETE request with an announce_key query
+// field and erases all personal data associated with the key, see eraseKey.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func ErasePeerDataHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		announce_key := r.URL.Query().Get("announce_key")
+		if announce_key == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: no announce key provided in query"})
+			return
+		}
+
+		if err := eraseKey(ctx, conf, announce_key); err != nil {
+			writeEraseError(w, err)
+			return
+		}
+
+		response, err := json.Marshal(MessageJSON{"success"})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success erasing, but error making response"})
+		}
+
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// DefaultWantedLimit is the number of infohashes returned by WantedHandler
+// when no limit is given.
+const DefaultWantedLimit = 50
+
+// WantedHandler takes a GET request with an optional limit query field and
+// returns the infohashes most requested by announces but not in the
+// allowlist, with the number of requests and when they were first and last
+// seen. Infohashes which have since been added are omitted.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func WantedHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := DefaultWantedLimit
+		if limitString := r.URL.Query().Get("limit"); limitString != "" {
+			var err error
+			limit, err = strconv.Atoi(limitString)
+			if err != nil || limit <= 0 {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid limit"})
+				return
+			}
+		}
+
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT
+			    info_hash,
+			    requests,
+			    first_seen,
+			    last_seen
+			FROM
+			    wanted_infohashes
+			WHERE
+			    NOT EXISTS (
+				SELECT FROM infohashes WHERE infohashes.info_hash = wanted_infohashes.info_hash)
+			ORDER BY
+			    requests DESC,
+			    last_seen DESC
+			LIMIT $1
+			`,
+			limit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		wanted, err := pgx.CollectRows(rows, pgx.RowToStructByName[WantedInfohash])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+
+		result, err := json.Marshal(wanted)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// writeAlgorithmStatus writes the current peering algorithm as JSON.
+func writeAlgorithmStatus(conf config.Config, w http.ResponseWriter) {
+	status := AlgorithmStatus{Algorithm: handler.AlgorithmName(conf.Settings().Algorithm)}
+	for name := range handler.Algorithms {
+		status.Available = append(status.Available, name)
+	}
+	slices.Sort(status.Available)
+
+	result, err := json.Marshal(status)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+		return
+	}
+	fmt.Fprintf(w, "%s", result)
+}
+
+// GetAlgorithmHandler returns the current peering algorithm, see
+// handler.Algorithms.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetAlgorithmHandler(conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeAlgorithmStatus(conf, w)
+	}
+}
+
+// PostAlgorithmHandler takes a POST request with an AlgorithmStatus body,
+// and switches the peering algorithm to the one named. Announces already
+// in progress finish with the previous algorithm. The switch only applies
+// to the tracker instance which receives it, and lasts until it restarts,
+// when $ETRACKER_ALGORITHM applies again.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PostAlgorithmHandler(conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var status AlgorithmStatus
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid algorithm"})
+			return
+		}
+
+		algorithm, ok := handler.Algorithms[status.Algorithm]
+		if !ok {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: unknown algorithm"})
+			return
+		}
+		conf.UpdateSettings(func(s *config.Settings) { s.Algorithm = algorithm })
+		log.Printf("Peering algorithm switched to %s", status.Algorithm)
+
+		writeAlgorithmStatus(conf, w)
+	}
+}
+
+// writeMaintenanceStatus writes the current maintenance mode as JSON.
+func writeMaintenanceStatus(ctx context.Context, conf config.Config, w http.ResponseWriter) {
+	enabled, retry, err := handler.Maintenance(ctx, conf)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not fetch maintenance mode"})
+		return
+	}
+
+	result, err := json.Marshal(MaintenanceStatus{Enabled: enabled, Retry_seconds: int(retry.Seconds())})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+		return
+	}
+	fmt.Fprintf(w, "%s", result)
+}
+
+// GetMaintenanceHandler returns whether maintenance mode is enabled, and how
+// long clients are asked to wait.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetMaintenanceHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeMaintenanceStatus(ctx, conf, w)
+	}
+}
+
+// PutMaintenanceHandler takes a PUT request with a MaintenanceStatus body,
+// and enables or disables maintenance mode. While enabled, announces are
+// answered with a failure asking clients to retry after retry_seconds, or
+// after config.DefaultMaintenanceRetry if it is not given. The API and
+// scrapes are unaffected.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PutMaintenanceHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var status MaintenanceStatus
+		err := json.NewDecoder(r.Body).Decode(&status)
+		if err != nil || status.Retry_seconds < 0 {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid maintenance status"})
+			return
+		}
+
+		var retry time.Duration
+		if status.Enabled {
+			retry = config.DefaultMaintenanceRetry
+			if status.Retry_seconds > 0 {
+				retry = time.Duration(status.Retry_seconds) * time.Second
+			}
+		}
+
+		err = handler.SetMaintenance(ctx, conf, retry)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not set maintenance mode"})
+			return
+		}
+
+		writeMaintenanceStatus(ctx, conf, w)
+	}
+}
+
+// writeReadOnlyStatus writes the current read-only mode as JSON.
+func writeReadOnlyStatus(ctx context.Context, conf config.Config, w http.ResponseWriter) {
+	enabled, err := handler.ReadOnly(ctx, conf)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not fetch read-only mode"})
+		return
+	}
+
+	buffered, err := handler.BufferedAnnounces(ctx, conf)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not fetch read-only mode"})
+		return
+	}
+
+	result, err := json.Marshal(ReadOnlyStatus{Enabled: enabled, Buffered: buffered})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+		return
+	}
+	fmt.Fprintf(w, "%s", result)
+}
+
+// GetReadOnlyHandler returns whether read-only mode is enabled, and how many
+// announces are buffered for replay.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetReadOnlyHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeReadOnlyStatus(ctx, conf, w)
+	}
+}
+
+// PutReadOnlyHandler takes a PUT request with a ReadOnlyStatus body, and
+// enables or disables read-only mode. While enabled, announces are served
+// from Redis and buffered; disabling replays them into Postgres before
+// responding. Other endpoints still query Postgres and may fail while it is
+// unavailable.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PutReadOnlyHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var status ReadOnlyStatus
+		err := json.NewDecoder(r.Body).Decode(&status)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid read-only status"})
+			return
+		}
+
+		err = handler.SetReadOnly(ctx, conf, status.Enabled)
+		if err != nil {
+			log.Printf("Error setting read-only mode: %v", err)
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not set read-only mode"})
+			return
+		}
+
+		writeReadOnlyStatus(ctx, conf, w)
 	}
 }
@@ -11,7 +11,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dmoerner/etracker/internal/config"
 	"github.com/dmoerner/etracker/internal/handler"
@@ -49,7 +53,7 @@ func TestUnsetAuthorization(t *testing.T) {
 		{"no api key", "https://example.com:8080/api/infohash", "", http.StatusForbidden},
 	}
 
-	handler := PostInfohashHandler(ctx, conf)
+	handler := WithAuthorization(conf)(http.HandlerFunc(PostInfohashHandler(ctx, conf)))
 
 	for _, d := range data {
 		t.Run(d.name, func(t *testing.T) {
@@ -57,7 +61,7 @@ func TestUnsetAuthorization(t *testing.T) {
 			req.Header.Add("Authorization", d.authorization)
 			w := httptest.NewRecorder()
 
-			handler(w, req)
+			handler.ServeHTTP(w, req)
 			if w.Result().StatusCode != d.expected {
 				t.Errorf("expected %d, got %d", d.expected, w.Result().StatusCode)
 			}
@@ -82,7 +86,7 @@ func TestAuthorizationHeader(t *testing.T) {
 		{"no api key", "https://example.com:8080/api/infohash", "", http.StatusBadRequest},
 	}
 
-	handler := PostInfohashHandler(ctx, conf)
+	handler := WithAuthorization(conf)(http.HandlerFunc(PostInfohashHandler(ctx, conf)))
 
 	for _, d := range data {
 		t.Run(d.name, func(t *testing.T) {
@@ -92,7 +96,7 @@ func TestAuthorizationHeader(t *testing.T) {
 			}
 			w := httptest.NewRecorder()
 
-			handler(w, req)
+			handler.ServeHTTP(w, req)
 			if w.Result().StatusCode != d.expected {
 				t.Errorf("expected %d, got %d", d.expected, w.Result().StatusCode)
 			}
@@ -115,7 +119,7 @@ func TestInsertDupeInfohash(t *testing.T) {
 
 	for _, d := range data {
 		t.Run(d.name, func(t *testing.T) {
-			body, err := json.Marshal(InfohashPost{d.info_hash, d.name})
+			body, err := json.Marshal(InfohashPost{Info_hash: d.info_hash, Name: d.name})
 			if err != nil {
 				t.Errorf("error marshaling dummy request body: %v", err)
 			}
@@ -156,7 +160,7 @@ func TestInsertBadInfohash(t *testing.T) {
 
 	for _, d := range data {
 		t.Run(d.name, func(t *testing.T) {
-			body, err := json.Marshal(InfohashPost{d.info_hash, d.name})
+			body, err := json.Marshal(InfohashPost{Info_hash: d.info_hash, Name: d.name})
 			if err != nil {
 				t.Errorf("error marshaling dummy request body: %v", err)
 			}
@@ -197,7 +201,7 @@ func TestInsertRemoveInfohash(t *testing.T) {
 
 	for _, d := range data {
 		t.Run(d.name, func(t *testing.T) {
-			body, err := json.Marshal(InfohashPost{d.info_hash, d.name})
+			body, err := json.Marshal(InfohashPost{Info_hash: d.info_hash, Name: d.name})
 			if err != nil {
 				t.Errorf("error marshaling dummy request body: %v", err)
 			}
@@ -314,6 +318,10 @@ func TestInfohashes(t *testing.T) {
 			Info_hash:  []byte(testutils.AllowedInfoHashes["d"]),
 		},
 	}
+	for i := range expected {
+		expected[i].Info_hash_hex = hex.EncodeToString(expected[i].Info_hash)
+		expected[i].Magnet = "magnet:?xt=urn:btih:" + expected[i].Info_hash_hex + "&dn=" + expected[i].Name
+	}
 
 	var received []InfohashStats
 
@@ -326,6 +334,143 @@ func TestInfohashes(t *testing.T) {
 	if cmp.Diff(expected, received) != "" {
 		t.Errorf("error in infohashes json, expected %v, got %v", expected, received)
 	}
+
+	// Legacy frontends are sent only the original fields.
+	conf.LegacyInfohashes = true
+	w = httptest.NewRecorder()
+	InfohashesHandler(ctx, conf)(w, httptest.NewRequest("GET", "http://example.com/api/infohashes", nil))
+	if strings.Contains(w.Body.String(), "info_hash_hex") || strings.Contains(w.Body.String(), "magnet") {
+		t.Errorf("expected no hex infohash or magnet link in legacy mode, got %s", w.Body)
+	}
+}
+
+func TestInfohashesFilter(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Event:       config.Completed,
+		Left:        0,
+	}))
+	peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[2],
+		Info_hash:   testutils.AllowedInfoHashes["b"],
+		Left:        1,
+	}))
+
+	infohashesHandler := InfohashesHandler(ctx, conf)
+
+	data := []struct {
+		name     string
+		query    string
+		expected []string
+		total    string
+	}{
+		{"default", "", []string{"a", "b", "c", "d"}, "4"},
+		{"seeders", "?sort=seeders&limit=1", []string{"a"}, "4"},
+		{"leechers", "?sort=leechers", []string{"b", "a", "c", "d"}, "4"},
+		{"descending names", "?order=desc", []string{"d", "c", "b", "a"}, "4"},
+		{"offset", "?limit=2&offset=3", []string{"d"}, "4"},
+		{"past the end", "?limit=2&offset=10", []string{}, "4"},
+		{"name", "?name=CCC", []string{"c"}, "1"},
+		{"info_hash", "?info_hash=" + hex.EncodeToString([]byte(testutils.AllowedInfoHashes["b"])), []string{"b"}, "1"},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			infohashesHandler(w, httptest.NewRequest("GET", "http://example.com/api/infohashes"+d.query, nil))
+
+			var received []InfohashStats
+			if err := json.NewDecoder(w.Body).Decode(&received); err != nil {
+				t.Fatalf("error decoding infohashes: %v", err)
+			}
+			names := []string{}
+			for _, i := range received {
+				names = append(names, i.Name[:1])
+			}
+			if cmp.Diff(d.expected, names) != "" {
+				t.Errorf("expected %v, got %v", d.expected, names)
+			}
+			if total := w.Header().Get("X-Total-Count"); total != d.total {
+				t.Errorf("expected total %s, got %s", d.total, total)
+			}
+		})
+	}
+
+	for _, query := range []string{"?sort=bogus", "?order=up", "?limit=0", "?offset=-1", "?info_hash=zz"} {
+		w := httptest.NewRecorder()
+		infohashesHandler(w, httptest.NewRequest("GET", "http://example.com/api/infohashes"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestInfohashTags(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	postHandler := PostInfohashHandler(ctx, conf)
+	post := func(infohash InfohashPost) int {
+		body, err := json.Marshal(infohash)
+		if err != nil {
+			t.Fatalf("error marshaling request body: %v", err)
+		}
+		w := httptest.NewRecorder()
+		postHandler(w, httptest.NewRequest("POST", "http://example.com/api/infohash", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	if code := post(InfohashPost{Info_hash: []byte("eeeeeeeeeeeeeeeeeeee"), Name: "e", Category: "Software", Tags: []string{"Linux", "iso"}}); code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d", http.StatusCreated, code)
+	}
+	if code := post(InfohashPost{Info_hash: []byte("ffffffffffffffffffff"), Name: "f", Category: "software", Tags: []string{"bsd", "iso"}}); code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d", http.StatusCreated, code)
+	}
+	if code := post(InfohashPost{Info_hash: []byte("gggggggggggggggggggg"), Name: "g", Tags: []string{"a,b"}}); code != http.StatusBadRequest {
+		t.Errorf("expected %d for an invalid tag, got %d", http.StatusBadRequest, code)
+	}
+
+	infohashesHandler := InfohashesHandler(ctx, conf)
+
+	data := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{"category", "?category=Software", []string{"e", "f"}},
+		{"tag", "?tag=linux", []string{"e"}},
+		{"every tag", "?tag=iso&tag=bsd", []string{"f"}},
+		{"no match", "?category=software&tag=windows", []string{}},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			infohashesHandler(w, httptest.NewRequest("GET", "http://example.com/api/infohashes"+d.query, nil))
+
+			var received []InfohashStats
+			if err := json.NewDecoder(w.Body).Decode(&received); err != nil {
+				t.Fatalf("error decoding infohashes: %v", err)
+			}
+			names := []string{}
+			for _, i := range received {
+				names = append(names, i.Name)
+				if i.Category != "software" {
+					t.Errorf("expected category software, got %q", i.Category)
+				}
+			}
+			if cmp.Diff(d.expected, names) != "" {
+				t.Errorf("expected %v, got %v", d.expected, names)
+			}
+		})
+	}
 }
 
 func TestStats(t *testing.T) {
@@ -370,6 +515,65 @@ func TestStats(t *testing.T) {
 	}
 }
 
+// TestStatsConsistency checks that every query counting seeders and leechers
+// agrees, including for a key with several clients and a stopped peer.
+func TestStatsConsistency(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+
+	requests := []testutils.Request{
+		{AnnounceKey: testutils.AnnounceKeys[1], Info_hash: testutils.AllowedInfoHashes["a"], Peer_id: testutils.GeneratePeerID(), Left: 0},
+		{AnnounceKey: testutils.AnnounceKeys[2], Info_hash: testutils.AllowedInfoHashes["a"], Peer_id: testutils.GeneratePeerID(), Left: 100},
+		{AnnounceKey: testutils.AnnounceKeys[2], Info_hash: testutils.AllowedInfoHashes["b"], Peer_id: testutils.GeneratePeerID(), Left: 0},
+		{AnnounceKey: testutils.AnnounceKeys[2], Info_hash: testutils.AllowedInfoHashes["b"], Peer_id: testutils.GeneratePeerID(), Left: 100},
+		{AnnounceKey: testutils.AnnounceKeys[3], Info_hash: testutils.AllowedInfoHashes["a"], Peer_id: testutils.GeneratePeerID(), Event: config.Stopped},
+	}
+	for i, r := range requests {
+		request := testutils.CreateTestAnnounce(r)
+		request.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i+1)
+		peerHandler(httptest.NewRecorder(), request)
+	}
+
+	global, err := QueryGlobalStats(ctx, conf)
+	if err != nil {
+		t.Fatalf("error querying stats: %v", err)
+	}
+	// The key with two clients on b counts once, by its latest announce.
+	expected := GlobalStats{Hashcount: len(testutils.AllowedInfoHashes), Seeders: 1, Leechers: 2}
+	if global != expected {
+		t.Errorf("expected stats %v, got %v", expected, global)
+	}
+
+	infohashes, err := QueryInfohashStats(ctx, conf, InfohashFilter{})
+	if err != nil {
+		t.Fatalf("error querying infohash stats: %v", err)
+	}
+	var seeders, leechers int
+	for _, i := range infohashes {
+		seeders += i.Seeders
+		leechers += i.Leechers
+	}
+	if seeders != global.Seeders || leechers != global.Leechers {
+		t.Errorf("infohash stats disagree with global stats: %d seeders and %d leechers", seeders, leechers)
+	}
+
+	entries, err := queryCatalog(ctx, conf)
+	if err != nil {
+		t.Fatalf("error querying catalog: %v", err)
+	}
+	seeders, leechers = 0, 0
+	for _, e := range entries {
+		seeders += e.Seeders
+		leechers += e.Leechers
+	}
+	if seeders != global.Seeders || leechers != global.Leechers {
+		t.Errorf("catalog disagrees with global stats: %d seeders and %d leechers", seeders, leechers)
+	}
+}
+
 func TestGenerate(t *testing.T) {
 	ctx := context.Background()
 	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
@@ -415,6 +619,7 @@ func TestPostGetTorrentFile(t *testing.T) {
 
 	postHandler := PostTorrentFileHandler(ctx, conf)
 	getHandler := GetTorrentFileHandler(ctx, conf)
+	infoHandler := TorrentInfoHandler(ctx, conf)
 
 	// These info_hashes are hard-coded, by manually constructing a stripped
 	// torrent file and extracting the info_hash.
@@ -424,9 +629,12 @@ func TestPostGetTorrentFile(t *testing.T) {
 		announce_key     string
 		stored_info_hash string
 		get_file         string
+		files            []TorrentFile
 	}{
-		{"single file", "./test_files/post/singlefile.txt.torrent", testutils.AnnounceKeys[1], "07d3b124456aea33187e832e4c3c046fd94dde9a", "./test_files/get/singlefile.txt.torrent"},
-		{"multi file", "./test_files/post/multifile.torrent", testutils.AnnounceKeys[1], "d77f2817a93fe9e98eff809202fc898d4d812f11", "./test_files/get/multifile.torrent"},
+		{"single file", "./test_files/post/singlefile.txt.torrent", testutils.AnnounceKeys[1], "07d3b124456aea33187e832e4c3c046fd94dde9a", "./test_files/get/singlefile.txt.torrent",
+			[]TorrentFile{{"singlefile.txt", 12}}},
+		{"multi file", "./test_files/post/multifile.torrent", testutils.AnnounceKeys[1], "d77f2817a93fe9e98eff809202fc898d4d812f11", "./test_files/get/multifile.torrent",
+			[]TorrentFile{{"subdir1/subdir1.1/data.txt", 10}, {"subdir2/data.txt", 8}}},
 	}
 
 	for _, d := range data {
@@ -498,10 +706,53 @@ func TestPostGetTorrentFile(t *testing.T) {
 			if !bytes.Equal(expected, received_file) {
 				t.Errorf("Did not receive expected torrent file. Expected: %s, Received: %s", expected, received_file)
 			}
+
+			// Test the stored metadata.
+
+			w = httptest.NewRecorder()
+			infoHandler(w, httptest.NewRequest(http.MethodGet, "https://example.com/api/torrentinfo?info_hash="+d.stored_info_hash, nil))
+
+			var metadata TorrentMetadata
+			if err = json.NewDecoder(w.Body).Decode(&metadata); err != nil {
+				t.Fatalf("could not decode torrent metadata: %v", err)
+			}
+			if diff := cmp.Diff(d.files, metadata.Files); diff != "" {
+				t.Errorf("unexpected files (-want +got):\n%s", diff)
+			}
+			if metadata.Piece_length != 262144 || !bytes.Equal(metadata.Info_hash, info_hash) {
+				t.Errorf("unexpected torrent metadata: %+v", metadata)
+			}
 		})
 	}
 }
 
+func TestPostTorrentFileTooLarge(t *testing.T) {
+	conf := config.Config{MaxUploadSize: 1 << 10}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	filePart, err := writer.CreateFormFile("file", "large.torrent")
+	if err != nil {
+		t.Fatalf("could not create multipart writer from file: %v", err)
+	}
+	if _, err = filePart.Write(bytes.Repeat([]byte("x"), 2<<10)); err != nil {
+		t.Fatalf("could not write file content: %v", err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatalf("failed to close multipart writer: %v", err)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "https://example.com/api/torrentfile/", body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+
+	PostTorrentFileHandler(context.Background(), conf)(w, request)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected %d for a file over the upload size, got %d: %s", http.StatusRequestEntityTooLarge, w.Code, w.Body)
+	}
+}
+
 // func TestGetTorrentFile(t *testing.T) {
 // 	tc, conf := testutils.BuildTestConfig(nil, testutils.DefaultAPIKey)
 // 	defer testutils.TeardownTest(conf)
@@ -539,3 +790,778 @@ func TestPostGetTorrentFile(t *testing.T) {
 // 		})
 // 	}
 // }
+
+func TestKeyUsage(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+
+	peerIDs := []string{testutils.GeneratePeerID(), testutils.GeneratePeerID()}
+	for i, ip := range []string{"10.0.0.1:1234", "10.0.0.2:1234", "10.0.0.2:1234"} {
+		request := testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[1],
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Peer_id:     peerIDs[i/2],
+			Port:        6881,
+		})
+		request.RemoteAddr = ip
+		peerHandler(httptest.NewRecorder(), request)
+	}
+
+	request := httptest.NewRequest("GET", fmt.Sprintf("http://example.com/api/keyusage?announce_key=%s", testutils.AnnounceKeys[1]), nil)
+	w := httptest.NewRecorder()
+
+	keyUsageHandler := KeyUsageHandler(ctx, conf)
+	keyUsageHandler(w, request)
+
+	var received KeyUsage
+
+	err := json.NewDecoder(w.Result().Body).Decode(&received)
+	if err != nil {
+		t.Fatalf("error unmarshalling json response: %v", err)
+	}
+
+	if received.Distinct_ips != 2 {
+		t.Errorf("expected %d distinct ips, got %d", 2, received.Distinct_ips)
+	}
+	if received.Distinct_peers != 2 {
+		t.Errorf("expected %d distinct peers, got %d", 2, received.Distinct_peers)
+	}
+	if received.Last_activity == nil {
+		t.Errorf("expected last activity to be set")
+	}
+	if len(received.Daily) != 1 || received.Daily[0].Announces != 3 {
+		t.Fatalf("expected %d announces on one day, got %v", 3, received.Daily)
+	}
+	if received.First_activity == nil || !received.First_activity.Equal(received.Daily[0].Day) {
+		t.Errorf("expected first activity on %v, got %v", received.Daily[0].Day, received.First_activity)
+	}
+
+	// A key which has never announced has no activity, however long ago it
+	// was created.
+	w = httptest.NewRecorder()
+	keyUsageHandler(w, httptest.NewRequest("GET", fmt.Sprintf("http://example.com/api/keyusage?announce_key=%s", testutils.AnnounceKeys[2]), nil))
+	var unused KeyUsage
+	if err = json.NewDecoder(w.Result().Body).Decode(&unused); err != nil {
+		t.Fatalf("error unmarshalling json response: %v", err)
+	}
+	if unused.First_activity != nil || unused.Last_activity != nil {
+		t.Errorf("expected no activity, got %v and %v", unused.First_activity, unused.Last_activity)
+	}
+}
+
+func TestCountryStats(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	request := testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Event:       config.Completed,
+		Left:        0,
+	})
+	w := httptest.NewRecorder()
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	peerHandler(w, request)
+
+	request = httptest.NewRequest("GET", "http://example.com/api/stats/countries", nil)
+	w = httptest.NewRecorder()
+
+	countryStatsHandler := CountryStatsHandler(ctx, conf)
+	countryStatsHandler(w, request)
+
+	body, _ := io.ReadAll(w.Result().Body)
+
+	// Without a GeoIP database, all peers are counted as unknown.
+	expected := []CountryStats{
+		{
+			Country:  "unknown",
+			Swarms:   1,
+			Seeders:  1,
+			Leechers: 0,
+		},
+	}
+
+	var received []CountryStats
+
+	err := json.Unmarshal(body, &received)
+	if err != nil {
+		t.Errorf("error unmarshalling json response: %v", err)
+	}
+
+	if cmp.Diff(expected, received) != "" {
+		t.Errorf("error in country stats json, expected %v, got %v", expected, received)
+	}
+}
+
+func TestErasePeerData(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	request := testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Event:       config.Completed,
+	})
+	peerHandler := handler.PeerHandler(ctx, conf)
+	peerHandler(httptest.NewRecorder(), request)
+
+	eraseHandler := ErasePeerDataHandler(ctx, conf)
+
+	data := []struct {
+		name     string
+		key      string
+		expected int
+	}{
+		{"erase", testutils.AnnounceKeys[1], http.StatusOK},
+		{"erase again", testutils.AnnounceKeys[1], http.StatusNotFound},
+		{"no key", "", http.StatusBadRequest},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			req := httptest.NewRequest("DELETE", fmt.Sprintf("http://example.com/api/peerdata?announce_key=%s", d.key), nil)
+			w := httptest.NewRecorder()
+
+			eraseHandler(w, req)
+			if w.Result().StatusCode != d.expected {
+				t.Errorf("expected %d, got %d", d.expected, w.Result().StatusCode)
+			}
+		})
+	}
+
+	// Personal data is gone, but the aggregate download count is kept.
+	var remaining int
+	err := conf.Dbpool.QueryRow(ctx, `
+		SELECT COUNT(*) FROM announces
+		`).Scan(&remaining)
+	if err != nil {
+		t.Fatalf("error querying db: %v", err)
+	}
+	if remaining != 0 {
+		t.Errorf("expected no announces after erasure, found %d", remaining)
+	}
+
+	cached, err := conf.Rdb.ZCard(ctx, "swarm:"+testutils.AllowedInfoHashes["a"]).Result()
+	if err != nil {
+		t.Fatalf("error querying swarm cache: %v", err)
+	}
+	if cached != 0 {
+		t.Errorf("expected no cached peers after erasure, found %d", cached)
+	}
+
+	var downloaded int
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT downloaded FROM infohashes WHERE info_hash = $1
+		`,
+		testutils.AllowedInfoHashes["a"]).Scan(&downloaded)
+	if err != nil {
+		t.Fatalf("error querying db: %v", err)
+	}
+	if downloaded != 1 {
+		t.Errorf("expected %d downloads after erasure, found %d", 1, downloaded)
+	}
+}
+
+func TestMergeInfohash(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	deprecated := testutils.AllowedInfoHashes["a"]
+	canonical := testutils.AllowedInfoHashes["b"]
+
+	// The same peer is in both swarms, another completed the deprecated
+	// infohash, and a third has gone stale in it.
+	peerHandler := handler.PeerHandler(ctx, conf)
+	for _, r := range []testutils.Request{
+		{AnnounceKey: testutils.AnnounceKeys[1], Info_hash: deprecated, Event: config.Completed},
+		{AnnounceKey: testutils.AnnounceKeys[2], Info_hash: deprecated},
+		{AnnounceKey: testutils.AnnounceKeys[2], Info_hash: canonical},
+		{AnnounceKey: testutils.AnnounceKeys[4], Info_hash: deprecated},
+	} {
+		peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(r))
+	}
+	staleTime := conf.StaleCutoff().Add(-time.Minute).Truncate(time.Second)
+	_, err := conf.Dbpool.Exec(ctx, `
+		UPDATE announces SET last_announce = $2
+		FROM peers
+		WHERE announces.peers_id = peers.id
+		    AND announce_key = $1
+		`,
+		testutils.AnnounceKeys[4], staleTime)
+	if err != nil {
+		t.Fatalf("error aging announce: %v", err)
+	}
+
+	mergeHandler := MergeInfohashHandler(ctx, conf)
+
+	data := []struct {
+		name       string
+		deprecated string
+		canonical  string
+		expected   int
+	}{
+		{"merge", deprecated, canonical, http.StatusOK},
+		{"merge again", deprecated, canonical, http.StatusBadRequest},
+		{"into merged", testutils.AllowedInfoHashes["c"], deprecated, http.StatusBadRequest},
+		{"into itself", canonical, canonical, http.StatusBadRequest},
+		{"untracked", "ffffffffffffffffffff", canonical, http.StatusNotFound},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			body, err := json.Marshal(InfohashMerge{[]byte(d.deprecated), []byte(d.canonical)})
+			if err != nil {
+				t.Fatalf("error marshaling request body: %v", err)
+			}
+			req := httptest.NewRequest("POST", "http://example.com/api/infohash/merge", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+
+			mergeHandler(w, req)
+			if w.Result().StatusCode != d.expected {
+				t.Errorf("expected %d, got %d", d.expected, w.Result().StatusCode)
+			}
+		})
+	}
+
+	var downloaded, announces, stale int
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    downloaded,
+		    (SELECT COUNT(*) FROM announces WHERE announces.info_hash_id = infohashes.id),
+		    (SELECT COUNT(*) FROM announces WHERE announces.info_hash_id = infohashes.id AND last_announce = $2)
+		FROM infohashes WHERE info_hash = $1
+		`,
+		canonical, staleTime).Scan(&downloaded, &announces, &stale)
+	if err != nil {
+		t.Fatalf("error querying db: %v", err)
+	}
+	if downloaded != 1 {
+		t.Errorf("expected %d downloads after merge, found %d", 1, downloaded)
+	}
+	if announces != 3 {
+		t.Errorf("expected %d announces after merge, found %d", 3, announces)
+	}
+	if stale != 1 {
+		t.Errorf("expected stale announce to keep its last_announce after merge, found %d", stale)
+	}
+
+	infohashes, err := QueryInfohashStats(ctx, conf, InfohashFilter{})
+	if err != nil {
+		t.Fatalf("error querying infohash stats: %v", err)
+	}
+	for _, i := range infohashes {
+		if string(i.Info_hash) == deprecated {
+			t.Errorf("expected merged infohash to be hidden from stats")
+		}
+	}
+
+	// Later announces for the deprecated infohash join the canonical swarm
+	// with a warning.
+	w := httptest.NewRecorder()
+	peerHandler(w, testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[3],
+		Info_hash:   deprecated,
+	}))
+	if !strings.Contains(w.Body.String(), fmt.Sprintf(handler.MergedWarning, canonical)) {
+		t.Errorf("expected merge warning, got %q", w.Body.String())
+	}
+
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM announces JOIN infohashes ON announces.info_hash_id = infohashes.id
+		WHERE info_hash = $1
+		`,
+		canonical).Scan(&announces)
+	if err != nil {
+		t.Fatalf("error querying db: %v", err)
+	}
+	if announces != 4 {
+		t.Errorf("expected %d announces after redirect, found %d", 4, announces)
+	}
+}
+
+func TestGenerateCaptcha(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	// A fake siteverify API which accepts only the token "valid".
+	verify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"success": %t}`, r.FormValue("secret") == "testsecret" && r.FormValue("response") == "valid")
+	}))
+	defer verify.Close()
+
+	conf.CaptchaSecret = "testsecret"
+	conf.CaptchaVerifyURL = verify.URL
+
+	generateHandler := GenerateHandler(ctx, conf)
+
+	data := []struct {
+		name     string
+		request  string
+		expected int
+	}{
+		{"no captcha", "http://example.com/api/generate", http.StatusForbidden},
+		{"invalid captcha", "http://example.com/api/generate?captcha=invalid", http.StatusForbidden},
+		{"valid captcha", "http://example.com/api/generate?captcha=valid", http.StatusOK},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", d.request, nil)
+			w := httptest.NewRecorder()
+
+			generateHandler(w, req)
+			if w.Result().StatusCode != d.expected {
+				t.Errorf("expected %d, got %d", d.expected, w.Result().StatusCode)
+			}
+		})
+	}
+}
+
+func TestGenerateProofOfWork(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	conf.PowDifficulty = 8
+
+	challengeHandler := ChallengeHandler(ctx, conf)
+	generateHandler := GenerateHandler(ctx, conf)
+
+	w := httptest.NewRecorder()
+	challengeHandler(w, httptest.NewRequest("GET", "http://example.com/api/challenge", nil))
+
+	var challenge Challenge
+	err := json.NewDecoder(w.Result().Body).Decode(&challenge)
+	if err != nil {
+		t.Fatalf("error unmarshalling challenge: %v", err)
+	}
+
+	nonce := SolveChallenge(challenge)
+
+	data := []struct {
+		name     string
+		request  string
+		expected int
+	}{
+		{"no proof", "http://example.com/api/generate", http.StatusForbidden},
+		{"unknown challenge", "http://example.com/api/generate?challenge=unknown&nonce=0", http.StatusForbidden},
+		{"valid proof", fmt.Sprintf("http://example.com/api/generate?challenge=%s&nonce=%s", challenge.Challenge, nonce), http.StatusOK},
+		{"reused proof", fmt.Sprintf("http://example.com/api/generate?challenge=%s&nonce=%s", challenge.Challenge, nonce), http.StatusForbidden},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", d.request, nil)
+			w := httptest.NewRecorder()
+
+			generateHandler(w, req)
+			if w.Result().StatusCode != d.expected {
+				t.Errorf("expected %d, got %d", d.expected, w.Result().StatusCode)
+			}
+		})
+	}
+}
+
+func TestVerifyKeyProofOfWork(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	conf.PowDifficulty = 8
+
+	challengeHandler := ChallengeHandler(ctx, conf)
+	verifyHandler := VerifyKeyHandler(ctx, conf)
+	peerHandler := handler.PeerHandler(ctx, conf)
+
+	announce := func() string {
+		w := httptest.NewRecorder()
+		peerHandler(w, testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[1],
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Port:        6881,
+			Left:        100,
+			Event:       config.Started,
+		}))
+		body, _ := io.ReadAll(w.Result().Body)
+		return string(body)
+	}
+
+	// The test keys were not generated with a proof of work.
+	if body := announce(); !strings.Contains(body, handler.UnverifiedFailure) {
+		t.Fatalf("expected unverified key to be refused, got %q", body)
+	}
+
+	w := httptest.NewRecorder()
+	challengeHandler(w, httptest.NewRequest("GET", "http://example.com/api/challenge", nil))
+
+	var challenge Challenge
+	err := json.NewDecoder(w.Result().Body).Decode(&challenge)
+	if err != nil {
+		t.Fatalf("error unmarshalling challenge: %v", err)
+	}
+
+	nonce := SolveChallenge(challenge)
+
+	data := []struct {
+		name     string
+		request  string
+		expected int
+	}{
+		{"no key", "http://example.com/api/verify", http.StatusBadRequest},
+		{"no proof", "http://example.com/api/verify?announce_key=" + testutils.AnnounceKeys[1], http.StatusForbidden},
+		{"valid proof", fmt.Sprintf("http://example.com/api/verify?announce_key=%s&challenge=%s&nonce=%s", testutils.AnnounceKeys[1], challenge.Challenge, nonce), http.StatusOK},
+		{"reused proof", fmt.Sprintf("http://example.com/api/verify?announce_key=%s&challenge=%s&nonce=%s", testutils.AnnounceKeys[2], challenge.Challenge, nonce), http.StatusForbidden},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", d.request, nil)
+			w := httptest.NewRecorder()
+
+			verifyHandler(w, req)
+			if w.Result().StatusCode != d.expected {
+				t.Errorf("expected %d, got %d", d.expected, w.Result().StatusCode)
+			}
+		})
+	}
+
+	if body := announce(); strings.Contains(body, "failure reason") {
+		t.Errorf("expected verified key to announce, got %q", body)
+	}
+}
+
+func TestGenerateInvite(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	conf.RequireInvite = true
+
+	generateHandler := GenerateHandler(ctx, conf)
+
+	addInvite := func() InviteCode {
+		w := httptest.NewRecorder()
+		PostInviteHandler(ctx, conf)(w, httptest.NewRequest("POST", "http://example.com/api/invites", strings.NewReader(`{"note": "test"}`)))
+		var code InviteCode
+		if err := json.NewDecoder(w.Result().Body).Decode(&code); err != nil {
+			t.Fatalf("error unmarshalling invite: %v", err)
+		}
+		return code
+	}
+	invite := addInvite()
+
+	data := []struct {
+		name     string
+		request  string
+		expected int
+	}{
+		{"no invite", "http://example.com/api/generate", http.StatusForbidden},
+		{"invalid invite", "http://example.com/api/generate?invite=invalid", http.StatusForbidden},
+		{"valid invite", "http://example.com/api/generate?invite=" + invite.Code, http.StatusOK},
+		{"reused invite", "http://example.com/api/generate?invite=" + invite.Code, http.StatusForbidden},
+	}
+
+	var key Key
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", d.request, nil)
+			w := httptest.NewRecorder()
+
+			generateHandler(w, req)
+			if w.Result().StatusCode != d.expected {
+				t.Errorf("expected %d, got %d", d.expected, w.Result().StatusCode)
+			}
+			if w.Result().StatusCode == http.StatusOK {
+				_ = json.NewDecoder(w.Result().Body).Decode(&key)
+			}
+		})
+	}
+
+	unused := addInvite()
+
+	w := httptest.NewRecorder()
+	GetInvitesHandler(ctx, conf)(w, httptest.NewRequest("GET", "http://example.com/api/invites", nil))
+	var invites []Invite
+	if err := json.NewDecoder(w.Result().Body).Decode(&invites); err != nil {
+		t.Fatalf("error unmarshalling invites: %v", err)
+	}
+	if len(invites) != 2 || invites[0].Used_time != nil || invites[1].Used_time == nil {
+		t.Fatalf("expected one used and one unused invite, got %+v", invites)
+	}
+	if invites[1].Announce_key == nil || *invites[1].Announce_key != key.Announce_key || invites[1].Note != "test" {
+		t.Errorf("expected used invite to record key %s, got %+v", key.Announce_key, invites[1])
+	}
+
+	deleteInvite := func(id int) int {
+		req := httptest.NewRequest("DELETE", fmt.Sprintf("http://example.com/api/invites/%d", id), nil)
+		req.SetPathValue("id", strconv.Itoa(id))
+		w := httptest.NewRecorder()
+		DeleteInviteHandler(ctx, conf)(w, req)
+		return w.Result().StatusCode
+	}
+	if code := deleteInvite(invite.Id); code != http.StatusNotFound {
+		t.Errorf("expected %d deleting used invite, got %d", http.StatusNotFound, code)
+	}
+	if code := deleteInvite(unused.Id); code != http.StatusOK {
+		t.Errorf("expected %d deleting unused invite, got %d", http.StatusOK, code)
+	}
+}
+
+func TestWanted(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+
+	for _, info_hash := range []string{"wantedwantedwantedwa", "wantedwantedwantedwa", "lesswantedlesswanted"} {
+		request := testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[1],
+			Info_hash:   info_hash,
+		})
+		peerHandler(httptest.NewRecorder(), request)
+	}
+
+	request := httptest.NewRequest("GET", "http://example.com/api/wanted", nil)
+	w := httptest.NewRecorder()
+
+	wantedHandler := WantedHandler(ctx, conf)
+	wantedHandler(w, request)
+
+	var received []WantedInfohash
+
+	err := json.NewDecoder(w.Result().Body).Decode(&received)
+	if err != nil {
+		t.Fatalf("error unmarshalling json response: %v", err)
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("expected %d wanted infohashes, got %d", 2, len(received))
+	}
+	if string(received[0].Info_hash) != "wantedwantedwantedwa" || received[0].Requests != 2 {
+		t.Errorf("expected most wanted infohash with 2 requests, got %s with %d", received[0].Info_hash, received[0].Requests)
+	}
+
+	request = httptest.NewRequest("GET", "http://example.com/api/wanted?limit=1", nil)
+	w = httptest.NewRecorder()
+	wantedHandler(w, request)
+
+	err = json.NewDecoder(w.Result().Body).Decode(&received)
+	if err != nil {
+		t.Fatalf("error unmarshalling json response: %v", err)
+	}
+	if len(received) != 1 {
+		t.Errorf("expected %d wanted infohash with limit, got %d", 1, len(received))
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	var document struct {
+		Paths map[string]map[string]any `json:"paths"`
+	}
+	err := json.Unmarshal(openAPIDocument, &document)
+	if err != nil {
+		t.Fatalf("error parsing OpenAPI document: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	identity := func(h http.Handler) http.Handler { return h }
+	MuxAPIRoutes(context.Background(), config.Config{}, mux, identity, identity, identity)
+
+	for path, methods := range document.Paths {
+		for method := range methods {
+			pattern := fmt.Sprintf("%s %s", strings.ToUpper(method), path)
+			_, got := mux.Handler(httptest.NewRequest(strings.ToUpper(method), path, nil))
+			if got != pattern {
+				t.Errorf("documented %s is routed to %q", pattern, got)
+			}
+		}
+	}
+}
+
+func TestDocsAuthorization(t *testing.T) {
+	conf := config.Config{Authorization: testutils.DefaultAPIKey}
+	handler := WithDocsAuthorization(conf)(http.HandlerFunc(DocsHandler))
+
+	data := []struct {
+		name         string
+		basic        string
+		header       string
+		expectedcode int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"basic", testutils.DefaultAPIKey, "", http.StatusOK},
+		{"wrong basic", "wrong", "", http.StatusForbidden},
+		{"header", "", testutils.DefaultAPIKey, http.StatusOK},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://example.com/api/docs", nil)
+			if d.basic != "" {
+				request.SetBasicAuth("admin", d.basic)
+			}
+			if d.header != "" {
+				request.Header.Set("Authorization", d.header)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, request)
+
+			if w.Code != d.expectedcode {
+				t.Errorf("expected code %d, got %d", d.expectedcode, w.Code)
+			}
+			if d.expectedcode == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("expected basic authentication challenge")
+			}
+		})
+	}
+}
+
+func TestAnnounceURL(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	publicConf := conf
+	publicConf.PublicURL = "https://tracker.example.com"
+
+	data := []struct {
+		name         string
+		conf         config.Config
+		query        string
+		expectedcode int
+		expectedbody string
+	}{
+		{"request host", conf, "announce_key=" + testutils.AnnounceKeys[1], http.StatusOK, fmt.Sprintf(`{"announce_url":"http://example.com/%s/announce"}`, testutils.AnnounceKeys[1])},
+		{"public url", publicConf, "announce_key=" + testutils.AnnounceKeys[1], http.StatusOK, fmt.Sprintf(`{"announce_url":"https://tracker.example.com/%s/announce"}`, testutils.AnnounceKeys[1])},
+		{"untracked key", conf, "announce_key=" + testutils.UntrackedAnnounceKey, http.StatusBadRequest, `{"message":"error: invalid announce key"}`},
+		{"invalid size", conf, "qr=1&size=0&announce_key=" + testutils.AnnounceKeys[1], http.StatusBadRequest, `{"message":"error: invalid size"}`},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://example.com/api/announceurl?"+d.query, nil)
+			w := httptest.NewRecorder()
+
+			AnnounceURLHandler(ctx, d.conf)(w, request)
+
+			if w.Code != d.expectedcode {
+				t.Errorf("expected code %d, got %d", d.expectedcode, w.Code)
+			}
+			if body := w.Body.String(); body != d.expectedbody {
+				t.Errorf("expected body %s, got %s", d.expectedbody, body)
+			}
+		})
+	}
+
+	request := httptest.NewRequest("GET", "http://example.com/api/announceurl?qr=1&announce_key="+testutils.AnnounceKeys[1], nil)
+	w := httptest.NewRecorder()
+
+	AnnounceURLHandler(ctx, conf)(w, request)
+
+	if !bytes.HasPrefix(w.Body.Bytes(), []byte("\x89PNG")) {
+		t.Errorf("expected a PNG, got %q", w.Body.Bytes())
+	}
+}
+
+func TestServeFrontend(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":    "<html>index</html>",
+		"404.html":      "<html>missing</html>",
+		"assets/app.js": "console.log('app')",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := []struct {
+		name         string
+		path         string
+		accept       string
+		notFoundPage string
+		expected     int
+		body         string
+	}{
+		{"asset", "/assets/app.js", "", "", http.StatusOK, "console.log('app')"},
+		{"navigation", "/infohashes", "text/html,application/xhtml+xml", "", http.StatusOK, "<html>index</html>"},
+		{"route without extension", "/keys/usage", "*/*", "", http.StatusOK, "<html>index</html>"},
+		{"api typo", "/api/infohashs", "text/html", "", http.StatusNotFound, `{"message":"error: no such API endpoint"}`},
+		{"frontend api typo", "/frontendapi/stat", "*/*", "", http.StatusNotFound, `{"message":"error: no such API endpoint"}`},
+		{"missing asset", "/assets/missing.js", "*/*", "", http.StatusNotFound, "404 page not found\n"},
+		{"custom 404", "/assets/missing.js", "*/*", "404.html", http.StatusNotFound, "<html>missing</html>"},
+		{"missing custom 404", "/assets/missing.js", "*/*", "nope.html", http.StatusNotFound, "404 page not found\n"},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://example.com"+d.path, nil)
+			if d.accept != "" {
+				request.Header.Set("Accept", d.accept)
+			}
+			w := httptest.NewRecorder()
+
+			ServeFrontend(dir, d.notFoundPage)(w, request)
+
+			if w.Code != d.expected {
+				t.Errorf("expected status %d, got %d", d.expected, w.Code)
+			}
+			if w.Body.String() != d.body {
+				t.Errorf("expected body %q, got %q", d.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAlgorithm(t *testing.T) {
+	conf, _ := testutils.BuildFakeConfig(t, handler.PeersForRatio, testutils.DefaultAPIKey)
+
+	getHandler := GetAlgorithmHandler(conf)
+	postHandler := PostAlgorithmHandler(conf)
+
+	status := func(w *httptest.ResponseRecorder) AlgorithmStatus {
+		var s AlgorithmStatus
+		if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+			t.Fatalf("error decoding algorithm: %v", err)
+		}
+		return s
+	}
+
+	w := httptest.NewRecorder()
+	getHandler(w, httptest.NewRequest("GET", "http://example.com/api/algorithm", nil))
+	if s := status(w); s.Algorithm != "PeersForRatio" || len(s.Available) != len(handler.Algorithms) {
+		t.Errorf("expected PeersForRatio among all algorithms, got %+v", s)
+	}
+
+	w = httptest.NewRecorder()
+	postHandler(w, httptest.NewRequest("POST", "http://example.com/api/algorithm", strings.NewReader(`{"algorithm": "NumwantPeers"}`)))
+	if s := status(w); s.Algorithm != "NumwantPeers" {
+		t.Errorf("expected NumwantPeers, got %+v", s)
+	}
+	if name := handler.AlgorithmName(conf.Settings().Algorithm); name != "NumwantPeers" {
+		t.Errorf("expected settings to be switched to NumwantPeers, got %q", name)
+	}
+
+	for _, body := range []string{`{"algorithm": "Unknown"}`, `not json`} {
+		w = httptest.NewRecorder()
+		postHandler(w, httptest.NewRequest("POST", "http://example.com/api/algorithm", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d, got %d", body, http.StatusBadRequest, w.Code)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// BanListVersion is the version of the BanList format, so that trackers can
+// refuse ban lists they do not understand.
+const BanListVersion = 1
+
+// Ban refuses announces by announce key, IP range, or client peer_id
+// prefix, see handler.NormalizeBan.
+type Ban struct {
+	Kind         string    `json:"kind"`
+	Value        string    `json:"value"`
+	Reason       string    `json:"reason"`
+	Created_time time.Time `json:"created_time"`
+}
+
+// BanList is the format in which bans are exported and imported, so that
+// cooperating trackers or a rebuilt instance can share them.
+type BanList struct {
+	Version int   `json:"version"`
+	Bans    []Ban `json:"bans"`
+}
+
+type BanImportResult struct {
+	Imported int `json:"imported"`
+	Removed  int `json:"removed"`
+}
+
+// GetBansHandler exports every ban as a BanList.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetBansHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT kind, value, reason, created_time
+			FROM bans
+			ORDER BY kind, value
+			`)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		bans, err := pgx.CollectRows(rows, pgx.RowToStructByName[Ban])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+		if bans == nil {
+			bans = []Ban{}
+		}
+
+		response, err := json.Marshal(BanList{Version: BanListVersion, Bans: bans})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PostBansHandler takes a POST request with a BanList body and imports its
+// bans. Bans which already exist are kept as they are. With a replace=true
+// query field, every existing ban not in the list is removed, so that the
+// bans become exactly the list. The whole list is validated before anything
+// is imported.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PostBansHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var list BanList
+		err := json.NewDecoder(r.Body).Decode(&list)
+		if err != nil || list.Version != BanListVersion {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid ban list"})
+			return
+		}
+		replace := r.URL.Query().Get("replace") == "true"
+
+		for i, ban := range list.Bans {
+			list.Bans[i].Value, err = handler.NormalizeBan(ban.Kind, ban.Value)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+				return
+			}
+			if ban.Created_time.IsZero() {
+				list.Bans[i].Created_time = conf.Now()
+			}
+		}
+
+		tx, err := conf.Dbpool.Begin(ctx)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not import bans"})
+			return
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
+
+		var result BanImportResult
+		if replace {
+			kinds := make([]string, len(list.Bans))
+			values := make([]string, len(list.Bans))
+			for i, ban := range list.Bans {
+				kinds[i], values[i] = ban.Kind, ban.Value
+			}
+			tag, err := tx.Exec(ctx, `
+				DELETE FROM bans
+				WHERE (kind, value) NOT IN (
+				    SELECT
+					*
+				    FROM
+					unnest($1::text[], $2::text[]))
+				`,
+				kinds, values)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not import bans"})
+				return
+			}
+			result.Removed = int(tag.RowsAffected())
+		}
+
+		for _, ban := range list.Bans {
+			tag, err := tx.Exec(ctx, `
+				INSERT INTO bans (kind, value, reason, created_time)
+				    VALUES ($1, $2, $3, $4)
+				ON CONFLICT (kind, value)
+				    DO NOTHING
+				`,
+				ban.Kind, ban.Value, ban.Reason, ban.Created_time)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not import bans"})
+				return
+			}
+			result.Imported += int(tag.RowsAffected())
+		}
+
+		if err = tx.Commit(ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not import bans"})
+			return
+		}
+
+		if err = handler.BansChanged(ctx, conf); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: imported bans, but could not update cache"})
+			return
+		}
+
+		response, err := json.Marshal(result)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success importing, but error making response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// DeleteBanHandler takes a DELETE request with kind and value query fields,
+// and lifts that ban.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func DeleteBanHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kind := r.URL.Query().Get("kind")
+		value, err := handler.NormalizeBan(kind, r.URL.Query().Get("value"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
+
+		tag, err := conf.Dbpool.Exec(ctx, `
+			DELETE FROM bans
+			WHERE kind = $1
+			    AND value = $2
+			`,
+			kind, value)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not delete ban"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: unknown ban"})
+			return
+		}
+
+		if err = handler.BansChanged(ctx, conf); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: deleted ban, but could not update cache"})
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
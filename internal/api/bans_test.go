@@ -0,0 +1,97 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestBans(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	banned := func(key int) bool {
+		w := httptest.NewRecorder()
+		peerHandler(w, testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[key],
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+		}))
+		return strings.Contains(w.Body.String(), "banned")
+	}
+
+	importBans := func(body string, replace bool) (*httptest.ResponseRecorder, BanImportResult) {
+		url := "http://example.com/api/bans"
+		if replace {
+			url += "?replace=true"
+		}
+		w := httptest.NewRecorder()
+		PostBansHandler(ctx, conf)(w, httptest.NewRequest("POST", url, strings.NewReader(body)))
+		var result BanImportResult
+		_ = json.Unmarshal(w.Body.Bytes(), &result)
+		return w, result
+	}
+
+	if banned(1) {
+		t.Fatalf("expected announce to be allowed before bans")
+	}
+
+	list := `{"version": 1, "bans": [
+		{"kind": "key", "value": "` + testutils.AnnounceKeys[1] + `", "reason": "abuse"},
+		{"kind": "cidr", "value": "198.51.100.7"}
+	]}`
+	w, result := importBans(list, false)
+	if w.Code != http.StatusOK || result.Imported != 2 {
+		t.Fatalf("expected 2 bans imported, got %d: %s", w.Code, w.Body)
+	}
+	if _, result = importBans(list, false); result.Imported != 0 {
+		t.Errorf("expected reimport to add nothing, got %d", result.Imported)
+	}
+	if w, _ = importBans(`{"version": 1, "bans": [{"kind": "cidr", "value": "bad"}]}`, false); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for invalid ban, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w, _ = importBans(`{"version": 2, "bans": []}`, false); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for unknown version, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	if !banned(1) || banned(2) {
+		t.Errorf("expected only the banned key to be refused")
+	}
+
+	w = httptest.NewRecorder()
+	GetBansHandler(ctx, conf)(w, httptest.NewRequest("GET", "http://example.com/api/bans", nil))
+	var exported BanList
+	if err := json.NewDecoder(w.Body).Decode(&exported); err != nil {
+		t.Fatalf("error decoding bans: %v", err)
+	}
+	if len(exported.Bans) != 2 || exported.Bans[0].Value != "198.51.100.7/32" || exported.Bans[1].Reason != "abuse" {
+		t.Errorf("expected exported bans, got %+v", exported)
+	}
+
+	// Replacing with only the CIDR ban lifts the key ban.
+	_, result = importBans(`{"version": 1, "bans": [{"kind": "cidr", "value": "198.51.100.7/32"}]}`, true)
+	if result.Imported != 0 || result.Removed != 1 {
+		t.Errorf("expected 1 ban removed, got %+v", result)
+	}
+	if banned(1) {
+		t.Errorf("expected replaced ban to be lifted")
+	}
+
+	w = httptest.NewRecorder()
+	DeleteBanHandler(ctx, conf)(w, httptest.NewRequest("DELETE", "http://example.com/api/bans?kind=cidr&value=198.51.100.7", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d lifting ban, got %d", http.StatusOK, w.Code)
+	}
+	w = httptest.NewRecorder()
+	DeleteBanHandler(ctx, conf)(w, httptest.NewRequest("DELETE", "http://example.com/api/bans?kind=cidr&value=198.51.100.7", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %d lifting unknown ban, got %d", http.StatusNotFound, w.Code)
+	}
+}
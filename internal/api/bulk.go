@@ -0,0 +1,238 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/events"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// MaxBulkInfohashes is the most infohashes which can be imported by one
+// request to BulkInfohashesHandler.
+const MaxBulkInfohashes = 100_000
+
+// BulkImport is the result of a bulk import of infohashes. Infohashes which
+// were already tracked are skipped, and keep their names and labels.
+type BulkImport struct {
+	Added   int `json:"added"`
+	Skipped int `json:"skipped"`
+}
+
+// InfohashExport is an infohash as dumped by ExportInfohashesHandler. The
+// dump can be imported again with BulkInfohashesHandler, although the
+// download count, creation time, and status are not imported.
+type InfohashExport struct {
+	Info_hash    []byte    `json:"info_hash"`
+	Name         string    `json:"name"`
+	Category     string    `json:"category,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+	Length       *int64    `json:"length,omitempty"`
+	Downloaded   int       `json:"downloaded"`
+	Created_time time.Time `json:"created_time"`
+	Archived     bool      `json:"archived"`
+	Retired      bool      `json:"retired"`
+	Merged_into  []byte    `json:"merged_into,omitempty"`
+}
+
+// parseBulkText parses a newline-delimited list of hex-encoded infohashes,
+// each optionally followed by whitespace and a name. Blank lines and lines
+// starting with # are skipped.
+func parseBulkText(r io.Reader) ([]InfohashPost, error) {
+	var infohashes []InfohashPost
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hexHash, name := line, ""
+		if i := strings.IndexFunc(line, unicode.IsSpace); i >= 0 {
+			hexHash, name = line[:i], line[i:]
+		}
+		info_hash, err := hex.DecodeString(hexHash)
+		if err != nil || len(info_hash) != 20 {
+			return nil, fmt.Errorf("invalid infohash on line %d", n)
+		}
+		infohashes = append(infohashes, InfohashPost{Info_hash: info_hash, Name: strings.TrimSpace(name)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read body: %w", err)
+	}
+	return infohashes, nil
+}
+
+// parseBulkJSON parses a JSON array of infohashes as posted to
+// PostInfohashHandler.
+func parseBulkJSON(r io.Reader) ([]InfohashPost, error) {
+	var infohashes []InfohashPost
+	if err := json.NewDecoder(r).Decode(&infohashes); err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return nil, err
+		}
+		return nil, errors.New("did not receive valid JSON array of infohashes")
+	}
+	for i, infohash := range infohashes {
+		if len(infohash.Info_hash) != 20 {
+			return nil, fmt.Errorf("invalid infohash at index %d", i)
+		}
+	}
+	return infohashes, nil
+}
+
+// BulkInfohashesHandler takes a POST request to the /api/infohashes/bulk
+// endpoint, to migrate infohashes from another tracker. With a JSON content
+// type, the body is a JSON array of infohashes as posted to
+// PostInfohashHandler; otherwise, it is a newline-delimited list of
+// hex-encoded infohashes, each optionally followed by a space and a name. At
+// most MaxBulkInfohashes are accepted, and bodies larger than MaxUploadSize
+// are refused. The infohashes are validated before any is inserted, and
+// inserted in one transaction. Infohashes which are already tracked are
+// skipped, see BulkImport.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func BulkInfohashesHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conf.MaxUploadSize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, conf.MaxUploadSize)
+		}
+
+		parse := parseBulkText
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			parse = parseBulkJSON
+		}
+		infohashes, err := parse(r.Body)
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			writeError(w, http.StatusRequestEntityTooLarge, MessageJSON{"error: body too large"})
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
+		if len(infohashes) > MaxBulkInfohashes {
+			writeError(w, http.StatusBadRequest, MessageJSON{fmt.Sprintf("error: at most %d infohashes can be imported at once", MaxBulkInfohashes)})
+			return
+		}
+
+		labels := make([]struct {
+			category string
+			tags     []string
+		}, len(infohashes))
+		for i, infohash := range infohashes {
+			labels[i].category, labels[i].tags, err = normalizeLabels(infohash.Category, infohash.Tags)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, MessageJSON{fmt.Sprintf("error: %v at index %d", err, i)})
+				return
+			}
+		}
+
+		tx, err := conf.Dbpool.Begin(ctx)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error inserting infohashes"})
+			return
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
+
+		batch := &pgx.Batch{}
+		for i, infohash := range infohashes {
+			batch.Queue(`
+				INSERT INTO infohashes (info_hash, name, category, tags)
+				    VALUES ($1, $2, $3, $4)
+				ON CONFLICT (info_hash)
+				    DO NOTHING
+				`,
+				infohash.Info_hash, infohash.Name, labels[i].category, labels[i].tags)
+		}
+		results := tx.SendBatch(ctx, batch)
+		var added []InfohashPost
+		for _, infohash := range infohashes {
+			tag, err := results.Exec()
+			if err != nil {
+				results.Close()
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error inserting infohashes"})
+				return
+			}
+			if tag.RowsAffected() > 0 {
+				added = append(added, infohash)
+			}
+		}
+		if err = results.Close(); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error inserting infohashes"})
+			return
+		}
+		if err = tx.Commit(ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error inserting infohashes"})
+			return
+		}
+
+		for _, infohash := range added {
+			conf.Publish(events.Event{Kind: events.InfohashAdded, Info_hash: infohash.Info_hash, Name: infohash.Name})
+		}
+
+		response, err := json.Marshal(BulkImport{Added: len(added), Skipped: len(infohashes) - len(added)})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// ExportInfohashesHandler dumps every infohash, including archived, retired,
+// and merged ones, in order of creation, see InfohashExport.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func ExportInfohashesHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, _ := conf.Dbpool.Query(ctx, `
+			SELECT
+			    infohashes.info_hash,
+			    infohashes.name,
+			    infohashes.category,
+			    infohashes.tags,
+			    infohashes.length,
+			    infohashes.downloaded,
+			    infohashes.created_time,
+			    infohashes.archived_time IS NOT NULL,
+			    infohashes.retired_time IS NOT NULL,
+			    canonical.info_hash
+			FROM
+			    infohashes
+			    LEFT JOIN infohashes canonical ON infohashes.merged_into = canonical.id
+			ORDER BY
+			    infohashes.created_time,
+			    infohashes.id
+			`)
+		infohashes, err := pgx.CollectRows(rows, pgx.RowToStructByPos[InfohashExport])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+		if infohashes == nil {
+			infohashes = []InfohashExport{}
+		}
+
+		response, err := json.Marshal(infohashes)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
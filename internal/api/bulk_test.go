@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseBulkText(t *testing.T) {
+	a := strings.Repeat("ab", 20)
+	b := strings.Repeat("cd", 20)
+
+	data := []struct {
+		name     string
+		body     string
+		expected []string
+		err      bool
+	}{
+		{"names", a + " debian.iso\n" + b + "\tubuntu 24.04.iso\n", []string{"debian.iso", "ubuntu 24.04.iso"}, false},
+		{"no name", a + "\n", []string{""}, false},
+		{"comments and blank lines", "# exported\n\n" + a + " debian.iso\n", []string{"debian.iso"}, false},
+		{"short infohash", "abcd debian.iso\n", nil, true},
+		{"not hex", strings.Repeat("zz", 20) + "\n", nil, true},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			infohashes, err := parseBulkText(strings.NewReader(d.body))
+			if d.err {
+				if err == nil {
+					t.Errorf("expected error, got %v", infohashes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var names []string
+			for _, infohash := range infohashes {
+				if len(infohash.Info_hash) != 20 {
+					t.Errorf("expected 20 byte infohash, got %x", infohash.Info_hash)
+				}
+				names = append(names, infohash.Name)
+			}
+			if diff := cmp.Diff(d.expected, names); diff != "" {
+				t.Errorf("names mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBulkInfohashes(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	bulkHandler := BulkInfohashesHandler(ctx, conf)
+	post := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://example.com/api/infohashes/bulk", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		bulkHandler(w, req)
+		return w
+	}
+
+	// One infohash of the list is already tracked.
+	list := hex.EncodeToString([]byte(testutils.AllowedInfoHashes["a"])) + " existing\n" +
+		strings.Repeat("01", 20) + " new one\n" +
+		strings.Repeat("02", 20) + "\n"
+	w := post("text/plain", []byte(list))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	var result BulkImport
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if diff := cmp.Diff(BulkImport{Added: 2, Skipped: 1}, result); diff != "" {
+		t.Errorf("import mismatch (-want +got):\n%s", diff)
+	}
+
+	// Nothing is inserted if any infohash is invalid.
+	body, err := json.Marshal([]InfohashPost{
+		{Info_hash: bytes.Repeat([]byte{3}, 20), Name: "valid"},
+		{Info_hash: []byte("short"), Name: "invalid"},
+	})
+	if err != nil {
+		t.Fatalf("error marshaling request body: %v", err)
+	}
+	if w = post("application/json", body); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	ExportInfohashesHandler(ctx, conf)(w, httptest.NewRequest("GET", "http://example.com/api/infohashes/export", nil))
+	var infohashes []InfohashExport
+	if err := json.NewDecoder(w.Body).Decode(&infohashes); err != nil {
+		t.Fatalf("error decoding export: %v", err)
+	}
+	names := map[string]string{}
+	for _, infohash := range infohashes {
+		names[string(infohash.Info_hash)] = infohash.Name
+	}
+	if len(names) != len(testutils.AllowedInfoHashes)+2 {
+		t.Errorf("expected %d infohashes exported, got %d", len(testutils.AllowedInfoHashes)+2, len(names))
+	}
+	if name := names[string(bytes.Repeat([]byte{1}, 20))]; name != "new one" {
+		t.Errorf("expected imported name %q, got %q", "new one", name)
+	}
+	if _, ok := names[string(bytes.Repeat([]byte{3}, 20))]; ok {
+		t.Errorf("expected invalid import to insert nothing")
+	}
+}
@@ -0,0 +1,347 @@
+package api
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// CatalogVersion is the version of the Catalog format. It is incremented
+// whenever a field is removed or changes meaning, so that indexers can
+// refuse catalogs they do not understand.
+const CatalogVersion = 1
+
+// IndexerKeyLength is the length of the hex keys given to indexers.
+const IndexerKeyLength = 32
+
+var ErrCatalogSignature = errors.New("invalid catalog signature")
+
+// CatalogEntry is the metadata of a single tracked infohash. Length is nil
+// for infohashes added without a torrent file.
+type CatalogEntry struct {
+	Name       string   `json:"name"`
+	Info_hash  []byte   `json:"info_hash"`
+	Length     *int64   `json:"length"`
+	Downloaded int      `json:"downloaded"`
+	Seeders    int      `json:"seeders"`
+	Leechers   int      `json:"leechers"`
+	Category   string   `json:"category,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+// Catalog is a snapshot of every tracked infohash for external indexers.
+type Catalog struct {
+	Version   int             `json:"version"`
+	Generated time.Time       `json:"generated"`
+	Entries   []*CatalogEntry `json:"entries"`
+}
+
+// SignedCatalog is the container in which a Catalog is served. The payload
+// is the JSON encoding of the Catalog, and the signature is the Ed25519
+// signature of the payload by the tracker's catalog signing key. The
+// payload is kept as bytes so that it can be verified exactly as signed.
+type SignedCatalog struct {
+	Version   int    `json:"version"`
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+type CatalogPublicKey struct {
+	Public_key []byte `json:"public_key"`
+}
+
+// Indexer is a consumer of the catalog. The key itself is only returned
+// when the indexer is added, as an IndexerKey.
+type Indexer struct {
+	Name         string     `json:"name"`
+	Created_time time.Time  `json:"created_time"`
+	Last_used    *time.Time `json:"last_used"`
+}
+
+type IndexerKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// VerifyCatalog checks the signature of a SignedCatalog against the
+// tracker's public key, and returns the Catalog it contains.
+func VerifyCatalog(publicKey ed25519.PublicKey, signed *SignedCatalog) (*Catalog, error) {
+	if len(publicKey) != ed25519.PublicKeySize || !ed25519.Verify(publicKey, signed.Payload, signed.Signature) {
+		return nil, ErrCatalogSignature
+	}
+
+	var catalog Catalog
+	if err := json.Unmarshal(signed.Payload, &catalog); err != nil {
+		return nil, fmt.Errorf("error decoding catalog: %w", err)
+	}
+	if catalog.Version != signed.Version {
+		return nil, fmt.Errorf("%w: version mismatch", ErrCatalogSignature)
+	}
+
+	return &catalog, nil
+}
+
+// hashIndexerKey returns the hash under which an indexer key is stored, so
+// that keys cannot be recovered from the database.
+func hashIndexerKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// WithIndexerAuthorization is middleware which rejects any request without
+// a valid indexer key in the Authorization header, and records when each
+// key was last used.
+func WithIndexerAuthorization(ctx context.Context, conf config.Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Authorization")
+			if key == "" {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: catalog request with empty authorization header"})
+				return
+			}
+
+			var name string
+			err := conf.Dbpool.QueryRow(ctx, `
+				UPDATE indexer_keys
+				SET last_used = $2
+				WHERE key_hash = $1
+				RETURNING name
+				`,
+				hashIndexerKey(key), conf.Now()).Scan(&name)
+			if err != nil {
+				if errors.Is(err, pgx.ErrNoRows) {
+					writeError(w, http.StatusForbidden, MessageJSON{"error: invalid indexer key"})
+					return
+				}
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to validate indexer key"})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// queryCatalog returns the catalog entry of every tracked infohash which is
+// not archived or restricted by an ACL, ordered by name.
+func queryCatalog(ctx context.Context, conf config.Config) ([]*CatalogEntry, error) {
+	query := `
+		WITH ` + db.RecentAnnounces(1, 2, "amount_left") + `
+		SELECT
+		    name,
+		    info_hash,
+		    length,
+		    downloaded,
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left = 0) AS seeders,
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left > 0) AS leechers,
+		    category,
+		    tags
+		FROM
+		    infohashes
+		    LEFT JOIN recent_announces ON infohashes.id = recent_announces.info_hash_id
+		WHERE
+		    infohashes.archived_time IS NULL
+		    AND infohashes.merged_into IS NULL
+		    AND ` + noACL + `
+		GROUP BY
+		    info_hash,
+		    name,
+		    length,
+		    downloaded,
+		    category,
+		    tags
+		ORDER BY
+		    name
+		`
+
+	rows, err := conf.Dbpool.Query(ctx, query, config.Stopped, conf.StaleCutoff())
+	if err != nil {
+		return nil, fmt.Errorf("error querying catalog: %w", err)
+	}
+
+	entries, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[CatalogEntry])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing catalog: %w", err)
+	}
+
+	return entries, nil
+}
+
+// CatalogHandler returns a SignedCatalog of every tracked infohash, for
+// external indexers. It is disabled unless a catalog signing key is
+// configured.
+//
+// This endpoint requires an indexer key, see WithIndexerAuthorization.
+func CatalogHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conf.CatalogSigningKey == nil {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: catalog disabled"})
+			return
+		}
+
+		entries, err := queryCatalog(ctx, conf)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		payload, err := json.Marshal(Catalog{Version: CatalogVersion, Generated: conf.Now().UTC(), Entries: entries})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+
+		response, err := json.Marshal(SignedCatalog{
+			Version:   CatalogVersion,
+			Payload:   payload,
+			Signature: ed25519.Sign(conf.CatalogSigningKey, payload),
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// CatalogPublicKeyHandler returns the public key with which catalogs are
+// signed.
+func CatalogPublicKeyHandler(conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conf.CatalogSigningKey == nil {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: catalog disabled"})
+			return
+		}
+
+		response, err := json.Marshal(CatalogPublicKey{Public_key: conf.CatalogSigningKey.Public().(ed25519.PublicKey)})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// GetIndexersHandler lists the indexers which have catalog keys.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetIndexersHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT name, created_time, last_used
+			FROM indexer_keys
+			ORDER BY name
+			`)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		indexers, err := pgx.CollectRows(rows, pgx.RowToStructByName[Indexer])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+		if indexers == nil {
+			indexers = []Indexer{}
+		}
+
+		response, err := json.Marshal(indexers)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PostIndexerHandler takes a POST request with a JSON body naming a new
+// indexer, and returns a new catalog key for it. Only a hash of the key is
+// stored, so it cannot be shown again.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PostIndexerHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var indexer Indexer
+		err := json.NewDecoder(r.Body).Decode(&indexer)
+		if err != nil || indexer.Name == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid indexer name"})
+			return
+		}
+
+		randomBytes := make([]byte, IndexerKeyLength/2)
+		_, _ = rand.Read(randomBytes)
+		key := hex.EncodeToString(randomBytes)
+
+		_, err = conf.Dbpool.Exec(ctx, `
+			INSERT INTO indexer_keys (name, key_hash, created_time)
+			    VALUES ($1, $2, $3)
+			`,
+			indexer.Name, hashIndexerKey(key), conf.Now())
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: indexer already exists"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error inserting indexer"})
+			return
+		}
+
+		response, err := json.Marshal(IndexerKey{Name: indexer.Name, Key: key})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success adding indexer, but error making response"})
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// DeleteIndexerHandler takes a DELETE request with a name query field, and
+// revokes that indexer's catalog key.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func DeleteIndexerHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: no indexer name provided in query"})
+			return
+		}
+
+		tag, err := conf.Dbpool.Exec(ctx, `
+			DELETE FROM indexer_keys
+			WHERE name = $1
+			`,
+			name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not delete indexer"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: unknown indexer"})
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
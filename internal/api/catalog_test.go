@@ -0,0 +1,159 @@
+package api
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestCatalog(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	catalogHandler := WithIndexerAuthorization(ctx, conf)(http.HandlerFunc(CatalogHandler(ctx, conf)))
+
+	w := httptest.NewRecorder()
+	catalogHandler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/api/catalog", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d without key, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	PostIndexerHandler(ctx, conf)(w, httptest.NewRequest("POST", "http://example.com/api/indexers", strings.NewReader(`{"name": "indexer"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected %d adding indexer, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	var key IndexerKey
+	if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+		t.Fatalf("error decoding indexer key: %v", err)
+	}
+	if len(key.Key) != IndexerKeyLength {
+		t.Errorf("expected key of length %d, got %q", IndexerKeyLength, key.Key)
+	}
+
+	w = httptest.NewRecorder()
+	PostIndexerHandler(ctx, conf)(w, httptest.NewRequest("POST", "http://example.com/api/indexers", strings.NewReader(`{"name": "indexer"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for duplicate indexer, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	request := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://example.com/api/catalog", nil)
+		r.Header.Set("Authorization", key)
+		w := httptest.NewRecorder()
+		catalogHandler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w = request("wrong"); w.Code != http.StatusForbidden {
+		t.Errorf("expected %d with wrong key, got %d", http.StatusForbidden, w.Code)
+	}
+
+	// Without a signing key, the catalog is disabled.
+	if w = request(key.Key); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d with catalog disabled, got %d", http.StatusNotFound, w.Code)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("error generating signing key: %v", err)
+	}
+	conf.CatalogSigningKey = privateKey
+	catalogHandler = WithIndexerAuthorization(ctx, conf)(http.HandlerFunc(CatalogHandler(ctx, conf)))
+
+	w = request(key.Key)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var signed SignedCatalog
+	if err := json.NewDecoder(w.Body).Decode(&signed); err != nil {
+		t.Fatalf("error decoding catalog: %v", err)
+	}
+	catalog, err := VerifyCatalog(publicKey, &signed)
+	if err != nil {
+		t.Fatalf("error verifying catalog: %v", err)
+	}
+	if catalog.Version != CatalogVersion {
+		t.Errorf("expected version %d, got %d", CatalogVersion, catalog.Version)
+	}
+	if len(catalog.Entries) != len(testutils.AllowedInfoHashes) {
+		t.Errorf("expected %d entries, got %d", len(testutils.AllowedInfoHashes), len(catalog.Entries))
+	}
+
+	w = httptest.NewRecorder()
+	CatalogPublicKeyHandler(conf)(w, httptest.NewRequest("GET", "http://example.com/api/catalog/publickey", nil))
+	var received CatalogPublicKey
+	if err := json.NewDecoder(w.Body).Decode(&received); err != nil {
+		t.Fatalf("error decoding public key: %v", err)
+	}
+	if !publicKey.Equal(ed25519.PublicKey(received.Public_key)) {
+		t.Errorf("expected public key %x, got %x", publicKey, received.Public_key)
+	}
+
+	w = httptest.NewRecorder()
+	GetIndexersHandler(ctx, conf)(w, httptest.NewRequest("GET", "http://example.com/api/indexers", nil))
+	var indexers []Indexer
+	if err := json.NewDecoder(w.Body).Decode(&indexers); err != nil {
+		t.Fatalf("error decoding indexers: %v", err)
+	}
+	if len(indexers) != 1 || indexers[0].Name != "indexer" || indexers[0].Last_used == nil {
+		t.Errorf("expected one used indexer, got %v", indexers)
+	}
+
+	w = httptest.NewRecorder()
+	DeleteIndexerHandler(ctx, conf)(w, httptest.NewRequest("DELETE", "http://example.com/api/indexers?name=indexer", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d deleting indexer, got %d", http.StatusOK, w.Code)
+	}
+
+	if w = request(key.Key); w.Code != http.StatusForbidden {
+		t.Errorf("expected %d with revoked key, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestVerifyCatalog(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("error generating signing key: %v", err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("error generating signing key: %v", err)
+	}
+
+	payload := []byte(`{"version": 1, "entries": [{"name": "test"}]}`)
+	signed := SignedCatalog{Version: 1, Payload: payload, Signature: ed25519.Sign(privateKey, payload)}
+
+	catalog, err := VerifyCatalog(publicKey, &signed)
+	if err != nil {
+		t.Fatalf("error verifying catalog: %v", err)
+	}
+	if len(catalog.Entries) != 1 || catalog.Entries[0].Name != "test" {
+		t.Errorf("unexpected catalog entries %v", catalog.Entries)
+	}
+
+	if _, err := VerifyCatalog(otherKey, &signed); !errors.Is(err, ErrCatalogSignature) {
+		t.Errorf("expected signature error with wrong key, got %v", err)
+	}
+
+	tampered := signed
+	tampered.Payload = []byte(`{"version": 1, "entries": []}`)
+	if _, err := VerifyCatalog(publicKey, &tampered); !errors.Is(err, ErrCatalogSignature) {
+		t.Errorf("expected signature error with tampered payload, got %v", err)
+	}
+
+	mismatched := signed
+	mismatched.Version = 2
+	if _, err := VerifyCatalog(publicKey, &mismatched); !errors.Is(err, ErrCatalogSignature) {
+		t.Errorf("expected signature error with mismatched version, got %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ClientCert maps a client TLS certificate, by its hex-encoded SHA-256
+// fingerprint, to the announce key it announces as. See
+// handler.WithClientCertificate.
+type ClientCert struct {
+	Fingerprint  string    `json:"fingerprint"`
+	Announce_key string    `json:"announce_key"`
+	Subject      string    `json:"subject"`
+	Created_time time.Time `json:"created_time"`
+}
+
+// ClientCertPost is a PEM-encoded client certificate to map to an announce
+// key.
+type ClientCertPost struct {
+	Announce_key string `json:"announce_key"`
+	Certificate  string `json:"certificate"`
+}
+
+// GetClientCertsHandler lists the client certificates mapped to announce
+// keys.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetClientCertsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT
+			    encode(fingerprint, 'hex'),
+			    announce_key,
+			    subject,
+			    client_certs.created_time
+			FROM
+			    client_certs
+			    JOIN peers ON client_certs.peers_id = peers.id
+			ORDER BY
+			    client_certs.created_time
+			`)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		certs, err := pgx.CollectRows(rows, pgx.RowToStructByPos[ClientCert])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+		if certs == nil {
+			certs = []ClientCert{}
+		}
+
+		response, err := json.Marshal(certs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PostClientCertHandler takes a POST request with a ClientCertPost body, and
+// maps the certificate to the announce key, returning the ClientCert. Only
+// the fingerprint and subject of the certificate are stored. The
+// certificate must still be signed by one of the client CAs to be accepted
+// by the listener.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PostClientCertHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var post ClientCertPost
+		err := json.NewDecoder(r.Body).Decode(&post)
+		if err != nil || post.Announce_key == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid client certificate"})
+			return
+		}
+
+		block, _ := pem.Decode([]byte(post.Certificate))
+		if block == nil || block.Type != "CERTIFICATE" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive PEM-encoded certificate"})
+			return
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{fmt.Sprintf("error: invalid certificate: %v", err)})
+			return
+		}
+
+		clientCert := ClientCert{
+			Fingerprint:  hex.EncodeToString(handler.CertificateFingerprint(cert)),
+			Announce_key: post.Announce_key,
+			Subject:      cert.Subject.String(),
+			Created_time: conf.Now(),
+		}
+
+		var peers_id int
+		err = conf.Dbpool.QueryRow(ctx, `
+			SELECT
+			    id
+			FROM
+			    peers
+			WHERE
+			    announce_key = $1
+			`,
+			post.Announce_key).Scan(&peers_id)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeError(w, http.StatusNotFound, MessageJSON{"error: unknown announce key"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		_, err = conf.Dbpool.Exec(ctx, `
+			INSERT INTO client_certs (fingerprint, peers_id, subject, created_time)
+			    VALUES ($1, $2, $3, $4)
+			`,
+			handler.CertificateFingerprint(cert), peers_id, clientCert.Subject, clientCert.Created_time)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: client certificate already mapped"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not add client certificate"})
+			return
+		}
+
+		response, err := json.Marshal(clientCert)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success adding, but error making response"})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// DeleteClientCertHandler takes a DELETE request for a client certificate
+// by hex-encoded fingerprint, and removes its mapping, so that it can no
+// longer announce.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func DeleteClientCertHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fingerprint, err := hex.DecodeString(r.PathValue("fingerprint"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid fingerprint"})
+			return
+		}
+
+		tag, err := conf.Dbpool.Exec(ctx, `
+			DELETE FROM client_certs
+			WHERE fingerprint = $1
+			`,
+			fingerprint)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not delete client certificate"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: unknown client certificate"})
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
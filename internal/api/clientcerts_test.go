@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestClientCerts(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	mux := http.NewServeMux()
+	identity := func(h http.Handler) http.Handler { return h }
+	MuxAPIRoutes(ctx, conf, mux, identity, identity, identity)
+
+	request := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", testutils.DefaultAPIKey)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "seedbox"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := json.Marshal(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := request("POST", "http://example.com/api/clientcerts", `{"announce_key": "unknown", "certificate": `+string(certPEM)+`}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d for unknown key, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := request("POST", "http://example.com/api/clientcerts", `{"announce_key": "`+testutils.AnnounceKeys[1]+`", "certificate": "not pem"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for invalid certificate, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w := request("POST", "http://example.com/api/clientcerts", `{"announce_key": "`+testutils.AnnounceKeys[1]+`", "certificate": `+string(certPEM)+`}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected %d, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	var added ClientCert
+	if err = json.NewDecoder(w.Body).Decode(&added); err != nil {
+		t.Fatalf("error decoding client certificate: %v", err)
+	}
+	if added.Subject != "CN=seedbox" {
+		t.Errorf("expected subject CN=seedbox, got %s", added.Subject)
+	}
+
+	var certs []ClientCert
+	if err = json.NewDecoder(request("GET", "http://example.com/api/clientcerts", "").Body).Decode(&certs); err != nil {
+		t.Fatalf("error decoding client certificates: %v", err)
+	}
+	if len(certs) != 1 || certs[0].Fingerprint != added.Fingerprint || certs[0].Announce_key != testutils.AnnounceKeys[1] {
+		t.Errorf("expected the added client certificate, got %v", certs)
+	}
+
+	announce := handler.WithClientCertificate(ctx, conf)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.PathValue("id")))
+	}))
+	announceWith := func(state *tls.ConnectionState) string {
+		r := httptest.NewRequest("GET", "https://example.com/announce", nil)
+		r.TLS = state
+		w := httptest.NewRecorder()
+		announce.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	if got := announceWith(verified); got != testutils.AnnounceKeys[1] {
+		t.Errorf("expected announce as %s, got %s", testutils.AnnounceKeys[1], got)
+	}
+	if got := announceWith(nil); !strings.Contains(got, "failure reason") {
+		t.Errorf("expected failure without a certificate, got %s", got)
+	}
+
+	if w := request("DELETE", "http://example.com/api/clientcerts/"+added.Fingerprint, ""); w.Code != http.StatusOK {
+		t.Errorf("expected %d deleting, got %d", http.StatusOK, w.Code)
+	}
+	if got := announceWith(verified); !strings.Contains(got, "failure reason") {
+		t.Errorf("expected failure after deleting the mapping, got %s", got)
+	}
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/debuglog"
+	"github.com/dmoerner/etracker/internal/handler"
+)
+
+// RuntimeStatus is a snapshot of the process and its connection pools, see
+// RuntimeHandler. Memory is in bytes.
+type RuntimeStatus struct {
+	Goroutines   int                `json:"goroutines"`
+	Heap_alloc   uint64             `json:"heap_alloc"`
+	Heap_objects uint64             `json:"heap_objects"`
+	Sys          uint64             `json:"sys"`
+	Num_gc       uint32             `json:"num_gc"`
+	Postgres     PostgresPoolStatus `json:"postgres"`
+	Redis        RedisPoolStatus    `json:"redis"`
+	Caches       map[string]int64   `json:"caches"`
+}
+
+// PostgresPoolStatus is the state of the Postgres connection pool.
+type PostgresPoolStatus struct {
+	Total_conns         int32 `json:"total_conns"`
+	Idle_conns          int32 `json:"idle_conns"`
+	Acquired_conns      int32 `json:"acquired_conns"`
+	Max_conns           int32 `json:"max_conns"`
+	Acquire_count       int64 `json:"acquire_count"`
+	Empty_acquire_count int64 `json:"empty_acquire_count"`
+}
+
+// RedisPoolStatus is the state of the Redis connection pool.
+type RedisPoolStatus struct {
+	Total_conns uint32 `json:"total_conns"`
+	Idle_conns  uint32 `json:"idle_conns"`
+	Stale_conns uint32 `json:"stale_conns"`
+	Hits        uint32 `json:"hits"`
+	Misses      uint32 `json:"misses"`
+	Timeouts    uint32 `json:"timeouts"`
+}
+
+// RecentAnnouncesHandler takes a GET request with optional outcome and
+// limit query fields, and returns the decisions made for the most recent
+// announces handled by this tracker instance, newest first, see the
+// debuglog package. With an outcome, only decisions with that outcome are
+// returned. It fails with 404 if recent decisions are not kept.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func RecentAnnouncesHandler(conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conf.Recent == nil {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: recent announces are not kept, see ETRACKER_DEBUG_RECENT"})
+			return
+		}
+
+		limit := debuglog.MaxSize
+		if limitString := r.URL.Query().Get("limit"); limitString != "" {
+			var err error
+			limit, err = strconv.Atoi(limitString)
+			if err != nil || limit <= 0 {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid limit"})
+				return
+			}
+		}
+		outcome := r.URL.Query().Get("outcome")
+
+		decisions := []debuglog.Decision{}
+		for _, d := range conf.Recent.Recent() {
+			if len(decisions) == limit {
+				break
+			}
+			if outcome == "" || d.Outcome == outcome {
+				decisions = append(decisions, d)
+			}
+		}
+
+		response, err := json.Marshal(decisions)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// RuntimeHandler takes a GET request and returns the RuntimeStatus of this
+// tracker instance: goroutines, memory, the Postgres and Redis pools, and
+// the number of entries in each cache, including the keys in Redis, which
+// are left out if Redis cannot be reached.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func RuntimeHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+
+		status := RuntimeStatus{
+			Goroutines:   runtime.NumGoroutine(),
+			Heap_alloc:   mem.HeapAlloc,
+			Heap_objects: mem.HeapObjects,
+			Sys:          mem.Sys,
+			Num_gc:       mem.NumGC,
+			Caches:       map[string]int64{"recent": int64(conf.Recent.Len())},
+		}
+
+		pg := conf.Dbpool.Stat()
+		status.Postgres = PostgresPoolStatus{
+			Total_conns:         pg.TotalConns(),
+			Idle_conns:          pg.IdleConns(),
+			Acquired_conns:      pg.AcquiredConns(),
+			Max_conns:           pg.MaxConns(),
+			Acquire_count:       pg.AcquireCount(),
+			Empty_acquire_count: pg.EmptyAcquireCount(),
+		}
+
+		rdb := conf.Rdb.PoolStats()
+		status.Redis = RedisPoolStatus{
+			Total_conns: rdb.TotalConns,
+			Idle_conns:  rdb.IdleConns,
+			Stale_conns: rdb.StaleConns,
+			Hits:        rdb.Hits,
+			Misses:      rdb.Misses,
+			Timeouts:    rdb.Timeouts,
+		}
+
+		for name, size := range handler.CacheSizes(conf) {
+			status.Caches[name] = int64(size)
+		}
+		if keys, err := conf.Rdb.DBSize(ctx).Result(); err == nil {
+			status.Caches["redis_keys"] = keys
+		} else {
+			log.Printf("Error counting Redis keys: %v", err)
+		}
+
+		response, err := json.Marshal(status)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
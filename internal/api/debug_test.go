@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/debuglog"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestRecentAnnounces(t *testing.T) {
+	request := func(conf config.Config, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		RecentAnnouncesHandler(conf)(w, httptest.NewRequest("GET", url, nil))
+		return w
+	}
+
+	if w := request(config.Config{}, "http://example.com/api/debug/recent"); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d when recent announces are not kept, got %d", http.StatusNotFound, w.Code)
+	}
+
+	conf := config.Config{Recent: debuglog.NewRing(10)}
+	for _, outcome := range []string{debuglog.OutcomeOK, debuglog.OutcomeRejected, debuglog.OutcomeOK} {
+		d := conf.Recent.Start(time.Now())
+		if outcome != debuglog.OutcomeOK {
+			d.SetOutcome(outcome, nil)
+		}
+		conf.Recent.Record(d)
+	}
+
+	data := []struct {
+		query    string
+		expected int
+	}{
+		{"", 3},
+		{"?outcome=ok", 2},
+		{"?outcome=rejected", 1},
+		{"?outcome=ok&limit=1", 1},
+	}
+
+	for _, d := range data {
+		w := request(conf, "http://example.com/api/debug/recent"+d.query)
+		var decisions []debuglog.Decision
+		if err := json.Unmarshal(w.Body.Bytes(), &decisions); err != nil {
+			t.Fatalf("%q: error decoding decisions: %v", d.query, err)
+		}
+		if len(decisions) != d.expected {
+			t.Errorf("%q: expected %d decisions, got %d", d.query, d.expected, len(decisions))
+		}
+	}
+
+	if w := request(conf, "http://example.com/api/debug/recent?limit=0"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for invalid limit, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestRuntime(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, nil, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	w := httptest.NewRecorder()
+	RuntimeHandler(ctx, conf)(w, httptest.NewRequest("GET", "http://example.com/api/debug/runtime", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var status RuntimeStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("error decoding runtime status: %v", err)
+	}
+	if status.Goroutines == 0 || status.Postgres.Max_conns == 0 {
+		t.Errorf("expected goroutines and a Postgres pool, got %+v", status)
+	}
+	for _, cache := range []string{"bans", "promotions", "recent", "redis_keys"} {
+		if _, ok := status.Caches[cache]; !ok {
+			t.Errorf("expected size of cache %s, got %v", cache, status.Caches)
+		}
+	}
+}
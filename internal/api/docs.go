@@ -0,0 +1,56 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/dmoerner/etracker/internal/config"
+)
+
+// openAPIDocument describes the REST API. It must be updated alongside
+// MuxAPIRoutes.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// docsPage is an interactive console which renders openAPIDocument and sends
+// requests to the API from the browser.
+//
+//go:embed docs.html
+var docsPage []byte
+
+// WithDocsAuthorization is like WithAuthorization, but also accepts the API
+// key as the password of HTTP basic authentication, and otherwise asks for
+// it, so that the API console can be opened in a browser.
+func WithDocsAuthorization(conf config.Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, password, ok := r.BasicAuth(); ok && conf.Authorization != "" && password == conf.Authorization {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.Header.Get("Authorization") == "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="etracker API", charset="UTF-8"`)
+				writeError(w, http.StatusUnauthorized, MessageJSON{"error: restricted API request with empty authorization header"})
+				return
+			}
+			WithAuthorization(conf)(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// OpenAPIHandler serves the OpenAPI document describing the REST API.
+//
+// This is an authorization-only endpoint, see WithDocsAuthorization.
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPIDocument)
+}
+
+// DocsHandler serves the interactive API console.
+//
+// This is an authorization-only endpoint, see WithDocsAuthorization.
+func DocsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(docsPage)
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/dmoerner/etracker/internal/config"
+)
+
+// FeatureFlags are whether each known feature is enabled, by name, see
+// config.Feature.
+type FeatureFlags = config.FeatureFlags
+
+// FeaturesHandler returns whether each known feature is enabled in this
+// deployment, so that clients such as the frontend can hide what is not.
+func FeaturesHandler(conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response, err := json.Marshal(conf.Features.All())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
@@ -0,0 +1,24 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/config"
+)
+
+func TestFeatures(t *testing.T) {
+	conf := config.Config{Features: config.FeatureFlags{config.FeatureWebTorrent: false}}
+
+	w := httptest.NewRecorder()
+	FeaturesHandler(conf)(w, httptest.NewRequest("GET", "http://example.com/api/features", nil))
+
+	var features FeatureFlags
+	if err := json.NewDecoder(w.Body).Decode(&features); err != nil {
+		t.Fatalf("error decoding features: %v", err)
+	}
+	if features[config.FeatureWebTorrent] || !features[config.FeatureGeoIP] {
+		t.Errorf("expected webtorrent disabled and geoip enabled, got %v", features)
+	}
+}
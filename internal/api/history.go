@@ -0,0 +1,41 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/history"
+)
+
+// StatsHistoryPoint is one point of the stats history, see history.Point.
+type StatsHistoryPoint = history.Point
+
+// StatsHistoryHandler presents a REST API on /api/stats/history which returns
+// the stats history over the range query field, such as "24h" or "30d",
+// oldest first. Ranges of up to a week have hourly points, and longer ranges
+// daily points. The default range is a week.
+func StatsHistoryHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		historyRange, err := history.ParseRange(r.URL.Query().Get("range"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
+
+		points, err := history.Query(ctx, conf, historyRange)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		response, err := json.Marshal(points)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// InviteCodeLength is the length of the hex invite codes.
+const InviteCodeLength = 32
+
+var ErrInvalidInvite = errors.New("invalid invite code")
+
+// Invite is a single-use invite code, required to generate an announce key
+// when RequireInvite is set. The code itself is only returned when the
+// invite is created, as an InviteCode. Announce_key is the key generated
+// with the invite, if it has been used and the key has not been deleted.
+type Invite struct {
+	Id           int        `json:"id"`
+	Note         string     `json:"note"`
+	Created_time time.Time  `json:"created_time"`
+	Used_time    *time.Time `json:"used_time"`
+	Announce_key *string    `json:"announce_key"`
+}
+
+type InviteCode struct {
+	Id   int    `json:"id"`
+	Note string `json:"note"`
+	Code string `json:"code"`
+}
+
+// redeemInvite marks an unused invite as used, and returns its id. Since
+// the invite is marked in a single statement, concurrent requests cannot
+// both redeem it.
+func redeemInvite(ctx context.Context, conf config.Config, code string) (int, error) {
+	var id int
+	err := conf.Dbpool.QueryRow(ctx, `
+		UPDATE invites
+		SET used_time = $2
+		WHERE code_hash = $1
+		    AND used_time IS NULL
+		RETURNING id
+		`,
+		hashIndexerKey(code), conf.Now()).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrInvalidInvite
+		}
+		return 0, fmt.Errorf("error redeeming invite: %w", err)
+	}
+	return id, nil
+}
+
+// releaseInvite makes a redeemed invite usable again, for when the key it
+// was redeemed for could not be generated.
+func releaseInvite(ctx context.Context, conf config.Config, id int) {
+	_, err := conf.Dbpool.Exec(ctx, `
+		UPDATE invites
+		SET used_time = NULL
+		WHERE id = $1
+		`,
+		id)
+	if err != nil {
+		log.Printf("error releasing invite %d: %v", id, err)
+	}
+}
+
+// bindInvite records the announce key generated with a redeemed invite.
+func bindInvite(ctx context.Context, conf config.Config, id int, announce_key string) error {
+	_, err := conf.Dbpool.Exec(ctx, `
+		UPDATE invites
+		SET peers_id = (
+		        SELECT
+		            id
+		        FROM
+		            peers
+		        WHERE
+		            announce_key = $2)
+		WHERE id = $1
+		`,
+		id, announce_key)
+	if err != nil {
+		return fmt.Errorf("error binding invite: %w", err)
+	}
+	return nil
+}
+
+// GetInvitesHandler lists every invite, newest first.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetInvitesHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT
+			    invites.id,
+			    note,
+			    invites.created_time,
+			    used_time,
+			    announce_key
+			FROM
+			    invites
+			    LEFT JOIN peers ON invites.peers_id = peers.id
+			ORDER BY
+			    invites.created_time DESC,
+			    invites.id DESC
+			`)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		invites, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Invite])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+		if invites == nil {
+			invites = []Invite{}
+		}
+
+		response, err := json.Marshal(invites)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PostInviteHandler takes a POST request with an optional JSON body with a
+// note, such as who the invite is for, and creates an invite. The code is
+// only returned here, since only its hash is stored.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PostInviteHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var invite Invite
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&invite); err != nil {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid invite"})
+				return
+			}
+		}
+
+		randomBytes := make([]byte, InviteCodeLength/2)
+		_, _ = rand.Read(randomBytes)
+		code := hex.EncodeToString(randomBytes)
+
+		var id int
+		err := conf.Dbpool.QueryRow(ctx, `
+			INSERT INTO invites (code_hash, note, created_time)
+			    VALUES ($1, $2, $3)
+			RETURNING id
+			`,
+			hashIndexerKey(code), invite.Note, conf.Now()).Scan(&id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error inserting invite"})
+			return
+		}
+
+		response, err := json.Marshal(InviteCode{Id: id, Note: invite.Note, Code: code})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success adding invite, but error making response"})
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// DeleteInviteHandler takes a DELETE request for an invite id, and revokes
+// the invite if it has not been used. Used invites are kept as a record of
+// the key each was used for.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func DeleteInviteHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid invite id"})
+			return
+		}
+
+		tag, err := conf.Dbpool.Exec(ctx, `
+			DELETE FROM invites
+			WHERE id = $1
+			    AND used_time IS NULL
+			`,
+			id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not delete invite"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: unknown or used invite"})
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
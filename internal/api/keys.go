@@ -0,0 +1,473 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+	"github.com/dmoerner/etracker/internal/events"
+	"github.com/dmoerner/etracker/internal/handler"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// DefaultKeysLimit is the number of announce keys returned by GetKeysHandler
+// when no limit is given, and MaxKeysLimit the most it returns in one page.
+const (
+	DefaultKeysLimit = 100
+	MaxKeysLimit     = 1000
+)
+
+// AnnounceKey is an announce key with its lifetime totals. Last_announce is
+// nil for a key which has never announced.
+type AnnounceKey struct {
+	Announce_key  string     `json:"announce_key"`
+	Snatched      int        `json:"snatched"`
+	Uploaded      int        `json:"uploaded"`
+	Downloaded    int        `json:"downloaded"`
+	Created_time  time.Time  `json:"created_time"`
+	Last_announce *time.Time `json:"last_announce"`
+}
+
+// KeyPage is one page of announce keys, oldest first, with the total number
+// of keys for paging.
+type KeyPage struct {
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Keys   []AnnounceKey `json:"keys"`
+}
+
+// KeyStats is an announce key with the swarms it is currently active in.
+type KeyStats struct {
+	AnnounceKey
+	Seeding  int `json:"seeding"`
+	Leeching int `json:"leeching"`
+}
+
+// parseKeyPage parses the optional limit and offset query fields.
+func parseKeyPage(r *http.Request) (limit int, offset int, err error) {
+	limit = DefaultKeysLimit
+	if limitString := r.URL.Query().Get("limit"); limitString != "" {
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit <= 0 || limit > MaxKeysLimit {
+			return 0, 0, errors.New("invalid limit")
+		}
+	}
+	if offsetString := r.URL.Query().Get("offset"); offsetString != "" {
+		offset, err = strconv.Atoi(offsetString)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+	return limit, offset, nil
+}
+
+// GetKeysHandler takes a GET request with optional limit and offset query
+// fields and returns a page of announce keys, oldest first, with their
+// lifetime totals and last announce.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetKeysHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parseKeyPage(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
+
+		page := KeyPage{Offset: offset}
+		err = conf.Dbpool.QueryRow(ctx, `
+			SELECT COUNT(*) FROM peers
+			`).Scan(&page.Total)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT
+			    announce_key,
+			    snatched,
+			    uploaded,
+			    downloaded,
+			    created_time,
+			    (
+				SELECT
+				    MAX(last_announce)
+				FROM
+				    key_activity
+				WHERE
+				    key_activity.peers_id = peers.id) AS last_announce
+			FROM
+			    peers
+			ORDER BY
+			    created_time,
+			    id
+			LIMIT $1 OFFSET $2
+			`,
+			limit, offset)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		page.Keys, err = pgx.CollectRows(rows, pgx.RowToStructByName[AnnounceKey])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+
+		result, err := json.Marshal(page)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// KeyStatsHandler takes a GET request for the announce key in the path and
+// returns its lifetime totals, its last announce, and the number of swarms
+// it is currently seeding and leeching.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func KeyStatsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := KeyStats{AnnounceKey: AnnounceKey{Announce_key: r.PathValue("key")}}
+
+		err := conf.Dbpool.QueryRow(ctx, `
+			WITH `+db.RecentAnnouncesOf(1, 2, 3, "amount_left")+`
+			SELECT
+			    snatched,
+			    uploaded,
+			    downloaded,
+			    created_time,
+			    (
+				SELECT
+				    MAX(last_announce)
+				FROM
+				    key_activity
+				WHERE
+				    key_activity.peers_id = peers.id),
+			    COUNT(recent_announces.info_hash_id) FILTER (WHERE amount_left = 0),
+			    COUNT(recent_announces.info_hash_id) FILTER (WHERE amount_left > 0)
+			FROM
+			    peers
+			    LEFT JOIN recent_announces ON recent_announces.peers_id = peers.id
+			WHERE
+			    announce_key = $3
+			GROUP BY
+			    peers.id
+			`,
+			config.Stopped, conf.StaleCutoff(), stats.Announce_key).Scan(&stats.Snatched, &stats.Uploaded, &stats.Downloaded, &stats.Created_time, &stats.Last_announce, &stats.Seeding, &stats.Leeching)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeError(w, http.StatusNotFound, MessageJSON{"error: invalid announce key"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		result, err := json.Marshal(stats)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// DeleteKeyHandler takes a DELETE request for the announce key in the path
+// and revokes it. Revoking erases the key and its personal data exactly as
+// ErasePeerDataHandler does, so the key can no longer announce and its
+// peers are dropped from every swarm, and publishes events.KeyRevoked.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func DeleteKeyHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := eraseKey(ctx, conf, r.PathValue("key")); err != nil {
+			writeEraseError(w, err)
+			return
+		}
+		conf.Publish(events.Event{Kind: events.KeyRevoked, Announce_key: r.PathValue("key")})
+
+		response, err := json.Marshal(MessageJSON{"success"})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success revoking, but error making response"})
+		}
+
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+var (
+	// errKeyOwned is returned by rotateKey for a key owned by a user other
+	// than the one rotating it.
+	errKeyOwned = errors.New("announce key owned by another user")
+
+	// errKeyBanned is returned by rotateKey for a banned key, so that a ban
+	// cannot be escaped by rotating.
+	errKeyBanned = errors.New("announce key banned")
+
+	// errKeyExpired is returned by rotateKey for a key without an owner
+	// whose rotation deadline has passed.
+	errKeyExpired = errors.New("announce key expired")
+
+	// errOldKeyLive is returned by rotateKey when the key was rotated in
+	// the database but the old key could not be cleared from Redis, where
+	// it is cached without expiry, so that it still announces.
+	errOldKeyLive = errors.New("rotated key, but could not revoke the old key")
+
+	// errRotatedCacheNotCleared is returned by rotateKey when the old key
+	// was revoked, but its peers could not be dropped from the swarm cache
+	// or the ACLs or tiers could not be reloaded.
+	errRotatedCacheNotCleared = errors.New("rotated key, but could not clear cache")
+)
+
+// RevokeRetries is how many times clearing a rotated key from Redis is
+// retried, waiting RevokeBackoff before the first retry and twice as long
+// before each later one.
+const (
+	RevokeRetries = 3
+	RevokeBackoff = 100 * time.Millisecond
+)
+
+// revokeCached clears an announce key from Redis, retrying with backoff,
+// see RevokeRetries, since the key keeps announcing until it is cleared.
+func revokeCached(ctx context.Context, conf config.Config, announce_key string) error {
+	backoff := RevokeBackoff
+	for attempt := 0; ; attempt++ {
+		err := conf.Rdb.Unlink(ctx, "announce:"+announce_key, "rotate_by:"+announce_key, "pow_verified:"+announce_key).Err()
+		if err == nil {
+			return nil
+		}
+		if attempt == RevokeRetries {
+			return fmt.Errorf("%w: %v", errOldKeyLive, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", errOldKeyLive, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// rotateKey replaces an announce key with a new one, and returns the new
+// key. The peers row is updated in place, so that its lifetime totals,
+// snatches, active announces, profile, owner, and proof of work carry
+// over, as do references to the key by text in agent_keys and
+// infohash_acls, and the tier of its owner. users_id is the user rotating
+// the key, which must be its owner if it has one. A key without an owner
+// cannot be rotated after the deadline of a rotation campaign, since it may
+// be in the wrong hands.
+// The old key is cleared from Redis, so that it can no longer announce, see
+// revokeCached, and its peers are dropped from the swarm cache until they
+// announce again with the new key.
+func rotateKey(ctx context.Context, conf config.Config, announce_key string, users_id *int) (string, error) {
+	randomBytes := make([]byte, config.AnnounceKeyLength/2)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", fmt.Errorf("unable to generate new announce key: %w", err)
+	}
+	new_key := hex.EncodeToString(randomBytes)
+
+	tx, err := conf.Dbpool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	var peers_id int
+	var owner *int
+	var rotate_by *time.Time
+	var banned bool
+	err = tx.QueryRow(ctx, `
+		SELECT
+		    id,
+		    users_id,
+		    rotate_by,
+		    EXISTS (
+		        SELECT
+		        FROM
+		            bans
+		        WHERE
+		            kind = 'key'
+		            AND value = announce_key)
+		FROM
+		    peers
+		WHERE
+		    announce_key = $1
+		FOR UPDATE
+		`,
+		announce_key).Scan(&peers_id, &owner, &rotate_by, &banned)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", errUnknownKey
+		}
+		return "", err
+	}
+	if owner != nil && (users_id == nil || *users_id != *owner) {
+		return "", errKeyOwned
+	}
+	if banned {
+		return "", errKeyBanned
+	}
+	if owner == nil && rotate_by != nil && !conf.Now().Before(*rotate_by) {
+		return "", errKeyExpired
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE peers
+		SET announce_key = $2,
+		    rotate_by = NULL
+		WHERE id = $1
+		`,
+		peers_id, new_key)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE agent_keys
+		SET announce_key = $2
+		WHERE announce_key = $1
+		`,
+		announce_key, new_key)
+	if err != nil {
+		return "", err
+	}
+	acls, err := tx.Exec(ctx, `
+		UPDATE infohash_acls
+		SET value = $2
+		WHERE kind = 'key'
+		    AND value = $1
+		`,
+		announce_key, new_key)
+	if err != nil {
+		return "", err
+	}
+
+	rows, _ := tx.Query(ctx, `
+		SELECT
+		    info_hash,
+		    peer_id,
+		    ip_port
+		FROM
+		    announces
+		    JOIN infohashes ON announces.info_hash_id = infohashes.id
+		WHERE
+		    peers_id = $1
+		`,
+		peers_id)
+	active, err := pgx.CollectRows(rows, pgx.RowToStructByPos[erasedAnnounce])
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	if err = revokeCached(ctx, conf, announce_key); err != nil {
+		return new_key, err
+	}
+	for _, a := range active {
+		err = handler.DropCachedPeer(ctx, conf, a.Info_hash, announce_key, a.Peer_id, a.Ip_port)
+		if err != nil {
+			return new_key, errRotatedCacheNotCleared
+		}
+	}
+	if acls.RowsAffected() > 0 {
+		if err = handler.ACLsChanged(ctx, conf); err != nil {
+			return new_key, errRotatedCacheNotCleared
+		}
+	}
+	if owner != nil {
+		if err = handler.TiersChanged(ctx, conf); err != nil {
+			return new_key, errRotatedCacheNotCleared
+		}
+	}
+
+	return new_key, nil
+}
+
+// RotateKeyHandler takes a POST request with an announce_key query field,
+// and replaces the key with a new one, see rotateKey, for users whose
+// announce URL has leaked. A key owned by a user can only be rotated with
+// that user's session token in the Authorization header. The new key is
+// returned as a Key. If the old key could not be revoked, the request fails
+// with a 500 whose message gives the new key.
+func RotateKeyHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		announce_key := r.URL.Query().Get("announce_key")
+		if announce_key == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: no announce key provided in query"})
+			return
+		}
+
+		var users_id *int
+		if token := r.Header.Get("Authorization"); token != "" {
+			id, err := sessionUser(ctx, conf, token)
+			if err != nil {
+				if errors.Is(err, ErrInvalidSession) {
+					writeError(w, http.StatusUnauthorized, MessageJSON{"error: invalid session token"})
+					return
+				}
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to validate session token"})
+				return
+			}
+			users_id = &id
+		}
+
+		new_key, err := rotateKey(ctx, conf, announce_key, users_id)
+		if errors.Is(err, errOldKeyLive) {
+			// The old key stays cached as tracked, which never expires,
+			// so it keeps announcing until the cache is cleared by hand.
+			// The new key already replaced it in the database and cannot
+			// be looked up again, so it is reported with the error.
+			log.Printf("error rotating announce key: %v", err)
+			writeError(w, http.StatusInternalServerError, MessageJSON{fmt.Sprintf("error: rotated to new announce key %s, but the old key could not be revoked and still works", new_key)})
+			return
+		}
+		if errors.Is(err, errRotatedCacheNotCleared) {
+			// Both keys work as they should, so the new key is returned.
+			// The old key's peers stay in the swarm cache until they go
+			// stale, and ACLs and tiers of the key are only updated at
+			// their next reload.
+			log.Printf("error rotating announce key: %v", err)
+			err = nil
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, errUnknownKey):
+				writeError(w, http.StatusNotFound, MessageJSON{"error: invalid announce key"})
+			case errors.Is(err, errKeyOwned):
+				writeError(w, http.StatusUnauthorized, MessageJSON{"error: announce key is owned by a user, log in to rotate it"})
+			case errors.Is(err, errKeyBanned):
+				writeError(w, http.StatusForbidden, MessageJSON{"error: announce key is banned"})
+			case errors.Is(err, errKeyExpired):
+				writeError(w, http.StatusForbidden, MessageJSON{"error: announce key expired, generate a new one"})
+			default:
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not rotate announce key"})
+			}
+			return
+		}
+
+		response, err := json.Marshal(Key{Announce_key: new_key})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success rotating, but error making response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestKeys(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Left:        0,
+	}))
+
+	mux := http.NewServeMux()
+	identity := func(h http.Handler) http.Handler { return h }
+	MuxAPIRoutes(ctx, conf, mux, identity, identity, identity)
+
+	request := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+
+	t.Run("list", func(t *testing.T) {
+		w := request("GET", "http://example.com/api/keys?limit=1&offset=1")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+		var page KeyPage
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatalf("error decoding keys: %v", err)
+		}
+		if page.Total != len(testutils.AnnounceKeys) || len(page.Keys) != 1 || page.Offset != 1 {
+			t.Errorf("expected page 1 of %d keys, got %+v", len(testutils.AnnounceKeys), page)
+		}
+
+		for _, query := range []string{"limit=0", "limit=100000", "offset=-1", "limit=x"} {
+			if w := request("GET", "http://example.com/api/keys?"+query); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected %d, got %d", query, http.StatusBadRequest, w.Code)
+			}
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		w := request("GET", "http://example.com/api/keys/"+testutils.AnnounceKeys[1]+"/stats")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+		var stats KeyStats
+		if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+			t.Fatalf("error decoding key stats: %v", err)
+		}
+		if stats.Announce_key != testutils.AnnounceKeys[1] || stats.Seeding != 1 || stats.Leeching != 0 || stats.Last_announce == nil {
+			t.Errorf("expected one seed with a last announce, got %+v", stats)
+		}
+
+		if w := request("GET", "http://example.com/api/keys/invalid/stats"); w.Code != http.StatusNotFound {
+			t.Errorf("expected %d for invalid key, got %d", http.StatusNotFound, w.Code)
+		}
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[2],
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Left:        0,
+		}))
+		if tracked, err := handler.KeyTracked(ctx, conf, testutils.AnnounceKeys[2]); err != nil || !tracked {
+			t.Fatalf("expected key to be tracked before rotating, got %v", err)
+		}
+
+		w := request("POST", "http://example.com/api/rotate?announce_key="+testutils.AnnounceKeys[2])
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+		var key Key
+		if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+			t.Fatalf("error decoding key: %v", err)
+		}
+
+		// The old key is no longer tracked, even though it was cached.
+		tracked, err := handler.KeyTracked(ctx, conf, testutils.AnnounceKeys[2])
+		if err != nil {
+			t.Fatalf("error checking key: %v", err)
+		}
+		if tracked {
+			t.Errorf("expected rotated key to be untracked")
+		}
+
+		var stats KeyStats
+		if err := json.NewDecoder(request("GET", "http://example.com/api/keys/"+key.Announce_key+"/stats").Body).Decode(&stats); err != nil {
+			t.Fatalf("error decoding key stats: %v", err)
+		}
+		if stats.Seeding != 1 {
+			t.Errorf("expected the active announce to move to the new key, got %+v", stats)
+		}
+
+		if w := request("POST", "http://example.com/api/rotate?announce_key="+testutils.AnnounceKeys[2]); w.Code != http.StatusNotFound {
+			t.Errorf("expected %d rotating again, got %d", http.StatusNotFound, w.Code)
+		}
+
+		_, err = conf.Dbpool.Exec(ctx, `INSERT INTO bans (kind, value) VALUES ('key', $1)`, testutils.AnnounceKeys[3])
+		if err != nil {
+			t.Fatalf("error banning key: %v", err)
+		}
+		if w := request("POST", "http://example.com/api/rotate?announce_key="+testutils.AnnounceKeys[3]); w.Code != http.StatusForbidden {
+			t.Errorf("expected %d rotating a banned key, got %d", http.StatusForbidden, w.Code)
+		}
+	})
+
+	t.Run("rotate without redis", func(t *testing.T) {
+		// Without Redis, the old key cannot be revoked, so the rotation
+		// fails, but the new key is still given.
+		noRedis := conf
+		noRedis.Rdb = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+		defer noRedis.Rdb.Close()
+
+		var peers_id int
+		err := conf.Dbpool.QueryRow(ctx, `SELECT id FROM peers WHERE announce_key = $1`, testutils.AnnounceKeys[4]).Scan(&peers_id)
+		if err != nil {
+			t.Fatalf("error querying test db: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		RotateKeyHandler(ctx, noRedis)(w, httptest.NewRequest("POST", "http://example.com/api/rotate?announce_key="+testutils.AnnounceKeys[4], nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("expected %d, got %d: %s", http.StatusInternalServerError, w.Code, w.Body)
+		}
+
+		var new_key string
+		err = conf.Dbpool.QueryRow(ctx, `SELECT announce_key FROM peers WHERE id = $1`, peers_id).Scan(&new_key)
+		if err != nil {
+			t.Fatalf("error querying test db: %v", err)
+		}
+		if new_key == testutils.AnnounceKeys[4] {
+			t.Fatalf("expected the key to be rotated in the database")
+		}
+		if !strings.Contains(w.Body.String(), new_key) {
+			t.Errorf("expected the new key %s in the error, got %s", new_key, w.Body)
+		}
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		if w := request("DELETE", "http://example.com/api/keys/"+testutils.AnnounceKeys[1]); w.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+		if w := request("DELETE", "http://example.com/api/keys/"+testutils.AnnounceKeys[1]); w.Code != http.StatusNotFound {
+			t.Errorf("expected %d revoking again, got %d", http.StatusNotFound, w.Code)
+		}
+
+		tracked, err := handler.KeyTracked(ctx, conf, testutils.AnnounceKeys[1])
+		if err != nil {
+			t.Fatalf("error checking key: %v", err)
+		}
+		if tracked {
+			t.Errorf("expected revoked key to be untracked")
+		}
+	})
+}
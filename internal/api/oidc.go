@@ -0,0 +1,295 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/oidc"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// OIDCTimeout is how long a login at the identity provider may take
+	// before its state expires.
+	OIDCTimeout = 10 * time.Minute
+
+	// OIDCCallbackPath is the path of the callback registered with the
+	// identity provider, under the public URL.
+	OIDCCallbackPath = "/api/user/oidc/callback"
+
+	// DefaultOIDCUsername is the base of the username of a new user whose
+	// claims give none.
+	DefaultOIDCUsername = "user"
+
+	// oidcUsernameAttempts bounds how many usernames are tried for a new
+	// user, whose name from the identity provider may be taken.
+	oidcUsernameAttempts = 5
+)
+
+// oidcLogin is what is kept of a login between the redirect to the identity
+// provider and the callback.
+type oidcLogin struct {
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// NewOIDCProvider returns the identity provider users log in with, or nil
+// if OpenID Connect login is disabled. The provider caches its discovery
+// document and keys, so it is created once for every handler.
+func NewOIDCProvider(conf config.Config) *oidc.Provider {
+	if conf.OIDCIssuer == "" || conf.PublicURL == "" {
+		return nil
+	}
+	return oidc.NewProvider(conf.OIDCIssuer, conf.OIDCClientID, conf.OIDCClientSecret, conf.PublicURL+OIDCCallbackPath, conf.OIDCScopes)
+}
+
+// oidcStateKey is the Redis key of the oidcLogin of an outstanding login.
+func oidcStateKey(state string) string {
+	return "oidc:" + state
+}
+
+// oidcUsername returns a valid username for a new user from the
+// preferred_username or email claims, with invalid characters removed.
+func oidcUsername(claims oidc.Claims) string {
+	name := claims.String("preferred_username")
+	if name == "" {
+		name, _, _ = strings.Cut(claims.String("email"), "@")
+	}
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("_-.", r) {
+			return r
+		}
+		return -1
+	}, strings.ToLower(name))
+
+	// Leave room for the suffix added if the name is taken.
+	name = name[:min(len(name), MaxUsernameLength-5)]
+	if len(name) < MinUsernameLength {
+		return DefaultOIDCUsername
+	}
+	return name
+}
+
+// oidcUser returns the id and username of the user the subject of the
+// identity provider logs in as, creating the user on their first login.
+func oidcUser(ctx context.Context, conf config.Config, subject, username string) (int, string, error) {
+	candidate := username
+	for range oidcUsernameAttempts {
+		var users_id int
+		var existing string
+		err := conf.Dbpool.QueryRow(ctx, `
+			SELECT
+			    users.id,
+			    username
+			FROM
+			    user_identities
+			    JOIN users ON user_identities.users_id = users.id
+			WHERE
+			    issuer = $1
+			    AND subject = $2
+			`,
+			conf.OIDCIssuer, subject).Scan(&users_id, &existing)
+		if err == nil {
+			return users_id, existing, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return 0, "", fmt.Errorf("unable to query identity: %w", err)
+		}
+
+		err = conf.Dbpool.QueryRow(ctx, `
+			WITH new_user AS (
+			    INSERT INTO users (username, created_time)
+			        VALUES ($3, $4)
+			    RETURNING id
+			)
+			INSERT INTO user_identities (issuer, subject, users_id, created_time)
+			SELECT
+			    $1,
+			    $2,
+			    id,
+			    $4
+			FROM
+			    new_user
+			RETURNING users_id
+			`,
+			conf.OIDCIssuer, subject, candidate, conf.Now()).Scan(&users_id)
+		if err == nil {
+			return users_id, candidate, nil
+		}
+
+		// Either the username is taken, so another is tried, or the
+		// subject logged in concurrently, so the identity is found on
+		// the next attempt.
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != pgerrcode.UniqueViolation {
+			return 0, "", fmt.Errorf("unable to add user: %w", err)
+		}
+		suffix := make([]byte, 2)
+		if _, err := rand.Read(suffix); err != nil {
+			return 0, "", fmt.Errorf("unable to generate username: %w", err)
+		}
+		candidate = username + "-" + hex.EncodeToString(suffix)
+	}
+	return 0, "", errors.New("unable to find a free username")
+}
+
+// syncOIDCGroups puts the user with the id users_id in the tracker groups
+// which the groups claim maps to, see config.ParseOIDCRoles, and removes
+// them from the other mapped groups. Groups which are not mapped are left
+// alone, so that they can still be managed through /api/groups.
+func syncOIDCGroups(ctx context.Context, conf config.Config, users_id int, claims oidc.Claims) error {
+	if len(conf.OIDCRoles) == 0 {
+		return nil
+	}
+	// groups is not nil, which would be NULL rather than an empty array.
+	var managed []string
+	groups := []string{}
+	for _, group := range conf.OIDCRoles {
+		managed = append(managed, group)
+	}
+	for _, idpGroup := range claims.Strings(conf.OIDCGroupsClaim) {
+		if group, ok := conf.OIDCRoles[idpGroup]; ok && !slices.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+
+	removed, err := conf.Dbpool.Exec(ctx, `
+		DELETE FROM user_groups
+		WHERE users_id = $1
+		    AND group_name = ANY ($2::text[])
+		    AND NOT group_name = ANY ($3::text[])
+		`,
+		users_id, managed, groups)
+	if err != nil {
+		return fmt.Errorf("unable to remove groups: %w", err)
+	}
+	added, err := conf.Dbpool.Exec(ctx, `
+		INSERT INTO user_groups (users_id, group_name)
+		SELECT
+		    $1,
+		    unnest($2::text[])
+		ON CONFLICT (users_id, group_name)
+		    DO NOTHING
+		`,
+		users_id, groups)
+	if err != nil {
+		return fmt.Errorf("unable to add groups: %w", err)
+	}
+
+	if removed.RowsAffected() > 0 || added.RowsAffected() > 0 {
+		return handler.ACLsChanged(ctx, conf)
+	}
+	return nil
+}
+
+// OIDCLoginHandler takes a GET request and redirects to the identity
+// provider to log in, which then redirects to OIDCCallbackHandler.
+func OIDCLoginHandler(ctx context.Context, conf config.Config, provider *oidc.Provider) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if provider == nil {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: OIDC login disabled"})
+			return
+		}
+
+		var state string
+		var login oidcLogin
+		for _, value := range []*string{&state, &login.Nonce, &login.Verifier} {
+			var err error
+			if *value, err = oidc.NewState(); err != nil {
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to start login"})
+				return
+			}
+		}
+		stored, _ := json.Marshal(login)
+		if err := conf.Rdb.Set(ctx, oidcStateKey(state), stored, OIDCTimeout).Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to start login"})
+			return
+		}
+
+		authURL, err := provider.AuthCodeURL(r.Context(), state, login.Nonce, login.Verifier)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, MessageJSON{"error: identity provider unavailable"})
+			return
+		}
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+// OIDCCallbackHandler takes the GET request the identity provider redirects
+// to after a login, with code and state query fields. The user is logged in
+// as the user of the provider's subject, who is created on their first
+// login, and redirected to the public URL with the username and session
+// token of a UserSession in the fragment, such as
+// "https://tracker.example.com/#username=alice&token=...". Each state can
+// be used at most once.
+func OIDCCallbackHandler(ctx context.Context, conf config.Config, provider *oidc.Provider) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if provider == nil {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: OIDC login disabled"})
+			return
+		}
+
+		query := r.URL.Query()
+		stored, err := conf.Rdb.GetDel(ctx, oidcStateKey(query.Get("state"))).Bytes()
+		if errors.Is(err, redis.Nil) {
+			writeError(w, http.StatusUnauthorized, MessageJSON{"error: unknown or expired login"})
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query login"})
+			return
+		}
+		if query.Get("error") != "" {
+			writeError(w, http.StatusUnauthorized, MessageJSON{"error: identity provider refused login: " + query.Get("error")})
+			return
+		}
+		var login oidcLogin
+		if err = json.Unmarshal(stored, &login); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query login"})
+			return
+		}
+
+		claims, err := provider.Exchange(r.Context(), query.Get("code"), login.Nonce, login.Verifier)
+		if errors.Is(err, oidc.ErrInvalidToken) {
+			writeError(w, http.StatusUnauthorized, MessageJSON{"error: invalid ID token"})
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadGateway, MessageJSON{"error: could not log in with identity provider"})
+			return
+		}
+
+		users_id, username, err := oidcUser(ctx, conf, claims.String("sub"), oidcUsername(claims))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not add user"})
+			return
+		}
+		if err = syncOIDCGroups(ctx, conf, users_id, claims); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not update groups"})
+			return
+		}
+
+		token, err := logIn(ctx, conf, users_id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not create session"})
+			return
+		}
+		fragment := url.Values{"username": {username}, "token": {token}}
+		http.Redirect(w, r, conf.PublicURL+"/#"+fragment.Encode(), http.StatusFound)
+	}
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	ctx := context.Background()
+	const origin = "https://tracker.example.com"
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey, config.WithPublicURL(origin))
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	idp := testutils.NewIdentityProvider("etracker", "secret")
+	defer idp.Close()
+
+	disabled := http.NewServeMux()
+	identity := func(h http.Handler) http.Handler { return h }
+	MuxAPIRoutes(ctx, conf, disabled, identity, identity, identity)
+	w := httptest.NewRecorder()
+	disabled.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/api/user/oidc/login", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %d without an issuer, got %d", http.StatusNotFound, w.Code)
+	}
+
+	conf.OIDCIssuer = idp.URL
+	conf.OIDCClientID = idp.ClientID
+	conf.OIDCClientSecret = idp.ClientSecret
+	conf.OIDCScopes = config.DefaultOIDCScopes
+	conf.OIDCGroupsClaim = config.DefaultOIDCGroupsClaim
+	conf.OIDCRoles = map[string]string{"tracker-admins": "staff", "donors": "vip"}
+	mux := http.NewServeMux()
+	MuxAPIRoutes(ctx, conf, mux, identity, identity, identity)
+
+	request := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	// login logs the subject in at the identity provider and returns the
+	// response to the callback.
+	login := func(subject string, claims map[string]any) *httptest.ResponseRecorder {
+		w := request("GET", "http://example.com/api/user/oidc/login", "", "")
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected %d for login, got %d: %s", http.StatusFound, w.Code, w.Body)
+		}
+		return request("GET", idp.Authorize(w.Header().Get("Location"), subject, claims), "", "")
+	}
+	session := func(w *httptest.ResponseRecorder) UserSession {
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected %d for callback, got %d: %s", http.StatusFound, w.Code, w.Body)
+		}
+		location := w.Header().Get("Location")
+		prefix := origin + "/#"
+		if !strings.HasPrefix(location, prefix) {
+			t.Fatalf("unexpected redirect to %s", location)
+		}
+		fragment, _ := url.ParseQuery(strings.TrimPrefix(location, prefix))
+		return UserSession{Username: fragment.Get("username"), Token: fragment.Get("token")}
+	}
+	groups := func(username string) []string {
+		var groups []string
+		err := conf.Dbpool.QueryRow(ctx, `
+			SELECT
+			    COALESCE(ARRAY_AGG(group_name ORDER BY group_name) FILTER (WHERE group_name IS NOT NULL), '{}')
+			FROM
+			    users
+			    LEFT JOIN user_groups ON user_groups.users_id = users.id
+			WHERE
+			    username = $1
+			`,
+			username).Scan(&groups)
+		if err != nil {
+			t.Fatalf("error querying groups: %v", err)
+		}
+		return groups
+	}
+
+	// The first login creates the user, named by the identity provider,
+	// and puts them in the mapped groups.
+	alice := session(login("alice-1", map[string]any{"preferred_username": "Alice", "groups": []string{"tracker-admins", "other"}}))
+	if alice.Username != "alice" {
+		t.Errorf("expected username alice, got %s", alice.Username)
+	}
+	if w := request("GET", "http://example.com/api/user/stats", alice.Token, ""); w.Code != http.StatusOK {
+		t.Errorf("expected %d for stats with the session, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if received := groups("alice"); !slices.Equal(received, []string{"staff"}) {
+		t.Errorf("expected groups [staff], got %v", received)
+	}
+
+	// Later logins are the same user, whose mapped groups follow the
+	// identity provider and whose other groups are kept.
+	_, err := conf.Dbpool.Exec(ctx, `
+		INSERT INTO user_groups (users_id, group_name)
+		SELECT
+		    id,
+		    'manual'
+		FROM
+		    users
+		WHERE
+		    username = 'alice'
+		`)
+	if err != nil {
+		t.Fatalf("error adding group: %v", err)
+	}
+	again := session(login("alice-1", map[string]any{"preferred_username": "renamed", "groups": "donors"}))
+	if again.Username != "alice" || again.Token == alice.Token {
+		t.Errorf("expected a new session for alice, got %+v", again)
+	}
+	if received := groups("alice"); !slices.Equal(received, []string{"manual", "vip"}) {
+		t.Errorf("expected groups [manual vip], got %v", received)
+	}
+
+	// Another subject with a taken name gets a new user.
+	other := session(login("alice-2", map[string]any{"email": "alice@example.com"}))
+	if !strings.HasPrefix(other.Username, "alice-") {
+		t.Errorf("expected a suffixed username, got %s", other.Username)
+	}
+
+	// Users created through the identity provider have no password.
+	if w := request("POST", "http://example.com/api/user/login", "", `{"username": "alice", "password": ""}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d for a password login, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// Each state is used once.
+	w = request("GET", "http://example.com/api/user/oidc/login", "", "")
+	callback := idp.Authorize(w.Header().Get("Location"), "alice-1", nil)
+	session(request("GET", callback, "", ""))
+	if w := request("GET", callback, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d for a used state, got %d", http.StatusUnauthorized, w.Code)
+	}
+	w = request("GET", "http://example.com/api/user/oidc/login", "", "")
+	location, _ := url.Parse(w.Header().Get("Location"))
+	refused := url.Values{"state": {location.Query().Get("state")}, "error": {"access_denied"}}
+	if w := request("GET", origin+OIDCCallbackPath+"?"+refused.Encode(), "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d for a refused login, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestOIDCUsername(t *testing.T) {
+	data := []struct {
+		claims   map[string]any
+		expected string
+	}{
+		{map[string]any{"preferred_username": "Alice Smith", "email": "bob@example.com"}, "alicesmith"},
+		{map[string]any{"email": "Bob.Jones@example.com"}, "bob.jones"},
+		{map[string]any{"preferred_username": "李"}, DefaultOIDCUsername},
+		{map[string]any{}, DefaultOIDCUsername},
+		{map[string]any{"preferred_username": strings.Repeat("a", 40)}, strings.Repeat("a", MaxUsernameLength-5)},
+	}
+	for _, d := range data {
+		if received := oidcUsername(d.claims); received != d.expected {
+			t.Errorf("%v: expected %s, got %s", d.claims, d.expected, received)
+		}
+	}
+}
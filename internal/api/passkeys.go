@@ -0,0 +1,553 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/webauthn"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// PasskeyTimeout is how long a passkey registration or login may take
+	// before its challenge expires.
+	PasskeyTimeout = 5 * time.Minute
+
+	// MaxPasskeyNameLength bounds the names users give their passkeys.
+	MaxPasskeyNameLength = 64
+
+	// DefaultPasskeyName is the name of a passkey registered without one.
+	DefaultPasskeyName = "passkey"
+)
+
+// PasskeyEntity names the relying party or the user in
+// PasskeyCreationOptions.
+type PasskeyEntity struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// PasskeyParameter is a public key algorithm accepted for new passkeys.
+type PasskeyParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// PasskeyDescriptor identifies a registered passkey by its base64url
+// credential ID.
+type PasskeyDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// PasskeySelection are the requirements on the authenticator of a new
+// passkey.
+type PasskeySelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// PasskeyCreationOptions are the options for registering a passkey, in the
+// format of PublicKeyCredentialCreationOptionsJSON, which browsers parse
+// with PublicKeyCredential.parseCreationOptionsFromJSON. Passkeys must be
+// discoverable, so that they can log in without a username.
+type PasskeyCreationOptions struct {
+	Challenge              string              `json:"challenge"`
+	RP                     PasskeyEntity       `json:"rp"`
+	User                   PasskeyEntity       `json:"user"`
+	PubKeyCredParams       []PasskeyParameter  `json:"pubKeyCredParams"`
+	Timeout                int64               `json:"timeout"`
+	ExcludeCredentials     []PasskeyDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection PasskeySelection    `json:"authenticatorSelection"`
+	Attestation            string              `json:"attestation"`
+}
+
+// PasskeyRequestOptions are the options for logging in with a passkey, in
+// the format of PublicKeyCredentialRequestOptionsJSON, which browsers parse
+// with PublicKeyCredential.parseRequestOptionsFromJSON.
+type PasskeyRequestOptions struct {
+	Challenge        string              `json:"challenge"`
+	RPID             string              `json:"rpId"`
+	Timeout          int64               `json:"timeout"`
+	UserVerification string              `json:"userVerification"`
+	AllowCredentials []PasskeyDescriptor `json:"allowCredentials"`
+}
+
+// PasskeyResponse is the response of the authenticator in a
+// PasskeyCredential. Registrations have an attestation object, and logins
+// authenticator data and a signature.
+type PasskeyResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+}
+
+// PasskeyCredential is the body of passkey registration and login requests,
+// as returned by PublicKeyCredential.toJSON, with every binary field encoded
+// as base64url. Registrations may add a Name for the passkey.
+type PasskeyCredential struct {
+	ID       string          `json:"id"`
+	Name     string          `json:"name,omitempty"`
+	Response PasskeyResponse `json:"response"`
+}
+
+// Passkey is a passkey registered by a user. Last_used is nil for a passkey
+// which has never logged in.
+type Passkey struct {
+	ID           int        `json:"id"`
+	Name         string     `json:"name"`
+	Created_time time.Time  `json:"created_time"`
+	Last_used    *time.Time `json:"last_used"`
+}
+
+// relyingParty returns the site passkeys are registered for, which is the
+// public URL of the tracker. Passkeys are disabled without a public URL,
+// since they are scoped to the domain they are registered on.
+func relyingParty(conf config.Config) (webauthn.RelyingParty, bool) {
+	if conf.PublicURL == "" {
+		return webauthn.RelyingParty{}, false
+	}
+	rp, err := webauthn.NewRelyingParty(conf.PublicURL)
+	return rp, err == nil
+}
+
+// passkeyChallengeKey is the Redis key of an outstanding passkey challenge,
+// whose value is the id of the user registering a passkey, or zero for a
+// login.
+func passkeyChallengeKey(challenge string) string {
+	return "passkey:" + challenge
+}
+
+// newPasskeyChallenge issues a challenge for the user with the id users_id,
+// or for a login if it is zero.
+func newPasskeyChallenge(ctx context.Context, conf config.Config, users_id int) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	err = conf.Rdb.Set(ctx, passkeyChallengeKey(challenge), users_id, PasskeyTimeout).Err()
+	if err != nil {
+		return "", fmt.Errorf("unable to store passkey challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+var errUnknownChallenge = errors.New("unknown or expired passkey challenge")
+
+// redeemPasskeyChallenge returns the challenge of the client data of a
+// response, if it was issued for the user with the id users_id, or for a
+// login if it is zero. Each challenge can be redeemed at most once, whether
+// or not the response is valid.
+func redeemPasskeyChallenge(ctx context.Context, conf config.Config, clientDataJSON []byte, users_id int) (string, error) {
+	challenge, err := webauthn.Challenge(clientDataJSON)
+	if err != nil {
+		return "", err
+	}
+	issuedFor, err := conf.Rdb.GetDel(ctx, passkeyChallengeKey(challenge)).Int()
+	if errors.Is(err, redis.Nil) {
+		return "", errUnknownChallenge
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to redeem passkey challenge: %w", err)
+	}
+	if issuedFor != users_id {
+		return "", errUnknownChallenge
+	}
+	return challenge, nil
+}
+
+// decodeBase64URL decodes a binary field of a PasskeyCredential. Padding is
+// tolerated, although browsers leave it out.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// passkeyUserHandle is the user handle of the user with the id users_id,
+// which authenticators store with the passkey.
+func passkeyUserHandle(users_id int) string {
+	return base64.RawURLEncoding.EncodeToString(binary.BigEndian.AppendUint64(nil, uint64(users_id)))
+}
+
+// writePasskeyError replies to a passkey registration or login which could
+// not be verified. Invalid responses are the client's fault, and anything
+// else is the server's.
+func writePasskeyError(w http.ResponseWriter, code int, err error) {
+	switch {
+	case errors.Is(err, errUnknownChallenge):
+		writeError(w, code, MessageJSON{"error: unknown or expired passkey challenge"})
+	case errors.Is(err, webauthn.ErrSignCount):
+		writeError(w, code, MessageJSON{"error: passkey signature counter did not increase, the passkey may have been cloned"})
+	case errors.Is(err, webauthn.ErrInvalidResponse), errors.Is(err, webauthn.ErrUnsupportedKey):
+		writeError(w, code, MessageJSON{"error: " + err.Error()})
+	default:
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not verify passkey"})
+	}
+}
+
+// PasskeyCreationOptionsHandler takes a POST request and returns the
+// PasskeyCreationOptions for registering a passkey for the logged in user,
+// to be passed to navigator.credentials.create. The challenge expires after
+// PasskeyTimeout. Passkeys are disabled without a public URL.
+//
+// This endpoint requires a session token, see WithUserAuthorization.
+func PasskeyCreationOptionsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rp, ok := relyingParty(conf)
+		if !ok {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: passkeys disabled"})
+			return
+		}
+		users_id := r.Context().Value(usersIDKey{}).(int)
+
+		var username string
+		var credentialIDs [][]byte
+		err := conf.Dbpool.QueryRow(ctx, `
+			SELECT
+			    username,
+			    COALESCE(ARRAY_AGG(credential_id) FILTER (WHERE credential_id IS NOT NULL), '{}')
+			FROM
+			    users
+			    LEFT JOIN credentials ON credentials.users_id = users.id
+			WHERE
+			    users.id = $1
+			GROUP BY
+			    users.id
+			`,
+			users_id).Scan(&username, &credentialIDs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		challenge, err := newPasskeyChallenge(ctx, conf, users_id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not store challenge"})
+			return
+		}
+
+		options := PasskeyCreationOptions{
+			Challenge: challenge,
+			RP:        PasskeyEntity{ID: rp.ID, Name: rp.ID},
+			User: PasskeyEntity{
+				ID:          passkeyUserHandle(users_id),
+				Name:        username,
+				DisplayName: username,
+			},
+			Timeout: PasskeyTimeout.Milliseconds(),
+			// The user's passkeys are excluded, so that an authenticator
+			// is not registered twice.
+			ExcludeCredentials: []PasskeyDescriptor{},
+			AuthenticatorSelection: PasskeySelection{
+				ResidentKey:      "required",
+				UserVerification: "required",
+			},
+			Attestation: "none",
+		}
+		for _, alg := range webauthn.Algorithms {
+			options.PubKeyCredParams = append(options.PubKeyCredParams, PasskeyParameter{Type: "public-key", Alg: alg})
+		}
+		for _, id := range credentialIDs {
+			options.ExcludeCredentials = append(options.ExcludeCredentials, PasskeyDescriptor{
+				Type: "public-key",
+				ID:   base64.RawURLEncoding.EncodeToString(id),
+			})
+		}
+
+		response, err := json.Marshal(options)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// RegisterPasskeyHandler takes a POST request with a PasskeyCredential body
+// answering a challenge from PasskeyCreationOptionsHandler, and registers
+// the passkey for the logged in user, who can then log in with it at
+// PasskeyLoginHandler. It returns the new Passkey.
+//
+// This endpoint requires a session token, see WithUserAuthorization.
+func RegisterPasskeyHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rp, ok := relyingParty(conf)
+		if !ok {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: passkeys disabled"})
+			return
+		}
+		users_id := r.Context().Value(usersIDKey{}).(int)
+
+		var body PasskeyCredential
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive a valid passkey"})
+			return
+		}
+		clientDataJSON, err := decodeBase64URL(body.Response.ClientDataJSON)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive a valid passkey"})
+			return
+		}
+		attestationObject, err := decodeBase64URL(body.Response.AttestationObject)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive a valid passkey"})
+			return
+		}
+		name := strings.TrimSpace(body.Name)
+		if name == "" {
+			name = DefaultPasskeyName
+		}
+		if len(name) > MaxPasskeyNameLength {
+			writeError(w, http.StatusBadRequest, MessageJSON{fmt.Sprintf("error: passkey names must be at most %d bytes", MaxPasskeyNameLength)})
+			return
+		}
+
+		challenge, err := redeemPasskeyChallenge(ctx, conf, clientDataJSON, users_id)
+		if err != nil {
+			writePasskeyError(w, http.StatusBadRequest, err)
+			return
+		}
+		credential, err := rp.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+		if err != nil {
+			writePasskeyError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		passkey := Passkey{Name: name, Created_time: conf.Now()}
+		err = conf.Dbpool.QueryRow(ctx, `
+			INSERT INTO credentials (users_id, credential_id, public_key, sign_count, name, created_time)
+			    VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id
+			`,
+			users_id, credential.ID, credential.PublicKey, int64(credential.SignCount), name, passkey.Created_time).Scan(&passkey.ID)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: passkey already registered"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not add passkey"})
+			return
+		}
+
+		response, err := json.Marshal(passkey)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PasskeysHandler takes a GET request and returns the Passkeys of the
+// logged in user, oldest first.
+//
+// This endpoint requires a session token, see WithUserAuthorization.
+func PasskeysHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users_id := r.Context().Value(usersIDKey{}).(int)
+
+		rows, _ := conf.Dbpool.Query(ctx, `
+			SELECT
+			    id,
+			    name,
+			    created_time,
+			    last_used
+			FROM
+			    credentials
+			WHERE
+			    users_id = $1
+			ORDER BY
+			    created_time,
+			    id
+			`,
+			users_id)
+		passkeys, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Passkey])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+		if passkeys == nil {
+			passkeys = []Passkey{}
+		}
+
+		response, err := json.Marshal(passkeys)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// DeletePasskeyHandler takes a DELETE request for a passkey id, and removes
+// the passkey if the logged in user registered it. Sessions the passkey
+// logged in are not ended.
+//
+// This endpoint requires a session token, see WithUserAuthorization.
+func DeletePasskeyHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users_id := r.Context().Value(usersIDKey{}).(int)
+
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid passkey id"})
+			return
+		}
+
+		tag, err := conf.Dbpool.Exec(ctx, `
+			DELETE FROM credentials
+			WHERE id = $1
+			    AND users_id = $2
+			`,
+			id, users_id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not delete passkey"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: unknown passkey"})
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PasskeyRequestOptionsHandler takes a POST request and returns the
+// PasskeyRequestOptions for logging in with a passkey, to be passed to
+// navigator.credentials.get. No username is needed, since passkeys are
+// discoverable. The challenge expires after PasskeyTimeout.
+func PasskeyRequestOptionsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rp, ok := relyingParty(conf)
+		if !ok {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: passkeys disabled"})
+			return
+		}
+
+		challenge, err := newPasskeyChallenge(ctx, conf, 0)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not store challenge"})
+			return
+		}
+
+		response, err := json.Marshal(PasskeyRequestOptions{
+			Challenge:        challenge,
+			RPID:             rp.ID,
+			Timeout:          PasskeyTimeout.Milliseconds(),
+			UserVerification: "required",
+			AllowCredentials: []PasskeyDescriptor{},
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PasskeyLoginHandler takes a POST request with a PasskeyCredential body
+// answering a challenge from PasskeyRequestOptionsHandler, and returns a
+// new UserSession for the user who registered the passkey, like
+// LoginHandler.
+func PasskeyLoginHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rp, ok := relyingParty(conf)
+		if !ok {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: passkeys disabled"})
+			return
+		}
+
+		var body PasskeyCredential
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive a valid passkey"})
+			return
+		}
+		var fields [4][]byte
+		for i, field := range []string{body.ID, body.Response.ClientDataJSON, body.Response.AuthenticatorData, body.Response.Signature} {
+			decoded, err := decodeBase64URL(field)
+			if err != nil || len(decoded) == 0 {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive a valid passkey"})
+				return
+			}
+			fields[i] = decoded
+		}
+		credentialID, clientDataJSON, authenticatorData, signature := fields[0], fields[1], fields[2], fields[3]
+
+		challenge, err := redeemPasskeyChallenge(ctx, conf, clientDataJSON, 0)
+		if err != nil {
+			writePasskeyError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		var id, users_id int
+		var username string
+		var signCount int64
+		credential := webauthn.Credential{ID: credentialID}
+		err = conf.Dbpool.QueryRow(ctx, `
+			SELECT
+			    credentials.id,
+			    users_id,
+			    username,
+			    public_key,
+			    sign_count
+			FROM
+			    credentials
+			    JOIN users ON credentials.users_id = users.id
+			WHERE
+			    credential_id = $1
+			`,
+			credentialID).Scan(&id, &users_id, &username, &credential.PublicKey, &signCount)
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, MessageJSON{"error: unknown passkey"})
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+		credential.SignCount = uint32(signCount)
+
+		newCount, err := rp.VerifyLogin(challenge, credential, clientDataJSON, authenticatorData, signature)
+		if err != nil {
+			writePasskeyError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		_, err = conf.Dbpool.Exec(ctx, `
+			UPDATE credentials
+			SET sign_count = $2,
+			    last_used = $3
+			WHERE id = $1
+			`,
+			id, int64(newCount), conf.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not update passkey"})
+			return
+		}
+
+		token, err := logIn(ctx, conf, users_id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not create session"})
+			return
+		}
+		writeSession(w, http.StatusOK, UserSession{Username: username, Token: token})
+	}
+}
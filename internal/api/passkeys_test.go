@@ -0,0 +1,174 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestPasskeys(t *testing.T) {
+	ctx := context.Background()
+	const rpID, origin = "tracker.example.com", "https://tracker.example.com"
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey, config.WithPublicURL(origin))
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	mux := http.NewServeMux()
+	identity := func(h http.Handler) http.Handler { return h }
+	MuxAPIRoutes(ctx, conf, mux, identity, identity, identity)
+
+	request := func(method, url, token string, body any) *httptest.ResponseRecorder {
+		var reader *strings.Reader
+		switch body := body.(type) {
+		case string:
+			reader = strings.NewReader(body)
+		default:
+			encoded, _ := json.Marshal(body)
+			reader = strings.NewReader(string(encoded))
+		}
+		req := httptest.NewRequest(method, url, reader)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+
+	w := request("POST", "http://example.com/api/user/register", "", `{"username": "alice", "password": "correct horse"}`)
+	var registered UserSession
+	if err := json.NewDecoder(w.Body).Decode(&registered); err != nil {
+		t.Fatalf("error decoding session: %v", err)
+	}
+	token := registered.Token
+
+	creationOptions := func() PasskeyCreationOptions {
+		w := request("POST", "http://example.com/api/user/passkeys/options", token, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d for creation options, got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+		var options PasskeyCreationOptions
+		if err := json.NewDecoder(w.Body).Decode(&options); err != nil {
+			t.Fatalf("error decoding creation options: %v", err)
+		}
+		return options
+	}
+	requestOptions := func() PasskeyRequestOptions {
+		w := request("POST", "http://example.com/api/user/login/passkey/options", "", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d for request options, got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+		var options PasskeyRequestOptions
+		if err := json.NewDecoder(w.Body).Decode(&options); err != nil {
+			t.Fatalf("error decoding request options: %v", err)
+		}
+		return options
+	}
+	login := func(a *testutils.Authenticator, challenge string) *httptest.ResponseRecorder {
+		clientData, authData, signature := a.Login(rpID, origin, challenge)
+		return request("POST", "http://example.com/api/user/login/passkey", "", PasskeyCredential{
+			ID: encode(a.ID),
+			Response: PasskeyResponse{
+				ClientDataJSON:    encode(clientData),
+				AuthenticatorData: encode(authData),
+				Signature:         encode(signature),
+			},
+		})
+	}
+
+	if w := request("POST", "http://example.com/api/user/passkeys/options", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d for creation options without a session, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	options := creationOptions()
+	if options.RP.ID != rpID || options.User.Name != "alice" || len(options.ExcludeCredentials) != 0 {
+		t.Errorf("unexpected creation options %+v", options)
+	}
+
+	a := testutils.NewAuthenticator(false)
+	clientData, attestation := a.Register(rpID, origin, options.Challenge)
+	registration := PasskeyCredential{
+		ID:   encode(a.ID),
+		Name: "laptop",
+		Response: PasskeyResponse{
+			ClientDataJSON:    encode(clientData),
+			AttestationObject: encode(attestation),
+		},
+	}
+	w = request("POST", "http://example.com/api/user/passkeys", token, registration)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected %d registering a passkey, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	var passkey Passkey
+	if err := json.NewDecoder(w.Body).Decode(&passkey); err != nil {
+		t.Fatalf("error decoding passkey: %v", err)
+	}
+	if passkey.Name != "laptop" || passkey.Last_used != nil {
+		t.Errorf("unexpected passkey %+v", passkey)
+	}
+
+	// Each challenge can be redeemed once.
+	if w := request("POST", "http://example.com/api/user/passkeys", token, registration); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d replaying a registration, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	options = creationOptions()
+	if len(options.ExcludeCredentials) != 1 || options.ExcludeCredentials[0].ID != encode(a.ID) {
+		t.Errorf("expected the registered passkey to be excluded, got %+v", options.ExcludeCredentials)
+	}
+
+	w = login(a, requestOptions().Challenge)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d logging in with a passkey, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var session UserSession
+	if err := json.NewDecoder(w.Body).Decode(&session); err != nil {
+		t.Fatalf("error decoding session: %v", err)
+	}
+	if session.Username != "alice" {
+		t.Errorf("expected a session for alice, got %+v", session)
+	}
+	if w := request("GET", "http://example.com/api/user/stats", session.Token, ""); w.Code != http.StatusOK {
+		t.Errorf("expected %d with the passkey session, got %d", http.StatusOK, w.Code)
+	}
+
+	// A registration challenge cannot be used to log in.
+	if w := login(a, creationOptions().Challenge); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d logging in with a registration challenge, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := login(testutils.NewAuthenticator(true), requestOptions().Challenge); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d logging in with an unknown passkey, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	var passkeys []Passkey
+	if err := json.NewDecoder(request("GET", "http://example.com/api/user/passkeys", token, "").Body).Decode(&passkeys); err != nil {
+		t.Fatalf("error decoding passkeys: %v", err)
+	}
+	if len(passkeys) != 1 || passkeys[0].ID != passkey.ID || passkeys[0].Last_used == nil {
+		t.Errorf("expected the used passkey, got %+v", passkeys)
+	}
+
+	if w := request("DELETE", "http://example.com/api/user/passkeys/"+strconv.Itoa(passkey.ID), token, ""); w.Code != http.StatusOK {
+		t.Errorf("expected %d deleting the passkey, got %d", http.StatusOK, w.Code)
+	}
+	if w := login(a, requestOptions().Challenge); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d logging in with a deleted passkey, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// Passkeys are disabled without a public URL.
+	conf.PublicURL = ""
+	w = httptest.NewRecorder()
+	PasskeyRequestOptionsHandler(ctx, conf)(w, httptest.NewRequest("POST", "http://example.com/api/user/login/passkey/options", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %d without a public URL, got %d", http.StatusNotFound, w.Code)
+	}
+}
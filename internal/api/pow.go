@@ -0,0 +1,155 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+)
+
+// ChallengeTTL is how long a proof-of-work challenge may be used for.
+const ChallengeTTL = 10 * time.Minute
+
+type Challenge struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"`
+}
+
+// leadingZeroBits counts the leading zero bits of a hash.
+func leadingZeroBits(hash []byte) int {
+	count := 0
+	for _, b := range hash {
+		if b != 0 {
+			return count + bits.LeadingZeros8(b)
+		}
+		count += 8
+	}
+	return count
+}
+
+// checkProofOfWork reports whether SHA-256 of "challenge:nonce" has at least
+// difficulty leading zero bits.
+func checkProofOfWork(challenge, nonce string, difficulty int) bool {
+	hash := sha256.Sum256([]byte(challenge + ":" + nonce))
+	return leadingZeroBits(hash[:]) >= difficulty
+}
+
+// SolveChallenge finds a nonce solving a challenge issued by
+// ChallengeHandler. The expected number of attempts is 2^difficulty.
+func SolveChallenge(challenge Challenge) string {
+	for nonce := 0; ; nonce++ {
+		n := strconv.Itoa(nonce)
+		if checkProofOfWork(challenge.Challenge, n, challenge.Difficulty) {
+			return n
+		}
+	}
+}
+
+// redeemProofOfWork verifies a solution to a challenge issued by
+// ChallengeHandler. Each challenge can be redeemed at most once, whether or
+// not the solution is valid.
+func redeemProofOfWork(ctx context.Context, conf config.Config, challenge, nonce string) (bool, error) {
+	if challenge == "" || nonce == "" {
+		return false, nil
+	}
+
+	deleted, err := conf.Rdb.Del(ctx, "pow:"+challenge).Result()
+	if err != nil {
+		return false, fmt.Errorf("error redeeming challenge: %w", err)
+	}
+	if deleted == 0 {
+		return false, nil
+	}
+
+	return checkProofOfWork(challenge, nonce, conf.PowDifficulty), nil
+}
+
+// ChallengeHandler issues a new proof-of-work challenge. To generate a key,
+// the client must find a nonce such that SHA-256 of "challenge:nonce" has
+// at least difficulty leading zero bits, and pass both to GenerateHandler.
+func ChallengeHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conf.PowDifficulty <= 0 {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: proof of work disabled"})
+			return
+		}
+
+		randomBytes := make([]byte, 16)
+		if _, err := rand.Read(randomBytes); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not generate challenge"})
+			return
+		}
+		challenge := Challenge{
+			Challenge:  hex.EncodeToString(randomBytes),
+			Difficulty: conf.PowDifficulty,
+		}
+
+		err := conf.Rdb.Set(ctx, "pow:"+challenge.Challenge, "true", ChallengeTTL).Err()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not store challenge"})
+			return
+		}
+
+		result, err := json.Marshal(challenge)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// VerifyKeyHandler lets an existing announce key which has never announced,
+// such as one created before proof of work was enabled, announce once it
+// has solved a challenge from ChallengeHandler.
+func VerifyKeyHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conf.PowDifficulty <= 0 {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: proof of work disabled"})
+			return
+		}
+
+		query := r.URL.Query()
+		announce_key := query.Get("announce_key")
+		if announce_key == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: no announce key"})
+			return
+		}
+
+		ok, err := redeemProofOfWork(ctx, conf, query.Get("challenge"), query.Get("nonce"))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to verify proof of work"})
+			log.Print(err)
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusForbidden, MessageJSON{"error: invalid proof of work"})
+			return
+		}
+
+		err = handler.VerifyKey(ctx, conf, announce_key)
+		if errors.Is(err, handler.ErrUntrackedAnnounce) {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: invalid announce key"})
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not verify announce key"})
+			log.Print(err)
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
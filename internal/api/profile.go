@@ -0,0 +1,265 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ProfileIDLength is the length of the hex profile ids, which are random so
+// that a profile cannot be traced back to its announce key.
+const ProfileIDLength = 16
+
+// MaxProfileSnatches is the most snatches listed on a profile.
+const MaxProfileSnatches = 50
+
+// RareSeeders is the most seeders an infohash may have for its seeders to
+// earn the rare content badge.
+const RareSeeders = 2
+
+// Badges shown on profiles.
+const (
+	BadgeSeeder         = "seeder"
+	BadgeProlificSeeder = "prolific seeder"
+	BadgeRareSeeder     = "rare content seeder"
+)
+
+// ProlificSeeds is the number of infohashes seeded for BadgeProlificSeeder.
+const ProlificSeeds = 10
+
+// ProfileSettings is the owner's view of whether their profile is public.
+type ProfileSettings struct {
+	Public     bool    `json:"public"`
+	Profile_id *string `json:"profile_id"`
+}
+
+type ProfileSnatch struct {
+	Name        string    `json:"name"`
+	Info_hash   []byte    `json:"info_hash"`
+	Last_seeded time.Time `json:"last_seeded"`
+}
+
+// Profile is the public view of an announce key which opted in, identified
+// only by its profile id. Only the achievements the key has earned are
+// listed.
+type Profile struct {
+	Profile_id   string          `json:"profile_id"`
+	Since        time.Time       `json:"since"`
+	Seeding      int             `json:"seeding"`
+	Snatched     int             `json:"snatched"`
+	Uploaded     int             `json:"uploaded"`
+	Badges       []string        `json:"badges"`
+	Achievements []Achievement   `json:"achievements"`
+	Snatches     []ProfileSnatch `json:"snatches"`
+}
+
+// profileBadges returns the badges earned by a key seeding the given number
+// of infohashes, of which rare have at most RareSeeders seeders.
+func profileBadges(seeding, rare int) []string {
+	badges := []string{}
+	if seeding > 0 {
+		badges = append(badges, BadgeSeeder)
+	}
+	if seeding >= ProlificSeeds {
+		badges = append(badges, BadgeProlificSeeder)
+	}
+	if rare > 0 {
+		badges = append(badges, BadgeRareSeeder)
+	}
+	return badges
+}
+
+// ProfileHandler takes a GET request with an announce_key query field, and
+// returns whether that key has a public profile. Since the announce key is
+// secret, only its owner can see or change its profile settings.
+func ProfileHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		announce_key := r.URL.Query().Get("announce_key")
+		if announce_key == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: no announce key provided in query"})
+			return
+		}
+
+		var settings ProfileSettings
+		err := conf.Dbpool.QueryRow(ctx, `
+			SELECT profile_id
+			FROM peers
+			WHERE announce_key = $1
+			`,
+			announce_key).Scan(&settings.Profile_id)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeError(w, http.StatusNotFound, MessageJSON{"error: invalid announce key"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+		settings.Public = settings.Profile_id != nil
+
+		response, err := json.Marshal(settings)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PutProfileHandler takes a PUT request with an announce_key query field and
+// a JSON ProfileSettings body, and makes the profile of that key public or
+// private. A profile made public again gets a new profile id, so that
+// links shared before it was made private stop working.
+func PutProfileHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		announce_key := r.URL.Query().Get("announce_key")
+		if announce_key == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: no announce key provided in query"})
+			return
+		}
+
+		var settings ProfileSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid profile settings"})
+			return
+		}
+
+		randomBytes := make([]byte, ProfileIDLength/2)
+		_, _ = rand.Read(randomBytes)
+
+		err := conf.Dbpool.QueryRow(ctx, `
+			UPDATE peers
+			SET profile_id = CASE WHEN $2 THEN COALESCE(profile_id, $3) END
+			WHERE announce_key = $1
+			RETURNING profile_id
+			`,
+			announce_key, settings.Public, hex.EncodeToString(randomBytes)).Scan(&settings.Profile_id)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeError(w, http.StatusNotFound, MessageJSON{"error: invalid announce key"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not update profile"})
+			return
+		}
+
+		response, err := json.Marshal(settings)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PublicProfileHandler presents the public profile with the profile id in
+// the path: how many infohashes the key seeds, its snatch history, its
+// badges, and its achievements. Only profiles which opted in exist.
+func PublicProfileHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		profile := Profile{Profile_id: r.PathValue("id")}
+
+		var rare int
+		err := conf.Dbpool.QueryRow(ctx, `
+			WITH `+db.RecentAnnounces(1, 2, "amount_left")+`,
+			seeds AS (
+			    SELECT
+				info_hash_id,
+				COUNT(*) FILTER (WHERE amount_left = 0) AS seeders
+			    FROM
+				recent_announces
+			    GROUP BY
+				info_hash_id
+			)
+			SELECT
+			    peers.created_time,
+			    peers.snatched,
+			    peers.uploaded,
+			    COUNT(*) FILTER (WHERE mine.amount_left = 0),
+			    COUNT(*) FILTER (WHERE mine.amount_left = 0
+				AND seeds.seeders <= $4)
+			FROM
+			    peers
+			    LEFT JOIN recent_announces mine ON mine.peers_id = peers.id
+			    LEFT JOIN seeds ON seeds.info_hash_id = mine.info_hash_id
+			WHERE
+			    peers.profile_id = $3
+			GROUP BY
+			    peers.id
+			`,
+			config.Stopped, conf.StaleCutoff(), profile.Profile_id, RareSeeders).Scan(&profile.Since, &profile.Snatched, &profile.Uploaded, &profile.Seeding, &rare)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeError(w, http.StatusNotFound, MessageJSON{"error: unknown profile"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+		profile.Badges = profileBadges(profile.Seeding, rare)
+
+		all, err := keyAchievements(ctx, conf, "profile_id", profile.Profile_id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+		profile.Achievements = []Achievement{}
+		for _, a := range all {
+			if a.Earned_time != nil {
+				profile.Achievements = append(profile.Achievements, a)
+			}
+		}
+
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT
+			    name,
+			    info_hash,
+			    MAX(announces.last_announce) AS last_seeded
+			FROM
+			    announces
+			    JOIN peers ON announces.peers_id = peers.id
+			    JOIN infohashes ON announces.info_hash_id = infohashes.id
+			WHERE
+			    peers.profile_id = $1
+			    AND announces.amount_left = 0
+			    AND infohashes.archived_time IS NULL
+			    AND infohashes.merged_into IS NULL
+			    AND `+noACL+`
+			GROUP BY
+			    infohashes.id
+			ORDER BY
+			    last_seeded DESC
+			LIMIT $2
+			`,
+			profile.Profile_id, MaxProfileSnatches)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+		profile.Snatches, err = pgx.CollectRows(rows, pgx.RowToStructByName[ProfileSnatch])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+		if profile.Snatches == nil {
+			profile.Snatches = []ProfileSnatch{}
+		}
+
+		response, err := json.Marshal(profile)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
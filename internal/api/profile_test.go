@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestProfileBadges(t *testing.T) {
+	data := []struct {
+		seeding  int
+		rare     int
+		expected []string
+	}{
+		{0, 0, []string{}},
+		{1, 0, []string{BadgeSeeder}},
+		{ProlificSeeds, 1, []string{BadgeSeeder, BadgeProlificSeeder, BadgeRareSeeder}},
+	}
+
+	for _, d := range data {
+		if got := profileBadges(d.seeding, d.rare); !slices.Equal(got, d.expected) {
+			t.Errorf("seeding %d, rare %d: expected %v, got %v", d.seeding, d.rare, d.expected, got)
+		}
+	}
+}
+
+func TestProfile(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	handler.PeerHandler(ctx, conf)(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Left:        0,
+	}))
+
+	mux := http.NewServeMux()
+	identity := func(h http.Handler) http.Handler { return h }
+	MuxAPIRoutes(ctx, conf, mux, identity, identity, identity)
+
+	request := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+	settings := func(w *httptest.ResponseRecorder) ProfileSettings {
+		var s ProfileSettings
+		if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+			t.Fatalf("error decoding profile settings: %v", err)
+		}
+		return s
+	}
+
+	keyURL := "http://example.com/api/profile?announce_key=" + testutils.AnnounceKeys[1]
+
+	if s := settings(request("GET", keyURL, "")); s.Public || s.Profile_id != nil {
+		t.Errorf("expected private profile by default, got %+v", s)
+	}
+	if w := request("GET", "http://example.com/api/profile?announce_key=invalid", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d for invalid key, got %d", http.StatusNotFound, w.Code)
+	}
+
+	s := settings(request("PUT", keyURL, `{"public": true}`))
+	if !s.Public || s.Profile_id == nil || len(*s.Profile_id) != ProfileIDLength {
+		t.Fatalf("expected public profile with id, got %+v", s)
+	}
+	profileURL := "http://example.com/api/profiles/" + *s.Profile_id
+
+	w := request("GET", profileURL, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var profile Profile
+	if err := json.NewDecoder(w.Body).Decode(&profile); err != nil {
+		t.Fatalf("error decoding profile: %v", err)
+	}
+	if profile.Seeding != 1 || len(profile.Snatches) != 1 {
+		t.Errorf("expected 1 seed and snatch, got %+v", profile)
+	}
+	// The only seeder of an infohash is a rare content seeder.
+	if !slices.Contains(profile.Badges, BadgeRareSeeder) {
+		t.Errorf("expected rare content badge, got %v", profile.Badges)
+	}
+	if strings.Contains(w.Body.String(), testutils.AnnounceKeys[1]) {
+		t.Errorf("expected profile not to reveal the announce key")
+	}
+
+	if s = settings(request("PUT", keyURL, `{"public": false}`)); s.Public {
+		t.Errorf("expected private profile, got %+v", s)
+	}
+	if w = request("GET", profileURL, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d for private profile, got %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Promotion is a freeleech or upload multiplier window, for one infohash or,
+// if Info_hash is empty, for every infohash. See handler.ValidatePromotion.
+type Promotion struct {
+	Id                int       `json:"id"`
+	Info_hash         []byte    `json:"info_hash"`
+	Freeleech         bool      `json:"freeleech"`
+	Upload_multiplier float64   `json:"upload_multiplier"`
+	Start_time        time.Time `json:"start_time"`
+	End_time          time.Time `json:"end_time"`
+	Reason            string    `json:"reason"`
+	Created_time      time.Time `json:"created_time"`
+}
+
+// GetPromotionsHandler lists every promotion which has not ended, in order
+// of start_time.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetPromotionsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT
+			    promotions.id,
+			    info_hash,
+			    freeleech,
+			    upload_multiplier,
+			    start_time,
+			    end_time,
+			    reason,
+			    promotions.created_time
+			FROM
+			    promotions
+			    LEFT JOIN infohashes ON promotions.info_hash_id = infohashes.id
+			WHERE
+			    end_time > $1
+			ORDER BY
+			    start_time,
+			    promotions.id
+			`,
+			conf.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		promotions, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Promotion])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+		if promotions == nil {
+			promotions = []Promotion{}
+		}
+
+		response, err := json.Marshal(promotions)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PostPromotionHandler takes a POST request with a Promotion body, and
+// returns the promotion as stored. The id and created_time are assigned by
+// the tracker, upload_multiplier defaults to 1, and start_time defaults to
+// now. The infohash, if any, must be in the allowlist.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PostPromotionHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		promotion := Promotion{Upload_multiplier: 1}
+		err := json.NewDecoder(r.Body).Decode(&promotion)
+		if err != nil || (promotion.Info_hash != nil && len(promotion.Info_hash) != 20) {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid promotion"})
+			return
+		}
+		if promotion.Start_time.IsZero() {
+			promotion.Start_time = conf.Now()
+		}
+		promotion.Created_time = conf.Now()
+
+		err = handler.ValidatePromotion(promotion.Freeleech, promotion.Upload_multiplier, promotion.Start_time, promotion.End_time)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
+
+		// A global promotion has no infohash.
+		var info_hash_id *int
+		if promotion.Info_hash != nil {
+			err = conf.Dbpool.QueryRow(ctx, `
+				SELECT
+				    id
+				FROM
+				    infohashes
+				WHERE
+				    info_hash = $1
+				`,
+				promotion.Info_hash).Scan(&info_hash_id)
+			if err != nil {
+				if errors.Is(err, pgx.ErrNoRows) {
+					writeError(w, http.StatusNotFound, MessageJSON{"error: infohash not in allowlist"})
+					return
+				}
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+				return
+			}
+		}
+
+		err = conf.Dbpool.QueryRow(ctx, `
+			INSERT INTO promotions (info_hash_id, freeleech, upload_multiplier, start_time, end_time, reason, created_time)
+			    VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING
+			    id
+			`,
+			info_hash_id, promotion.Freeleech, promotion.Upload_multiplier,
+			promotion.Start_time, promotion.End_time, promotion.Reason, promotion.Created_time).Scan(&promotion.Id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not add promotion"})
+			return
+		}
+
+		if err = handler.PromotionsChanged(ctx, conf); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: added promotion, but could not update cache"})
+			return
+		}
+
+		response, err := json.Marshal(promotion)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success adding, but error making response"})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// DeletePromotionHandler takes a DELETE request for a promotion by id, and
+// ends it early by removing it. Totals already counted under it are kept.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func DeletePromotionHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: invalid promotion id"})
+			return
+		}
+
+		tag, err := conf.Dbpool.Exec(ctx, `
+			DELETE FROM promotions
+			WHERE id = $1
+			`,
+			id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not delete promotion"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: unknown promotion"})
+			return
+		}
+
+		if err = handler.PromotionsChanged(ctx, conf); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: deleted promotion, but could not update cache"})
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestPromotions(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	mux := http.NewServeMux()
+	identity := func(h http.Handler) http.Handler { return h }
+	MuxAPIRoutes(ctx, conf, mux, identity, identity, identity)
+
+	request := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", testutils.DefaultAPIKey)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	end := conf.Now().Add(time.Hour).Format(time.RFC3339)
+	encoded := func(info_hash string) string {
+		return base64.StdEncoding.EncodeToString([]byte(info_hash))
+	}
+
+	w := request("POST", "http://example.com/api/promotions", `{"freeleech": true, "end_time": "`+end+`", "reason": "holiday"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected %d adding global freeleech, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	var global Promotion
+	if err := json.Unmarshal(w.Body.Bytes(), &global); err != nil {
+		t.Fatalf("error decoding promotion: %v", err)
+	}
+	if global.Upload_multiplier != 1 || global.Info_hash != nil {
+		t.Errorf("expected global promotion with multiplier 1, got %+v", global)
+	}
+
+	w = request("POST", "http://example.com/api/promotions", `{"info_hash": "`+encoded(testutils.AllowedInfoHashes["a"])+`", "upload_multiplier": 2, "end_time": "`+end+`"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected %d adding multiplier, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+
+	if w = request("POST", "http://example.com/api/promotions", `{"info_hash": "`+encoded("unknownunknownunknow")+`", "freeleech": true, "end_time": "`+end+`"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d for unknown infohash, got %d", http.StatusNotFound, w.Code)
+	}
+	if w = request("POST", "http://example.com/api/promotions", `{"end_time": "`+end+`"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for empty promotion, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = request("GET", "http://example.com/api/promotions", "")
+	var promotions []Promotion
+	if err := json.Unmarshal(w.Body.Bytes(), &promotions); err != nil || len(promotions) != 2 {
+		t.Fatalf("expected 2 promotions, got %s", w.Body)
+	}
+
+	// Announces on a are freeleech and have their upload doubled, and on b
+	// are only freeleech.
+	peerHandler := handler.PeerHandler(ctx, conf)
+	for _, info_hash := range []string{testutils.AllowedInfoHashes["a"], testutils.AllowedInfoHashes["b"]} {
+		for _, amount := range []int{0, 100} {
+			peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+				AnnounceKey: testutils.AnnounceKeys[1],
+				Info_hash:   info_hash,
+				Uploaded:    amount,
+				Downloaded:  amount,
+				Left:        100,
+			}))
+		}
+	}
+
+	var uploaded, downloaded int
+	err := conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    uploaded,
+		    downloaded
+		FROM
+		    peers
+		WHERE
+		    announce_key = $1
+		`, testutils.AnnounceKeys[1]).Scan(&uploaded, &downloaded)
+	if err != nil {
+		t.Fatalf("error querying peer: %v", err)
+	}
+	if uploaded != 300 || downloaded != 0 {
+		t.Errorf("expected 300 uploaded and 0 downloaded, got %d and %d", uploaded, downloaded)
+	}
+
+	if w = request("DELETE", "http://example.com/api/promotions/"+strconv.Itoa(global.Id), ""); w.Code != http.StatusOK {
+		t.Errorf("expected %d deleting promotion, got %d", http.StatusOK, w.Code)
+	}
+	if w = request("DELETE", "http://example.com/api/promotions/"+strconv.Itoa(global.Id), ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d deleting promotion again, got %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+)
+
+// RetireInfohashHandler takes a POST request to the /api/infohash/retire
+// endpoint, with the body as a JSON object with a base64-encoded infohash.
+// Unlike DeleteInfohashHandler, the infohash and its announces, snatches,
+// and download count are kept, so that its stats are preserved, but later
+// announces for it are refused with handler.RetiredFailure. Retiring an
+// infohash which is already retired keeps its original retirement time.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func RetireInfohashHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return setRetired(ctx, conf, true)
+}
+
+// RestoreInfohashHandler takes a POST request to the /api/infohash/restore
+// endpoint, with the body as a JSON object with a base64-encoded infohash
+// which has been retired, see RetireInfohashHandler. Announces for it are
+// accepted again.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func RestoreInfohashHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return setRetired(ctx, conf, false)
+}
+
+// setRetired returns a handler which retires or restores an infohash, and
+// updates its status in the announce cache.
+func setRetired(ctx context.Context, conf config.Config, retired bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var infohash Infohash
+		err := json.NewDecoder(r.Body).Decode(&infohash)
+		if err != nil || len(infohash.Info_hash) != 20 {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid infohash"})
+			return
+		}
+
+		tag, err := conf.Dbpool.Exec(ctx, `
+			UPDATE infohashes
+			SET retired_time = CASE WHEN $2 THEN
+				COALESCE(retired_time, $3)
+			    ELSE
+				NULL
+			    END
+			WHERE info_hash = $1
+			`,
+			infohash.Info_hash, retired, conf.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not update infohash"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: infohash not tracked"})
+			return
+		}
+
+		status := handler.InfohashAllowed
+		if retired {
+			status = handler.InfohashRetired
+		}
+		if err = handler.SetInfohashStatus(ctx, conf, infohash.Info_hash, status); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: updated infohash, but could not update cache"})
+			return
+		}
+
+		response, err := json.Marshal(MessageJSON{"success"})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestRetireInfohash(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	info_hash := testutils.AllowedInfoHashes["a"]
+	peerHandler := handler.PeerHandler(ctx, conf)
+	announce := func() string {
+		w := httptest.NewRecorder()
+		peerHandler(w, testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[1],
+			Info_hash:   info_hash,
+			Event:       config.Completed,
+		}))
+		return w.Body.String()
+	}
+	announce()
+
+	post := func(h func(http.ResponseWriter, *http.Request), info_hash string) int {
+		body, err := json.Marshal(Infohash{[]byte(info_hash)})
+		if err != nil {
+			t.Fatalf("error marshaling request body: %v", err)
+		}
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", "http://example.com/api/infohash", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	retire := RetireInfohashHandler(ctx, conf)
+	restore := RestoreInfohashHandler(ctx, conf)
+
+	if code := post(retire, "ffffffffffffffffffff"); code != http.StatusNotFound {
+		t.Errorf("expected %d retiring untracked infohash, got %d", http.StatusNotFound, code)
+	}
+	if code := post(retire, info_hash); code != http.StatusOK {
+		t.Fatalf("expected %d retiring infohash, got %d", http.StatusOK, code)
+	}
+
+	if reply := announce(); !strings.Contains(reply, handler.RetiredFailure) {
+		t.Errorf("expected retired failure, got %q", reply)
+	}
+
+	var downloaded int
+	err := conf.Dbpool.QueryRow(ctx, `
+		SELECT downloaded FROM infohashes WHERE info_hash = $1
+		`,
+		info_hash).Scan(&downloaded)
+	if err != nil {
+		t.Fatalf("error querying db: %v", err)
+	}
+	if downloaded != 1 {
+		t.Errorf("expected %d downloads kept after retiring, found %d", 1, downloaded)
+	}
+
+	if code := post(restore, info_hash); code != http.StatusOK {
+		t.Fatalf("expected %d restoring infohash, got %d", http.StatusOK, code)
+	}
+	if reply := announce(); strings.Contains(reply, "failure reason") {
+		t.Errorf("expected restored infohash to be announced, got %q", reply)
+	}
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+)
+
+// RotationCampaign starts a rotation campaign, in which every existing
+// announce key must be rotated by the deadline, see handler.checkRotation.
+type RotationCampaign struct {
+	Deadline time.Time `json:"deadline"`
+}
+
+// RotationStatus is the progress of a rotation campaign. Pending keys have
+// not been rotated and their deadline has not passed, and Deadline is the
+// latest of their deadlines, or nil if there are none. Expired keys were
+// not rotated in time, and are refused.
+type RotationStatus struct {
+	Deadline *time.Time `json:"deadline"`
+	Pending  int        `json:"pending"`
+	Expired  int        `json:"expired"`
+}
+
+// rotationStatus counts the keys which must still be rotated.
+func rotationStatus(ctx context.Context, conf config.Config) (RotationStatus, error) {
+	var status RotationStatus
+	err := conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    max(rotate_by) FILTER (WHERE rotate_by > $1),
+		    count(*) FILTER (WHERE rotate_by > $1),
+		    count(*) FILTER (WHERE rotate_by <= $1)
+		FROM
+		    peers
+		WHERE
+		    rotate_by IS NOT NULL
+		`,
+		conf.Now()).Scan(&status.Deadline, &status.Pending, &status.Expired)
+	if err != nil {
+		return status, fmt.Errorf("error counting keys to rotate: %w", err)
+	}
+	return status, nil
+}
+
+// writeRotationStatus writes the current RotationStatus as the response.
+func writeRotationStatus(ctx context.Context, conf config.Config, w http.ResponseWriter) {
+	status, err := rotationStatus(ctx, conf)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+		return
+	}
+
+	response, err := json.Marshal(status)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+		return
+	}
+	fmt.Fprintf(w, "%s", response)
+}
+
+// GetRotationHandler returns the RotationStatus of the rotation campaign.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetRotationHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeRotationStatus(ctx, conf, w)
+	}
+}
+
+// PostRotationHandler takes a POST request with a RotationCampaign body,
+// and marks every existing announce key to be rotated by the deadline, such
+// as after a suspected leak of the keys. Keys whose deadline has already
+// passed are left expired. Until the deadline, announces with a marked key
+// are warned with a link to the rotation page under the PublicURL, which
+// must therefore be set. The RotationStatus is returned.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PostRotationHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var campaign RotationCampaign
+		if err := json.NewDecoder(r.Body).Decode(&campaign); err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid rotation campaign"})
+			return
+		}
+		now := conf.Now()
+		if !campaign.Deadline.After(now) {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: deadline must be in the future"})
+			return
+		}
+		if conf.PublicURL == "" {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: a public url must be configured for rotation links"})
+			return
+		}
+
+		_, err := conf.Dbpool.Exec(ctx, `
+			UPDATE peers
+			SET rotate_by = $1
+			WHERE rotate_by IS NULL
+			    OR rotate_by > $2
+			`,
+			campaign.Deadline, now)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not start rotation campaign"})
+			return
+		}
+
+		if err = handler.RotationChanged(ctx, conf); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: started rotation campaign, but could not update cache"})
+			return
+		}
+
+		writeRotationStatus(ctx, conf, w)
+	}
+}
+
+// DeleteRotationHandler cancels the rotation campaign, unmarking every key
+// whose deadline has not passed. Expired keys stay expired.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func DeleteRotationHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := conf.Dbpool.Exec(ctx, `
+			UPDATE peers
+			SET rotate_by = NULL
+			WHERE rotate_by > $1
+			`,
+			conf.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not cancel rotation campaign"})
+			return
+		}
+
+		if err = handler.RotationChanged(ctx, conf); err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: cancelled rotation campaign, but could not update cache"})
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
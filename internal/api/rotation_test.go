@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestRotation(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	// The handlers take conf by value, so they are rebuilt after it changes.
+	var mux *http.ServeMux
+	var peerHandler func(w http.ResponseWriter, r *http.Request)
+	build := func() {
+		mux = http.NewServeMux()
+		identity := func(h http.Handler) http.Handler { return h }
+		MuxAPIRoutes(ctx, conf, mux, identity, identity, identity)
+		peerHandler = handler.PeerHandler(ctx, conf)
+	}
+	build()
+
+	request := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	campaign := func(deadline time.Time) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(RotationCampaign{Deadline: deadline})
+		return request("POST", "http://example.com/api/rotation", string(body))
+	}
+
+	announce := func(key string) string {
+		w := httptest.NewRecorder()
+		peerHandler(w, testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: key,
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+		}))
+		return w.Body.String()
+	}
+
+	deadline := conf.Now().Add(time.Hour)
+	if w := campaign(deadline); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d without a public url, got %d", http.StatusBadRequest, w.Code)
+	}
+	conf.PublicURL = "https://tracker.example.com"
+	build()
+
+	if w := campaign(conf.Now().Add(-time.Hour)); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for a past deadline, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Warm the cache before the campaign, which must clear it.
+	if body := announce(testutils.AnnounceKeys[1]); strings.Contains(body, "warning message") {
+		t.Fatalf("expected no warning before the campaign, got %q", body)
+	}
+
+	w := campaign(deadline)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d starting campaign, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var status RotationStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("error decoding rotation status: %v", err)
+	}
+	if status.Pending != len(testutils.AnnounceKeys) || status.Expired != 0 || status.Deadline == nil {
+		t.Errorf("expected every key pending, got %+v", status)
+	}
+
+	link := handler.RotationURL(conf, testutils.AnnounceKeys[1])
+	if body := announce(testutils.AnnounceKeys[1]); !strings.Contains(body, link) {
+		t.Errorf("expected warning with rotation link %s, got %q", link, body)
+	}
+
+	// A rotated key is no longer marked.
+	w = request("POST", "http://example.com/api/rotate?announce_key="+testutils.AnnounceKeys[1], "")
+	var key Key
+	if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+		t.Fatalf("error decoding key: %v", err)
+	}
+	if body := announce(key.Announce_key); strings.Contains(body, "warning message") || strings.Contains(body, "failure reason") {
+		t.Errorf("expected rotated key to announce without warning, got %q", body)
+	}
+
+	// After the deadline, keys which were not rotated are refused, and can
+	// no longer be rotated.
+	conf.Clock = testutils.NewFakeClock(deadline.Add(time.Minute))
+	build()
+	if body := announce(testutils.AnnounceKeys[2]); !strings.Contains(body, "announce key expired") {
+		t.Errorf("expected key past its deadline to be refused, got %q", body)
+	}
+	if w := request("POST", "http://example.com/api/rotate?announce_key="+testutils.AnnounceKeys[2], ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected %d rotating expired key, got %d", http.StatusForbidden, w.Code)
+	}
+
+	if err := json.NewDecoder(request("GET", "http://example.com/api/rotation", "").Body).Decode(&status); err != nil {
+		t.Fatalf("error decoding rotation status: %v", err)
+	}
+	if status.Pending != 0 || status.Expired != len(testutils.AnnounceKeys)-1 {
+		t.Errorf("expected every key but the rotated one expired, got %+v", status)
+	}
+
+	// Cancelling leaves expired keys expired.
+	if w := request("DELETE", "http://example.com/api/rotation", ""); w.Code != http.StatusOK {
+		t.Errorf("expected %d cancelling campaign, got %d", http.StatusOK, w.Code)
+	}
+	if body := announce(testutils.AnnounceKeys[2]); !strings.Contains(body, "announce key expired") {
+		t.Errorf("expected expired key to stay refused, got %q", body)
+	}
+}
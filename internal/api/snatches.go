@@ -0,0 +1,88 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Snatch is one completed event of an infohash, by the announce key which
+// sent it.
+type Snatch struct {
+	Announce_key string    `json:"announce_key"`
+	Snatch_time  time.Time `json:"snatch_time"`
+}
+
+// SnatchesHandler lists the snatches of the infohash given hex-encoded in
+// the path, oldest first. A key which completed the torrent more than once
+// is listed once for each completion, so that duplicate completions can be
+// found, even though the downloaded count of the infohash includes them
+// all. Snatches of erased keys are not listed.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func SnatchesHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info_hash, err := hex.DecodeString(r.PathValue("hex"))
+		if err != nil || len(info_hash) != 20 {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid infohash"})
+			return
+		}
+
+		var info_hash_id int
+		err = conf.Dbpool.QueryRow(ctx, `
+			SELECT
+			    id
+			FROM
+			    infohashes
+			WHERE
+			    info_hash = $1
+			`,
+			info_hash).Scan(&info_hash_id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusNotFound, MessageJSON{"error: infohash not tracked"})
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		rows, _ := conf.Dbpool.Query(ctx, `
+			SELECT
+			    announce_key,
+			    snatch_time
+			FROM
+			    snatches
+			    JOIN peers ON snatches.peers_id = peers.id
+			WHERE
+			    info_hash_id = $1
+			ORDER BY
+			    snatch_time,
+			    snatches.id
+			`,
+			info_hash_id)
+		snatches, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Snatch])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+		if snatches == nil {
+			snatches = []Snatch{}
+		}
+
+		response, err := json.Marshal(snatches)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestSnatches(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	mux := http.NewServeMux()
+	identity := func(h http.Handler) http.Handler { return h }
+	MuxAPIRoutes(ctx, conf, mux, identity, identity, identity)
+
+	request := func(url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", testutils.DefaultAPIKey)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// The first key completes twice, as with a duplicate completion bug.
+	peerHandler := handler.PeerHandler(ctx, conf)
+	for _, key := range []string{testutils.AnnounceKeys[1], testutils.AnnounceKeys[1], testutils.AnnounceKeys[2]} {
+		announce := testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: key,
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Event:       config.Completed,
+		})
+		peerHandler(httptest.NewRecorder(), announce)
+	}
+
+	w := request("http://example.com/api/infohash/" + hex.EncodeToString([]byte(testutils.AllowedInfoHashes["a"])) + "/snatches")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var snatches []Snatch
+	if err := json.NewDecoder(w.Body).Decode(&snatches); err != nil {
+		t.Fatalf("error decoding snatches: %v", err)
+	}
+	var keys []string
+	for _, s := range snatches {
+		keys = append(keys, s.Announce_key)
+	}
+	expected := []string{testutils.AnnounceKeys[1], testutils.AnnounceKeys[1], testutils.AnnounceKeys[2]}
+	if len(keys) != len(expected) {
+		t.Fatalf("expected snatches by %v, got %v", expected, keys)
+	}
+	for i := range expected {
+		if keys[i] != expected[i] {
+			t.Errorf("expected snatches by %v, got %v", expected, keys)
+			break
+		}
+	}
+
+	w = request("http://example.com/api/infohash/" + hex.EncodeToString([]byte(testutils.AllowedInfoHashes["b"])) + "/snatches")
+	if w.Code != http.StatusOK || w.Body.String() != "[]" {
+		t.Errorf("expected empty list of snatches, got %d: %s", w.Code, w.Body)
+	}
+
+	if w = request("http://example.com/api/infohash/nothex/snatches"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for invalid infohash, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w = request("http://example.com/api/infohash/" + hex.EncodeToString([]byte("ffffffffffffffffffff")) + "/snatches"); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d for untracked infohash, got %d", http.StatusNotFound, w.Code)
+	}
+}
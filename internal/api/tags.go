@@ -0,0 +1,80 @@
+package api
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+const (
+	// MaxTags is the most tags an infohash may have.
+	MaxTags = 16
+
+	// MaxTagLength is the longest tag or category, in bytes.
+	MaxTagLength = 64
+)
+
+var (
+	ErrTooManyTags = errors.New("too many tags")
+	ErrInvalidTag  = errors.New("invalid tag")
+)
+
+// normalizeLabel trims and lowercases a tag or category, so that "Linux"
+// and "linux " are the same. Labels must be printable, and may not contain
+// commas, since tags are posted with torrent files as a comma-separated
+// list.
+func normalizeLabel(label string) (string, error) {
+	label = strings.ToLower(strings.TrimSpace(label))
+	if len(label) > MaxTagLength || strings.ContainsRune(label, ',') {
+		return "", ErrInvalidTag
+	}
+	for _, r := range label {
+		if !unicode.IsPrint(r) {
+			return "", ErrInvalidTag
+		}
+	}
+	return label, nil
+}
+
+// normalizeTags normalizes each tag, see normalizeLabel, dropping empty and
+// duplicate tags. The tags are returned sorted, and never nil, to match the
+// tags column.
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	for _, tag := range tags {
+		tag, err := normalizeLabel(tag)
+		if err != nil {
+			return nil, err
+		}
+		if tag != "" && !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > MaxTags {
+		return nil, ErrTooManyTags
+	}
+	slices.Sort(normalized)
+	return normalized, nil
+}
+
+// normalizeLabels normalizes a category and its tags.
+func normalizeLabels(category string, tags []string) (string, []string, error) {
+	category, err := normalizeLabel(category)
+	if err != nil {
+		return "", nil, err
+	}
+	tags, err = normalizeTags(tags)
+	if err != nil {
+		return "", nil, err
+	}
+	return category, tags, nil
+}
+
+// splitTags splits a comma-separated list of tags.
+func splitTags(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+	return strings.Split(tags, ",")
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	data := []struct {
+		name     string
+		tags     []string
+		expected []string
+		err      error
+	}{
+		{"none", nil, []string{}, nil},
+		{"normalized", []string{" Linux", "ISO ", "linux", ""}, []string{"iso", "linux"}, nil},
+		{"comma", []string{"a,b"}, nil, ErrInvalidTag},
+		{"unprintable", []string{"a\nb"}, nil, ErrInvalidTag},
+		{"too long", []string{strings.Repeat("a", MaxTagLength+1)}, nil, ErrInvalidTag},
+		{"too many", strings.Split("a,b,c,d,e,f,g,h,i,j,k,l,m,n,o,p,q", ","), nil, ErrTooManyTags},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			tags, err := normalizeTags(d.tags)
+			if !errors.Is(err, d.err) {
+				t.Fatalf("expected error %v, got %v", d.err, err)
+			}
+			if diff := cmp.Diff(d.expected, tags); diff != "" {
+				t.Errorf("unexpected tags (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
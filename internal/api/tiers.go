@@ -0,0 +1,209 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TierSignatureHeader carries the hex HMAC-SHA256 of the body of a tier
+// webhook request, keyed with the TierWebhookSecret.
+const TierSignatureHeader = "X-Etracker-Signature"
+
+// MaxTierWebhookBody bounds the body of a tier webhook request.
+const MaxTierWebhookBody = 1 << 16
+
+var (
+	ErrInvalidTier = errors.New("invalid tier")
+	errUnknownUser = errors.New("unknown user")
+)
+
+// UserTier is the account tier of a user, see config.Tier. An empty Tier
+// removes the user from their tier. Expires_time is when the tier lapses,
+// such as at the end of a paid period, or nil if it does not.
+type UserTier struct {
+	Username     string     `json:"username"`
+	Tier         string     `json:"tier"`
+	Expires_time *time.Time `json:"expires_time"`
+}
+
+// TierList is the configured tiers and the users in them.
+type TierList struct {
+	Tiers map[string]config.Tier `json:"tiers"`
+	Users []UserTier             `json:"users"`
+}
+
+// setUserTier stores the tier of a user, and tells every tracker instance
+// to reload the tiers of announce keys.
+func setUserTier(ctx context.Context, conf config.Config, userTier UserTier) error {
+	username, err := normalizeUsername(userTier.Username)
+	if err != nil {
+		return err
+	}
+	var tier *string
+	if userTier.Tier != "" {
+		if _, ok := conf.Tiers[userTier.Tier]; !ok {
+			return fmt.Errorf("%w: %q is not configured", ErrInvalidTier, userTier.Tier)
+		}
+		tier = &userTier.Tier
+	}
+
+	tag, err := conf.Dbpool.Exec(ctx, `
+		UPDATE users
+		SET tier = $2,
+		    tier_expires = $3
+		WHERE username = $1
+		`,
+		username, tier, userTier.Expires_time)
+	if err != nil {
+		return fmt.Errorf("error setting tier: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return errUnknownUser
+	}
+
+	return handler.TiersChanged(ctx, conf)
+}
+
+// writeTierError writes the response for an error from setUserTier.
+func writeTierError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidUsername), errors.Is(err, ErrInvalidTier):
+		writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+	case errors.Is(err, errUnknownUser):
+		writeError(w, http.StatusNotFound, MessageJSON{"error: unknown user"})
+	default:
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not set tier"})
+	}
+}
+
+// GetTiersHandler lists the configured tiers, and the users in a tier which
+// has not lapsed.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func GetTiersHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := conf.Dbpool.Query(ctx, `
+			SELECT
+			    username,
+			    tier,
+			    tier_expires
+			FROM
+			    users
+			WHERE
+			    tier IS NOT NULL
+			    AND (tier_expires IS NULL
+			        OR tier_expires > $1)
+			ORDER BY
+			    tier,
+			    username
+			`,
+			conf.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+
+		users, err := pgx.CollectRows(rows, pgx.RowToStructByPos[UserTier])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not parse response from database"})
+			return
+		}
+		if users == nil {
+			users = []UserTier{}
+		}
+		tiers := conf.Tiers
+		if tiers == nil {
+			tiers = map[string]config.Tier{}
+		}
+
+		response, err := json.Marshal(TierList{Tiers: tiers, Users: users})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// PutTierHandler takes a PUT request with a UserTier body, and sets the tier
+// of the user.
+//
+// This is an authorization-only endpoint, see WithAuthorization.
+func PutTierHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var userTier UserTier
+		if err := json.NewDecoder(r.Body).Decode(&userTier); err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid tier"})
+			return
+		}
+
+		if err := setUserTier(ctx, conf, userTier); err != nil {
+			writeTierError(w, err)
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// TierWebhookHandler takes a POST request from a payment provider, or an
+// adapter in front of one, with a UserTier body, and sets the tier of the
+// user as PutTierHandler does. Instead of the admin key, the request must
+// be signed with the TierWebhookSecret in the TierSignatureHeader. The
+// webhook does not exist unless the secret is set.
+func TierWebhookHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conf.TierWebhookSecret == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxTierWebhookBody))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: could not read request body"})
+			return
+		}
+
+		signature, err := hex.DecodeString(r.Header.Get(TierSignatureHeader))
+		if err != nil || !hmac.Equal(signature, SignTierWebhook(conf.TierWebhookSecret, body)) {
+			writeError(w, http.StatusUnauthorized, MessageJSON{"error: invalid signature"})
+			return
+		}
+
+		var userTier UserTier
+		if err = json.Unmarshal(body, &userTier); err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid tier"})
+			return
+		}
+
+		if err = setUserTier(ctx, conf, userTier); err != nil {
+			writeTierError(w, err)
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// SignTierWebhook returns the signature of a tier webhook body, to be sent
+// hex-encoded in the TierSignatureHeader.
+func SignTierWebhook(secret string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestTiers(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	conf.Tiers = map[string]config.Tier{"donor": {PeerMultiplier: 2, DownloadMultiplier: 0.5}}
+	conf.TierWebhookSecret = "webhooksecret"
+
+	mux := http.NewServeMux()
+	identity := func(h http.Handler) http.Handler { return h }
+	MuxAPIRoutes(ctx, conf, mux, identity, identity, identity)
+
+	request := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	webhook := func(body, secret string) int {
+		req := httptest.NewRequest("POST", "http://example.com/api/tiers/webhook", strings.NewReader(body))
+		req.Header.Set(TierSignatureHeader, hex.EncodeToString(SignTierWebhook(secret, []byte(body))))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	w := request("POST", "http://example.com/api/user/register", "", `{"username": "alice", "password": "correct horse"}`)
+	var session UserSession
+	if err := json.NewDecoder(w.Body).Decode(&session); err != nil {
+		t.Fatalf("error decoding session: %v", err)
+	}
+	var key Key
+	if err := json.NewDecoder(request("GET", "http://example.com/api/generate", session.Token, "").Body).Decode(&key); err != nil {
+		t.Fatalf("error decoding key: %v", err)
+	}
+
+	// downloaded announces 1000 more bytes downloaded for the key, and
+	// returns the lifetime total.
+	peerHandler := handler.PeerHandler(ctx, conf)
+	total := 0
+	downloaded := func() int {
+		total += 1000
+		peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: key.Announce_key,
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Downloaded:  total,
+			Left:        1,
+		}))
+		var stats UserStats
+		if err := json.NewDecoder(request("GET", "http://example.com/api/user/stats", session.Token, "").Body).Decode(&stats); err != nil {
+			t.Fatalf("error decoding user stats: %v", err)
+		}
+		return stats.Downloaded
+	}
+
+	if got := downloaded(); got != 1000 {
+		t.Fatalf("expected 1000 downloaded without a tier, got %d", got)
+	}
+
+	if w := request("PUT", "http://example.com/api/tiers", "", `{"username": "alice", "tier": "unknown"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an unknown tier, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := request("PUT", "http://example.com/api/tiers", "", `{"username": "nobody", "tier": "donor"}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d for an unknown user, got %d", http.StatusNotFound, w.Code)
+	}
+	if w := request("PUT", "http://example.com/api/tiers", "", `{"username": "alice", "tier": "donor"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected %d setting tier, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	if got := downloaded(); got != 1500 {
+		t.Errorf("expected half of the next 1000 downloaded to count, got %d", got)
+	}
+
+	var list TierList
+	if err := json.NewDecoder(request("GET", "http://example.com/api/tiers", "", "").Body).Decode(&list); err != nil {
+		t.Fatalf("error decoding tiers: %v", err)
+	}
+	if len(list.Users) != 1 || list.Users[0].Username != "alice" || list.Users[0].Tier != "donor" || list.Tiers["donor"] != conf.Tiers["donor"] {
+		t.Errorf("expected alice in the donor tier, got %+v", list)
+	}
+
+	body := `{"username": "alice", "tier": ""}`
+	if code := webhook(body, "wrongsecret"); code != http.StatusUnauthorized {
+		t.Errorf("expected %d for a bad signature, got %d", http.StatusUnauthorized, code)
+	}
+	if code := webhook(body, conf.TierWebhookSecret); code != http.StatusOK {
+		t.Fatalf("expected %d from the webhook, got %d", http.StatusOK, code)
+	}
+
+	if got := downloaded(); got != 2500 {
+		t.Errorf("expected all of the next 1000 downloaded to count after the tier is removed, got %d", got)
+	}
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Errors returned by parseTorrent for corrupt or unsupported torrent files.
+var (
+	ErrTorrentNotDict        = errors.New("torrent file is not a dictionary")
+	ErrTorrentNoInfo         = errors.New("missing info dictionary")
+	ErrTorrentNoName         = errors.New("missing name")
+	ErrTorrentNoLength       = errors.New("missing length or files")
+	ErrTorrentBadLength      = errors.New("invalid file length")
+	ErrTorrentBadPath        = errors.New("invalid file path")
+	ErrTorrentOverflow       = errors.New("total length overflows 64 bits")
+	ErrTorrentBadPieceLength = errors.New("invalid piece length")
+	ErrTorrentBadPieces      = errors.New("pieces is not a multiple of 20 bytes")
+	ErrTorrentPieceCount     = errors.New("piece count does not match length")
+)
+
+// TorrentFile is a file in a torrent, with the elements of its path joined
+// by slashes.
+type TorrentFile struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+}
+
+// TorrentMetadata is the metadata of an uploaded torrent file, see
+// TorrentInfoHandler. Creation_date is nil if the torrent file has none.
+type TorrentMetadata struct {
+	Info_hash     []byte        `json:"info_hash"`
+	Name          string        `json:"name"`
+	Length        int64         `json:"length"`
+	Piece_length  int64         `json:"piece_length"`
+	Creation_date *time.Time    `json:"creation_date"`
+	Files         []TorrentFile `json:"files"`
+}
+
+// torrentInfo is the metadata needed from a torrent file. The creation
+// date is nil if the torrent file has none.
+type torrentInfo struct {
+	name         string
+	length       int64
+	pieceLength  int64
+	creationDate *time.Time
+	files        []TorrentFile
+}
+
+// filePath returns the path of a file dictionary of a multi-file torrent,
+// with its elements joined by slashes.
+func filePath(file any) (string, error) {
+	f, _ := file.(map[string]any)
+	elements, ok := f["path"].([]any)
+	if !ok || len(elements) == 0 {
+		return "", ErrTorrentBadPath
+	}
+	path := make([]string, len(elements))
+	for i, e := range elements {
+		element, ok := e.(string)
+		if !ok || element == "" {
+			return "", ErrTorrentBadPath
+		}
+		path[i] = element
+	}
+	return strings.Join(path, "/"), nil
+}
+
+// fileLength returns the length of a single file dictionary.
+func fileLength(file any) (int64, error) {
+	f, ok := file.(map[string]any)
+	if !ok {
+		return 0, ErrTorrentBadLength
+	}
+	length, ok := f["length"].(int64)
+	if !ok || length < 0 {
+		return 0, ErrTorrentBadLength
+	}
+	return length, nil
+}
+
+// parseTorrent checks that a decoded torrent file is well formed, and
+// returns its name, total length, piece length, creation date, and files.
+// A single-file torrent has one file, named after the torrent. The length
+// of a multi-file torrent is the sum of its files, which must fit in 64
+// bits. The pieces must be a
+// whole number of 20-byte SHA-1 hashes, one for each piece of the total
+// length.
+func parseTorrent(data any) (torrentInfo, error) {
+	torrent, ok := data.(map[string]any)
+	if !ok {
+		return torrentInfo{}, ErrTorrentNotDict
+	}
+	info, ok := torrent["info"].(map[string]any)
+	if !ok {
+		return torrentInfo{}, ErrTorrentNoInfo
+	}
+
+	name, ok := info["name"].(string)
+	if !ok || name == "" {
+		return torrentInfo{}, ErrTorrentNoName
+	}
+
+	var length int64
+	var torrentFiles []TorrentFile
+	if _, ok := info["length"]; ok {
+		l, err := fileLength(info)
+		if err != nil {
+			return torrentInfo{}, err
+		}
+		length = l
+		torrentFiles = []TorrentFile{{Path: name, Length: l}}
+	} else {
+		files, ok := info["files"].([]any)
+		if !ok || len(files) == 0 {
+			return torrentInfo{}, ErrTorrentNoLength
+		}
+		for _, f := range files {
+			l, err := fileLength(f)
+			if err != nil {
+				return torrentInfo{}, err
+			}
+			if length > math.MaxInt64-l {
+				return torrentInfo{}, ErrTorrentOverflow
+			}
+			length += l
+			path, err := filePath(f)
+			if err != nil {
+				return torrentInfo{}, err
+			}
+			torrentFiles = append(torrentFiles, TorrentFile{Path: path, Length: l})
+		}
+	}
+
+	pieceLength, ok := info["piece length"].(int64)
+	if !ok || pieceLength <= 0 {
+		return torrentInfo{}, ErrTorrentBadPieceLength
+	}
+	pieces, ok := info["pieces"].(string)
+	if !ok || len(pieces)%20 != 0 {
+		return torrentInfo{}, ErrTorrentBadPieces
+	}
+	// Written so as not to overflow for lengths near math.MaxInt64.
+	expected := length / pieceLength
+	if length%pieceLength != 0 {
+		expected++
+	}
+	if int64(len(pieces)/20) != expected {
+		return torrentInfo{}, fmt.Errorf("%w: %d pieces for %d bytes", ErrTorrentPieceCount, len(pieces)/20, length)
+	}
+
+	var creationDate *time.Time
+	if seconds, ok := torrent["creation date"].(int64); ok {
+		date := time.Unix(seconds, 0).UTC()
+		creationDate = &date
+	}
+
+	return torrentInfo{
+		name:         name,
+		length:       length,
+		pieceLength:  pieceLength,
+		creationDate: creationDate,
+		files:        torrentFiles,
+	}, nil
+}
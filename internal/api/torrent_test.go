@@ -0,0 +1,101 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+func TestParseTorrentFiles(t *testing.T) {
+	data := []struct {
+		file   string
+		name   string
+		length int64
+		files  int
+	}{
+		{"./test_files/post/singlefile.txt.torrent", "singlefile.txt", 12, 1},
+		{"./test_files/post/multifile.torrent", "multifile", 18, 2},
+	}
+
+	for _, d := range data {
+		f, err := os.Open(d.file)
+		if err != nil {
+			t.Fatalf("could not open file: %v", err)
+		}
+		decoded, err := bencode.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("could not decode %s: %v", d.file, err)
+		}
+
+		torrent, err := parseTorrent(decoded)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", d.file, err)
+		}
+		if torrent.name != d.name || torrent.length != d.length {
+			t.Errorf("%s: expected %s of %d bytes, got %s of %d bytes", d.file, d.name, d.length, torrent.name, torrent.length)
+		}
+		if len(torrent.files) != d.files {
+			t.Errorf("%s: expected %d files, got %d", d.file, d.files, len(torrent.files))
+		}
+	}
+}
+
+func TestParseTorrent(t *testing.T) {
+	pieces := func(n int) string { return strings.Repeat("x", 20*n) }
+	files := func(lengths ...int64) []any {
+		var files []any
+		for _, l := range lengths {
+			files = append(files, map[string]any{"length": l, "path": []any{"f"}})
+		}
+		return files
+	}
+
+	data := []struct {
+		name     string
+		info     map[string]any
+		expected error
+	}{
+		{"single file", map[string]any{"name": "a", "length": int64(100), "piece length": int64(32), "pieces": pieces(4)}, nil},
+		{"multi file", map[string]any{"name": "a", "files": files(16, 16, 1), "piece length": int64(16), "pieces": pieces(3)}, nil},
+		{"large file", map[string]any{"name": "a", "length": int64(5 << 30), "piece length": int64(1 << 30), "pieces": pieces(5)}, nil},
+		{"no name", map[string]any{"length": int64(1), "piece length": int64(16), "pieces": pieces(1)}, ErrTorrentNoName},
+		{"no length", map[string]any{"name": "a", "piece length": int64(16), "pieces": pieces(1)}, ErrTorrentNoLength},
+		{"negative length", map[string]any{"name": "a", "length": int64(-1), "piece length": int64(16), "pieces": ""}, ErrTorrentBadLength},
+		{"overflow", map[string]any{"name": "a", "files": files(math.MaxInt64, 1), "piece length": int64(16), "pieces": ""}, ErrTorrentOverflow},
+		{"no piece length", map[string]any{"name": "a", "length": int64(1), "pieces": pieces(1)}, ErrTorrentBadPieceLength},
+		{"no path", map[string]any{"name": "a", "files": []any{map[string]any{"length": int64(1)}}, "piece length": int64(16), "pieces": pieces(1)}, ErrTorrentBadPath},
+		{"empty path element", map[string]any{"name": "a", "files": []any{map[string]any{"length": int64(1), "path": []any{""}}}, "piece length": int64(16), "pieces": pieces(1)}, ErrTorrentBadPath},
+		{"truncated pieces", map[string]any{"name": "a", "length": int64(1), "piece length": int64(16), "pieces": pieces(1)[1:]}, ErrTorrentBadPieces},
+		{"too few pieces", map[string]any{"name": "a", "length": int64(33), "piece length": int64(16), "pieces": pieces(2)}, ErrTorrentPieceCount},
+		{"too many pieces", map[string]any{"name": "a", "length": int64(32), "piece length": int64(16), "pieces": pieces(3)}, ErrTorrentPieceCount},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			_, err := parseTorrent(map[string]any{"info": d.info})
+			if !errors.Is(err, d.expected) {
+				t.Errorf("expected %v, got %v", d.expected, err)
+			}
+		})
+	}
+
+	torrent, err := parseTorrent(map[string]any{
+		"creation date": int64(1700000000),
+		"info":          map[string]any{"name": "a", "length": int64(1), "piece length": int64(16), "pieces": pieces(1)},
+	})
+	if err != nil || torrent.creationDate == nil || torrent.creationDate.Unix() != 1700000000 {
+		t.Errorf("expected creation date 1700000000, got %v, %v", torrent.creationDate, err)
+	}
+
+	if _, err := parseTorrent("not a torrent"); !errors.Is(err, ErrTorrentNotDict) {
+		t.Errorf("expected %v, got %v", ErrTorrentNotDict, err)
+	}
+	if _, err := parseTorrent(map[string]any{}); !errors.Is(err, ErrTorrentNoInfo) {
+		t.Errorf("expected %v, got %v", ErrTorrentNoInfo, err)
+	}
+}
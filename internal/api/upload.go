@@ -0,0 +1,320 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/events"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// MaxArchiveTorrents is the most torrent files which can be uploaded at
+// once, in a zip archive or as several files, see PostTorrentFileHandler.
+const MaxArchiveTorrents = 1000
+
+// Statuses of a TorrentUpload.
+const (
+	UploadAdded     = "added"
+	UploadDuplicate = "duplicate"
+	UploadError     = "error"
+)
+
+// TorrentUpload is the result for one torrent file of a bulk upload, see
+// PostTorrentFileHandler. File is the name of the uploaded file, prefixed
+// by the name of its zip archive if it was in one.
+type TorrentUpload struct {
+	File      string `json:"file"`
+	Status    string `json:"status"`
+	Info_hash []byte `json:"info_hash,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// zipMagic is the signature at the start of a zip archive. Torrent files,
+// which are bencoded dictionaries, always start with "d".
+var zipMagic = []byte("PK\x03\x04")
+
+// uploadError is an error caused by the uploaded torrent file, rather than
+// by the tracker.
+type uploadError struct {
+	msg string
+}
+
+func (e uploadError) Error() string {
+	return e.msg
+}
+
+// preparedTorrent is an uploaded torrent file ready to be inserted, see
+// prepareTorrent.
+type preparedTorrent struct {
+	info_hash []byte
+	file      []byte
+	files     []byte
+	info      torrentInfo
+}
+
+// prepareTorrent decodes and checks an uploaded torrent file, see
+// parseTorrent, strips out any announce url, sets the private flag, and
+// calculates its infohash. Errors caused by the torrent file are
+// uploadErrors.
+func prepareTorrent(r io.Reader) (preparedTorrent, error) {
+	data, err := bencode.Decode(r)
+	if err != nil {
+		return preparedTorrent{}, uploadError{"could not decode posted file"}
+	}
+
+	torrent, err := parseTorrent(data)
+	if err != nil {
+		return preparedTorrent{}, uploadError{fmt.Sprintf("invalid torrent file: %v", err)}
+	}
+
+	// Strip out announce url, and any BEP 12 announce-list.
+	data.(map[string]any)["announce"] = ""
+	delete(data.(map[string]any), "announce-list")
+
+	// Ensure private flag is set.
+	data.(map[string]any)["info"].(map[string]any)["private"] = int64(1)
+
+	// Calculate info_hash.
+	var b bytes.Buffer
+	err = bencode.Marshal(&b, data.(map[string]any)["info"])
+	if err != nil {
+		return preparedTorrent{}, errors.New("could not calculate infohash")
+	}
+	info_hash := sha1.Sum(b.Bytes())
+
+	// Re-encode stripped torrent file.
+	var torrentFile bytes.Buffer
+	err = bencode.Marshal(&torrentFile, data)
+	if err != nil {
+		return preparedTorrent{}, errors.New("could not construct new torrent file")
+	}
+
+	files, err := json.Marshal(torrent.files)
+	if err != nil {
+		return preparedTorrent{}, errors.New("could not encode file list")
+	}
+
+	return preparedTorrent{info_hash: info_hash[:], file: torrentFile.Bytes(), files: files, info: torrent}, nil
+}
+
+// execer is satisfied by both a pool and a transaction.
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// insertTorrent inserts a prepared torrent file with its metadata, and
+// reports whether it was inserted, or skipped as already tracked.
+func insertTorrent(ctx context.Context, db execer, torrent preparedTorrent, category string, tags []string) (bool, error) {
+	tag, err := db.Exec(ctx, `
+		WITH inserted AS (
+		    INSERT INTO infohashes (info_hash, name, file, length, category, tags)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		    ON CONFLICT (info_hash)
+			DO NOTHING
+		    RETURNING
+			id
+		)
+		INSERT INTO torrent_files (info_hash_id, piece_length, creation_date, files)
+		SELECT
+		    id,
+		    $7,
+		    $8,
+		    $9
+		FROM
+		    inserted
+		`,
+		torrent.info_hash, torrent.info.name, torrent.file, torrent.info.length, category, tags,
+		torrent.info.pieceLength, torrent.info.creationDate, torrent.files)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// uploadedFile is a torrent file to be prepared, or the error with which it
+// was refused.
+type uploadedFile struct {
+	name string
+	data []byte
+	err  error
+}
+
+// readUploads reads the posted files, expanding zip archives into the
+// torrent files they contain. Entries of an archive which are not torrent
+// files, or which are larger than limit, are refused. An error is returned
+// if more than MaxArchiveTorrents files are found, or if the files come to
+// more than limit bytes in total once decompressed, since a small archive
+// can hold many entries which each decompress to just under limit.
+func readUploads(headers []*multipart.FileHeader, limit int64) ([]uploadedFile, error) {
+	tooMany := uploadError{fmt.Sprintf("at most %d torrent files can be uploaded at once", MaxArchiveTorrents)}
+	tooLarge := uploadError{fmt.Sprintf("uploaded files larger than %d bytes in total", limit)}
+
+	var uploads []uploadedFile
+	var total int64
+	for _, header := range headers {
+		if len(uploads) >= MaxArchiveTorrents {
+			return nil, tooMany
+		}
+		data, err := readFileHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(data, zipMagic) {
+			total += int64(len(data))
+			if limit > 0 && total > limit {
+				return nil, tooLarge
+			}
+			uploads = append(uploads, uploadedFile{name: header.Filename, data: data})
+			continue
+		}
+
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			uploads = append(uploads, uploadedFile{name: header.Filename, err: uploadError{"could not read zip archive"}})
+			continue
+		}
+		for _, f := range archive.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			if len(uploads) >= MaxArchiveTorrents {
+				return nil, tooMany
+			}
+			upload := uploadedFile{name: header.Filename + "/" + f.Name}
+			switch {
+			case !strings.EqualFold(path.Ext(f.Name), ".torrent"):
+				upload.err = uploadError{"not a torrent file"}
+			case limit > 0 && f.UncompressedSize64 > uint64(limit):
+				upload.err = uploadError{fmt.Sprintf("file larger than %d bytes", limit)}
+			default:
+				upload.data, upload.err = readZipFile(f, limit)
+				total += int64(len(upload.data))
+				if limit > 0 && total > limit {
+					return nil, tooLarge
+				}
+			}
+			uploads = append(uploads, upload)
+		}
+	}
+	return uploads, nil
+}
+
+// readFileHeader reads a posted file.
+func readFileHeader(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// readZipFile reads an entry of a zip archive, refusing it if it
+// decompresses to more than limit bytes, whatever its header claims.
+func readZipFile(f *zip.File, limit int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, uploadError{"could not read file from zip archive"}
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if limit > 0 {
+		r = io.LimitReader(rc, limit+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, uploadError{"could not read file from zip archive"}
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		return nil, uploadError{fmt.Sprintf("file larger than %d bytes", limit)}
+	}
+	return data, nil
+}
+
+// postTorrentFiles handles a bulk upload for PostTorrentFileHandler, with
+// every torrent file inserted in one transaction under the same category
+// and tags. Each file gets a TorrentUpload result; a torrent file which is
+// invalid, or already tracked, does not stop the others.
+func postTorrentFiles(ctx context.Context, conf config.Config, w http.ResponseWriter, headers []*multipart.FileHeader, category string, tags []string) {
+	uploads, err := readUploads(headers, conf.MaxUploadSize)
+	var uploadErr uploadError
+	if errors.As(err, &uploadErr) {
+		writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, MessageJSON{"error: could not process posted file"})
+		return
+	}
+
+	tx, err := conf.Dbpool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error inserting infohash"})
+		return
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	results := make([]TorrentUpload, len(uploads))
+	var added []TorrentUpload
+	for i, upload := range uploads {
+		results[i] = TorrentUpload{File: upload.name, Status: UploadError}
+		if upload.err != nil {
+			results[i].Error = upload.err.Error()
+			continue
+		}
+
+		torrent, err := prepareTorrent(bytes.NewReader(upload.data))
+		if errors.As(err, &uploadErr) {
+			results[i].Error = err.Error()
+			continue
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: " + err.Error()})
+			return
+		}
+		results[i].Info_hash = torrent.info_hash
+		results[i].Name = torrent.info.name
+
+		inserted, err := insertTorrent(ctx, tx, torrent, category, tags)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error inserting infohash"})
+			return
+		}
+		if inserted {
+			results[i].Status = UploadAdded
+			added = append(added, results[i])
+		} else {
+			results[i].Status = UploadDuplicate
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error inserting infohash"})
+		return
+	}
+	for _, result := range added {
+		conf.Publish(events.Event{Kind: events.InfohashAdded, Info_hash: result.Info_hash, Name: result.Name})
+	}
+
+	response, err := json.Marshal(results)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+		return
+	}
+	fmt.Fprintf(w, "%s", response)
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+	"github.com/google/go-cmp/cmp"
+)
+
+// buildZip returns a zip archive of the named files, with a directory
+// entry which is skipped.
+func buildZip(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	if _, err := zw.Create("torrents/"); err != nil {
+		t.Fatalf("could not create zip directory: %v", err)
+	}
+	for name, data := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("could not create zip entry: %v", err)
+		}
+		if _, err = fw.Write(data); err != nil {
+			t.Fatalf("could not write zip entry: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("could not close zip archive: %v", err)
+	}
+	return b.Bytes()
+}
+
+// buildUpload returns a multipart body with each file as a file field.
+func buildUpload(t *testing.T, files ...[2]string) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, f := range files {
+		part, err := writer.CreateFormFile("file", f[0])
+		if err != nil {
+			t.Fatalf("could not create multipart writer from file: %v", err)
+		}
+		if _, err = part.Write([]byte(f[1])); err != nil {
+			t.Fatalf("could not write file content: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close multipart writer: %v", err)
+	}
+	return body, writer.FormDataContentType()
+}
+
+// uploadHeaders returns the file headers of a multipart body with each file
+// as a file field.
+func uploadHeaders(t *testing.T, files ...[2]string) []*multipart.FileHeader {
+	t.Helper()
+	body, contentType := buildUpload(t, files...)
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("could not parse content type: %v", err)
+	}
+	form, err := multipart.NewReader(body, params["boundary"]).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatalf("could not read form: %v", err)
+	}
+	return form.File["file"]
+}
+
+func TestReadUploads(t *testing.T) {
+	archive := buildZip(t, map[string][]byte{
+		"torrents/a.torrent":     []byte("d4:infod4:name1:aee"),
+		"torrents/notes.txt":     []byte("not a torrent"),
+		"torrents/large.TORRENT": bytes.Repeat([]byte("x"), 100),
+	})
+
+	headers := uploadHeaders(t, [2]string{"archive.zip", string(archive)}, [2]string{"b.torrent", "d4:infod4:name1:bee"})
+
+	uploads, err := readUploads(headers, 64)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type result struct {
+		Name string
+		Data string
+		Err  string
+	}
+	var results []result
+	for _, u := range uploads {
+		r := result{Name: u.name, Data: string(u.data)}
+		if u.err != nil {
+			r.Err = u.err.Error()
+		}
+		results = append(results, r)
+	}
+	expected := map[string]result{
+		"archive.zip/torrents/a.torrent":     {Name: "archive.zip/torrents/a.torrent", Data: "d4:infod4:name1:aee"},
+		"archive.zip/torrents/notes.txt":     {Name: "archive.zip/torrents/notes.txt", Err: "not a torrent file"},
+		"archive.zip/torrents/large.TORRENT": {Name: "archive.zip/torrents/large.TORRENT", Err: "file larger than 64 bytes"},
+		"b.torrent":                          {Name: "b.torrent", Data: "d4:infod4:name1:bee"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d uploads, got %+v", len(expected), results)
+	}
+	for _, r := range results {
+		if diff := cmp.Diff(expected[r.Name], r); diff != "" {
+			t.Errorf("upload mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestReadUploadsTotal(t *testing.T) {
+	// Each entry is within the limit, and the archive is far smaller than
+	// it, but together the entries decompress to more.
+	entries := make(map[string][]byte)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		entries["torrents/"+name+".torrent"] = bytes.Repeat([]byte("x"), 60)
+	}
+	archive := buildZip(t, entries)
+
+	data := []struct {
+		name  string
+		files [][2]string
+	}{
+		{"archive", [][2]string{{"archive.zip", string(archive)}}},
+		{"archive and file", [][2]string{{"archive.zip", string(buildZip(t, map[string][]byte{"a.torrent": entries["torrents/a.torrent"]}))}, {"b.torrent", string(entries["torrents/b.torrent"])}}},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			_, err := readUploads(uploadHeaders(t, d.files...), 100)
+			var uploadErr uploadError
+			if !errors.As(err, &uploadErr) || uploadErr.Error() != "uploaded files larger than 100 bytes in total" {
+				t.Errorf("expected total size error, got %v", err)
+			}
+		})
+	}
+
+	if _, err := readUploads(uploadHeaders(t, [2]string{"archive.zip", string(archive)}), 240); err != nil {
+		t.Errorf("expected archive within the total to be read, got %v", err)
+	}
+}
+
+func TestPostTorrentFileArchive(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	single, err := os.ReadFile("./test_files/post/singlefile.txt.torrent")
+	if err != nil {
+		t.Fatalf("could not read torrent file: %v", err)
+	}
+	multi, err := os.ReadFile("./test_files/post/multifile.torrent")
+	if err != nil {
+		t.Fatalf("could not read torrent file: %v", err)
+	}
+	archive := buildZip(t, map[string][]byte{
+		"torrents/singlefile.txt.torrent": single,
+		"torrents/multifile.torrent":      multi,
+		"torrents/corrupt.torrent":        []byte("not bencoded"),
+	})
+
+	post := func() map[string]string {
+		body, contentType := buildUpload(t, [2]string{"torrents.zip", string(archive)})
+		request := httptest.NewRequest(http.MethodPost, "https://example.com/api/torrentfile", body)
+		request.Header.Add("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		PostTorrentFileHandler(ctx, conf)(w, request)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+		var results []TorrentUpload
+		if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+			t.Fatalf("could not decode results: %v", err)
+		}
+		statuses := map[string]string{}
+		for _, r := range results {
+			statuses[r.File] = r.Status
+		}
+		return statuses
+	}
+
+	expected := map[string]string{
+		"torrents.zip/torrents/singlefile.txt.torrent": UploadAdded,
+		"torrents.zip/torrents/multifile.torrent":      UploadAdded,
+		"torrents.zip/torrents/corrupt.torrent":        UploadError,
+	}
+	if diff := cmp.Diff(expected, post()); diff != "" {
+		t.Errorf("first upload mismatch (-want +got):\n%s", diff)
+	}
+
+	expected["torrents.zip/torrents/singlefile.txt.torrent"] = UploadDuplicate
+	expected["torrents.zip/torrents/multifile.torrent"] = UploadDuplicate
+	if diff := cmp.Diff(expected, post()); diff != "" {
+		t.Errorf("second upload mismatch (-want +got):\n%s", diff)
+	}
+}
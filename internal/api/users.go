@@ -0,0 +1,439 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+	"github.com/dmoerner/etracker/internal/history"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// SessionTokenLength is the length of the hex session tokens given out
+	// on registration and login.
+	SessionTokenLength = 64
+
+	// SessionDays is how long a session lasts without being used.
+	SessionDays = 30
+
+	// MinUsernameLength and MaxUsernameLength bound the length of usernames.
+	MinUsernameLength = 3
+	MaxUsernameLength = 32
+
+	// MinPasswordLength and MaxPasswordLength bound the length of
+	// passwords in bytes. Passwords are hashed with bcrypt, which limits
+	// them to 72 bytes.
+	MinPasswordLength = 8
+	MaxPasswordLength = 72
+)
+
+var (
+	ErrInvalidUsername = errors.New("invalid username")
+	ErrInvalidPassword = errors.New("invalid password")
+	ErrInvalidSession  = errors.New("invalid session token")
+)
+
+// UserCredentials is the body of registration and login requests.
+type UserCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// UserSession is a session token for a user, sent in the Authorization
+// header of user requests. The token cannot be retrieved again.
+type UserSession struct {
+	Username string `json:"username"`
+	Token    string `json:"token"`
+}
+
+// UserStats are the totals of every announce key a user owns. Ratio is nil
+// for a user who has downloaded nothing. Seeding and Leeching count
+// distinct infohashes, however many of the user's keys are in the swarm.
+type UserStats struct {
+	Username      string   `json:"username"`
+	Announce_keys []string `json:"announce_keys"`
+	Uploaded      int      `json:"uploaded"`
+	Downloaded    int      `json:"downloaded"`
+	Ratio         *float64 `json:"ratio"`
+	Snatched      int      `json:"snatched"`
+	Seeding       int      `json:"seeding"`
+	Leeching      int      `json:"leeching"`
+}
+
+// TrafficPoint is the upload and download of a user in the Hours starting
+// at Time, as counted into their lifetime totals.
+type TrafficPoint struct {
+	Time       time.Time `json:"time"`
+	Hours      int       `json:"hours"`
+	Uploaded   int64     `json:"uploaded"`
+	Downloaded int64     `json:"downloaded"`
+}
+
+// normalizeUsername lowercases a username, which may only contain letters,
+// digits, and the characters "_", "-", and ".".
+func normalizeUsername(username string) (string, error) {
+	username = strings.ToLower(strings.TrimSpace(username))
+	if len(username) < MinUsernameLength || len(username) > MaxUsernameLength {
+		return "", ErrInvalidUsername
+	}
+	for _, r := range username {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("_-.", r)) {
+			return "", ErrInvalidUsername
+		}
+	}
+	return username, nil
+}
+
+// validatePassword checks the length of a new password.
+func validatePassword(password string) error {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// newSession creates a session for the user with the id users_id and
+// returns its token. Only a hash of the token is stored.
+func newSession(ctx context.Context, conf config.Config, users_id int) (string, error) {
+	randomBytes := make([]byte, SessionTokenLength/2)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", fmt.Errorf("unable to generate session token: %w", err)
+	}
+	token := hex.EncodeToString(randomBytes)
+
+	_, err := conf.Dbpool.Exec(ctx, `
+		INSERT INTO user_sessions (token_hash, users_id, created_time, last_used)
+		    VALUES ($1, $2, $3, $3)
+		`,
+		hashIndexerKey(token), users_id, conf.Now())
+	if err != nil {
+		return "", fmt.Errorf("unable to create session: %w", err)
+	}
+	return token, nil
+}
+
+// logIn removes the expired sessions of the user with the id users_id, and
+// creates a new session for them.
+func logIn(ctx context.Context, conf config.Config, users_id int) (string, error) {
+	_, err := conf.Dbpool.Exec(ctx, `
+		DELETE FROM user_sessions
+		WHERE users_id = $1
+		    AND last_used < $2
+		`,
+		users_id, conf.Now().AddDate(0, 0, -SessionDays))
+	if err != nil {
+		return "", fmt.Errorf("unable to remove expired sessions: %w", err)
+	}
+	return newSession(ctx, conf, users_id)
+}
+
+// sessionUser returns the id of the user with the session token, and
+// records that the session was used. Sessions unused for SessionDays are
+// invalid.
+func sessionUser(ctx context.Context, conf config.Config, token string) (int, error) {
+	var users_id int
+	err := conf.Dbpool.QueryRow(ctx, `
+		UPDATE user_sessions
+		SET last_used = $2
+		WHERE token_hash = $1
+		    AND last_used >= $3
+		RETURNING users_id
+		`,
+		hashIndexerKey(token), conf.Now(), conf.Now().AddDate(0, 0, -SessionDays)).Scan(&users_id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrInvalidSession
+		}
+		return 0, fmt.Errorf("unable to validate session: %w", err)
+	}
+	return users_id, nil
+}
+
+type usersIDKey struct{}
+
+// WithUserAuthorization is middleware which rejects any request without a
+// valid session token in the Authorization header. The id of the user is
+// passed on in the request context.
+func WithUserAuthorization(ctx context.Context, conf config.Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get("Authorization")
+			if token == "" {
+				writeError(w, http.StatusUnauthorized, MessageJSON{"error: user request with empty authorization header"})
+				return
+			}
+
+			users_id, err := sessionUser(ctx, conf, token)
+			if err != nil {
+				if errors.Is(err, ErrInvalidSession) {
+					writeError(w, http.StatusUnauthorized, MessageJSON{"error: invalid session token"})
+					return
+				}
+				writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to validate session token"})
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), usersIDKey{}, users_id)))
+		})
+	}
+}
+
+// writeSession writes a UserSession with the given status code.
+func writeSession(w http.ResponseWriter, code int, session UserSession) {
+	response, err := json.Marshal(session)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+		return
+	}
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%s", response)
+}
+
+// RegisterHandler takes a POST request with a UserCredentials body, creates
+// the user, and returns a UserSession, so that the new user is logged in.
+// Usernames are case-insensitive.
+func RegisterHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var credentials UserCredentials
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid credentials"})
+			return
+		}
+		username, err := normalizeUsername(credentials.Username)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{fmt.Sprintf("error: usernames must be %d to %d letters, digits, _, -, or .", MinUsernameLength, MaxUsernameLength)})
+			return
+		}
+		if err = validatePassword(credentials.Password); err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{fmt.Sprintf("error: passwords must be %d to %d bytes", MinPasswordLength, MaxPasswordLength)})
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(credentials.Password), bcrypt.DefaultCost)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to hash password"})
+			return
+		}
+
+		var users_id int
+		err = conf.Dbpool.QueryRow(ctx, `
+			INSERT INTO users (username, password_hash, created_time)
+			    VALUES ($1, $2, $3)
+			RETURNING id
+			`,
+			username, hash, conf.Now()).Scan(&users_id)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+				writeError(w, http.StatusBadRequest, MessageJSON{"error: username already taken"})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not add user"})
+			return
+		}
+
+		token, err := newSession(ctx, conf, users_id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"success registering, but error creating session"})
+			return
+		}
+		writeSession(w, http.StatusCreated, UserSession{Username: username, Token: token})
+	}
+}
+
+// LoginHandler takes a POST request with a UserCredentials body, and returns
+// a new UserSession if the password is correct. Expired sessions of the
+// user are removed.
+func LoginHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var credentials UserCredentials
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: did not receive valid credentials"})
+			return
+		}
+		// Unknown users get the same error as wrong passwords, so that
+		// logins cannot be used to find usernames.
+		username, err := normalizeUsername(credentials.Username)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, MessageJSON{"error: invalid username or password"})
+			return
+		}
+
+		var users_id int
+		var hash []byte
+		err = conf.Dbpool.QueryRow(ctx, `
+			SELECT
+			    id,
+			    password_hash
+			FROM
+			    users
+			WHERE
+			    username = $1
+			`,
+			username).Scan(&users_id, &hash)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+		if err != nil || bcrypt.CompareHashAndPassword(hash, []byte(credentials.Password)) != nil {
+			writeError(w, http.StatusUnauthorized, MessageJSON{"error: invalid username or password"})
+			return
+		}
+
+		token, err := logIn(ctx, conf, users_id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not create session"})
+			return
+		}
+		writeSession(w, http.StatusOK, UserSession{Username: username, Token: token})
+	}
+}
+
+// LogoutHandler takes a POST request and ends the session whose token is in
+// the Authorization header.
+//
+// This endpoint requires a session token, see WithUserAuthorization.
+func LogoutHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := conf.Dbpool.Exec(ctx, `
+			DELETE FROM user_sessions
+			WHERE token_hash = $1
+			`,
+			hashIndexerKey(r.Header.Get("Authorization")))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not end session"})
+			return
+		}
+
+		response, _ := json.Marshal(MessageJSON{"success"})
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// UserStatsHandler takes a GET request and returns the UserStats of the
+// logged in user: the announce keys they own, oldest first, their lifetime
+// totals and ratio, and the number of swarms they are currently seeding and
+// leeching.
+//
+// This endpoint requires a session token, see WithUserAuthorization.
+func UserStatsHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users_id := r.Context().Value(usersIDKey{}).(int)
+
+		var stats UserStats
+		err := conf.Dbpool.QueryRow(ctx, `
+			WITH `+db.RecentAnnouncesOfUser(1, 2, 3, "amount_left")+`
+			SELECT
+			    username,
+			    COALESCE(ARRAY_AGG(announce_key ORDER BY peers.created_time) FILTER (WHERE peers.id IS NOT NULL), '{}'),
+			    COALESCE(SUM(uploaded), 0)::bigint,
+			    COALESCE(SUM(downloaded), 0)::bigint,
+			    COALESCE(SUM(snatched), 0)::bigint,
+			    (
+				SELECT
+				    COUNT(DISTINCT info_hash_id)
+				FROM
+				    recent_announces
+				WHERE
+				    amount_left = 0),
+			    (
+				SELECT
+				    COUNT(DISTINCT info_hash_id)
+				FROM
+				    recent_announces
+				WHERE
+				    amount_left > 0)
+			FROM
+			    users
+			    LEFT JOIN peers ON peers.users_id = users.id
+			WHERE
+			    users.id = $3
+			GROUP BY
+			    users.id
+			`,
+			config.Stopped, conf.StaleCutoff(), users_id).Scan(&stats.Username, &stats.Announce_keys, &stats.Uploaded, &stats.Downloaded, &stats.Snatched, &stats.Seeding, &stats.Leeching)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+		if stats.Downloaded > 0 {
+			ratio := float64(stats.Uploaded) / float64(stats.Downloaded)
+			stats.Ratio = &ratio
+		}
+
+		response, err := json.Marshal(stats)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
+
+// UserTrafficHandler takes a GET request with an optional range query field,
+// such as "24h" or "30d", and returns the TrafficPoints of the logged in
+// user over the range, oldest first, summed over the announce keys they
+// own. Like the stats history, see history.ParseRange, ranges of up to a
+// week have hourly points, and longer ranges daily points. Hours without
+// traffic are left out.
+//
+// This endpoint requires a session token, see WithUserAuthorization.
+func UserTrafficHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users_id := r.Context().Value(usersIDKey{}).(int)
+
+		trafficRange, err := history.ParseRange(r.URL.Query().Get("range"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, MessageJSON{"error: " + err.Error()})
+			return
+		}
+		step := history.Step(trafficRange)
+
+		rows, _ := conf.Dbpool.Query(ctx, `
+			SELECT
+			    to_timestamp(floor(extract(epoch FROM hour) / $3) * $3),
+			    $4::integer,
+			    SUM(user_traffic.uploaded)::bigint,
+			    SUM(user_traffic.downloaded)::bigint
+			FROM
+			    user_traffic
+			    JOIN peers ON user_traffic.peers_id = peers.id
+			WHERE
+			    peers.users_id = $1
+			    AND hour >= $2
+			GROUP BY
+			    1
+			ORDER BY
+			    1
+			`,
+			users_id, conf.Now().Add(-trafficRange), step*3600, step)
+		points, err := pgx.CollectRows(rows, pgx.RowToStructByPos[TrafficPoint])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: could not query database"})
+			return
+		}
+		if points == nil {
+			points = []TrafficPoint{}
+		}
+
+		response, err := json.Marshal(points)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, MessageJSON{"error: unable to construct response"})
+			return
+		}
+		fmt.Fprintf(w, "%s", response)
+	}
+}
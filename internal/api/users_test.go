@@ -0,0 +1,164 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	data := []struct {
+		username string
+		expected string
+		err      bool
+	}{
+		{"alice", "alice", false},
+		{" Alice.B-C_1 ", "alice.b-c_1", false},
+		{"al", "", true},
+		{strings.Repeat("a", MaxUsernameLength+1), "", true},
+		{"alice bob", "", true},
+		{"ålice", "", true},
+	}
+
+	for _, d := range data {
+		received, err := normalizeUsername(d.username)
+		if (err != nil) != d.err {
+			t.Errorf("%q: expected error %v, got %v", d.username, d.err, err)
+		}
+		if received != d.expected {
+			t.Errorf("%q: expected %q, got %q", d.username, d.expected, received)
+		}
+	}
+}
+
+func TestUsers(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	mux := http.NewServeMux()
+	identity := func(h http.Handler) http.Handler { return h }
+	MuxAPIRoutes(ctx, conf, mux, identity, identity, identity)
+
+	request := func(method, url, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	session := func(w *httptest.ResponseRecorder) UserSession {
+		var s UserSession
+		if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+			t.Fatalf("error decoding session: %v", err)
+		}
+		return s
+	}
+
+	w := request("POST", "http://example.com/api/user/register", "", `{"username": "Alice", "password": "correct horse"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected %d registering, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	registered := session(w)
+	if registered.Username != "alice" || len(registered.Token) != SessionTokenLength {
+		t.Errorf("expected session for alice, got %+v", registered)
+	}
+
+	if w := request("POST", "http://example.com/api/user/register", "", `{"username": "alice", "password": "another password"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for a taken username, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := request("POST", "http://example.com/api/user/register", "", `{"username": "bob", "password": "short"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for a short password, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := request("POST", "http://example.com/api/user/login", "", `{"username": "alice", "password": "wrong horse"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d for a wrong password, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := request("POST", "http://example.com/api/user/login", "", `{"username": "nobody", "password": "correct horse"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d for an unknown user, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	w = request("POST", "http://example.com/api/user/login", "", `{"username": "ALICE", "password": "correct horse"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d logging in, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	token := session(w).Token
+
+	if w := request("GET", "http://example.com/api/generate", "invalid", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d generating with an invalid session, got %d", http.StatusUnauthorized, w.Code)
+	}
+	var key Key
+	if err := json.NewDecoder(request("GET", "http://example.com/api/generate", token, "").Body).Decode(&key); err != nil {
+		t.Fatalf("error decoding key: %v", err)
+	}
+
+	handler.PeerHandler(ctx, conf)(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: key.Announce_key,
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Left:        0,
+	}))
+
+	w = request("GET", "http://example.com/api/user/stats", token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d for stats, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var stats UserStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("error decoding user stats: %v", err)
+	}
+	if stats.Username != "alice" || !slices.Equal(stats.Announce_keys, []string{key.Announce_key}) {
+		t.Errorf("expected alice to own %s, got %+v", key.Announce_key, stats)
+	}
+	if stats.Seeding != 1 || stats.Leeching != 0 || stats.Ratio != nil {
+		t.Errorf("expected one seed and no ratio, got %+v", stats)
+	}
+
+	handler.PeerHandler(ctx, conf)(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: key.Announce_key,
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Left:        0,
+		Uploaded:    1000,
+	}))
+
+	w = request("GET", "http://example.com/api/user/traffic?range=24h", token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d for traffic, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var traffic []TrafficPoint
+	if err := json.NewDecoder(w.Body).Decode(&traffic); err != nil {
+		t.Fatalf("error decoding user traffic: %v", err)
+	}
+	if len(traffic) != 1 || traffic[0].Hours != 1 || traffic[0].Uploaded != 1000 || traffic[0].Downloaded != 0 {
+		t.Errorf("expected one hour with 1000 uploaded, got %+v", traffic)
+	}
+	if w := request("GET", "http://example.com/api/user/traffic?range=week", token, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an invalid range, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Logging out of one session leaves the other.
+	if w := request("POST", "http://example.com/api/user/logout", token, ""); w.Code != http.StatusOK {
+		t.Errorf("expected %d logging out, got %d", http.StatusOK, w.Code)
+	}
+	if w := request("GET", "http://example.com/api/user/stats", token, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d after logging out, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := request("GET", "http://example.com/api/user/stats", registered.Token, ""); w.Code != http.StatusOK {
+		t.Errorf("expected %d with the registration session, got %d", http.StatusOK, w.Code)
+	}
+
+	// Only the owner can rotate a key.
+	if w := request("POST", "http://example.com/api/rotate?announce_key="+key.Announce_key, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d rotating without a session, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := request("POST", "http://example.com/api/rotate?announce_key="+key.Announce_key, registered.Token, ""); w.Code != http.StatusOK {
+		t.Errorf("expected %d rotating with the owner's session, got %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,168 @@
+// Package archive retires idle infohashes. An infohash with no announces for
+// ArchiveAfterDays is archived, which hides it from the public infohash list,
+// stats, and catalog, but keeps it on the allowlist. If a client announces
+// for an archived infohash, it is resurrected on the next run. A webhook can
+// be notified ArchiveNoticeDays before an infohash is archived, and whenever
+// one is archived or resurrected.
+package archive
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/events"
+	"github.com/dmoerner/etracker/internal/handler"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Interval is how often the archival policy is applied.
+const Interval = time.Hour
+
+// Statuses of an Event.
+const (
+	Warning     = "warning"
+	Archived    = "archived"
+	Resurrected = "resurrected"
+)
+
+// Event is the Detail of the events.InfohashArchival event published for
+// each infohash which is about to be archived, has been archived, or has
+// been resurrected.
+type Event struct {
+	Info_hash     []byte    `json:"info_hash"`
+	Name          string    `json:"name"`
+	Status        string    `json:"status"`
+	Last_activity time.Time `json:"last_activity"`
+}
+
+// lastActivity is the time of the latest announce for an infohash, or the
+// time it was added if it has never been announced.
+const lastActivity = `
+	GREATEST(infohashes.created_time, (
+	    SELECT
+		MAX(last_announce)
+	    FROM
+		announces
+	    WHERE
+		announces.info_hash_id = infohashes.id))`
+
+// update runs a query which updates infohashes and returns the changed rows
+// as events with the given status.
+func update(ctx context.Context, conf config.Config, status, query string, args ...any) ([]Event, error) {
+	rows, err := conf.Dbpool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error applying archival policy: %w", err)
+	}
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Event, error) {
+		e := Event{Status: status}
+		err := row.Scan(&e.Info_hash, &e.Name, &e.Last_activity)
+		return e, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error applying archival policy: %w", err)
+	}
+	return events, nil
+}
+
+// Run applies the archival policy once, and returns an event for every
+// infohash which was warned, archived, or resurrected. It does nothing if
+// conf.ArchiveAfterDays is not positive.
+//
+// Infohashes are only archived once they have been warned for
+// ArchiveNoticeDays, so the notice is honored even if the tracker was down
+// when it fell due. Activity after a warning cancels it silently. Merged
+// infohashes are already hidden, and are never warned or archived.
+func Run(ctx context.Context, conf config.Config) ([]Event, error) {
+	if conf.ArchiveAfterDays <= 0 {
+		return nil, nil
+	}
+
+	now := conf.Now()
+	archiveCutoff := now.AddDate(0, 0, -conf.ArchiveAfterDays)
+	noticeDays := min(max(conf.ArchiveNoticeDays, 0), conf.ArchiveAfterDays)
+	warnCutoff := archiveCutoff.AddDate(0, 0, noticeDays)
+
+	resurrected, err := update(ctx, conf, Resurrected, `
+		UPDATE infohashes
+		SET archived_time = NULL, archive_warned = NULL
+		WHERE archived_time IS NOT NULL
+		    AND `+lastActivity+` > archived_time
+		RETURNING info_hash, name, `+lastActivity)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conf.Dbpool.Exec(ctx, `
+		UPDATE infohashes
+		SET archive_warned = NULL
+		WHERE archived_time IS NULL
+		    AND archive_warned IS NOT NULL
+		    AND `+lastActivity+` > archive_warned
+		`)
+	if err != nil {
+		return nil, fmt.Errorf("error applying archival policy: %w", err)
+	}
+
+	archived, err := update(ctx, conf, Archived, `
+		UPDATE infohashes
+		SET archived_time = $1
+		WHERE archived_time IS NULL
+		    AND merged_into IS NULL
+		    AND `+lastActivity+` < $2
+		    AND ($4 = 0 OR archive_warned <= $3)
+		RETURNING info_hash, name, `+lastActivity,
+		now, archiveCutoff, now.AddDate(0, 0, -noticeDays), noticeDays)
+	if err != nil {
+		return nil, err
+	}
+
+	var warned []Event
+	if noticeDays > 0 {
+		warned, err = update(ctx, conf, Warning, `
+			UPDATE infohashes
+			SET archive_warned = $1
+			WHERE archived_time IS NULL
+			    AND archive_warned IS NULL
+			    AND merged_into IS NULL
+			    AND `+lastActivity+` < $2
+			RETURNING info_hash, name, `+lastActivity,
+			now, warnCutoff)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return append(append(resurrected, archived...), warned...), nil
+}
+
+// Job applies the archival policy at startup and then every Interval,
+// skipping while read-only. Events are logged, and published as
+// events.InfohashArchival, which the server posts to conf.ArchiveWebhook if
+// set. Failures are logged and retried on the next run.
+func Job(ctx context.Context, conf config.Config) error {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+
+	for {
+		if enabled, err := handler.ReadOnly(ctx, conf); err == nil && !enabled {
+			changed, err := Run(ctx, conf)
+			if err != nil && ctx.Err() == nil {
+				log.Print(err)
+			}
+			for _, e := range changed {
+				log.Printf("Infohash %x (%s) %s, last active %s", e.Info_hash, e.Name, e.Status, e.Last_activity.Format(time.RFC3339))
+				conf.Publish(events.Event{Kind: events.InfohashArchival, Info_hash: e.Info_hash, Name: e.Name, Detail: e})
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package archive
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/api"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	clock := testutils.NewFakeClock(time.Now())
+	conf.Clock = clock
+	conf.ArchiveAfterDays = 30
+	conf.ArchiveNoticeDays = 7
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	announce := func(info_hash string) {
+		peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[1],
+			Info_hash:   info_hash,
+		}))
+	}
+
+	// statuses runs the policy and counts the events of each status.
+	statuses := func() map[string]int {
+		events, err := Run(ctx, conf)
+		if err != nil {
+			t.Fatalf("error running archival policy: %v", err)
+		}
+		counts := make(map[string]int)
+		for _, e := range events {
+			counts[e.Status]++
+		}
+		return counts
+	}
+
+	if events := statuses(); len(events) != 0 {
+		t.Errorf("expected no events for new infohashes, got %v", events)
+	}
+
+	// Every infohash but a is idle and due for a warning.
+	clock.Advance(24 * 24 * time.Hour)
+	announce(testutils.AllowedInfoHashes["a"])
+	idle := len(testutils.AllowedInfoHashes) - 1
+	if events := statuses(); events[Warning] != idle || len(events) != 1 {
+		t.Errorf("expected %d warnings, got %v", idle, events)
+	}
+
+	// Idle for 27 days and warned for 3, so not yet archived.
+	clock.Advance(3 * 24 * time.Hour)
+	if events := statuses(); len(events) != 0 {
+		t.Errorf("expected no events during notice, got %v", events)
+	}
+
+	clock.Advance(4 * 24 * time.Hour)
+	if events := statuses(); events[Archived] != idle || len(events) != 1 {
+		t.Errorf("expected %d archived, got %v", idle, events)
+	}
+
+	stats, err := api.QueryGlobalStats(ctx, conf)
+	if err != nil {
+		t.Fatalf("error querying stats: %v", err)
+	}
+	if stats.Hashcount != 1 {
+		t.Errorf("expected archived infohashes to be hidden from stats, got %d", stats.Hashcount)
+	}
+
+	clock.Advance(time.Hour)
+	announce(testutils.AllowedInfoHashes["b"])
+	if events := statuses(); events[Resurrected] != 1 || len(events) != 1 {
+		t.Errorf("expected 1 resurrected, got %v", events)
+	}
+}
@@ -1,6 +1,7 @@
 // A tracker does not need a full bencode implementation, but only needs to encode
-// error messages and peer list dicts. We therefore implement these two functions,
-// rather than relying on a full library (with reflection) for bencoding.
+// error messages and announce replies. We therefore implement a small encoder
+// for these, rather than relying on a full library (with reflection) for
+// bencoding.
 //
 // Scraping is still handled by an external library at this time.
 
@@ -8,39 +9,187 @@ package bencode
 
 import (
 	"bytes"
-	"fmt"
-	"log"
+	"encoding/binary"
+	"net"
+	"strconv"
 
 	"github.com/dmoerner/etracker/internal/config"
 )
 
+// encoder writes bencoded values to a buffer. Dictionary keys must be
+// written in sorted order, as required by BEP 3.
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.WriteString(strconv.Itoa(len(b)))
+	e.WriteByte(':')
+	e.Write(b)
+}
+
+func (e *encoder) string(s string) {
+	e.bytes([]byte(s))
+}
+
+func (e *encoder) int(i int) {
+	e.WriteByte('i')
+	e.WriteString(strconv.Itoa(i))
+	e.WriteByte('e')
+}
+
 // FailureReason generates a bencoded failure reason from a string.
 // According to BEP 3, this should be the only key included on an error.
 func FailureReason(msg string) []byte {
-	var bencoded bytes.Buffer
-	_, err := fmt.Fprintf(&bencoded, "d14:failure reason%d:%se", len(msg), msg)
-	if err != nil {
-		log.Fatal(err)
+	var e encoder
+	e.WriteByte('d')
+	e.string("failure reason")
+	e.string(msg)
+	e.WriteByte('e')
+	return e.Bytes()
+}
+
+// RetryFailure generates a bencoded failure reason which also asks the
+// client to wait retryIn seconds before announcing again. The interval key
+// is understood by most clients, and the "retry in" key, in minutes, is
+// defined by BEP 31.
+func RetryFailure(msg string, retryIn int) []byte {
+	var e encoder
+	e.WriteByte('d')
+	e.string("failure reason")
+	e.string(msg)
+	e.string("interval")
+	e.int(retryIn)
+	e.string("min interval")
+	e.int(retryIn)
+	e.string("retry in")
+	e.int((retryIn + 59) / 60)
+	e.WriteByte('e')
+	return e.Bytes()
+}
+
+// Peer is a peer to be sent in a peer list. Ip_port is in the compact format.
+// Seeding is whether the peer has the whole torrent, and Nearby whether it
+// is preferred for being close to the announcing peer, for choosing which
+// peers to send; neither is itself sent.
+type Peer struct {
+	Ip_port []byte
+	Peer_id []byte
+	Seeding bool
+	Nearby  bool `db:"-" json:"-"`
+}
+
+// AnnounceResponse is the reply to a successful announce. Keys which are
+// optional are only sent when set.
+type AnnounceResponse struct {
+	// Complete and Incomplete are the number of seeders and leechers in
+	// the swarm, sent if Counted is set.
+	Counted    bool
+	Complete   int
+	Incomplete int
+	// Peers are sent in the compact format if Compact is set, with the
+	// 6-byte IPv4 peers of BEP 23 under "peers" and the 18-byte IPv6 peers
+	// of BEP 7 under "peers6", both of which are always present. Otherwise
+	// they are sent in the original dictionary format of BEP 3, without
+	// peer ids if NoPeerID is set, as requested by no_peer_id=1.
+	Peers    []Peer
+	Compact  bool
+	NoPeerID bool
+	// TrackerID is sent as the BEP 3 "tracker id", which clients send back
+	// as trackerid on their next announce.
+	TrackerID string
+	// Warning is sent as the BEP 3 "warning message", which clients show
+	// to the user without treating the announce as failed.
+	Warning string
+	// Interval is the announce interval in seconds, or config.Interval if
+	// it is zero, and MinInterval the minimum announce interval, or
+	// config.MinInterval if it is zero.
+	Interval    int
+	MinInterval int
+}
+
+// Encode returns the bencoded reply.
+func (r AnnounceResponse) Encode() []byte {
+	interval := config.Interval
+	if r.Interval > 0 {
+		interval = r.Interval
+	}
+	minInterval := config.MinInterval
+	if r.MinInterval > 0 {
+		minInterval = r.MinInterval
+	}
+
+	var e encoder
+	e.WriteByte('d')
+	if r.Counted {
+		e.string("complete")
+		e.int(r.Complete)
+		e.string("incomplete")
+		e.int(r.Incomplete)
+	}
+	e.string("interval")
+	e.int(interval)
+	e.string("min interval")
+	e.int(minInterval)
+
+	e.string("peers")
+	if r.Compact {
+		var peers, peers6 [][]byte
+		for _, peer := range r.Peers {
+			if len(peer.Ip_port) == net.IPv6len+2 {
+				peers6 = append(peers6, peer.Ip_port)
+			} else {
+				peers = append(peers, peer.Ip_port)
+			}
+		}
+		e.bytes(bytes.Join(peers, nil))
+		e.string("peers6")
+		e.bytes(bytes.Join(peers6, nil))
+	} else {
+		e.WriteByte('l')
+		for _, peer := range r.Peers {
+			ip := net.IP(peer.Ip_port[:len(peer.Ip_port)-2]).String()
+			port := binary.BigEndian.Uint16(peer.Ip_port[len(peer.Ip_port)-2:])
+			e.WriteByte('d')
+			e.string("ip")
+			e.string(ip)
+			if !r.NoPeerID {
+				e.string("peer id")
+				e.bytes(peer.Peer_id)
+			}
+			e.string("port")
+			e.int(int(port))
+			e.WriteByte('e')
+		}
+		e.WriteByte('e')
 	}
-	return bencoded.Bytes()
-}
-
-// PeerList returns a bencoded list of peers using the compact format.
-// For more information, see BEP 23.
-func PeerList(peers [][]byte) []byte {
-	joinedPeers := bytes.Join(peers, []byte(""))
-	intervalString := fmt.Sprintf("%d", config.Interval)
-	minIntervalString := fmt.Sprintf("%d", config.MinInterval)
-	var bencoded bytes.Buffer
-	_, err := fmt.Fprintf(&bencoded, "d8:interval%d:%s12:min interval%d:%s5:peers%d:%se",
-		len(intervalString),
-		intervalString,
-		len(minIntervalString),
-		minIntervalString,
-		len(joinedPeers),
-		joinedPeers)
-	if err != nil {
-		log.Fatal(err)
+
+	if r.TrackerID != "" {
+		e.string("tracker id")
+		e.string(r.TrackerID)
+	}
+	if r.Warning != "" {
+		e.string("warning message")
+		e.string(r.Warning)
 	}
-	return bencoded.Bytes()
+	e.WriteByte('e')
+	return e.Bytes()
+}
+
+// PeerList returns a bencoded compact peer list, see AnnounceResponse.
+func PeerList(peers [][]byte, peers6 [][]byte) []byte {
+	r := AnnounceResponse{Compact: true}
+	for _, list := range [][][]byte{peers, peers6} {
+		for _, ip_port := range list {
+			r.Peers = append(r.Peers, Peer{Ip_port: ip_port})
+		}
+	}
+	return r.Encode()
+}
+
+// PeerDicts returns a bencoded list of peers using the original dictionary
+// format of BEP 3, for clients which do not support compact peer lists. If
+// noPeerID is set, peer ids are omitted, as requested by no_peer_id=1.
+func PeerDicts(peers []Peer, noPeerID bool) []byte {
+	return AnnounceResponse{Peers: peers, NoPeerID: noPeerID}.Encode()
 }
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"testing"
 
+	"github.com/dmoerner/etracker/internal/config"
 	bencode_go "github.com/jackpal/bencode-go"
 )
 
@@ -27,14 +28,34 @@ func TestFail(t *testing.T) {
 	}
 }
 
+func TestRetryFailure(t *testing.T) {
+	result := RetryFailure("under maintenance", 3600)
+
+	var expected bytes.Buffer
+	err := bencode_go.Marshal(&expected, map[string]any{
+		"failure reason": "under maintenance",
+		"interval":       3600,
+		"min interval":   3600,
+		"retry in":       60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(result, expected.Bytes()) {
+		t.Errorf("Expected %s, got %s\n", expected.Bytes(), result)
+	}
+}
+
 // reflectExpected uses "github.com/jackpal/bencode-go" to generate reference
 // expected bencode results. That is a fully-functioned library which uses
 // reflection to bencode arbitrary data structures.
-func reflectExpected(peers [][]byte) []byte {
-	expectedMap := map[string]string{
-		"interval":     "2700",
-		"min interval": "30",
+func reflectExpected(peers [][]byte, peers6 [][]byte) []byte {
+	expectedMap := map[string]any{
+		"interval":     2700,
+		"min interval": 30,
 		"peers":        string(bytes.Join(peers, []byte(""))),
+		"peers6":       string(bytes.Join(peers6, []byte(""))),
 	}
 	var expected bytes.Buffer
 	err := bencode_go.Marshal(&expected, expectedMap)
@@ -46,7 +67,11 @@ func reflectExpected(peers [][]byte) []byte {
 
 func encodeIpPort(ip string, port string) []byte {
 	var peer bytes.Buffer
-	_, err := peer.Write(net.ParseIP(ip).To4())
+	parsedIP := net.ParseIP(ip)
+	if ip4 := parsedIP.To4(); ip4 != nil {
+		parsedIP = ip4
+	}
+	_, err := peer.Write(parsedIP)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -72,15 +97,161 @@ func TestPeers(t *testing.T) {
 		peers = append(peers, encodeIpPort(ip, port))
 	}
 
-	result := PeerList(peers)
+	result := PeerList(peers, nil)
 
-	expected := reflectExpected(peers)
+	expected := reflectExpected(peers, nil)
 
 	if !bytes.Equal(result, expected) {
 		t.Errorf("Expected %v, got %v\n", expected, result)
 	}
 }
 
+func TestPeers6(t *testing.T) {
+	peers := [][]byte{encodeIpPort("10.0.0.1", "8081")}
+	peers6 := make([][]byte, 0, 8)
+	for i := 1; i <= 8; i += 1 {
+		ip := "2001:db8::" + strconv.Itoa(i)
+		port := "808" + strconv.Itoa(i)
+		peers6 = append(peers6, encodeIpPort(ip, port))
+	}
+
+	result := PeerList(peers, peers6)
+
+	expected := reflectExpected(peers, peers6)
+
+	if !bytes.Equal(result, expected) {
+		t.Errorf("Expected %v, got %v\n", expected, result)
+	}
+}
+
+func TestAnnounceResponse(t *testing.T) {
+	peers := []Peer{
+		{Ip_port: encodeIpPort("10.0.0.1", "8081"), Peer_id: []byte("-qB4650-aaaaaaaaaaaa")},
+		{Ip_port: encodeIpPort("2001:db8::2", "8082"), Peer_id: []byte("-TR4060-bbbbbbbbbbbb")},
+	}
+
+	data := []struct {
+		name     string
+		response AnnounceResponse
+		expected map[string]any
+	}{
+		{
+			"counts",
+			AnnounceResponse{Counted: true, Complete: 3, Incomplete: 7, Compact: true},
+			map[string]any{"complete": int64(3), "incomplete": int64(7), "peers": "", "peers6": ""},
+		},
+		{
+			"no counts",
+			AnnounceResponse{Compact: true},
+			map[string]any{"complete": nil, "incomplete": nil},
+		},
+		{
+			"compact",
+			AnnounceResponse{Peers: peers, Compact: true},
+			map[string]any{"peers": string(peers[0].Ip_port), "peers6": string(peers[1].Ip_port)},
+		},
+		{
+			"tracker id and warning",
+			AnnounceResponse{Peers: peers, TrackerID: "etracker-1", Warning: "use the new torrent"},
+			map[string]any{"tracker id": "etracker-1", "warning message": "use the new torrent", "peers6": nil},
+		},
+		{
+			"default interval",
+			AnnounceResponse{Compact: true},
+			map[string]any{"interval": int64(config.Interval)},
+		},
+		{
+			"interval",
+			AnnounceResponse{Compact: true, Interval: 2 * config.Interval},
+			map[string]any{"interval": int64(2 * config.Interval), "min interval": int64(config.MinInterval)},
+		},
+		{
+			"min interval",
+			AnnounceResponse{Compact: true, Interval: 600, MinInterval: 60},
+			map[string]any{"interval": int64(600), "min interval": int64(60)},
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			result := d.response.Encode()
+			decoded, err := bencode_go.Decode(bytes.NewReader(result))
+			if err != nil {
+				t.Fatalf("unable to decode reply: %v", err)
+			}
+			reply, ok := decoded.(map[string]any)
+			if !ok {
+				t.Fatalf("expected dictionary, got %v", decoded)
+			}
+
+			// Keys must be sorted, so the reply is as the library encodes it.
+			var canonical bytes.Buffer
+			if err := bencode_go.Marshal(&canonical, reply); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(result, canonical.Bytes()) {
+				t.Errorf("expected keys in sorted order %s, got %s", canonical.Bytes(), result)
+			}
+			if _, ok := reply["interval"]; !ok {
+				t.Errorf("expected interval, got %v", reply)
+			}
+			for key, expected := range d.expected {
+				if got := reply[key]; got != expected {
+					t.Errorf("expected %s %v, got %v", key, expected, got)
+				}
+			}
+		})
+	}
+}
+
+// TestIntervalsAreIntegers checks that the intervals are bencoded as
+// integers, as required by BEP 3, since strict clients ignore strings.
+func TestIntervalsAreIntegers(t *testing.T) {
+	result := AnnounceResponse{Compact: true, Interval: 1800, MinInterval: 60}.Encode()
+	for _, expected := range []string{"8:intervali1800e", "12:min intervali60e"} {
+		if !bytes.Contains(result, []byte(expected)) {
+			t.Errorf("expected %s in %s", expected, result)
+		}
+	}
+}
+
+func TestPeerDicts(t *testing.T) {
+	peers := []Peer{
+		{Ip_port: encodeIpPort("10.0.0.1", "8081"), Peer_id: []byte("-qB4650-aaaaaaaaaaaa")},
+		{Ip_port: encodeIpPort("10.0.0.2", "8082"), Peer_id: []byte("-TR4060-bbbbbbbbbbbb")},
+		{Ip_port: encodeIpPort("2001:db8::3", "8083"), Peer_id: []byte("-DE2110-cccccccccccc")},
+	}
+
+	for _, noPeerID := range []bool{false, true} {
+		var dicts []any
+		for _, peer := range peers {
+			dict := map[string]any{
+				"ip":   net.IP(peer.Ip_port[:len(peer.Ip_port)-2]).String(),
+				"port": int(binary.BigEndian.Uint16(peer.Ip_port[len(peer.Ip_port)-2:])),
+			}
+			if !noPeerID {
+				dict["peer id"] = string(peer.Peer_id)
+			}
+			dicts = append(dicts, dict)
+		}
+
+		var expected bytes.Buffer
+		err := bencode_go.Marshal(&expected, map[string]any{
+			"interval":     2700,
+			"min interval": 30,
+			"peers":        dicts,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := PeerDicts(peers, noPeerID)
+		if !bytes.Equal(result, expected.Bytes()) {
+			t.Errorf("noPeerID %v: expected %s, got %s\n", noPeerID, expected.Bytes(), result)
+		}
+	}
+}
+
 // randomPeer generates random peers for benchmarking. Adapted from
 // https://gist.github.com/porjo/f1e6b79af77893ee71e857dfba2f8e9a
 func randomPeer() []byte {
@@ -102,7 +273,7 @@ func BenchmarkNonReflect(b *testing.B) {
 		data = append(data, randomPeer())
 	}
 	for i := 0; i < b.N; i++ {
-		result := PeerList(data)
+		result := PeerList(data, nil)
 		blackhole = result
 	}
 }
@@ -114,7 +285,7 @@ func BenchmarkReflectLibrary(b *testing.B) {
 		data = append(data, randomPeer())
 	}
 	for i := 0; i < b.N; i++ {
-		result := reflectExpected(data)
+		result := reflectExpected(data, nil)
 		blackhole = result
 	}
 }
@@ -0,0 +1,269 @@
+// Package canary implements an end-to-end health check. The tracker
+// periodically announces a synthetic canary torrent to itself through the
+// full HTTP path, and reports failed or slow round trips through expvar and
+// the event bus.
+package canary
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/events"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// InfoHash is the synthetic infohash announced by the canary.
+	InfoHash = "etracker-canary-hash"
+	Name     = "etracker canary"
+
+	DefaultSlow = time.Second
+	Timeout     = 10 * time.Second
+)
+
+var (
+	ErrFailed = errors.New("canary announce failed")
+	ErrSlow   = errors.New("canary announce slow")
+)
+
+var (
+	rounds       = expvar.NewInt("canary_rounds")
+	failures     = expvar.NewInt("canary_failures")
+	slowRounds   = expvar.NewInt("canary_slow")
+	lastDuration = expvar.NewInt("canary_last_duration_ms")
+	healthy      = expvar.NewInt("canary_healthy")
+)
+
+// Alert is the Detail of the events.CanaryAlert event published when the
+// canary changes state.
+type Alert struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// BaseURL returns the URL the canary should use to reach a listener bound to
+// addr. Wildcard hosts are replaced with localhost.
+func BaseURL(addr string, useTLS bool) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+
+	return scheme + "://" + net.JoinHostPort(host, port), nil
+}
+
+// ensureTracked makes sure the canary announce key and infohash exist, and
+// returns the announce key. The key is kept in Redis so that restarts reuse
+// it rather than leaving unused keys behind.
+func ensureTracked(ctx context.Context, conf config.Config) (string, error) {
+	key, err := conf.Rdb.Get(ctx, "canary:key").Result()
+	if err != nil {
+		if err != redis.Nil {
+			return "", fmt.Errorf("error fetching canary key: %w", err)
+		}
+		key, err = config.GenerateAnnounceKey(ctx, conf)
+		if err != nil {
+			return "", err
+		}
+		err = conf.Rdb.Set(ctx, "canary:key", key, 0).Err()
+		if err != nil {
+			return "", fmt.Errorf("error storing canary key: %w", err)
+		}
+	}
+
+	// The canary key is issued by the tracker itself, so it needs no proof
+	// of work, see handler.checkVerified.
+	_, err = conf.Dbpool.Exec(ctx, `
+		INSERT INTO peers (announce_key, pow_verified)
+		    VALUES ($1, TRUE)
+		ON CONFLICT (announce_key)
+		    DO UPDATE SET
+			pow_verified = TRUE
+		`,
+		key)
+	if err != nil {
+		return "", fmt.Errorf("error inserting canary key: %w", err)
+	}
+
+	_, err = conf.Dbpool.Exec(ctx, `
+		INSERT INTO infohashes (info_hash, name)
+		    VALUES ($1, $2)
+		ON CONFLICT (info_hash)
+		    DO NOTHING
+		`,
+		[]byte(InfoHash), Name)
+	if err != nil {
+		return "", fmt.Errorf("error inserting canary infohash: %w", err)
+	}
+
+	// Either may have been cached as untracked, and the key as unverified,
+	// before they were inserted.
+	err = conf.Rdb.MSet(ctx, "announce:"+key, "true", "pow_verified:"+key, "true", "info_hash:"+InfoHash, "true").Err()
+	if err != nil {
+		return "", fmt.Errorf("error caching canary key: %w", err)
+	}
+
+	return key, nil
+}
+
+// announce sends a single canary announce and checks that the tracker
+// replied with a peer list. The canary announces as stopped, so that it never
+// appears as a peer or in swarm statistics.
+func announce(ctx context.Context, client *http.Client, baseURL, key string) error {
+	peerID := make([]byte, 12)
+	_, _ = rand.Read(peerID)
+
+	params := url.Values{}
+	params.Set("info_hash", InfoHash)
+	params.Set("peer_id", "-EC0001-"+hex.EncodeToString(peerID)[:12])
+	params.Set("port", "6881")
+	params.Set("uploaded", "0")
+	params.Set("downloaded", "0")
+	params.Set("left", "0")
+	params.Set("numwant", "0")
+	params.Set("event", "stopped")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/"+key+"/announce?"+params.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrFailed, err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrFailed, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: status %d", ErrFailed, resp.StatusCode)
+	}
+
+	data, err := bencode.Decode(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%w: invalid reply: %w", ErrFailed, err)
+	}
+	reply, ok := data.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%w: reply is not a dictionary", ErrFailed)
+	}
+	if reason, ok := reply["failure reason"]; ok {
+		return fmt.Errorf("%w: %v", ErrFailed, reason)
+	}
+	if _, ok := reply["peers"]; !ok {
+		return fmt.Errorf("%w: reply has no peers", ErrFailed)
+	}
+
+	return nil
+}
+
+// Check runs a single canary round trip, records it in the metrics, and
+// returns ErrFailed or ErrSlow if it did not succeed within slow.
+func Check(ctx context.Context, client *http.Client, baseURL, key string, slow time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := announce(ctx, client, baseURL, key)
+	duration := time.Since(start)
+
+	rounds.Add(1)
+	lastDuration.Set(duration.Milliseconds())
+
+	if err != nil {
+		failures.Add(1)
+		return duration, err
+	}
+	if duration > slow {
+		slowRounds.Add(1)
+		return duration, fmt.Errorf("%w: took %v", ErrSlow, duration)
+	}
+
+	return duration, nil
+}
+
+// Job returns a background job which runs the canary against the listener
+// at baseURL every conf.CanaryInterval. Whenever the canary becomes
+// unhealthy or recovers, the Alert is logged, and published as
+// events.CanaryAlert, which the server posts to conf.CanaryWebhook if set.
+// tlsHostname is the name to verify when baseURL is HTTPS.
+func Job(baseURL, tlsHostname string) func(ctx context.Context, conf config.Config) error {
+	return func(ctx context.Context, conf config.Config) error {
+		key, err := ensureTracked(ctx, conf)
+		if err != nil {
+			return err
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if tlsHostname != "" {
+			transport.TLSClientConfig = &tls.Config{ServerName: tlsHostname}
+		} else {
+			// The canary only ever connects to its own listener, whose
+			// certificate is usually not valid for localhost.
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		client := &http.Client{Transport: transport}
+
+		slow := conf.CanarySlow
+		if slow <= 0 {
+			slow = DefaultSlow
+		}
+
+		ticker := time.NewTicker(conf.CanaryInterval)
+		defer ticker.Stop()
+
+		wasHealthy := true
+		healthy.Set(1)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+
+			duration, err := Check(ctx, client, baseURL, key, slow)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if (err == nil) == wasHealthy {
+				continue
+			}
+			wasHealthy = err == nil
+
+			a := Alert{Status: "recovered", DurationMs: duration.Milliseconds()}
+			if err != nil {
+				healthy.Set(0)
+				a.Status = "unhealthy"
+				a.Error = err.Error()
+				log.Printf("Canary unhealthy: %v", err)
+			} else {
+				healthy.Set(1)
+				log.Printf("Canary recovered after %v", duration)
+			}
+
+			conf.Publish(events.Event{Kind: events.CanaryAlert, Detail: a})
+		}
+	}
+}
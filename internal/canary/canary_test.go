@@ -0,0 +1,90 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/bencode"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestBaseURL(t *testing.T) {
+	data := []struct {
+		addr     string
+		useTLS   bool
+		expected string
+	}{
+		{"localhost:3000", false, "http://localhost:3000"},
+		{":3000", false, "http://localhost:3000"},
+		{"0.0.0.0:443", true, "https://localhost:443"},
+		{"[::]:3000", false, "http://localhost:3000"},
+		{"192.0.2.1:3000", false, "http://192.0.2.1:3000"},
+	}
+
+	for _, d := range data {
+		got, err := BaseURL(d.addr, d.useTLS)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", d.addr, err)
+		}
+		if got != d.expected {
+			t.Errorf("%s: expected %s, got %s", d.addr, d.expected, got)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{id}/announce", handler.PeerHandler(ctx, conf))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	key, err := ensureTracked(ctx, conf)
+	if err != nil {
+		t.Fatalf("error tracking canary: %v", err)
+	}
+
+	_, err = Check(ctx, ts.Client(), ts.URL, key, time.Minute)
+	if err != nil {
+		t.Errorf("expected healthy canary, got %v", err)
+	}
+
+	// The canary announces as stopped, so it never shows up as a peer.
+	var peers int
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT COUNT(*) FROM announces WHERE event <> $1
+		`, config.Stopped).Scan(&peers)
+	if err != nil {
+		t.Fatalf("error querying announces: %v", err)
+	}
+	if peers != 0 {
+		t.Errorf("expected no active peers, found %d", peers)
+	}
+
+	_, err = Check(ctx, ts.Client(), ts.URL, "untracked", time.Minute)
+	if !errors.Is(err, ErrFailed) {
+		t.Errorf("expected ErrFailed for untracked key, got %v", err)
+	}
+}
+
+func TestCheckSlow(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write(bencode.PeerList(nil, nil))
+	}))
+	defer ts.Close()
+
+	_, err := Check(context.Background(), ts.Client(), ts.URL, "key", time.Millisecond)
+	if !errors.Is(err, ErrSlow) {
+		t.Errorf("expected ErrSlow, got %v", err)
+	}
+}
@@ -1,15 +1,28 @@
 package config
 
 import (
+	"cmp"
 	"context"
+	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"log"
+	"math"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dmoerner/etracker/internal/db"
+	"github.com/dmoerner/etracker/internal/debuglog"
+	"github.com/dmoerner/etracker/internal/events"
+	"github.com/dmoerner/etracker/internal/geoip"
+	"github.com/dmoerner/etracker/internal/locale"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
@@ -23,44 +36,692 @@ const (
 	Started
 	Stopped
 	Completed
+	// Paused is the BEP 21 event of a partial seed, a peer which has all
+	// of a torrent it wants and does not download the rest. It is sent on
+	// every announce for as long as the peer stays a partial seed.
+	Paused
 )
 
 const (
 	Interval      = 2700 // 45 minutes
 	StaleInterval = 2 * Interval
 	MinInterval   = 30 // 30 seconds
+	// MaxInterval bounds personalized announce intervals, leaving a third
+	// of StaleInterval for announces which arrive late.
+	MaxInterval = StaleInterval * 2 / 3
 
 	DefaultBackendPort      = 3000
 	DefaultFrontendHostname = "localhost"
+	DefaultUnusedKeyDays    = 7
+
+	// DefaultHistoryRetentionDays is how long the stats history is kept.
+	DefaultHistoryRetentionDays = 365
+
+	// DefaultArchiveNoticeDays is how long before archival an idle
+	// infohash is warned about.
+	DefaultArchiveNoticeDays = 7
+
+	// DefaultSnapshotEndpoint is the S3 endpoint used for stats snapshots
+	// when no other S3-compatible endpoint is configured.
+	DefaultSnapshotEndpoint = "https://s3.amazonaws.com"
+
+	// DefaultMaintenanceRetry is how long clients are asked to wait when
+	// maintenance mode is enabled without a retry time.
+	DefaultMaintenanceRetry = time.Hour
+
+	// DefaultScrapeCacheTTL is how long scrape results for an infohash are
+	// cached in Redis.
+	DefaultScrapeCacheTTL = 30 * time.Second
+
+	// DefaultClientIPHeader is the header trusted proxies set to the
+	// client IP.
+	DefaultClientIPHeader = "X-Forwarded-For"
+
+	// DefaultReadTimeout, DefaultHandlerTimeout, DefaultAdminHandlerTimeout,
+	// and DefaultMaxUploadSize are the defaults of the server timeouts and
+	// limits, see Config.ReadTimeout.
+	DefaultReadTimeout         = 5 * time.Second
+	DefaultHandlerTimeout      = time.Second
+	DefaultAdminHandlerTimeout = 5 * time.Second
+	DefaultMaxUploadSize       = 10 << 20
+
+	// DefaultGeoPeerShare is the default of GeoPeerShare.
+	DefaultGeoPeerShare = 0.5
+
+	// DefaultRatioGrace is how many bytes an announce key may download
+	// before ratio enforcement applies to it.
+	DefaultRatioGrace = 1 << 30
+
+	// DefaultOIDCGroupsClaim is the ID token claim with the groups of a
+	// user at the identity provider, as used by Authentik and Keycloak.
+	DefaultOIDCGroupsClaim = "groups"
 )
 
+// DefaultOIDCScopes are the scopes requested from the identity provider,
+// which give the claims used to name new users.
+var DefaultOIDCScopes = []string{"openid", "profile", "email"}
+
 type Announce struct {
 	Announce_key string
-	Ip_port      []byte
-	Info_hash    []byte
-	Numwant      int
-	Amount_left  int
-	Downloaded   int
-	Uploaded     int
-	Event        Event
+	Client       string
+	Peer_id      []byte
+	// Key is the optional key parameter of BEP 7, which identifies the
+	// client across changes of IP or peer_id. It is also kept in Params.
+	Key     string
+	Ip_port []byte
+	// Remote_ip is the address the announce was received from. It differs
+	// from the address in Ip_port when the ip parameter is honored, see
+	// HonorIPParam, and is the one IP bans are checked against, since the
+	// ip parameter is chosen by the client.
+	Remote_ip   []byte
+	Country     string
+	Asn         int
+	Asn_org     string
+	Info_hash   []byte
+	Numwant     int
+	Amount_left int
+	Downloaded  int
+	Uploaded    int
+	Event       Event
+	// Compact is unset only when a client asks for the dictionary peer
+	// list format with compact=0, in which case No_peer_id may ask for
+	// peer ids to be omitted.
+	Compact    bool
+	No_peer_id bool
+	// Params holds the query parameters which have no field above, such as
+	// corrupt, redundant, key, and trackerid, recorded for analysis.
+	Params map[string]string
+	// Warning is sent to the client with the reply, as a BEP 3 warning
+	// message.
+	Warning string
+	// Language is the language negotiated for failure reasons and
+	// warnings sent to the client.
+	Language string
+	// Webrtc is set for browser peers announcing over WebSocket, which are
+	// reached through WebRTC offers relayed by the tracker rather than at
+	// their ip_port.
+	Webrtc bool
+	// Decision records how the announce was handled, if the recent
+	// decisions are kept. It is not part of the announce itself.
+	Decision *debuglog.Decision `json:"-"`
 }
 
+// Clock is the source of time for interval logic: stale peers, pruning, and
+// retention. All cutoffs are computed from the Clock and written timestamps
+// are taken from it, so that the Postgres clock is never compared against
+// the application clock, and so that tests can substitute a fake clock.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SystemClock is the default Clock.
+var SystemClock Clock = systemClock{}
+
+// MaxClockSkew is the difference between the Postgres and application clocks
+// above which CheckClockSkew warns. Since all interval logic uses the Clock,
+// skew only affects rows timestamped by database defaults.
+const MaxClockSkew = 30 * time.Second
+
 type PeeringAlgorithm func(ctx context.Context, config Config, a *Announce) (int, error)
 
+// Config is the tracker configuration. It is built once, with BuildConfig or
+// New, and then copied by value. Fields which may change while the tracker
+// is running are kept in Settings instead.
 type Config struct {
-	Algorithm        PeeringAlgorithm
 	Authorization    string
 	Dbpool           *pgxpool.Pool
 	Rdb              *redis.Client
 	BackendPort      int
-	DisableAllowlist bool
 	FrontendHostname string
+	GeoIP            *geoip.Reader
+	PrivacySalt      string
+
+	// PublicURL is the base of announce URLs given to users. If empty,
+	// the host of each request is used.
+	PublicURL string
+
+	// BackupURLs are the bases of backup announce URLs, such as a UDP
+	// endpoint of the same deployment, which are added after the main
+	// announce URL to the BEP 12 announce-list of served torrent files.
+	BackupURLs []string
+
+	// Features are whether subsystems are enabled in this deployment, see
+	// Feature.
+	Features FeatureFlags
+
+	// Retention windows in days for personal data. Zero keeps data
+	// forever. See the prune package.
+	AnnounceRetentionDays int
+	ActivityRetentionDays int
+	// HistoryRetentionDays is how long the aggregate stats history is
+	// kept, see the history package. Zero keeps it forever.
+	HistoryRetentionDays int
+
+	// Quotas limit requests to API routes, keyed by route pattern.
+	Quotas map[string]Quota
+
+	// Keys which are never used for an announce are pruned after
+	// UnusedKeyDays. Zero disables this, leaving only the general prune.
+	UnusedKeyDays int
+
+	// When CaptchaSecret is set, generating a key requires a CAPTCHA
+	// token, which is verified against CaptchaVerifyURL. Any service with
+	// a reCAPTCHA-compatible siteverify API, such as hCaptcha or
+	// Turnstile, can be used.
+	CaptchaVerifyURL string
+	CaptchaSecret    string
+
+	// When PowDifficulty is positive, generating a key requires a
+	// Hashcash-style proof of work with that many leading zero bits.
+	PowDifficulty int
+
+	// When RequireInvite is set, generating a key requires a single-use
+	// invite code created through the admin API.
+	RequireInvite bool
+
+	// Tiers are the account tiers which users can be given, by name.
+	// TierWebhookSecret is the HMAC key of requests to the payment webhook
+	// which sets tiers, which is disabled if it is empty.
+	Tiers             map[string]Tier
+	TierWebhookSecret string
+
+	// OIDCIssuer enables logging in to user accounts through an external
+	// OpenID Connect identity provider, which is disabled if it is empty.
+	// OIDCRoles maps groups in the OIDCGroupsClaim of its ID tokens to
+	// tracker groups, see ParseOIDCRoles.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCScopes       []string
+	OIDCGroupsClaim  string
+	OIDCRoles        map[string]string
+
+	// MinRatio enables ratio enforcement: leeching announces with a key
+	// whose lifetime ratio is below it are given no peers, once the key
+	// has downloaded more than RatioGrace bytes. Zero disables it.
+	MinRatio   float64
+	RatioGrace int
+
+	// SwarmIntervals are the announce intervals of swarms by size, sorted
+	// by MinPeers, see ParseSwarmIntervals. SeederIntervalFactor multiplies
+	// the interval given to seeders, whose announces change the swarm less
+	// than those of leechers. Both are unused if zero.
+	SwarmIntervals       []SwarmInterval
+	SeederIntervalFactor float64
+
+	// GeoPeerShare is the most of the peers given to an announce which are
+	// chosen for being in the same network or country as it, when
+	// FeatureGeoSelection is enabled. The rest are chosen at random, so that
+	// swarms do not split into islands.
+	GeoPeerShare float64
+
+	// LoadMaxQPS and LoadMaxLatency are the announce rate of a process,
+	// and the latency of the Postgres stages of its announce replies,
+	// beyond which it gives fewer peers and lengthens the interval. Zero
+	// disables each, see handler.LoadLimits.
+	LoadMaxQPS     float64
+	LoadMaxLatency time.Duration
+
+	// ReadTimeout and WriteTimeout bound reading each request and writing
+	// its response. A zero WriteTimeout is none, since it would also cut
+	// off WebSockets, long polls, and profiles. HandlerTimeout bounds the
+	// announce, scrape, and frontend API handlers, and AdminHandlerTimeout
+	// the admin API handlers. MaxUploadSize bounds the bodies of admin API
+	// requests, such as torrent file uploads, in bytes.
+	ReadTimeout         time.Duration
+	WriteTimeout        time.Duration
+	HandlerTimeout      time.Duration
+	AdminHandlerTimeout time.Duration
+	MaxUploadSize       int64
+
+	// MaxInFlight and MaxInFlightPerIP bound the announces a process
+	// handles at once, overall and from one IP. Announces beyond them are
+	// asked to retry after MinInterval. Zero disables each.
+	MaxInFlight      int
+	MaxInFlightPerIP int
+
+	// Clock defaults to SystemClock.
+	Clock Clock
+
+	// When CanaryInterval is positive, the tracker announces a canary
+	// torrent to itself at that interval, and alerts CanaryWebhook when
+	// the round trip fails or takes longer than CanarySlow.
+	CanaryInterval time.Duration
+	CanarySlow     time.Duration
+	CanaryWebhook  string
+
+	// When AnomalyWindow is positive, announce and scrape traffic is
+	// compared every window to a rolling baseline, and AnomalyWebhook is
+	// alerted when it deviates by more than AnomalyFactor. See the
+	// anomaly package.
+	AnomalyWindow  time.Duration
+	AnomalyFactor  float64
+	AnomalyWebhook string
+
+	// When ArchiveAfterDays is positive, infohashes without announces for
+	// that many days are archived, after ArchiveWebhook is warned
+	// ArchiveNoticeDays in advance. See the archive package.
+	ArchiveAfterDays  int
+	ArchiveNoticeDays int
+	ArchiveWebhook    string
+
+	// When SnapshotDir or SnapshotBucket is set, public statistics are
+	// written there as static JSON every SnapshotInterval. See the snapshot
+	// package.
+	SnapshotInterval time.Duration
+	SnapshotDir      string
+	SnapshotEndpoint string
+	SnapshotRegion   string
+	SnapshotBucket   string
+	SnapshotPrefix   string
+
+	// When CatalogSigningKey is set, indexers with a key can download a
+	// catalog of tracked infohashes signed with it.
+	CatalogSigningKey ed25519.PrivateKey
+
+	// When MaintenanceRetry is positive, the tracker starts in maintenance
+	// mode, asking clients to retry after that long. Maintenance mode can
+	// also be toggled through the admin API.
+	MaintenanceRetry time.Duration
+
+	// When ReadOnly is set, the tracker starts in read-only mode, serving
+	// announces from Redis without writing to Postgres. Read-only mode can
+	// also be toggled through the admin API.
+	ReadOnly bool
+
+	// Events is the event bus published to by the announce pipeline, the
+	// API, and the background jobs. It may be nil, in which case nothing
+	// is published. When EventsWebhooks are set, events of
+	// EventsWebhookKinds, or of every kind if none are given, are posted
+	// to each of them, signed with EventsWebhookSecret if it is set. The
+	// canary, anomaly, and archive webhooks are sent only the events of
+	// their job, signed the same way. See the events package.
+	Events              events.Bus
+	EventsWebhooks      []string
+	EventsWebhookKinds  []events.Kind
+	EventsWebhookSecret string
+
+	// Language is the default language of failure reasons and warnings
+	// sent to clients whose Accept-Language names no supported language.
+	// See the locale package.
+	Language string
+
+	// Recent keeps the decisions made for the most recent announces,
+	// for triage through the admin API. It may be nil, in which case
+	// nothing is kept. See the debuglog package.
+	Recent *debuglog.Ring
+
+	// When SwarmFile is set, the swarms are saved to it on shutdown and
+	// restored from it on startup, see handler.SaveSwarms.
+	SwarmFile string
+
+	// TrackerID is sent to clients as the BEP 3 tracker id, if set.
+	TrackerID string
+
+	// ScrapeCacheTTL is how long scrape results for an infohash are cached
+	// in Redis. Zero disables the cache. See the scrape package.
+	ScrapeCacheTTL time.Duration
+
+	// TrustedProxies are the networks of the reverse proxies or CDN edges
+	// in front of the tracker. Requests from them are attributed to the
+	// client IP in ClientIPHeader instead of the connecting address.
+	TrustedProxies []netip.Prefix
+
+	// ClientIPHeader is the header which TrustedProxies set to the client
+	// IP, such as X-Forwarded-For, X-Real-IP, CF-Connecting-IP, or the
+	// standard Forwarded.
+	ClientIPHeader string
+
+	// When HonorIPParam is set, a public unicast address in the ip
+	// parameter of an announce is given out to peers instead of the
+	// connecting address, for clients behind NAT which know their address.
+	// It is off by default, since it lets clients point peers at any
+	// address. IP bans still apply to the connecting address.
+	HonorIPParam bool
+
+	// FailureCacheTTL is how long edge caches may keep announce failures
+	// for unknown announce keys and infohashes which are not allowed.
+	// Zero marks every announce response as not cacheable.
+	FailureCacheTTL time.Duration
+
+	// LegacyInfohashes leaves the hex infohash and magnet link out of
+	// /api/infohashes and its snapshots, for frontends which expect only
+	// the original fields.
+	LegacyInfohashes bool
+
+	// Dev enables checks at startup which are too slow or noisy for
+	// production, such as db.CheckQueryPlans.
+	Dev bool
+
+	// live holds the Settings, shared by every copy of the Config.
+	live *liveSettings
+}
+
+// Now returns the current time according to the configured Clock.
+func (conf Config) Now() time.Time {
+	if conf.Clock == nil {
+		return SystemClock.Now()
+	}
+	return conf.Clock.Now()
+}
+
+// Publish publishes e on the event bus at the current time. It does nothing
+// if there is no bus.
+func (conf Config) Publish(e events.Event) {
+	if conf.Events == nil {
+		return
+	}
+	e.Time = conf.Now()
+	conf.Events.Publish(e)
+}
+
+// StaleCutoff returns the time before which announces are stale.
+func (conf Config) StaleCutoff() time.Time {
+	return conf.Now().Add(-StaleInterval * time.Second)
+}
+
+// CheckClockSkew returns the difference between the Postgres clock and the
+// configured Clock, and logs a warning if it exceeds MaxClockSkew.
+func CheckClockSkew(ctx context.Context, conf Config) (time.Duration, error) {
+	var dbNow time.Time
+	err := conf.Dbpool.QueryRow(ctx, `SELECT NOW()`).Scan(&dbNow)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read database clock: %w", err)
+	}
+
+	skew := dbNow.Sub(conf.Now())
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		log.Printf("Database clock is %v ahead of the application clock; using the application clock for all intervals", skew)
+	}
+
+	return skew, nil
+}
+
+// Quota allows Limit requests in each Window.
+type Quota struct {
+	Limit  int
+	Window time.Duration
+}
+
+// SwarmInterval is the announce interval of swarms with at least MinPeers
+// seeders and leechers.
+type SwarmInterval struct {
+	MinPeers int
+	Interval time.Duration
+}
+
+// ParseSwarmIntervals parses a comma-separated list of announce intervals
+// in the format "min_peers=interval", for example "0=15m,1000=60m", where
+// each interval is a time.Duration. The result is sorted by MinPeers. So
+// that peers are not dropped as stale between announces, each interval must
+// be between MinInterval and MaxInterval.
+func ParseSwarmIntervals(s string) ([]SwarmInterval, error) {
+	var intervals []SwarmInterval
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		peersString, intervalString, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid swarm interval %q: missing =", entry)
+		}
+		minPeers, err := strconv.Atoi(strings.TrimSpace(peersString))
+		if err != nil || minPeers < 0 {
+			return nil, fmt.Errorf("invalid swarm interval %q: bad swarm size", entry)
+		}
+		interval, err := time.ParseDuration(strings.TrimSpace(intervalString))
+		if err != nil || interval < MinInterval*time.Second || interval > MaxInterval*time.Second {
+			return nil, fmt.Errorf("invalid swarm interval %q: interval must be between %v and %v",
+				entry, MinInterval*time.Second, MaxInterval*time.Second)
+		}
+
+		intervals = append(intervals, SwarmInterval{MinPeers: minPeers, Interval: interval})
+	}
+
+	slices.SortFunc(intervals, func(a, b SwarmInterval) int { return cmp.Compare(a.MinPeers, b.MinPeers) })
+	return intervals, nil
+}
+
+// DefaultQuotas limits key generation, since each key is a row in the peers
+// table until it is pruned, catalog downloads by each indexer, since the
+// catalog covers every infohash, and registrations and logins, which are
+// slow by design and would otherwise allow guessing passwords. Each passkey
+// login challenge and OpenID Connect login state is also held in Redis until
+// it expires.
+var DefaultQuotas = map[string]Quota{
+	"GET /api/generate": {Limit: 10, Window: 24 * time.Hour},
+	"GET /api/catalog":  {Limit: 60, Window: time.Hour},
+
+	"POST /api/user/register":              {Limit: 10, Window: 24 * time.Hour},
+	"POST /api/user/login":                 {Limit: 30, Window: time.Hour},
+	"POST /api/user/login/passkey/options": {Limit: 30, Window: time.Hour},
+	"POST /api/user/login/passkey":         {Limit: 30, Window: time.Hour},
+	"GET /api/user/oidc/login":             {Limit: 30, Window: time.Hour},
+}
+
+// ParseQuotas parses a comma-separated list of quotas in the format
+// "pattern=limit/window", for example "GET /api/generate=10/24h". The pattern
+// must match a route pattern exactly, and the window is a time.Duration.
+func ParseQuotas(s string) (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		pattern, rate, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid quota %q: missing =", entry)
+		}
+		limitString, windowString, ok := strings.Cut(rate, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid quota %q: missing /", entry)
+		}
+
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid quota %q: bad limit", entry)
+		}
+		window, err := time.ParseDuration(windowString)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid quota %q: bad window", entry)
+		}
+
+		quotas[strings.TrimSpace(pattern)] = Quota{Limit: limit, Window: window}
+	}
+
+	return quotas, nil
+}
+
+// Tier is an account tier, such as for donors, whose users' announce keys
+// are treated more generously. PeerMultiplier multiplies the number of peers
+// given by the peering algorithm, up to the number requested, and
+// DownloadMultiplier the downloads counted against the lifetime totals, so
+// that 0 is permanent freeleech.
+type Tier struct {
+	PeerMultiplier     float64 `json:"peer_multiplier"`
+	DownloadMultiplier float64 `json:"download_multiplier"`
+}
+
+// WithServerDefaults returns conf with the default of each server timeout
+// and limit which is not set, as in a Config not built by BuildConfig.
+func (conf Config) WithServerDefaults() Config {
+	if conf.ReadTimeout <= 0 {
+		conf.ReadTimeout = DefaultReadTimeout
+	}
+	if conf.HandlerTimeout <= 0 {
+		conf.HandlerTimeout = DefaultHandlerTimeout
+	}
+	if conf.AdminHandlerTimeout <= 0 {
+		conf.AdminHandlerTimeout = DefaultAdminHandlerTimeout
+	}
+	if conf.MaxUploadSize <= 0 {
+		conf.MaxUploadSize = DefaultMaxUploadSize
+	}
+	return conf
+}
+
+// MaxPeerMultiplier bounds the PeerMultiplier of a Tier.
+const MaxPeerMultiplier = 10
+
+// ParseWebhooks parses a comma-separated list of http or https webhook
+// URLs.
+func ParseWebhooks(s string) ([]string, error) {
+	return parseURLs(s, "http", "https")
+}
+
+// ParseBackupURLs parses a comma-separated list of http, https, or udp
+// announce URL bases. Trailing slashes are removed, as from PublicURL.
+func ParseBackupURLs(s string) ([]string, error) {
+	urls, err := parseURLs(s, "http", "https", "udp")
+	for i := range urls {
+		urls[i] = strings.TrimSuffix(urls[i], "/")
+	}
+	return urls, err
+}
+
+// parseURLs parses a comma-separated list of URLs with one of the given
+// schemes.
+func parseURLs(s string, schemes ...string) ([]string, error) {
+	var urls []string
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		u, err := url.Parse(entry)
+		if err != nil || !slices.Contains(schemes, u.Scheme) || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q", entry)
+		}
+		urls = append(urls, entry)
+	}
+	return urls, nil
+}
+
+// ParseTiers parses a comma-separated list of tiers in the format
+// "name=peer_multiplier/download_multiplier", for example
+// "donor=1.5/0.5,staff=2/0". The download multiplier must be between 0
+// and 1, so that a tier cannot count more than was downloaded.
+func ParseTiers(s string) (map[string]Tier, error) {
+	tiers := make(map[string]Tier)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, multipliers, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid tier %q: missing name", entry)
+		}
+		peerString, downloadString, ok := strings.Cut(multipliers, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid tier %q: missing /", entry)
+		}
+
+		peerMultiplier, err := strconv.ParseFloat(peerString, 64)
+		if err != nil || !(peerMultiplier >= 0 && peerMultiplier <= MaxPeerMultiplier) {
+			return nil, fmt.Errorf("invalid tier %q: bad peer multiplier", entry)
+		}
+		downloadMultiplier, err := strconv.ParseFloat(downloadString, 64)
+		if err != nil || !(downloadMultiplier >= 0 && downloadMultiplier <= 1) {
+			return nil, fmt.Errorf("invalid tier %q: bad download multiplier", entry)
+		}
+
+		tiers[name] = Tier{PeerMultiplier: peerMultiplier, DownloadMultiplier: downloadMultiplier}
+	}
+
+	return tiers, nil
+}
+
+// ParseTrustedProxies parses a comma-separated list of networks in CIDR
+// notation, such as "173.245.48.0/20, 2400:cb00::/32". A bare IP is a network
+// of that address alone.
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			addr = addr.Unmap()
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+
+	return proxies, nil
+}
+
+// ParseOIDCRoles parses a comma-separated list of mappings in the format
+// "idp_group=tracker_group", for example "tracker-admins=staff,vip=vip".
+// Several identity provider groups may map to the same tracker group.
+func ParseOIDCRoles(s string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		idpGroup, group, ok := strings.Cut(entry, "=")
+		idpGroup, group = strings.TrimSpace(idpGroup), strings.TrimSpace(group)
+		if !ok || idpGroup == "" || group == "" {
+			return nil, fmt.Errorf("invalid role mapping %q", entry)
+		}
+		if _, ok := roles[idpGroup]; ok {
+			return nil, fmt.Errorf("duplicate role mapping for %q", idpGroup)
+		}
+		roles[idpGroup] = group
+	}
+
+	return roles, nil
 }
 
 type TLSConfig struct {
 	CertFile    string
 	KeyFile     string
 	TlsHostname string
+
+	// DisableHTTP2 restricts the TLS listener to HTTP/1.1. HTTP/2 is
+	// negotiated by default.
+	DisableHTTP2 bool
+
+	// HTTP3 additionally serves HTTP/3 over QUIC on the same UDP port. This
+	// is experimental.
+	HTTP3 bool
+
+	// When ClientCAFile is set, clients may present a certificate signed by
+	// one of the CAs in it, and announce and scrape without an announce key
+	// in the URL, see handler.WithClientCertificate.
+	ClientCAFile string
+
+	// When AutocertHosts is set, certificates for these hostnames are
+	// obtained and renewed automatically from Let's Encrypt instead of
+	// loaded from CertFile and KeyFile, and cached in AutocertCacheDir.
+	// AutocertEmail is given to Let's Encrypt for expiry notices. The ACME
+	// challenge is answered on the TLS listener, which must then be
+	// reachable on port 443, and also on AutocertHTTPAddr if set, usually
+	// ":80", which redirects everything else to HTTPS.
+	AutocertHosts    []string
+	AutocertCacheDir string
+	AutocertEmail    string
+	AutocertHTTPAddr string
 }
 
 const AnnounceKeyLength = 30
@@ -70,6 +731,12 @@ const AnnounceKeyLength = 30
 // AnnounceKeyLength we do not need to check for collisions. We also write the
 // new key to the database.
 func GenerateAnnounceKey(ctx context.Context, conf Config) (string, error) {
+	return GenerateUserAnnounceKey(ctx, conf, nil)
+}
+
+// GenerateUserAnnounceKey is GenerateAnnounceKey for a key owned by the user
+// with the id users_id, or by no one if it is nil.
+func GenerateUserAnnounceKey(ctx context.Context, conf Config, users_id *int) (string, error) {
 	randomBytes := make([]byte, AnnounceKeyLength/2)
 	if _, err := rand.Read(randomBytes); err != nil {
 		return "", fmt.Errorf("unable to generate new announce key: %w", err)
@@ -77,13 +744,14 @@ func GenerateAnnounceKey(ctx context.Context, conf Config) (string, error) {
 	key := hex.EncodeToString(randomBytes)
 
 	_, err := conf.Dbpool.Exec(ctx, `
-			INSERT INTO peers (announce_key)
-			    VALUES ($1)
+			INSERT INTO peers (announce_key, created_time, users_id)
+			    VALUES ($1, $2, $3)
 			`,
-		key)
+		key, conf.Now(), users_id)
 	if err != nil {
 		return "", fmt.Errorf("createNSeeders: Unable to insert announce key: %w", err)
 	}
+	conf.Publish(events.Event{Kind: events.KeyGenerated, Announce_key: key})
 
 	return key, nil
 }
@@ -111,10 +779,13 @@ func BuildConfig(ctx context.Context, algorithm PeeringAlgorithm) Config {
 		log.Fatal("ETRACKER_REDIS not set in environment.")
 	}
 
+	// Context deadlines are honored so that announces can bound the time
+	// spent waiting on Redis, see handler.RedisBudget.
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: redis_password,
-		DB:       0, // Production DB
+		Addr:                  "localhost:6379",
+		Password:              redis_password,
+		DB:                    0, // Production DB
+		ContextTimeoutEnabled: true,
 	})
 
 	// An empty authorization string in the config means the API is forbidden.
@@ -129,6 +800,21 @@ func BuildConfig(ctx context.Context, algorithm PeeringAlgorithm) Config {
 		disableAllowlist = true
 	}
 
+	dev := false
+	if envDev, ok := os.LookupEnv("ETRACKER_DEV"); ok && envDev == "true" {
+		dev = true
+	}
+
+	legacyInfohashes := false
+	if envLegacyInfohashes, ok := os.LookupEnv("ETRACKER_LEGACY_INFOHASHES"); ok && envLegacyInfohashes == "true" {
+		legacyInfohashes = true
+	}
+
+	privateScrape := false
+	if envPrivateScrape, ok := os.LookupEnv("ETRACKER_PRIVATE_SCRAPE"); ok && envPrivateScrape == "true" {
+		privateScrape = true
+	}
+
 	backendPort := DefaultBackendPort
 	if envBackendPort, ok := os.LookupEnv("ETRACKER_BACKEND_PORT"); ok {
 		if intBackendPort, err := strconv.Atoi(envBackendPort); err != nil {
@@ -141,24 +827,497 @@ func BuildConfig(ctx context.Context, algorithm PeeringAlgorithm) Config {
 		frontendHostname = envFrontendHostname
 	}
 
+	publicURL := strings.TrimSuffix(os.Getenv("ETRACKER_PUBLIC_URL"), "/")
+	if publicURL != "" {
+		if u, err := url.Parse(publicURL); err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("Unable to parse ETRACKER_PUBLIC_URL: %q", publicURL)
+		}
+	}
+
+	// A privacy salt enables privacy mode, in which only salted hashes of
+	// peer IPs are stored in Postgres.
+	privacySalt := os.Getenv("ETRACKER_PRIVACY_SALT")
+
+	// The swarm file holds peer addresses, which privacy mode keeps off
+	// disk.
+	swarmFile := os.Getenv("ETRACKER_SWARM_FILE")
+	if swarmFile != "" && privacySalt != "" {
+		log.Fatal("ETRACKER_SWARM_FILE cannot be used with ETRACKER_PRIVACY_SALT")
+	}
+
+	scrapeCacheTTL := DefaultScrapeCacheTTL
+	if envScrapeCacheTTL, ok := os.LookupEnv("ETRACKER_SCRAPE_CACHE_TTL"); ok {
+		scrapeCacheTTL, err = time.ParseDuration(envScrapeCacheTTL)
+		if err != nil || scrapeCacheTTL < 0 {
+			log.Fatalf("Unable to parse ETRACKER_SCRAPE_CACHE_TTL: %q", envScrapeCacheTTL)
+		}
+	}
+
+	trustedProxies, err := ParseTrustedProxies(os.Getenv("ETRACKER_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Unable to parse ETRACKER_TRUSTED_PROXIES: %v", err)
+	}
+
+	clientIPHeader := DefaultClientIPHeader
+	if envClientIPHeader, ok := os.LookupEnv("ETRACKER_CLIENT_IP_HEADER"); ok && envClientIPHeader != "" {
+		clientIPHeader = envClientIPHeader
+	}
+
+	honorIPParam := false
+	if envHonorIPParam, ok := os.LookupEnv("ETRACKER_HONOR_IP_PARAM"); ok && envHonorIPParam == "true" {
+		honorIPParam = true
+	}
+
+	var failureCacheTTL time.Duration
+	if envFailureCacheTTL, ok := os.LookupEnv("ETRACKER_FAILURE_CACHE_TTL"); ok {
+		failureCacheTTL, err = time.ParseDuration(envFailureCacheTTL)
+		if err != nil || failureCacheTTL < 0 {
+			log.Fatalf("Unable to parse ETRACKER_FAILURE_CACHE_TTL: %q", envFailureCacheTTL)
+		}
+	}
+
+	announceRetentionDays := 0
+	if envRetention, ok := os.LookupEnv("ETRACKER_RETENTION_ANNOUNCES_DAYS"); ok {
+		if intRetention, err := strconv.Atoi(envRetention); err == nil && intRetention >= 0 {
+			announceRetentionDays = intRetention
+		}
+	}
+
+	activityRetentionDays := 0
+	if envRetention, ok := os.LookupEnv("ETRACKER_RETENTION_ACTIVITY_DAYS"); ok {
+		if intRetention, err := strconv.Atoi(envRetention); err == nil && intRetention >= 0 {
+			activityRetentionDays = intRetention
+		}
+	}
+
+	historyRetentionDays := DefaultHistoryRetentionDays
+	if envRetention, ok := os.LookupEnv("ETRACKER_RETENTION_HISTORY_DAYS"); ok {
+		if intRetention, err := strconv.Atoi(envRetention); err == nil && intRetention >= 0 {
+			historyRetentionDays = intRetention
+		}
+	}
+
+	quotas := DefaultQuotas
+	if envQuotas, ok := os.LookupEnv("ETRACKER_QUOTAS"); ok {
+		quotas, err = ParseQuotas(envQuotas)
+		if err != nil {
+			log.Fatalf("Unable to parse ETRACKER_QUOTAS: %v", err)
+		}
+	}
+
+	unusedKeyDays := DefaultUnusedKeyDays
+	if envUnusedKeyDays, ok := os.LookupEnv("ETRACKER_UNUSED_KEY_DAYS"); ok {
+		if intUnusedKeyDays, err := strconv.Atoi(envUnusedKeyDays); err == nil && intUnusedKeyDays >= 0 {
+			unusedKeyDays = intUnusedKeyDays
+		}
+	}
+
+	captchaSecret := os.Getenv("ETRACKER_CAPTCHA_SECRET")
+	captchaVerifyURL := os.Getenv("ETRACKER_CAPTCHA_VERIFY_URL")
+	if captchaSecret != "" && captchaVerifyURL == "" {
+		log.Fatal("ETRACKER_CAPTCHA_SECRET set without ETRACKER_CAPTCHA_VERIFY_URL.")
+	}
+
+	powDifficulty := 0
+	if envPowDifficulty, ok := os.LookupEnv("ETRACKER_POW_DIFFICULTY"); ok {
+		if intPowDifficulty, err := strconv.Atoi(envPowDifficulty); err == nil && intPowDifficulty >= 0 && intPowDifficulty <= 256 {
+			powDifficulty = intPowDifficulty
+		}
+	}
+
+	var tiers map[string]Tier
+	if envTiers, ok := os.LookupEnv("ETRACKER_TIERS"); ok {
+		tiers, err = ParseTiers(envTiers)
+		if err != nil {
+			log.Fatalf("Unable to parse ETRACKER_TIERS: %v", err)
+		}
+	}
+
+	// OpenID Connect login redirects back to the public URL, so it must be
+	// set. The issuer is kept as given, since ID tokens must name it
+	// exactly, trailing slash and all.
+	oidcIssuer := os.Getenv("ETRACKER_OIDC_ISSUER")
+	oidcClientID := os.Getenv("ETRACKER_OIDC_CLIENT_ID")
+	if oidcIssuer != "" && (oidcClientID == "" || publicURL == "") {
+		log.Fatal("ETRACKER_OIDC_ISSUER requires ETRACKER_OIDC_CLIENT_ID and ETRACKER_PUBLIC_URL")
+	}
+
+	oidcScopes := DefaultOIDCScopes
+	if envOIDCScopes, ok := os.LookupEnv("ETRACKER_OIDC_SCOPES"); ok {
+		oidcScopes = strings.Fields(envOIDCScopes)
+		if !slices.Contains(oidcScopes, "openid") {
+			log.Fatalf("Unable to parse ETRACKER_OIDC_SCOPES: missing openid: %q", envOIDCScopes)
+		}
+	}
+
+	oidcGroupsClaim := DefaultOIDCGroupsClaim
+	if envOIDCGroupsClaim, ok := os.LookupEnv("ETRACKER_OIDC_GROUPS_CLAIM"); ok {
+		oidcGroupsClaim = envOIDCGroupsClaim
+	}
+
+	oidcRoles := make(map[string]string)
+	if envOIDCRoles, ok := os.LookupEnv("ETRACKER_OIDC_ROLES"); ok {
+		oidcRoles, err = ParseOIDCRoles(envOIDCRoles)
+		if err != nil {
+			log.Fatalf("Unable to parse ETRACKER_OIDC_ROLES: %v", err)
+		}
+	}
+
+	var swarmIntervals []SwarmInterval
+	if envSwarmIntervals, ok := os.LookupEnv("ETRACKER_SWARM_INTERVALS"); ok {
+		swarmIntervals, err = ParseSwarmIntervals(envSwarmIntervals)
+		if err != nil {
+			log.Fatalf("Unable to parse ETRACKER_SWARM_INTERVALS: %v", err)
+		}
+	}
+
+	var seederIntervalFactor float64
+	if envSeederIntervalFactor, ok := os.LookupEnv("ETRACKER_SEEDER_INTERVAL_FACTOR"); ok {
+		seederIntervalFactor, err = strconv.ParseFloat(envSeederIntervalFactor, 64)
+		if err != nil || math.IsNaN(seederIntervalFactor) || seederIntervalFactor <= 0 {
+			log.Fatalf("Unable to parse ETRACKER_SEEDER_INTERVAL_FACTOR: %q", envSeederIntervalFactor)
+		}
+	}
+
+	geoPeerShare := DefaultGeoPeerShare
+	if envGeoPeerShare, ok := os.LookupEnv("ETRACKER_GEO_PEER_SHARE"); ok {
+		geoPeerShare, err = strconv.ParseFloat(envGeoPeerShare, 64)
+		if err != nil || !(geoPeerShare >= 0 && geoPeerShare <= 1) {
+			log.Fatalf("Unable to parse ETRACKER_GEO_PEER_SHARE: %q", envGeoPeerShare)
+		}
+	}
+
+	var minRatio float64
+	if envMinRatio, ok := os.LookupEnv("ETRACKER_MIN_RATIO"); ok {
+		minRatio, err = strconv.ParseFloat(envMinRatio, 64)
+		if err != nil || math.IsNaN(minRatio) || minRatio < 0 {
+			log.Fatalf("Unable to parse ETRACKER_MIN_RATIO: %q", envMinRatio)
+		}
+	}
+	ratioGrace := DefaultRatioGrace
+	if envRatioGrace, ok := os.LookupEnv("ETRACKER_RATIO_GRACE"); ok {
+		ratioGrace, err = strconv.Atoi(envRatioGrace)
+		if err != nil || ratioGrace < 0 {
+			log.Fatalf("Unable to parse ETRACKER_RATIO_GRACE: %q", envRatioGrace)
+		}
+	}
+
+	var loadMaxQPS float64
+	if envLoadMaxQPS, ok := os.LookupEnv("ETRACKER_LOAD_MAX_QPS"); ok {
+		loadMaxQPS, err = strconv.ParseFloat(envLoadMaxQPS, 64)
+		if err != nil || math.IsNaN(loadMaxQPS) || loadMaxQPS < 0 {
+			log.Fatalf("Unable to parse ETRACKER_LOAD_MAX_QPS: %q", envLoadMaxQPS)
+		}
+	}
+	var loadMaxLatency time.Duration
+	if envLoadMaxLatency, ok := os.LookupEnv("ETRACKER_LOAD_MAX_LATENCY"); ok {
+		loadMaxLatency, err = time.ParseDuration(envLoadMaxLatency)
+		if err != nil || loadMaxLatency < 0 {
+			log.Fatalf("Unable to parse ETRACKER_LOAD_MAX_LATENCY: %q", envLoadMaxLatency)
+		}
+	}
+
+	maxInFlight := 0
+	if envMaxInFlight, ok := os.LookupEnv("ETRACKER_MAX_IN_FLIGHT"); ok {
+		if maxInFlight, err = strconv.Atoi(envMaxInFlight); err != nil || maxInFlight < 0 {
+			log.Fatalf("Unable to parse ETRACKER_MAX_IN_FLIGHT: %q", envMaxInFlight)
+		}
+	}
+	maxInFlightPerIP := 0
+	if envMaxInFlightPerIP, ok := os.LookupEnv("ETRACKER_MAX_IN_FLIGHT_PER_IP"); ok {
+		if maxInFlightPerIP, err = strconv.Atoi(envMaxInFlightPerIP); err != nil || maxInFlightPerIP < 0 {
+			log.Fatalf("Unable to parse ETRACKER_MAX_IN_FLIGHT_PER_IP: %q", envMaxInFlightPerIP)
+		}
+	}
+
+	readTimeout := DefaultReadTimeout
+	if envReadTimeout, ok := os.LookupEnv("ETRACKER_READ_TIMEOUT"); ok {
+		if readTimeout, err = time.ParseDuration(envReadTimeout); err != nil || readTimeout <= 0 {
+			log.Fatalf("Unable to parse ETRACKER_READ_TIMEOUT: %q", envReadTimeout)
+		}
+	}
+	var writeTimeout time.Duration
+	if envWriteTimeout, ok := os.LookupEnv("ETRACKER_WRITE_TIMEOUT"); ok {
+		if writeTimeout, err = time.ParseDuration(envWriteTimeout); err != nil || writeTimeout < 0 {
+			log.Fatalf("Unable to parse ETRACKER_WRITE_TIMEOUT: %q", envWriteTimeout)
+		}
+	}
+	handlerTimeout := DefaultHandlerTimeout
+	if envHandlerTimeout, ok := os.LookupEnv("ETRACKER_HANDLER_TIMEOUT"); ok {
+		if handlerTimeout, err = time.ParseDuration(envHandlerTimeout); err != nil || handlerTimeout <= 0 {
+			log.Fatalf("Unable to parse ETRACKER_HANDLER_TIMEOUT: %q", envHandlerTimeout)
+		}
+	}
+	adminHandlerTimeout := DefaultAdminHandlerTimeout
+	if envAdminHandlerTimeout, ok := os.LookupEnv("ETRACKER_ADMIN_HANDLER_TIMEOUT"); ok {
+		if adminHandlerTimeout, err = time.ParseDuration(envAdminHandlerTimeout); err != nil || adminHandlerTimeout <= 0 {
+			log.Fatalf("Unable to parse ETRACKER_ADMIN_HANDLER_TIMEOUT: %q", envAdminHandlerTimeout)
+		}
+	}
+	var maxUploadSize int64 = DefaultMaxUploadSize
+	if envMaxUploadSize, ok := os.LookupEnv("ETRACKER_MAX_UPLOAD_SIZE"); ok {
+		if maxUploadSize, err = strconv.ParseInt(envMaxUploadSize, 10, 64); err != nil || maxUploadSize <= 0 {
+			log.Fatalf("Unable to parse ETRACKER_MAX_UPLOAD_SIZE: %q", envMaxUploadSize)
+		}
+	}
+
+	requireInvite := false
+	if envRequireInvite, ok := os.LookupEnv("ETRACKER_REQUIRE_INVITE"); ok && envRequireInvite == "true" {
+		requireInvite = true
+	}
+
+	var canaryInterval, canarySlow time.Duration
+	if envCanaryInterval, ok := os.LookupEnv("ETRACKER_CANARY_INTERVAL"); ok {
+		canaryInterval, err = time.ParseDuration(envCanaryInterval)
+		if err != nil {
+			log.Fatalf("Unable to parse ETRACKER_CANARY_INTERVAL: %v", err)
+		}
+	}
+	if envCanarySlow, ok := os.LookupEnv("ETRACKER_CANARY_SLOW"); ok {
+		canarySlow, err = time.ParseDuration(envCanarySlow)
+		if err != nil {
+			log.Fatalf("Unable to parse ETRACKER_CANARY_SLOW: %v", err)
+		}
+	}
+	canaryWebhook := os.Getenv("ETRACKER_CANARY_WEBHOOK")
+
+	var anomalyWindow time.Duration
+	if envAnomalyWindow, ok := os.LookupEnv("ETRACKER_ANOMALY_WINDOW"); ok {
+		anomalyWindow, err = time.ParseDuration(envAnomalyWindow)
+		if err != nil {
+			log.Fatalf("Unable to parse ETRACKER_ANOMALY_WINDOW: %v", err)
+		}
+	}
+	var anomalyFactor float64
+	if envAnomalyFactor, ok := os.LookupEnv("ETRACKER_ANOMALY_FACTOR"); ok {
+		anomalyFactor, err = strconv.ParseFloat(envAnomalyFactor, 64)
+		if err != nil || anomalyFactor <= 1 {
+			log.Fatalf("Unable to parse ETRACKER_ANOMALY_FACTOR: %q", envAnomalyFactor)
+		}
+	}
+	anomalyWebhook := os.Getenv("ETRACKER_ANOMALY_WEBHOOK")
+
+	archiveAfterDays := 0
+	if envArchiveAfter, ok := os.LookupEnv("ETRACKER_ARCHIVE_AFTER_DAYS"); ok {
+		if intArchiveAfter, err := strconv.Atoi(envArchiveAfter); err == nil && intArchiveAfter >= 0 {
+			archiveAfterDays = intArchiveAfter
+		}
+	}
+
+	archiveNoticeDays := DefaultArchiveNoticeDays
+	if envArchiveNotice, ok := os.LookupEnv("ETRACKER_ARCHIVE_NOTICE_DAYS"); ok {
+		if intArchiveNotice, err := strconv.Atoi(envArchiveNotice); err == nil && intArchiveNotice >= 0 {
+			archiveNoticeDays = intArchiveNotice
+		}
+	}
+
+	// The catalog signing key is a base64-encoded Ed25519 seed.
+	var catalogSigningKey ed25519.PrivateKey
+	if envCatalogKey, ok := os.LookupEnv("ETRACKER_CATALOG_SIGNING_KEY"); ok && envCatalogKey != "" {
+		seed, err := base64.StdEncoding.DecodeString(envCatalogKey)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			log.Fatalf("Unable to parse ETRACKER_CATALOG_SIGNING_KEY: expected %d base64-encoded bytes", ed25519.SeedSize)
+		}
+		catalogSigningKey = ed25519.NewKeyFromSeed(seed)
+	}
+
+	var snapshotInterval time.Duration
+	if envSnapshotInterval, ok := os.LookupEnv("ETRACKER_SNAPSHOT_INTERVAL"); ok {
+		snapshotInterval, err = time.ParseDuration(envSnapshotInterval)
+		if err != nil || snapshotInterval <= 0 {
+			log.Fatalf("Unable to parse ETRACKER_SNAPSHOT_INTERVAL: %q", envSnapshotInterval)
+		}
+	}
+	snapshotEndpoint := DefaultSnapshotEndpoint
+	if envSnapshotEndpoint, ok := os.LookupEnv("ETRACKER_SNAPSHOT_S3_ENDPOINT"); ok {
+		snapshotEndpoint = envSnapshotEndpoint
+	}
+
+	language := locale.English
+	if envLanguage, ok := os.LookupEnv("ETRACKER_LANGUAGE"); ok && envLanguage != "" {
+		if !locale.Supported(envLanguage) {
+			log.Fatalf("Unsupported ETRACKER_LANGUAGE %q, expected one of %v", envLanguage, locale.Languages)
+		}
+		language = envLanguage
+	}
+
+	var recent *debuglog.Ring
+	if envDebugRecent, ok := os.LookupEnv("ETRACKER_DEBUG_RECENT"); ok {
+		size, err := strconv.Atoi(envDebugRecent)
+		if err != nil || size < 0 || size > debuglog.MaxSize {
+			log.Fatalf("Unable to parse ETRACKER_DEBUG_RECENT, expected 0 to %d: %q", debuglog.MaxSize, envDebugRecent)
+		}
+		if size > 0 {
+			recent = debuglog.NewRing(size)
+		}
+	}
+
+	backupURLs, err := ParseBackupURLs(os.Getenv("ETRACKER_BACKUP_URLS"))
+	if err != nil {
+		log.Fatalf("Unable to parse ETRACKER_BACKUP_URLS: %v", err)
+	}
+
+	eventsWebhooks, err := ParseWebhooks(os.Getenv("ETRACKER_EVENTS_WEBHOOK"))
+	if err != nil {
+		log.Fatalf("Unable to parse ETRACKER_EVENTS_WEBHOOK: %v", err)
+	}
+	eventsWebhookKinds, err := events.ParseKinds(os.Getenv("ETRACKER_EVENTS_WEBHOOK_KINDS"))
+	if err != nil {
+		log.Fatalf("Unable to parse ETRACKER_EVENTS_WEBHOOK_KINDS: %v", err)
+	}
+
+	// ETRACKER_MAINTENANCE is either "true" or the retry time.
+	var maintenanceRetry time.Duration
+	if envMaintenance, ok := os.LookupEnv("ETRACKER_MAINTENANCE"); ok && envMaintenance != "" && envMaintenance != "false" {
+		maintenanceRetry = DefaultMaintenanceRetry
+		if envMaintenance != "true" {
+			maintenanceRetry, err = time.ParseDuration(envMaintenance)
+			if err != nil || maintenanceRetry <= 0 {
+				log.Fatalf("Unable to parse ETRACKER_MAINTENANCE: %q", envMaintenance)
+			}
+		}
+	}
+
+	readOnly := false
+	if envReadOnly, ok := os.LookupEnv("ETRACKER_READ_ONLY"); ok && envReadOnly == "true" {
+		readOnly = true
+	}
+
+	var features FeatureFlags
+	if envFeatures, ok := os.LookupEnv("ETRACKER_FEATURES"); ok {
+		features, err = ParseFeatures(envFeatures)
+		if err != nil {
+			log.Fatalf("Unable to parse ETRACKER_FEATURES: %v", err)
+		}
+	}
+
+	// GeoIP databases are optional, and only used for aggregate statistics.
+	var geoipReader *geoip.Reader
+	if features.Enabled(FeatureGeoIP) {
+		geoipReader, err = geoip.Open(os.Getenv("ETRACKER_GEOIP_COUNTRY"), os.Getenv("ETRACKER_GEOIP_ASN"))
+		if err != nil {
+			log.Fatalf("Unable to open GeoIP databases: %v", err)
+		}
+	}
+
 	dbpool, err := db.DbConnect(ctx, "")
 	if err != nil {
 		log.Fatalf("Unable to connect to DB: %v", err)
 	}
 
-	err = db.DbInitialize(ctx, dbpool)
-	if err != nil {
-		log.Fatalf("Unable to initialize DB: %v", err)
+	// Postgres may be unavailable when starting read-only, so the schema
+	// is left as it is.
+	if !readOnly {
+		err = db.DbInitialize(ctx, dbpool)
+		if err != nil {
+			log.Fatalf("Unable to initialize DB: %v", err)
+		}
 	}
 
 	config := Config{
-		Algorithm:        algorithm,
 		Authorization:    authorization,
 		Dbpool:           dbpool,
 		Rdb:              rdb,
 		BackendPort:      backendPort,
-		DisableAllowlist: disableAllowlist,
 		FrontendHostname: frontendHostname,
+		PublicURL:        publicURL,
+		BackupURLs:       backupURLs,
+		Features:         features,
+		GeoIP:            geoipReader,
+		PrivacySalt:      privacySalt,
+
+		AnnounceRetentionDays: announceRetentionDays,
+		ActivityRetentionDays: activityRetentionDays,
+		HistoryRetentionDays:  historyRetentionDays,
+
+		Quotas: quotas,
+
+		UnusedKeyDays:    unusedKeyDays,
+		CaptchaVerifyURL: captchaVerifyURL,
+		CaptchaSecret:    captchaSecret,
+		PowDifficulty:    powDifficulty,
+		RequireInvite:    requireInvite,
+		Clock:            SystemClock,
+
+		Tiers:             tiers,
+		TierWebhookSecret: os.Getenv("ETRACKER_TIER_WEBHOOK_SECRET"),
+
+		OIDCIssuer:       oidcIssuer,
+		OIDCClientID:     oidcClientID,
+		OIDCClientSecret: os.Getenv("ETRACKER_OIDC_CLIENT_SECRET"),
+		OIDCScopes:       oidcScopes,
+		OIDCGroupsClaim:  oidcGroupsClaim,
+		OIDCRoles:        oidcRoles,
+
+		GeoPeerShare: geoPeerShare,
+
+		SwarmIntervals:       swarmIntervals,
+		SeederIntervalFactor: seederIntervalFactor,
+
+		MinRatio:   minRatio,
+		RatioGrace: ratioGrace,
+
+		LoadMaxQPS:     loadMaxQPS,
+		LoadMaxLatency: loadMaxLatency,
+
+		ReadTimeout:         readTimeout,
+		WriteTimeout:        writeTimeout,
+		HandlerTimeout:      handlerTimeout,
+		AdminHandlerTimeout: adminHandlerTimeout,
+		MaxUploadSize:       maxUploadSize,
+
+		MaxInFlight:      maxInFlight,
+		MaxInFlightPerIP: maxInFlightPerIP,
+
+		CanaryInterval: canaryInterval,
+		CanarySlow:     canarySlow,
+		CanaryWebhook:  canaryWebhook,
+
+		AnomalyWindow:  anomalyWindow,
+		AnomalyFactor:  anomalyFactor,
+		AnomalyWebhook: anomalyWebhook,
+
+		ArchiveAfterDays:  archiveAfterDays,
+		ArchiveNoticeDays: archiveNoticeDays,
+		ArchiveWebhook:    os.Getenv("ETRACKER_ARCHIVE_WEBHOOK"),
+
+		SnapshotInterval: snapshotInterval,
+		SnapshotDir:      os.Getenv("ETRACKER_SNAPSHOT_DIR"),
+		SnapshotEndpoint: snapshotEndpoint,
+		SnapshotRegion:   os.Getenv("ETRACKER_SNAPSHOT_S3_REGION"),
+		SnapshotBucket:   os.Getenv("ETRACKER_SNAPSHOT_S3_BUCKET"),
+		SnapshotPrefix:   os.Getenv("ETRACKER_SNAPSHOT_S3_PREFIX"),
+
+		CatalogSigningKey: catalogSigningKey,
+
+		MaintenanceRetry: maintenanceRetry,
+		ReadOnly:         readOnly,
+
+		Language: language,
+		Recent:   recent,
+		Dev:      dev,
+
+		SwarmFile: swarmFile,
+		TrackerID: os.Getenv("ETRACKER_TRACKER_ID"),
+
+		ScrapeCacheTTL:   scrapeCacheTTL,
+		LegacyInfohashes: legacyInfohashes,
+
+		TrustedProxies:  trustedProxies,
+		ClientIPHeader:  clientIPHeader,
+		HonorIPParam:    honorIPParam,
+		FailureCacheTTL: failureCacheTTL,
+
+		Events:              events.NewLocal(events.DefaultBuffer),
+		EventsWebhooks:      eventsWebhooks,
+		EventsWebhookKinds:  eventsWebhookKinds,
+		EventsWebhookSecret: os.Getenv("ETRACKER_EVENTS_WEBHOOK_SECRET"),
+
+		live: newLiveSettings(Settings{
+			Algorithm:        algorithm,
+			DisableAllowlist: disableAllowlist,
+			PrivateScrape:    privateScrape,
+		}),
 	}
 
 	return config
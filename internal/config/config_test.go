@@ -0,0 +1,306 @@
+package config
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseQuotas(t *testing.T) {
+	data := []struct {
+		name     string
+		quotas   string
+		expected map[string]Quota
+		err      bool
+	}{
+		{"empty", "", map[string]Quota{}, false},
+		{"single", "GET /api/generate=10/24h", map[string]Quota{"GET /api/generate": {10, 24 * time.Hour}}, false},
+		{
+			"multiple",
+			"GET /api/generate=10/24h, GET /api/stats=100/1m",
+			map[string]Quota{
+				"GET /api/generate": {10, 24 * time.Hour},
+				"GET /api/stats":    {100, time.Minute},
+			},
+			false,
+		},
+		{"missing equals", "GET /api/generate", nil, true},
+		{"missing window", "GET /api/generate=10", nil, true},
+		{"bad limit", "GET /api/generate=ten/24h", nil, true},
+		{"bad window", "GET /api/generate=10/day", nil, true},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			received, err := ParseQuotas(d.quotas)
+			if (err != nil) != d.err {
+				t.Fatalf("expected error %v, got %v", d.err, err)
+			}
+			if diff := cmp.Diff(d.expected, received); diff != "" {
+				t.Errorf("unexpected quotas (-expected +received):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseTiers(t *testing.T) {
+	data := []struct {
+		name     string
+		tiers    string
+		expected map[string]Tier
+		err      bool
+	}{
+		{"empty", "", map[string]Tier{}, false},
+		{
+			"multiple",
+			"donor=1.5/0.5, staff=2/0",
+			map[string]Tier{
+				"donor": {1.5, 0.5},
+				"staff": {2, 0},
+			},
+			false,
+		},
+		{"missing name", "=1.5/0.5", nil, true},
+		{"missing download multiplier", "donor=1.5", nil, true},
+		{"bad peer multiplier", "donor=100/0.5", nil, true},
+		{"bad download multiplier", "donor=1.5/2", nil, true},
+		{"nan", "donor=NaN/0.5", nil, true},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			received, err := ParseTiers(d.tiers)
+			if (err != nil) != d.err {
+				t.Fatalf("expected error %v, got %v", d.err, err)
+			}
+			if diff := cmp.Diff(d.expected, received); diff != "" {
+				t.Errorf("unexpected tiers (-expected +received):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseOIDCRoles(t *testing.T) {
+	data := []struct {
+		name     string
+		roles    string
+		expected map[string]string
+		err      bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{
+			"multiple",
+			"tracker-admins=staff, vip=vip, donors=vip",
+			map[string]string{
+				"tracker-admins": "staff",
+				"vip":            "vip",
+				"donors":         "vip",
+			},
+			false,
+		},
+		{"missing group", "vip=", nil, true},
+		{"missing identity provider group", "=vip", nil, true},
+		{"missing =", "vip", nil, true},
+		{"duplicate", "vip=vip,vip=staff", nil, true},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			received, err := ParseOIDCRoles(d.roles)
+			if (err != nil) != d.err {
+				t.Fatalf("expected error %v, got %v", d.err, err)
+			}
+			if diff := cmp.Diff(d.expected, received); diff != "" {
+				t.Errorf("unexpected roles (-expected +received):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseWebhooks(t *testing.T) {
+	data := []struct {
+		name     string
+		webhooks string
+		expected []string
+		err      bool
+	}{
+		{"empty", "", nil, false},
+		{"multiple", "https://a.example.com/hook, http://b.example.com", []string{"https://a.example.com/hook", "http://b.example.com"}, false},
+		{"bad scheme", "ftp://example.com", nil, true},
+		{"no host", "https://", nil, true},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			received, err := ParseWebhooks(d.webhooks)
+			if (err != nil) != d.err {
+				t.Fatalf("expected error %v, got %v", d.err, err)
+			}
+			if diff := cmp.Diff(d.expected, received); diff != "" {
+				t.Errorf("unexpected webhooks (-expected +received):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseBackupURLs(t *testing.T) {
+	received, err := ParseBackupURLs("udp://tracker.example.com:6969/, https://backup.example.com")
+	expected := []string{"udp://tracker.example.com:6969", "https://backup.example.com"}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(expected, received); diff != "" {
+		t.Errorf("unexpected backup URLs (-expected +received):\n%s", diff)
+	}
+	if _, err := ParseBackupURLs("wss://tracker.example.com"); err == nil {
+		t.Errorf("expected error for unsupported scheme")
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	data := []struct {
+		name     string
+		proxies  string
+		expected []netip.Prefix
+		err      bool
+	}{
+		{"empty", "", nil, false},
+		{"network", "173.245.48.0/20", []netip.Prefix{netip.MustParsePrefix("173.245.48.0/20")}, false},
+		{"masked", "10.1.2.3/8", []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, false},
+		{
+			"addresses",
+			"192.0.2.1, 2001:db8::1",
+			[]netip.Prefix{netip.MustParsePrefix("192.0.2.1/32"), netip.MustParsePrefix("2001:db8::1/128")},
+			false,
+		},
+		{"invalid", "cloudflare", nil, true},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			received, err := ParseTrustedProxies(d.proxies)
+			if (err != nil) != d.err {
+				t.Fatalf("expected error %v, got %v", d.err, err)
+			}
+			if diff := cmp.Diff(d.expected, received, cmp.Comparer(func(a, b netip.Prefix) bool { return a == b })); diff != "" {
+				t.Errorf("unexpected proxies (-expected +received):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSettings(t *testing.T) {
+	if (Config{}).Settings().Algorithm != nil {
+		t.Errorf("expected zero settings for a zero Config")
+	}
+
+	conf := New(WithPrivateScrape(true))
+	copied := conf
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			conf.UpdateSettings(func(s *Settings) { s.DisableAllowlist = i%2 == 0 })
+		}()
+		go func() {
+			defer wg.Done()
+			_ = copied.Settings()
+		}()
+	}
+	wg.Wait()
+
+	conf.UpdateSettings(func(s *Settings) { s.DisableAllowlist = true })
+
+	settings := copied.Settings()
+	if !settings.DisableAllowlist {
+		t.Errorf("expected update to be visible in every copy")
+	}
+	if !settings.PrivateScrape {
+		t.Errorf("expected option to be kept across updates")
+	}
+}
+
+func TestWithServerDefaults(t *testing.T) {
+	received := Config{HandlerTimeout: 2 * time.Second, WriteTimeout: time.Minute}.WithServerDefaults()
+	if received.ReadTimeout != DefaultReadTimeout || received.AdminHandlerTimeout != DefaultAdminHandlerTimeout || received.MaxUploadSize != DefaultMaxUploadSize {
+		t.Errorf("expected defaults for unset limits, got %+v", received)
+	}
+	if received.HandlerTimeout != 2*time.Second || received.WriteTimeout != time.Minute {
+		t.Errorf("expected set limits to be kept, got %+v", received)
+	}
+}
+
+func TestParseFeatures(t *testing.T) {
+	data := []struct {
+		name     string
+		features string
+		expected FeatureFlags
+		err      bool
+	}{
+		{"empty", "", FeatureFlags{}, false},
+		{"list", "anomaly, -geoip", FeatureFlags{FeatureAnomaly: true, FeatureGeoIP: false}, false},
+		{"json", `{"webtorrent": false, "http3": true}`, FeatureFlags{FeatureWebTorrent: false, FeatureHTTP3: true}, false},
+		{"unknown in list", "udp", nil, true},
+		{"unknown in json", `{"udp": true}`, nil, true},
+		{"bad json", `{"webtorrent": "no"}`, nil, true},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			received, err := ParseFeatures(d.features)
+			if (err != nil) != d.err {
+				t.Fatalf("expected error %v, got %v", d.err, err)
+			}
+			if diff := cmp.Diff(d.expected, received); diff != "" {
+				t.Errorf("unexpected features (-expected +received):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	var unset FeatureFlags
+	if !unset.Enabled(FeatureWebTorrent) || unset.Enabled(Feature("unknown")) {
+		t.Errorf("expected known features enabled and unknown features disabled by default")
+	}
+
+	flags := FeatureFlags{FeatureGeoIP: false}
+	all := flags.All()
+	if all[FeatureGeoIP] || !all[FeatureAnomaly] || len(all) != len(defaultFeatures) {
+		t.Errorf("expected every known feature with geoip disabled, got %v", all)
+	}
+}
+
+func TestParseSwarmIntervals(t *testing.T) {
+	data := []struct {
+		name      string
+		intervals string
+		expected  []SwarmInterval
+		err       bool
+	}{
+		{"empty", "", nil, false},
+		{"sorted", "1000=60m, 0=15m", []SwarmInterval{{0, 15 * time.Minute}, {1000, 60 * time.Minute}}, false},
+		{"missing equals", "100", nil, true},
+		{"bad size", "-1=15m", nil, true},
+		{"bad interval", "100=soon", nil, true},
+		{"too short", "0=10s", nil, true},
+		{"too long", "1000=2h", nil, true},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			received, err := ParseSwarmIntervals(d.intervals)
+			if (err != nil) != d.err {
+				t.Fatalf("expected error %v, got %v", d.err, err)
+			}
+			if diff := cmp.Diff(d.expected, received); diff != "" {
+				t.Errorf("unexpected intervals (-expected +received):\n%s", diff)
+			}
+		})
+	}
+}
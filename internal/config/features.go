@@ -0,0 +1,91 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Feature names a subsystem which can be enabled or disabled per deployment,
+// independently of its own configuration, so that new subsystems can ship
+// disabled and existing ones can be switched off without reconfiguring them.
+type Feature string
+
+const (
+	// FeatureHTTP3 is the UDP listener serving HTTP/3 over QUIC, when
+	// TLSConfig.HTTP3 is also set.
+	FeatureHTTP3 Feature = "http3"
+	// FeatureWebTorrent is the WebSocket tracker for browser peers.
+	FeatureWebTorrent Feature = "webtorrent"
+	// FeatureAnomaly is the detection of anomalous traffic, when
+	// AnomalyWindow is also set.
+	FeatureAnomaly Feature = "anomaly"
+	// FeatureGeoIP is the lookup of the location of peers, when GeoIP
+	// databases are also configured.
+	FeatureGeoIP Feature = "geoip"
+	// FeatureGeoSelection prefers peers in the same network or country as
+	// the announcing peer, see GeoPeerShare. It needs FeatureGeoIP.
+	FeatureGeoSelection Feature = "geoselection"
+)
+
+// defaultFeatures are whether each known feature is enabled when it is not
+// set. A new subsystem is added here as false until it is ready.
+var defaultFeatures = FeatureFlags{
+	FeatureHTTP3:      true,
+	FeatureWebTorrent: true,
+	FeatureAnomaly:    true,
+	FeatureGeoIP:      true,
+
+	FeatureGeoSelection: false,
+}
+
+// FeatureFlags are whether features are enabled, by name. A nil
+// FeatureFlags has every feature at its default.
+type FeatureFlags map[Feature]bool
+
+// Enabled reports whether a feature is enabled. Unknown features are not.
+func (f FeatureFlags) Enabled(feature Feature) bool {
+	if enabled, ok := f[feature]; ok {
+		return enabled
+	}
+	return defaultFeatures[feature]
+}
+
+// All returns whether every known feature is enabled.
+func (f FeatureFlags) All() FeatureFlags {
+	all := make(FeatureFlags, len(defaultFeatures))
+	for feature := range defaultFeatures {
+		all[feature] = f.Enabled(feature)
+	}
+	return all
+}
+
+// ParseFeatures parses feature flags either as a JSON object of booleans,
+// for example `{"webtorrent": false}`, or as a comma-separated list of
+// features to enable, each prefixed with "-" to disable it instead, for
+// example "webtorrent,-geoip". Unknown features are an error, so that a
+// misspelled flag is not silently ignored.
+func ParseFeatures(s string) (FeatureFlags, error) {
+	flags := make(FeatureFlags)
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		if err := json.Unmarshal([]byte(s), &flags); err != nil {
+			return nil, fmt.Errorf("invalid features: %w", err)
+		}
+	} else {
+		for _, entry := range strings.Split(s, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			name, disabled := strings.CutPrefix(entry, "-")
+			flags[Feature(strings.TrimSpace(name))] = !disabled
+		}
+	}
+
+	for feature := range flags {
+		if _, ok := defaultFeatures[feature]; !ok {
+			return nil, fmt.Errorf("unknown feature %q", feature)
+		}
+	}
+	return flags, nil
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// Settings are the parts of the configuration which may change while the
+// tracker is running, such as the peering algorithm. Config is copied by
+// value into every handler and job, so Settings are kept behind a pointer
+// shared by all copies, and are read with Config.Settings and changed with
+// Config.UpdateSettings.
+type Settings struct {
+	Algorithm        PeeringAlgorithm
+	DisableAllowlist bool
+	// PrivateScrape restricts scrapes to infohashes the announce key has
+	// announced.
+	PrivateScrape bool
+}
+
+// liveSettings is the mutable section of a Config.
+type liveSettings struct {
+	mu       sync.RWMutex
+	settings Settings
+}
+
+func newLiveSettings(s Settings) *liveSettings {
+	return &liveSettings{settings: s}
+}
+
+// Settings returns a snapshot of the current settings. A Config which was not
+// built with New or BuildConfig has zero settings.
+func (conf Config) Settings() Settings {
+	if conf.live == nil {
+		return Settings{}
+	}
+	conf.live.mu.RLock()
+	defer conf.live.mu.RUnlock()
+	return conf.live.settings
+}
+
+// UpdateSettings changes the settings in place for every copy of the Config.
+// Requests already in progress keep the snapshot they started with. It
+// panics on a Config which was not built with New or BuildConfig.
+func (conf Config) UpdateSettings(update func(s *Settings)) {
+	conf.live.mu.Lock()
+	defer conf.live.mu.Unlock()
+	update(&conf.live.settings)
+}
+
+// Option configures a Config built with New.
+type Option func(*Config)
+
+// New returns a Config with its own mutable Settings, configured by opts.
+// Options cover the Settings and the fields an embedding program sets.
+// The remaining fields are read from the environment by BuildConfig, and
+// are zero in a Config built with New.
+func New(opts ...Option) Config {
+	conf := Config{live: newLiveSettings(Settings{})}
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	return conf
+}
+
+// WithAlgorithm sets the initial peering algorithm.
+func WithAlgorithm(algorithm PeeringAlgorithm) Option {
+	return func(conf *Config) {
+		conf.live.settings.Algorithm = algorithm
+	}
+}
+
+// WithDisableAllowlist sets whether every infohash announced is tracked.
+func WithDisableAllowlist(disable bool) Option {
+	return func(conf *Config) {
+		conf.live.settings.DisableAllowlist = disable
+	}
+}
+
+// WithPrivateScrape sets whether scrapes are restricted to infohashes the
+// announce key has announced.
+func WithPrivateScrape(private bool) Option {
+	return func(conf *Config) {
+		conf.live.settings.PrivateScrape = private
+	}
+}
+
+// WithAuthorization sets the API key. An empty key forbids the API.
+func WithAuthorization(authorization string) Option {
+	return func(conf *Config) {
+		conf.Authorization = authorization
+	}
+}
+
+// WithStorage sets the Postgres pool and Redis client.
+func WithStorage(dbpool *pgxpool.Pool, rdb *redis.Client) Option {
+	return func(conf *Config) {
+		conf.Dbpool = dbpool
+		conf.Rdb = rdb
+	}
+}
+
+// WithBackendPort sets the port the backend listens on.
+func WithBackendPort(port int) Option {
+	return func(conf *Config) {
+		conf.BackendPort = port
+	}
+}
+
+// WithFrontendHostname sets the hostname used for CORS headers on the
+// frontend API.
+func WithFrontendHostname(hostname string) Option {
+	return func(conf *Config) {
+		conf.FrontendHostname = hostname
+	}
+}
+
+// WithPublicURL sets the base of announce URLs given to users.
+func WithPublicURL(url string) Option {
+	return func(conf *Config) {
+		conf.PublicURL = url
+	}
+}
+
+// WithPrivacySalt enables privacy mode, in which only salted hashes of peer
+// IPs are stored.
+func WithPrivacySalt(salt string) Option {
+	return func(conf *Config) {
+		conf.PrivacySalt = salt
+	}
+}
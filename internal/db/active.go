@@ -0,0 +1,67 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Active returns the condition on announces which defines an active peer:
+// an announce made since a cutoff which is not a stopped event, and has not
+// been expired by prune.SweepStale. The event and the cutoff are bound to
+// the numbered parameters stopped and cutoff, so that the condition can be
+// combined with the parameters of any query. The cutoff is normally
+// config.Config.StaleCutoff, so the window follows config.StaleInterval.
+// The cutoff still applies between sweeps.
+func Active(stopped, cutoff int) string {
+	return fmt.Sprintf("NOT announces.expired AND announces.last_announce >= $%d AND announces.event <> $%d", cutoff, stopped)
+}
+
+// PartialSeed returns the condition on recent_announces which defines a
+// BEP 21 partial seed: a peer with data left whose latest announce was a
+// paused event, which is bound to the numbered parameter paused. Partial
+// seeds are not downloading, so they are counted apart from leechers.
+// recent_announces must include the amount_left and event columns.
+func PartialSeed(paused int) string {
+	return fmt.Sprintf("(recent_announces.amount_left > 0 AND recent_announces.event = $%d)", paused)
+}
+
+// RecentAnnounces returns a common table expression named recent_announces,
+// for use in a WITH clause. It holds the latest active announce of each
+// announce key in each swarm, with the peers_id and info_hash_id columns and
+// any other columns of announces given.
+//
+// Every count of seeders and leechers is built on this expression, so that
+// scrapes, stats, and the catalog can never disagree about who is active.
+func RecentAnnounces(stopped, cutoff int, columns ...string) string {
+	return recentAnnounces(Active(stopped, cutoff), columns)
+}
+
+// RecentAnnouncesOf is RecentAnnounces restricted to the announce key bound
+// to the numbered parameter key, for per-client queries on the announce path
+// which must not scan every swarm.
+func RecentAnnouncesOf(stopped, cutoff, key int, columns ...string) string {
+	return recentAnnounces(fmt.Sprintf("%s AND announces.peers_id = (SELECT id FROM peers WHERE announce_key = $%d)", Active(stopped, cutoff), key), columns)
+}
+
+// RecentAnnouncesOfUser is RecentAnnounces restricted to the announce keys
+// owned by the user bound to the numbered parameter user.
+func RecentAnnouncesOfUser(stopped, cutoff, user int, columns ...string) string {
+	return recentAnnounces(fmt.Sprintf("%s AND announces.peers_id IN (SELECT id FROM peers WHERE users_id = $%d)", Active(stopped, cutoff), user), columns)
+}
+
+func recentAnnounces(where string, columns []string) string {
+	return fmt.Sprintf(`recent_announces AS (
+		    SELECT DISTINCT ON (peers_id, info_hash_id)
+			%s
+		    FROM
+			announces
+		    WHERE
+			%s
+		    ORDER BY
+			peers_id,
+			info_hash_id,
+			last_announce DESC
+		)`,
+		strings.Join(append([]string{"peers_id", "info_hash_id"}, columns...), ",\n\t\t\t"),
+		where)
+}
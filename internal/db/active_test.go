@@ -0,0 +1,50 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecentAnnounces(t *testing.T) {
+	data := []struct {
+		name     string
+		cte      string
+		expected []string
+	}{
+		{
+			"all keys",
+			RecentAnnounces(1, 2, "amount_left"),
+			[]string{"announces.last_announce >= $2", "announces.event <> $1", "peers_id,\n\t\t\tinfo_hash_id,\n\t\t\tamount_left"},
+		},
+		{
+			"one key",
+			RecentAnnouncesOf(3, 5, 4, "uploaded", "downloaded"),
+			[]string{"announces.last_announce >= $5", "announces.event <> $3", "announce_key = $4", "info_hash_id,\n\t\t\tuploaded,\n\t\t\tdownloaded"},
+		},
+		{
+			"one user",
+			RecentAnnouncesOfUser(1, 2, 3, "amount_left"),
+			[]string{"announces.last_announce >= $2", "announces.event <> $1", "users_id = $3", "info_hash_id,\n\t\t\tamount_left"},
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			if !strings.HasPrefix(d.cte, "recent_announces AS (") {
+				t.Errorf("expected recent_announces expression, got %s", d.cte)
+			}
+			for _, e := range d.expected {
+				if !strings.Contains(d.cte, e) {
+					t.Errorf("expected %q in %s", e, d.cte)
+				}
+			}
+		})
+	}
+}
+
+func TestPartialSeed(t *testing.T) {
+	expected := "(recent_announces.amount_left > 0 AND recent_announces.event = $3)"
+	if got := PartialSeed(3); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
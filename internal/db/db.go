@@ -2,8 +2,11 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -23,20 +26,88 @@ func DbConnect(ctx context.Context, address string) (*pgxpool.Pool, error) {
 	return dbpool, nil
 }
 
+// ErrLegacySchema is returned by DbInitialize when the database still uses
+// the legacy layout, in which peer ids were kept in a peerids table and the
+// peers table held announces. Rather than creating the current tables
+// alongside it and silently starting with an empty tracker, startup is
+// refused until the legacy tables are converted with
+// scripts/migrate_legacy_schema.sql, which checks that they have the
+// expected columns before changing anything, or are dropped by hand. The
+// conversion is not run automatically, since it moves the legacy tables
+// aside and an operator should back up the database first.
+var ErrLegacySchema = errors.New("database uses the legacy peerids/peers schema, convert it with scripts/migrate_legacy_schema.sql")
+
+// detectLegacySchema reports whether the legacy peerids table exists.
+func detectLegacySchema(ctx context.Context, dbpool *pgxpool.Pool) (bool, error) {
+	var legacy bool
+	err := dbpool.QueryRow(ctx, `SELECT to_regclass('peerids') IS NOT NULL`).Scan(&legacy)
+	if err != nil {
+		return false, fmt.Errorf("unable to check for legacy schema: %w", err)
+	}
+
+	return legacy, nil
+}
+
+// widenColumns changes the type of those columns of table which are still
+// integer to bigint. Since the change rewrites the table, columns which have
+// already been widened are left alone, so that it only happens once.
+func widenColumns(ctx context.Context, dbpool *pgxpool.Pool, table string, columns ...string) error {
+	rows, err := dbpool.Query(ctx, `
+		SELECT
+		    column_name
+		FROM
+		    information_schema.columns
+		WHERE
+		    table_schema = current_schema()
+		    AND table_name = $1
+		    AND column_name = ANY ($2)
+		    AND data_type = 'integer'
+		`,
+		table, columns)
+	if err != nil {
+		return fmt.Errorf("unable to check column types of %s: %w", table, err)
+	}
+	narrow, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("unable to check column types of %s: %w", table, err)
+	}
+	if len(narrow) == 0 {
+		return nil
+	}
+
+	var alters []string
+	for _, column := range narrow {
+		alters = append(alters, "ALTER COLUMN "+pgx.Identifier{column}.Sanitize()+" TYPE BIGINT")
+	}
+	_, err = dbpool.Exec(ctx, "ALTER TABLE "+pgx.Identifier{table}.Sanitize()+" "+strings.Join(alters, ", "))
+	if err != nil {
+		return fmt.Errorf("unable to widen columns of %s: %w", table, err)
+	}
+	return nil
+}
+
 // DbInitialize ensures that all required tables are set up.
 func DbInitialize(ctx context.Context, dbpool *pgxpool.Pool) error {
+	legacy, err := detectLegacySchema(ctx, dbpool)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		return ErrLegacySchema
+	}
+
 	// infohashes table. Includes info_hash, downloaded key (for use in /scrape),
 	// and an optional name, which should match the "name" section in the info
 	// section of the torrent file (for use in /scrape and searching), and
 	// an optional license (for verification, moderation, and search).
-	_, err := dbpool.Exec(ctx, `
+	_, err = dbpool.Exec(ctx, `
 		CREATE TABLE IF NOT EXISTS infohashes (
 		    id serial PRIMARY KEY,
 		    info_hash bytea NOT NULL UNIQUE,
 		    downloaded integer DEFAULT 0 NOT NULL,
 		    name text NOT NULL,
 		    file bytea,
-		    length integer
+		    length bigint
 		);
 
 		CREATE INDEX IF NOT EXISTS idx_info_hash ON infohashes (info_hash);
@@ -45,6 +116,67 @@ func DbInitialize(ctx context.Context, dbpool *pgxpool.Pool) error {
 		return fmt.Errorf("unable to create infohashes table: %w", err)
 	}
 
+	// Torrents may be larger than 2 GiB, so infohashes tables created with
+	// an integer length are migrated.
+	if err = widenColumns(ctx, dbpool, "infohashes", "length"); err != nil {
+		return err
+	}
+
+	// Archival columns, see the archive package. Existing infohashes are
+	// treated as added when they are migrated.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE infohashes
+		    ADD COLUMN IF NOT EXISTS created_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    ADD COLUMN IF NOT EXISTS archive_warned TIMESTAMPTZ,
+		    ADD COLUMN IF NOT EXISTS archived_time TIMESTAMPTZ;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add infohashes archival columns: %w", err)
+	}
+
+	// A deprecated infohash merged into a canonical one points to it, see
+	// api.MergeInfohashHandler.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE infohashes
+		    ADD COLUMN IF NOT EXISTS merged_into INTEGER REFERENCES infohashes (id) ON DELETE SET NULL;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add merged_into to infohashes table: %w", err)
+	}
+
+	// A retired infohash refuses announces but keeps its history, see
+	// api.RetireInfohashHandler.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE infohashes
+		    ADD COLUMN IF NOT EXISTS retired_time TIMESTAMPTZ;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add retired_time to infohashes table: %w", err)
+	}
+
+	// Whether the swarm of an infohash had a seeder when last checked, see
+	// the swarms package.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE infohashes
+		    ADD COLUMN IF NOT EXISTS seeded BOOLEAN NOT NULL DEFAULT FALSE;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add seeded to infohashes table: %w", err)
+	}
+
+	// Infohashes may be filed under a category and any number of tags, for
+	// browsing. Both are normalized to lower case by the API.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE infohashes
+		    ADD COLUMN IF NOT EXISTS category TEXT NOT NULL DEFAULT '',
+		    ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+
+		CREATE INDEX IF NOT EXISTS idx_infohashes_tags ON infohashes USING GIN (tags);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add category and tags to infohashes table: %w", err)
+	}
+
 	// peers table. Includes stored score for each peer used to calculate
 	// peer quality, and will in the future be extended to include
 	// statistics to detect cheaters. At the moment, the peer_max_upload
@@ -54,8 +186,8 @@ func DbInitialize(ctx context.Context, dbpool *pgxpool.Pool) error {
 		    id SERIAL PRIMARY KEY,
 		    announce_key TEXT NOT NULL UNIQUE,
 		    snatched INTEGER DEFAULT 0 NOT NULL,
-		    downloaded INTEGER DEFAULT 0 NOT NULL,
-		    uploaded INTEGER DEFAULT 0 NOT NULL,
+		    downloaded BIGINT DEFAULT 0 NOT NULL,
+		    uploaded BIGINT DEFAULT 0 NOT NULL,
 		    created_time TIMESTAMPTZ NOT NULL DEFAULT NOW()
 		);
 
@@ -67,42 +199,547 @@ func DbInitialize(ctx context.Context, dbpool *pgxpool.Pool) error {
 
 	// announces table, which includes information from announces.
 	// "left" is a reserved word so we use amount_left.
-	// For information on the triggers to keep track of announce times, see
-	// https://x-team.com/blog/automatic-timestamps-with-postgresql
+	// The tracker sets last_announce itself from the application clock on
+	// every announce, so other updates, such as expiring a stale announce,
+	// merging swarms, or recording agent reports, leave it alone. Tables
+	// created with the trigger which used to set it from the database clock
+	// on every update are migrated by dropping it.
 	_, err = dbpool.Exec(ctx, `
 		CREATE TABLE IF NOT EXISTS announces (
 		    id SERIAL PRIMARY KEY,
 		    peers_id INTEGER,
 		    info_hash_id INTEGER,
 		    ip_port BYTEA NOT NULL,
-		    amount_left INTEGER NOT NULL,
-		    downloaded INTEGER NOT NULL,
-		    uploaded INTEGER NOT NULL,
+		    amount_left BIGINT NOT NULL,
+		    downloaded BIGINT NOT NULL,
+		    uploaded BIGINT NOT NULL,
 		    event INTEGER,
 		    last_announce TIMESTAMPTZ NOT NULL DEFAULT NOW(),
 		    CONSTRAINT fk_peers FOREIGN KEY(peers_id) REFERENCES peers(id) ON DELETE CASCADE,
-		    CONSTRAINT fk_infohashes FOREIGN KEY(info_hash_id) REFERENCES infohashes(id) ON DELETE CASCADE,
-		    UNIQUE (peers_id, info_hash_id)
+		    CONSTRAINT fk_infohashes FOREIGN KEY(info_hash_id) REFERENCES infohashes(id) ON DELETE CASCADE
 		);
 
-		CREATE OR REPLACE FUNCTION trigger_set_timestamp ()
-		    RETURNS TRIGGER
-		    AS $$
-		BEGIN
-		    NEW.last_announce = NOW();
-		    RETURN NEW;
-		END;
-		$$
-		LANGUAGE plpgsql;
-
-		CREATE OR REPLACE TRIGGER set_timestamp
-		    BEFORE UPDATE ON announces
-		    FOR EACH ROW
-		    EXECUTE PROCEDURE trigger_set_timestamp ();
+		DROP TRIGGER IF EXISTS set_timestamp ON announces;
+		DROP FUNCTION IF EXISTS trigger_set_timestamp ();
 		`)
 	if err != nil {
 		return fmt.Errorf("unable to create announces table: %w", err)
 	}
 
+	// Clients report byte counts, which exceed an integer for torrents
+	// larger than 2 GiB, so announces tables created with integer counts
+	// are migrated.
+	if err = widenColumns(ctx, dbpool, "announces", "amount_left", "downloaded", "uploaded"); err != nil {
+		return err
+	}
+
+	// Location columns for aggregate statistics, filled in only when a
+	// GeoIP database is configured. Added separately so that existing
+	// announces tables are migrated.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE announces
+		    ADD COLUMN IF NOT EXISTS country TEXT,
+		    ADD COLUMN IF NOT EXISTS asn INTEGER,
+		    ADD COLUMN IF NOT EXISTS asn_org TEXT;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add location columns to announces table: %w", err)
+	}
+
+	// A peer is identified by its announce key and peer_id, so that
+	// several clients announcing with one key, such as a household behind
+	// a NAT, are each stored. Existing announces tables are migrated from
+	// one row per announce key and infohash.
+	//
+	// A dual-stack client announces with the same peer_id over IPv4 and
+	// IPv6, and is stored once per address family so that peers of either
+	// family are given its address. The family is kept in its own column
+	// because ip_port is hashed in privacy mode. Existing tables are
+	// migrated from the index without it.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE announces
+		    ADD COLUMN IF NOT EXISTS peer_id BYTEA NOT NULL DEFAULT '',
+		    ADD COLUMN IF NOT EXISTS ipv6 BOOLEAN NOT NULL DEFAULT FALSE,
+		    DROP CONSTRAINT IF EXISTS announces_peers_id_info_hash_id_key;
+		DROP INDEX IF EXISTS idx_announces_peer;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_announces_peer_family ON announces (peers_id, info_hash_id, peer_id, ipv6);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add peer_id to announces table: %w", err)
+	}
+
+	// The announce parameters which have no column of their own, as sent
+	// in the latest announce, are kept for analysis.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE announces
+		    ADD COLUMN IF NOT EXISTS params JSONB;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add params to announces table: %w", err)
+	}
+
+	// Browser peers announcing over WebSocket are marked, since they can
+	// only be given to other browser peers.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE announces
+		    ADD COLUMN IF NOT EXISTS webrtc BOOLEAN NOT NULL DEFAULT FALSE;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add webrtc to announces table: %w", err)
+	}
+
+	// Peer health reported by seedbox agents, see api.AgentReportHandler.
+	// Unlike the rest of the row, it is not overwritten by announces.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE announces
+		    ADD COLUMN IF NOT EXISTS connectable BOOLEAN,
+		    ADD COLUMN IF NOT EXISTS agent_client TEXT,
+		    ADD COLUMN IF NOT EXISTS upload_rate BIGINT,
+		    ADD COLUMN IF NOT EXISTS download_rate BIGINT,
+		    ADD COLUMN IF NOT EXISTS health_time TIMESTAMPTZ;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add peer health to announces table: %w", err)
+	}
+
+	// peer_id is also indexed on its own, for looking up a client across
+	// announce keys and infohashes.
+	_, err = dbpool.Exec(ctx, `
+		CREATE INDEX IF NOT EXISTS idx_announces_peer_id ON announces (peer_id);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create peer_id index: %w", err)
+	}
+
+	// key_activity table, which aggregates announces per announce key, day,
+	// IP, and client. It is used to spot shared or leaked announce keys.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS key_activity (
+		    peers_id INTEGER NOT NULL,
+		    day DATE NOT NULL DEFAULT CURRENT_DATE,
+		    ip BYTEA NOT NULL,
+		    client TEXT NOT NULL,
+		    announces INTEGER DEFAULT 1 NOT NULL,
+		    last_announce TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    CONSTRAINT fk_peers FOREIGN KEY(peers_id) REFERENCES peers(id) ON DELETE CASCADE,
+		    PRIMARY KEY (peers_id, day, ip, client)
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create key_activity table: %w", err)
+	}
+
+	// wanted_infohashes table, which counts announces for infohashes
+	// rejected by the allowlist, so that operators can see which missing
+	// content is most requested.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS wanted_infohashes (
+		    info_hash BYTEA PRIMARY KEY,
+		    requests INTEGER DEFAULT 1 NOT NULL,
+		    first_seen TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    last_seen TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create wanted_infohashes table: %w", err)
+	}
+
+	// indexer_keys table, which holds hashes of the keys given to external
+	// indexers for downloading the catalog.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS indexer_keys (
+		    id SERIAL PRIMARY KEY,
+		    name TEXT NOT NULL UNIQUE,
+		    key_hash BYTEA NOT NULL UNIQUE,
+		    created_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    last_used TIMESTAMPTZ
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create indexer_keys table: %w", err)
+	}
+
+	// Announce keys which opt in to a public profile get a random
+	// pseudonymous profile_id, see api.ProfileHandler.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE peers
+		    ADD COLUMN IF NOT EXISTS profile_id TEXT UNIQUE;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add profile_id to peers table: %w", err)
+	}
+
+	// bans table, see handler.NormalizeBan for the kinds and values.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS bans (
+		    id SERIAL PRIMARY KEY,
+		    kind TEXT NOT NULL,
+		    value TEXT NOT NULL,
+		    reason TEXT NOT NULL DEFAULT '',
+		    created_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    UNIQUE (kind, value)
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create bans table: %w", err)
+	}
+
+	// agent_keys table, which holds hashes of the keys given to trusted
+	// seedbox agents for reporting peer health.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS agent_keys (
+		    id SERIAL PRIMARY KEY,
+		    name TEXT NOT NULL UNIQUE,
+		    key_hash BYTEA NOT NULL UNIQUE,
+		    created_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    last_used TIMESTAMPTZ
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create agent_keys table: %w", err)
+	}
+
+	// Inputs to the achievement rules, see package achievements. Lifetime
+	// totals of peers tables created with integer totals are widened so
+	// that they can reach terabytes, seeding_since is when a peer began its
+	// current unbroken run of seeding, and first_snatcher is the first
+	// announce key to complete an infohash.
+	if err = widenColumns(ctx, dbpool, "peers", "uploaded", "downloaded"); err != nil {
+		return err
+	}
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE announces
+		    ADD COLUMN IF NOT EXISTS seeding_since TIMESTAMPTZ;
+		ALTER TABLE infohashes
+		    ADD COLUMN IF NOT EXISTS first_snatcher INTEGER REFERENCES peers (id) ON DELETE SET NULL;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add achievement columns: %w", err)
+	}
+
+	// achievements table, which holds the achievements earned by each
+	// announce key.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS achievements (
+		    peers_id INTEGER NOT NULL,
+		    achievement TEXT NOT NULL,
+		    earned_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    CONSTRAINT fk_peers FOREIGN KEY(peers_id) REFERENCES peers(id) ON DELETE CASCADE,
+		    PRIMARY KEY (peers_id, achievement)
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create achievements table: %w", err)
+	}
+
+	// promotions table, which holds freeleech and upload multiplier
+	// windows, see handler.ValidatePromotion. A promotion without an
+	// info_hash_id applies to every infohash.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS promotions (
+		    id SERIAL PRIMARY KEY,
+		    info_hash_id INTEGER,
+		    freeleech BOOLEAN NOT NULL DEFAULT FALSE,
+		    upload_multiplier DOUBLE PRECISION NOT NULL DEFAULT 1,
+		    start_time TIMESTAMPTZ NOT NULL,
+		    end_time TIMESTAMPTZ NOT NULL,
+		    reason TEXT NOT NULL DEFAULT '',
+		    created_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    CONSTRAINT fk_infohashes FOREIGN KEY(info_hash_id) REFERENCES infohashes(id) ON DELETE CASCADE
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create promotions table: %w", err)
+	}
+
+	// Indexes for the hot queries on announces, see CheckQueryPlans: the
+	// active peers of a swarm, the active announces of one key, and the
+	// active seeders, which every seeder count and peering algorithm
+	// filters on.
+	_, err = dbpool.Exec(ctx, `
+		CREATE INDEX IF NOT EXISTS idx_announces_swarm_recent ON announces (info_hash_id, last_announce);
+		CREATE INDEX IF NOT EXISTS idx_announces_peer_recent ON announces (peers_id, last_announce);
+		CREATE INDEX IF NOT EXISTS idx_announces_seeders ON announces (info_hash_id, last_announce)
+		WHERE
+		    amount_left = 0;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create announces indexes: %w", err)
+	}
+
+	// The optional key announce parameter of BEP 7, hashed at rest in
+	// privacy mode, which lets a client which changes IP or peer_id be
+	// matched to its previous announce.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE announces
+		    ADD COLUMN IF NOT EXISTS client_key BYTEA;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add client_key to announces table: %w", err)
+	}
+
+	// Announces which have gone stale or stopped are marked expired by
+	// prune.SweepStale, and cleared again by the next announce. Active
+	// excludes them, so that every instance sharing the database agrees
+	// that a peer is gone once one has swept it, whatever its own clock.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE announces
+		    ADD COLUMN IF NOT EXISTS expired BOOLEAN NOT NULL DEFAULT FALSE;
+
+		CREATE INDEX IF NOT EXISTS idx_announces_live ON announces (info_hash_id, last_announce)
+		WHERE
+		    NOT expired;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add expired to announces table: %w", err)
+	}
+
+	// The announce key put in torrent files fetched by each seedbox agent,
+	// created the first time it fetches one.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE agent_keys
+		    ADD COLUMN IF NOT EXISTS announce_key TEXT;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add announce_key to agent_keys table: %w", err)
+	}
+
+	// client_certs table, which maps the SHA-256 fingerprints of client TLS
+	// certificates to announce keys, so that announces authenticated by a
+	// certificate need no key in the URL.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS client_certs (
+		    fingerprint BYTEA PRIMARY KEY,
+		    peers_id INTEGER NOT NULL REFERENCES peers (id) ON DELETE CASCADE,
+		    subject TEXT NOT NULL,
+		    created_time TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create client_certs table: %w", err)
+	}
+
+	// ip_changes table, which records announce keys whose clients moved to
+	// a new IP mid-session, matched by peer_id or BEP 7 key. Like
+	// key_activity, it is used to spot shared or leaked announce keys.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS ip_changes (
+		    id SERIAL PRIMARY KEY,
+		    peers_id INTEGER NOT NULL REFERENCES peers (id) ON DELETE CASCADE,
+		    info_hash_id INTEGER NOT NULL REFERENCES infohashes (id) ON DELETE CASCADE,
+		    previous_ip BYTEA,
+		    ip BYTEA NOT NULL,
+		    by_key BOOLEAN NOT NULL,
+		    change_time TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_ip_changes_peers_id ON ip_changes (peers_id);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create ip_changes table: %w", err)
+	}
+
+	// torrent_files table, which holds the metadata of each uploaded
+	// torrent file: its piece length, creation date, and its files as a
+	// JSON list of paths and lengths.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS torrent_files (
+		    info_hash_id INTEGER PRIMARY KEY REFERENCES infohashes (id) ON DELETE CASCADE,
+		    piece_length BIGINT NOT NULL,
+		    creation_date TIMESTAMPTZ,
+		    files JSONB NOT NULL
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create torrent_files table: %w", err)
+	}
+
+	// users table, which holds accounts with bcrypt password hashes, and
+	// user_sessions, which holds hashes of the session tokens given out on
+	// login. Each announce key may be owned by one user.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS users (
+		    id SERIAL PRIMARY KEY,
+		    username TEXT NOT NULL UNIQUE,
+		    password_hash BYTEA NOT NULL,
+		    created_time TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE TABLE IF NOT EXISTS user_sessions (
+		    token_hash BYTEA PRIMARY KEY,
+		    users_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		    created_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    last_used TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		ALTER TABLE peers
+		    ADD COLUMN IF NOT EXISTS users_id INTEGER REFERENCES users (id) ON DELETE SET NULL;
+		CREATE INDEX IF NOT EXISTS idx_peers_users_id ON peers (users_id);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create users tables: %w", err)
+	}
+
+	// infohash_acls table, which restricts infohashes to announce keys and
+	// user groups, see handler.checkACL, and user_groups, which holds the
+	// groups of each user.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS infohash_acls (
+		    info_hash_id INTEGER NOT NULL REFERENCES infohashes (id) ON DELETE CASCADE,
+		    kind TEXT NOT NULL,
+		    value TEXT NOT NULL,
+		    created_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    PRIMARY KEY (info_hash_id, kind, value)
+		);
+		CREATE TABLE IF NOT EXISTS user_groups (
+		    users_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		    group_name TEXT NOT NULL,
+		    PRIMARY KEY (users_id, group_name)
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create acl tables: %w", err)
+	}
+
+	// invites table, which holds hashes of the single-use invite codes
+	// required to generate announce keys when ETRACKER_REQUIRE_INVITE is
+	// set. peers_id is the key generated with a used invite.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS invites (
+		    id SERIAL PRIMARY KEY,
+		    code_hash BYTEA NOT NULL UNIQUE,
+		    note TEXT NOT NULL DEFAULT '',
+		    created_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    used_time TIMESTAMPTZ,
+		    peers_id INTEGER REFERENCES peers (id) ON DELETE SET NULL
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create invites table: %w", err)
+	}
+
+	// The account tier of each user, see config.Tier, until tier_expires if
+	// it is set.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE users
+		    ADD COLUMN IF NOT EXISTS tier TEXT,
+		    ADD COLUMN IF NOT EXISTS tier_expires TIMESTAMPTZ;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add tier to users table: %w", err)
+	}
+
+	// The deadline by which an announce key must be rotated during a
+	// rotation campaign, see handler.checkRotation.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE peers
+		    ADD COLUMN IF NOT EXISTS rotate_by TIMESTAMPTZ;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add rotate_by to peers table: %w", err)
+	}
+
+	// Whether an announce key was generated with a proof of work, or issued
+	// by an operator, see handler.checkVerified.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE peers
+		    ADD COLUMN IF NOT EXISTS pow_verified BOOLEAN NOT NULL DEFAULT FALSE;
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to add pow_verified to peers table: %w", err)
+	}
+
+	// snatches table, which records each completed event with its announce
+	// key and time, as a history behind the downloaded counter of
+	// infohashes, for moderation and for finding duplicate completions.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS snatches (
+		    id SERIAL PRIMARY KEY,
+		    peers_id INTEGER NOT NULL REFERENCES peers (id) ON DELETE CASCADE,
+		    info_hash_id INTEGER NOT NULL REFERENCES infohashes (id) ON DELETE CASCADE,
+		    snatch_time TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_snatches_info_hash_id ON snatches (info_hash_id, snatch_time);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create snatches table: %w", err)
+	}
+
+	// stats_history table, which holds the aggregate stats of each hour, or
+	// of each day once downsampled, see the history package.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS stats_history (
+		    record_time TIMESTAMPTZ NOT NULL,
+		    hours INTEGER NOT NULL,
+		    seeders INTEGER NOT NULL,
+		    leechers INTEGER NOT NULL,
+		    peers INTEGER NOT NULL,
+		    snatches INTEGER NOT NULL,
+		    announce_rate DOUBLE PRECISION NOT NULL,
+		    PRIMARY KEY (record_time, hours)
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create stats_history table: %w", err)
+	}
+
+	// user_traffic table, which holds the upload and download of each
+	// announce key by hour, as counted into the lifetime totals of peers,
+	// so that users can chart their traffic over time.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS user_traffic (
+		    peers_id INTEGER NOT NULL REFERENCES peers (id) ON DELETE CASCADE,
+		    hour TIMESTAMPTZ NOT NULL,
+		    uploaded BIGINT NOT NULL DEFAULT 0,
+		    downloaded BIGINT NOT NULL DEFAULT 0,
+		    PRIMARY KEY (peers_id, hour)
+		);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create user_traffic table: %w", err)
+	}
+
+	// credentials table, which holds the passkeys users log in with, see
+	// the webauthn package. public_key is in COSE format, and sign_count
+	// is the signature counter of the authenticator at the last login.
+	_, err = dbpool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS credentials (
+		    id SERIAL PRIMARY KEY,
+		    users_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		    credential_id BYTEA NOT NULL UNIQUE,
+		    public_key BYTEA NOT NULL,
+		    sign_count BIGINT NOT NULL DEFAULT 0,
+		    name TEXT NOT NULL,
+		    created_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    last_used TIMESTAMPTZ
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_credentials_users_id ON credentials (users_id);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create credentials table: %w", err)
+	}
+
+	// user_identities table, which maps the subjects of OpenID Connect
+	// identity providers to the users they log in as. Users created on
+	// their first OpenID Connect login have no password_hash, so they
+	// cannot log in with a password.
+	_, err = dbpool.Exec(ctx, `
+		ALTER TABLE users
+		    ALTER COLUMN password_hash DROP NOT NULL;
+
+		CREATE TABLE IF NOT EXISTS user_identities (
+		    issuer TEXT NOT NULL,
+		    subject TEXT NOT NULL,
+		    users_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		    created_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		    PRIMARY KEY (issuer, subject)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_user_identities_users_id ON user_identities (users_id);
+		`)
+	if err != nil {
+		return fmt.Errorf("unable to create user_identities table: %w", err)
+	}
+
 	return nil
 }
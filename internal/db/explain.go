@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// stoppedEvent is the value of config.Stopped, which cannot be imported
+// here, for binding the hot queries.
+const stoppedEvent = 2
+
+// hotQueries are representative forms of the queries made on every
+// announce, which must be served by an index as the announces table grows.
+// Each binds the stopped event, the stale cutoff, and an id.
+var hotQueries = []struct {
+	name  string
+	query string
+}{
+	{"swarm peers", `
+		SELECT
+		    peers_id
+		FROM
+		    announces
+		WHERE
+		    info_hash_id = $3
+		    AND ` + Active(1, 2)},
+	{"key announces", `
+		SELECT
+		    info_hash_id
+		FROM
+		    announces
+		WHERE
+		    peers_id = $3
+		    AND ` + Active(1, 2)},
+	{"swarm seeders", `
+		SELECT
+		    COUNT(*)
+		FROM
+		    announces
+		WHERE
+		    info_hash_id = $3
+		    AND amount_left = 0
+		    AND ` + Active(1, 2)},
+}
+
+// planNode is a node of a plan from EXPLAIN (FORMAT JSON).
+type planNode struct {
+	NodeType     string     `json:"Node Type"`
+	RelationName string     `json:"Relation Name"`
+	Plans        []planNode `json:"Plans"`
+}
+
+// seqScans returns the relations scanned sequentially in a plan.
+func seqScans(plan planNode) []string {
+	var relations []string
+	if plan.NodeType == "Seq Scan" {
+		relations = append(relations, plan.RelationName)
+	}
+	for _, p := range plan.Plans {
+		relations = append(relations, seqScans(p)...)
+	}
+	return relations
+}
+
+// CheckQueryPlans explains each of the hot queries, and returns and logs a
+// warning for each one which falls back to a sequential scan. Sequential
+// scans are disabled while planning, so that a small development database
+// does not hide a missing index: the planner only chooses one when no index
+// can serve the query. It is meant for development, see config.Config.Dev.
+func CheckQueryPlans(ctx context.Context, dbpool *pgxpool.Pool) ([]string, error) {
+	tx, err := dbpool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to begin query plan check: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `SET LOCAL enable_seqscan = off`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to disable sequential scans: %w", err)
+	}
+
+	var warnings []string
+	for _, q := range hotQueries {
+		var explained []struct {
+			Plan planNode `json:"Plan"`
+		}
+		err = tx.QueryRow(ctx, `EXPLAIN (FORMAT JSON) `+q.query,
+			pgx.QueryExecModeSimpleProtocol, stoppedEvent, time.Now(), 1).Scan(&explained)
+		if err != nil {
+			return nil, fmt.Errorf("unable to explain %s query: %w", q.name, err)
+		}
+
+		for _, e := range explained {
+			for _, relation := range seqScans(e.Plan) {
+				warning := fmt.Sprintf("Hot query %q falls back to a sequential scan on %s", q.name, relation)
+				log.Print(warning)
+				warnings = append(warnings, warning)
+			}
+		}
+	}
+
+	return warnings, nil
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestSeqScans(t *testing.T) {
+	data := []struct {
+		name     string
+		plan     string
+		expected []string
+	}{
+		{
+			"index scan",
+			`{"Node Type": "Index Scan", "Relation Name": "announces"}`,
+			nil,
+		},
+		{
+			"nested seq scan",
+			`{"Node Type": "Aggregate", "Plans": [
+				{"Node Type": "Hash Join", "Plans": [
+					{"Node Type": "Seq Scan", "Relation Name": "announces"},
+					{"Node Type": "Index Scan", "Relation Name": "peers"}
+				]}
+			]}`,
+			[]string{"announces"},
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			var plan planNode
+			if err := json.Unmarshal([]byte(d.plan), &plan); err != nil {
+				t.Fatalf("unable to parse plan: %v", err)
+			}
+			if got := seqScans(plan); !slices.Equal(got, d.expected) {
+				t.Errorf("expected %v, got %v", d.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+// Package debuglog keeps the decisions made for the most recent announces
+// in a ring buffer, so that an operator can see why announces are failing or
+// getting few peers in production without enabling verbose logs. Decisions
+// are anonymized: they record the infohash and client, but never the
+// announce key, IP, or peer_id.
+//
+// Every method is safe to call on a nil Ring or Decision, and does nothing,
+// so that the announce path records decisions unconditionally whether or not
+// the ring buffer is enabled. A Decision is filled in by the goroutine
+// handling its announce, and is not changed once it is recorded.
+package debuglog
+
+import (
+	"encoding/hex"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxSize bounds the number of decisions kept.
+const MaxSize = 10000
+
+// Outcomes of an announce.
+const (
+	OutcomeOK          = "ok"
+	OutcomeParseError  = "parse error"
+	OutcomeRejected    = "rejected"
+	OutcomeMaintenance = "maintenance"
+	OutcomeReadOnly    = "read-only"
+	OutcomeError       = "error"
+)
+
+// Stage is the outcome and latency of one stage of building a reply, see
+// handler.runStage.
+type Stage struct {
+	Name         string `json:"name"`
+	Outcome      string `json:"outcome"`
+	Microseconds int64  `json:"microseconds"`
+}
+
+// Decision is how the tracker handled one announce. Source is the tier
+// which answered with the candidate peers: redis when the swarm cache hit,
+// postgres when it missed, or fallback.
+type Decision struct {
+	Time         time.Time `json:"time"`
+	Info_hash    string    `json:"info_hash,omitempty"`
+	Client       string    `json:"client,omitempty"`
+	Event        string    `json:"event,omitempty"`
+	Seeder       bool      `json:"seeder"`
+	Numwant      int       `json:"numwant"`
+	Outcome      string    `json:"outcome"`
+	Error        string    `json:"error,omitempty"`
+	Num_to_give  int       `json:"num_to_give"`
+	Source       string    `json:"source,omitempty"`
+	Candidates   int       `json:"candidates"`
+	Given        int       `json:"given"`
+	Stages       []Stage   `json:"stages,omitempty"`
+	Microseconds int64     `json:"microseconds"`
+
+	start time.Time
+}
+
+// Ring holds the most recent decisions.
+type Ring struct {
+	mu        sync.Mutex
+	decisions []*Decision
+	next      int
+}
+
+// NewRing returns a Ring which keeps the last size decisions, at most
+// MaxSize.
+func NewRing(size int) *Ring {
+	return &Ring{decisions: make([]*Decision, 0, min(size, MaxSize))}
+}
+
+// Start returns a new Decision for an announce received at now, which is
+// added to the ring by Record. It returns nil if r is nil.
+func (r *Ring) Start(now time.Time) *Decision {
+	if r == nil {
+		return nil
+	}
+	return &Decision{Time: now, Outcome: OutcomeOK, start: time.Now()}
+}
+
+// Record adds d to the ring, replacing the oldest decision if it is full.
+func (r *Ring) Record(d *Decision) {
+	if r == nil || d == nil || cap(r.decisions) == 0 {
+		return
+	}
+	d.Microseconds = time.Since(d.start).Microseconds()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.decisions) < cap(r.decisions) {
+		r.decisions = append(r.decisions, d)
+		return
+	}
+	r.decisions[r.next] = d
+	r.next = (r.next + 1) % len(r.decisions)
+}
+
+// Len returns the number of decisions in the ring.
+func (r *Ring) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.decisions)
+}
+
+// Recent returns copies of the decisions in the ring, newest first.
+func (r *Ring) Recent() []Decision {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	recent := make([]Decision, 0, len(r.decisions))
+	for i := range len(r.decisions) {
+		d := *r.decisions[(r.next+len(r.decisions)-1-i)%len(r.decisions)]
+		d.Stages = slices.Clone(d.Stages)
+		recent = append(recent, d)
+	}
+	return recent
+}
+
+// SetAnnounce records the parsed announce.
+func (d *Decision) SetAnnounce(info_hash []byte, client string, event string, seeder bool, numwant int) {
+	if d == nil {
+		return
+	}
+	d.Info_hash = hex.EncodeToString(info_hash)
+	d.Client = client
+	d.Event = event
+	d.Seeder = seeder
+	d.Numwant = numwant
+}
+
+// SetOutcome records an outcome other than OutcomeOK, and the error which
+// caused it, if any. Only the outermost message of the error is kept, since
+// wrapped errors may contain addresses or announce keys.
+func (d *Decision) SetOutcome(outcome string, err error) {
+	if d == nil {
+		return
+	}
+	d.Outcome = outcome
+	if err != nil {
+		d.Error, _, _ = strings.Cut(err.Error(), ": ")
+	}
+}
+
+// AddStage records the outcome and latency of a stage.
+func (d *Decision) AddStage(name string, outcome string, elapsed time.Duration) {
+	if d == nil {
+		return
+	}
+	d.Stages = append(d.Stages, Stage{Name: name, Outcome: outcome, Microseconds: elapsed.Microseconds()})
+}
+
+// SetNumToGive records the number of peers the peering algorithm allowed.
+func (d *Decision) SetNumToGive(n int) {
+	if d == nil {
+		return
+	}
+	d.Num_to_give = n
+}
+
+// SetCandidates records the tier which answered with candidate peers, and
+// how many it gave.
+func (d *Decision) SetCandidates(source string, n int) {
+	if d == nil {
+		return
+	}
+	d.Source = source
+	d.Candidates = n
+}
+
+// SetGiven records the number of peers in the reply.
+func (d *Decision) SetGiven(n int) {
+	if d == nil {
+		return
+	}
+	d.Given = n
+}
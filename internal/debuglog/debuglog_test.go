@@ -0,0 +1,62 @@
+package debuglog
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	ring := NewRing(3)
+	now := time.Now()
+
+	for i := range 5 {
+		d := ring.Start(now.Add(time.Duration(i) * time.Second))
+		d.SetAnnounce([]byte{byte(i)}, "qB4650", "", true, 50)
+		ring.Record(d)
+	}
+
+	if ring.Len() != 3 {
+		t.Errorf("expected a full ring of 3, got %d", ring.Len())
+	}
+	recent := ring.Recent()
+	if len(recent) != 3 {
+		t.Fatalf("expected 3 decisions, got %d", len(recent))
+	}
+	for i, d := range recent {
+		if expected := fmt.Sprintf("%02x", 4-i); d.Info_hash != expected {
+			t.Errorf("decision %d: expected info_hash %s, got %s", i, expected, d.Info_hash)
+		}
+	}
+}
+
+func TestNilRing(t *testing.T) {
+	var ring *Ring
+	d := ring.Start(time.Now())
+	if d != nil {
+		t.Fatalf("expected no decision from a nil ring")
+	}
+
+	// None of these may panic.
+	d.SetAnnounce(nil, "", "", false, 0)
+	d.SetOutcome(OutcomeError, errors.New("error"))
+	d.AddStage("redis", "ok", time.Millisecond)
+	d.SetNumToGive(1)
+	d.SetCandidates("redis", 1)
+	d.SetGiven(1)
+	ring.Record(d)
+
+	if recent := ring.Recent(); recent != nil || ring.Len() != 0 {
+		t.Errorf("expected no decisions, got %v", recent)
+	}
+}
+
+func TestSetOutcome(t *testing.T) {
+	d := NewRing(1).Start(time.Now())
+	d.SetOutcome(OutcomeParseError, fmt.Errorf("error encoding remote address: %w", errors.New("invalid IP 192.0.2.1")))
+
+	if d.Outcome != OutcomeParseError || d.Error != "error encoding remote address" {
+		t.Errorf("expected only the outermost error, got %q: %q", d.Outcome, d.Error)
+	}
+}
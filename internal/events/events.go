@@ -0,0 +1,312 @@
+// Package events is the tracker's internal event bus. The announce pipeline
+// and the API publish events, such as an accepted announce or a generated
+// key, and subsystems such as metrics and webhooks subscribe to the kinds
+// they need, so that they can be enabled independently without the
+// publishers knowing about them.
+//
+// Bus is the interface between the two sides. Local delivers events within
+// the process; a broker such as NATS or ZeroMQ can carry events between
+// tracker instances by implementing Bus as well.
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind is the kind of an event.
+type Kind string
+
+const (
+	// AnnounceAccepted is published for every announce which is recorded.
+	AnnounceAccepted Kind = "announce_accepted"
+	// SnatchCompleted is published for every announce with the completed
+	// event, after its AnnounceAccepted.
+	SnatchCompleted Kind = "snatch_completed"
+	// KeyGenerated is published for every new announce key.
+	KeyGenerated Kind = "key_generated"
+	// InfohashAdded is published for every infohash added through the API.
+	InfohashAdded Kind = "infohash_added"
+	// IPChanged is published when a client announces from a new IP under
+	// the same peer_id or BEP 7 key, before its AnnounceAccepted.
+	IPChanged Kind = "ip_changed"
+	// SwarmDied is published when the last seeder of an infohash leaves,
+	// see the swarms package.
+	SwarmDied Kind = "swarm_died"
+	// KeyRevoked is published for every announce key revoked through the
+	// API.
+	KeyRevoked Kind = "key_revoked"
+	// InfohashArchival is published for every infohash which is about to
+	// be archived, is archived, or is resurrected, with an archive.Event as
+	// Detail.
+	InfohashArchival Kind = "infohash_archival"
+	// AnomalyAlert is published whenever an endpoint becomes anomalous or
+	// recovers, with an anomaly.Alert as Detail.
+	AnomalyAlert Kind = "anomaly_alert"
+	// CanaryAlert is published whenever the canary becomes unhealthy or
+	// recovers, with a canary.Alert as Detail.
+	CanaryAlert Kind = "canary_alert"
+)
+
+// Kinds are every kind of event, in the order they are documented.
+var Kinds = []Kind{AnnounceAccepted, SnatchCompleted, KeyGenerated, InfohashAdded, IPChanged, SwarmDied, KeyRevoked, InfohashArchival, AnomalyAlert, CanaryAlert}
+
+// DefaultBuffer is the number of events queued for each subscriber before
+// further events are dropped.
+const DefaultBuffer = 1024
+
+const Timeout = 10 * time.Second
+
+// WebhookRetries is how many times a failed webhook delivery is retried,
+// waiting WebhookBackoff before the first retry and twice as long before
+// each later one.
+const (
+	WebhookRetries = 3
+	WebhookBackoff = time.Second
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the body of a webhook
+// request, keyed with the webhook secret, see Sign.
+const SignatureHeader = "X-Etracker-Signature"
+
+var (
+	counts  = expvar.NewMap("events")
+	dropped = expvar.NewMap("events_dropped")
+)
+
+// Event is something which happened in the tracker. Fields which do not
+// apply to its kind are left empty. The announce key is available to
+// subscribers in the process, but is never serialized, since it is a
+// secret; serialized events identify it by its hash instead, see HashKey.
+// Detail is the record of a background job reported by the event, for the
+// kinds which carry one.
+type Event struct {
+	Kind         Kind      `json:"kind"`
+	Time         time.Time `json:"time"`
+	Announce_key string    `json:"-"`
+	Info_hash    []byte    `json:"info_hash,omitempty"`
+	Name         string    `json:"name,omitempty"`
+	Client       string    `json:"client,omitempty"`
+	Uploaded     int       `json:"uploaded,omitempty"`
+	Downloaded   int       `json:"downloaded,omitempty"`
+	Left         int       `json:"left,omitempty"`
+	Detail       any       `json:"detail,omitempty"`
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	// event has the fields of Event without its methods, so that it is
+	// marshalled with the default encoding.
+	type event Event
+	var key_hash string
+	if e.Announce_key != "" {
+		key_hash = HashKey(e.Announce_key)
+	}
+	return json.Marshal(struct {
+		event
+		Key_hash string `json:"key_hash,omitempty"`
+	}{event(e), key_hash})
+}
+
+// HashKey returns the hex SHA-256 of an announce key, which identifies the
+// key in serialized events without revealing it. Announce keys are random,
+// so the hash cannot be reversed, but an operator who has a key can
+// compute it to match events to the key.
+func HashKey(announce_key string) string {
+	sum := sha256.Sum256([]byte(announce_key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Handler consumes events from a subscription.
+type Handler func(ctx context.Context, e Event)
+
+// Bus carries events from publishers to subscribers. Publish must never
+// block the caller, since it is called on the announce path, so events may
+// be dropped if a subscriber falls behind.
+type Bus interface {
+	// Publish sends e to every subscriber to its kind.
+	Publish(e Event)
+	// Subscribe calls h with every later event of the given kinds, or of
+	// every kind if none are given, until ctx is cancelled. Events are
+	// delivered to each subscriber in order, one at a time.
+	Subscribe(ctx context.Context, name string, h Handler, kinds ...Kind)
+}
+
+// ParseKinds parses a comma-separated list of kinds. An empty list is every
+// kind.
+func ParseKinds(s string) ([]Kind, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var kinds []Kind
+	for _, name := range strings.Split(s, ",") {
+		kind := Kind(strings.TrimSpace(name))
+		if !slices.Contains(Kinds, kind) {
+			return nil, fmt.Errorf("unknown event kind %q", kind)
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+// Local is a Bus which delivers events to subscribers in the same process.
+// Each subscriber has its own queue and goroutine, so that a slow webhook
+// cannot hold up metrics.
+type Local struct {
+	buffer int
+
+	mu          sync.RWMutex
+	subscribers []*subscriber
+}
+
+type subscriber struct {
+	name  string
+	kinds []Kind
+	queue chan Event
+	done  <-chan struct{}
+}
+
+// NewLocal returns a Local bus which queues up to buffer events for each
+// subscriber.
+func NewLocal(buffer int) *Local {
+	return &Local{buffer: buffer}
+}
+
+func (b *Local) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subscribers {
+		if len(s.kinds) > 0 && !slices.Contains(s.kinds, e.Kind) {
+			continue
+		}
+		select {
+		case <-s.done:
+		case s.queue <- e:
+		default:
+			dropped.Add(s.name, 1)
+		}
+	}
+}
+
+func (b *Local) Subscribe(ctx context.Context, name string, h Handler, kinds ...Kind) {
+	s := &subscriber{
+		name:  name,
+		kinds: kinds,
+		queue: make(chan Event, b.buffer),
+		done:  ctx.Done(),
+	}
+
+	b.mu.Lock()
+	b.subscribers = append(b.subscribers, s)
+	b.mu.Unlock()
+
+	go func() {
+		defer b.unsubscribe(s)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-s.queue:
+				h(ctx, e)
+			}
+		}
+	}()
+}
+
+func (b *Local) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = slices.DeleteFunc(b.subscribers, func(other *subscriber) bool {
+		return other == s
+	})
+}
+
+// Metrics is a Handler which counts events of each kind through expvar.
+func Metrics(_ context.Context, e Event) {
+	counts.Add(string(e.Kind), 1)
+}
+
+// Webhook returns a Handler which posts each event to url as JSON. If
+// secret is set, the body is signed in the SignatureHeader. Deliveries
+// which fail with a network error or a 5xx or 429 status are retried with
+// backoff, see WebhookRetries, holding up later events of the same
+// subscriber. Failures are only logged.
+func Webhook(url, secret string) Handler {
+	return func(ctx context.Context, e Event) {
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("Error constructing event notification: %v", err)
+			return
+		}
+
+		backoff := WebhookBackoff
+		for attempt := 0; ; attempt++ {
+			retry, err := deliver(ctx, url, secret, body)
+			if err == nil {
+				return
+			}
+			if !retry || attempt == WebhookRetries {
+				log.Printf("Error sending event notification: %v", err)
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// deliver posts a webhook body once, and reports whether a failure may be
+// retried.
+func deliver(ctx context.Context, url, secret string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(SignatureHeader, hex.EncodeToString(Sign(secret, body)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook responded %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+}
+
+// Sign returns the signature of a webhook body, sent hex-encoded in the
+// SignatureHeader, so that receivers can verify that it was sent by the
+// tracker.
+func Sign(secret string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
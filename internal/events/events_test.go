@@ -0,0 +1,167 @@
+package events
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseKinds(t *testing.T) {
+	kinds, err := ParseKinds("snatch_completed, key_generated")
+	if err != nil || !slices.Equal(kinds, []Kind{SnatchCompleted, KeyGenerated}) {
+		t.Errorf("expected two kinds, got %v, %v", kinds, err)
+	}
+	if kinds, err := ParseKinds(""); err != nil || kinds != nil {
+		t.Errorf("expected every kind, got %v, %v", kinds, err)
+	}
+	if _, err := ParseKinds("announce_accepted,unknown"); err == nil {
+		t.Errorf("expected error for unknown kind")
+	}
+}
+
+func TestLocal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bus := NewLocal(DefaultBuffer)
+	all := make(chan Event, 10)
+	snatches := make(chan Event, 10)
+	bus.Subscribe(ctx, "all", func(_ context.Context, e Event) { all <- e })
+	bus.Subscribe(ctx, "snatches", func(_ context.Context, e Event) { snatches <- e }, SnatchCompleted)
+
+	bus.Publish(Event{Kind: AnnounceAccepted})
+	bus.Publish(Event{Kind: SnatchCompleted})
+
+	receive := func(ch chan Event) Kind {
+		select {
+		case e := <-ch:
+			return e.Kind
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for event")
+			return ""
+		}
+	}
+
+	if k1, k2 := receive(all), receive(all); k1 != AnnounceAccepted || k2 != SnatchCompleted {
+		t.Errorf("expected both events in order, got %s, %s", k1, k2)
+	}
+	if k := receive(snatches); k != SnatchCompleted {
+		t.Errorf("expected only the snatch, got %s", k)
+	}
+	select {
+	case e := <-snatches:
+		t.Errorf("expected no more events, got %s", e.Kind)
+	default:
+	}
+}
+
+func TestLocalDrops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bus := NewLocal(1)
+	block := make(chan struct{})
+	defer close(block)
+	bus.Subscribe(ctx, "slow", func(context.Context, Event) { <-block })
+
+	// Publishing never blocks, however far behind the subscriber is.
+	done := make(chan struct{})
+	go func() {
+		for range 100 {
+			bus.Publish(Event{Kind: AnnounceAccepted})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on a slow subscriber")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var attempts atomic.Int32
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first attempt fails, and is retried.
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	Webhook(server.URL, "secret")(context.Background(), Event{Kind: SwarmDied, Info_hash: []byte("aaaaaaaaaaaaaaaaaaaa")})
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+		if err != nil || !hmac.Equal(signature, Sign("secret", body)) {
+			t.Errorf("expected valid signature, got %q", r.Header.Get(SignatureHeader))
+		}
+		var e Event
+		if err := json.Unmarshal(body, &e); err != nil || e.Kind != SwarmDied {
+			t.Errorf("expected swarm_died event, got %s: %v", body, err)
+		}
+	default:
+		t.Fatal("expected webhook to be retried")
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("expected %d attempts, got %d", 2, n)
+	}
+}
+
+func TestMarshalEvent(t *testing.T) {
+	key := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	body, err := json.Marshal(Event{Kind: KeyRevoked, Announce_key: key, Detail: map[string]string{"status": "revoked"}})
+	if err != nil {
+		t.Fatalf("error marshalling event: %v", err)
+	}
+	if strings.Contains(string(body), key) {
+		t.Errorf("expected announce key not to be serialized, got %s", body)
+	}
+
+	var e struct {
+		Kind     Kind              `json:"kind"`
+		Key_hash string            `json:"key_hash"`
+		Detail   map[string]string `json:"detail"`
+	}
+	if err = json.Unmarshal(body, &e); err != nil {
+		t.Fatalf("error unmarshalling event: %v", err)
+	}
+	if e.Kind != KeyRevoked || e.Key_hash != HashKey(key) || e.Detail["status"] != "revoked" {
+		t.Errorf("expected key_revoked event with key hash and detail, got %s", body)
+	}
+
+	if body, _ := json.Marshal(Event{Kind: SwarmDied}); strings.Contains(string(body), "key_hash") {
+		t.Errorf("expected no key hash without a key, got %s", body)
+	}
+}
+
+func TestWebhookClientError(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	Webhook(server.URL, "")(context.Background(), Event{Kind: KeyRevoked})
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("expected client errors not to be retried, got %d attempts", n)
+	}
+}
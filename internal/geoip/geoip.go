@@ -0,0 +1,87 @@
+// Package geoip looks up the country and autonomous system of peer IPs in
+// MaxMind-format databases, such as the free GeoLite2 Country and ASN
+// databases. Lookups are only used for aggregate statistics.
+package geoip
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Reader wraps the optional country and ASN databases. A nil Reader, or a
+// Reader missing either database, is valid and returns empty results.
+type Reader struct {
+	country *geoip2.Reader
+	asn     *geoip2.Reader
+}
+
+// Location is the result of a lookup. Country is an ISO 3166-1 alpha-2 code.
+// Empty fields mean the lookup failed or the database is not configured.
+type Location struct {
+	Country string
+	Asn     int
+	Asn_org string
+}
+
+// Open opens the country and ASN databases at the given paths. Either path
+// may be empty to skip that database.
+func Open(countryPath, asnPath string) (*Reader, error) {
+	var r Reader
+	var err error
+
+	if countryPath != "" {
+		r.country, err = geoip2.Open(countryPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open country database: %w", err)
+		}
+	}
+
+	if asnPath != "" {
+		r.asn, err = geoip2.Open(asnPath)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("unable to open ASN database: %w", err)
+		}
+	}
+
+	return &r, nil
+}
+
+// Lookup returns the location of ip. Errors are not reported; an address
+// missing from the databases simply has an empty location.
+func (r *Reader) Lookup(ip net.IP) Location {
+	var loc Location
+	if r == nil || ip == nil {
+		return loc
+	}
+
+	if r.country != nil {
+		if country, err := r.country.Country(ip); err == nil {
+			loc.Country = country.Country.IsoCode
+		}
+	}
+
+	if r.asn != nil {
+		if asn, err := r.asn.ASN(ip); err == nil {
+			loc.Asn = int(asn.AutonomousSystemNumber)
+			loc.Asn_org = asn.AutonomousSystemOrganization
+		}
+	}
+
+	return loc
+}
+
+// Close closes any open databases.
+func (r *Reader) Close() {
+	if r == nil {
+		return
+	}
+	if r.country != nil {
+		_ = r.country.Close()
+	}
+	if r.asn != nil {
+		_ = r.asn.Close()
+	}
+}
@@ -0,0 +1,37 @@
+package geoip
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNilReader(t *testing.T) {
+	var r *Reader
+
+	loc := r.Lookup(net.ParseIP("1.1.1.1"))
+	if loc != (Location{}) {
+		t.Errorf("expected empty location from nil reader, got %v", loc)
+	}
+
+	r.Close()
+}
+
+func TestOpenWithoutDatabases(t *testing.T) {
+	r, err := Open("", "")
+	if err != nil {
+		t.Fatalf("error opening reader without databases: %v", err)
+	}
+	defer r.Close()
+
+	loc := r.Lookup(net.ParseIP("1.1.1.1"))
+	if loc != (Location{}) {
+		t.Errorf("expected empty location without databases, got %v", loc)
+	}
+}
+
+func TestOpenMissingDatabase(t *testing.T) {
+	_, err := Open("./does-not-exist.mmdb", "")
+	if err == nil {
+		t.Errorf("expected error opening missing database")
+	}
+}
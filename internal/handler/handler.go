@@ -1,19 +1,30 @@
 package handler
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/dmoerner/etracker/internal/bencode"
 	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+	"github.com/dmoerner/etracker/internal/debuglog"
+	"github.com/dmoerner/etracker/internal/events"
+	"github.com/dmoerner/etracker/internal/locale"
 	"github.com/redis/go-redis/v9"
 
 	"github.com/jackc/pgx/v5"
@@ -23,21 +34,21 @@ const DefaultTrackerError = "tracker error"
 
 var (
 	ErrInfoHashNotAllowed = errors.New("info_hash not in infohashes")
+	ErrInfoHashRetired    = errors.New("info_hash retired")
 	ErrUntrackedAnnounce  = errors.New("untracked announce key")
 )
 
-// encodeAddr converts a request RemoteAddr in the format x.x.x.x:port into
-// 6-byte compact format expected by BEP 23. The port used is extracted from
-// the client announce; the RemoteAddr port is ignored.
+// encodeAddr converts a request RemoteAddr into the compact format: 6 bytes
+// for an IPv4 address as in BEP 23, or 18 bytes for an IPv6 address as in
+// BEP 7. IPv4-mapped IPv6 addresses, which dual-stack listeners report for
+// IPv4 clients, are encoded as IPv4. The port used is extracted from the
+// client announce; the RemoteAddr port is ignored.
 func encodeAddr(remoteAddr string, port string) ([]byte, error) {
-	splitAddr := strings.Split(remoteAddr, ":")
-
-	if len(splitAddr) != 2 {
+	ipString, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
 		return nil, fmt.Errorf("invalid address format: %s", remoteAddr)
 	}
 
-	ipString := splitAddr[0]
-
 	portInt, err := strconv.Atoi(port)
 	if err != nil {
 		return nil, fmt.Errorf("error converting port to int: %w", err)
@@ -46,19 +57,139 @@ func encodeAddr(remoteAddr string, port string) ([]byte, error) {
 	bytesPort := make([]byte, 2)
 	binary.BigEndian.PutUint16(bytesPort, uint16(portInt))
 
-	parsedIP := []byte(net.ParseIP(ipString).To4())
-	if parsedIP == nil {
+	ip := net.ParseIP(ipString)
+	if ip == nil {
 		return nil, fmt.Errorf("invalid IP address: %s", ipString)
 	}
 
+	parsedIP := []byte(ip.To4())
+	if parsedIP == nil {
+		parsedIP = []byte(ip.To16())
+	}
+
 	ip_port := append(parsedIP, bytesPort...)
 
 	return ip_port, nil
 }
 
+// isIPv6 reports whether a compact ip_port holds an IPv6 address.
+func isIPv6(ip_port []byte) bool {
+	return len(ip_port) == net.IPv6len+2
+}
+
+// clientFromPeerID extracts the client identifier from a peer_id. Most
+// clients use the Azureus-style "-XXYYYY-" prefix, where XX is the client and
+// YYYY the version. Shadow-style peer_ids only identify the client by the
+// first character. Anything else is reported as "unknown".
+func clientFromPeerID(peer_id string) string {
+	isPrintable := func(s string) bool {
+		for _, c := range []byte(s) {
+			if c < '!' || c > '~' {
+				return false
+			}
+		}
+		return true
+	}
+
+	if len(peer_id) >= 8 && peer_id[0] == '-' && peer_id[7] == '-' && isPrintable(peer_id[1:7]) {
+		return peer_id[1:7]
+	}
+	if len(peer_id) >= 1 && isPrintable(peer_id[:1]) {
+		return peer_id[:1]
+	}
+	return "unknown"
+}
+
+// announceFields are the query parameters parsed into Announce fields. Any
+// others are recorded in Announce.Params.
+var announceFields = map[string]bool{
+	"info_hash":  true,
+	"peer_id":    true,
+	"port":       true,
+	"left":       true,
+	"uploaded":   true,
+	"downloaded": true,
+	"numwant":    true,
+	"event":      true,
+	"compact":    true,
+	"no_peer_id": true,
+}
+
+const (
+	// MaxParams and MaxParamLength bound what is recorded of the
+	// parameters in Announce.Params, since clients may send anything.
+	MaxParams      = 16
+	MaxParamLength = 64
+)
+
+// parseParams collects the announce parameters without an Announce field.
+// Clients send a long tail of these, such as uTorrent's corrupt and
+// redundant byte counts, the key and trackerid of BEP 3, and the encryption
+// flags of various clients. None of them affect the reply, but they are
+// recorded for analysis. Keys are taken in order up to MaxParams, and keys
+// and values are truncated to MaxParamLength and stripped of control
+// characters, which Postgres does not accept in JSON.
+func parseParams(query url.Values) map[string]string {
+	clean := func(s string) string {
+		s = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, strings.ToValidUTF8(s, ""))
+		if len(s) > MaxParamLength {
+			s = strings.ToValidUTF8(s[:MaxParamLength], "")
+		}
+		return s
+	}
+
+	keys := slices.Sorted(maps.Keys(query))
+
+	var params map[string]string
+	for _, k := range keys {
+		key := clean(k)
+		if announceFields[k] || key == "" {
+			continue
+		}
+		if params == nil {
+			params = make(map[string]string)
+		} else if len(params) == MaxParams {
+			break
+		}
+		params[key] = clean(query.Get(k))
+	}
+
+	return params
+}
+
+// eventNames are the names of events as sent by clients.
+var eventNames = map[config.Event]string{
+	config.Started:   "started",
+	config.Stopped:   "stopped",
+	config.Completed: "completed",
+	config.Paused:    "paused",
+}
+
+// announcedIP returns the address in the ip parameter of an announce, if it
+// is a public unicast address. Hostnames, which BEP 3 also allows, and
+// private addresses, which many clients send, are ignored.
+func announcedIP(param string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(param)
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
+
 // parseAnnounce parses a request to construct an announce struct, and returns
-// a pointer to the struct and any error.
-func parseAnnounce(r *http.Request) (*config.Announce, error) {
+// a pointer to the struct and any error. The peer address is the remote
+// address, or the ip parameter if it is honored, see config.HonorIPParam,
+// and the remote address is kept as Remote_ip either way.
+func parseAnnounce(conf config.Config, r *http.Request) (*config.Announce, error) {
 	query := r.URL.Query()
 
 	announce_key := r.PathValue("id")
@@ -76,6 +207,15 @@ func parseAnnounce(r *http.Request) (*config.Announce, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error encoding remote address: %w", err)
 	}
+	remote_ip := ip_port[:len(ip_port)-2]
+	if conf.HonorIPParam {
+		if addr, ok := announcedIP(query.Get("ip")); ok {
+			ip_port, err = encodeAddr(netip.AddrPortFrom(addr, 0).String(), port)
+			if err != nil {
+				return nil, fmt.Errorf("error encoding announced address: %w", err)
+			}
+		}
+	}
 
 	// "left" is the key in the announce, but it's a reserved word in
 	// PostgreSQL, so we will store the integer as amount_left.
@@ -109,11 +249,24 @@ func parseAnnounce(r *http.Request) (*config.Announce, error) {
 	// numwant is optional
 	numwantString := query.Get("numwant")
 	numwant, err := strconv.Atoi(numwantString)
-	if err != nil || numwant < 0 || numwant > 100 {
+	if err != nil || numwant < 0 || numwant > MaxNumwant {
 		numwant = 50
 	}
 
-	// event is optional, but if present must be "started", "stopped", or "completed"
+	// peer_id distinguishes clients announcing with the same key, and
+	// identifies the client software.
+	peer_id := query.Get("peer_id")
+	client := clientFromPeerID(peer_id)
+
+	// key is optional, see BEP 7. Keys too long to be a client's random
+	// key are ignored.
+	key := query.Get("key")
+	if len(key) > MaxParamLength {
+		key = ""
+	}
+
+	// event is optional, but if present must be "started", "stopped",
+	// "completed", or the BEP 21 "paused".
 	var event config.Event
 	eventString := query.Get("event")
 	switch eventString {
@@ -123,135 +276,291 @@ func parseAnnounce(r *http.Request) (*config.Announce, error) {
 		event = config.Stopped
 	case "completed":
 		event = config.Completed
+	case "paused":
+		event = config.Paused
 	}
 
 	var announce config.Announce
 
 	announce.Announce_key = announce_key
+	announce.Client = client
+	announce.Peer_id = []byte(peer_id)
+	announce.Key = key
 	announce.Info_hash = []byte(info_hash)
 	announce.Ip_port = ip_port
+	announce.Remote_ip = remote_ip
 	announce.Numwant = numwant
 	announce.Amount_left = amount_left
 	announce.Downloaded = downloaded
 	announce.Uploaded = uploaded
 	announce.Event = event
+	announce.Compact = query.Get("compact") != "0"
+	announce.No_peer_id = query.Get("no_peer_id") == "1"
+	announce.Params = parseParams(query)
 
 	return &announce, nil
 }
 
-// checkAnnounce checks announces for two conditions. First, is the announce
-// key being tracked? Second, if the infohash allowlist is enabled, is the infohash
-// allowed (otherwise it is tracked as well).
-//
-// Everything in checkAnnounce is stored in the Redis cache as a persistent key, since
-// these values change at most once during the runtime of the tracker.
-func checkAnnounce(ctx context.Context, conf config.Config, announce *config.Announce) error {
-	tracked := true
-	tracked_cache, err := conf.Rdb.Get(ctx, "announce:"+announce.Announce_key).Result()
+// KeyTracked reports whether an announce key is tracked. The answer is
+// cached in Redis as a persistent key, which is cleared when the key is
+// revoked, erased, pruned, or rotated, see checkAnnounce.
+func KeyTracked(ctx context.Context, conf config.Config, announce_key string) (bool, error) {
+	return keyTracked(ctx, conf, announce_key, false)
+}
+
+// keyTracked is KeyTracked, which if cacheOnly returns ErrNotCached rather
+// than querying Postgres on a cache miss.
+func keyTracked(ctx context.Context, conf config.Config, announce_key string, cacheOnly bool) (bool, error) {
+	tracked_cache, err := conf.Rdb.Get(ctx, "announce:"+announce_key).Result()
+	if err == nil {
+		return tracked_cache != "false", nil
+	}
+	if cacheOnly {
+		return false, notCached("announce key", err)
+	}
+
+	// Cache miss or failure
+	if err != redis.Nil {
+		// An issue with the cache must be logged but is not fatal.
+		log.Printf("Error fetching announce keys from cache: %v", err)
+	}
+
+	var tracked bool
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT EXISTS (SELECT FROM peers WHERE announce_key = $1);
+		`,
+		announce_key).Scan(&tracked)
 	if err != nil {
-		// Cache miss or failure
-		if err != redis.Nil {
-			// An issue with the cache must be logged but is not fatal.
-			log.Printf("Error fetching announce keys from cache: %v", err)
-		}
-		err = conf.Dbpool.QueryRow(ctx, `
-			SELECT EXISTS (SELECT FROM peers WHERE announce_key = $1);
-			`,
-			announce.Announce_key).Scan(&tracked)
-		if err != nil {
-			return fmt.Errorf("error checking peers for announce: %w", err)
-		}
-		if tracked {
-			tracked_cache = "true"
-		} else {
-			tracked_cache = "false"
-		}
-		err = conf.Rdb.Set(ctx, "announce:"+announce.Announce_key, tracked_cache, 0).Err()
-		if err != nil {
-			// An issue with the cache must be logged but is not fatal.
-			log.Printf("Error setting announce keys in cache: %v", err)
-		}
+		return false, fmt.Errorf("error checking peers for announce: %w", err)
+	}
+	if tracked {
+		tracked_cache = "true"
 	} else {
-		if tracked_cache == "false" {
-			tracked = false
-		}
+		tracked_cache = "false"
+	}
+	err = conf.Rdb.Set(ctx, "announce:"+announce_key, tracked_cache, 0).Err()
+	if err != nil {
+		// An issue with the cache must be logged but is not fatal.
+		log.Printf("Error setting announce keys in cache: %v", err)
+	}
+
+	return tracked, nil
+}
+
+// checkAnnounce checks announces for two conditions, after refusing banned
+// announces. First, is the announce key being tracked, not past its
+// rotation deadline, see checkRotation, and verified if proof of work is
+// enabled, see checkVerified? Second, if the infohash allowlist is
+// enabled, is the infohash allowed (otherwise it is tracked as well)? Retired
+// infohashes are refused either way, see RetiredFailure. Announces for a
+// merged infohash are then redirected to the canonical infohash, whose ACL,
+// if any, must allow the key, see checkACL.
+//
+// The answers for keys and infohashes are cached in Redis as persistent
+// keys, which never expire, so each is only invalidated by the change which
+// alters it. Revoking, erasing, or pruning a key clears whether it is
+// tracked, rotating it also clears its deadline and verification, and
+// verifying it overwrites its verification. Starting or cancelling a
+// rotation campaign clears every deadline, see RotationChanged. Retiring or restoring an infohash overwrites its status,
+// and merging or deleting one clears its redirect. Anything else, such as
+// adding an infohash which was cached as not allowed, only takes effect once
+// the cache is flushed. Bans and ACLs are compiled per tracker instance and
+// reloaded whenever their version counter in Redis is bumped, see
+// BansChanged and ACLsChanged.
+//
+// If cacheOnly is set, as while read-only, nothing is read from Postgres:
+// the cached answers and the last compiled bans and ACLs are used, and an
+// announce whose answer is not cached is refused with ErrNotCached.
+func checkAnnounce(ctx context.Context, conf config.Config, announce *config.Announce, cacheOnly bool) error {
+	if err := checkBanned(ctx, conf, announce, cacheOnly); err != nil {
+		return err
+	}
+
+	tracked, err := keyTracked(ctx, conf, announce.Announce_key, cacheOnly)
+	if err != nil {
+		return err
 	}
 	if !tracked {
 		return ErrUntrackedAnnounce
 	}
+	if err = checkRotation(ctx, conf, announce, cacheOnly); err != nil {
+		return err
+	}
+	if err = checkVerified(ctx, conf, announce, cacheOnly); err != nil {
+		return err
+	}
 
-	if conf.DisableAllowlist {
-		err = conf.Rdb.Get(ctx, "info_hash:"+string(announce.Info_hash)).Err()
-		if err != nil {
-			// Cache miss or failure
-			if err != redis.Nil {
-				// An issue with the cache must be logged but is not fatal.
-				log.Printf("Error fetching info_hash from cache: %v", err)
-			}
-			err = conf.Rdb.Set(ctx, "info_hash:"+string(announce.Info_hash), "true", 0).Err()
-			if err != nil {
-				// An issue with the cache must be logged but is not fatal.
-				log.Printf("Error setting info_hash in cache: %v", err)
-			}
-			_, err = conf.Dbpool.Exec(ctx, `
+	status, err := infohashStatus(ctx, conf, announce.Info_hash, cacheOnly)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case InfohashRetired:
+		return ErrInfoHashRetired
+	case InfohashNotAllowed:
+		return ErrInfoHashNotAllowed
+	}
+
+	if err = redirectMerged(ctx, conf, announce, cacheOnly); err != nil {
+		return err
+	}
+	return checkACL(ctx, conf, announce, cacheOnly)
+}
+
+// Statuses of an infohash, as cached in Redis under "info_hash:" followed by
+// the infohash, see SetInfohashStatus.
+const (
+	InfohashAllowed    = "true"
+	InfohashNotAllowed = "false"
+	InfohashRetired    = "retired"
+)
+
+// RetiredFailure is the failure reason sent to announces for a retired
+// infohash.
+const RetiredFailure = "this torrent has been retired"
+
+// infohashStatus returns the status of an infohash, from the cache if
+// possible. If the allowlist is disabled, an infohash which is not yet
+// tracked is added, even if it was cached as not allowed before the
+// allowlist was disabled. If cacheOnly is set, ErrNotCached is returned
+// rather than querying or adding to Postgres.
+func infohashStatus(ctx context.Context, conf config.Config, info_hash []byte, cacheOnly bool) (string, error) {
+	disableAllowlist := conf.Settings().DisableAllowlist
+	status, err := conf.Rdb.Get(ctx, "info_hash:"+string(info_hash)).Result()
+	if err == nil && !(disableAllowlist && status == InfohashNotAllowed) {
+		return status, nil
+	}
+	if cacheOnly {
+		return "", notCached("info_hash", err)
+	}
+	if err != nil && err != redis.Nil {
+		// An issue with the cache must be logged but is not fatal.
+		log.Printf("Error fetching info_hash from cache: %v", err)
+	}
+
+	if disableAllowlist {
+		_, err = conf.Dbpool.Exec(ctx, `
 			INSERT INTO infohashes (info_hash, name)
 			    VALUES ($1, $2)
 			ON CONFLICT (info_hash)
 			    DO NOTHING
 			`,
-				announce.Info_hash, "client added")
-			if err != nil {
-				fmt.Println(err)
-				return fmt.Errorf("error inserting announce_key: %w", err)
-			}
+			info_hash, "client added")
+		if err != nil {
+			return "", fmt.Errorf("error inserting info_hash: %w", err)
 		}
-		return nil
 	}
 
-	allowed := true
-	allowed_cache, err := conf.Rdb.Get(ctx, "info_hash:"+string(announce.Info_hash)).Result()
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    CASE WHEN retired_time IS NULL THEN $2 ELSE $3 END
+		FROM
+		    infohashes
+		WHERE
+		    info_hash = $1
+		`,
+		info_hash, InfohashAllowed, InfohashRetired).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		status = InfohashNotAllowed
+	} else if err != nil {
+		return "", fmt.Errorf("error checking infohashes for info_hash: %w", err)
+	}
+
+	if err = SetInfohashStatus(ctx, conf, info_hash, status); err != nil {
+		// An issue with the cache must be logged but is not fatal.
+		log.Print(err)
+	}
+	return status, nil
+}
+
+// SetInfohashStatus caches the status of an infohash, which must be one of
+// InfohashAllowed, InfohashNotAllowed, or InfohashRetired.
+func SetInfohashStatus(ctx context.Context, conf config.Config, info_hash []byte, status string) error {
+	err := conf.Rdb.Set(ctx, "info_hash:"+string(info_hash), status, 0).Err()
+	if err != nil {
+		return fmt.Errorf("error setting info_hash in cache: %w", err)
+	}
+	return nil
+}
+
+// MergedWarning is the warning sent with replies to announces for an
+// infohash which has been merged into another.
+const MergedWarning = "this torrent has been replaced by %x, please switch to the new torrent"
+
+// redirectMerged rewrites an announce for an infohash which has been merged
+// into a canonical one, so that it is recorded in the canonical swarm and
+// the client is warned. The canonical infohash, or an empty string if there
+// is none, is cached in Redis as a persistent key. If cacheOnly is set,
+// ErrNotCached is returned on a cache miss.
+func redirectMerged(ctx context.Context, conf config.Config, announce *config.Announce, cacheOnly bool) error {
+	canonical, err := conf.Rdb.Get(ctx, "merged:"+string(announce.Info_hash)).Result()
+	if err != nil && cacheOnly {
+		return notCached("merged infohash", err)
+	}
 	if err != nil {
 		if err != redis.Nil {
 			// An issue with the cache must be logged but is not fatal.
-			log.Printf("Error fetching info_hash keys from cache: %v", err)
+			log.Printf("Error fetching merged infohash from cache: %v", err)
 		}
+		var canonicalBytes []byte
 		err = conf.Dbpool.QueryRow(ctx, `
-			SELECT EXISTS (SELECT FROM infohashes WHERE info_hash = $1);
+			SELECT
+			    canonical.info_hash
+			FROM
+			    infohashes
+			    JOIN infohashes canonical ON infohashes.merged_into = canonical.id
+			WHERE
+			    infohashes.info_hash = $1
 			`,
-			announce.Info_hash).Scan(&allowed)
-		if err != nil {
-			return fmt.Errorf("error checking infohashes for info_hash: %w", err)
+			announce.Info_hash).Scan(&canonicalBytes)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("error checking infohashes for merge: %w", err)
 		}
-		if allowed {
-			allowed_cache = "true"
-		} else {
-			allowed_cache = "false"
-		}
-		err = conf.Rdb.Set(ctx, "info_hash:"+string(announce.Info_hash), allowed_cache, 0).Err()
+		canonical = string(canonicalBytes)
+		err = conf.Rdb.Set(ctx, "merged:"+string(announce.Info_hash), canonical, 0).Err()
 		if err != nil {
 			// An issue with the cache must be logged but is not fatal.
-			log.Printf("Error setting info_hash keys in cache: %v", err)
-		}
-	} else {
-		if allowed_cache == "false" {
-			allowed = false
+			log.Printf("Error setting merged infohash in cache: %v", err)
 		}
 	}
-	if !allowed {
-		return ErrInfoHashNotAllowed
+
+	if canonical != "" {
+		announce.Info_hash = []byte(canonical)
+		addWarning(announce, locale.Sprintf(announce.Language, MergedWarning, canonical))
 	}
 
 	return nil
 }
 
+// addWarning adds a warning to those sent with the reply to an announce.
+func addWarning(announce *config.Announce, warning string) {
+	if announce.Warning != "" {
+		warning = announce.Warning + "; " + warning
+	}
+	announce.Warning = warning
+}
+
 // writeAnnounce updates the peers table with an announce.
 func writeAnnounce(ctx context.Context, conf config.Config, announce *config.Announce) error {
-	// Calculate most recent upload change.
+	var client_key []byte
+	if announce.Key != "" {
+		client_key = hashAtRest(conf, []byte(announce.Key))
+	}
+	ipv6 := isIPv6(announce.Ip_port)
+
+	// Calculate most recent upload change. The previous announce is the
+	// one with the same peer_id, or, failing that, the same key in the
+	// same address family, so that a client which changes peer_id when it
+	// changes networks is not counted twice.
 	var last_uploaded int
 	var last_downloaded int
+	var previous_id int
+	var previous_peer_id []byte
+	var previous_ip_port []byte
+	var previous_ipv6 bool
 	err := conf.Dbpool.QueryRow(ctx, `
 		SELECT
-		    announces.uploaded, announces.downloaded
+		    announces.uploaded, announces.downloaded, announces.id, peer_id, ip_port, ipv6
 		FROM
 		    announces
 		    LEFT JOIN infohashes ON announces.info_hash_id = infohashes.id
@@ -260,11 +569,18 @@ func writeAnnounce(ctx context.Context, conf config.Config, announce *config.Ann
 		    info_hash = $1
 		    AND announce_key = $2
 		    AND event <> $3
+		    AND (peer_id = $4
+			OR (client_key = $5
+			    AND ipv6 = $6))
 		ORDER BY
+		    peer_id = $4
+		    AND ipv6 = $6 DESC,
+		    peer_id = $4 DESC,
 		    last_announce DESC
 		LIMIT 1
 		`,
-		announce.Info_hash, announce.Announce_key, config.Stopped).Scan(&last_uploaded, &last_downloaded)
+		announce.Info_hash, announce.Announce_key, config.Stopped, announce.Peer_id, client_key, ipv6).Scan(
+		&last_uploaded, &last_downloaded, &previous_id, &previous_peer_id, &previous_ip_port, &previous_ipv6)
 	if err != nil {
 		if !errors.Is(err, pgx.ErrNoRows) {
 			return fmt.Errorf("error fetching recent announces: %w", err)
@@ -273,6 +589,35 @@ func writeAnnounce(ctx context.Context, conf config.Config, announce *config.Ann
 		last_uploaded = 0
 		last_downloaded = 0
 	}
+
+	// A client matched by its key under a new peer_id takes over its
+	// previous row, unless it has a row of its own, which the upsert
+	// below then updates.
+	roamed := err == nil && previous_ipv6 == ipv6
+	if roamed && !bytes.Equal(previous_peer_id, announce.Peer_id) {
+		_, err = conf.Dbpool.Exec(ctx, `
+			UPDATE
+			    announces
+			SET
+			    peer_id = $2
+			WHERE
+			    id = $1
+			    AND NOT EXISTS (
+				SELECT
+				FROM
+				    announces other
+				WHERE
+				    other.peers_id = announces.peers_id
+				    AND other.info_hash_id = announces.info_hash_id
+				    AND other.peer_id = $2
+				    AND other.ipv6 = announces.ipv6)
+			`,
+			previous_id, announce.Peer_id)
+		if err != nil {
+			return fmt.Errorf("error updating peer_id of roaming peer: %w", err)
+		}
+	}
+
 	upload_change := announce.Uploaded - last_uploaded
 	download_change := announce.Downloaded - last_downloaded
 
@@ -284,6 +629,8 @@ func writeAnnounce(ctx context.Context, conf config.Config, announce *config.Ann
 	if download_change < 0 {
 		download_change = 0
 	}
+	upload_change, download_change = applyPromotions(ctx, conf, announce, upload_change, download_change)
+	download_change = applyTierDownload(ctx, conf, announce, download_change)
 
 	completed_snatch := 0
 	if announce.Event == config.Completed {
@@ -309,25 +656,85 @@ func writeAnnounce(ctx context.Context, conf config.Config, announce *config.Ann
 		return fmt.Errorf("error updating peers table: %w", err)
 	}
 
-	// Update infohashes table on completed event.
+	// Add the same changes to the traffic of the key in this hour, so that
+	// its totals can be charted over time.
+	if upload_change > 0 || download_change > 0 {
+		_, err = conf.Dbpool.Exec(ctx, `
+			INSERT INTO user_traffic (peers_id, hour, uploaded, downloaded)
+			SELECT
+			    id,
+			    $2,
+			    $3,
+			    $4
+			FROM
+			    peers
+			WHERE
+			    announce_key = $1
+			ON CONFLICT (peers_id,
+			    hour)
+			    DO UPDATE SET
+				uploaded = user_traffic.uploaded + EXCLUDED.uploaded,
+				downloaded = user_traffic.downloaded + EXCLUDED.downloaded
+			`,
+			announce.Announce_key, conf.Now().Truncate(time.Hour), upload_change, download_change)
+		if err != nil {
+			return fmt.Errorf("error updating user traffic: %w", err)
+		}
+	}
+
+	// Update infohashes table on completed event, remembering the first
+	// announce key to complete it.
 	if announce.Event == config.Completed {
 		_, err = conf.Dbpool.Exec(ctx, `
 			UPDATE
 			    infohashes
 			SET
-			    downloaded = downloaded + 1
+			    downloaded = downloaded + 1,
+			    first_snatcher = COALESCE(first_snatcher, (
+				    SELECT
+					id
+				    FROM
+					peers
+				    WHERE
+					announce_key = $2))
 			WHERE
 			    info_hash = $1
 			`,
-			announce.Info_hash)
+			announce.Info_hash, announce.Announce_key)
 		if err != nil {
 			return fmt.Errorf("error updating infohashes on downloaded event: %w", err)
 		}
+
+		_, err = conf.Dbpool.Exec(ctx, `
+			INSERT INTO snatches (peers_id, info_hash_id, snatch_time)
+			SELECT
+			    peers.id,
+			    infohashes.id,
+			    $3
+			FROM
+			    infohashes
+			    JOIN peers ON peers.announce_key = $2
+			WHERE
+			    infohashes.info_hash = $1
+			`,
+			announce.Info_hash, announce.Announce_key, conf.Now())
+		if err != nil {
+			return fmt.Errorf("error recording snatch: %w", err)
+		}
 	}
 
-	// Update announces table
-	_, err = conf.Dbpool.Exec(ctx, `
-		INSERT INTO announces (peers_id, info_hash_id, ip_port, amount_left, uploaded, downloaded, event)
+	ip_port, err := storeIpPort(ctx, conf, announce.Ip_port)
+	if err != nil {
+		return err
+	}
+
+	// Update announces table. A seeder keeps its seeding_since while it
+	// stays active, and starts again from this announce after stopping or
+	// going stale. Whether a seedbox agent has recently reported the peer
+	// as not connectable decides whether it is kept in the swarm cache.
+	var unconnectable bool
+	err = conf.Dbpool.QueryRow(ctx, `
+		INSERT INTO announces (peers_id, info_hash_id, ip_port, amount_left, uploaded, downloaded, event, country, asn, asn_org, last_announce, peer_id, ipv6, params, webrtc, seeding_since, client_key)
 		SELECT
 		    peers.id,
 		    infohashes.id,
@@ -335,84 +742,420 @@ func writeAnnounce(ctx context.Context, conf config.Config, announce *config.Ann
 		    $4,
 		    $5,
 		    $6,
-		    $7
+		    $7,
+		    NULLIF($8, ''),
+		    NULLIF($9, 0),
+		    NULLIF($10, ''),
+		    $11,
+		    $12,
+		    $13,
+		    $14,
+		    $15,
+		    CASE WHEN $4 = 0 THEN
+			$11::timestamptz
+		    END,
+		    $18
 		FROM
 		    infohashes
 		    JOIN peers ON peers.announce_key = $1
 		WHERE
 		    infohashes.info_hash = $2
 		ON CONFLICT (peers_id,
-		    info_hash_id)
+		    info_hash_id,
+		    peer_id,
+		    ipv6)
 		    DO UPDATE SET
 			ip_port = $3,
 			amount_left = $4,
 			uploaded = $5,
 			downloaded = $6,
-			event = $7
+			event = $7,
+			country = NULLIF($8, ''),
+			asn = NULLIF($9, 0),
+			asn_org = NULLIF($10, ''),
+			last_announce = $11,
+			params = $14,
+			webrtc = $15,
+			client_key = COALESCE($18, announces.client_key),
+			expired = FALSE,
+			seeding_since = CASE WHEN $4 <> 0 THEN
+			    NULL
+			WHEN announces.seeding_since IS NOT NULL
+			    AND NOT announces.expired
+			    AND announces.last_announce >= $16
+			    AND announces.event <> $17 THEN
+			    announces.seeding_since
+			ELSE
+			    $11
+			END
+		RETURNING
+		    COALESCE(announces.connectable IS FALSE
+			AND announces.health_time > $16, FALSE)
 		`,
-		announce.Announce_key, announce.Info_hash, announce.Ip_port, announce.Amount_left, announce.Uploaded, announce.Downloaded, announce.Event)
-	if err != nil {
+		announce.Announce_key, announce.Info_hash, ip_port, announce.Amount_left, announce.Uploaded, announce.Downloaded, announce.Event,
+		announce.Country, announce.Asn, announce.Asn_org, conf.Now(), announce.Peer_id, ipv6, paramsAtRest(conf, announce.Params), announce.Webrtc,
+		conf.StaleCutoff(), config.Stopped, client_key).Scan(&unconnectable)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
 		return fmt.Errorf("error upserting peer row: %w", err)
 	}
 
+	// A peer which has moved is dropped from the swarm cache at its
+	// previous address, rather than given out until it goes stale.
+	if roamed && (!bytes.Equal(previous_peer_id, announce.Peer_id) || !bytes.Equal(previous_ip_port, ip_port)) {
+		err = DropCachedPeer(ctx, conf, announce.Info_hash, announce.Announce_key, previous_peer_id, previous_ip_port)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A client which has moved to a new IP, rather than only a new port, is
+	// recorded as an IP change. Its session totals carry over above.
+	if roamed && !bytes.Equal(previous_ip_port, ip_port) {
+		err = recordIPChange(ctx, conf, announce, previous_ip_port, !bytes.Equal(previous_peer_id, announce.Peer_id))
+		if err != nil {
+			return err
+		}
+	}
+
+	publishAnnounce(conf, announce)
+
+	return cacheSwarm(ctx, conf, announce, ip_port, !announce.Webrtc && !unconnectable)
+}
+
+// publishAnnounce publishes a recorded announce on the event bus, followed by
+// a snatch if it completed.
+func publishAnnounce(conf config.Config, announce *config.Announce) {
+	e := events.Event{
+		Kind:         events.AnnounceAccepted,
+		Announce_key: announce.Announce_key,
+		Info_hash:    announce.Info_hash,
+		Client:       announce.Client,
+		Uploaded:     announce.Uploaded,
+		Downloaded:   announce.Downloaded,
+		Left:         announce.Amount_left,
+	}
+	conf.Publish(e)
+	if announce.Event == config.Completed {
+		e.Kind = events.SnatchCompleted
+		conf.Publish(e)
+	}
+}
+
+// recordIPChange records in the ip_changes table that a client has moved
+// from the stored previous_ip_port to the IP of the announce, and publishes
+// it on the event bus. The client was matched by its BEP 7 key if byKey,
+// and otherwise by its peer_id. Changes of port alone are ignored. In
+// privacy mode, the previous IP is unknown once it has expired from Redis.
+func recordIPChange(ctx context.Context, conf config.Config, announce *config.Announce, previous_ip_port []byte, byKey bool) error {
+	ip := announce.Ip_port[:len(announce.Ip_port)-2]
+
+	previous, err := resolveIpPort(ctx, conf, previous_ip_port)
+	if err != nil {
+		return err
+	}
+	var previous_ip []byte
+	if previous != nil {
+		if bytes.Equal(previous[:len(previous)-2], ip) {
+			return nil
+		}
+		previous_ip = hashAtRest(conf, previous[:len(previous)-2])
+	}
+
+	_, err = conf.Dbpool.Exec(ctx, `
+		INSERT INTO ip_changes (peers_id, info_hash_id, previous_ip, ip, by_key, change_time)
+		SELECT
+		    peers.id,
+		    infohashes.id,
+		    $3,
+		    $4,
+		    $5,
+		    $6
+		FROM
+		    infohashes
+		    JOIN peers ON peers.announce_key = $1
+		WHERE
+		    infohashes.info_hash = $2
+		`,
+		announce.Announce_key, announce.Info_hash, previous_ip, hashAtRest(conf, ip), byKey, conf.Now())
+	if err != nil {
+		return fmt.Errorf("error recording ip change: %w", err)
+	}
+
+	conf.Publish(events.Event{
+		Kind:         events.IPChanged,
+		Announce_key: announce.Announce_key,
+		Info_hash:    announce.Info_hash,
+		Client:       announce.Client,
+		Uploaded:     announce.Uploaded,
+		Downloaded:   announce.Downloaded,
+		Left:         announce.Amount_left,
+	})
+
+	return nil
+}
+
+// recordKeyActivity aggregates the announce into the key_activity table,
+// counting announces per announce key, day, IP, and client.
+func recordKeyActivity(ctx context.Context, conf config.Config, announce *config.Announce) error {
+	ip := hashAtRest(conf, announce.Ip_port[:len(announce.Ip_port)-2])
+
+	_, err := conf.Dbpool.Exec(ctx, `
+		INSERT INTO key_activity (peers_id, ip, client, day, last_announce)
+		SELECT
+		    id,
+		    $2,
+		    $3,
+		    $4::timestamptz::date,
+		    $4
+		FROM
+		    peers
+		WHERE
+		    announce_key = $1
+		ON CONFLICT (peers_id,
+		    day,
+		    ip,
+		    client)
+		    DO UPDATE SET
+			announces = key_activity.announces + 1,
+			last_announce = $4
+		`,
+		announce.Announce_key, ip, announce.Client, conf.Now())
+	if err != nil {
+		return fmt.Errorf("error recording key activity: %w", err)
+	}
+
+	return nil
+}
+
+// recordWantedInfohash counts an announce for an infohash rejected by the
+// allowlist in the wanted_infohashes table.
+func recordWantedInfohash(ctx context.Context, conf config.Config, info_hash []byte) error {
+	_, err := conf.Dbpool.Exec(ctx, `
+		INSERT INTO wanted_infohashes (info_hash, first_seen, last_seen)
+		    VALUES ($1, $2, $2)
+		ON CONFLICT (info_hash)
+		    DO UPDATE SET
+			requests = wanted_infohashes.requests + 1,
+			last_seen = $2
+		`,
+		info_hash, conf.Now())
+	if err != nil {
+		return fmt.Errorf("error recording wanted infohash: %w", err)
+	}
+
 	return nil
 }
 
 // sendReply writes a bencoded reply to the client consisting of an appropriate
 // peer list. Tracker error messages will generally be sent by the parent
-// PeerHandler due to earlier failures.
+// PeerHandler due to earlier failures. The candidate peers and the number to
+// give are found within latency budgets, see selectPeers.
 //
 // If a client requests fewer than the number of available peers, a
 // pseudorandom contiguous subset of the peers of the appropriate size will be
 // sent. Given different client announce intervals, this should provide enough
 // randomness, but it may be something revisit.
 //
-// PostgreSQL doesn't substitute inside of string literals, so to use a variable
-// for the interval, we need to use fmt.Sprintf in an intermediate step. See further:
-// https://github.com/jackc/pgx/issues/1043
+// Seeders often announce with numwant=0 only to report their statistics, so
+// peer selection is skipped entirely when the client wants no peers or the
+// algorithm gives it none, and only the intervals are sent.
+//
+// The interval depends on the swarm and the peer, see personalInterval.
+// Under load, fewer peers are given and the interval is lengthened, see
+// loadLimits.
 func sendReply(ctx context.Context, conf config.Config, w http.ResponseWriter, a *config.Announce) error {
-	query := fmt.Sprintf(`
-		SELECT DISTINCT ON (announce_key)
-		    ip_port
+	limits := loadLimits(conf)
+	reply := bencode.AnnounceResponse{TrackerID: conf.TrackerID}
+	counts, err := runStage(ctx, a.Decision, "counts", PostgresBudget, func(ctx context.Context) (*swarmCounts, error) {
+		return countSwarm(ctx, conf, a)
+	})
+	if err != nil {
+		log.Printf("Error counting swarm, replying without counts: %v", err)
+		counts = nil
+	} else {
+		reply.Counted = true
+		reply.Complete = counts.complete
+		reply.Incomplete = counts.incomplete
+	}
+
+	// The personalized interval is lengthened further under load.
+	interval, minInterval := personalInterval(conf, counts, a.Amount_left == 0)
+	reply.Interval = interval * limits.Interval / config.Interval
+	reply.MinInterval = minInterval
+
+	if a.Numwant == 0 {
+		return writePeers(w, a, reply, 0)
+	}
+	if checkRatio(ctx, conf, a) {
+		a.Decision.SetNumToGive(0)
+		return writePeers(w, a, reply, 0)
+	}
+
+	numToGive, err := runStage(ctx, a.Decision, "algorithm", PostgresBudget, func(ctx context.Context) (int, error) {
+		return conf.Settings().Algorithm(ctx, conf, a)
+	})
+	if err != nil {
+		log.Printf("Error calculating number of peers to give, giving at most %d: %v", FallbackPeers, err)
+		numToGive = min(a.Numwant, FallbackPeers)
+	}
+	numToGive = min(applyTierPeers(ctx, conf, a, numToGive), limits.Numwant)
+	a.Decision.SetNumToGive(numToGive)
+	if numToGive <= 0 {
+		return writePeers(w, a, reply, 0)
+	}
+
+	reply.Peers = selectPeers(ctx, conf, a)
+	markNearby(conf, a, reply.Peers, numToGive, conf.GeoIP.Lookup)
+	return writePeers(w, a, reply, numToGive)
+}
+
+// swarmCounts are the number of seeders and leechers in a swarm.
+type swarmCounts struct {
+	complete   int
+	incomplete int
+}
+
+// countSwarm returns the number of seeders and leechers in the swarm of an
+// announce, counted as in scrapes, including the client itself.
+func countSwarm(ctx context.Context, conf config.Config, a *config.Announce) (*swarmCounts, error) {
+	var counts swarmCounts
+	err := conf.Dbpool.QueryRow(ctx, `
+		WITH `+db.RecentAnnounces(1, 2, "amount_left")+`
+		SELECT
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left = 0),
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left > 0)
+		FROM
+		    recent_announces
+		    JOIN infohashes ON recent_announces.info_hash_id = infohashes.id
+		WHERE
+		    info_hash = $3
+		`,
+		config.Stopped, conf.StaleCutoff(), a.Info_hash).Scan(&counts.complete, &counts.incomplete)
+	if err != nil {
+		return nil, fmt.Errorf("error counting swarm: %w", err)
+	}
+	return &counts, nil
+}
+
+// storedPeers returns the candidate peers for an announce from Postgres.
+//
+// Staleness is decided by a cutoff computed from the configured Clock rather
+// than by NOW() in Postgres, so that skew between the two clocks cannot make
+// peers vanish.
+//
+// Browser peers which announced over WebSocket cannot be reached at their
+// ip_port, and are left out.
+//
+// Peers which a seedbox agent has reported as not connectable since the
+// stale cutoff are left out as well, see api.AgentReportHandler.
+//
+// Peers are told apart by announce key and peer_id, and only deduplicated by
+// ip_port, so that clients sharing a key or an IP behind a NAT are given to
+// each other. The client itself is excluded by its peer_id, or by its ip_port
+// if it has restarted with a new peer_id.
+func storedPeers(ctx context.Context, conf config.Config, a *config.Announce) ([]bencode.Peer, error) {
+	query := `
+		SELECT DISTINCT ON (ip_port)
+		    ip_port,
+		    peer_id,
+		    amount_left = 0 AS seeding
 		FROM
 		    announces
 		    JOIN peers ON announces.peers_id = peers.id
 		    JOIN infohashes ON announces.info_hash_id = infohashes.id
 		WHERE
 		    info_hash = $1
-		    AND announce_key <> $2
-		    AND last_announce >= NOW() - INTERVAL '%d seconds'
-		    AND event <> $3
+		    AND NOT (announce_key = $2
+			AND (peer_id = $5
+			    OR ip_port = $6))
+		    AND NOT announces.webrtc
+		    AND NOT (announces.connectable IS FALSE
+			AND announces.health_time > $4)
+		    AND ` + db.Active(3, 4) + `
 		ORDER BY
-		    announce_key,
+		    ip_port,
 		    last_announce DESC
-		`,
-		config.StaleInterval)
-	rows, err := conf.Dbpool.Query(ctx, query, a.Info_hash, a.Announce_key, config.Stopped)
+		`
+	rows, err := conf.Dbpool.Query(ctx, query, a.Info_hash, a.Announce_key, config.Stopped, conf.StaleCutoff(), a.Peer_id, hashAtRest(conf, a.Ip_port))
 	if err != nil {
-		return fmt.Errorf("error selecting peer rows: %w", err)
+		return nil, fmt.Errorf("error selecting peer rows: %w", err)
 	}
 	defer rows.Close()
 
-	peers, err := pgx.CollectRows(rows, pgx.RowTo[[]byte])
+	peers, err := pgx.CollectRows(rows, pgx.RowToStructByName[bencode.Peer])
 	if err != nil {
-		return fmt.Errorf("error collecting rows: %w", err)
+		return nil, fmt.Errorf("error collecting rows: %w", err)
 	}
 
-	numToGive, err := conf.Algorithm(ctx, conf, a)
-	if err != nil {
-		return fmt.Errorf("error calculating number of peers to give: %w", err)
+	return resolveIpPorts(ctx, conf, peers)
+}
+
+// SeederShare is the share of seeders among the peers given to a leecher,
+// when the swarm has enough of both.
+const SeederShare = 0.5
+
+// choosePeers returns at most numToGive of peers, in a pseudo-random order.
+// If there are more, seeders are given leechers first, since other seeders
+// have nothing to trade with them, and leechers are given SeederShare
+// seeders and otherwise leechers, so that they both download from seeders
+// and trade pieces among themselves. A shortage of either kind is made up
+// with the other. Within each kind, Nearby peers are chosen first, see
+// markNearby.
+func choosePeers(peers []bencode.Peer, numToGive int, seeding bool) []bencode.Peer {
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) <= numToGive {
+		return peers
 	}
 
-	// Give a pseudo-random subset of peers.
-	if len(peers) > numToGive {
-		rand.Shuffle(len(peers), func(i, j int) {
-			peers[i], peers[j] = peers[j], peers[i]
-		})
-		peers = peers[:numToGive]
+	slices.SortStableFunc(peers, func(a, b bencode.Peer) int {
+		switch {
+		case a.Nearby == b.Nearby:
+			return 0
+		case a.Nearby:
+			return -1
+		}
+		return 1
+	})
+
+	var seeders, leechers []bencode.Peer
+	for _, peer := range peers {
+		if peer.Seeding {
+			seeders = append(seeders, peer)
+		} else {
+			leechers = append(leechers, peer)
+		}
+	}
+
+	numSeeders := 0
+	if !seeding {
+		numSeeders = min(int(float64(numToGive)*SeederShare+0.5), len(seeders))
 	}
+	numLeechers := min(numToGive-numSeeders, len(leechers))
+	numSeeders = min(numToGive-numLeechers, len(seeders))
+
+	chosen := append(seeders[:numSeeders], leechers[:numLeechers]...)
+	rand.Shuffle(len(chosen), func(i, j int) {
+		chosen[i], chosen[j] = chosen[j], chosen[i]
+	})
+	return chosen
+}
 
-	_, err = w.Write(bencode.PeerList(peers))
+// writePeers writes a reply with at most numToGive of its peers, see
+// choosePeers. The compact format is used unless the client asked for
+// dictionaries, see bencode.AnnounceResponse, and any warning for the
+// announce is included.
+func writePeers(w http.ResponseWriter, a *config.Announce, reply bencode.AnnounceResponse, numToGive int) error {
+	peers := choosePeers(reply.Peers, numToGive, a.Amount_left == 0)
+	a.Decision.SetGiven(len(peers))
+
+	reply.Peers = peers
+	reply.Compact = a.Compact
+	reply.NoPeerID = a.No_peer_id
+	reply.Warning = a.Warning
+
+	_, err := w.Write(reply.Encode())
 	if err != nil {
 		return fmt.Errorf("error replying to peer: %w", err)
 	}
@@ -421,50 +1164,204 @@ func sendReply(ctx context.Context, conf config.Config, w http.ResponseWriter, a
 
 // writeTrackerError is a helper function which writes a tracker error message
 // to a peer. If there is a failure on right, we log an error.
-func writeTrackerError(msg string, w http.ResponseWriter) {
-	_, err := w.Write(bencode.FailureReason(msg))
+func writeTrackerError(lang string, msg string, w http.ResponseWriter) {
+	_, err := w.Write(bencode.FailureReason(locale.Sprintf(lang, msg)))
 	if err != nil {
 		log.Printf("Error responding to peer: %v", err)
 	}
 }
 
+// cacheFailure marks an announce failure as cacheable for
+// conf.FailureCacheTTL, so that a CDN in front of the tracker can absorb
+// repeated announces which are bound to fail, such as from clients with a
+// deleted announce key. It must only be used for failures which depend on
+// nothing but the announce URL and the language, and which will not change
+// soon: since the body is cached, no side effects of the announce, such as
+// counting wanted infohashes, happen on a cache hit.
+func cacheFailure(conf config.Config, w http.ResponseWriter) {
+	if conf.FailureCacheTTL <= 0 {
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(conf.FailureCacheTTL.Seconds())))
+	w.Header().Add("Vary", "Accept-Language")
+}
+
 // PeerHandler encapsulates the handling of each peer request. The first step
 // is to update the peers table with the information in the announce. The
-// second step is to send a bencoded reply.
+// second step is to send a bencoded reply. Replies are personal to the peer
+// and must not be cached, with the exception of failures for unknown announce
+// keys and infohashes which are not allowed, see cacheFailure.
 func PeerHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		announce, err := parseAnnounce(r)
+		w.Header().Set("Cache-Control", "no-store")
+
+		decision := conf.Recent.Start(conf.Now())
+		defer conf.Recent.Record(decision)
+		load.recordAnnounce(conf.Now())
+
+		lang := locale.Negotiate(r.Header.Get("Accept-Language"), conf.Language)
+		if writeMaintenance(ctx, conf, w, lang) {
+			decision.SetOutcome(debuglog.OutcomeMaintenance, nil)
+			return
+		}
+
+		announce, err := parseAnnounce(conf, r)
 		if err != nil {
 			log.Printf("Error parsing announce: %v", err)
-			_, err = w.Write(bencode.FailureReason("error parsing announce"))
-			if err != nil {
-				log.Printf("Error responding to peer: %v", err)
-			}
+			decision.SetOutcome(debuglog.OutcomeParseError, err)
+			writeTrackerError(lang, "error parsing announce", w)
 			return
 		}
+		announce.Language = lang
+		announce.Decision = decision
+		decision.SetAnnounce(announce.Info_hash, announce.Client, eventNames[announce.Event], announce.Amount_left == 0, announce.Numwant)
+
+		loc := conf.GeoIP.Lookup(net.IP(announce.Ip_port[:len(announce.Ip_port)-2]))
+		announce.Country = loc.Country
+		announce.Asn = loc.Asn
+		announce.Asn_org = loc.Asn_org
 
-		err = checkAnnounce(ctx, conf, announce)
+		readOnly, err := ReadOnly(ctx, conf)
 		if err != nil {
+			log.Print(err)
+		}
+
+		err = checkAnnounce(ctx, conf, announce, readOnly)
+		if err != nil {
+			decision.SetOutcome(debuglog.OutcomeRejected, err)
 			msg := DefaultTrackerError
 			if errors.Is(err, ErrInfoHashNotAllowed) {
 				msg = "info_hash not in the allowed list"
+				cacheFailure(conf, w)
+				if !readOnly {
+					if err := recordWantedInfohash(ctx, conf, announce.Info_hash); err != nil {
+						log.Print(err)
+					}
+				}
+			} else if errors.Is(err, ErrInfoHashRetired) {
+				msg = RetiredFailure
 			} else if errors.Is(err, ErrUntrackedAnnounce) {
 				msg = "untracked announce key, generate new announce url"
+				cacheFailure(conf, w)
+			} else if errors.Is(err, ErrKeyExpired) {
+				msg = "announce key expired, generate new announce url"
+				cacheFailure(conf, w)
+			} else if errors.Is(err, ErrUnverifiedKey) {
+				msg = UnverifiedFailure
+			} else if errors.Is(err, ErrBanned) {
+				msg = "banned"
+			} else if errors.Is(err, ErrRestricted) {
+				msg = "access to this torrent is restricted"
+			} else if errors.Is(err, ErrNotCached) {
+				msg = ReadOnlyFailure
+			}
+			writeTrackerError(lang, msg, w)
+			return
+		}
+
+		if readOnly {
+			err = serveReadOnly(ctx, conf, w, announce)
+			if err != nil {
+				log.Printf("Error serving read-only announce: %v", err)
 			}
-			writeTrackerError(msg, w)
+			decision.SetOutcome(debuglog.OutcomeReadOnly, err)
 			return
 		}
 
 		err = sendReply(ctx, conf, w, announce)
 		if err != nil {
 			log.Printf("Error responding to peer: %v", err)
+			decision.SetOutcome(debuglog.OutcomeError, err)
 		}
 
 		err = writeAnnounce(ctx, conf, announce)
 		if err != nil {
-			writeTrackerError(DefaultTrackerError, w)
+			decision.SetOutcome(debuglog.OutcomeError, err)
+			writeTrackerError(lang, DefaultTrackerError, w)
 			return
 
 		}
+
+		// Key activity is only used for analytics, so failures are logged
+		// but not reported to the peer.
+		err = recordKeyActivity(ctx, conf, announce)
+		if err != nil {
+			log.Printf("Error recording key activity: %v", err)
+		}
+	}
+}
+
+// RecordAnnounce checks and records an announce received by another
+// transport than HTTP, such as WebSocket, as PeerHandler does. The
+// announce must have its Announce_key, Peer_id, Info_hash, and Ip_port set;
+// the client and location are filled in. It returns ErrUntrackedAnnounce,
+// ErrKeyExpired, ErrUnverifiedKey, ErrInfoHashNotAllowed,
+// ErrInfoHashRetired, or ErrRestricted if the announce is rejected.
+// While the tracker is read-only, the announce is checked against the cache
+// only, and may also be rejected with ErrNotCached, but is not recorded.
+func RecordAnnounce(ctx context.Context, conf config.Config, announce *config.Announce) error {
+	announce.Client = clientFromPeerID(string(announce.Peer_id))
+
+	loc := conf.GeoIP.Lookup(net.IP(announce.Ip_port[:len(announce.Ip_port)-2]))
+	announce.Country = loc.Country
+	announce.Asn = loc.Asn
+	announce.Asn_org = loc.Asn_org
+
+	readOnly, err := ReadOnly(ctx, conf)
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = checkAnnounce(ctx, conf, announce, readOnly)
+	if err != nil {
+		if errors.Is(err, ErrInfoHashNotAllowed) && !readOnly {
+			if err := recordWantedInfohash(ctx, conf, announce.Info_hash); err != nil {
+				log.Print(err)
+			}
+		}
+		return err
 	}
+
+	if readOnly {
+		return nil
+	}
+
+	err = writeAnnounce(ctx, conf, announce)
+	if err != nil {
+		return err
+	}
+
+	// As in PeerHandler, key activity failures are only logged.
+	err = recordKeyActivity(ctx, conf, announce)
+	if err != nil {
+		log.Printf("Error recording key activity: %v", err)
+	}
+
+	return nil
+}
+
+// CacheSizes returns the number of entries in each in-process cache kept
+// for conf, for diagnostics. Caches which have not been loaded are empty.
+func CacheSizes(conf config.Config) map[string]int {
+	sizes := map[string]int{"bans": 0, "promotions": 0, "tiers": 0}
+
+	loadedBans.mu.Lock()
+	if set, ok := loadedBans.sets[conf.Rdb]; ok {
+		sizes["bans"] = set.size()
+	}
+	loadedBans.mu.Unlock()
+
+	loadedPromotions.mu.Lock()
+	if set, ok := loadedPromotions.sets[conf.Rdb]; ok {
+		sizes["promotions"] = set.size()
+	}
+	loadedPromotions.mu.Unlock()
+
+	loadedTiers.mu.Lock()
+	if set, ok := loadedTiers.sets[conf.Rdb]; ok {
+		sizes["tiers"] = len(set.keys)
+	}
+	loadedTiers.mu.Unlock()
+
+	return sizes
 }
@@ -0,0 +1,245 @@
+// Access control lists restrict infohashes, such as staff-only or
+// donor-only content, to the announce keys and user groups listed for them.
+// An infohash without an ACL is open to every tracked key. The same check
+// applies to torrent file downloads and scrapes, and restricted infohashes
+// are left out of public listings. As with bans,
+// ACLs are stored in Postgres, and each tracker instance keeps a compiled
+// copy, which it reloads whenever the version counter in Redis is bumped by
+// a change to the ACLs or to group membership. Unlike bans, ACLs fail
+// closed: if they cannot be reloaded, the last copy loaded is used, and
+// without one announces fail.
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// Kinds of ACL entry.
+const (
+	ACLKey   = "key"
+	ACLGroup = "group"
+)
+
+// MaxACLLength bounds the value of an ACL entry.
+const MaxACLLength = 64
+
+var (
+	ErrRestricted = errors.New("info_hash restricted")
+	ErrInvalidACL = errors.New("invalid acl entry")
+)
+
+// ValidateACL checks the value of an ACL entry of the given kind.
+func ValidateACL(kind, value string) error {
+	if value == "" || len(value) > MaxACLLength {
+		return fmt.Errorf("%w: %s %q", ErrInvalidACL, kind, value)
+	}
+	if kind != ACLKey && kind != ACLGroup {
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidACL, kind)
+	}
+	return nil
+}
+
+// acl is the compiled ACL of one infohash.
+type acl struct {
+	keys   map[string]bool
+	groups []string
+}
+
+// aclSet is the compiled form of the ACLs at one version. The groups of
+// each announce key which has announced a restricted infohash are looked up
+// once per version, since group membership only changes with the version.
+type aclSet struct {
+	version string
+	acls    map[string]*acl
+
+	mu     sync.Mutex
+	groups map[string][]string
+}
+
+// keyGroups returns the groups of the user who owns announce_key. If
+// cacheOnly is set, ErrNotCached is returned if they have not been looked up
+// yet.
+func (s *aclSet) keyGroups(ctx context.Context, conf config.Config, announce_key string, cacheOnly bool) ([]string, error) {
+	s.mu.Lock()
+	groups, ok := s.groups[announce_key]
+	s.mu.Unlock()
+	if ok {
+		return groups, nil
+	}
+	if cacheOnly {
+		return nil, fmt.Errorf("%w: groups of announce key", ErrNotCached)
+	}
+
+	rows, err := conf.Dbpool.Query(ctx, `
+		SELECT
+		    group_name
+		FROM
+		    user_groups
+		    JOIN peers ON peers.users_id = user_groups.users_id
+		WHERE
+		    announce_key = $1
+		`,
+		announce_key)
+	if err != nil {
+		return nil, fmt.Errorf("error loading groups: %w", err)
+	}
+	defer rows.Close()
+
+	groups = []string{}
+	for rows.Next() {
+		var group string
+		if err = rows.Scan(&group); err != nil {
+			return nil, fmt.Errorf("error loading groups: %w", err)
+		}
+		groups = append(groups, group)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error loading groups: %w", err)
+	}
+
+	s.mu.Lock()
+	s.groups[announce_key] = groups
+	s.mu.Unlock()
+
+	return groups, nil
+}
+
+// loadedACLs holds the compiled ACLs per Redis client, so that configs
+// sharing a process, as in tests, do not share ACLs.
+var loadedACLs = struct {
+	mu   sync.Mutex
+	sets map[*redis.Client]*aclSet
+}{sets: make(map[*redis.Client]*aclSet)}
+
+// currentACLs returns the compiled ACLs, reloading them from Postgres if
+// they have changed since they were last loaded. If cacheOnly is set, the
+// ACLs last loaded are returned as they are, or ErrNotCached if there are
+// none.
+func currentACLs(ctx context.Context, conf config.Config, cacheOnly bool) (*aclSet, error) {
+	if cacheOnly {
+		loadedACLs.mu.Lock()
+		set := loadedACLs.sets[conf.Rdb]
+		loadedACLs.mu.Unlock()
+		if set == nil {
+			return nil, fmt.Errorf("%w: acls not loaded", ErrNotCached)
+		}
+		return set, nil
+	}
+
+	version, err := conf.Rdb.Get(ctx, "acls:version").Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("error fetching acls version: %w", err)
+	}
+
+	loadedACLs.mu.Lock()
+	set, ok := loadedACLs.sets[conf.Rdb]
+	loadedACLs.mu.Unlock()
+	if ok && set.version == version {
+		return set, nil
+	}
+
+	rows, err := conf.Dbpool.Query(ctx, `
+		SELECT
+		    info_hash,
+		    kind,
+		    value
+		FROM
+		    infohash_acls
+		    JOIN infohashes ON infohash_acls.info_hash_id = infohashes.id
+		`)
+	if err != nil {
+		return nil, fmt.Errorf("error loading acls: %w", err)
+	}
+	defer rows.Close()
+
+	set = &aclSet{version: version, acls: make(map[string]*acl), groups: make(map[string][]string)}
+	for rows.Next() {
+		var info_hash []byte
+		var kind, value string
+		if err = rows.Scan(&info_hash, &kind, &value); err != nil {
+			return nil, fmt.Errorf("error loading acls: %w", err)
+		}
+		a, ok := set.acls[string(info_hash)]
+		if !ok {
+			a = &acl{keys: make(map[string]bool)}
+			set.acls[string(info_hash)] = a
+		}
+		switch kind {
+		case ACLKey:
+			a.keys[value] = true
+		case ACLGroup:
+			a.groups = append(a.groups, value)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error loading acls: %w", err)
+	}
+
+	loadedACLs.mu.Lock()
+	loadedACLs.sets[conf.Rdb] = set
+	loadedACLs.mu.Unlock()
+
+	return set, nil
+}
+
+// checkACL returns ErrRestricted if the infohash of the announce has an ACL
+// which lists neither its announce key nor a group of the key's owner. If
+// cacheOnly is set, nothing is loaded from Postgres, see currentACLs.
+func checkACL(ctx context.Context, conf config.Config, announce *config.Announce, cacheOnly bool) error {
+	return aclAllows(ctx, conf, announce.Announce_key, announce.Info_hash, cacheOnly)
+}
+
+// CheckACL is checkACL for uses of an infohash other than announces, such as
+// downloading its torrent file or scraping it.
+func CheckACL(ctx context.Context, conf config.Config, announce_key string, info_hash []byte) error {
+	return aclAllows(ctx, conf, announce_key, info_hash, false)
+}
+
+// aclAllows implements checkACL and CheckACL.
+func aclAllows(ctx context.Context, conf config.Config, announce_key string, info_hash []byte, cacheOnly bool) error {
+	set, err := currentACLs(ctx, conf, cacheOnly)
+	if err != nil {
+		loadedACLs.mu.Lock()
+		set = loadedACLs.sets[conf.Rdb]
+		loadedACLs.mu.Unlock()
+		if set == nil {
+			return err
+		}
+		log.Print(err)
+	}
+
+	a, ok := set.acls[string(info_hash)]
+	if !ok || a.keys[announce_key] {
+		return nil
+	}
+	if len(a.groups) > 0 {
+		groups, err := set.keyGroups(ctx, conf, announce_key, cacheOnly)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			if slices.Contains(a.groups, group) {
+				return nil
+			}
+		}
+	}
+	return ErrRestricted
+}
+
+// ACLsChanged tells every tracker instance to reload its ACLs. It must be
+// called after any change to the infohash_acls or user_groups tables.
+func ACLsChanged(ctx context.Context, conf config.Config) error {
+	if err := conf.Rdb.Incr(ctx, "acls:version").Err(); err != nil {
+		return fmt.Errorf("error updating acls version: %w", err)
+	}
+	return nil
+}
@@ -6,13 +6,40 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"reflect"
 
 	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
 )
 
 // The current default algorithm.
 var DefaultAlgorithm = PeersForRatio
 
+// Algorithms are the peering algorithms which can be selected by name, with
+// $ETRACKER_ALGORITHM or through the admin API.
+var Algorithms = map[string]config.PeeringAlgorithm{
+	"NumwantPeers":      NumwantPeers,
+	"PeersForAnnounces": PeersForAnnounces,
+	"PeersForSeeds":     PeersForSeeds,
+	"PeersForGoodSeeds": PeersForGoodSeeds,
+	"PeersForRatio":     PeersForRatio,
+}
+
+// AlgorithmName returns the name of algorithm in Algorithms, or "" if it is
+// not one of them, such as in tests with a custom algorithm.
+func AlgorithmName(algorithm config.PeeringAlgorithm) string {
+	if algorithm == nil {
+		return ""
+	}
+	pointer := reflect.ValueOf(algorithm).Pointer()
+	for name, a := range Algorithms {
+		if reflect.ValueOf(a).Pointer() == pointer {
+			return name
+		}
+	}
+	return ""
+}
+
 // The minimumPeers to return to a peer, and the maximum ratio used
 // in calculations. Rewarding higher ratios is only apt to incentivize
 // cheating.
@@ -23,7 +50,7 @@ const (
 
 // NumwantPeers is the non-intelligent algorithm which distributes peers up to
 // the number requested by the client, not including themselves.
-func NumwantPeers(conf config.Config, a *config.Announce) (int, error) {
+func NumwantPeers(ctx context.Context, conf config.Config, a *config.Announce) (int, error) {
 	return a.Numwant, nil
 }
 
@@ -34,20 +61,18 @@ func NumwantPeers(conf config.Config, a *config.Announce) (int, error) {
 // snatching more torrents. An improvement would count only torrents you are seeding,
 // not torrents you are leeching as well.
 func PeersForAnnounces(ctx context.Context, conf config.Config, a *config.Announce) (int, error) {
-	query := fmt.Sprintf(`
+	query := `
 		SELECT
-		    COUNT(*)
+		    COUNT(DISTINCT info_hash_id)
 		FROM
 		    announces
 		    JOIN peers ON announces.peers_id = peers.id
 		WHERE
 		    announce_key = $1
-		    AND last_announce >= NOW() - INTERVAL '%d seconds'
-		    AND event <> $2
-		`,
-		config.StaleInterval)
+		    AND ` + db.Active(2, 3) + `
+		`
 	var torrentCount int
-	err := conf.Dbpool.QueryRow(ctx, query, a.Announce_key, config.Stopped).Scan(&torrentCount)
+	err := conf.Dbpool.QueryRow(ctx, query, a.Announce_key, config.Stopped, conf.StaleCutoff()).Scan(&torrentCount)
 	if err != nil {
 		return 0, fmt.Errorf("error determining announce count: %w", err)
 	}
@@ -64,29 +89,38 @@ func PeersForAnnounces(ctx context.Context, conf config.Config, a *config.Announ
 	return numToGive, nil
 }
 
+// PartialSeedsPerSeed is how many BEP 21 partial seeds are credited as one
+// seed by PeersForSeeds, since a partial seed only uploads part of a
+// torrent.
+const PartialSeedsPerSeed = 2
+
+// seedCredit returns the number of torrents credited as seeded for a number
+// of seeds and partial seeds.
+func seedCredit(seeds, partialSeeds int) int {
+	return seeds + partialSeeds/PartialSeedsPerSeed
+}
+
 // PeersForSeeds, aka "Algorithm 2", gives peers to each client as a function
-// of the number of torrents they are seeding.
-//
-// A problem with this algorithm is that it does not count partial seeders.
+// of the number of torrents they are seeding. Partial seeds are credited
+// at a fraction of a seed, see PartialSeedsPerSeed.
 func PeersForSeeds(ctx context.Context, conf config.Config, a *config.Announce) (int, error) {
-	query := fmt.Sprintf(`
+	query := `
+		WITH ` + db.RecentAnnouncesOf(2, 3, 1, "amount_left", "event") + `
 		SELECT
-		    COUNT(*)
+		    COUNT(DISTINCT info_hash_id) FILTER (WHERE amount_left = 0),
+		    COUNT(DISTINCT info_hash_id) FILTER (WHERE ` + db.PartialSeed(4) + `)
 		FROM
-		    announces
-		    JOIN peers ON announces.peers_id = peers.id
+		    recent_announces
+		    JOIN peers ON recent_announces.peers_id = peers.id
 		WHERE
 		    announce_key = $1
-		    AND amount_left = 0
-		    AND last_announce >= NOW() - INTERVAL '%d seconds'
-		    AND event <> $2
-		`,
-		config.StaleInterval)
-	var torrentCount int
-	err := conf.Dbpool.QueryRow(ctx, query, a.Announce_key, config.Stopped).Scan(&torrentCount)
+		`
+	var seeds, partialSeeds int
+	err := conf.Dbpool.QueryRow(ctx, query, a.Announce_key, config.Stopped, conf.StaleCutoff(), config.Paused).Scan(&seeds, &partialSeeds)
 	if err != nil {
 		return 0, fmt.Errorf("error determining seed count: %w", err)
 	}
+	torrentCount := seedCredit(seeds, partialSeeds)
 
 	var numToGive int
 
@@ -120,24 +154,19 @@ func PeersForGoodSeeds(ctx context.Context, conf config.Config, a *config.Announ
 		return 0, nil
 	}
 
-	query := fmt.Sprintf(`
-		SELECT DISTINCT ON (info_hash_id)
+	query := `
+		WITH ` + db.RecentAnnouncesOf(2, 3, 1, "amount_left", "uploaded", "downloaded") + `
+		SELECT
 		    amount_left,
-		    announces.uploaded,
-		    announces.downloaded
+		    recent_announces.uploaded,
+		    recent_announces.downloaded
 		FROM
-		    announces
-		    JOIN peers ON announces.peers_id = peers.id
+		    recent_announces
+		    JOIN peers ON recent_announces.peers_id = peers.id
 		WHERE
 		    announce_key = $1
-		    AND last_announce >= NOW() - INTERVAL '%d seconds'
-		    AND event <> $2
-		ORDER BY
-		    info_hash_id,
-		    last_announce DESC
-		`,
-		config.StaleInterval)
-	rows, err := conf.Dbpool.Query(ctx, query, a.Announce_key, config.Stopped)
+		`
+	rows, err := conf.Dbpool.Query(ctx, query, a.Announce_key, config.Stopped, conf.StaleCutoff())
 	if err != nil {
 		return 0, fmt.Errorf("error querying for rows: %w", err)
 	}
@@ -185,28 +214,25 @@ func PeersForGoodSeeds(ctx context.Context, conf config.Config, a *config.Announ
 	// Calculate goodSeedCount, which is defined as seeding more torrents
 	// than 1 standard deviation above the mean. The minimum for small swarms
 	// is the constant minimumPeers.
-	query = fmt.Sprintf(`
-		WITH seed_counts AS (
+	query = `
+		WITH ` + db.RecentAnnounces(1, 3, "amount_left") + `,
+		seed_counts AS (
 		    SELECT
-			COUNT(*) AS seed_count
+			COUNT(DISTINCT info_hash_id) AS seed_count
 		    FROM
-			announces
-			JOIN peers ON announces.peers_id = peers.id
+			recent_announces
 		    WHERE
 			amount_left = 0
-			AND last_announce >= NOW() - INTERVAL '%d seconds'
-			AND event <> $1
 		    GROUP BY
-			peers.id
+			peers_id
 		)
 		SELECT
 		    COALESCE((STDDEV_POP(seed_count) + AVG(seed_count))::integer, $2)
 		FROM
 		    seed_counts
-		`,
-		config.StaleInterval)
+		`
 	var goodSeedCount int
-	err = conf.Dbpool.QueryRow(ctx, query, config.Stopped, minimumPeers).Scan(&goodSeedCount)
+	err = conf.Dbpool.QueryRow(ctx, query, config.Stopped, minimumPeers, conf.StaleCutoff()).Scan(&goodSeedCount)
 	if err != nil {
 		return 0, fmt.Errorf("error calculating current swarm seeder counts: %w", err)
 	}
@@ -259,17 +285,16 @@ func smoothFunction(x, numWanted, goodSeedCount int) int {
 func PeersForRatio(ctx context.Context, conf config.Config, a *config.Announce) (int, error) {
 	var ratio float64
 	var seedPercentage float64
-	query := fmt.Sprintf(`
-		WITH client_announces AS (
+	query := `
+		WITH ` + db.RecentAnnouncesOf(1, 3, 2, "amount_left") + `,
+		client_announces AS (
 		    SELECT
-			count(info_hash_id) AS seeding
+			count(DISTINCT info_hash_id) AS seeding
 		    FROM
-			announces
-			INNER JOIN peers ON announces.peers_id = peers.id
+			recent_announces
+			INNER JOIN peers ON recent_announces.peers_id = peers.id
 		    WHERE
 			amount_left = 0
-			AND last_announce >= NOW() - INTERVAL '%d seconds'
-			AND event <> $1
 			AND peers.announce_key = $2
 		)
 		SELECT
@@ -291,8 +316,8 @@ func PeersForRatio(ctx context.Context, conf config.Config, a *config.Announce)
 		    peers
 		WHERE
 		    peers.announce_key = $2
-		`, config.StaleInterval)
-	err := conf.Dbpool.QueryRow(ctx, query, config.Stopped, a.Announce_key).Scan(&ratio, &seedPercentage)
+		`
+	err := conf.Dbpool.QueryRow(ctx, query, config.Stopped, a.Announce_key, conf.StaleCutoff()).Scan(&ratio, &seedPercentage)
 	if err != nil {
 		return 0, fmt.Errorf("error querying for rows: %w", err)
 	}
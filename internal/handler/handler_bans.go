@@ -0,0 +1,204 @@
+// Bans refuse announces by announce key, by source IP range, or by client,
+// matched as a prefix of the peer_id such as "-XL0012-". They are stored in
+// Postgres, and each tracker instance keeps a compiled copy, which it
+// reloads whenever the version counter in Redis is bumped by a change. If
+// the bans cannot be loaded, announces are allowed.
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// Kinds of ban.
+const (
+	BanKey    = "key"
+	BanCIDR   = "cidr"
+	BanClient = "client"
+)
+
+// MaxBanLength bounds the value of a ban.
+const MaxBanLength = 64
+
+var (
+	ErrBanned     = errors.New("banned")
+	ErrInvalidBan = errors.New("invalid ban")
+)
+
+// NormalizeBan validates the value of a ban of the given kind, and returns
+// it in the form in which it is stored. A single IP is accepted as a CIDR
+// ban of just that address.
+func NormalizeBan(kind, value string) (string, error) {
+	if value == "" || len(value) > MaxBanLength {
+		return "", fmt.Errorf("%w: %s %q", ErrInvalidBan, kind, value)
+	}
+
+	switch kind {
+	case BanKey, BanClient:
+		return value, nil
+	case BanCIDR:
+		if ip := net.ParseIP(value); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				return ip4.String() + "/32", nil
+			}
+			return ip.String() + "/128", nil
+		}
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s %q", ErrInvalidBan, kind, value)
+		}
+		return ipnet.String(), nil
+	}
+
+	return "", fmt.Errorf("%w: unknown kind %q", ErrInvalidBan, kind)
+}
+
+// banSet is the compiled form of the bans at one version.
+type banSet struct {
+	version string
+	keys    map[string]bool
+	nets    []*net.IPNet
+	clients []string
+}
+
+func (s *banSet) add(kind, value string) {
+	switch kind {
+	case BanKey:
+		s.keys[value] = true
+	case BanCIDR:
+		if _, ipnet, err := net.ParseCIDR(value); err == nil {
+			s.nets = append(s.nets, ipnet)
+		}
+	case BanClient:
+		s.clients = append(s.clients, value)
+	}
+}
+
+// size returns the number of bans in s.
+func (s *banSet) size() int {
+	return len(s.keys) + len(s.nets) + len(s.clients)
+}
+
+// banned reports whether an announce matches any ban.
+func (s *banSet) banned(announce *config.Announce) bool {
+	if s.keys[announce.Announce_key] {
+		return true
+	}
+	// Bans apply to the connecting address, rather than to an address the
+	// client announced, see config.HonorIPParam. Announces buffered before
+	// Remote_ip was recorded only have Ip_port.
+	ip := net.IP(announce.Remote_ip)
+	if ip == nil && len(announce.Ip_port) > 2 {
+		ip = net.IP(announce.Ip_port[:len(announce.Ip_port)-2])
+	}
+	if ip != nil {
+		for _, ipnet := range s.nets {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, prefix := range s.clients {
+		if strings.HasPrefix(string(announce.Peer_id), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadedBans holds the compiled bans per Redis client, so that configs
+// sharing a process, as in tests, do not share bans.
+var loadedBans = struct {
+	mu   sync.Mutex
+	sets map[*redis.Client]*banSet
+}{sets: make(map[*redis.Client]*banSet)}
+
+// currentBans returns the compiled bans, reloading them from Postgres if
+// they have changed since they were last loaded. If cacheOnly is set, the
+// bans last loaded are returned as they are, or ErrNotCached if there are
+// none.
+func currentBans(ctx context.Context, conf config.Config, cacheOnly bool) (*banSet, error) {
+	if cacheOnly {
+		loadedBans.mu.Lock()
+		set := loadedBans.sets[conf.Rdb]
+		loadedBans.mu.Unlock()
+		if set == nil {
+			return nil, fmt.Errorf("%w: bans not loaded", ErrNotCached)
+		}
+		return set, nil
+	}
+
+	version, err := conf.Rdb.Get(ctx, "bans:version").Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("error fetching bans version: %w", err)
+	}
+
+	loadedBans.mu.Lock()
+	set, ok := loadedBans.sets[conf.Rdb]
+	loadedBans.mu.Unlock()
+	if ok && set.version == version {
+		return set, nil
+	}
+
+	rows, err := conf.Dbpool.Query(ctx, `
+		SELECT kind, value
+		FROM bans
+		`)
+	if err != nil {
+		return nil, fmt.Errorf("error loading bans: %w", err)
+	}
+	defer rows.Close()
+
+	set = &banSet{version: version, keys: make(map[string]bool)}
+	for rows.Next() {
+		var kind, value string
+		if err = rows.Scan(&kind, &value); err != nil {
+			return nil, fmt.Errorf("error loading bans: %w", err)
+		}
+		set.add(kind, value)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error loading bans: %w", err)
+	}
+
+	loadedBans.mu.Lock()
+	loadedBans.sets[conf.Rdb] = set
+	loadedBans.mu.Unlock()
+
+	return set, nil
+}
+
+// checkBanned returns ErrBanned if the announce matches a ban. If the bans
+// cannot be loaded, announces are allowed, except that with cacheOnly set
+// and no bans loaded yet, they are refused with ErrNotCached.
+func checkBanned(ctx context.Context, conf config.Config, announce *config.Announce, cacheOnly bool) error {
+	set, err := currentBans(ctx, conf, cacheOnly)
+	if errors.Is(err, ErrNotCached) {
+		return err
+	}
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	if set.banned(announce) {
+		return ErrBanned
+	}
+	return nil
+}
+
+// BansChanged tells every tracker instance to reload its bans. It must be
+// called after any change to the bans table.
+func BansChanged(ctx context.Context, conf config.Config) error {
+	if err := conf.Rdb.Incr(ctx, "bans:version").Err(); err != nil {
+		return fmt.Errorf("error updating bans version: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Announce replies are built in tiers, each with its own latency budget, so
+// that a slow dependency degrades the reply instead of failing it. Candidate
+// peers are read first from the swarm cache in Redis, then from Postgres,
+// and if both fail or run over budget, from the last peers this process
+// served for the infohash. The number of peers to give is calculated by the
+// peering algorithm within the Postgres budget, falling back to
+// FallbackPeers. The outcome and latency of every stage are published with
+// expvar.
+package handler
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/bencode"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/debuglog"
+)
+
+const (
+	// RedisBudget is the time allowed to read a swarm from the swarm cache.
+	RedisBudget = 50 * time.Millisecond
+	// PostgresBudget is the time allowed each for the peering algorithm and
+	// for reading a swarm from Postgres.
+	PostgresBudget = 300 * time.Millisecond
+	// FallbackPeers is the most peers given when the peering algorithm
+	// cannot be run in time.
+	FallbackPeers = 10
+	// maxFallbackSwarms bounds the last served peers kept in memory.
+	maxFallbackSwarms = 10000
+)
+
+// Outcomes of a stage.
+const (
+	stageOK       = "ok"
+	stageFailed   = "failed"
+	stageExceeded = "exceeded"
+)
+
+var (
+	stageCounts  = expvar.NewMap("announce_stages")
+	stageLatency = expvar.NewMap("announce_stage_microseconds")
+)
+
+// runStage runs f within budget, and counts its outcome and latency under
+// name, recording them in decision as well. The latency of stages with the
+// PostgresBudget is also recorded for load shedding, see loadLimits. A
+// result which arrives after the budget is discarded, so a stage never
+// costs much more than its budget even if its dependency ignores the
+// deadline.
+func runStage[T any](ctx context.Context, decision *debuglog.Decision, name string, budget time.Duration, f func(ctx context.Context) (T, error)) (T, error) {
+	stageCtx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	start := time.Now()
+	result, err := f(stageCtx)
+	elapsed := time.Since(start)
+
+	outcome := stageOK
+	switch {
+	case elapsed > budget || errors.Is(err, context.DeadlineExceeded):
+		outcome = stageExceeded
+		err = fmt.Errorf("%s exceeded budget of %v: %w", name, budget, context.DeadlineExceeded)
+	case err != nil:
+		outcome = stageFailed
+	}
+	stageCounts.Add(name+" "+outcome, 1)
+	stageLatency.Add(name, elapsed.Microseconds())
+	if budget == PostgresBudget {
+		load.recordLatency(elapsed)
+	}
+	decision.AddStage(name, outcome, elapsed)
+
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return result, nil
+}
+
+// servedSwarms holds the last peers served for each infohash, for when
+// neither Redis nor Postgres can answer in time. When it is full it is
+// cleared, like rateLimiter.
+type servedSwarms struct {
+	mu     sync.Mutex
+	swarms map[string][]bencode.Peer
+}
+
+var lastServed = &servedSwarms{swarms: make(map[string][]bencode.Peer)}
+
+func (s *servedSwarms) store(info_hash []byte, peers []bencode.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.swarms) >= maxFallbackSwarms {
+		clear(s.swarms)
+	}
+	s.swarms[string(info_hash)] = slices.Clone(peers)
+}
+
+// load returns the last peers served for the infohash of a, without the
+// client itself.
+func (s *servedSwarms) load(a *config.Announce) []bencode.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var peers []bencode.Peer
+	for _, peer := range s.swarms[string(a.Info_hash)] {
+		if string(peer.Ip_port) != string(a.Ip_port) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// selectPeers returns the candidate peers for an announce from the first
+// tier which answers within its budget. An empty swarm cache is not
+// trusted, since it is also empty after Redis restarts, so Postgres is
+// asked as well.
+func selectPeers(ctx context.Context, conf config.Config, a *config.Announce) []bencode.Peer {
+	peers, err := runStage(ctx, a.Decision, "redis", RedisBudget, func(ctx context.Context) ([]bencode.Peer, error) {
+		return cachedPeers(ctx, conf, a)
+	})
+	if err != nil {
+		log.Printf("Falling back from swarm cache: %v", err)
+	}
+	if err == nil && len(peers) > 0 {
+		lastServed.store(a.Info_hash, peers)
+		a.Decision.SetCandidates("redis", len(peers))
+		return peers
+	}
+
+	peers, err = runStage(ctx, a.Decision, "postgres", PostgresBudget, func(ctx context.Context) ([]bencode.Peer, error) {
+		return storedPeers(ctx, conf, a)
+	})
+	if err == nil {
+		lastServed.store(a.Info_hash, peers)
+		a.Decision.SetCandidates("postgres", len(peers))
+		return peers
+	}
+	log.Printf("Falling back from Postgres: %v", err)
+
+	stageCounts.Add("fallback "+stageOK, 1)
+	peers = lastServed.load(a)
+	a.Decision.SetCandidates("fallback", len(peers))
+	return peers
+}
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/dmoerner/etracker/internal/bencode"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/locale"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CertificateFingerprint returns the SHA-256 fingerprint of a client
+// certificate, by which it is mapped to an announce key.
+func CertificateFingerprint(cert *x509.Certificate) []byte {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return fingerprint[:]
+}
+
+// CertificateKey returns the announce key mapped to the verified client
+// certificate of r, or the empty string if r has no verified certificate or
+// it is not mapped to a key.
+func CertificateKey(ctx context.Context, conf config.Config, r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", nil
+	}
+
+	var announce_key string
+	err := conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    announce_key
+		FROM
+		    client_certs
+		    JOIN peers ON client_certs.peers_id = peers.id
+		WHERE
+		    fingerprint = $1
+		`,
+		CertificateFingerprint(r.TLS.VerifiedChains[0][0])).Scan(&announce_key)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error fetching announce key for client certificate: %w", err)
+	}
+
+	return announce_key, nil
+}
+
+// WithClientCertificate is middleware for announces and scrapes which carry
+// no announce key in the URL. It sets the announce key mapped to the
+// client certificate as the id path value, as if it had been in the URL,
+// and otherwise fails with a bencoded failure reason.
+func WithClientCertificate(ctx context.Context, conf config.Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lang := locale.Negotiate(r.Header.Get("Accept-Language"), conf.Language)
+
+			announce_key, err := CertificateKey(ctx, conf, r)
+			if err != nil {
+				log.Print(err)
+				_, _ = w.Write(bencode.FailureReason(locale.Sprintf(lang, "error validating client certificate")))
+				return
+			}
+			if announce_key == "" {
+				_, _ = w.Write(bencode.FailureReason(locale.Sprintf(lang, "no announce key for client certificate")))
+				return
+			}
+
+			r.SetPathValue("id", announce_key)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+// Peers in the same network or country usually connect faster and more
+// cheaply than distant ones. With the geoselection feature and GeoIP
+// databases, part of the peers given to an announce, at most GeoPeerShare,
+// are chosen for being nearby: first peers in the same autonomous system,
+// then peers in the same country. The rest are chosen as usual, so that
+// every swarm stays connected across networks and countries.
+package handler
+
+import (
+	"math/rand"
+	"net"
+
+	"github.com/dmoerner/etracker/internal/bencode"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/geoip"
+)
+
+// markNearby marks as Nearby up to GeoPeerShare of numToGive of the peers
+// closest to the announcing peer, as located by locate, choosing at random
+// among those equally close. Peers are not marked if the announcing peer
+// has no known location.
+func markNearby(conf config.Config, a *config.Announce, peers []bencode.Peer, numToGive int, locate func(net.IP) geoip.Location) {
+	if conf.GeoPeerShare <= 0 || !conf.Features.Enabled(config.FeatureGeoSelection) {
+		return
+	}
+	if a.Asn == 0 && a.Country == "" {
+		return
+	}
+
+	var sameAsn, sameCountry []int
+	for i, peer := range peers {
+		loc := locate(net.IP(peer.Ip_port[:len(peer.Ip_port)-2]))
+		switch {
+		case a.Asn != 0 && loc.Asn == a.Asn:
+			sameAsn = append(sameAsn, i)
+		case a.Country != "" && loc.Country == a.Country:
+			sameCountry = append(sameCountry, i)
+		}
+	}
+	rand.Shuffle(len(sameAsn), func(i, j int) {
+		sameAsn[i], sameAsn[j] = sameAsn[j], sameAsn[i]
+	})
+	rand.Shuffle(len(sameCountry), func(i, j int) {
+		sameCountry[i], sameCountry[j] = sameCountry[j], sameCountry[i]
+	})
+
+	nearby := append(sameAsn, sameCountry...)
+	quota := int(float64(numToGive)*conf.GeoPeerShare + 0.5)
+	for _, i := range nearby[:min(quota, len(nearby))] {
+		peers[i].Nearby = true
+	}
+}
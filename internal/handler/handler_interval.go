@@ -0,0 +1,35 @@
+// Announce intervals are personalized to the swarm and the peer. Tiny swarms
+// are asked to announce more often, so that their few peers find each other
+// quickly, and huge swarms less often, since each peer matters less and their
+// announces are most of the load. Seeders may be asked to announce less often
+// than leechers, since they change the swarm less. The minimum interval is
+// scaled with the interval, so that clients honoring it do not undo the
+// lengthening with manual announces.
+package handler
+
+import (
+	"github.com/dmoerner/etracker/internal/config"
+)
+
+// personalInterval returns the announce interval and minimum interval, in
+// seconds, for a peer in a swarm with the given counts, which may be nil if
+// they are not known.
+func personalInterval(conf config.Config, counts *swarmCounts, seeding bool) (int, int) {
+	interval := config.Interval
+	if counts != nil {
+		peers := counts.complete + counts.incomplete
+		for _, swarm := range conf.SwarmIntervals {
+			if peers < swarm.MinPeers {
+				break
+			}
+			interval = int(swarm.Interval.Seconds())
+		}
+	}
+	if seeding && conf.SeederIntervalFactor > 0 {
+		interval = int(float64(interval) * conf.SeederIntervalFactor)
+	}
+	interval = min(max(interval, config.MinInterval), config.MaxInterval)
+
+	minInterval := max(config.MinInterval, config.MinInterval*interval/config.Interval)
+	return interval, minInterval
+}
@@ -0,0 +1,134 @@
+// Under load, the tracker trades the freshness of peer lists for stability.
+// Each process keeps moving averages of its announce rate and of the latency
+// of the Postgres stages of announce replies, see runStage. When either
+// exceeds its configured threshold, replies give fewer peers and ask clients
+// to announce less often, in proportion to the overload, until the averages
+// recede. The current limits are published with expvar as "announce_load".
+package handler
+
+import (
+	"expvar"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+)
+
+const (
+	// MaxNumwant is the most peers given in one reply, and the numwant of
+	// announces which ask for more.
+	MaxNumwant = 100
+	// MinLoadNumwant is the fewest peers given in one reply under load, so
+	// that leechers can still find seeders.
+	MinLoadNumwant = 10
+	// MaxLoadIntervalFactor bounds how much the announce interval is
+	// lengthened under load.
+	MaxLoadIntervalFactor = 4
+
+	// rateSmoothing and latencySmoothing are the weights of the newest
+	// second and the newest sample in the moving averages.
+	rateSmoothing    = 0.3
+	latencySmoothing = 0.1
+)
+
+// LoadLimits are the limits applied to announce replies at a load Factor,
+// the greater of the announce rate and the Postgres latency relative to
+// their thresholds. Below a Factor of 1 there is no overload.
+type LoadLimits struct {
+	Factor   float64 `json:"factor"`
+	Numwant  int     `json:"numwant"`
+	Interval int     `json:"interval"`
+}
+
+// limitsAt returns the LoadLimits at a load factor.
+func limitsAt(factor float64) LoadLimits {
+	if factor <= 1 {
+		return LoadLimits{Factor: factor, Numwant: MaxNumwant, Interval: config.Interval}
+	}
+	return LoadLimits{
+		Factor:   factor,
+		Numwant:  max(MinLoadNumwant, int(MaxNumwant/factor)),
+		Interval: int(config.Interval * min(factor, MaxLoadIntervalFactor)),
+	}
+}
+
+// loadMonitor holds the moving averages of one process.
+type loadMonitor struct {
+	mu sync.Mutex
+	// second is the Unix second in which count announces have been seen
+	// so far. Only complete seconds are folded into rate.
+	second  int64
+	count   int
+	rate    float64
+	latency time.Duration
+	last    LoadLimits
+}
+
+var load = &loadMonitor{last: limitsAt(0)}
+
+func init() {
+	expvar.Publish("announce_load", expvar.Func(func() any {
+		load.mu.Lock()
+		defer load.mu.Unlock()
+		return struct {
+			LoadLimits
+			Rate      float64 `json:"announces_per_second"`
+			LatencyMs float64 `json:"postgres_latency_ms"`
+		}{load.last, load.rate, float64(load.latency.Microseconds()) / 1000}
+	}))
+}
+
+// roll folds the completed seconds before now into the announce rate. The
+// caller must hold m.mu.
+func (m *loadMonitor) roll(now time.Time) {
+	second := now.Unix()
+	if second <= m.second {
+		return
+	}
+	m.rate = rateSmoothing*float64(m.count) + (1-rateSmoothing)*m.rate
+	// Seconds without announces count as zero.
+	m.rate *= math.Pow(1-rateSmoothing, float64(min(second-m.second-1, 60)))
+	m.second = second
+	m.count = 0
+}
+
+// recordAnnounce counts an announce at now.
+func (m *loadMonitor) recordAnnounce(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roll(now)
+	m.count++
+}
+
+// recordLatency adds the latency of a Postgres stage to the average.
+func (m *loadMonitor) recordLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency = time.Duration(latencySmoothing*float64(d) + (1-latencySmoothing)*float64(m.latency))
+}
+
+// limits returns the LoadLimits for conf at now.
+func (m *loadMonitor) limits(conf config.Config, now time.Time) LoadLimits {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roll(now)
+
+	factor := 0.0
+	if conf.LoadMaxQPS > 0 {
+		factor = max(factor, m.rate/conf.LoadMaxQPS)
+	}
+	if conf.LoadMaxLatency > 0 {
+		factor = max(factor, float64(m.latency)/float64(conf.LoadMaxLatency))
+	}
+	m.last = limitsAt(factor)
+	return m.last
+}
+
+// loadLimits returns the limits to apply to an announce reply now.
+func loadLimits(conf config.Config) LoadLimits {
+	if conf.LoadMaxQPS <= 0 && conf.LoadMaxLatency <= 0 {
+		return limitsAt(0)
+	}
+	return load.limits(conf, conf.Now())
+}
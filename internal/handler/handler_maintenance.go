@@ -0,0 +1,76 @@
+// In maintenance mode, every announce is answered with a failure asking the
+// client to retry later, while the API and scrapes stay live. The state is
+// kept in Redis, so that it can be toggled through the admin API without
+// restarting the tracker.
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/bencode"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/locale"
+	"github.com/redis/go-redis/v9"
+)
+
+// Maintenance returns whether maintenance mode is enabled, and if so, how
+// long clients are asked to wait before retrying.
+func Maintenance(ctx context.Context, conf config.Config) (bool, time.Duration, error) {
+	retry, err := conf.Rdb.Get(ctx, "maintenance").Result()
+	if err != nil {
+		if err == redis.Nil {
+			return false, 0, nil
+		}
+		return false, 0, fmt.Errorf("error fetching maintenance mode: %w", err)
+	}
+
+	seconds, err := strconv.Atoi(retry)
+	if err != nil || seconds <= 0 {
+		return true, config.DefaultMaintenanceRetry, nil
+	}
+
+	return true, time.Duration(seconds) * time.Second, nil
+}
+
+// SetMaintenance enables maintenance mode, asking clients to retry after
+// retry, or disables it if retry is zero.
+func SetMaintenance(ctx context.Context, conf config.Config, retry time.Duration) error {
+	var err error
+	if retry > 0 {
+		err = conf.Rdb.Set(ctx, "maintenance", int(retry.Seconds()), 0).Err()
+	} else {
+		err = conf.Rdb.Del(ctx, "maintenance").Err()
+	}
+	if err != nil {
+		return fmt.Errorf("error setting maintenance mode: %w", err)
+	}
+
+	return nil
+}
+
+// writeMaintenance answers an announce during maintenance in lang, and
+// reports whether it did. If the state cannot be read from Redis, announces are
+// handled normally.
+func writeMaintenance(ctx context.Context, conf config.Config, w http.ResponseWriter, lang string) bool {
+	enabled, retry, err := Maintenance(ctx, conf)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	if !enabled {
+		return false
+	}
+
+	msg := locale.Sprintf(lang, "tracker under maintenance, retry in %v", retry)
+	_, err = w.Write(bencode.RetryFailure(msg, int(retry.Seconds())))
+	if err != nil {
+		log.Printf("Error responding to peer: %v", err)
+	}
+
+	return true
+}
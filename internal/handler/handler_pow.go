@@ -0,0 +1,117 @@
+// With proof of work enabled, see config.PowDifficulty, the first announce
+// of every key must be backed by a proof of work. Keys generated with one
+// are marked as verified in peers.pow_verified, as are keys which operators
+// issue to seedbox agents and the canary, and rotating a key keeps its mark.
+// Any other key which has not announced yet, such as one created before
+// proof of work was enabled, is refused until a challenge is solved for it,
+// see VerifyKey. Keys with announces on record are not asked again. Whether
+// a key may announce is cached in Redis as a persistent key, since it only
+// changes when the key is verified.
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrUnverifiedKey = errors.New("announce key not verified by proof of work")
+
+// UnverifiedFailure is the failure reason sent to announces with a key
+// which needs a proof of work before its first announce.
+const UnverifiedFailure = "announce key must be verified with a proof of work before its first announce"
+
+// keyVerified reports whether an announce key may announce with proof of
+// work enabled: it was verified, or it has announced before. If cacheOnly
+// is set, ErrNotCached is returned on a cache miss.
+func keyVerified(ctx context.Context, conf config.Config, announce_key string, cacheOnly bool) (bool, error) {
+	cached, err := conf.Rdb.Get(ctx, "pow_verified:"+announce_key).Result()
+	if err == nil {
+		return cached == "true", nil
+	}
+	if cacheOnly {
+		return false, notCached("key verification", err)
+	}
+	if err != redis.Nil {
+		// An issue with the cache must be logged but is not fatal.
+		log.Printf("Error fetching key verification from cache: %v", err)
+	}
+
+	var verified bool
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    pow_verified
+		    OR EXISTS (
+			SELECT
+			FROM
+			    announces
+			WHERE
+			    announces.peers_id = peers.id)
+		FROM
+		    peers
+		WHERE
+		    announce_key = $1
+		`,
+		announce_key).Scan(&verified)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return false, fmt.Errorf("error checking peers for key verification: %w", err)
+	}
+
+	cached = "false"
+	if verified {
+		cached = "true"
+	}
+	if err = conf.Rdb.Set(ctx, "pow_verified:"+announce_key, cached, 0).Err(); err != nil {
+		// An issue with the cache must be logged but is not fatal.
+		log.Printf("Error setting key verification in cache: %v", err)
+	}
+
+	return verified, nil
+}
+
+// checkVerified refuses announces with a key which needs a proof of work,
+// if proof of work is enabled.
+func checkVerified(ctx context.Context, conf config.Config, announce *config.Announce, cacheOnly bool) error {
+	if conf.PowDifficulty <= 0 {
+		return nil
+	}
+	verified, err := keyVerified(ctx, conf, announce.Announce_key, cacheOnly)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return ErrUnverifiedKey
+	}
+	return nil
+}
+
+// VerifyKey marks an announce key as backed by a proof of work, or as
+// issued by an operator, so that it may announce. It returns
+// ErrUntrackedAnnounce if the key is not tracked.
+func VerifyKey(ctx context.Context, conf config.Config, announce_key string) error {
+	tag, err := conf.Dbpool.Exec(ctx, `
+		UPDATE
+		    peers
+		SET
+		    pow_verified = TRUE
+		WHERE
+		    announce_key = $1
+		`,
+		announce_key)
+	if err != nil {
+		return fmt.Errorf("error verifying announce key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrUntrackedAnnounce
+	}
+
+	if err = conf.Rdb.Set(ctx, "pow_verified:"+announce_key, "true", 0).Err(); err != nil {
+		return fmt.Errorf("error setting key verification in cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// In privacy mode, enabled by setting a PrivacySalt, Postgres never stores
+// raw peer IPs. Instead it stores salted hashes, which still allow counting
+// distinct IPs. The compact ip_port needed to reply to peers is kept only in
+// Redis, keyed by its hash, and expires once the peer is stale.
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/bencode"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// hashAtRest returns the value to store in Postgres for an IP or ip_port. In
+// privacy mode this is a salted hash; otherwise it is the value itself.
+func hashAtRest(conf config.Config, b []byte) []byte {
+	if conf.PrivacySalt == "" {
+		return b
+	}
+	mac := hmac.New(sha256.New, []byte(conf.PrivacySalt))
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+// addressParams are the announce parameters which carry client IPs.
+var addressParams = []string{"ip", "ipv4", "ipv6", "localip"}
+
+// IpPortAtRest returns the value stored in the ip_port column of the
+// announces table for a peer at ip and port, for matching reports about
+// peers from outside an announce.
+func IpPortAtRest(conf config.Config, ip string, port int) ([]byte, error) {
+	ip_port, err := encodeAddr(net.JoinHostPort(ip, "0"), strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	return hashAtRest(conf, ip_port), nil
+}
+
+// paramsAtRest returns the announce parameters to store in Postgres. In
+// privacy mode, IPs sent as parameters are hashed like ip_port.
+func paramsAtRest(conf config.Config, params map[string]string) map[string]string {
+	if conf.PrivacySalt == "" || params == nil {
+		return params
+	}
+	stored := maps.Clone(params)
+	for _, k := range addressParams {
+		if v, ok := stored[k]; ok {
+			stored[k] = hex.EncodeToString(hashAtRest(conf, []byte(v)))
+		}
+	}
+	return stored
+}
+
+// storeIpPort returns the value to write to the ip_port column of the
+// announces table. In privacy mode, the real ip_port is cached in Redis
+// under its hash for StaleInterval, since it is required to reply to peers.
+func storeIpPort(ctx context.Context, conf config.Config, ip_port []byte) ([]byte, error) {
+	stored := hashAtRest(conf, ip_port)
+	if conf.PrivacySalt == "" {
+		return stored, nil
+	}
+
+	err := conf.Rdb.Set(ctx, "ip_port:"+string(stored), ip_port, config.StaleInterval*time.Second).Err()
+	if err != nil {
+		return nil, fmt.Errorf("error caching ip_port: %w", err)
+	}
+
+	return stored, nil
+}
+
+// resolveIpPort converts a single ip_port value read from the announces
+// table back into a compact ip_port. In privacy mode, it returns nil if the
+// ip_port has expired from Redis.
+func resolveIpPort(ctx context.Context, conf config.Config, stored []byte) ([]byte, error) {
+	if conf.PrivacySalt == "" {
+		return stored, nil
+	}
+
+	ip_port, err := conf.Rdb.Get(ctx, "ip_port:"+string(stored)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error fetching cached ip_port: %w", err)
+	}
+	return ip_port, nil
+}
+
+// resolveIpPorts converts the ip_port values read from the announces table
+// back into compact peers. In privacy mode, hashes whose ip_port has expired
+// from Redis are dropped.
+func resolveIpPorts(ctx context.Context, conf config.Config, stored []bencode.Peer) ([]bencode.Peer, error) {
+	if conf.PrivacySalt == "" || len(stored) == 0 {
+		return stored, nil
+	}
+
+	keys := make([]string, len(stored))
+	for i, s := range stored {
+		keys[i] = "ip_port:" + string(s.Ip_port)
+	}
+
+	values, err := conf.Rdb.MGet(ctx, keys...).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("error fetching cached ip_ports: %w", err)
+	}
+
+	var peers []bencode.Peer
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			peers = append(peers, bencode.Peer{Ip_port: []byte(s), Peer_id: stored[i].Peer_id, Seeding: stored[i].Seeding})
+		}
+	}
+
+	return peers, nil
+}
@@ -0,0 +1,198 @@
+// Promotions are time windows in which downloads are freeleech, not counted
+// against peers.downloaded, or uploads are multiplied, either for a single
+// infohash or for every infohash. Like bans, they are stored in Postgres,
+// and each tracker instance keeps a copy which it reloads whenever the
+// version counter in Redis is bumped by a change. If the promotions cannot
+// be loaded, announces are counted as they are.
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// MaxUploadMultiplier bounds the upload multiplier of a promotion, so that
+// a mistyped promotion cannot inflate every ratio.
+const MaxUploadMultiplier = 10
+
+var ErrInvalidPromotion = errors.New("invalid promotion")
+
+// promotion is one promotion window.
+type promotion struct {
+	freeleech         bool
+	upload_multiplier float64
+	start_time        time.Time
+	end_time          time.Time
+}
+
+func (p promotion) active(now time.Time) bool {
+	return !now.Before(p.start_time) && now.Before(p.end_time)
+}
+
+// ValidatePromotion checks the values of a promotion before it is stored.
+func ValidatePromotion(freeleech bool, upload_multiplier float64, start_time, end_time time.Time) error {
+	if !end_time.After(start_time) {
+		return fmt.Errorf("%w: end_time must be after start_time", ErrInvalidPromotion)
+	}
+	if math.IsNaN(upload_multiplier) || upload_multiplier < 0 || upload_multiplier > MaxUploadMultiplier {
+		return fmt.Errorf("%w: upload_multiplier must be between 0 and %d", ErrInvalidPromotion, MaxUploadMultiplier)
+	}
+	if !freeleech && upload_multiplier == 1 {
+		return fmt.Errorf("%w: neither freeleech nor an upload_multiplier", ErrInvalidPromotion)
+	}
+	return nil
+}
+
+// promotionSet is the loaded form of the promotions at one version.
+type promotionSet struct {
+	version    string
+	global     []promotion
+	infohashes map[string][]promotion
+}
+
+// size returns the number of promotions in s.
+func (s *promotionSet) size() int {
+	n := len(s.global)
+	for _, promotions := range s.infohashes {
+		n += len(promotions)
+	}
+	return n
+}
+
+// apply returns the upload and download changes of an announce of
+// info_hash at now, after any active promotions. Overlapping promotions
+// are not compounded: the download is freeleech if any of them is, and the
+// highest upload multiplier applies.
+func (s *promotionSet) apply(info_hash []byte, now time.Time, upload_change, download_change int) (int, int) {
+	freeleech := false
+	multiplier := 0.0
+	found := false
+	for _, promotions := range [][]promotion{s.global, s.infohashes[string(info_hash)]} {
+		for _, p := range promotions {
+			if !p.active(now) {
+				continue
+			}
+			freeleech = freeleech || p.freeleech
+			if !found || p.upload_multiplier > multiplier {
+				multiplier = p.upload_multiplier
+			}
+			found = true
+		}
+	}
+	if !found {
+		return upload_change, download_change
+	}
+
+	if freeleech {
+		download_change = 0
+	}
+	return int(math.Round(float64(upload_change) * multiplier)), download_change
+}
+
+// freeleech reports whether a freeleech promotion is active for info_hash
+// at now.
+func (s *promotionSet) freeleech(info_hash []byte, now time.Time) bool {
+	for _, promotions := range [][]promotion{s.global, s.infohashes[string(info_hash)]} {
+		for _, p := range promotions {
+			if p.freeleech && p.active(now) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadedPromotions holds the loaded promotions per Redis client, so that
+// configs sharing a process, as in tests, do not share promotions.
+var loadedPromotions = struct {
+	mu   sync.Mutex
+	sets map[*redis.Client]*promotionSet
+}{sets: make(map[*redis.Client]*promotionSet)}
+
+// currentPromotions returns the promotions, reloading them from Postgres if
+// they have changed since they were last loaded. Expired promotions are not
+// loaded.
+func currentPromotions(ctx context.Context, conf config.Config) (*promotionSet, error) {
+	version, err := conf.Rdb.Get(ctx, "promotions:version").Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("error fetching promotions version: %w", err)
+	}
+
+	loadedPromotions.mu.Lock()
+	set, ok := loadedPromotions.sets[conf.Rdb]
+	loadedPromotions.mu.Unlock()
+	if ok && set.version == version {
+		return set, nil
+	}
+
+	rows, err := conf.Dbpool.Query(ctx, `
+		SELECT
+		    info_hash,
+		    freeleech,
+		    upload_multiplier,
+		    start_time,
+		    end_time
+		FROM
+		    promotions
+		    LEFT JOIN infohashes ON promotions.info_hash_id = infohashes.id
+		WHERE
+		    end_time > $1
+		`,
+		conf.Now())
+	if err != nil {
+		return nil, fmt.Errorf("error loading promotions: %w", err)
+	}
+	defer rows.Close()
+
+	set = &promotionSet{version: version, infohashes: make(map[string][]promotion)}
+	for rows.Next() {
+		var info_hash []byte
+		var p promotion
+		if err = rows.Scan(&info_hash, &p.freeleech, &p.upload_multiplier, &p.start_time, &p.end_time); err != nil {
+			return nil, fmt.Errorf("error loading promotions: %w", err)
+		}
+		if info_hash == nil {
+			set.global = append(set.global, p)
+		} else {
+			set.infohashes[string(info_hash)] = append(set.infohashes[string(info_hash)], p)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error loading promotions: %w", err)
+	}
+
+	loadedPromotions.mu.Lock()
+	loadedPromotions.sets[conf.Rdb] = set
+	loadedPromotions.mu.Unlock()
+
+	return set, nil
+}
+
+// applyPromotions returns the upload and download changes of an announce
+// after any promotions active for its infohash. Only the lifetime totals of
+// the announce key are affected; the announce itself is recorded as sent.
+func applyPromotions(ctx context.Context, conf config.Config, announce *config.Announce, upload_change, download_change int) (int, int) {
+	set, err := currentPromotions(ctx, conf)
+	if err != nil {
+		log.Print(err)
+		return upload_change, download_change
+	}
+	return set.apply(announce.Info_hash, conf.Now(), upload_change, download_change)
+}
+
+// PromotionsChanged tells every tracker instance to reload its promotions.
+// It must be called after any change to the promotions table.
+func PromotionsChanged(ctx context.Context, conf config.Config) error {
+	if err := conf.Rdb.Incr(ctx, "promotions:version").Err(); err != nil {
+		return fmt.Errorf("error updating promotions version: %w", err)
+	}
+	return nil
+}
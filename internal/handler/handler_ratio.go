@@ -0,0 +1,71 @@
+// Ratio enforcement refuses to help announce keys which take much more than
+// they give. Once a key has downloaded more than the configured grace
+// amount, leeching announces with a lifetime ratio below the minimum are
+// answered with no peers and a warning, while seeding announces are served
+// as usual, so that the key can always seed its ratio back up. Torrents
+// which are freeleech, see promotions, are exempt, since downloading them
+// does not lower the ratio.
+package handler
+
+import (
+	"context"
+	"log"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/locale"
+)
+
+// RatioWarning is the warning sent with replies to leeching announces which
+// are refused peers for their ratio.
+const RatioWarning = "your ratio of %.2f is below the minimum of %.2f, seed to raise it before downloading more"
+
+// belowRatio returns the ratio of lifetime totals, and whether they are
+// below the minimum ratio after the grace amount.
+func belowRatio(conf config.Config, uploaded, downloaded int) (float64, bool) {
+	if conf.MinRatio <= 0 || downloaded <= conf.RatioGrace {
+		return 0, false
+	}
+	ratio := float64(uploaded) / float64(downloaded)
+	return ratio, ratio < conf.MinRatio
+}
+
+// checkRatio reports whether a leeching announce is refused peers for the
+// ratio of its announce key, and if so warns it. If the ratio or the
+// promotions cannot be loaded, the announce is not refused.
+func checkRatio(ctx context.Context, conf config.Config, announce *config.Announce) bool {
+	if conf.MinRatio <= 0 || announce.Amount_left == 0 {
+		return false
+	}
+
+	var uploaded, downloaded int
+	err := conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    uploaded,
+		    downloaded
+		FROM
+		    peers
+		WHERE
+		    announce_key = $1
+		`,
+		announce.Announce_key).Scan(&uploaded, &downloaded)
+	if err != nil {
+		log.Printf("Error fetching ratio for enforcement: %v", err)
+		return false
+	}
+	ratio, below := belowRatio(conf, uploaded, downloaded)
+	if !below {
+		return false
+	}
+
+	set, err := currentPromotions(ctx, conf)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	if set.freeleech(announce.Info_hash, conf.Now()) {
+		return false
+	}
+
+	addWarning(announce, locale.Sprintf(announce.Language, RatioWarning, ratio, conf.MinRatio))
+	return true
+}
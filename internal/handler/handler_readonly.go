@@ -0,0 +1,325 @@
+// Read-only mode allows planned Postgres maintenance without dropping
+// swarms. Every announce also records its peer in a swarm cache in Redis.
+// While read-only, announces are answered from that cache and nothing is
+// written to Postgres; instead the announces are buffered in Redis, and
+// replayed in order once read-only mode is disabled, so that upload and
+// download statistics are not lost. An announce being replayed is moved to
+// a processing list until it is written, so that one which was in flight
+// when a tracker crashed is recovered at the next startup, and written at
+// least once.
+//
+// While read-only, nothing is read from Postgres either. Announce keys and
+// infohashes are validated only from the Redis cache, which is populated by
+// normal operation, and bans and ACLs only from the copies each tracker
+// instance last loaded, see checkAnnounce. An announce whose key or
+// infohash is not cached is refused, so keys and infohashes never seen
+// before cannot announce while read-only. Peers are given up to the number
+// requested, limited under load, since the peering algorithms need
+// Postgres, and the interval is personalized to the swarm as counted from
+// the cache.
+package handler
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/bencode"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNotCached is returned when an announce is checked while read-only and
+// something it must be checked against is not cached, see checkAnnounce.
+var ErrNotCached = errors.New("not cached while read-only")
+
+// ReadOnlyFailure is the failure reason sent to announces refused with
+// ErrNotCached.
+const ReadOnlyFailure = "tracker is temporarily read-only and cannot check this announce, retry later"
+
+// notCached returns ErrNotCached for a cache lookup of what which failed
+// with err, which is nil or redis.Nil on a plain cache miss.
+func notCached(what string, err error) error {
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("%w: %s: %v", ErrNotCached, what, err)
+	}
+	return fmt.Errorf("%w: %s", ErrNotCached, what)
+}
+
+// bufferedAnnounce is an announce received while read-only, with the time
+// it was received.
+type bufferedAnnounce struct {
+	Announce config.Announce
+	Time     time.Time
+}
+
+// fixedClock is a config.Clock stopped at a single time, used to replay
+// announces at the time they were received.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+// ReadOnly returns whether read-only mode is enabled.
+func ReadOnly(ctx context.Context, conf config.Config) (bool, error) {
+	n, err := conf.Rdb.Exists(ctx, "readonly").Result()
+	if err != nil {
+		return false, fmt.Errorf("error fetching read-only mode: %w", err)
+	}
+	return n > 0, nil
+}
+
+// BufferedAnnounces returns the number of announces waiting to be replayed,
+// including any left in processing by a crashed replay.
+func BufferedAnnounces(ctx context.Context, conf config.Config) (int64, error) {
+	pipe := conf.Rdb.Pipeline()
+	buffered := pipe.LLen(ctx, "readonly:announces")
+	processing := pipe.LLen(ctx, "readonly:processing")
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("error counting buffered announces: %w", err)
+	}
+	return buffered.Val() + processing.Val(), nil
+}
+
+// SetReadOnly enables or disables read-only mode. When disabling, buffered
+// announces are replayed into Postgres.
+func SetReadOnly(ctx context.Context, conf config.Config, enabled bool) error {
+	if enabled {
+		if err := conf.Rdb.Set(ctx, "readonly", "true", 0).Err(); err != nil {
+			return fmt.Errorf("error enabling read-only mode: %w", err)
+		}
+		return nil
+	}
+
+	if err := conf.Rdb.Del(ctx, "readonly").Err(); err != nil {
+		return fmt.Errorf("error disabling read-only mode: %w", err)
+	}
+
+	return ReplayAnnounces(ctx, conf)
+}
+
+// RecoverAnnounces returns any announces left in processing by a replay
+// which did not finish, such as when the tracker crashed between taking an
+// announce from the buffer and writing it, to the front of the buffer in
+// their original order. It returns the number recovered. It must not run
+// while another tracker instance is replaying, see server.Run.
+func RecoverAnnounces(ctx context.Context, conf config.Config) (int, error) {
+	recovered := 0
+	for {
+		err := conf.Rdb.LMove(ctx, "readonly:processing", "readonly:announces", "RIGHT", "LEFT").Err()
+		if errors.Is(err, redis.Nil) {
+			return recovered, nil
+		}
+		if err != nil {
+			return recovered, fmt.Errorf("error recovering buffered announce: %w", err)
+		}
+		recovered++
+	}
+}
+
+// ReplayAnnounces writes buffered announces to Postgres in the order they
+// were received. Each announce is moved to a processing list while it is
+// written, and only removed once the write succeeds, see RecoverAnnounces.
+// If an announce cannot be written, it is returned to the front of the
+// buffer and replay stops.
+func ReplayAnnounces(ctx context.Context, conf config.Config) error {
+	for {
+		data, err := conf.Rdb.LMove(ctx, "readonly:announces", "readonly:processing", "LEFT", "RIGHT").Bytes()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+			return fmt.Errorf("error fetching buffered announce: %w", err)
+		}
+
+		var buffered bufferedAnnounce
+		if err = json.Unmarshal(data, &buffered); err != nil {
+			// A corrupt entry can never be replayed, so it is dropped.
+			log.Printf("Dropping buffered announce: %v", err)
+			if err = conf.Rdb.LRem(ctx, "readonly:processing", 1, data).Err(); err != nil {
+				return fmt.Errorf("error dropping buffered announce: %w", err)
+			}
+			continue
+		}
+
+		replayConf := conf
+		replayConf.Clock = fixedClock(buffered.Time)
+
+		if err = writeAnnounce(ctx, replayConf, &buffered.Announce); err != nil {
+			if moveErr := conf.Rdb.LMove(ctx, "readonly:processing", "readonly:announces", "RIGHT", "LEFT").Err(); moveErr != nil {
+				return fmt.Errorf("error returning buffered announce: %w", moveErr)
+			}
+			return fmt.Errorf("error replaying announce: %w", err)
+		}
+
+		if err = conf.Rdb.LRem(ctx, "readonly:processing", 1, data).Err(); err != nil {
+			return fmt.Errorf("error removing replayed announce: %w", err)
+		}
+
+		// Key activity is only used for analytics, so it is not retried.
+		_ = recordKeyActivity(ctx, replayConf, &buffered.Announce)
+	}
+}
+
+// swarmMember is the swarm cache member for a peer, which like the announces
+// table is identified by announce key and peer_id. Announce keys and the
+// encoded peer_id are hex, so the separators are unambiguous.
+func swarmMember(announce_key string, peer_id []byte, ip_port []byte) string {
+	return announce_key + "|" + hex.EncodeToString(peer_id) + "|" + string(ip_port)
+}
+
+// cacheSwarm records a peer in the swarm cache, a sorted set per infohash
+// scored by announce time, with the members which are seeding in a set
+// alongside it. Stopped peers are removed, as are any peers which have gone
+// stale. Peers which cannot be given to other peers, such as browser peers,
+// are removed as well, since the cache is read first when replying to
+// announces, see selectPeers. Stale members of the seeders set are left
+// until the set expires, since only members of the sorted set are read.
+func cacheSwarm(ctx context.Context, conf config.Config, announce *config.Announce, ip_port []byte, reachable bool) error {
+	key := "swarm:" + string(announce.Info_hash)
+	seedersKey := "seeders:" + string(announce.Info_hash)
+	member := swarmMember(announce.Announce_key, announce.Peer_id, ip_port)
+	now := conf.Now()
+
+	pipe := conf.Rdb.Pipeline()
+	if announce.Event == config.Stopped || !reachable {
+		pipe.ZRem(ctx, key, member)
+		pipe.SRem(ctx, seedersKey, member)
+	} else {
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.Unix()), Member: member})
+		if announce.Amount_left == 0 {
+			pipe.SAdd(ctx, seedersKey, member)
+		} else {
+			pipe.SRem(ctx, seedersKey, member)
+		}
+	}
+	pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(conf.StaleCutoff().Unix(), 10))
+	pipe.Expire(ctx, key, config.StaleInterval*time.Second)
+	pipe.Expire(ctx, seedersKey, config.StaleInterval*time.Second)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error caching swarm: %w", err)
+	}
+
+	return nil
+}
+
+// DropCachedPeer removes a peer from the swarm cache of an infohash, such
+// as when it is reported as not connectable. The ip_port is as stored at
+// rest.
+func DropCachedPeer(ctx context.Context, conf config.Config, info_hash []byte, announce_key string, peer_id []byte, ip_port []byte) error {
+	member := swarmMember(announce_key, peer_id, ip_port)
+	pipe := conf.Rdb.Pipeline()
+	pipe.ZRem(ctx, "swarm:"+string(info_hash), member)
+	pipe.SRem(ctx, "seeders:"+string(info_hash), member)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error removing peer from swarm cache: %w", err)
+	}
+	return nil
+}
+
+// cachedPeers returns the candidate peers for an announce from the swarm
+// cache.
+func cachedPeers(ctx context.Context, conf config.Config, a *config.Announce) ([]bencode.Peer, error) {
+	pipe := conf.Rdb.Pipeline()
+	membersCmd := pipe.ZRangeByScore(ctx, "swarm:"+string(a.Info_hash), &redis.ZRangeBy{
+		Min: strconv.FormatInt(conf.StaleCutoff().Unix(), 10),
+		Max: "+inf",
+	})
+	seedersCmd := pipe.SMembersMap(ctx, "seeders:"+string(a.Info_hash))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("error fetching cached swarm: %w", err)
+	}
+	members := membersCmd.Val()
+	seeders := seedersCmd.Val()
+
+	// As in storedPeers, peers are deduplicated by ip_port, and the client
+	// itself is excluded by peer_id or ip_port.
+	own_peer_id := hex.EncodeToString(a.Peer_id)
+	own_ip_port := string(hashAtRest(conf, a.Ip_port))
+	seen := make(map[string]bool)
+	var peers []bencode.Peer
+	for _, member := range members {
+		parts := strings.SplitN(member, "|", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		announce_key, peer_id, ip_port := parts[0], parts[1], parts[2]
+		if announce_key == a.Announce_key && (peer_id == own_peer_id || ip_port == own_ip_port) {
+			continue
+		}
+		if seen[ip_port] {
+			continue
+		}
+		seen[ip_port] = true
+		decoded, _ := hex.DecodeString(peer_id)
+		_, seeding := seeders[member]
+		peers = append(peers, bencode.Peer{Ip_port: []byte(ip_port), Peer_id: decoded, Seeding: seeding})
+	}
+
+	return resolveIpPorts(ctx, conf, peers)
+}
+
+// serveReadOnly answers an announce from the swarm cache, and buffers it for
+// replay. As in sendReply, the interval is personalized and lengthened under
+// load, and fewer peers are given under load.
+func serveReadOnly(ctx context.Context, conf config.Config, w http.ResponseWriter, a *config.Announce) error {
+	peers, err := cachedPeers(ctx, conf, a)
+	if err != nil {
+		writeTrackerError(a.Language, DefaultTrackerError, w)
+		return err
+	}
+	a.Decision.SetCandidates("redis", len(peers))
+
+	data, err := json.Marshal(bufferedAnnounce{Announce: *a, Time: conf.Now()})
+	if err != nil {
+		writeTrackerError(a.Language, DefaultTrackerError, w)
+		return fmt.Errorf("error encoding announce: %w", err)
+	}
+	if err = conf.Rdb.RPush(ctx, "readonly:announces", data).Err(); err != nil {
+		writeTrackerError(a.Language, DefaultTrackerError, w)
+		return fmt.Errorf("error buffering announce: %w", err)
+	}
+
+	// The swarm is counted from the cache, including the client itself, to
+	// personalize the interval. Since cached peers are deduplicated by
+	// ip_port and partial seeds are not told apart, the counts are only
+	// approximate, so they are not sent.
+	counts := &swarmCounts{}
+	for _, peer := range peers {
+		if peer.Seeding {
+			counts.complete++
+		} else {
+			counts.incomplete++
+		}
+	}
+	if a.Amount_left == 0 {
+		counts.complete++
+	} else {
+		counts.incomplete++
+	}
+	limits := loadLimits(conf)
+	interval, minInterval := personalInterval(conf, counts, a.Amount_left == 0)
+	reply := bencode.AnnounceResponse{
+		TrackerID:   conf.TrackerID,
+		Peers:       peers,
+		Interval:    interval * limits.Interval / config.Interval,
+		MinInterval: minInterval,
+	}
+	numToGive := min(a.Numwant, limits.Numwant)
+	a.Decision.SetNumToGive(numToGive)
+	if err = writePeers(w, a, reply, numToGive); err != nil {
+		return err
+	}
+
+	ip_port, err := storeIpPort(ctx, conf, a.Ip_port)
+	if err != nil {
+		return err
+	}
+	return cacheSwarm(ctx, conf, a, ip_port, !a.Webrtc)
+}
@@ -0,0 +1,129 @@
+// A rotation campaign, run after a suspected leak of the announce keys,
+// marks every existing key to be rotated by a deadline. Until the deadline,
+// announces with a marked key are answered as usual but with a warning
+// linking to the self-service rotation page; after it, they are refused.
+// The deadline of each key is stored in Postgres as peers.rotate_by, which
+// rotating the key clears, and cached in Redis as a persistent key, since it
+// only changes when a campaign is started or cancelled, see RotationChanged.
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/locale"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrKeyExpired = errors.New("announce key expired")
+
+// RotationWarning is the warning sent with replies to announces with a key
+// which must be rotated, with the deadline and the rotation link.
+const RotationWarning = "your announce url must be replaced by %s, get a new one at %s"
+
+// RotationDeadlineFormat is the format of the deadline in RotationWarning.
+const RotationDeadlineFormat = "2006-01-02 15:04 MST"
+
+// RotationURL returns the self-service rotation page for an announce key,
+// which is served by the frontend under the configured PublicURL.
+func RotationURL(conf config.Config, announce_key string) string {
+	return strings.TrimSuffix(conf.PublicURL, "/") + "/rotate?" + url.Values{"announce_key": {announce_key}}.Encode()
+}
+
+// keyRotateBy returns the deadline by which an announce key must be rotated,
+// or the zero time if it need not be. If cacheOnly is set, ErrNotCached is
+// returned on a cache miss.
+func keyRotateBy(ctx context.Context, conf config.Config, announce_key string, cacheOnly bool) (time.Time, error) {
+	cached, err := conf.Rdb.Get(ctx, "rotate_by:"+announce_key).Result()
+	if err == nil {
+		if cached == "" {
+			return time.Time{}, nil
+		}
+		if deadline, err := time.Parse(time.RFC3339Nano, cached); err == nil {
+			return deadline, nil
+		}
+	}
+	if cacheOnly {
+		return time.Time{}, notCached("rotation deadline", err)
+	}
+	if err != nil && err != redis.Nil {
+		// An issue with the cache must be logged but is not fatal.
+		log.Printf("Error fetching rotation deadline from cache: %v", err)
+	}
+
+	var rotate_by *time.Time
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    rotate_by
+		FROM
+		    peers
+		WHERE
+		    announce_key = $1
+		`,
+		announce_key).Scan(&rotate_by)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, fmt.Errorf("error checking peers for rotation deadline: %w", err)
+	}
+
+	var deadline time.Time
+	cached = ""
+	if rotate_by != nil {
+		deadline = *rotate_by
+		cached = deadline.Format(time.RFC3339Nano)
+	}
+	err = conf.Rdb.Set(ctx, "rotate_by:"+announce_key, cached, 0).Err()
+	if err != nil {
+		// An issue with the cache must be logged but is not fatal.
+		log.Printf("Error setting rotation deadline in cache: %v", err)
+	}
+
+	return deadline, nil
+}
+
+// checkRotation refuses announces with a key whose rotation deadline has
+// passed, and warns announces with a key which must be rotated before it.
+func checkRotation(ctx context.Context, conf config.Config, announce *config.Announce, cacheOnly bool) error {
+	deadline, err := keyRotateBy(ctx, conf, announce.Announce_key, cacheOnly)
+	if err != nil {
+		return err
+	}
+	if deadline.IsZero() {
+		return nil
+	}
+	if !conf.Now().Before(deadline) {
+		return ErrKeyExpired
+	}
+
+	addWarning(announce, locale.Sprintf(announce.Language, RotationWarning,
+		deadline.UTC().Format(RotationDeadlineFormat), RotationURL(conf, announce.Announce_key)))
+	return nil
+}
+
+// RotationChanged clears the cached rotation deadlines of every announce
+// key. It must be called after a campaign is started or cancelled. Rotating
+// a single key only needs its own entry cleared.
+func RotationChanged(ctx context.Context, conf config.Config) error {
+	var keys []string
+	iter := conf.Rdb.Scan(ctx, 0, "rotate_by:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("error scanning rotation deadlines: %w", err)
+	}
+	for len(keys) > 0 {
+		batch := keys[:min(len(keys), 1000)]
+		keys = keys[len(batch):]
+		if err := conf.Rdb.Unlink(ctx, batch...).Err(); err != nil {
+			return fmt.Errorf("error clearing rotation deadlines: %w", err)
+		}
+	}
+	return nil
+}
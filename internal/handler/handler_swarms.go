@@ -0,0 +1,178 @@
+// The swarm cache in Redis and the last peers served from memory are lost
+// when Redis or the tracker restarts, so that read-only trackers and
+// fallback replies would give no peers until clients announce again, a full
+// announce interval later. SaveSwarms writes them to a file on shutdown, and
+// RestoreSwarms loads them on startup, leaving out peers which have gone
+// stale in between. The file holds peer addresses, so it is not written in
+// privacy mode.
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/bencode"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrSwarmsPrivacy = errors.New("swarms are not saved in privacy mode")
+
+// swarmFile is the state written by SaveSwarms. Infohashes and members are
+// binary, so they are base64-encoded as []byte.
+type swarmFile struct {
+	Time   time.Time    `json:"time"`
+	Swarms []savedSwarm `json:"swarms"`
+}
+
+type savedSwarm struct {
+	Info_hash []byte         `json:"info_hash"`
+	Members   []savedMember  `json:"members,omitempty"`
+	Seeders   [][]byte       `json:"seeders,omitempty"`
+	Served    []bencode.Peer `json:"served,omitempty"`
+}
+
+// savedMember is a member of the swarm cache, see swarmMember, with its
+// announce time as score.
+type savedMember struct {
+	Member []byte  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// SaveSwarms writes the swarm cache and the last peers served to path,
+// replacing it atomically.
+func SaveSwarms(ctx context.Context, conf config.Config, path string) error {
+	if conf.PrivacySalt != "" {
+		return ErrSwarmsPrivacy
+	}
+
+	swarms := make(map[string]*savedSwarm)
+	swarm := func(info_hash string) *savedSwarm {
+		if swarms[info_hash] == nil {
+			swarms[info_hash] = &savedSwarm{Info_hash: []byte(info_hash)}
+		}
+		return swarms[info_hash]
+	}
+
+	cutoff := strconv.FormatInt(conf.StaleCutoff().Unix(), 10)
+	iter := conf.Rdb.Scan(ctx, 0, "swarm:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		members, err := conf.Rdb.ZRangeByScoreWithScores(ctx, iter.Val(), &redis.ZRangeBy{Min: cutoff, Max: "+inf"}).Result()
+		if err != nil {
+			return fmt.Errorf("error reading swarm cache: %w", err)
+		}
+		s := swarm(strings.TrimPrefix(iter.Val(), "swarm:"))
+		for _, z := range members {
+			member, _ := z.Member.(string)
+			s.Members = append(s.Members, savedMember{Member: []byte(member), Score: z.Score})
+		}
+		seeders, err := conf.Rdb.SMembers(ctx, "seeders:"+string(s.Info_hash)).Result()
+		if err != nil {
+			return fmt.Errorf("error reading swarm cache: %w", err)
+		}
+		for _, member := range seeders {
+			s.Seeders = append(s.Seeders, []byte(member))
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("error scanning swarm cache: %w", err)
+	}
+
+	lastServed.mu.Lock()
+	for info_hash, peers := range lastServed.swarms {
+		swarm(info_hash).Served = peers
+	}
+	lastServed.mu.Unlock()
+
+	file := swarmFile{Time: conf.Now()}
+	for _, s := range swarms {
+		file.Swarms = append(file.Swarms, *s)
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("error encoding swarms: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".swarms-*")
+	if err != nil {
+		return fmt.Errorf("error saving swarms: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error saving swarms: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("error saving swarms: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error saving swarms: %w", err)
+	}
+
+	return nil
+}
+
+// RestoreSwarms loads the swarms saved by SaveSwarms at path, if it exists.
+// Members of the swarm cache which have gone stale are left out, and newer
+// announces already in the cache are kept. The last peers served are only
+// restored if they were saved within the stale interval. It returns the
+// number of swarm cache members restored.
+func RestoreSwarms(ctx context.Context, conf config.Config, path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error reading swarms: %w", err)
+	}
+
+	var file swarmFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return 0, fmt.Errorf("error decoding swarms: %w", err)
+	}
+
+	cutoff := float64(conf.StaleCutoff().Unix())
+	fresh := file.Time.After(conf.StaleCutoff())
+	restored := 0
+
+	pipe := conf.Rdb.Pipeline()
+	for _, s := range file.Swarms {
+		var members []redis.Z
+		for _, m := range s.Members {
+			if m.Score >= cutoff {
+				members = append(members, redis.Z{Score: m.Score, Member: string(m.Member)})
+			}
+		}
+		if len(members) > 0 {
+			key := "swarm:" + string(s.Info_hash)
+			pipe.ZAddGT(ctx, key, members...)
+			pipe.Expire(ctx, key, config.StaleInterval*time.Second)
+			restored += len(members)
+		}
+		if len(members) > 0 && len(s.Seeders) > 0 {
+			seeders := make([]any, len(s.Seeders))
+			for i, member := range s.Seeders {
+				seeders[i] = string(member)
+			}
+			key := "seeders:" + string(s.Info_hash)
+			pipe.SAdd(ctx, key, seeders...)
+			pipe.Expire(ctx, key, config.StaleInterval*time.Second)
+		}
+
+		if fresh && len(s.Served) > 0 {
+			lastServed.store(s.Info_hash, s.Served)
+		}
+	}
+	if _, err = pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("error restoring swarm cache: %w", err)
+	}
+
+	return restored, nil
+}
@@ -3,20 +3,29 @@ package handler
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"log"
+	"maps"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/dmoerner/etracker/internal/bencode"
 	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/debuglog"
+	"github.com/dmoerner/etracker/internal/geoip"
 	"github.com/dmoerner/etracker/internal/testutils"
 
-	bencode "github.com/jackpal/bencode-go"
+	bencode_go "github.com/jackpal/bencode-go"
+	"github.com/redis/go-redis/v9"
 )
 
 type RequestResponseWrapper struct {
@@ -28,64 +37,20 @@ const (
 	deniedInfoHash = "denydenydenydenydeny"
 )
 
-// createNSeeders is a helper function which creates n request structs for a
-// specified info_hash. Used to populate the handler with many existing
-// seeders.
-func createNSeeders(ctx context.Context, conf config.Config, n int, info_hash string) []testutils.Request {
-	var requests []testutils.Request
-
-	for range n {
-		announce_key, err := config.GenerateAnnounceKey(ctx, conf)
-		if err != nil {
-			log.Fatalf("createNSeeders: Unable to generate announce keys: %v", err)
-		}
-		requests = append(requests, testutils.Request{
-			AnnounceKey: announce_key,
-			Info_hash:   info_hash,
-		})
-	}
-
-	return requests
-}
-
-// seedNTorrents is a helper function which adds n torrents with random
-// info_hashes to a particular announce_key. This also requires inserting these
-// info_hashes into the allowlist in the test db. Used to mimic good or bad
-// seeding behavior.
-func seedNTorrents(ctx context.Context, conf config.Config, n int, announce_key string) []testutils.Request {
-	var requests []testutils.Request
-
-	for i := range n {
-		info_hash := make([]byte, 20)
-		_, _ = rand.Read(info_hash)
-		_, err := conf.Dbpool.Exec(ctx, `
-			INSERT INTO infohashes (info_hash, name)
-			    VALUES ($1, $2)
-			`, info_hash, fmt.Sprintf("test infohash %d", i))
-		if err != nil {
-			log.Fatalf("Unable to insert test allowed infohashes: %v", err)
-		}
-		requests = append(requests, testutils.Request{
-			AnnounceKey: announce_key,
-			Info_hash:   string(info_hash),
-		})
-	}
-	return requests
-}
-
 // countPeersReceived is a helper function which reads in a compact HTTP
 // tracker response and returns the number of peers.
 func countPeersReceived(recorder *httptest.ResponseRecorder) int {
 	resp := recorder.Result()
-	data, err := bencode.Decode(resp.Body)
+	data, err := bencode_go.Decode(resp.Body)
 	if err != nil {
 		return 0
 	}
 
-	// Use type assertions to extract the compacted peerlist, which
-	// uses 6 bytes per peer.
+	// Use type assertions to extract the compacted peerlists, which
+	// use 6 bytes per IPv4 peer and 18 bytes per IPv6 peer.
 	peersReceived := []byte(data.(map[string]any)["peers"].(string))
-	numRec := len(peersReceived) / 6
+	peers6Received := []byte(data.(map[string]any)["peers6"].(string))
+	numRec := len(peersReceived)/6 + len(peers6Received)/18
 
 	return numRec
 }
@@ -333,22 +298,112 @@ func TestStopped(t *testing.T) {
 	}
 }
 
-func TestPeersForRatio(t *testing.T) {
+func TestNumwantZero(t *testing.T) {
 	ctx := context.Background()
-	tc, conf := testutils.BuildTestConfig(ctx, PeersForRatio, testutils.DefaultAPIKey)
+	tc, conf := testutils.BuildTestConfig(ctx, DefaultAlgorithm, testutils.DefaultAPIKey)
 	defer testutils.TeardownTest(ctx, tc, conf)
 
-	// Populate 50 seeders
-	seeders := createNSeeders(ctx, conf, 50, testutils.AllowedInfoHashes["a"])
+	handler := PeerHandler(ctx, conf)
+
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Numwant:     50,
+	}))
+
+	// A seeder announcing with numwant=0 gets no peers, even though the
+	// algorithm would otherwise give it the minimum, but its statistics
+	// are still recorded.
+	w := httptest.NewRecorder()
+	handler(w, testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[2],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Uploaded:    100,
+		Left:        0,
+	}))
+
+	data, err := bencode_go.Decode(w.Result().Body)
+	if err != nil {
+		t.Fatalf("failure decoding tracker response: %v", err)
+	}
+	reply := data.(map[string]any)
+	if _, ok := reply["interval"]; !ok {
+		t.Errorf("expected interval in reply, got %v", reply)
+	}
+	if peers, ok := reply["peers"].(string); !ok || len(peers) != 0 {
+		t.Errorf("expected empty peer list, got %v", reply["peers"])
+	}
+	if reply["complete"] != int64(2) || reply["incomplete"] != int64(0) {
+		t.Errorf("expected counts of 2 seeders and no leechers, got %v and %v", reply["complete"], reply["incomplete"])
+	}
+
+	var uploaded int
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    uploaded
+		FROM
+		    announces
+		    JOIN peers ON announces.peers_id = peers.id
+		WHERE
+		    announce_key = $1
+		`, testutils.AnnounceKeys[2]).Scan(&uploaded)
+	if err != nil {
+		t.Fatalf("error querying announce: %v", err)
+	}
+	if uploaded != 100 {
+		t.Errorf("expected %d uploaded, got %d", 100, uploaded)
+	}
+}
+
+func TestStale(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, NumwantPeers, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	// Run the tracker far ahead of the database clock, to check that
+	// staleness depends only on the configured clock.
+	clock := testutils.NewFakeClock(time.Now().AddDate(1, 0, 0))
+	conf.Clock = clock
 
 	handler := PeerHandler(ctx, conf)
 
-	for _, r := range seeders {
-		req := testutils.CreateTestAnnounce(r)
+	announce := func(key string) int {
+		req := testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: key,
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Numwant:     1,
+		})
 		w := httptest.NewRecorder()
 		handler(w, req)
+		return countPeersReceived(w)
 	}
 
+	announce(testutils.AnnounceKeys[1])
+
+	if numRec := announce(testutils.AnnounceKeys[2]); numRec != 1 {
+		t.Errorf("expected 1 peer before stale interval, received %d", numRec)
+	}
+
+	clock.Advance((config.StaleInterval + 1) * time.Second)
+
+	if numRec := announce(testutils.AnnounceKeys[2]); numRec != 0 {
+		t.Errorf("expected 0 peers after stale interval, received %d", numRec)
+	}
+}
+
+func TestPeersForRatio(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, PeersForRatio, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	handler := PeerHandler(ctx, conf)
+
+	// Populate 50 seeders
+	testutils.Scenario{
+		Info_hashes: []string{testutils.AllowedInfoHashes["a"]},
+		Seeders:     50,
+	}.Run(t, ctx, conf, handler)
+
 	// Test new bad seeder, they are not currently in the swarm but receive full amount.
 	newSeederRequest := testutils.Request{
 		AnnounceKey: testutils.AnnounceKeys[1],
@@ -415,16 +470,13 @@ func TestPeersForGoodSeedsBigSwarm(t *testing.T) {
 	tc, conf := testutils.BuildTestConfig(ctx, PeersForGoodSeeds, testutils.DefaultAPIKey)
 	defer testutils.TeardownTest(ctx, tc, conf)
 
-	// Populate 50 seeders
-	seeders := createNSeeders(ctx, conf, 50, testutils.AllowedInfoHashes["a"])
-
 	handler := PeerHandler(ctx, conf)
 
-	for _, r := range seeders {
-		req := testutils.CreateTestAnnounce(r)
-		w := httptest.NewRecorder()
-		handler(w, req)
-	}
+	// Populate 50 seeders
+	seeders := testutils.Scenario{
+		Info_hashes: []string{testutils.AllowedInfoHashes["a"]},
+		Seeders:     50,
+	}.Run(t, ctx, conf, handler).Requests()
 
 	// Test bad seeder, they are not currently in the swarm.
 	badSeederRequest := testutils.Request{
@@ -451,12 +503,11 @@ func TestPeersForGoodSeedsBigSwarm(t *testing.T) {
 	}
 	goodSeederExpected := goodSeederRequest.Numwant
 
-	goodSeederSeeds := seedNTorrents(ctx, conf, 5, goodSeederRequest.AnnounceKey)
-	for _, r := range goodSeederSeeds {
-		req := testutils.CreateTestAnnounce(r)
-		w := httptest.NewRecorder()
-		handler(w, req)
-	}
+	testutils.Scenario{
+		Torrents: 5,
+		Seeders:  1,
+		Keys:     []string{goodSeederRequest.AnnounceKey},
+	}.Run(t, ctx, conf, handler)
 
 	goodSeederRecorder := httptest.NewRecorder()
 	handler(goodSeederRecorder,
@@ -668,7 +719,7 @@ func TestDenylistInfoHash(t *testing.T) {
 	handler(w, req)
 
 	resp := w.Result()
-	data, err := bencode.Decode(resp.Body)
+	data, err := bencode_go.Decode(resp.Body)
 	if err != nil {
 		t.Errorf("failure decoding tracker response: %v", err)
 	}
@@ -683,7 +734,7 @@ func TestDisableAllowlist(t *testing.T) {
 	tc, conf := testutils.BuildTestConfig(ctx, PeersForSeeds, testutils.DefaultAPIKey)
 	defer testutils.TeardownTest(ctx, tc, conf)
 
-	conf.DisableAllowlist = true
+	conf.UpdateSettings(func(s *config.Settings) { s.DisableAllowlist = true })
 
 	request := testutils.Request{
 		AnnounceKey: testutils.AnnounceKeys[1],
@@ -699,7 +750,7 @@ func TestDisableAllowlist(t *testing.T) {
 	handler(w, req)
 
 	resp := w.Result()
-	data, err := bencode.Decode(resp.Body)
+	data, err := bencode_go.Decode(resp.Body)
 	if err != nil {
 		t.Errorf("failure decoding tracker response: %v", err)
 	}
@@ -793,7 +844,7 @@ func TestUntrackedAnnounce(t *testing.T) {
 	handler(w, req)
 
 	resp := w.Result()
-	data, err := bencode.Decode(resp.Body)
+	data, err := bencode_go.Decode(resp.Body)
 	if err != nil {
 		t.Errorf("failure decoding tracker response: %v", err)
 	}
@@ -803,6 +854,35 @@ func TestUntrackedAnnounce(t *testing.T) {
 	}
 }
 
+func TestFailureCaching(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	conf.FailureCacheTTL = time.Minute
+	handler := PeerHandler(ctx, conf)
+
+	data := []struct {
+		name         string
+		request      testutils.Request
+		cacheControl string
+	}{
+		{"untracked key", testutils.Request{AnnounceKey: testutils.UntrackedAnnounceKey, Info_hash: testutils.AllowedInfoHashes["a"]}, "public, max-age=60"},
+		{"denied infohash", testutils.Request{AnnounceKey: testutils.AnnounceKeys[1], Info_hash: deniedInfoHash}, "public, max-age=60"},
+		{"accepted", testutils.Request{AnnounceKey: testutils.AnnounceKeys[1], Info_hash: testutils.AllowedInfoHashes["a"]}, "no-store"},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, testutils.CreateTestAnnounce(d.request))
+			if received := w.Header().Get("Cache-Control"); received != d.cacheControl {
+				t.Errorf("expected Cache-Control %q, got %q", d.cacheControl, received)
+			}
+		})
+	}
+}
+
 // An attempt to start to benchmark core functions. Move as much setup as possible
 // outside of the benchmark loop. Preliminary benchmarking shows that using Redis to
 // cache announce key and infohash allowlist lookups leads to an improvement in speed
@@ -813,7 +893,10 @@ func BenchmarkPeersForRatio(b *testing.B) {
 	defer testutils.TeardownTest(ctx, tc, conf)
 	handler := PeerHandler(ctx, conf)
 
-	peers := createNSeeders(ctx, conf, 10, testutils.AllowedInfoHashes["a"])
+	peers := testutils.Scenario{
+		Info_hashes: []string{testutils.AllowedInfoHashes["a"]},
+		Seeders:     10,
+	}.Run(b, ctx, conf, handler).Requests()
 
 	var reqs []http.Request
 
@@ -829,3 +912,1480 @@ func BenchmarkPeersForRatio(b *testing.B) {
 		}
 	}
 }
+
+func TestClientFromPeerID(t *testing.T) {
+	data := []struct {
+		name     string
+		peer_id  string
+		expected string
+	}{
+		{"azureus style", "-qB4650-abcdefghijkl", "qB4650"},
+		{"shadow style", "M7-2-2--abcdefghijkl", "M"},
+		{"binary", "\x00\x01\x02", "unknown"},
+		{"empty", "", "unknown"},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			if received := clientFromPeerID(d.peer_id); received != d.expected {
+				t.Errorf("expected %s, got %s", d.expected, received)
+			}
+		})
+	}
+}
+
+func TestPrivacyMode(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, NumwantPeers, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	conf.PrivacySalt = "testsalt"
+
+	requests := []testutils.Request{
+		{
+			AnnounceKey: testutils.AnnounceKeys[1],
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Port:        6881,
+			Numwant:     50,
+		},
+		{
+			AnnounceKey: testutils.AnnounceKeys[2],
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Port:        6882,
+			Numwant:     50,
+		},
+	}
+
+	handler := PeerHandler(ctx, conf)
+
+	var w *httptest.ResponseRecorder
+	for _, r := range requests {
+		req := testutils.CreateTestAnnounce(r)
+		w = httptest.NewRecorder()
+		handler(w, req)
+	}
+
+	// The second peer must still receive the first peer's real address.
+	data, err := bencode_go.Decode(w.Result().Body)
+	if err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	expected, _ := encodeAddr("192.0.2.1:1234", "6881")
+	received := []byte(data.(map[string]any)["peers"].(string))
+	if !bytes.Equal(expected, received) {
+		t.Errorf("expected peers %v, got %v", expected, received)
+	}
+
+	// But no raw addresses may be stored in Postgres.
+	var stored []byte
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    ip_port
+		FROM
+		    announces
+		    JOIN peers ON announces.peers_id = peers.id
+		WHERE
+		    announce_key = $1
+		`,
+		testutils.AnnounceKeys[1]).Scan(&stored)
+	if err != nil {
+		t.Fatalf("error querying test db: %v", err)
+	}
+	if bytes.Equal(expected, stored) {
+		t.Errorf("raw ip_port stored in privacy mode")
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	handler := PeerHandler(ctx, conf)
+	announce := func() []byte {
+		req := testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[1],
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+		})
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Body.Bytes()
+	}
+
+	err := SetMaintenance(ctx, conf, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("error enabling maintenance: %v", err)
+	}
+
+	got := announce()
+	if !bytes.Contains(got, []byte("tracker under maintenance, retry in 10m0s")) || !bytes.Contains(got, []byte("8:retry ini10e")) {
+		t.Errorf("expected maintenance failure, got %s", got)
+	}
+
+	err = SetMaintenance(ctx, conf, 0)
+	if err != nil {
+		t.Fatalf("error disabling maintenance: %v", err)
+	}
+
+	if got := announce(); bytes.Contains(got, []byte("failure reason")) {
+		t.Errorf("expected normal reply after maintenance, got %s", got)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	handler := PeerHandler(ctx, conf)
+
+	seeder := testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Port:        6881,
+		Left:        0,
+	}
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(seeder))
+
+	err := SetReadOnly(ctx, conf, true)
+	if err != nil {
+		t.Fatalf("error enabling read-only mode: %v", err)
+	}
+
+	leecher := testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[2],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Port:        6882,
+		Left:        100,
+		Numwant:     10,
+	}
+	w := httptest.NewRecorder()
+	handler(w, testutils.CreateTestAnnounce(leecher))
+
+	if received := countPeersReceived(w); received != 1 {
+		t.Errorf("expected 1 peer from the swarm cache, got %d", received)
+	}
+
+	countAnnounces := func() int {
+		var count int
+		err := conf.Dbpool.QueryRow(ctx, `
+			SELECT
+			    COUNT(*)
+			FROM
+			    announces
+			    JOIN peers ON announces.peers_id = peers.id
+			WHERE
+			    peers.announce_key = $1
+			`, leecher.AnnounceKey).Scan(&count)
+		if err != nil {
+			t.Fatalf("error querying test db: %v", err)
+		}
+		return count
+	}
+
+	if count := countAnnounces(); count != 0 {
+		t.Errorf("expected no announces written while read-only, got %d", count)
+	}
+
+	buffered, err := BufferedAnnounces(ctx, conf)
+	if err != nil || buffered != 1 {
+		t.Errorf("expected 1 buffered announce, got %d (%v)", buffered, err)
+	}
+
+	err = SetReadOnly(ctx, conf, false)
+	if err != nil {
+		t.Fatalf("error disabling read-only mode: %v", err)
+	}
+
+	if count := countAnnounces(); count != 1 {
+		t.Errorf("expected buffered announce to be replayed, got %d announces", count)
+	}
+
+	buffered, err = BufferedAnnounces(ctx, conf)
+	if err != nil || buffered != 0 {
+		t.Errorf("expected empty buffer after replay, got %d (%v)", buffered, err)
+	}
+}
+
+func TestRecoverAnnounces(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	handler := PeerHandler(ctx, conf)
+
+	leecher := testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Left:        100,
+		Uploaded:    1000,
+	}
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(leecher))
+
+	err := SetReadOnly(ctx, conf, true)
+	if err != nil {
+		t.Fatalf("error enabling read-only mode: %v", err)
+	}
+	leecher.Uploaded = 3000
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(leecher))
+
+	// A replay which crashes after taking the announce from the buffer,
+	// but before writing it, leaves it in processing.
+	err = conf.Rdb.LMove(ctx, "readonly:announces", "readonly:processing", "LEFT", "RIGHT").Err()
+	if err != nil {
+		t.Fatalf("error moving buffered announce: %v", err)
+	}
+	err = conf.Rdb.Del(ctx, "readonly").Err()
+	if err != nil {
+		t.Fatalf("error disabling read-only mode: %v", err)
+	}
+
+	uploaded := func() int {
+		var uploaded int
+		err := conf.Dbpool.QueryRow(ctx, `
+			SELECT
+			    uploaded
+			FROM
+			    peers
+			WHERE
+			    announce_key = $1
+			`, leecher.AnnounceKey).Scan(&uploaded)
+		if err != nil {
+			t.Fatalf("error querying test db: %v", err)
+		}
+		return uploaded
+	}
+
+	buffered, err := BufferedAnnounces(ctx, conf)
+	if err != nil || buffered != 1 {
+		t.Errorf("expected the announce in processing to be counted, got %d (%v)", buffered, err)
+	}
+
+	recovered, err := RecoverAnnounces(ctx, conf)
+	if err != nil || recovered != 1 {
+		t.Fatalf("expected 1 recovered announce, got %d (%v)", recovered, err)
+	}
+	err = ReplayAnnounces(ctx, conf)
+	if err != nil {
+		t.Fatalf("error replaying announces: %v", err)
+	}
+
+	if u := uploaded(); u != 3000 {
+		t.Errorf("expected recovered announce to be replayed with 3000 uploaded, got %d", u)
+	}
+	buffered, err = BufferedAnnounces(ctx, conf)
+	if err != nil || buffered != 0 {
+		t.Errorf("expected empty buffer after replay, got %d (%v)", buffered, err)
+	}
+}
+
+func TestReadOnlyCacheOnly(t *testing.T) {
+	ctx := context.Background()
+	// The fake config has no Postgres, so read-only announces must be
+	// checked and answered from the cache alone.
+	conf, _ := testutils.BuildFakeConfig(t, NumwantPeers, testutils.DefaultAPIKey)
+	conf.SwarmIntervals = []config.SwarmInterval{{MinPeers: 0, Interval: 15 * time.Minute}}
+
+	info_hash := testutils.AllowedInfoHashes["a"]
+	for _, key := range []string{testutils.AnnounceKeys[1], testutils.AnnounceKeys[2]} {
+		if err := conf.Rdb.MSet(ctx, "announce:"+key, "true", "rotate_by:"+key, "").Err(); err != nil {
+			t.Fatalf("error caching announce key: %v", err)
+		}
+	}
+	if err := conf.Rdb.MSet(ctx, "info_hash:"+info_hash, InfohashAllowed, "merged:"+info_hash, "").Err(); err != nil {
+		t.Fatalf("error caching infohash: %v", err)
+	}
+	loadedBans.mu.Lock()
+	loadedBans.sets[conf.Rdb] = &banSet{keys: make(map[string]bool)}
+	loadedBans.mu.Unlock()
+	loadedACLs.mu.Lock()
+	loadedACLs.sets[conf.Rdb] = &aclSet{acls: make(map[string]*acl), groups: make(map[string][]string)}
+	loadedACLs.mu.Unlock()
+
+	if err := SetReadOnly(ctx, conf, true); err != nil {
+		t.Fatalf("error enabling read-only mode: %v", err)
+	}
+
+	handler := PeerHandler(ctx, conf)
+
+	seeder := testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   info_hash,
+		Port:        6881,
+		Left:        0,
+	}
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(seeder))
+
+	leecher := testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[2],
+		Info_hash:   info_hash,
+		Port:        6882,
+		Left:        100,
+		Numwant:     10,
+	}
+	w := httptest.NewRecorder()
+	handler(w, testutils.CreateTestAnnounce(leecher))
+
+	if received := countPeersReceived(w); received != 1 {
+		t.Errorf("expected 1 peer from the swarm cache, got %d: %s", received, w.Body.Bytes())
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("8:intervali900e")) {
+		t.Errorf("expected the personalized interval, got %s", w.Body.Bytes())
+	}
+
+	// An infohash which is not cached is refused rather than looked up.
+	uncached := leecher
+	uncached.Info_hash = testutils.AllowedInfoHashes["b"]
+	w = httptest.NewRecorder()
+	handler(w, testutils.CreateTestAnnounce(uncached))
+	if !bytes.Contains(w.Body.Bytes(), []byte(ReadOnlyFailure)) {
+		t.Errorf("expected read-only failure for an uncached infohash, got %s", w.Body.Bytes())
+	}
+
+	buffered, err := BufferedAnnounces(ctx, conf)
+	if err != nil || buffered != 2 {
+		t.Errorf("expected 2 buffered announces, got %d (%v)", buffered, err)
+	}
+}
+
+func TestSharedAnnounceKey(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	handler := PeerHandler(ctx, conf)
+
+	// Two clients behind one NAT announce with the same key, so they share
+	// an IP and differ only by port and peer_id.
+	first := testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Peer_id:     testutils.GeneratePeerID(),
+		Port:        6881,
+		Uploaded:    100,
+	}
+	second := first
+	second.Peer_id = testutils.GeneratePeerID()
+	second.Port = 6882
+
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(first))
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(second))
+
+	// Each client is given the other, but not itself.
+	first.Numwant = 10
+	w := httptest.NewRecorder()
+	handler(w, testutils.CreateTestAnnounce(first))
+	if received := countPeersReceived(w); received != 1 {
+		t.Errorf("expected 1 peer for a client sharing a key, got %d", received)
+	}
+
+	leecher := testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[2],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Port:        6883,
+		Left:        100,
+		Numwant:     10,
+	}
+	w = httptest.NewRecorder()
+	handler(w, testutils.CreateTestAnnounce(leecher))
+	if received := countPeersReceived(w); received != 2 {
+		t.Errorf("expected 2 peers behind the NAT, got %d", received)
+	}
+
+	// Uploads are tracked per client, so both count towards the key.
+	var uploaded int
+	err := conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    uploaded
+		FROM
+		    peers
+		WHERE
+		    announce_key = $1
+		`, first.AnnounceKey).Scan(&uploaded)
+	if err != nil {
+		t.Fatalf("error querying test db: %v", err)
+	}
+	if uploaded != 200 {
+		t.Errorf("expected 200 uploaded for the key, got %d", uploaded)
+	}
+}
+
+func TestRoamingKey(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	handler := PeerHandler(ctx, conf)
+
+	// A client changes networks, and with them its IP and peer_id, but
+	// keeps its BEP 7 key.
+	before := testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Peer_id:     testutils.GeneratePeerID(),
+		Key:         "1A2B3C4D",
+		RemoteAddr:  "192.0.2.1:1234",
+		Port:        6881,
+		Uploaded:    100,
+	}
+	after := before
+	after.Peer_id = testutils.GeneratePeerID()
+	after.RemoteAddr = "198.51.100.1:1234"
+	after.Uploaded = 150
+
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(before))
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(after))
+
+	var rows, uploaded int
+	err := conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    COUNT(*),
+		    MAX(peers.uploaded)
+		FROM
+		    announces
+		    JOIN peers ON announces.peers_id = peers.id
+		WHERE
+		    announce_key = $1
+		`, before.AnnounceKey).Scan(&rows, &uploaded)
+	if err != nil {
+		t.Fatalf("error querying test db: %v", err)
+	}
+	if rows != 1 {
+		t.Errorf("expected 1 announce row for a roaming client, got %d", rows)
+	}
+	if uploaded != 150 {
+		t.Errorf("expected 150 uploaded for a roaming client, got %d", uploaded)
+	}
+
+	// The move is recorded as an IP change, matched by key. A later change
+	// of port alone is not.
+	moved := after
+	moved.Port = 6884
+	moved.Uploaded = 175
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(moved))
+
+	var changes int
+	var byKey bool
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    COUNT(*),
+		    COALESCE(BOOL_AND(by_key), FALSE)
+		FROM
+		    ip_changes
+		    JOIN peers ON ip_changes.peers_id = peers.id
+		WHERE
+		    announce_key = $1
+		`, before.AnnounceKey).Scan(&changes, &byKey)
+	if err != nil {
+		t.Fatalf("error querying test db: %v", err)
+	}
+	if changes != 1 || !byKey {
+		t.Errorf("expected 1 IP change by key, got %d (by key: %t)", changes, byKey)
+	}
+	after = moved
+
+	// Other peers are given only its new address.
+	leecher := testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[2],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Port:        6883,
+		Left:        100,
+		Numwant:     10,
+	}
+	w := httptest.NewRecorder()
+	handler(w, testutils.CreateTestAnnounce(leecher))
+	if received := countPeersReceived(w); received != 1 {
+		t.Errorf("expected 1 peer for a roaming client, got %d", received)
+	}
+
+	// Without the key, a new peer_id is another client.
+	other := after
+	other.Peer_id = testutils.GeneratePeerID()
+	other.Key = ""
+	other.Port = 6882
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(other))
+	w = httptest.NewRecorder()
+	handler(w, testutils.CreateTestAnnounce(leecher))
+	if received := countPeersReceived(w); received != 2 {
+		t.Errorf("expected 2 peers without a key, got %d", received)
+	}
+}
+
+func TestPeerDicts(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	handler := PeerHandler(ctx, conf)
+
+	seeder := testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Port:        6881,
+	}
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(seeder))
+
+	data := []struct {
+		name     string
+		query    string
+		expected any
+	}{
+		{"dictionary", "&compact=0", testutils.PeerIDForKey(seeder.AnnounceKey)},
+		{"no peer id", "&compact=0&no_peer_id=1", nil},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			req := testutils.CreateTestAnnounce(testutils.Request{
+				AnnounceKey: testutils.AnnounceKeys[2],
+				Info_hash:   testutils.AllowedInfoHashes["a"],
+				Port:        6882,
+				Left:        100,
+				Numwant:     10,
+			})
+			req.URL.RawQuery += d.query
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			decoded, err := bencode_go.Decode(w.Result().Body)
+			if err != nil {
+				t.Fatalf("error decoding reply: %v", err)
+			}
+			peers, ok := decoded.(map[string]any)["peers"].([]any)
+			if !ok || len(peers) != 1 {
+				t.Fatalf("expected a list of 1 peer, got %v", decoded)
+			}
+
+			peer := peers[0].(map[string]any)
+			if peer["ip"] != "192.0.2.1" || peer["port"] != int64(seeder.Port) {
+				t.Errorf("unexpected peer address %v:%v", peer["ip"], peer["port"])
+			}
+			if peer["peer id"] != d.expected {
+				t.Errorf("expected peer id %q, got %q", d.expected, peer["peer id"])
+			}
+		})
+	}
+}
+
+func TestEncodeAddr(t *testing.T) {
+	data := []struct {
+		remoteAddr string
+		expected   []byte
+	}{
+		{"192.0.2.1:1234", []byte{192, 0, 2, 1, 0x1a, 0xe1}},
+		{"[::ffff:192.0.2.1]:1234", []byte{192, 0, 2, 1, 0x1a, 0xe1}},
+		{"[2001:db8::1]:1234", []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1}},
+		{"2001:db8::1", nil},
+		{"example.com:1234", nil},
+	}
+
+	for _, d := range data {
+		t.Run(d.remoteAddr, func(t *testing.T) {
+			ip_port, err := encodeAddr(d.remoteAddr, "6881")
+			if d.expected == nil {
+				if err == nil {
+					t.Errorf("expected error, got %v", ip_port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error encoding address: %v", err)
+			}
+			if !bytes.Equal(ip_port, d.expected) {
+				t.Errorf("expected %v, got %v", d.expected, ip_port)
+			}
+		})
+	}
+}
+
+func TestAnnouncedIP(t *testing.T) {
+	data := []struct {
+		name     string
+		ip       string
+		honor    bool
+		expected string
+	}{
+		{"not honored", "203.0.113.7", false, "192.0.2.1:6881"},
+		{"public ipv4", "203.0.113.7", true, "203.0.113.7:6881"},
+		{"public ipv6", "2001:db8::7", true, "[2001:db8::7]:6881"},
+		{"mapped ipv4", "::ffff:203.0.113.7", true, "203.0.113.7:6881"},
+		{"missing", "", true, "192.0.2.1:6881"},
+		{"private", "10.0.0.7", true, "192.0.2.1:6881"},
+		{"loopback", "127.0.0.1", true, "192.0.2.1:6881"},
+		{"link local", "fe80::1", true, "192.0.2.1:6881"},
+		{"multicast", "224.0.0.1", true, "192.0.2.1:6881"},
+		{"hostname", "example.com", true, "192.0.2.1:6881"},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://example.com/key/announce?"+url.Values{
+				"info_hash":  {"x"},
+				"port":       {"6881"},
+				"left":       {"0"},
+				"uploaded":   {"0"},
+				"downloaded": {"0"},
+				"ip":         {d.ip},
+			}.Encode(), nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+
+			announce, err := parseAnnounce(config.Config{HonorIPParam: d.honor}, r)
+			if err != nil {
+				t.Fatalf("error parsing announce: %v", err)
+			}
+			ip := net.IP(announce.Ip_port[:len(announce.Ip_port)-2])
+			port := binary.BigEndian.Uint16(announce.Ip_port[len(announce.Ip_port)-2:])
+			if received := net.JoinHostPort(ip.String(), strconv.Itoa(int(port))); received != d.expected {
+				t.Errorf("expected %s, got %s", d.expected, received)
+			}
+			if remote := net.IP(announce.Remote_ip).String(); remote != "192.0.2.1" {
+				t.Errorf("expected remote IP 192.0.2.1, got %s", remote)
+			}
+		})
+	}
+}
+
+func TestIPv6Peers(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	handler := PeerHandler(ctx, conf)
+
+	// A dual-stack peer announces over both families, and an IPv6-only
+	// peer announces once.
+	dualStack := testutils.CreateDualStackAnnounces(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Port:        6881,
+	}, testutils.IPv4Addr(1, 1), testutils.IPv6Addr(1, 1))
+	for _, req := range dualStack {
+		handler(httptest.NewRecorder(), req)
+	}
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[2],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Port:        6882,
+		RemoteAddr:  testutils.IPv6Addr(2, 1),
+	}))
+
+	var rows int
+	err := conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    COUNT(*)
+		FROM
+		    announces
+		    JOIN peers ON announces.peers_id = peers.id
+		WHERE
+		    announce_key = $1
+		`,
+		testutils.AnnounceKeys[1]).Scan(&rows)
+	if err != nil {
+		t.Fatalf("error querying test db: %v", err)
+	}
+	if rows != 2 {
+		t.Errorf("expected dual-stack peer stored once per family, got %d rows", rows)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[3],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Port:        6883,
+		Numwant:     50,
+		Left:        1,
+	}))
+
+	data, err := bencode_go.Decode(w.Result().Body)
+	if err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	reply := data.(map[string]any)
+
+	expected, _ := encodeAddr(testutils.IPv4Addr(1, 1), "6881")
+	if peers := []byte(reply["peers"].(string)); !bytes.Equal(peers, expected) {
+		t.Errorf("expected peers %v, got %v", expected, peers)
+	}
+
+	peers6 := []byte(reply["peers6"].(string))
+	if len(peers6) != 2*18 {
+		t.Fatalf("expected 2 IPv6 peers, got %d bytes", len(peers6))
+	}
+	for addr, port := range map[string]string{testutils.IPv6Addr(1, 1): "6881", testutils.IPv6Addr(2, 1): "6882"} {
+		expected, _ := encodeAddr(addr, port)
+		if !bytes.Equal(peers6[:18], expected) && !bytes.Equal(peers6[18:], expected) {
+			t.Errorf("expected %v in peers6 %v", expected, peers6)
+		}
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	query, _ := url.ParseQuery("info_hash=x&port=6881&left=0&corrupt=0&redundant=16384&trackerid=abc&key=1A2B3C4D&supportcrypto=1&bell=%07ding&" +
+		"long=" + strings.Repeat("z", MaxParamLength+1))
+
+	expected := map[string]string{
+		"corrupt":       "0",
+		"redundant":     "16384",
+		"trackerid":     "abc",
+		"key":           "1A2B3C4D",
+		"supportcrypto": "1",
+		"bell":          "ding",
+		"long":          strings.Repeat("z", MaxParamLength),
+	}
+	if received := parseParams(query); !maps.Equal(received, expected) {
+		t.Errorf("expected %v, got %v", expected, received)
+	}
+
+	query = url.Values{}
+	for i := range MaxParams + 1 {
+		query.Set(fmt.Sprintf("p%02d", i), "1")
+	}
+	if received := parseParams(query); len(received) != MaxParams {
+		t.Errorf("expected %d params, got %d", MaxParams, len(received))
+	}
+
+	if received := parseParams(url.Values{"info_hash": {"x"}}); received != nil {
+		t.Errorf("expected no params, got %v", received)
+	}
+}
+
+func TestAnnounceParams(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+	conf.PrivacySalt = "testsalt"
+
+	req := testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+	})
+	req.URL.RawQuery += "&corrupt=0&redundant=16384&ip=198.51.100.7"
+	PeerHandler(ctx, conf)(httptest.NewRecorder(), req)
+
+	var params map[string]string
+	err := conf.Dbpool.QueryRow(ctx, `
+		SELECT
+		    params
+		FROM
+		    announces
+		    JOIN peers ON announces.peers_id = peers.id
+		WHERE
+		    announce_key = $1
+		`,
+		testutils.AnnounceKeys[1]).Scan(&params)
+	if err != nil {
+		t.Fatalf("error querying test db: %v", err)
+	}
+
+	if params["corrupt"] != "0" || params["redundant"] != "16384" {
+		t.Errorf("expected corrupt and redundant to be recorded, got %v", params)
+	}
+	if ip, ok := params["ip"]; !ok || ip == "198.51.100.7" {
+		t.Errorf("expected ip param hashed in privacy mode, got %q", ip)
+	}
+}
+
+func TestRunStage(t *testing.T) {
+	ctx := context.Background()
+	decision := debuglog.NewRing(1).Start(time.Now())
+
+	n, err := runStage(ctx, decision, "test", time.Second, func(ctx context.Context) (int, error) {
+		return 1, nil
+	})
+	if err != nil || n != 1 {
+		t.Errorf("expected result within budget, got %d, %v", n, err)
+	}
+
+	n, err = runStage(ctx, decision, "test", time.Millisecond, func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		return 1, ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || n != 0 {
+		t.Errorf("expected budget to be exceeded, got %d, %v", n, err)
+	}
+
+	// A late result is discarded even if the stage ignores its deadline.
+	n, err = runStage(ctx, decision, "test", time.Millisecond, func(ctx context.Context) (int, error) {
+		time.Sleep(5 * time.Millisecond)
+		return 1, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || n != 0 {
+		t.Errorf("expected late result to be discarded, got %d, %v", n, err)
+	}
+
+	if got := stageCounts.Get("test " + stageExceeded).String(); got != "2" {
+		t.Errorf("expected 2 exceeded stages, got %s", got)
+	}
+
+	var outcomes []string
+	for _, stage := range decision.Stages {
+		outcomes = append(outcomes, stage.Outcome)
+	}
+	if expected := []string{stageOK, stageExceeded, stageExceeded}; !slices.Equal(outcomes, expected) {
+		t.Errorf("expected stages %v in decision, got %v", expected, outcomes)
+	}
+}
+
+func TestSelectPeersFromCache(t *testing.T) {
+	ctx := context.Background()
+	conf, _ := testutils.BuildFakeConfig(t, NumwantPeers, testutils.DefaultAPIKey)
+
+	announce := func(key int, host int, webrtc bool) *config.Announce {
+		ip_port, err := encodeAddr(testutils.IPv4Addr(0, host), "6881")
+		if err != nil {
+			t.Fatalf("error encoding address: %v", err)
+		}
+		a := &config.Announce{
+			Announce_key: testutils.AnnounceKeys[key],
+			Info_hash:    []byte(testutils.AllowedInfoHashes["a"]),
+			Peer_id:      []byte(fmt.Sprintf("-TR4060-%012d", key)),
+			Ip_port:      ip_port,
+			Webrtc:       webrtc,
+		}
+		if err = cacheSwarm(ctx, conf, a, ip_port, !webrtc); err != nil {
+			t.Fatalf("error caching swarm: %v", err)
+		}
+		return a
+	}
+
+	own := announce(1, 1, false)
+	announce(2, 2, false)
+	announce(3, 3, true)
+
+	peers := selectPeers(ctx, conf, own)
+	if len(peers) != 1 || !bytes.Equal(peers[0].Ip_port, []byte{10, 0, 0, 2, 0x1a, 0xe1}) || !peers[0].Seeding {
+		t.Errorf("expected only the other reachable peer, seeding, got %v", peers)
+	}
+
+	// A seeder which starts leeching again is no longer cached as seeding.
+	leecher := announce(2, 2, false)
+	leecher.Amount_left = 1
+	if err := cacheSwarm(ctx, conf, leecher, leecher.Ip_port, true); err != nil {
+		t.Fatalf("error caching swarm: %v", err)
+	}
+	if peers := selectPeers(ctx, conf, own); len(peers) != 1 || peers[0].Seeding {
+		t.Errorf("expected the other peer leeching, got %v", peers)
+	}
+
+	// The last served peers are kept for when neither tier answers.
+	if fallback := lastServed.load(own); len(fallback) != 1 {
+		t.Errorf("expected served peers to be kept, got %v", fallback)
+	}
+}
+
+func TestSaveRestoreSwarms(t *testing.T) {
+	ctx := context.Background()
+	conf, clock := testutils.BuildFakeConfig(t, NumwantPeers, testutils.DefaultAPIKey)
+	path := filepath.Join(t.TempDir(), "swarms.json")
+
+	announce := func(key int, host int) *config.Announce {
+		ip_port, err := encodeAddr(testutils.IPv4Addr(0, host), "6881")
+		if err != nil {
+			t.Fatalf("error encoding address: %v", err)
+		}
+		a := &config.Announce{
+			Announce_key: testutils.AnnounceKeys[key],
+			Info_hash:    []byte(testutils.AllowedInfoHashes["a"]),
+			Peer_id:      []byte(fmt.Sprintf("-TR4060-%012d", key)),
+			Ip_port:      ip_port,
+		}
+		if err = cacheSwarm(ctx, conf, a, ip_port, true); err != nil {
+			t.Fatalf("error caching swarm: %v", err)
+		}
+		return a
+	}
+
+	// One peer goes stale before the restart, and one does not.
+	announce(1, 1)
+	clock.Advance(config.StaleInterval*time.Second - time.Minute)
+	own := announce(2, 2)
+	announce(3, 3)
+
+	if err := SaveSwarms(ctx, conf, path); err != nil {
+		t.Fatalf("error saving swarms: %v", err)
+	}
+	if err := conf.Rdb.FlushAll(ctx).Err(); err != nil {
+		t.Fatalf("error flushing redis: %v", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	n, err := RestoreSwarms(ctx, conf, path)
+	if err != nil {
+		t.Fatalf("error restoring swarms: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 peers restored, got %d", n)
+	}
+
+	peers, err := cachedPeers(ctx, conf, own)
+	if err != nil {
+		t.Fatalf("error reading swarm cache: %v", err)
+	}
+	if len(peers) != 1 || !bytes.Equal(peers[0].Ip_port, []byte{10, 0, 0, 3, 0x1a, 0xe1}) || !peers[0].Seeding {
+		t.Errorf("expected only the fresh peer, seeding, after restoring, got %v", peers)
+	}
+
+	// A missing file is a first start.
+	if n, err = RestoreSwarms(ctx, conf, filepath.Join(t.TempDir(), "missing.json")); err != nil || n != 0 {
+		t.Errorf("expected nothing restored from a missing file, got %d, %v", n, err)
+	}
+
+	conf.PrivacySalt = "salt"
+	if err = SaveSwarms(ctx, conf, path); !errors.Is(err, ErrSwarmsPrivacy) {
+		t.Errorf("expected %v in privacy mode, got %v", ErrSwarmsPrivacy, err)
+	}
+}
+
+func TestNormalizeBan(t *testing.T) {
+	data := []struct {
+		kind     string
+		value    string
+		expected string
+		valid    bool
+	}{
+		{BanCIDR, "192.0.2.0/24", "192.0.2.0/24", true},
+		{BanCIDR, "192.0.2.7/24", "192.0.2.0/24", true},
+		{BanCIDR, "192.0.2.7", "192.0.2.7/32", true},
+		{BanCIDR, "2001:db8::1", "2001:db8::1/128", true},
+		{BanCIDR, "not an ip", "", false},
+		{BanKey, testutils.AnnounceKeys[1], testutils.AnnounceKeys[1], true},
+		{BanClient, "-XL0012-", "-XL0012-", true},
+		{BanClient, "", "", false},
+		{"unknown", "value", "", false},
+	}
+
+	for _, d := range data {
+		got, err := NormalizeBan(d.kind, d.value)
+		if (err == nil) != d.valid {
+			t.Errorf("%s %q: expected valid %v, got %v", d.kind, d.value, d.valid, err)
+		}
+		if got != d.expected {
+			t.Errorf("%s %q: expected %q, got %q", d.kind, d.value, d.expected, got)
+		}
+	}
+}
+
+func TestBanSet(t *testing.T) {
+	set := &banSet{keys: make(map[string]bool)}
+	set.add(BanKey, testutils.AnnounceKeys[1])
+	set.add(BanCIDR, "10.0.1.0/24")
+	set.add(BanClient, "-XL")
+
+	announce := func(key int, remoteAddr string, peer_id string) *config.Announce {
+		ip_port, err := encodeAddr(remoteAddr, "6881")
+		if err != nil {
+			t.Fatalf("error encoding address: %v", err)
+		}
+		return &config.Announce{Announce_key: testutils.AnnounceKeys[key], Ip_port: ip_port, Peer_id: []byte(peer_id)}
+	}
+
+	data := []struct {
+		name     string
+		announce *config.Announce
+		expected bool
+	}{
+		{"allowed", announce(2, testutils.IPv4Addr(0, 1), "-TR4060-000000000000"), false},
+		{"key", announce(1, testutils.IPv4Addr(0, 1), "-TR4060-000000000000"), true},
+		{"cidr", announce(2, testutils.IPv4Addr(1, 9), "-TR4060-000000000000"), true},
+		{"client", announce(2, testutils.IPv4Addr(0, 1), "-XL0012-000000000000"), true},
+		{"ipv6", announce(2, testutils.IPv6Addr(1, 9), "-TR4060-000000000000"), false},
+	}
+
+	// A banned IP which announces another address in the ip parameter is
+	// still banned, and the announced address alone is not.
+	bypass := announce(2, "203.0.113.7:1234", "-TR4060-000000000000")
+	bypass.Remote_ip = net.ParseIP("10.0.1.9").To4()
+	announced := announce(2, testutils.IPv4Addr(1, 9), "-TR4060-000000000000")
+	announced.Remote_ip = net.ParseIP("192.0.2.1").To4()
+	data = append(data, []struct {
+		name     string
+		announce *config.Announce
+		expected bool
+	}{
+		{"ip parameter bypass", bypass, true},
+		{"announced banned ip", announced, false},
+	}...)
+
+	for _, d := range data {
+		if got := set.banned(d.announce); got != d.expected {
+			t.Errorf("%s: expected banned %v, got %v", d.name, d.expected, got)
+		}
+	}
+}
+
+func TestValidateACL(t *testing.T) {
+	data := []struct {
+		kind  string
+		value string
+		valid bool
+	}{
+		{ACLKey, testutils.AnnounceKeys[1], true},
+		{ACLGroup, "staff", true},
+		{ACLGroup, "", false},
+		{ACLGroup, strings.Repeat("a", MaxACLLength+1), false},
+		{"unknown", "staff", false},
+	}
+
+	for _, d := range data {
+		if err := ValidateACL(d.kind, d.value); (err == nil) != d.valid {
+			t.Errorf("%s %q: expected valid %v, got %v", d.kind, d.value, d.valid, err)
+		}
+	}
+}
+
+func TestValidatePromotion(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+
+	data := []struct {
+		name       string
+		freeleech  bool
+		multiplier float64
+		start_time time.Time
+		end_time   time.Time
+		valid      bool
+	}{
+		{"freeleech", true, 1, start, end, true},
+		{"multiplier", false, 2, start, end, true},
+		{"both", true, 1.5, start, end, true},
+		{"neither", false, 1, start, end, false},
+		{"ends before start", true, 1, end, start, false},
+		{"negative multiplier", false, -1, start, end, false},
+		{"huge multiplier", false, MaxUploadMultiplier + 1, start, end, false},
+	}
+
+	for _, d := range data {
+		err := ValidatePromotion(d.freeleech, d.multiplier, d.start_time, d.end_time)
+		if (err == nil) != d.valid {
+			t.Errorf("%s: expected valid %v, got %v", d.name, d.valid, err)
+		}
+	}
+}
+
+func TestPromotionSet(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	window := func(freeleech bool, multiplier float64, start, end time.Duration) promotion {
+		return promotion{freeleech: freeleech, upload_multiplier: multiplier, start_time: now.Add(start), end_time: now.Add(end)}
+	}
+
+	set := &promotionSet{
+		global: []promotion{window(false, 1.5, -time.Hour, time.Hour)},
+		infohashes: map[string][]promotion{
+			testutils.AllowedInfoHashes["a"]: {window(true, 1, -time.Hour, time.Hour)},
+			testutils.AllowedInfoHashes["b"]: {window(true, 3, time.Hour, 2*time.Hour)},
+			testutils.AllowedInfoHashes["c"]: {window(false, 2, -time.Hour, time.Hour)},
+		},
+	}
+
+	data := []struct {
+		name       string
+		info_hash  string
+		uploaded   int
+		downloaded int
+	}{
+		{"global multiplier with freeleech", testutils.AllowedInfoHashes["a"], 150, 0},
+		{"not started", testutils.AllowedInfoHashes["b"], 150, 100},
+		{"highest multiplier", testutils.AllowedInfoHashes["c"], 200, 100},
+		{"global only", testutils.AllowedInfoHashes["d"], 150, 100},
+	}
+
+	for _, d := range data {
+		uploaded, downloaded := set.apply([]byte(d.info_hash), now, 100, 100)
+		if uploaded != d.uploaded || downloaded != d.downloaded {
+			t.Errorf("%s: expected %d up and %d down, got %d and %d", d.name, d.uploaded, d.downloaded, uploaded, downloaded)
+		}
+	}
+
+	if uploaded, downloaded := (&promotionSet{}).apply([]byte(testutils.AllowedInfoHashes["a"]), now, 100, 100); uploaded != 100 || downloaded != 100 {
+		t.Errorf("expected no change without promotions, got %d and %d", uploaded, downloaded)
+	}
+
+	if !set.freeleech([]byte(testutils.AllowedInfoHashes["a"]), now) {
+		t.Errorf("expected active freeleech")
+	}
+	if set.freeleech([]byte(testutils.AllowedInfoHashes["b"]), now) || set.freeleech([]byte(testutils.AllowedInfoHashes["c"]), now) {
+		t.Errorf("expected no freeleech before it starts or without it")
+	}
+}
+
+func TestTierSet(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	conf := config.Config{Tiers: map[string]config.Tier{"donor": {PeerMultiplier: 1.5, DownloadMultiplier: 0.5}}}
+
+	set := &tierSet{keys: map[string]keyTier{
+		testutils.AnnounceKeys[1]: {tier: "donor"},
+		testutils.AnnounceKeys[2]: {tier: "donor", expires: now.Add(time.Hour)},
+		testutils.AnnounceKeys[3]: {tier: "donor", expires: now},
+		testutils.AnnounceKeys[4]: {tier: "removed"},
+	}}
+
+	data := []struct {
+		name     string
+		key      int
+		expected bool
+	}{
+		{"no expiry", 1, true},
+		{"not expired", 2, true},
+		{"expired", 3, false},
+		{"not configured", 4, false},
+		{"no tier", 5, false},
+	}
+
+	for _, d := range data {
+		tier, ok := set.tier(conf, testutils.AnnounceKeys[d.key], now)
+		if ok != d.expected {
+			t.Errorf("%s: expected tier %v, got %v", d.name, d.expected, ok)
+		}
+		if ok && tier != conf.Tiers["donor"] {
+			t.Errorf("%s: expected donor tier, got %+v", d.name, tier)
+		}
+	}
+}
+
+func TestCheckRotation(t *testing.T) {
+	ctx := context.Background()
+	conf, clock := testutils.BuildFakeConfig(t, NumwantPeers, testutils.DefaultAPIKey)
+	conf.PublicURL = "https://tracker.example.com/"
+
+	// The deadlines are cached, so Postgres is never consulted.
+	deadline := clock.Now().Add(time.Hour).UTC()
+	cached := map[string]string{
+		testutils.AnnounceKeys[1]: deadline.Format(time.RFC3339Nano),
+		testutils.AnnounceKeys[2]: "",
+	}
+	for key, value := range cached {
+		if err := conf.Rdb.Set(ctx, "rotate_by:"+key, value, 0).Err(); err != nil {
+			t.Fatalf("error setting cache: %v", err)
+		}
+	}
+
+	announce := func(key int) (*config.Announce, error) {
+		a := &config.Announce{Announce_key: testutils.AnnounceKeys[key]}
+		return a, checkRotation(ctx, conf, a, false)
+	}
+
+	a, err := announce(1)
+	if err != nil {
+		t.Fatalf("expected key before its deadline to be allowed, got %v", err)
+	}
+	link := "https://tracker.example.com/rotate?announce_key=" + testutils.AnnounceKeys[1]
+	if !strings.Contains(a.Warning, link) || !strings.Contains(a.Warning, deadline.Format(RotationDeadlineFormat)) {
+		t.Errorf("expected warning with deadline and %s, got %q", link, a.Warning)
+	}
+
+	a, err = announce(2)
+	if err != nil || a.Warning != "" {
+		t.Errorf("expected unmarked key to be allowed without warning, got %q, %v", a.Warning, err)
+	}
+
+	clock.Advance(time.Hour)
+	if _, err = announce(1); !errors.Is(err, ErrKeyExpired) {
+		t.Errorf("expected key past its deadline to be refused, got %v", err)
+	}
+
+	if err = RotationChanged(ctx, conf); err != nil {
+		t.Fatalf("error clearing rotation deadlines: %v", err)
+	}
+	for key := range cached {
+		if err = conf.Rdb.Get(ctx, "rotate_by:"+key).Err(); err != redis.Nil {
+			t.Errorf("expected cached deadline to be cleared, got %v", err)
+		}
+	}
+}
+
+func TestBelowRatio(t *testing.T) {
+	conf := config.Config{MinRatio: 0.5, RatioGrace: 1000}
+
+	data := []struct {
+		name       string
+		uploaded   int
+		downloaded int
+		expected   bool
+	}{
+		{"within grace", 0, 1000, false},
+		{"below minimum", 499, 1001, true},
+		{"at minimum", 1000, 2000, false},
+		{"above minimum", 5000, 2000, false},
+	}
+
+	for _, d := range data {
+		if _, below := belowRatio(conf, d.uploaded, d.downloaded); below != d.expected {
+			t.Errorf("%s: expected below %v, got %v", d.name, d.expected, below)
+		}
+	}
+
+	conf.MinRatio = 0
+	if _, below := belowRatio(conf, 0, 1<<20); below {
+		t.Errorf("expected no enforcement without a minimum ratio")
+	}
+}
+
+func TestRatioEnforcement(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, NumwantPeers, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	conf.MinRatio = 1
+	conf.RatioGrace = 1000
+	handler := PeerHandler(ctx, conf)
+
+	handler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[2],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Left:        0,
+	}))
+
+	announce := func(downloaded, left int) map[string]any {
+		w := httptest.NewRecorder()
+		handler(w, testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[1],
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Downloaded:  downloaded,
+			Left:        left,
+		}))
+		data, err := bencode_go.Decode(w.Result().Body)
+		if err != nil {
+			t.Fatalf("failure decoding tracker response: %v", err)
+		}
+		return data.(map[string]any)
+	}
+
+	// The ratio is checked before the announce is recorded, so the key
+	// first falls below the minimum after this announce.
+	if reply := announce(2000, 1); reply["warning message"] != nil || reply["peers"] == "" {
+		t.Fatalf("expected peers within the grace amount, got %v", reply)
+	}
+
+	reply := announce(2000, 1)
+	if peers, ok := reply["peers"].(string); !ok || len(peers) != 0 {
+		t.Errorf("expected no peers below the minimum ratio, got %v", reply["peers"])
+	}
+	if warning, _ := reply["warning message"].(string); !strings.Contains(warning, "below the minimum") {
+		t.Errorf("expected ratio warning, got %q", warning)
+	}
+
+	if reply := announce(2000, 0); reply["warning message"] != nil {
+		t.Errorf("expected seeding announce to be served without warning, got %v", reply)
+	}
+
+	_, err := conf.Dbpool.Exec(ctx, `
+		INSERT INTO promotions (info_hash_id, freeleech, start_time, end_time)
+		    SELECT id, TRUE, $2, $3 FROM infohashes WHERE info_hash = $1
+		`,
+		[]byte(testutils.AllowedInfoHashes["a"]), conf.Now().Add(-time.Hour), conf.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("error inserting promotion: %v", err)
+	}
+	if err = PromotionsChanged(ctx, conf); err != nil {
+		t.Fatalf("error updating promotions: %v", err)
+	}
+	if reply := announce(2000, 1); reply["warning message"] != nil {
+		t.Errorf("expected freeleech torrent to be exempt, got %v", reply)
+	}
+}
+
+func TestLoadLimits(t *testing.T) {
+	conf := config.Config{LoadMaxQPS: 100, LoadMaxLatency: 100 * time.Millisecond}
+	now := time.Unix(1700000000, 0)
+	m := &loadMonitor{second: now.Unix()}
+
+	if limits := m.limits(conf, now); limits.Numwant != MaxNumwant || limits.Interval != config.Interval {
+		t.Errorf("expected no limits without load, got %+v", limits)
+	}
+
+	// Ten seconds at four times the threshold rate.
+	for range 10 {
+		for range 400 {
+			m.recordAnnounce(now)
+		}
+		now = now.Add(time.Second)
+	}
+	limits := m.limits(conf, now)
+	if limits.Factor <= 3 || limits.Numwant >= MaxNumwant/3 || limits.Interval <= 3*config.Interval {
+		t.Errorf("expected peers reduced and interval lengthened under load, got %+v", limits)
+	}
+	if limits.Numwant < MinLoadNumwant || limits.Interval > MaxLoadIntervalFactor*config.Interval {
+		t.Errorf("expected limits within bounds, got %+v", limits)
+	}
+
+	// The load recedes once the announces stop.
+	now = now.Add(30 * time.Second)
+	if limits := m.limits(conf, now); limits.Numwant != MaxNumwant || limits.Interval != config.Interval {
+		t.Errorf("expected no limits after the load recedes, got %+v", limits)
+	}
+
+	for range 100 {
+		m.recordLatency(time.Second)
+	}
+	if limits := m.limits(conf, now); limits.Numwant != MinLoadNumwant || limits.Interval != MaxLoadIntervalFactor*config.Interval {
+		t.Errorf("expected the tightest limits at ten times the latency threshold, got %+v", limits)
+	}
+
+	if limits := loadLimits(config.Config{}); limits.Numwant != MaxNumwant {
+		t.Errorf("expected no limits without thresholds, got %+v", limits)
+	}
+}
+
+func TestPersonalInterval(t *testing.T) {
+	conf := config.Config{
+		SwarmIntervals: []config.SwarmInterval{
+			{MinPeers: 0, Interval: 10 * time.Minute},
+			{MinPeers: 10, Interval: 30 * time.Minute},
+			{MinPeers: 1000, Interval: 50 * time.Minute},
+		},
+		SeederIntervalFactor: 1.5,
+	}
+
+	data := []struct {
+		name        string
+		conf        config.Config
+		counts      *swarmCounts
+		seeding     bool
+		interval    int
+		minInterval int
+	}{
+		{"unconfigured", config.Config{}, &swarmCounts{complete: 5000}, true, config.Interval, config.MinInterval},
+		{"unknown size", conf, nil, false, config.Interval, config.MinInterval},
+		{"tiny swarm", conf, &swarmCounts{complete: 1, incomplete: 2}, false, 600, config.MinInterval},
+		{"medium swarm", conf, &swarmCounts{complete: 5, incomplete: 5}, false, 1800, config.MinInterval},
+		{"huge swarm", conf, &swarmCounts{complete: 900, incomplete: 100}, false, 3000, 33},
+		{"seeder in medium swarm", conf, &swarmCounts{complete: 5, incomplete: 5}, true, 2700, config.MinInterval},
+		{"seeder in huge swarm", conf, &swarmCounts{complete: 900, incomplete: 100}, true, config.MaxInterval, 40},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			interval, minInterval := personalInterval(d.conf, d.counts, d.seeding)
+			if interval != d.interval || minInterval != d.minInterval {
+				t.Errorf("expected interval %d and min interval %d, got %d and %d", d.interval, d.minInterval, interval, minInterval)
+			}
+		})
+	}
+}
+
+func TestChoosePeers(t *testing.T) {
+	var peers []bencode.Peer
+	for i := range 20 {
+		peers = append(peers, bencode.Peer{Ip_port: []byte{10, 0, 0, byte(i), 0x1a, 0xe1}, Seeding: i < 10})
+	}
+	seeders := func(peers []bencode.Peer) int {
+		n := 0
+		for _, peer := range peers {
+			if peer.Seeding {
+				n++
+			}
+		}
+		return n
+	}
+
+	data := []struct {
+		name      string
+		peers     []bencode.Peer
+		numToGive int
+		seeding   bool
+		given     int
+		seeders   int
+	}{
+		{"all to a seeder", peers, 30, true, 20, 10},
+		{"leechers to a seeder", peers, 8, true, 8, 0},
+		{"leechers and seeders to a seeder", peers, 14, true, 14, 4},
+		{"mixed to a leecher", peers, 8, false, 8, 4},
+		{"seeders make up for leechers", peers[:12], 8, false, 8, 6},
+		{"leechers make up for seeders", peers[8:], 8, false, 8, 2},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			chosen := choosePeers(slices.Clone(d.peers), d.numToGive, d.seeding)
+			if len(chosen) != d.given || seeders(chosen) != d.seeders {
+				t.Errorf("expected %d peers with %d seeders, got %d with %d", d.given, d.seeders, len(chosen), seeders(chosen))
+			}
+		})
+	}
+}
+
+func TestMarkNearby(t *testing.T) {
+	// Peers 10.0.0.0-9 are in the same network, 10.0.1.0-9 in the same
+	// country, and 10.0.2.0-9 elsewhere.
+	locate := func(ip net.IP) geoip.Location {
+		switch ip[2] {
+		case 0:
+			return geoip.Location{Country: "CH", Asn: 64500}
+		case 1:
+			return geoip.Location{Country: "CH", Asn: 64501}
+		}
+		return geoip.Location{Country: "FR", Asn: 64502}
+	}
+	peers := func() []bencode.Peer {
+		var peers []bencode.Peer
+		for network := range 3 {
+			for host := range 10 {
+				peers = append(peers, bencode.Peer{Ip_port: []byte{10, 0, byte(network), byte(host), 0x1a, 0xe1}})
+			}
+		}
+		return peers
+	}
+	// nearby counts the marked peers in each network.
+	nearby := func(peers []bencode.Peer) [3]int {
+		var marked [3]int
+		for _, peer := range peers {
+			if peer.Nearby {
+				marked[peer.Ip_port[2]]++
+			}
+		}
+		return marked
+	}
+
+	enabled := config.Config{GeoPeerShare: 0.5, Features: config.FeatureFlags{config.FeatureGeoSelection: true}}
+	data := []struct {
+		name      string
+		conf      config.Config
+		announce  config.Announce
+		numToGive int
+		marked    [3]int
+	}{
+		{"disabled", config.Config{GeoPeerShare: 0.5}, config.Announce{Country: "CH", Asn: 64500}, 20, [3]int{}},
+		{"network first", enabled, config.Announce{Country: "CH", Asn: 64500}, 10, [3]int{5, 0, 0}},
+		{"then country", enabled, config.Announce{Country: "CH", Asn: 64500}, 30, [3]int{10, 5, 0}},
+		{"country only", enabled, config.Announce{Country: "FR"}, 10, [3]int{0, 0, 5}},
+		{"unknown location", enabled, config.Announce{}, 10, [3]int{}},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			peers := peers()
+			markNearby(d.conf, &d.announce, peers, d.numToGive, locate)
+			if marked := nearby(peers); marked != d.marked {
+				t.Errorf("expected %v peers marked in each network, got %v", d.marked, marked)
+			}
+		})
+	}
+
+	// Marked peers are chosen first.
+	all := peers()
+	markNearby(enabled, &config.Announce{Asn: 64500}, all, 8, locate)
+	chosen := choosePeers(all, 8, true)
+	if marked := nearby(chosen); marked[0] != 4 {
+		t.Errorf("expected the 4 marked peers to be chosen, got %v", marked)
+	}
+}
+
+func TestSeedCredit(t *testing.T) {
+	data := []struct {
+		seeds        int
+		partialSeeds int
+		expected     int
+	}{
+		{0, 0, 0},
+		{3, 0, 3},
+		{0, 1, 0},
+		{0, 2, 1},
+		{3, 5, 5},
+	}
+
+	for _, d := range data {
+		if got := seedCredit(d.seeds, d.partialSeeds); got != d.expected {
+			t.Errorf("expected %d seeds and %d partial seeds to be credited as %d, got %d", d.seeds, d.partialSeeds, d.expected, got)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Account tiers, such as for donors, make the tracker more generous to the
+// announce keys of users in them: more peers from the peering algorithm,
+// and fewer downloads counted against their lifetime totals. The tiers
+// themselves are configured, see config.Tier, and the tier of each user is
+// stored in Postgres. As with promotions, each tracker instance keeps the
+// tier of every key owned by a user with a tier, which it reloads whenever
+// the version counter in Redis is bumped. If the tiers cannot be loaded,
+// announces are treated as if no key had a tier.
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// keyTier is the tier of an announce key, which lapses at expires unless
+// it is zero.
+type keyTier struct {
+	tier    string
+	expires time.Time
+}
+
+// tierSet is the loaded form of the key tiers at one version.
+type tierSet struct {
+	version string
+	keys    map[string]keyTier
+}
+
+// tier returns the tier of announce_key at now, if it has one which is
+// configured.
+func (s *tierSet) tier(conf config.Config, announce_key string, now time.Time) (config.Tier, bool) {
+	k, ok := s.keys[announce_key]
+	if !ok || (!k.expires.IsZero() && !now.Before(k.expires)) {
+		return config.Tier{}, false
+	}
+	tier, ok := conf.Tiers[k.tier]
+	return tier, ok
+}
+
+// loadedTiers holds the loaded tiers per Redis client, so that configs
+// sharing a process, as in tests, do not share tiers.
+var loadedTiers = struct {
+	mu   sync.Mutex
+	sets map[*redis.Client]*tierSet
+}{sets: make(map[*redis.Client]*tierSet)}
+
+// currentTiers returns the key tiers, reloading them from Postgres if they
+// have changed since they were last loaded. Expired tiers are not loaded.
+func currentTiers(ctx context.Context, conf config.Config) (*tierSet, error) {
+	version, err := conf.Rdb.Get(ctx, "tiers:version").Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("error fetching tiers version: %w", err)
+	}
+
+	loadedTiers.mu.Lock()
+	set, ok := loadedTiers.sets[conf.Rdb]
+	loadedTiers.mu.Unlock()
+	if ok && set.version == version {
+		return set, nil
+	}
+
+	rows, err := conf.Dbpool.Query(ctx, `
+		SELECT
+		    announce_key,
+		    tier,
+		    tier_expires
+		FROM
+		    peers
+		    JOIN users ON peers.users_id = users.id
+		WHERE
+		    tier IS NOT NULL
+		    AND (tier_expires IS NULL
+		        OR tier_expires > $1)
+		`,
+		conf.Now())
+	if err != nil {
+		return nil, fmt.Errorf("error loading tiers: %w", err)
+	}
+	defer rows.Close()
+
+	set = &tierSet{version: version, keys: make(map[string]keyTier)}
+	for rows.Next() {
+		var announce_key string
+		var k keyTier
+		var expires *time.Time
+		if err = rows.Scan(&announce_key, &k.tier, &expires); err != nil {
+			return nil, fmt.Errorf("error loading tiers: %w", err)
+		}
+		if expires != nil {
+			k.expires = *expires
+		}
+		set.keys[announce_key] = k
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error loading tiers: %w", err)
+	}
+
+	loadedTiers.mu.Lock()
+	loadedTiers.sets[conf.Rdb] = set
+	loadedTiers.mu.Unlock()
+
+	return set, nil
+}
+
+// announceTier returns the tier of the announce key of an announce, if it
+// has one.
+func announceTier(ctx context.Context, conf config.Config, announce *config.Announce) (config.Tier, bool) {
+	if len(conf.Tiers) == 0 {
+		return config.Tier{}, false
+	}
+	set, err := currentTiers(ctx, conf)
+	if err != nil {
+		log.Print(err)
+		return config.Tier{}, false
+	}
+	return set.tier(conf, announce.Announce_key, conf.Now())
+}
+
+// applyTierPeers returns the number of peers to give an announce after the
+// peer multiplier of its tier, up to the number requested.
+func applyTierPeers(ctx context.Context, conf config.Config, announce *config.Announce, numToGive int) int {
+	tier, ok := announceTier(ctx, conf, announce)
+	if !ok {
+		return numToGive
+	}
+	return min(announce.Numwant, int(math.Ceil(float64(numToGive)*tier.PeerMultiplier)))
+}
+
+// applyTierDownload returns the download change of an announce after the
+// download multiplier of its tier. As with promotions, only the lifetime
+// totals of the announce key are affected.
+func applyTierDownload(ctx context.Context, conf config.Config, announce *config.Announce, download_change int) int {
+	tier, ok := announceTier(ctx, conf, announce)
+	if !ok {
+		return download_change
+	}
+	return int(math.Round(float64(download_change) * tier.DownloadMultiplier))
+}
+
+// TiersChanged tells every tracker instance to reload its tiers. It must be
+// called after any change to the tier of a user, or to the announce keys a
+// user owns.
+func TiersChanged(ctx context.Context, conf config.Config) error {
+	if err := conf.Rdb.Incr(ctx, "tiers:version").Err(); err != nil {
+		return fmt.Errorf("error updating tiers version: %w", err)
+	}
+	return nil
+}
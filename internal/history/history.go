@@ -0,0 +1,282 @@
+// Package history records the stats of the tracker as a time series for
+// charts. A background job records the seeders, leechers, and total peers
+// at the end of each hour, with the snatches and the announce rate of the
+// hour, in the stats_history table. Announces are counted in Redis by a
+// subscriber to the event bus, see Count, so that every tracker instance
+// sharing the cache is counted. Hourly points older than HourlyDays are
+// downsampled into daily points, which are kept for the configured
+// HistoryRetentionDays.
+package history
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+	"github.com/dmoerner/etracker/internal/events"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Interval is how often the job runs. Each hour is only recorded once,
+	// by whichever run on whichever instance comes first, so the interval
+	// only bounds how late an hour is recorded.
+	Interval = 10 * time.Minute
+
+	// HourlyDays is how long hourly points are kept before they are
+	// downsampled into daily points.
+	HourlyDays = 7
+
+	// DefaultRange and MaxRange bound the range of a Query.
+	DefaultRange = HourlyDays * 24 * time.Hour
+	MaxRange     = 5 * 366 * 24 * time.Hour
+)
+
+// Point is the stats of the Hours starting at Time. Seeders, leechers, and
+// peers are averaged over the hours, and snatches summed. Leechers do not
+// include partial seeds, but peers do.
+type Point struct {
+	Time         time.Time `json:"time"`
+	Hours        int       `json:"hours"`
+	Seeders      int       `json:"seeders"`
+	Leechers     int       `json:"leechers"`
+	Peers        int       `json:"peers"`
+	Snatches     int       `json:"snatches"`
+	AnnounceRate float64   `json:"announce_rate" db:"announce_rate"`
+}
+
+// counterKey is the Redis key counting the announces of the hour starting
+// at hour.
+func counterKey(hour time.Time) string {
+	return "history:announces:" + strconv.FormatInt(hour.Unix(), 10)
+}
+
+// Count returns an events.Handler which counts accepted announces by hour.
+// Errors are only logged, since they only lower the announce rate.
+func Count(conf config.Config) events.Handler {
+	return func(ctx context.Context, e events.Event) {
+		key := counterKey(e.Time.Truncate(time.Hour))
+		pipe := conf.Rdb.Pipeline()
+		pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, 3*time.Hour)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("Error counting announce for stats history: %v", err)
+		}
+	}
+}
+
+// Record records the hour before the current one, unless it has already
+// been recorded, and reports whether it did.
+func Record(ctx context.Context, conf config.Config) (bool, error) {
+	end := conf.Now().Truncate(time.Hour)
+	start := end.Add(-time.Hour)
+
+	announces, err := conf.Rdb.Get(ctx, counterKey(start)).Int()
+	if err != nil && err != redis.Nil {
+		return false, fmt.Errorf("error reading announce count for stats history: %w", err)
+	}
+
+	tag, err := conf.Dbpool.Exec(ctx, `
+		WITH `+db.RecentAnnounces(1, 2, "amount_left", "event")+`
+		INSERT INTO stats_history (record_time, hours, seeders, leechers, peers, snatches, announce_rate)
+		SELECT
+		    $4,
+		    1,
+		    COUNT(recent_announces.peers_id) FILTER (WHERE recent_announces.amount_left = 0),
+		    COUNT(recent_announces.peers_id) FILTER (WHERE recent_announces.amount_left > 0
+			AND NOT `+db.PartialSeed(3)+`),
+		    COUNT(recent_announces.peers_id),
+		    (
+			SELECT
+			    COUNT(*)
+			FROM
+			    snatches
+			WHERE
+			    snatch_time >= $4
+			    AND snatch_time < $5),
+		    $6
+		FROM
+		    infohashes
+		    LEFT JOIN recent_announces ON infohashes.id = recent_announces.info_hash_id
+		WHERE
+		    infohashes.archived_time IS NULL
+		    AND infohashes.merged_into IS NULL
+		ON CONFLICT (record_time, hours)
+		    DO NOTHING
+		`,
+		config.Stopped, conf.StaleCutoff(), config.Paused, start, end, float64(announces)/time.Hour.Seconds())
+	if err != nil {
+		return false, fmt.Errorf("error recording stats history: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Downsample replaces the hourly points of each whole UTC day older than
+// HourlyDays with a daily point, and deletes the points older than the
+// configured HistoryRetentionDays.
+func Downsample(ctx context.Context, conf config.Config) error {
+	now := conf.Now().UTC()
+	cutoff := time.Date(now.Year(), now.Month(), now.Day()-HourlyDays, 0, 0, 0, 0, time.UTC)
+
+	tx, err := conf.Dbpool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error downsampling stats history: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO stats_history (record_time, hours, seeders, leechers, peers, snatches, announce_rate)
+		SELECT
+		    date_trunc('day', record_time AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+		    24,
+		    ROUND(AVG(seeders)),
+		    ROUND(AVG(leechers)),
+		    ROUND(AVG(peers)),
+		    SUM(snatches),
+		    AVG(announce_rate)
+		FROM
+		    stats_history
+		WHERE
+		    hours = 1
+		    AND record_time < $1
+		GROUP BY
+		    1
+		ON CONFLICT (record_time, hours)
+		    DO NOTHING
+		`,
+		cutoff)
+	if err != nil {
+		return fmt.Errorf("error downsampling stats history: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		DELETE FROM stats_history
+		WHERE hours = 1
+		    AND record_time < $1
+		`,
+		cutoff)
+	if err != nil {
+		return fmt.Errorf("error downsampling stats history: %w", err)
+	}
+
+	if days := conf.HistoryRetentionDays; days > 0 {
+		_, err = tx.Exec(ctx, `
+			DELETE FROM stats_history
+			WHERE record_time < $1
+			`,
+			now.AddDate(0, 0, -days))
+		if err != nil {
+			return fmt.Errorf("error pruning stats history: %w", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("error downsampling stats history: %w", err)
+	}
+	return nil
+}
+
+// Job records each hour and downsamples the history at startup and then
+// every Interval, skipping while read-only. Failures are logged and retried
+// on the next run.
+func Job(ctx context.Context, conf config.Config) error {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+
+	for {
+		if enabled, err := handler.ReadOnly(ctx, conf); err == nil && !enabled {
+			recorded, err := Record(ctx, conf)
+			if err == nil && recorded {
+				err = Downsample(ctx, conf)
+			}
+			if err != nil && ctx.Err() == nil {
+				log.Print(err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// ParseRange parses the range of a Query, either as a number of days such
+// as "30d", or as a duration such as "24h". The empty string is
+// DefaultRange.
+func ParseRange(s string) (time.Duration, error) {
+	if s == "" {
+		return DefaultRange, nil
+	}
+
+	var r time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid range %q", s)
+		}
+		// Ranges beyond MaxRange are refused below, before they can
+		// overflow.
+		r = time.Duration(min(n, int(MaxRange/(24*time.Hour))+1)) * 24 * time.Hour
+	} else {
+		var err error
+		if r, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid range %q", s)
+		}
+	}
+
+	if r <= 0 || r > MaxRange {
+		return 0, fmt.Errorf("range %q must be positive and at most %d days", s, MaxRange/(24*time.Hour))
+	}
+	return r, nil
+}
+
+// Step returns the hours covered by each point of a Query over r: hourly
+// points while they are kept, and daily points beyond.
+func Step(r time.Duration) int {
+	if r <= DefaultRange {
+		return 1
+	}
+	return 24
+}
+
+// Query returns the points of the last r, oldest first, downsampled to
+// Step(r). Points which are already coarser are returned as they are.
+func Query(ctx context.Context, conf config.Config, r time.Duration) ([]Point, error) {
+	step := Step(r)
+	rows, _ := conf.Dbpool.Query(ctx, `
+		SELECT
+		    to_timestamp(floor(extract(epoch FROM record_time) / $2) * $2) AS time,
+		    GREATEST(MAX(hours), $3) AS hours,
+		    ROUND(AVG(seeders))::INTEGER AS seeders,
+		    ROUND(AVG(leechers))::INTEGER AS leechers,
+		    ROUND(AVG(peers))::INTEGER AS peers,
+		    SUM(snatches)::INTEGER AS snatches,
+		    AVG(announce_rate) AS announce_rate
+		FROM
+		    stats_history
+		WHERE
+		    record_time >= $1
+		GROUP BY
+		    1
+		ORDER BY
+		    1
+		`,
+		conf.Now().Add(-r), step*3600, step)
+	points, err := pgx.CollectRows(rows, pgx.RowToStructByName[Point])
+	if err != nil {
+		return nil, fmt.Errorf("error querying stats history: %w", err)
+	}
+	if points == nil {
+		points = []Point{}
+	}
+	return points, nil
+}
@@ -0,0 +1,133 @@
+package history
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/events"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestParseRange(t *testing.T) {
+	data := []struct {
+		s        string
+		expected time.Duration
+		valid    bool
+	}{
+		{"", DefaultRange, true},
+		{"24h", 24 * time.Hour, true},
+		{"30d", 30 * 24 * time.Hour, true},
+		{"90m", 90 * time.Minute, true},
+		{"0d", 0, false},
+		{"-1h", 0, false},
+		{"10000d", 0, false},
+		{"99999999999999d", 0, false},
+		{"week", 0, false},
+	}
+
+	for _, d := range data {
+		r, err := ParseRange(d.s)
+		if (err == nil) != d.valid {
+			t.Errorf("expected valid %v for %q, got error %v", d.valid, d.s, err)
+			continue
+		}
+		if r != d.expected {
+			t.Errorf("expected %v for %q, got %v", d.expected, d.s, r)
+		}
+	}
+}
+
+func TestStep(t *testing.T) {
+	if step := Step(24 * time.Hour); step != 1 {
+		t.Errorf("expected hourly points for a day, got %d hours", step)
+	}
+	if step := Step(30 * 24 * time.Hour); step != 24 {
+		t.Errorf("expected daily points for a month, got %d hours", step)
+	}
+}
+
+func TestCount(t *testing.T) {
+	ctx := context.Background()
+	conf, clock := testutils.BuildFakeConfig(t, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+
+	count := Count(conf)
+	hour := clock.Now().Truncate(time.Hour)
+	for range 3 {
+		count(ctx, events.Event{Kind: events.AnnounceAccepted, Time: hour.Add(time.Minute)})
+	}
+	count(ctx, events.Event{Kind: events.AnnounceAccepted, Time: hour.Add(time.Hour)})
+
+	if n, err := conf.Rdb.Get(ctx, counterKey(hour)).Int(); err != nil || n != 3 {
+		t.Errorf("expected 3 announces in the hour, got %d: %v", n, err)
+	}
+	if ttl, err := conf.Rdb.TTL(ctx, counterKey(hour)).Result(); err != nil || ttl <= 0 {
+		t.Errorf("expected the count to expire, got %v: %v", ttl, err)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	for i, left := range []int{0, 100} {
+		event := config.Started
+		if left == 0 {
+			event = config.Completed
+		}
+		peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[i+1],
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Event:       event,
+			Left:        left,
+		}))
+	}
+
+	// Record the hour of the announces.
+	clock := testutils.NewFakeClock(time.Now().Add(time.Hour))
+	conf.Clock = clock
+	hour := time.Now().Truncate(time.Hour)
+	if err := conf.Rdb.Set(ctx, counterKey(hour), 7200, 0).Err(); err != nil {
+		t.Fatalf("error setting announce count: %v", err)
+	}
+
+	recorded, err := Record(ctx, conf)
+	if err != nil || !recorded {
+		t.Fatalf("expected hour to be recorded, got %v: %v", recorded, err)
+	}
+	if recorded, err = Record(ctx, conf); err != nil || recorded {
+		t.Errorf("expected hour to be recorded once, got %v: %v", recorded, err)
+	}
+
+	points, err := Query(ctx, conf, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("error querying history: %v", err)
+	}
+	expected := Point{Time: hour, Hours: 1, Seeders: 1, Leechers: 1, Peers: 2, Snatches: 1, AnnounceRate: 2}
+	if len(points) != 1 || !points[0].Time.Equal(expected.Time) {
+		t.Fatalf("expected one point at %v, got %v", hour, points)
+	}
+	points[0].Time = expected.Time
+	if points[0] != expected {
+		t.Errorf("expected %v, got %v", expected, points[0])
+	}
+
+	// Once older than HourlyDays, the hour is downsampled into its day.
+	clock.Advance((HourlyDays + 2) * 24 * time.Hour)
+	if err = Downsample(ctx, conf); err != nil {
+		t.Fatalf("error downsampling history: %v", err)
+	}
+	points, err = Query(ctx, conf, 30*24*time.Hour)
+	if err != nil {
+		t.Fatalf("error querying history: %v", err)
+	}
+	day := time.Date(hour.UTC().Year(), hour.UTC().Month(), hour.UTC().Day(), 0, 0, 0, 0, time.UTC)
+	if len(points) != 1 || !points[0].Time.Equal(day) || points[0].Hours != 24 || points[0].Snatches != 1 {
+		t.Errorf("expected one daily point at %v, got %v", day, points)
+	}
+}
@@ -0,0 +1,180 @@
+// Package locale translates the failure reasons and warnings sent to
+// BitTorrent clients. Messages are looked up by their English text, which is
+// also the fallback, so a message without a translation is still served.
+// The language is negotiated from the Accept-Language header of the
+// announce or scrape, falling back to the operator's default.
+package locale
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// English is the language of the messages in the source.
+const English = "en"
+
+// Languages are the supported languages, English first.
+var Languages = []string{English, "de", "es", "fr"}
+
+// catalog maps each English message to its translations. A message may be
+// a format for Sprintf, in which case its translations must take the same
+// arguments in the same order.
+var catalog = map[string]map[string]string{
+	"tracker error": {
+		"de": "Tracker-Fehler",
+		"es": "error del tracker",
+		"fr": "erreur du tracker",
+	},
+	"error parsing announce": {
+		"de": "Fehler beim Verarbeiten des Announce",
+		"es": "error al procesar el announce",
+		"fr": "erreur d'analyse de l'announce",
+	},
+	"info_hash not in the allowed list": {
+		"de": "info_hash ist nicht in der Liste erlaubter Torrents",
+		"es": "el info_hash no está en la lista permitida",
+		"fr": "info_hash absent de la liste autorisée",
+	},
+	"untracked announce key, generate new announce url": {
+		"de": "unbekannter Announce-Schlüssel, bitte eine neue Announce-URL erzeugen",
+		"es": "clave de announce desconocida, genera una nueva URL de announce",
+		"fr": "clé d'announce inconnue, générez une nouvelle URL d'announce",
+	},
+	"announce key expired, generate new announce url": {
+		"de": "Announce-Schlüssel abgelaufen, bitte eine neue Announce-URL erzeugen",
+		"es": "la clave de announce ha caducado, genera una nueva URL de announce",
+		"fr": "clé d'announce expirée, générez une nouvelle URL d'announce",
+	},
+	"announce key must be verified with a proof of work before its first announce": {
+		"de": "der Announce-Schlüssel muss vor dem ersten Announce mit einem Arbeitsnachweis bestätigt werden",
+		"es": "la clave de announce debe verificarse con una prueba de trabajo antes de su primer announce",
+		"fr": "la clé d'announce doit être vérifiée par une preuve de travail avant son premier announce",
+	},
+	"your announce url must be replaced by %s, get a new one at %s": {
+		"de": "deine Announce-URL muss bis %s ersetzt werden, eine neue gibt es unter %s",
+		"es": "tu URL de announce debe reemplazarse antes de %s, obtén una nueva en %s",
+		"fr": "votre URL d'announce doit être remplacée avant %s, obtenez-en une nouvelle sur %s",
+	},
+	"your ratio of %.2f is below the minimum of %.2f, seed to raise it before downloading more": {
+		"de": "dein Verhältnis von %.2f liegt unter dem Minimum von %.2f, bitte vor weiteren Downloads seeden",
+		"es": "tu ratio de %.2f está por debajo del mínimo de %.2f, comparte para subirlo antes de descargar más",
+		"fr": "votre ratio de %.2f est inférieur au minimum de %.2f, partagez pour l'augmenter avant de télécharger davantage",
+	},
+	"banned": {
+		"de": "gesperrt",
+		"es": "bloqueado",
+		"fr": "banni",
+	},
+	"access to this torrent is restricted": {
+		"de": "der Zugriff auf diesen Torrent ist eingeschränkt",
+		"es": "el acceso a este torrent está restringido",
+		"fr": "l'accès à ce torrent est restreint",
+	},
+	"this torrent has been retired": {
+		"de": "dieser Torrent wurde stillgelegt",
+		"es": "este torrent ha sido retirado",
+		"fr": "ce torrent a été retiré",
+	},
+	"tracker under maintenance, retry in %v": {
+		"de": "Tracker wird gewartet, erneuter Versuch in %v",
+		"es": "tracker en mantenimiento, reintenta en %v",
+		"fr": "tracker en maintenance, réessayez dans %v",
+	},
+	"tracker is temporarily read-only and cannot check this announce, retry later": {
+		"de": "Tracker ist vorübergehend schreibgeschützt und kann diesen Announce nicht prüfen, bitte später erneut versuchen",
+		"es": "el tracker está temporalmente en modo de solo lectura y no puede comprobar este announce, reintenta más tarde",
+		"fr": "le tracker est temporairement en lecture seule et ne peut pas vérifier cet announce, réessayez plus tard",
+	},
+	"tracker busy, retry in %v": {
+		"de": "Tracker ausgelastet, erneuter Versuch in %v",
+		"es": "tracker ocupado, reintenta en %v",
+		"fr": "tracker surchargé, réessayez dans %v",
+	},
+	"this torrent has been replaced by %x, please switch to the new torrent": {
+		"de": "dieser Torrent wurde durch %x ersetzt, bitte zum neuen Torrent wechseln",
+		"es": "este torrent ha sido reemplazado por %x, cambia al nuevo torrent",
+		"fr": "ce torrent a été remplacé par %x, veuillez passer au nouveau torrent",
+	},
+	"error validating announce key": {
+		"de": "Fehler beim Prüfen des Announce-Schlüssels",
+		"es": "error al validar la clave de announce",
+		"fr": "erreur de validation de la clé d'announce",
+	},
+	"error fetching data for scrape": {
+		"de": "Fehler beim Abrufen der Scrape-Daten",
+		"es": "error al obtener los datos del scrape",
+		"fr": "erreur de récupération des données de scrape",
+	},
+	"error parsing data for scrape": {
+		"de": "Fehler beim Verarbeiten der Scrape-Daten",
+		"es": "error al procesar los datos del scrape",
+		"fr": "erreur d'analyse des données de scrape",
+	},
+	"announces and scrapes must use GET": {
+		"de": "Announces und Scrapes müssen GET verwenden",
+		"es": "los announces y scrapes deben usar GET",
+		"fr": "les announces et scrapes doivent utiliser GET",
+	},
+	"error validating client certificate": {
+		"de": "Fehler beim Prüfen des Client-Zertifikats",
+		"es": "error al validar el certificado de cliente",
+		"fr": "erreur de validation du certificat client",
+	},
+	"no announce key for client certificate": {
+		"de": "kein Announce-Schlüssel für das Client-Zertifikat",
+		"es": "no hay clave de announce para el certificado de cliente",
+		"fr": "aucune clé d'announce pour le certificat client",
+	},
+}
+
+// Supported reports whether lang is a supported language.
+func Supported(lang string) bool {
+	return slices.Contains(Languages, lang)
+}
+
+// Negotiate returns the supported language most preferred by an
+// Accept-Language header, or fallback if it prefers none of them. Regional
+// variants match their language, so de-AT is served German.
+func Negotiate(acceptLanguage string, fallback string) string {
+	type preference struct {
+		lang string
+		q    float64
+	}
+
+	var prefs []preference
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if q > 0 && Supported(lang) {
+			prefs = append(prefs, preference{lang, q})
+		}
+	}
+	if len(prefs) == 0 {
+		return fallback
+	}
+
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	return prefs[0].lang
+}
+
+// Sprintf translates the English format into lang, and formats it with
+// args like fmt.Sprintf. Formats without a translation are used as is.
+func Sprintf(lang string, format string, args ...any) string {
+	if translated, ok := catalog[format][lang]; ok {
+		format = translated
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,61 @@
+package locale
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	data := []struct {
+		header   string
+		fallback string
+		expected string
+	}{
+		{"", English, English},
+		{"", "de", "de"},
+		{"fr", English, "fr"},
+		{"de-AT,de;q=0.9,en;q=0.8", English, "de"},
+		{"ja,es;q=0.5", English, "es"},
+		{"en;q=0.5,fr;q=0.8", "de", "fr"},
+		{"es;q=0", "de", "de"},
+		{"ja,zh", "fr", "fr"},
+		{"FR-ca", English, "fr"},
+	}
+
+	for _, d := range data {
+		if got := Negotiate(d.header, d.fallback); got != d.expected {
+			t.Errorf("%q: expected %s, got %s", d.header, d.expected, got)
+		}
+	}
+}
+
+func TestSprintf(t *testing.T) {
+	if got := Sprintf("de", "tracker under maintenance, retry in %v", "1h0m0s"); got != "Tracker wird gewartet, erneuter Versuch in 1h0m0s" {
+		t.Errorf("unexpected translation %q", got)
+	}
+	if got := Sprintf("", "banned"); got != "banned" {
+		t.Errorf("expected English for no language, got %q", got)
+	}
+	if got := Sprintf("fr", "not in the catalog"); got != "not in the catalog" {
+		t.Errorf("expected untranslated message as is, got %q", got)
+	}
+}
+
+// TestCatalog checks that every message is translated into every language,
+// with the same format verbs.
+func TestCatalog(t *testing.T) {
+	verbs := regexp.MustCompile(`%[a-z]`)
+	for message, translations := range catalog {
+		for _, lang := range Languages[1:] {
+			translated, ok := translations[lang]
+			if !ok {
+				t.Errorf("%q: no %s translation", message, lang)
+				continue
+			}
+			if !slices.Equal(verbs.FindAllString(message, -1), verbs.FindAllString(translated, -1)) {
+				t.Errorf("%q: %s translation %q has different verbs", message, lang, translated)
+			}
+		}
+	}
+}
@@ -0,0 +1,428 @@
+// Package oidc logs users in through an external OpenID Connect identity
+// provider, such as Authentik, Keycloak, or Google, with the authorization
+// code flow and PKCE.
+//
+// Only what the tracker needs is implemented. The provider's endpoints are
+// found by discovery, and ID tokens are verified against its published keys,
+// which may be RS256 or ES256. Other claims than those of the ID token,
+// such as from the userinfo endpoint, are not used.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Leeway is the clock skew allowed when checking the expiry of ID
+	// tokens.
+	Leeway = time.Minute
+
+	// KeyRefreshInterval is how often the provider's keys may be fetched
+	// again when an ID token is signed with an unknown key, which happens
+	// after the provider rotates its keys.
+	KeyRefreshInterval = time.Minute
+
+	// MaxResponseSize bounds the responses read from the provider.
+	MaxResponseSize = 1 << 20
+)
+
+var (
+	ErrProvider     = errors.New("identity provider error")
+	ErrInvalidToken = errors.New("invalid ID token")
+)
+
+// Provider is an OpenID Connect identity provider the tracker is registered
+// with as a client. RedirectURL is the callback of the tracker registered
+// with the provider.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// Client makes the requests to the provider, and Now is the current
+	// time, for tests.
+	Client *http.Client
+	Now    func() time.Time
+
+	mu          sync.Mutex
+	endpoints   *endpoints
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// endpoints are the parts of the provider's discovery document which are
+// used.
+type endpoints struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewProvider returns the Provider with the issuer URL, such as
+// https://auth.example.com/application/o/etracker/. An empty clientSecret
+// makes the tracker a public client, which relies on PKCE alone.
+func NewProvider(issuer, clientID, clientSecret, redirectURL string, scopes []string) *Provider {
+	return &Provider{
+		Issuer:       issuer,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+		Client:       &http.Client{Timeout: 10 * time.Second},
+		Now:          time.Now,
+	}
+}
+
+// NewState returns a random value for the state, nonce, or PKCE verifier
+// of a login.
+func NewState() (string, error) {
+	state := make([]byte, 32)
+	if _, err := rand.Read(state); err != nil {
+		return "", fmt.Errorf("unable to generate state: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(state), nil
+}
+
+// getJSON fetches a JSON document from the provider.
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrProvider, err)
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrProvider, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %s", ErrProvider, url, resp.Status)
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, MaxResponseSize)).Decode(v); err != nil {
+		return fmt.Errorf("%w: malformed response from %s: %w", ErrProvider, url, err)
+	}
+	return nil
+}
+
+// discover returns the provider's endpoints, which are fetched once.
+func (p *Provider) discover(ctx context.Context) (*endpoints, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+
+	var e endpoints
+	err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &e)
+	if err != nil {
+		return nil, err
+	}
+	if e.Issuer != p.Issuer {
+		return nil, fmt.Errorf("%w: discovery is for issuer %q", ErrProvider, e.Issuer)
+	}
+	if e.AuthorizationEndpoint == "" || e.TokenEndpoint == "" || e.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: discovery lacks endpoints", ErrProvider)
+	}
+	p.endpoints = &e
+	return p.endpoints, nil
+}
+
+// AuthCodeURL returns the URL to send the user to for logging in. The state
+// is returned to the callback, and the nonce and verifier must be kept for
+// Exchange.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	e, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(e.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return e.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Claims are the claims of a verified ID token.
+type Claims map[string]any
+
+// String returns a string claim, or "" if it is missing or not a string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim which is a list of strings, such as groups. A
+// single string is a list of one.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Exchange redeems the code passed to the callback for an ID token, and
+// returns its verified claims. The nonce and verifier are those passed to
+// AuthCodeURL.
+func (p *Provider) Exchange(ctx context.Context, code, nonce, verifier string) (Claims, error) {
+	e, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", e.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProvider, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProvider, err)
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, MaxResponseSize)).Decode(&token); err != nil {
+		return nil, fmt.Errorf("%w: malformed token response with status %s", ErrProvider, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return nil, fmt.Errorf("%w: token request failed: %s %s", ErrProvider, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("%w: token response lacks an ID token", ErrProvider)
+	}
+
+	return p.Verify(ctx, token.IDToken, nonce)
+}
+
+// Verify checks the signature, issuer, audience, expiry, and nonce of an ID
+// token, and returns its claims.
+func (p *Provider) Verify(ctx context.Context, idToken, nonce string) (Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a signed JWT", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if !verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, fmt.Errorf("%w: bad %s signature", ErrInvalidToken, header.Alg)
+	}
+
+	var claims Claims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims.String("iss") != p.Issuer {
+		return nil, fmt.Errorf("%w: issued by %q", ErrInvalidToken, claims.String("iss"))
+	}
+	audience := claims.Strings("aud")
+	if !slices.Contains(audience, p.ClientID) {
+		return nil, fmt.Errorf("%w: not issued to this client", ErrInvalidToken)
+	}
+	if azp := claims.String("azp"); azp != "" && azp != p.ClientID {
+		return nil, fmt.Errorf("%w: authorized for another client", ErrInvalidToken)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || p.Now().Add(-Leeway).After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if claims.String("nonce") != nonce {
+		return nil, fmt.Errorf("%w: nonce does not match", ErrInvalidToken)
+	}
+	if claims.String("sub") == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT.
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: malformed segment", ErrInvalidToken)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: malformed segment", ErrInvalidToken)
+	}
+	return nil
+}
+
+// verifySignature checks a JWS signature of data.
+func verifySignature(alg string, key crypto.PublicKey, data, signature []byte) bool {
+	digest := sha256.Sum256(data)
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) == nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(ecKey, digest[:], r, s)
+	}
+	return false
+}
+
+// key returns the provider's signing key with the key ID kid, fetching the
+// keys again if it is unknown and they were not fetched recently. A token
+// without a key ID may be signed with the provider's only key.
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	e, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lookup := func() crypto.PublicKey {
+		if kid == "" && len(p.keys) == 1 {
+			for _, key := range p.keys {
+				return key
+			}
+		}
+		return p.keys[kid]
+	}
+	if key := lookup(); key != nil {
+		return key, nil
+	}
+	if !p.keysFetched.IsZero() && p.Now().Sub(p.keysFetched) < KeyRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = p.getJSON(ctx, e.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if key, err := k.publicKey(); err == nil && (k.Use == "" || k.Use == "sig") {
+			p.keys[k.Kid] = key
+		}
+	}
+	p.keysFetched = p.Now()
+
+	if key := lookup(); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+}
+
+// jwk is a JSON Web Key of the provider.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey parses an RSA or P-256 key.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch {
+	case k.Kty == "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decode(k.X)
+		if err != nil || len(x) != 32 {
+			return nil, errors.New("invalid EC key")
+		}
+		y, err := decode(k.Y)
+		if err != nil || len(y) != 32 {
+			return nil, errors.New("invalid EC key")
+		}
+		// crypto/ecdh rejects points which are not on the curve.
+		if _, err = ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,136 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+const redirectURL = "https://tracker.example.com/api/user/oidc/callback"
+
+func newProvider(idp *testutils.IdentityProvider) *Provider {
+	return NewProvider(idp.URL, idp.ClientID, idp.ClientSecret, redirectURL, []string{"openid", "profile"})
+}
+
+func TestLogin(t *testing.T) {
+	ctx := context.Background()
+
+	for _, secret := range []string{"secret", ""} {
+		idp := testutils.NewIdentityProvider("etracker", secret)
+		defer idp.Close()
+		p := newProvider(idp)
+
+		authURL, err := p.AuthCodeURL(ctx, "state", "nonce", "verifier")
+		if err != nil {
+			t.Fatalf("error building authorization URL: %v", err)
+		}
+		u, _ := url.Parse(authURL)
+		query := u.Query()
+		challenge := sha256.Sum256([]byte("verifier"))
+		if u.Path != "/authorize" || query.Get("state") != "state" || query.Get("scope") != "openid profile" ||
+			query.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			t.Errorf("unexpected authorization URL %s", authURL)
+		}
+
+		for _, ec := range []bool{false, true} {
+			idp.EC = ec
+			callback, _ := url.Parse(idp.Authorize(authURL, "user-1", map[string]any{"groups": []string{"staff"}}))
+			claims, err := p.Exchange(ctx, callback.Query().Get("code"), "nonce", "verifier")
+			if err != nil {
+				t.Fatalf("secret %q, ec %v: error exchanging code: %v", secret, ec, err)
+			}
+			if claims.String("sub") != "user-1" || len(claims.Strings("groups")) != 1 {
+				t.Errorf("unexpected claims %v", claims)
+			}
+		}
+		if idp.KeyFetches() != 1 {
+			t.Errorf("expected the keys to be fetched once, got %d", idp.KeyFetches())
+		}
+
+		callback, _ := url.Parse(idp.Authorize(authURL, "user-1", nil))
+		code := callback.Query().Get("code")
+		if _, err := p.Exchange(ctx, code, "nonce", "other"); !errors.Is(err, ErrProvider) {
+			t.Errorf("expected a provider error for another verifier, got %v", err)
+		}
+		if _, err := p.Exchange(ctx, code, "nonce", "verifier"); !errors.Is(err, ErrProvider) {
+			t.Errorf("expected a provider error for a used code, got %v", err)
+		}
+		callback, _ = url.Parse(idp.Authorize(authURL, "user-1", nil))
+		if _, err := p.Exchange(ctx, callback.Query().Get("code"), "other", "verifier"); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("expected an invalid token for another nonce, got %v", err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	idp := testutils.NewIdentityProvider("etracker", "secret")
+	defer idp.Close()
+	p := newProvider(idp)
+
+	with := func(name string, value any) map[string]any {
+		claims := idp.Claims("user-1", "nonce")
+		claims[name] = value
+		return claims
+	}
+
+	valid := idp.Token(idp.Claims("user-1", "nonce"))
+	if _, err := p.Verify(ctx, valid, "nonce"); err != nil {
+		t.Fatalf("error verifying token: %v", err)
+	}
+
+	data := []struct {
+		name  string
+		token string
+	}{
+		{"other issuer", idp.Token(with("iss", "https://evil.example.com"))},
+		{"other audience", idp.Token(with("aud", []string{"other"}))},
+		{"other authorized party", idp.Token(with("azp", "other"))},
+		{"expired", idp.Token(with("exp", time.Now().Add(-time.Hour).Unix()))},
+		{"no subject", idp.Token(with("sub", ""))},
+		{"tampered", valid[:len(valid)-2] + "AA"},
+		{"malformed", "not.a.jwt.at.all"},
+	}
+	for _, d := range data {
+		if _, err := p.Verify(ctx, d.token, "nonce"); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected an invalid token, got %v", d.name, err)
+		}
+	}
+
+	if _, err := p.Verify(ctx, idp.Token(with("aud", []string{"etracker", "other"})), "nonce"); err != nil {
+		t.Errorf("expected a token for several audiences to be valid, got %v", err)
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	ctx := context.Background()
+	idp := testutils.NewIdentityProvider("etracker", "secret")
+	defer idp.Close()
+	p := newProvider(idp)
+	now := time.Now()
+	p.Now = func() time.Time { return now }
+
+	if _, err := p.Verify(ctx, idp.Token(idp.Claims("user-1", "nonce")), "nonce"); err != nil {
+		t.Fatalf("error verifying token: %v", err)
+	}
+
+	// After a key rotation, the keys are fetched again, but not more than
+	// once per KeyRefreshInterval.
+	idp.RotateKeys()
+	if _, err := p.Verify(ctx, idp.Token(idp.Claims("user-1", "nonce")), "nonce"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("expected an unknown key before the refresh interval, got %v", err)
+	}
+	now = now.Add(KeyRefreshInterval)
+	if _, err := p.Verify(ctx, idp.Token(idp.Claims("user-1", "nonce")), "nonce"); err != nil {
+		t.Errorf("expected the rotated key to be fetched, got %v", err)
+	}
+	if idp.KeyFetches() != 2 {
+		t.Errorf("expected the keys to be fetched twice, got %d", idp.KeyFetches())
+	}
+}
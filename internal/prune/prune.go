@@ -3,22 +3,32 @@ package prune
 import (
 	"context"
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/scrape"
 	"github.com/jackc/pgx/v5"
 )
 
 const (
 	PruneIntervalMonths     = 3
 	PruneIntervalTimerHours = 24 * 7 // 7 days
+
+	DailyTimerHours = 24
+
+	// SweepInterval is how often stale announces are expired, see
+	// SweepStale.
+	SweepInterval = time.Minute
 )
 
 // PruneAnnounceKeys removes rows from the peers table, and corresponding
 // announces from the announce table, for announce keys that have not been
 // seen (either from original creation or last announce) for PruneInterval.
 func PruneAnnounceKeys(ctx context.Context, conf config.Config) error {
-	query := fmt.Sprintf(`
+	cutoff := conf.Now().AddDate(0, -PruneIntervalMonths, 0)
+	query := `
 		DELETE FROM peers WHERE id IN
 		(
 		SELECT
@@ -29,19 +39,23 @@ func PruneAnnounceKeys(ctx context.Context, conf config.Config) error {
 		GROUP BY
 		    peers.id
 		HAVING (MAX(announces.last_announce) IS NULL
-		    OR MAX(announces.last_announce) < NOW() - INTERVAL '%d months')
-		AND (peers.created_time < NOW() - INTERVAL '%d months')
+		    OR MAX(announces.last_announce) < $1)
+		AND (peers.created_time < $1)
 		)
 		RETURNING
 		    peers.announce_key
-		`, PruneIntervalMonths, PruneIntervalMonths)
-	rows, _ := conf.Dbpool.Query(ctx, query)
+		`
+	rows, _ := conf.Dbpool.Query(ctx, query, cutoff)
 	keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
 	if err != nil {
 		return fmt.Errorf("error pruning old announce keys from postgres: %w", err)
 	}
 	if len(keys) > 0 {
-		if err = conf.Rdb.Unlink(ctx, keys...).Err(); err != nil {
+		cacheKeys := make([]string, len(keys))
+		for i, key := range keys {
+			cacheKeys[i] = "announce:" + key
+		}
+		if err = conf.Rdb.Unlink(ctx, cacheKeys...).Err(); err != nil {
 			// Since the Redis DB is persistent, it is an error if we
 			// fail to invalidate these cache entries.
 			return fmt.Errorf("error pruning old announce keys from redis: %w", err)
@@ -51,16 +65,219 @@ func PruneAnnounceKeys(ctx context.Context, conf config.Config) error {
 	return nil
 }
 
-func PruneTimer(ctx context.Context, conf config.Config, errCh chan error) {
+// PruneRetention enforces the configured retention windows, deleting
+// announces, and key activity, IP changes, and traffic, older than
+// AnnounceRetentionDays and ActivityRetentionDays. A window of zero keeps
+// data forever.
+//
+// PruneAnnounceKeys decides whether a key is unused based on its announces,
+// so the announce retention window is never shorter than PruneIntervalMonths.
+func PruneRetention(ctx context.Context, conf config.Config) error {
+	now := conf.Now()
+
+	if days := conf.AnnounceRetentionDays; days > 0 {
+		cutoff := now.AddDate(0, 0, -days)
+		if monthsCutoff := now.AddDate(0, -PruneIntervalMonths, 0); monthsCutoff.Before(cutoff) {
+			cutoff = monthsCutoff
+		}
+		_, err := conf.Dbpool.Exec(ctx, `
+			DELETE FROM announces
+			WHERE last_announce < $1
+			`, cutoff)
+		if err != nil {
+			return fmt.Errorf("error pruning announces past retention: %w", err)
+		}
+	}
+
+	if days := conf.ActivityRetentionDays; days > 0 {
+		_, err := conf.Dbpool.Exec(ctx, `
+			DELETE FROM key_activity
+			WHERE day < $1::date
+			`, now.AddDate(0, 0, -days))
+		if err != nil {
+			return fmt.Errorf("error pruning key activity past retention: %w", err)
+		}
+		_, err = conf.Dbpool.Exec(ctx, `
+			DELETE FROM ip_changes
+			WHERE change_time < $1
+			`, now.AddDate(0, 0, -days))
+		if err != nil {
+			return fmt.Errorf("error pruning ip changes past retention: %w", err)
+		}
+		_, err = conf.Dbpool.Exec(ctx, `
+			DELETE FROM user_traffic
+			WHERE hour < $1
+			`, now.AddDate(0, 0, -days))
+		if err != nil {
+			return fmt.Errorf("error pruning user traffic past retention: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// PruneUnusedKeys removes announce keys which were created more than
+// UnusedKeyDays ago and have never been used for an announce. This is much
+// tighter than PruneAnnounceKeys, and cleans up after scripted key
+// generation. Keys with recorded statistics or activity, and keys owned by
+// a user, are never removed here, even if their announces have since been
+// pruned.
+func PruneUnusedKeys(ctx context.Context, conf config.Config) error {
+	if conf.UnusedKeyDays <= 0 {
+		return nil
+	}
+
+	query := `
+		DELETE FROM peers
+		WHERE created_time < $1
+		    AND users_id IS NULL
+		    AND snatched = 0
+		    AND uploaded = 0
+		    AND downloaded = 0
+		    AND NOT EXISTS (
+			SELECT FROM announces WHERE announces.peers_id = peers.id)
+		    AND NOT EXISTS (
+			SELECT FROM key_activity WHERE key_activity.peers_id = peers.id)
+		RETURNING
+		    announce_key
+		`
+	rows, _ := conf.Dbpool.Query(ctx, query, conf.Now().AddDate(0, 0, -conf.UnusedKeyDays))
+	keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("error pruning unused announce keys from postgres: %w", err)
+	}
+	if len(keys) > 0 {
+		cacheKeys := make([]string, len(keys))
+		for i, key := range keys {
+			cacheKeys[i] = "announce:" + key
+		}
+		if err = conf.Rdb.Unlink(ctx, cacheKeys...).Err(); err != nil {
+			return fmt.Errorf("error pruning unused announce keys from redis: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// readOnly reports whether a timer should skip pruning because the tracker
+// is read-only. Errors are treated as read-only, since pruning can wait.
+func readOnly(ctx context.Context, conf config.Config) bool {
+	enabled, err := handler.ReadOnly(ctx, conf)
+	return enabled || err != nil
+}
+
+// DailyTimer enforces retention windows and prunes unused keys every
+// DailyTimerHours until the context is cancelled, skipping while read-only.
+// It returns the first error encountered.
+func DailyTimer(ctx context.Context, conf config.Config) error {
+	ticker := time.NewTicker(DailyTimerHours * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if readOnly(ctx, conf) {
+				continue
+			}
+			err := PruneRetention(ctx, conf)
+			if err != nil {
+				return err
+			}
+			err = PruneUnusedKeys(ctx, conf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// SweepStale marks announces which have gone stale or stopped as expired,
+// so that they are excluded from every count of active peers, see
+// db.Active, and returns the infohashes of the swarms which changed. The
+// next announce of an expired peer makes it active again.
+func SweepStale(ctx context.Context, conf config.Config) ([][]byte, error) {
+	rows, _ := conf.Dbpool.Query(ctx, `
+		WITH expired AS (
+		    UPDATE
+			announces
+		    SET
+			expired = TRUE
+		    WHERE
+			NOT expired
+			AND (last_announce < $1
+			    OR event = $2)
+		    RETURNING
+			info_hash_id
+		)
+		SELECT DISTINCT
+		    info_hash
+		FROM
+		    infohashes
+		    JOIN expired ON infohashes.id = expired.info_hash_id
+		`,
+		conf.StaleCutoff(), config.Stopped)
+	info_hashes, err := pgx.CollectRows(rows, pgx.RowTo[[]byte])
+	if err != nil {
+		return nil, fmt.Errorf("error sweeping stale announces: %w", err)
+	}
+
+	return info_hashes, nil
+}
+
+// SweepTimer expires stale announces every SweepInterval until the context
+// is cancelled, skipping while read-only, and drops the cached scrape
+// results of the swarms which changed, so that scrapes reflect them
+// immediately. Errors are logged, and the sweep is tried again on the next
+// tick.
+func SweepTimer(ctx context.Context, conf config.Config) error {
+	ticker := time.NewTicker(SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if readOnly(ctx, conf) {
+				continue
+			}
+			info_hashes, err := SweepStale(ctx, conf)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Print(err)
+				}
+				continue
+			}
+			if conf.ScrapeCacheTTL > 0 {
+				if err = scrape.Forget(ctx, conf, info_hashes); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+	}
+}
+
+// PruneTimer prunes announce keys every PruneIntervalTimerHours until the
+// context is cancelled, skipping while read-only. It returns the first error
+// encountered while pruning.
+func PruneTimer(ctx context.Context, conf config.Config) error {
 	ticker := time.NewTicker(PruneIntervalTimerHours * time.Hour)
+	defer ticker.Stop()
 
-	go func() {
-		for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if readOnly(ctx, conf) {
+				continue
+			}
 			err := PruneAnnounceKeys(ctx, conf)
 			if err != nil {
-				errCh <- err
-				return
+				return err
 			}
 		}
-	}()
+	}
 }
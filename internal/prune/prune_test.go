@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
 	"github.com/dmoerner/etracker/internal/handler"
 	"github.com/dmoerner/etracker/internal/testutils"
 )
@@ -38,11 +41,8 @@ func TestOldCreationOldAnnounces(t *testing.T) {
 
 	handler(w, req)
 
-	// Since we only have one announce, we can UPDATE on all rows. We need to disable
-	// the trigger first.
+	// Since we only have one announce, we can UPDATE on all rows.
 	query = fmt.Sprintf(`
-		ALTER TABLE announces DISABLE TRIGGER ALL;
-
 		UPDATE
 		    announces
 		SET
@@ -185,3 +185,178 @@ func TestRecentCreationNoAnnounces(t *testing.T) {
 		t.Errorf("expected %d keys in db, found %d", expected, tracked_keys)
 	}
 }
+
+func TestRetention(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	conf.AnnounceRetentionDays = 1
+	conf.ActivityRetentionDays = 1
+
+	handler := handler.PeerHandler(ctx, conf)
+	for _, key := range []string{testutils.AnnounceKeys[1], testutils.AnnounceKeys[2]} {
+		req := testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: key,
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+		})
+		handler(httptest.NewRecorder(), req)
+	}
+
+	// Age only the first key's data past retention, and past the minimum
+	// announce retention of PruneIntervalMonths.
+	query := fmt.Sprintf(`
+		UPDATE
+		    announces
+		SET
+		    last_announce = last_announce - INTERVAL '%d months'
+		FROM
+		    peers
+		WHERE
+		    announces.peers_id = peers.id
+		    AND announce_key = $1;
+		`, PruneIntervalMonths+1)
+	_, err := conf.Dbpool.Exec(ctx, query, testutils.AnnounceKeys[1])
+	if err != nil {
+		t.Fatalf("error setting fake announce time: %v", err)
+	}
+
+	_, err = conf.Dbpool.Exec(ctx, `
+		UPDATE
+		    key_activity
+		SET
+		    day = day - 2
+		FROM
+		    peers
+		WHERE
+		    key_activity.peers_id = peers.id
+		    AND announce_key = $1
+		`, testutils.AnnounceKeys[1])
+	if err != nil {
+		t.Fatalf("error setting fake activity day: %v", err)
+	}
+
+	err = PruneRetention(ctx, conf)
+	if err != nil {
+		t.Fatalf("error pruning past retention: %v", err)
+	}
+
+	for _, table := range []string{"announces", "key_activity"} {
+		var count int
+		err = conf.Dbpool.QueryRow(ctx, "SELECT COUNT(*) FROM "+table).Scan(&count)
+		if err != nil {
+			t.Fatalf("error querying db: %v", err)
+		}
+		if count != 1 {
+			t.Errorf("expected %d rows in %s, found %d", 1, table, count)
+		}
+	}
+}
+
+func TestUnusedKeys(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	conf.UnusedKeyDays = 7
+
+	// The first key is used, the second and third are not. Only the
+	// second key is older than UnusedKeyDays.
+	handler := handler.PeerHandler(ctx, conf)
+	req := testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+	})
+	handler(httptest.NewRecorder(), req)
+
+	query := fmt.Sprintf(`
+		UPDATE
+		    peers
+		SET
+		    created_time = created_time - INTERVAL '%d days'
+		WHERE
+		    announce_key = $1 OR announce_key = $2
+		`, conf.UnusedKeyDays+1)
+	_, err := conf.Dbpool.Exec(ctx, query, testutils.AnnounceKeys[1], testutils.AnnounceKeys[2])
+	if err != nil {
+		t.Fatalf("error setting fake key created time: %v", err)
+	}
+
+	err = PruneUnusedKeys(ctx, conf)
+	if err != nil {
+		t.Fatalf("error pruning unused keys: %v", err)
+	}
+
+	var tracked_keys int
+	err = conf.Dbpool.QueryRow(ctx, `
+		SELECT COUNT(announce_key) FROM peers
+		`).Scan(&tracked_keys)
+	if err != nil {
+		t.Errorf("error querying db: %v", err)
+	}
+
+	expected := len(testutils.AnnounceKeys) - 1
+
+	if tracked_keys != expected {
+		t.Errorf("expected %d keys in db, found %d", expected, tracked_keys)
+	}
+}
+
+func TestSweepStale(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	start := time.Now()
+	clock := testutils.NewFakeClock(start)
+	conf.Clock = clock
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	seeder := testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+	}
+	leecher := testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[2],
+		Info_hash:   testutils.AllowedInfoHashes["b"],
+		Left:        1,
+	}
+	peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(seeder))
+	peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(leecher))
+
+	clock.Advance(config.StaleInterval*time.Second + time.Minute)
+	peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(leecher))
+
+	swept, err := SweepStale(ctx, conf)
+	if err != nil {
+		t.Fatalf("error sweeping stale announces: %v", err)
+	}
+	if len(swept) != 1 || string(swept[0]) != testutils.AllowedInfoHashes["a"] {
+		t.Errorf("expected only infohash a to be swept, got %q", swept)
+	}
+
+	// An instance whose clock lags behind still agrees that the swept
+	// peer is gone.
+	active := func() int {
+		var count int
+		err := conf.Dbpool.QueryRow(ctx, `
+			SELECT COUNT(*) FROM announces WHERE `+db.Active(1, 2),
+			config.Stopped, start.Add(-time.Minute)).Scan(&count)
+		if err != nil {
+			t.Fatalf("error querying test db: %v", err)
+		}
+		return count
+	}
+	if count := active(); count != 1 {
+		t.Errorf("expected 1 active announce after sweeping, got %d", count)
+	}
+
+	// Sweeping is idempotent, and the next announce revives the peer.
+	if swept, err = SweepStale(ctx, conf); err != nil || len(swept) != 0 {
+		t.Errorf("expected nothing to sweep, got %q, %v", swept, err)
+	}
+	peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(seeder))
+	if count := active(); count != 2 {
+		t.Errorf("expected 2 active announces after announcing again, got %d", count)
+	}
+}
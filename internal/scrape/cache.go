@@ -0,0 +1,103 @@
+package scrape
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/events"
+)
+
+// cacheKey is the Redis key of the cached scrape result for an infohash.
+// Infohashes which are not tracked are cached as an empty string, so that
+// repeated scrapes for them do not reach Postgres either.
+func cacheKey(info_hash []byte) string {
+	return "scrape:" + string(info_hash)
+}
+
+// cachedFiles returns the cached scrape results for info_hashes, and the
+// infohashes which were not cached. Errors are only logged, and every
+// infohash is then treated as a miss, since scrapes can still be answered
+// from Postgres.
+func cachedFiles(ctx context.Context, conf config.Config, info_hashes [][]byte) (map[string]File, [][]byte) {
+	files := make(map[string]File)
+
+	keys := make([]string, len(info_hashes))
+	for i, info_hash := range info_hashes {
+		keys[i] = cacheKey(info_hash)
+	}
+	values, err := conf.Rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		log.Printf("Error reading scrape cache: %v", err)
+		return files, info_hashes
+	}
+
+	var misses [][]byte
+	for i, value := range values {
+		cached, ok := value.(string)
+		if !ok {
+			misses = append(misses, info_hashes[i])
+			continue
+		}
+		if cached == "" {
+			continue
+		}
+		var file File
+		if err = json.Unmarshal([]byte(cached), &file); err != nil {
+			misses = append(misses, info_hashes[i])
+			continue
+		}
+		files[string(info_hashes[i])] = file
+	}
+
+	return files, misses
+}
+
+// cacheFiles caches the scrape results fetched for info_hashes for
+// ScrapeCacheTTL. Errors are only logged.
+func cacheFiles(ctx context.Context, conf config.Config, info_hashes [][]byte, files map[string]File) {
+	pipe := conf.Rdb.Pipeline()
+	for _, info_hash := range info_hashes {
+		var value []byte
+		if file, ok := files[string(info_hash)]; ok {
+			value, _ = json.Marshal(file)
+		}
+		pipe.Set(ctx, cacheKey(info_hash), value, conf.ScrapeCacheTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Error writing scrape cache: %v", err)
+	}
+}
+
+// Invalidate returns an events.Handler which drops the cached scrape result
+// for the infohash of each event, so that completed downloads are counted
+// in the next scrape rather than after ScrapeCacheTTL. Peers which go stale
+// are forgotten when they are swept, see prune.SweepTimer. Other changes to
+// a swarm are only reflected once the cached result expires.
+func Invalidate(conf config.Config) events.Handler {
+	return func(ctx context.Context, e events.Event) {
+		if len(e.Info_hash) == 0 {
+			return
+		}
+		if err := Forget(ctx, conf, [][]byte{e.Info_hash}); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// Forget drops the cached scrape results for info_hashes.
+func Forget(ctx context.Context, conf config.Config, info_hashes [][]byte) error {
+	if len(info_hashes) == 0 {
+		return nil
+	}
+	keys := make([]string, len(info_hashes))
+	for i, info_hash := range info_hashes {
+		keys[i] = cacheKey(info_hash)
+	}
+	if err := conf.Rdb.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("error invalidating scrape cache: %w", err)
+	}
+	return nil
+}
@@ -2,13 +2,19 @@ package scrape
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/dmoerner/etracker/internal/bencode"
 	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/locale"
 
 	bencode_go "github.com/jackpal/bencode-go"
 )
@@ -17,121 +23,84 @@ type Scrape struct {
 	Files map[string]File `bencode:"files"`
 }
 
+// File is the scrape result of one infohash. Incomplete counts every peer
+// which is not a seeder, while Downloaders is the BEP 21 count of those
+// which are downloading, leaving out partial seeds.
 type File struct {
-	Complete   int    `bencode:"complete"`
-	Downloaded int    `bencode:"downloaded"`
-	Incomplete int    `bencode:"incomplete"`
-	Name       string `bencode:"name"`
+	Complete    int    `bencode:"complete"`
+	Downloaded  int    `bencode:"downloaded"`
+	Downloaders int    `bencode:"downloaders"`
+	Incomplete  int    `bencode:"incomplete"`
+	Name        string `bencode:"name"`
 }
 
-// abortScrape is a helper function to write a failure reason to the peer. This
-// is an unofficial extension to the scraping protocol. Errors do not need to
-// be logged.
-func abortScrape(w http.ResponseWriter, reason string) {
-	_, _ = w.Write(bencode.FailureReason(reason))
+// abortScrape is a helper function to write a failure reason to the peer in
+// lang. This is an unofficial extension to the scraping protocol. Errors do
+// not need to be logged.
+func abortScrape(w http.ResponseWriter, lang string, reason string) {
+	_, _ = w.Write(bencode.FailureReason(locale.Sprintf(lang, reason)))
 }
 
 // ScrapeHandler implements the scrape convention to return information on
 // currently available torrents. For more information, see
 // https://wiki.theory.org/BitTorrentSpecification#Tracker_.27scrape.27_Convention
 //
-// Query is constructed in three stages, since SQL requires inserting the
-// optional WHERE specification for specific infohashes in the middle of the
-// query.
+// The announce key in the path is validated like an announce, and
+// infohashes restricted to other keys are left out. If PrivateScrape is
+// configured, results are restricted to infohashes the key has announced.
+// Results for specific infohashes are cached, see cachedFiles, unless
+// PrivateScrape is configured, since they then depend on the key.
 func ScrapeHandler(ctx context.Context, conf config.Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Start constructing query.
-		query := fmt.Sprintf(`
-			WITH recent_announces AS (
-			    SELECT DISTINCT ON (peers_id, info_hash_id)
-				amount_left,
-				info_hash_id
-			    FROM
-				announces
-			    WHERE
-				last_announce >= NOW() - INTERVAL '%d seconds'
-				AND event <> $1
-			    ORDER BY
-				peers_id,
-				info_hash_id,
-				last_announce DESC
-			)
-			SELECT
-			    info_hash,
-			    name,
-			    downloaded,
-			    COUNT(*) FILTER (WHERE recent_announces.amount_left > 0) AS leechers,
-			    COUNT(*) FILTER (WHERE recent_announces.amount_left = 0) AS seeders
-			FROM
-			    infohashes
-			    LEFT JOIN recent_announces ON infohashes.id = recent_announces.info_hash_id
-			`,
-			config.StaleInterval)
-
-		// This must be type []any to match the signature of pgxpool.Query(), and because
-		// it takes multiple types.
-		var paramsSlice []any
-		paramsSlice = append(paramsSlice, config.Stopped)
-
-		if infoHashes, ok := r.URL.Query()["info_hash"]; ok {
-			query += `WHERE `
-			for idx, info_hash := range infoHashes {
-				if idx > 0 {
-					query += " OR "
-				}
-				unescaped, err := url.QueryUnescape(info_hash)
-				if err != nil {
-					// Errors are skipped, clients have the responsibility to send
-					// proper infohashes.
-					paramsSlice = append(paramsSlice, []byte(""))
-				} else {
-					paramsSlice = append(paramsSlice, []byte(unescaped))
-				}
-				// Slice is zero-indexed, but SQL parameters are one-indexed, and
-				// the first parameter is already taken.
-				query += fmt.Sprintf("info_hash = $%d", idx+2)
-			}
-		}
-
-		query += `
-			GROUP BY
-			    info_hash,
-			    name,
-			    downloaded
-			`
-		// Finished constructing query.
-
-		rows, err := conf.Dbpool.Query(ctx, query, paramsSlice...)
+		lang := locale.Negotiate(r.Header.Get("Accept-Language"), conf.Language)
+		announce_key := r.PathValue("id")
+		tracked, err := handler.KeyTracked(ctx, conf, announce_key)
 		if err != nil {
-			log.Printf("Error fetching data for scrape: %v", err)
-			abortScrape(w, "error fetching data for scrape")
+			log.Printf("Error validating announce key for scrape: %v", err)
+			abortScrape(w, lang, "error validating announce key")
+			return
+		}
+		if !tracked {
+			abortScrape(w, lang, "untracked announce key, generate new announce url")
 			return
 		}
 
-		defer rows.Close()
-
-		var scrape Scrape
-
-		scrape.Files = make(map[string]File)
+		// A nil list of infohashes scrapes every infohash.
+		var info_hashes [][]byte
+		for _, info_hash := range r.URL.Query()["info_hash"] {
+			unescaped, err := url.QueryUnescape(info_hash)
+			if err != nil {
+				// Errors are skipped, clients have the responsibility to send
+				// proper infohashes.
+				info_hashes = append(info_hashes, []byte(""))
+			} else {
+				info_hashes = append(info_hashes, []byte(unescaped))
+			}
+		}
 
-		for rows.Next() {
-			var info_hash []byte
-			var name string
-			var downloaded int
-			var incomplete int
-			var complete int
+		scrape := Scrape{Files: make(map[string]File)}
+		misses := info_hashes
+		cached := conf.ScrapeCacheTTL > 0 && info_hashes != nil && !conf.Settings().PrivateScrape
+		if cached {
+			scrape.Files, misses = cachedFiles(ctx, conf, info_hashes)
+		}
 
-			err = rows.Scan(&info_hash, &name, &downloaded, &incomplete, &complete)
+		if !cached || len(misses) > 0 {
+			files, err := queryFiles(ctx, conf, announce_key, misses)
 			if err != nil {
-				// This error will be handled when rows.Err() is checked.
-				break
+				log.Printf("Error fetching data for scrape: %v", err)
+				abortScrape(w, lang, "error fetching data for scrape")
+				return
+			}
+			maps.Copy(scrape.Files, files)
+			if cached {
+				cacheFiles(ctx, conf, misses, files)
 			}
-			scrape.Files[string(info_hash)] = File{complete, downloaded, incomplete, name}
 		}
 
-		if rows.Err() != nil {
-			log.Printf("Error parsing data for scrape: %v", rows.Err())
-			abortScrape(w, "error parsing data for scrape")
+		if err = dropRestricted(ctx, conf, announce_key, scrape.Files); err != nil {
+			log.Printf("Error checking access for scrape: %v", err)
+			abortScrape(w, lang, "error fetching data for scrape")
 			return
 		}
 
@@ -142,3 +111,115 @@ func ScrapeHandler(ctx context.Context, conf config.Config) func(w http.Response
 		}
 	}
 }
+
+// dropRestricted removes the files of infohashes which are restricted to
+// other announce keys, see handler.CheckACL. Since cached results are shared
+// between keys, this is done after the cache is consulted.
+func dropRestricted(ctx context.Context, conf config.Config, announce_key string, files map[string]File) error {
+	for info_hash := range files {
+		err := handler.CheckACL(ctx, conf, announce_key, []byte(info_hash))
+		if errors.Is(err, handler.ErrRestricted) {
+			delete(files, info_hash)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryFiles fetches the scrape results for info_hashes from Postgres, or
+// for every infohash if info_hashes is nil, keyed by infohash.
+//
+// Query is constructed in three stages, since SQL requires inserting the
+// optional WHERE specification for specific infohashes in the middle of the
+// query.
+func queryFiles(ctx context.Context, conf config.Config, announce_key string, info_hashes [][]byte) (map[string]File, error) {
+	// Start constructing query.
+	query := `
+		WITH ` + db.RecentAnnounces(1, 2, "amount_left", "event") + `
+		SELECT
+		    info_hash,
+		    name,
+		    downloaded,
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left > 0) AS leechers,
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left > 0
+			AND NOT ` + db.PartialSeed(3) + `) AS downloaders,
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left = 0) AS seeders
+		FROM
+		    infohashes
+		    LEFT JOIN recent_announces ON infohashes.id = recent_announces.info_hash_id
+		`
+
+	// This must be type []any to match the signature of pgxpool.Query(), and because
+	// it takes multiple types.
+	var paramsSlice []any
+	paramsSlice = append(paramsSlice, config.Stopped, conf.StaleCutoff(), config.Paused)
+
+	var conditions []string
+
+	if conf.Settings().PrivateScrape {
+		paramsSlice = append(paramsSlice, announce_key)
+		conditions = append(conditions, fmt.Sprintf(`infohashes.id IN (
+		    SELECT
+			info_hash_id
+		    FROM
+			announces
+			JOIN peers ON announces.peers_id = peers.id
+		    WHERE
+			announce_key = $%d)`, len(paramsSlice)))
+	}
+
+	if info_hashes != nil {
+		var matches []string
+		for _, info_hash := range info_hashes {
+			paramsSlice = append(paramsSlice, info_hash)
+			// SQL parameters are one-indexed, so the parameter just
+			// appended is the length of the slice.
+			matches = append(matches, fmt.Sprintf("info_hash = $%d", len(paramsSlice)))
+		}
+		conditions = append(conditions, "("+strings.Join(matches, " OR ")+")")
+	}
+
+	if len(conditions) > 0 {
+		query += `WHERE ` + strings.Join(conditions, " AND ")
+	}
+
+	query += `
+		GROUP BY
+		    info_hash,
+		    name,
+		    downloaded
+		`
+	// Finished constructing query.
+
+	rows, err := conf.Dbpool.Query(ctx, query, paramsSlice...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	files := make(map[string]File)
+
+	for rows.Next() {
+		var info_hash []byte
+		var name string
+		var downloaded int
+		var incomplete int
+		var downloaders int
+		var complete int
+
+		err = rows.Scan(&info_hash, &name, &downloaded, &incomplete, &downloaders, &complete)
+		if err != nil {
+			// This error will be handled when rows.Err() is checked.
+			break
+		}
+		files[string(info_hash)] = File{complete, downloaded, downloaders, incomplete, name}
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error parsing data for scrape: %w", rows.Err())
+	}
+
+	return files, nil
+}
@@ -6,8 +6,10 @@ import (
 	"io"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/events"
 	"github.com/dmoerner/etracker/internal/handler"
 	"github.com/dmoerner/etracker/internal/testutils"
 )
@@ -36,12 +38,13 @@ func TestSpecificScrape(t *testing.T) {
 	request = httptest.NewRequest("GET",
 		fmt.Sprintf("http://example.com/scrape?info_hash=%s", testutils.AllowedInfoHashes["a"]),
 		nil)
+	request.SetPathValue("id", testutils.AnnounceKeys[1])
 	w = httptest.NewRecorder()
 	scrapeHandler(w, request)
 
 	body, _ := io.ReadAll(w.Result().Body)
 
-	expected := "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei1e10:downloadedi1e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaaeee"
+	expected := "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei1e10:downloadedi1e11:downloadersi0e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaaeee"
 
 	if string(body) != expected {
 		t.Errorf("expected non-empty swarm scrape %s, got %s", expected, body)
@@ -50,18 +53,53 @@ func TestSpecificScrape(t *testing.T) {
 	request = httptest.NewRequest("GET",
 		fmt.Sprintf("http://example.com/scrape?info_hash=%s&info_hash=%s", testutils.AllowedInfoHashes["a"], testutils.AllowedInfoHashes["b"]),
 		nil)
+	request.SetPathValue("id", testutils.AnnounceKeys[1])
 	w = httptest.NewRecorder()
 	scrapeHandler(w, request)
 
 	body, _ = io.ReadAll(w.Result().Body)
 
-	expected = "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei1e10:downloadedi1e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaae20:bbbbbbbbbbbbbbbbbbbbd8:completei0e10:downloadedi0e10:incompletei0e4:name20:bbbbbbbbbbbbbbbbbbbbeee"
+	expected = "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei1e10:downloadedi1e11:downloadersi0e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaae20:bbbbbbbbbbbbbbbbbbbbd8:completei0e10:downloadedi0e11:downloadersi0e10:incompletei0e4:name20:bbbbbbbbbbbbbbbbbbbbeee"
 
 	if string(body) != expected {
 		t.Errorf("expected non-empty swarm scrape %s, got %s", expected, body)
 	}
 }
 
+// TestPartialSeedScrape tests that BEP 21 partial seeds are counted as
+// incomplete but not as downloaders.
+func TestPartialSeedScrape(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	for i, event := range []config.Event{config.Paused, config.Started} {
+		request := testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[i+1],
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Event:       event,
+			Left:        100,
+		})
+		peerHandler(httptest.NewRecorder(), request)
+	}
+
+	request := httptest.NewRequest("GET",
+		fmt.Sprintf("http://example.com/scrape?info_hash=%s", testutils.AllowedInfoHashes["a"]),
+		nil)
+	request.SetPathValue("id", testutils.AnnounceKeys[1])
+	w := httptest.NewRecorder()
+	ScrapeHandler(ctx, conf)(w, request)
+
+	body, _ := io.ReadAll(w.Result().Body)
+
+	expected := "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei0e10:downloadedi0e11:downloadersi1e10:incompletei2e4:name20:aaaaaaaaaaaaaaaaaaaaeee"
+
+	if string(body) != expected {
+		t.Errorf("expected scrape with partial seed %s, got %s", expected, body)
+	}
+}
+
 func TestAllScrape(t *testing.T) {
 	ctx := context.Background()
 	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
@@ -70,12 +108,13 @@ func TestAllScrape(t *testing.T) {
 	scrapeHandler := ScrapeHandler(ctx, conf)
 
 	request := httptest.NewRequest("GET", "http://example.com/scrape", nil)
+	request.SetPathValue("id", testutils.AnnounceKeys[1])
 	w := httptest.NewRecorder()
 	scrapeHandler(w, request)
 
 	body, _ := io.ReadAll(w.Result().Body)
 
-	expected := "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei0e10:downloadedi0e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaae20:bbbbbbbbbbbbbbbbbbbbd8:completei0e10:downloadedi0e10:incompletei0e4:name20:bbbbbbbbbbbbbbbbbbbbe20:ccccccccccccccccccccd8:completei0e10:downloadedi0e10:incompletei0e4:name20:cccccccccccccccccccce20:ddddddddddddddddddddd8:completei0e10:downloadedi0e10:incompletei0e4:name20:ddddddddddddddddddddeee"
+	expected := "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei0e10:downloadedi0e11:downloadersi0e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaae20:bbbbbbbbbbbbbbbbbbbbd8:completei0e10:downloadedi0e11:downloadersi0e10:incompletei0e4:name20:bbbbbbbbbbbbbbbbbbbbe20:ccccccccccccccccccccd8:completei0e10:downloadedi0e11:downloadersi0e10:incompletei0e4:name20:cccccccccccccccccccce20:ddddddddddddddddddddd8:completei0e10:downloadedi0e11:downloadersi0e10:incompletei0e4:name20:ddddddddddddddddddddeee"
 
 	if string(body) != expected {
 		t.Errorf("expected empty swarm scrape %s, got %s", expected, body)
@@ -98,9 +137,185 @@ func TestAllScrape(t *testing.T) {
 
 	body, _ = io.ReadAll(w.Result().Body)
 
-	expected = "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei1e10:downloadedi1e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaae20:bbbbbbbbbbbbbbbbbbbbd8:completei0e10:downloadedi0e10:incompletei0e4:name20:bbbbbbbbbbbbbbbbbbbbe20:ccccccccccccccccccccd8:completei0e10:downloadedi0e10:incompletei0e4:name20:cccccccccccccccccccce20:ddddddddddddddddddddd8:completei0e10:downloadedi0e10:incompletei0e4:name20:ddddddddddddddddddddeee"
+	expected = "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei1e10:downloadedi1e11:downloadersi0e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaae20:bbbbbbbbbbbbbbbbbbbbd8:completei0e10:downloadedi0e11:downloadersi0e10:incompletei0e4:name20:bbbbbbbbbbbbbbbbbbbbe20:ccccccccccccccccccccd8:completei0e10:downloadedi0e11:downloadersi0e10:incompletei0e4:name20:cccccccccccccccccccce20:ddddddddddddddddddddd8:completei0e10:downloadedi0e11:downloadersi0e10:incompletei0e4:name20:ddddddddddddddddddddeee"
 
 	if string(body) != expected {
 		t.Errorf("expected non-empty swarm scrape %s, got %s", expected, body)
 	}
 }
+
+func TestUntrackedScrape(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	scrapeHandler := ScrapeHandler(ctx, conf)
+
+	request := httptest.NewRequest("GET", "http://example.com/scrape", nil)
+	request.SetPathValue("id", testutils.UntrackedAnnounceKey)
+	w := httptest.NewRecorder()
+	scrapeHandler(w, request)
+
+	body, _ := io.ReadAll(w.Result().Body)
+
+	expected := "d14:failure reason49:untracked announce key, generate new announce urle"
+
+	if string(body) != expected {
+		t.Errorf("expected failure %s, got %s", expected, body)
+	}
+}
+
+func TestPrivateScrape(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	conf.UpdateSettings(func(s *config.Settings) { s.PrivateScrape = true })
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	request := testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+	})
+	peerHandler(httptest.NewRecorder(), request)
+
+	scrapeHandler := ScrapeHandler(ctx, conf)
+
+	data := []struct {
+		name     string
+		key      string
+		query    string
+		expected string
+	}{
+		{
+			"all",
+			testutils.AnnounceKeys[1],
+			"",
+			"d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei1e10:downloadedi0e11:downloadersi0e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaaeee",
+		},
+		{
+			"specific",
+			testutils.AnnounceKeys[1],
+			fmt.Sprintf("?info_hash=%s&info_hash=%s", testutils.AllowedInfoHashes["a"], testutils.AllowedInfoHashes["b"]),
+			"d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei1e10:downloadedi0e11:downloadersi0e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaaeee",
+		},
+		{
+			"other key",
+			testutils.AnnounceKeys[2],
+			"",
+			"d5:filesdee",
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://example.com/scrape"+d.query, nil)
+			request.SetPathValue("id", d.key)
+			w := httptest.NewRecorder()
+			scrapeHandler(w, request)
+
+			body, _ := io.ReadAll(w.Result().Body)
+			if string(body) != d.expected {
+				t.Errorf("expected %s, got %s", d.expected, body)
+			}
+		})
+	}
+}
+
+func TestRestrictedScrape(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+	conf.ScrapeCacheTTL = time.Minute
+
+	_, err := conf.Dbpool.Exec(ctx, `
+		INSERT INTO infohash_acls (info_hash_id, kind, value, created_time)
+		SELECT
+		    id,
+		    $2,
+		    $3,
+		    $4
+		FROM
+		    infohashes
+		WHERE
+		    info_hash = $1
+		`,
+		[]byte(testutils.AllowedInfoHashes["a"]), handler.ACLKey, testutils.AnnounceKeys[1], conf.Now())
+	if err != nil {
+		t.Fatalf("error adding acl entry: %v", err)
+	}
+	if err = handler.ACLsChanged(ctx, conf); err != nil {
+		t.Fatalf("error updating acls: %v", err)
+	}
+
+	scrapeHandler := ScrapeHandler(ctx, conf)
+
+	allowed := "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei0e10:downloadedi0e11:downloadersi0e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaaeee"
+
+	// The listed key scrapes first, so that the other key is answered from
+	// the cache.
+	data := []struct {
+		name     string
+		key      string
+		expected string
+	}{
+		{"listed key", testutils.AnnounceKeys[1], allowed},
+		{"other key", testutils.AnnounceKeys[2], "d5:filesdee"},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "http://example.com/scrape?info_hash="+testutils.AllowedInfoHashes["a"], nil)
+			request.SetPathValue("id", d.key)
+			w := httptest.NewRecorder()
+			scrapeHandler(w, request)
+
+			body, _ := io.ReadAll(w.Result().Body)
+			if string(body) != d.expected {
+				t.Errorf("expected %s, got %s", d.expected, body)
+			}
+		})
+	}
+}
+
+func TestScrapeCache(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+	conf.ScrapeCacheTTL = time.Minute
+
+	scrapeHandler := ScrapeHandler(ctx, conf)
+	scrape := func() string {
+		request := httptest.NewRequest("GET",
+			fmt.Sprintf("http://example.com/scrape?info_hash=%s&info_hash=%s", testutils.AllowedInfoHashes["a"], "untrackedinfohash000"),
+			nil)
+		request.SetPathValue("id", testutils.AnnounceKeys[1])
+		w := httptest.NewRecorder()
+		scrapeHandler(w, request)
+		body, _ := io.ReadAll(w.Result().Body)
+		return string(body)
+	}
+
+	empty := "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei0e10:downloadedi0e11:downloadersi0e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaaeee"
+	if body := scrape(); body != empty {
+		t.Fatalf("expected %s, got %s", empty, body)
+	}
+
+	handler.PeerHandler(ctx, conf)(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Event:       config.Completed,
+		Left:        0,
+	}))
+
+	if body := scrape(); body != empty {
+		t.Errorf("expected cached %s, got %s", empty, body)
+	}
+
+	Invalidate(conf)(ctx, events.Event{Kind: events.SnatchCompleted, Info_hash: []byte(testutils.AllowedInfoHashes["a"])})
+
+	expected := "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei1e10:downloadedi1e11:downloadersi0e10:incompletei0e4:name20:aaaaaaaaaaaaaaaaaaaaeee"
+	if body := scrape(); body != expected {
+		t.Errorf("expected %s after invalidation, got %s", expected, body)
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the format of access log lines.
+type AccessLogFormat string
+
+const (
+	// CommonLog is the NCSA Common Log Format.
+	CommonLog AccessLogFormat = "common"
+	// CombinedLog is the Common Log Format followed by the Referer and
+	// User-Agent headers, as written by Apache and nginx by default.
+	CombinedLog AccessLogFormat = "combined"
+)
+
+// ParseAccessLogFormat parses the name of an access log format.
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch f := AccessLogFormat(s); f {
+	case CommonLog, CombinedLog:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown access log format %q", s)
+}
+
+// accessLogTime is the timestamp layout of the Common Log Format.
+const accessLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogger writes access log lines for announces and scrapes, so that
+// existing log analysis tools such as GoAccess or AWStats can be used.
+//
+// Announce keys are credentials, so they are replaced with "-" in the logged
+// path, and the query string, which identifies the peer, is not logged. In
+// privacy mode, client IPs are truncated to their /24 or /48 network.
+type accessLogger struct {
+	mu        sync.Mutex
+	w         io.Writer
+	format    AccessLogFormat
+	anonymize bool
+}
+
+// sizeRecorder records the status code and the number of body bytes
+// written by a handler.
+type sizeRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (s *sizeRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *sizeRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.size += n
+	return n, err
+}
+
+// withAccessLog logs each request to l. A nil logger logs nothing.
+func withAccessLog(l *accessLogger) middleware {
+	return func(next http.Handler) http.Handler {
+		if l == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &sizeRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			l.log(r, start, rec.status, rec.size)
+		})
+	}
+}
+
+// log writes a single line for a request. Write errors are ignored, since
+// a full disk should not take the tracker down with it.
+func (l *accessLogger) log(r *http.Request, start time.Time, status int, size int) {
+	host := remoteIP(r)
+	if l.anonymize {
+		host = truncateIP(host)
+	}
+
+	path := r.URL.Path
+	if id := r.PathValue("id"); id != "" {
+		path = strings.Replace(path, "/"+id+"/", "/-/", 1)
+	}
+
+	bytes := "-"
+	if size > 0 {
+		bytes = strconv.Itoa(size)
+	}
+
+	line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s",
+		host, start.Format(accessLogTime), escapeLogField(r.Method), escapeLogField(path), escapeLogField(r.Proto), status, bytes)
+	if l.format == CombinedLog {
+		line += fmt.Sprintf(" \"%s\" \"%s\"", logHeader(r, "Referer"), logHeader(r, "User-Agent"))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = io.WriteString(l.w, line+"\n")
+}
+
+// logHeader returns the escaped value of a request header, or "-" if it is
+// not set.
+func logHeader(r *http.Request, name string) string {
+	v := r.Header.Get(name)
+	if v == "" {
+		return "-"
+	}
+	return escapeLogField(v)
+}
+
+// escapeLogField escapes quotes, backslashes, and non-printable bytes as
+// Apache does, so that a client cannot forge log lines.
+func escapeLogField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// truncateIP zeroes the host part of an IP address, keeping the /24 of an
+// IPv4 address or the /48 of an IPv6 address.
+func truncateIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "-"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
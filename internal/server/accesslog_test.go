@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	data := []struct {
+		name      string
+		format    AccessLogFormat
+		anonymize bool
+		target    string
+		expected  string
+	}{
+		{
+			"common",
+			CommonLog,
+			false,
+			"/0123456789abcdef/announce?info_hash=abc",
+			`^192\.0\.2\.7 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /-/announce HTTP/1\.1" 200 5\n$`,
+		},
+		{
+			"combined",
+			CombinedLog,
+			false,
+			"/0123456789abcdef/scrape",
+			`^192\.0\.2\.7 - - \[.+\] "GET /-/scrape HTTP/1\.1" 200 5 "-" "test \\"client\\"\\x01"\n$`,
+		},
+		{
+			"anonymized",
+			CommonLog,
+			true,
+			"/0123456789abcdef/announce",
+			`^192\.0\.2\.0 - - `,
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := &accessLogger{w: &buf, format: d.format, anonymize: d.anonymize}
+
+			mux := http.NewServeMux()
+			h := withAccessLog(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello"))
+			}))
+			mux.Handle("GET /{id}/announce", h)
+			mux.Handle("GET /{id}/scrape", h)
+
+			req := httptest.NewRequest("GET", d.target, nil)
+			req.RemoteAddr = "192.0.2.7:6881"
+			req.Header.Set("User-Agent", "test \"client\"\x01")
+			mux.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !regexp.MustCompile(d.expected).MatchString(buf.String()) {
+				t.Errorf("unexpected log line %q", buf.String())
+			}
+		})
+	}
+}
+
+func TestTruncateIP(t *testing.T) {
+	data := map[string]string{
+		"192.0.2.200":         "192.0.2.0",
+		"2001:db8:1:2:3::4":   "2001:db8:1::",
+		"::ffff:198.51.100.9": "198.51.100.0",
+		"not an ip":           "-",
+	}
+
+	for ip, expected := range data {
+		if got := truncateIP(ip); got != expected {
+			t.Errorf("truncateIP(%q): expected %q, got %q", ip, expected, got)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/anomaly"
+	"github.com/dmoerner/etracker/internal/bencode"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/locale"
+)
+
+// middleware wraps an http.Handler with additional behavior. Middleware is
+// composed per route group with chain, so that each group of routes only pays
+// for the checks it actually needs.
+type middleware func(http.Handler) http.Handler
+
+// chain composes middlewares into a single middleware. The first middleware
+// in the list is the outermost, and so runs first on each request.
+func chain(middlewares ...middleware) middleware {
+	return func(h http.Handler) http.Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			h = middlewares[i](h)
+		}
+		return h
+	}
+}
+
+var (
+	requestCounts  = expvar.NewMap("requests")
+	errorCounts    = expvar.NewMap("errors")
+	protocolCounts = expvar.NewMap("requests_by_protocol")
+	limitedCounts  = expvar.NewMap("announces_limited")
+)
+
+// statusRecorder records the status code written by a handler so it can be
+// used by the logging and metrics middleware.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Hijack passes WebSocket upgrades through to the underlying connection,
+// which is recorded as switching protocols.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	s.status = http.StatusSwitchingProtocols
+	return http.NewResponseController(s.ResponseWriter).Hijack()
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// withLogging logs each request along with its status and duration. The
+// matched route pattern is logged instead of the path, since the announce and
+// scrape paths contain the announce key.
+func withLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Printf("%s %q %d %v", r.Method, r.Pattern, rec.status, time.Since(start))
+	})
+}
+
+// withMetrics counts requests and server errors for a route group, and
+// requests per group and protocol version, such as "announce HTTP/2.0". The
+// counters are published with expvar.
+func withMetrics(group string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			requestCounts.Add(group, 1)
+			protocolCounts.Add(group+" "+r.Proto, 1)
+			if rec.status >= http.StatusInternalServerError {
+				errorCounts.Add(group, 1)
+			}
+		})
+	}
+}
+
+// withAnomalyDetection records requests and server errors for an endpoint
+// with the anomaly detector d. A nil detector records nothing.
+func withAnomalyDetection(d *anomaly.Detector, endpoint string) middleware {
+	return func(next http.Handler) http.Handler {
+		if d == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			d.Record(endpoint, rec.status >= http.StatusInternalServerError)
+		})
+	}
+}
+
+// rateLimiter is a fixed window rate limiter keyed by remote IP.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	start   time.Time
+	counter map[string]int
+}
+
+// allow reports whether a request from ip is within the limit for the
+// current window. All counters are reset when the window expires. If the
+// request is not allowed, it also returns the time until the window resets.
+func (rl *rateLimiter) allow(ip string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if time.Since(rl.start) >= rl.window {
+		rl.start = time.Now()
+		clear(rl.counter)
+	}
+
+	rl.counter[ip]++
+	return rl.counter[ip] <= rl.limit, rl.window - time.Since(rl.start)
+}
+
+// remoteIP returns the IP of the request without its port.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// trusted reports whether addr is in one of the trusted proxy networks.
+func trusted(proxies []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, proxy := range proxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerAddrs splits the values of the client IP header into addresses, in
+// order. The standard Forwarded header of RFC 7239 gives each address as a
+// for parameter, which may be quoted, bracketed, and have a port; elements
+// without one, or with an obfuscated identifier, give an invalid address.
+func headerAddrs(header string, values []string) []string {
+	var addrs []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if !strings.EqualFold(header, "Forwarded") {
+				addrs = append(addrs, strings.TrimSpace(element))
+				continue
+			}
+			var addr string
+			for _, pair := range strings.Split(element, ";") {
+				key, node, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(key, "for") {
+					node = strings.Trim(node, `"`)
+					if addrPort, err := netip.ParseAddrPort(node); err == nil {
+						addr = addrPort.Addr().String()
+					} else {
+						addr = strings.Trim(node, "[]")
+					}
+				}
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// clientIP finds the client IP in the values of the header set by trusted
+// proxies. Proxies append the address they received the request from, so
+// the list is read from the right, skipping the trusted proxies themselves;
+// anything to the left of the first untrusted address could have been sent
+// by the client. Headers with a single address, such as CF-Connecting-IP or
+// X-Real-IP, are read the same way.
+func clientIP(proxies []netip.Prefix, header string, values []string) (netip.Addr, bool) {
+	addrs := headerAddrs(header, values)
+
+	var client netip.Addr
+	for i := len(addrs) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(addrs[i])
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !trusted(proxies, client) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+// withClientIP replaces the RemoteAddr of requests from trusted proxies,
+// such as the edges of a CDN, with the client IP from the header they set,
+// keeping the port. Every later use of RemoteAddr, from rate limits to the
+// peer addresses given out in announces, then sees the client. Requests from
+// anywhere else are left alone, so that clients cannot forge the header.
+func withClientIP(proxies []netip.Prefix, header string) middleware {
+	return func(next http.Handler) http.Handler {
+		if len(proxies) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+			if err == nil && trusted(proxies, addrPort.Addr()) {
+				if client, ok := clientIP(proxies, header, r.Header.Values(header)); ok {
+					r.RemoteAddr = netip.AddrPortFrom(client, addrPort.Port()).String()
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiKeyHash identifies a request by a hash of its Authorization header, so
+// that API keys are never written to Redis.
+func apiKeyHash(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// tooManyRequests replies with a 429 and a Retry-After header, rounded up to
+// whole seconds.
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
+// withRateLimit allows at most limit requests per remote IP in each window.
+func withRateLimit(limit int, window time.Duration) middleware {
+	rl := &rateLimiter{
+		limit:   limit,
+		window:  window,
+		start:   time.Now(),
+		counter: make(map[string]int),
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, retryAfter := rl.allow(remoteIP(r)); !ok {
+				tooManyRequests(w, retryAfter)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withQuotas enforces the configured per-route quotas. Requests are counted
+// in Redis per route and per client, as identified by by, so that quotas
+// survive restarts. Routes without a quota are not counted. As with other
+// cache failures, Redis errors are logged but the request is allowed.
+func withQuotas(conf config.Config, by func(*http.Request) string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			quota, ok := conf.Quotas[r.Pattern]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+			key := fmt.Sprintf("quota:%s:%s", r.Pattern, by(r))
+
+			// The counter is created with its expiry in the same
+			// transaction as the increment, so that a failure between
+			// the two cannot leave a counter which never expires.
+			pipe := conf.Rdb.TxPipeline()
+			pipe.SetNX(ctx, key, 0, quota.Window)
+			incr := pipe.Incr(ctx, key)
+			if _, err := pipe.Exec(ctx); err != nil {
+				log.Printf("Error counting quota: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			count := incr.Val()
+
+			if count > int64(quota.Limit) {
+				retryAfter, err := conf.Rdb.TTL(ctx, key).Result()
+				if err != nil || retryAfter < 0 {
+					retryAfter = quota.Window
+				}
+				tooManyRequests(w, retryAfter)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// inFlight counts the requests in progress, overall and per remote IP.
+type inFlight struct {
+	mu    sync.Mutex
+	total int
+	byIP  map[string]int
+}
+
+// acquire counts a request from ip as in progress, unless that would exceed
+// the limit overall or per IP, in which case it returns the name of the
+// exceeded limit. A limit of zero is no limit. Every acquired request must
+// be released.
+func (f *inFlight) acquire(ip string, limit, perIP int) (bool, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if limit > 0 && f.total >= limit {
+		return false, "global"
+	}
+	if perIP > 0 && f.byIP[ip] >= perIP {
+		return false, "ip"
+	}
+	f.total++
+	f.byIP[ip]++
+	return true, ""
+}
+
+// release counts a request from ip as finished.
+func (f *inFlight) release(ip string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.total--
+	if f.byIP[ip]--; f.byIP[ip] <= 0 {
+		delete(f.byIP, ip)
+	}
+}
+
+// withInFlightLimits refuses announces beyond the configured MaxInFlight
+// and MaxInFlightPerIP with a bencoded failure asking the client to retry
+// after MinInterval, so that a burst is turned away cheaply instead of
+// queueing on the Postgres pool. Refusals are counted by limit in the
+// "announces_limited" metric.
+func withInFlightLimits(conf config.Config) middleware {
+	return func(next http.Handler) http.Handler {
+		if conf.MaxInFlight <= 0 && conf.MaxInFlightPerIP <= 0 {
+			return next
+		}
+		counts := &inFlight{byIP: make(map[string]int)}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := remoteIP(r)
+			ok, limit := counts.acquire(ip, conf.MaxInFlight, conf.MaxInFlightPerIP)
+			if !ok {
+				limitedCounts.Add(limit, 1)
+				lang := locale.Negotiate(r.Header.Get("Accept-Language"), conf.Language)
+				msg := locale.Sprintf(lang, "tracker busy, retry in %v", config.MinInterval*time.Second)
+				if _, err := w.Write(bencode.RetryFailure(msg, config.MinInterval)); err != nil {
+					log.Printf("Error responding to peer: %v", err)
+				}
+				return
+			}
+			defer counts.release(ip)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withBodyLimit limits the size of request bodies to n bytes.
+func withBodyLimit(n int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withTimeout limits the time a handler may take to respond.
+func withTimeout(d time.Duration) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.TimeoutHandler(next, d, "Timeout")
+	}
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+
+	tag := func(name string) middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	h := chain(tag("first"), tag("second"), tag("third"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/", nil))
+
+	expected := "first second third handler"
+	if received := strings.Join(order, " "); received != expected {
+		t.Errorf("expected %s, got %s", expected, received)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}
+	h := withClientIP(proxies, "X-Forwarded-For")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RemoteAddr)
+	}))
+
+	data := []struct {
+		name       string
+		remoteAddr string
+		header     []string
+		expected   string
+	}{
+		{"direct", "192.0.2.1:1234", []string{"203.0.113.7"}, "192.0.2.1:1234"},
+		{"proxied", "198.51.100.1:1234", []string{"203.0.113.7"}, "203.0.113.7:1234"},
+		{"forged", "198.51.100.1:1234", []string{"10.0.0.1, 203.0.113.7"}, "203.0.113.7:1234"},
+		{"chained", "198.51.100.1:1234", []string{"203.0.113.7", "198.51.100.2"}, "203.0.113.7:1234"},
+		{"ipv6", "198.51.100.1:1234", []string{"2001:db8::7"}, "[2001:db8::7]:1234"},
+		{"missing", "198.51.100.1:1234", nil, "198.51.100.1:1234"},
+		{"invalid", "198.51.100.1:1234", []string{"unknown"}, "198.51.100.1:1234"},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://example.com/", nil)
+			r.RemoteAddr = d.remoteAddr
+			for _, value := range d.header {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if received := w.Body.String(); received != d.expected {
+				t.Errorf("expected %s, got %s", d.expected, received)
+			}
+		})
+	}
+}
+
+func TestClientIPForwarded(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")}
+
+	data := []struct {
+		name     string
+		header   []string
+		expected string
+	}{
+		{"ipv4", []string{"for=203.0.113.7;proto=https"}, "203.0.113.7"},
+		{"ipv4 with port", []string{`for="203.0.113.7:4711"`}, "203.0.113.7"},
+		{"ipv6", []string{`for="[2001:db8::7]:4711"`}, "2001:db8::7"},
+		{"ipv6 without port", []string{`For="[2001:db8::7]"`}, "2001:db8::7"},
+		{"chained", []string{"for=10.0.0.1, for=203.0.113.7", "for=198.51.100.2;by=198.51.100.1"}, "203.0.113.7"},
+		{"obfuscated", []string{"for=_hidden"}, ""},
+		{"without for", []string{"proto=https"}, ""},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			client, ok := clientIP(proxies, "Forwarded", d.header)
+			if d.expected == "" {
+				if ok {
+					t.Errorf("expected no client IP, got %s", client)
+				}
+				return
+			}
+			if !ok || client.String() != d.expected {
+				t.Errorf("expected %s, got %s", d.expected, client)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := withRateLimit(2, time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	data := []struct {
+		name       string
+		remoteAddr string
+		expected   int
+	}{
+		{"first request", "10.0.0.1:1234", http.StatusOK},
+		{"second request", "10.0.0.1:1235", http.StatusOK},
+		{"third request", "10.0.0.1:1236", http.StatusTooManyRequests},
+		{"different ip", "10.0.0.2:1234", http.StatusOK},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/api/infohash", nil)
+			req.RemoteAddr = d.remoteAddr
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+			if w.Result().StatusCode != d.expected {
+				t.Errorf("expected %d, got %d", d.expected, w.Result().StatusCode)
+			}
+			if d.expected == http.StatusTooManyRequests && w.Result().Header.Get("Retry-After") == "" {
+				t.Errorf("expected Retry-After header on rate limited request")
+			}
+		})
+	}
+}
+
+func TestQuotaWindow(t *testing.T) {
+	conf, clock := testutils.BuildFakeConfig(t, nil, testutils.DefaultAPIKey)
+	conf.Quotas = map[string]config.Quota{
+		"GET /api/generate": {Limit: 1, Window: time.Hour},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/generate", withQuotas(conf, remoteIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	request := func() *http.Response {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/api/generate", nil))
+		return w.Result()
+	}
+
+	if resp := request(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if ttl := conf.Rdb.TTL(context.Background(), "quota:GET /api/generate:192.0.2.1").Val(); ttl != time.Hour {
+		t.Errorf("expected the counter to expire with the window, got %v", ttl)
+	}
+
+	clock.Advance(15 * time.Minute)
+	resp := request()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "2700" {
+		t.Errorf("expected Retry-After of the rest of the window, got %s", retryAfter)
+	}
+
+	clock.Advance(45 * time.Minute)
+	if resp := request(); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected %d after the window, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	h := withBodyLimit(4)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}))
+
+	data := []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{"small body", "abc", http.StatusOK},
+		{"large body", "abcdefgh", http.StatusRequestEntityTooLarge},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "http://example.com/api/infohash", strings.NewReader(d.body))
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+			if w.Result().StatusCode != d.expected {
+				t.Errorf("expected %d, got %d", d.expected, w.Result().StatusCode)
+			}
+		})
+	}
+}
+
+func TestProtocolMetrics(t *testing.T) {
+	h := withMetrics("protocol test")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, proto := range []string{"HTTP/1.1", "HTTP/2.0", "HTTP/2.0", "HTTP/3.0"} {
+		req := httptest.NewRequest("GET", "http://example.com/announce", nil)
+		req.Proto = proto
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	expected := map[string]string{"HTTP/1.1": "1", "HTTP/2.0": "2", "HTTP/3.0": "1"}
+	for proto, count := range expected {
+		v := protocolCounts.Get("protocol test " + proto)
+		if v == nil || v.String() != count {
+			t.Errorf("expected %s requests for %s, got %v", count, proto, v)
+		}
+	}
+}
+
+func TestInFlightLimits(t *testing.T) {
+	conf := config.Config{MaxInFlight: 3, MaxInFlightPerIP: 2}
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	h := withInFlightLimits(conf)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		io.WriteString(w, "ok")
+	}))
+
+	request := func(remoteAddr string) string {
+		req := httptest.NewRequest("GET", "http://example.com/key/announce", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	// Hold three announces open, two of them from the same IP.
+	done := make(chan string)
+	for _, remoteAddr := range []string{"10.0.0.1:1234", "10.0.0.1:1235", "10.0.0.2:1234"} {
+		go func() { done <- request(remoteAddr) }()
+		<-started
+	}
+
+	if body := request("10.0.0.3:1234"); !strings.Contains(body, "failure reason") || !strings.Contains(body, "retry in") {
+		t.Errorf("expected retry failure over the global limit, got %q", body)
+	}
+
+	close(unblock)
+	for range 3 {
+		if body := <-done; body != "ok" {
+			t.Errorf("expected announces within the limits to be served, got %q", body)
+		}
+	}
+
+	// With the global limit lifted, the per-IP limit applies alone.
+	conf.MaxInFlight = 0
+	unblock = make(chan struct{})
+	h = withInFlightLimits(conf)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		io.WriteString(w, "ok")
+	}))
+	for _, remoteAddr := range []string{"10.0.0.1:1234", "10.0.0.1:1235"} {
+		go func() { done <- request(remoteAddr) }()
+		<-started
+	}
+	if body := request("10.0.0.1:1236"); !strings.Contains(body, "failure reason") {
+		t.Errorf("expected retry failure over the per-IP limit, got %q", body)
+	}
+	go func() { done <- request("10.0.0.2:1234") }()
+	<-started
+
+	close(unblock)
+	for range 3 {
+		if body := <-done; body != "ok" {
+			t.Errorf("expected announces within the limits to be served, got %q", body)
+		}
+	}
+}
+
+func TestInFlightLimitsTimeout(t *testing.T) {
+	conf := config.Config{MaxInFlight: 1}
+	unblock := make(chan struct{})
+	returned := make(chan struct{}, 3)
+	inner := withInFlightLimits(conf)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("slow") {
+			<-unblock
+		}
+		io.WriteString(w, "ok")
+	}))
+	// As in routes, the limits are inside the timeout.
+	h := withTimeout(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner.ServeHTTP(w, r)
+		returned <- struct{}{}
+	}))
+
+	request := func(query string) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/key/announce?"+query, nil))
+		return w.Body.String()
+	}
+
+	if body := request("slow"); body != "Timeout" {
+		t.Fatalf("expected the slow announce to time out, got %q", body)
+	}
+
+	// The timed out handler is still running, so its slot is still held.
+	if body := request(""); !strings.Contains(body, "retry in") {
+		t.Errorf("expected retry failure while the timed out handler runs, got %q", body)
+	}
+
+	close(unblock)
+	<-returned
+	<-returned
+	if body := request(""); body != "ok" {
+		t.Errorf("expected the slot to be released once the handler returns, got %q", body)
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/api"
+)
+
+// opentrackerStats are the figures reported by opentrackerStatsHandler.
+// Connections are HTTP requests to the tracker routes, and successful ones
+// are those without a server error. etracker has no UDP tracker, so UDP
+// figures are always zero.
+type opentrackerStats struct {
+	uptime    time.Duration
+	torrents  int
+	peers     int
+	seeds     int
+	completed int
+	announces int64
+	scrapes   int64
+	succeeded int64
+	errors    int64
+}
+
+// counter returns the value of the expvar counter key in m, or zero if it
+// has not been counted yet.
+func counter(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func (s *Server) queryOpentrackerStats(ctx context.Context, completed bool) (opentrackerStats, error) {
+	global, err := api.QueryGlobalStats(ctx, s.conf)
+	if err != nil {
+		return opentrackerStats{}, err
+	}
+
+	stats := opentrackerStats{
+		uptime:    time.Since(s.started),
+		torrents:  global.Hashcount,
+		peers:     global.Seeders + global.Leechers,
+		seeds:     global.Seeders,
+		announces: counter(requestCounts, "announce"),
+		scrapes:   counter(requestCounts, "scrape"),
+		errors:    counter(errorCounts, "announce") + counter(errorCounts, "scrape"),
+	}
+	stats.succeeded = stats.announces + stats.scrapes - stats.errors
+
+	if completed {
+		infohashes, err := api.QueryInfohashStats(ctx, s.conf, api.InfohashFilter{})
+		if err != nil {
+			return opentrackerStats{}, err
+		}
+		for _, i := range infohashes {
+			stats.completed += i.Downloaded
+		}
+	}
+
+	return stats, nil
+}
+
+// mrtg formats two values for MRTG, followed by the uptime and a title, as
+// opentracker does.
+func (st opentrackerStats) mrtg(a, b int64, title string) string {
+	seconds := int(st.uptime.Seconds())
+	return fmt.Sprintf("%d\n%d\n%d seconds (%d hours)\n%s", a, b, seconds, seconds/3600, title)
+}
+
+// everything formats every figure as opentracker's XML statistics.
+func (st opentrackerStats) everything() string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<stats>
+  <tracker_id>0</tracker_id>
+  <version>
+    etracker
+  </version>
+  <uptime>%d</uptime>
+  <torrents>
+    <count_mutex>%d</count_mutex>
+    <count_iterator>%d</count_iterator>
+  </torrents>
+  <peers>
+    <count>%d</count>
+  </peers>
+  <seeds>
+    <count>%d</count>
+  </seeds>
+  <completed>
+    <count>%d</count>
+  </completed>
+  <connections>
+    <tcp>
+      <accept>%d</accept>
+      <announce>%d</announce>
+      <scrape>%d</scrape>
+    </tcp>
+    <udp>
+      <overall>0</overall>
+      <connect>0</connect>
+      <announce>0</announce>
+      <scrape>0</scrape>
+      <missmatch>0</missmatch>
+    </udp>
+    <livesync>
+      <count>0</count>
+    </livesync>
+  </connections>
+  <debug>
+    <http_error>%d</http_error>
+  </debug>
+</stats>
+`, int64(st.uptime.Seconds()), st.torrents, st.torrents, st.peers, st.seeds, st.completed,
+		st.announces+st.scrapes, st.announces, st.scrapes, st.errors)
+}
+
+// opentrackerStatsHandler serves /stats in the formats of opentracker, so
+// that monitoring built for opentracker can point at etracker unchanged.
+// The mode query field selects the figures: peer (the default), torr,
+// conn, tcp4, scrp, completed, and version are plain text for MRTG, and
+// everything is XML. Figures opentracker has but etracker does not, such as
+// UDP connections, are zero.
+func (s *Server) opentrackerStatsHandler(ctx context.Context) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = "peer"
+		}
+		if mode == "version" {
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, "etracker")
+			return
+		}
+
+		switch mode {
+		case "peer", "torr", "conn", "tcp4", "scrp", "completed", "everything":
+		default:
+			http.Error(w, "invalid mode", http.StatusBadRequest)
+			return
+		}
+
+		st, err := s.queryOpentrackerStats(ctx, mode == "completed" || mode == "everything")
+		if err != nil {
+			http.Error(w, "could not query database", http.StatusInternalServerError)
+			return
+		}
+
+		var reply string
+		switch mode {
+		case "peer":
+			reply = fmt.Sprintf("%d\n%d\nopentracker serving %d torrents\nopentracker", st.peers, st.seeds, st.torrents)
+		case "torr":
+			reply = fmt.Sprintf("%d\n%d\nopentracker serving %d torrents\nopentracker", st.torrents, 0, st.torrents)
+		case "conn", "tcp4":
+			reply = st.mrtg(st.announces+st.scrapes, st.succeeded, "opentracker connections")
+		case "scrp":
+			reply = st.mrtg(st.scrapes, 0, "opentracker scrape stats")
+		case "completed":
+			reply = st.mrtg(int64(st.completed), 0, "opentracker, completed")
+		case "everything":
+			w.Header().Set("Content-Type", "text/xml")
+			fmt.Fprint(w, st.everything())
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, reply)
+	}
+}
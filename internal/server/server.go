@@ -0,0 +1,560 @@
+// Package server owns the construction of the tracker's routes, the listeners
+// which serve them, and the background jobs which run alongside them. It is
+// used by cmd/etracker, but can also be embedded in tests or other binaries.
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/achievements"
+	"github.com/dmoerner/etracker/internal/anomaly"
+	"github.com/dmoerner/etracker/internal/api"
+	"github.com/dmoerner/etracker/internal/archive"
+	"github.com/dmoerner/etracker/internal/bencode"
+	"github.com/dmoerner/etracker/internal/canary"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+	"github.com/dmoerner/etracker/internal/events"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/history"
+	"github.com/dmoerner/etracker/internal/locale"
+	"github.com/dmoerner/etracker/internal/prune"
+	"github.com/dmoerner/etracker/internal/scrape"
+	"github.com/dmoerner/etracker/internal/snapshot"
+	"github.com/dmoerner/etracker/internal/swarms"
+	"github.com/dmoerner/etracker/internal/wss"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	DefaultFrontendPath = "./frontend/dist"
+	ShutdownTimeout     = 10 * time.Second
+)
+
+// Job is a background task run alongside the listeners. A job should run
+// until the context is cancelled, and return a non-nil error only if the
+// server should stop.
+type Job func(ctx context.Context, conf config.Config) error
+
+// Server is an etracker instance: a mux with all routes registered, the
+// listeners which serve it, and its background jobs.
+type Server struct {
+	conf         config.Config
+	mux          *http.ServeMux
+	handler      http.Handler
+	addr         string
+	frontendPath string
+	notFound     string
+	tls          *config.TLSConfig
+	accessLog    *accessLogger
+	anomalies    *anomaly.Detector
+	jobs         []Job
+	started      time.Time
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithAddr sets the address the HTTP(S) listener binds to. The default is
+// localhost on the configured backend port.
+func WithAddr(addr string) Option {
+	return func(s *Server) {
+		s.addr = addr
+	}
+}
+
+// WithFrontendPath sets the directory the SPA frontend is served from.
+func WithFrontendPath(path string) Option {
+	return func(s *Server) {
+		s.frontendPath = path
+	}
+}
+
+// WithNotFoundPage sets an asset in the frontend directory, such as
+// "404.html", to serve as the body of 404 replies for missing files.
+func WithNotFoundPage(page string) Option {
+	return func(s *Server) {
+		s.notFound = page
+	}
+}
+
+// WithTLS serves HTTPS instead of HTTP using the given certificate and key,
+// or certificates obtained automatically for the AutocertHosts. The files
+// are checked for changes every CertReloadInterval, and reloaded without
+// restarting the listener. HTTP/2 is enabled unless disabled in the
+// config, and HTTP/3 may additionally be served over QUIC.
+func WithTLS(tls config.TLSConfig) Option {
+	return func(s *Server) {
+		s.tls = &tls
+	}
+}
+
+// WithAccessLog writes a line in the given format to w for every announce
+// and scrape. See accessLogger for what is left out of the log.
+func WithAccessLog(w io.Writer, format AccessLogFormat) Option {
+	return func(s *Server) {
+		s.accessLog = &accessLogger{w: w, format: format}
+	}
+}
+
+// WithJob adds a background job to be run alongside the listeners.
+func WithJob(job Job) Option {
+	return func(s *Server) {
+		s.jobs = append(s.jobs, job)
+	}
+}
+
+// WithoutJobs removes all background jobs, including the default pruning
+// jobs. This is mostly useful for tests.
+func WithoutJobs() Option {
+	return func(s *Server) {
+		s.jobs = nil
+	}
+}
+
+// New builds a Server with all routes registered. By default the server
+// listens on localhost at the configured backend port, serves the frontend
+// from DefaultFrontendPath, prunes announce keys and expired data and
+// sweeps stale peers on timers, awards achievements, and records the stats
+// history. Events are counted in the metrics, and posted to the events
+// webhook if configured. If a canary interval is configured and
+// jobs are enabled, the canary job is added as well, and likewise for
+// anomaly detection, infohash archival, and stats snapshots.
+func New(ctx context.Context, conf config.Config, opts ...Option) *Server {
+	conf = conf.WithServerDefaults()
+	s := &Server{
+		conf:         conf,
+		mux:          http.NewServeMux(),
+		addr:         fmt.Sprintf("localhost:%d", conf.BackendPort),
+		frontendPath: DefaultFrontendPath,
+		jobs:         []Job{prune.PruneTimer, prune.DailyTimer, prune.SweepTimer, achievements.Job, history.Job},
+		started:      time.Now(),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.accessLog != nil {
+		s.accessLog.anonymize = conf.PrivacySalt != ""
+	}
+
+	if s.tls != nil && !conf.Features.Enabled(config.FeatureHTTP3) {
+		s.tls.HTTP3 = false
+	}
+
+	if conf.Events != nil {
+		conf.Events.Subscribe(ctx, "metrics", events.Metrics)
+		conf.Events.Subscribe(ctx, "stats history", history.Count(conf), events.AnnounceAccepted)
+		// Each webhook has its own subscription, so that retries to one
+		// do not hold up the others.
+		for i, webhook := range conf.EventsWebhooks {
+			conf.Events.Subscribe(ctx, fmt.Sprintf("webhook %d", i+1), events.Webhook(webhook, conf.EventsWebhookSecret), conf.EventsWebhookKinds...)
+		}
+		// The webhooks of the background jobs only receive the events of
+		// their job, but are signed and retried like the others.
+		for _, webhook := range []struct {
+			name string
+			url  string
+			kind events.Kind
+		}{
+			{"archive webhook", conf.ArchiveWebhook, events.InfohashArchival},
+			{"anomaly webhook", conf.AnomalyWebhook, events.AnomalyAlert},
+			{"canary webhook", conf.CanaryWebhook, events.CanaryAlert},
+		} {
+			if webhook.url != "" {
+				conf.Events.Subscribe(ctx, webhook.name, events.Webhook(webhook.url, conf.EventsWebhookSecret), webhook.kind)
+			}
+		}
+		if conf.ScrapeCacheTTL > 0 {
+			conf.Events.Subscribe(ctx, "scrape cache", scrape.Invalidate(conf), events.SnatchCompleted)
+		}
+	}
+
+	if conf.CanaryInterval > 0 && s.jobs != nil {
+		s.addCanary()
+	}
+
+	if conf.AnomalyWindow > 0 && conf.Features.Enabled(config.FeatureAnomaly) && s.jobs != nil {
+		s.anomalies = anomaly.NewDetector(conf.AnomalyFactor)
+		s.jobs = append(s.jobs, s.anomalies.Job())
+	}
+
+	if conf.Events != nil && s.jobs != nil {
+		s.jobs = append(s.jobs, swarms.Job)
+	}
+
+	if conf.ArchiveAfterDays > 0 && s.jobs != nil {
+		s.jobs = append(s.jobs, archive.Job)
+	}
+
+	if (conf.SnapshotDir != "" || conf.SnapshotBucket != "") && s.jobs != nil {
+		s.jobs = append(s.jobs, snapshot.Job)
+	}
+
+	s.routes(ctx)
+	s.handler = withClientIP(conf.TrustedProxies, conf.ClientIPHeader)(withoutTrailingSlash(s.mux))
+
+	return s
+}
+
+// addCanary adds the canary job, which announces to the server's own
+// listener.
+func (s *Server) addCanary() {
+	var tlsHostname string
+	if s.tls != nil {
+		tlsHostname = s.tls.TlsHostname
+	}
+
+	baseURL, err := canary.BaseURL(s.addr, s.tls != nil)
+	if err != nil {
+		log.Printf("Canary disabled: %v", err)
+		return
+	}
+
+	s.jobs = append(s.jobs, canary.Job(baseURL, tlsHostname))
+}
+
+// routes registers every route on the mux. Middleware is composed per route
+// group. Announces and scrapes are the hot path and only receive the
+// minimum, and are written to the access log and counted for anomaly
+// detection if configured. Announces beyond the in-flight limits are
+// refused before they reach Postgres. The limits sit inside the timeout,
+// since a handler which times out keeps running, and holds its slot until
+// it returns. WebTorrent announces from browsers are long-lived WebSocket
+// connections. API routes are subject to configured quotas, per IP for the
+// frontend API and per API key for the restricted admin API. Frontend
+// bodies are limited to what passkey registrations need, and the admin API
+// is also rate limited and allows large bodies for torrent file uploads.
+func (s *Server) routes(ctx context.Context) {
+	conf := s.conf
+
+	static := chain(withLogging, withMetrics("static"))
+	announce := chain(withLogging, withAccessLog(s.accessLog), withMetrics("announce"), withAnomalyDetection(s.anomalies, "announce"), withTimeout(conf.HandlerTimeout), withInFlightLimits(conf))
+	scrapes := chain(withLogging, withAccessLog(s.accessLog), withMetrics("scrape"), withAnomalyDetection(s.anomalies, "scrape"), withTimeout(conf.HandlerTimeout))
+	frontend := chain(withLogging, withMetrics("frontend"), api.WithCors(conf), withQuotas(conf, remoteIP), withBodyLimit(8<<10), withTimeout(conf.HandlerTimeout))
+	admin := chain(withLogging, withMetrics("admin"), withRateLimit(60, time.Minute), withQuotas(conf, apiKeyHash), withBodyLimit(conf.MaxUploadSize), withTimeout(conf.AdminHandlerTimeout))
+	// Seedbox agents long-poll for new infohashes for longer than the admin
+	// timeout.
+	longpoll := chain(withLogging, withMetrics("admin"), withRateLimit(60, time.Minute), withQuotas(conf, apiKeyHash), withBodyLimit(1<<10))
+
+	s.mux.Handle("/", static(http.HandlerFunc(api.ServeFrontend(s.frontendPath, s.notFound))))
+
+	api.MuxAPIRoutes(ctx, conf, s.mux, frontend, admin, longpoll)
+
+	// Some clients and reverse proxies add a trailing slash to the announce
+	// URL, and clients do not reliably follow redirects, so both forms are
+	// served directly. Other methods get a bencoded failure.
+	announceHandler := announce(http.HandlerFunc(handler.PeerHandler(ctx, conf)))
+	scrapeHandler := scrapes(http.HandlerFunc(scrape.ScrapeHandler(ctx, conf)))
+	for _, path := range []string{"/{id}/announce", "/{id}/announce/{$}"} {
+		s.mux.Handle("GET "+path, announceHandler)
+		s.mux.Handle(path, announce(http.HandlerFunc(s.trackerMethodNotAllowed)))
+	}
+	for _, path := range []string{"/{id}/scrape", "/{id}/scrape/{$}"} {
+		s.mux.Handle("GET "+path, scrapeHandler)
+		s.mux.Handle(path, scrapes(http.HandlerFunc(s.trackerMethodNotAllowed)))
+	}
+	// Clients with a mapped certificate announce and scrape without a key
+	// in the URL.
+	if s.tls != nil && s.tls.ClientCAFile != "" {
+		withCert := handler.WithClientCertificate(ctx, conf)
+		for _, path := range []string{"/announce", "/announce/{$}"} {
+			s.mux.Handle("GET "+path, announce(withCert(http.HandlerFunc(handler.PeerHandler(ctx, conf)))))
+		}
+		for _, path := range []string{"/scrape", "/scrape/{$}"} {
+			s.mux.Handle("GET "+path, scrapes(withCert(http.HandlerFunc(scrape.ScrapeHandler(ctx, conf)))))
+		}
+	}
+	// Browser peers hold a WebSocket open for the whole session, so their
+	// route has no timeout.
+	if conf.Features.Enabled(config.FeatureWebTorrent) {
+		webtorrent := chain(withLogging, withMetrics("webtorrent"))
+		s.mux.Handle("GET /{id}/webtorrent", webtorrent(wss.Handler(ctx, conf)))
+	}
+
+	// Statistics in the formats of opentracker, for existing monitoring.
+	s.mux.Handle("GET /stats", frontend(http.HandlerFunc(s.opentrackerStatsHandler(ctx))))
+
+	s.mux.Handle("GET /debug/vars", admin(api.WithAuthorization(conf)(expvar.Handler())))
+
+	// Profiles such as /debug/pprof/profile?seconds=30 run for longer than
+	// the admin timeout, so pprof is only authorized and rate limited.
+	profiling := chain(withLogging, withMetrics("admin"), withRateLimit(60, time.Minute))
+	for path, h := range map[string]http.HandlerFunc{
+		"GET /debug/pprof/":        pprof.Index,
+		"GET /debug/pprof/cmdline": pprof.Cmdline,
+		"GET /debug/pprof/profile": pprof.Profile,
+		"GET /debug/pprof/symbol":  pprof.Symbol,
+		"POST /debug/pprof/symbol": pprof.Symbol,
+		"GET /debug/pprof/trace":   pprof.Trace,
+	} {
+		s.mux.Handle(path, profiling(api.WithAuthorization(conf)(h)))
+	}
+}
+
+// trackerMethodNotAllowed replies to announces and scrapes with any method
+// but GET or HEAD. The failure is bencoded so that BitTorrent clients can
+// show it.
+func (s *Server) trackerMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	lang := locale.Negotiate(r.Header.Get("Accept-Language"), s.conf.Language)
+	w.Header().Set("Allow", "GET, HEAD")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	_, _ = w.Write(bencode.FailureReason(locale.Sprintf(lang, "announces and scrapes must use GET")))
+}
+
+// withoutTrailingSlash permanently redirects requests whose path has a
+// trailing slash to the same path without it, if that is a route of its
+// own. Otherwise, such as for API typos, the request is served as is.
+func withoutTrailingSlash(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if len(path) > 1 && strings.HasSuffix(path, "/") {
+			if _, pattern := mux.Handler(r); pattern == "/" {
+				trimmed := r.Clone(r.Context())
+				trimmed.URL.Path = strings.TrimRight(path, "/")
+				trimmed.URL.RawPath = ""
+				if _, pattern = mux.Handler(trimmed); pattern != "/" && pattern != "" {
+					target := trimmed.URL.EscapedPath()
+					if r.URL.RawQuery != "" {
+						target += "?" + r.URL.RawQuery
+					}
+					// 308 keeps the method and body, unlike 301.
+					http.Redirect(w, r, target, http.StatusPermanentRedirect)
+					return
+				}
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Handler returns the server's routes, for use in tests or when embedding
+// the tracker in another http.Server.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Run checks for clock skew against the database, enters maintenance mode if
+// configured, prunes unused announce keys and expired data, then starts the
+// background jobs and the listener. When starting read-only, whether
+// configured or already enabled in Redis, the database is not touched;
+// otherwise any announces buffered while read-only, including any left in
+// flight by a crash, are replayed. It blocks until the context
+// is cancelled or a job or listener fails, and then shuts the listener down
+// gracefully.
+func (s *Server) Run(ctx context.Context) error {
+	var err error
+	if s.conf.MaintenanceRetry > 0 {
+		err = handler.SetMaintenance(ctx, s.conf, s.conf.MaintenanceRetry)
+		if err != nil {
+			return err
+		}
+		log.Printf("Starting in maintenance mode")
+	}
+
+	if s.conf.ReadOnly {
+		err = handler.SetReadOnly(ctx, s.conf, true)
+		if err != nil {
+			return err
+		}
+		log.Printf("Starting in read-only mode")
+		return s.serve(ctx)
+	}
+
+	// Read-only mode may already have been enabled through the admin API,
+	// in which case buffered announces must wait until it is disabled.
+	readOnly, err := handler.ReadOnly(ctx, s.conf)
+	if err != nil {
+		return err
+	}
+	if readOnly {
+		log.Printf("Starting in read-only mode, which was enabled before startup")
+		return s.serve(ctx)
+	}
+
+	_, err = config.CheckClockSkew(ctx, s.conf)
+	if err != nil {
+		return err
+	}
+
+	if s.conf.Dev {
+		_, err = db.CheckQueryPlans(ctx, s.conf.Dbpool)
+		if err != nil {
+			return err
+		}
+	}
+
+	recovered, err := handler.RecoverAnnounces(ctx, s.conf)
+	if err != nil {
+		return err
+	}
+	if recovered > 0 {
+		log.Printf("Recovered %d buffered announces from an unfinished replay", recovered)
+	}
+
+	err = handler.ReplayAnnounces(ctx, s.conf)
+	if err != nil {
+		return fmt.Errorf("error replaying buffered announces: %w", err)
+	}
+
+	err = prune.PruneAnnounceKeys(ctx, s.conf)
+	if err != nil {
+		return fmt.Errorf("error pruning unused announce keys: %w", err)
+	}
+
+	err = prune.PruneRetention(ctx, s.conf)
+	if err != nil {
+		return fmt.Errorf("error pruning data past retention: %w", err)
+	}
+
+	err = prune.PruneUnusedKeys(ctx, s.conf)
+	if err != nil {
+		return fmt.Errorf("error pruning never used announce keys: %w", err)
+	}
+
+	return s.serve(ctx)
+}
+
+// serve starts the background jobs and the listener, and blocks until the
+// context is cancelled or one of them fails.
+func (s *Server) serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Restored swarms are given out until their peers announce again. A
+	// swarm file which cannot be read only costs the restart its peers.
+	if s.conf.SwarmFile != "" {
+		n, err := handler.RestoreSwarms(ctx, s.conf, s.conf.SwarmFile)
+		if err != nil {
+			log.Printf("Error restoring swarms: %v", err)
+		} else {
+			log.Printf("Restored %d peers from %s", n, s.conf.SwarmFile)
+		}
+	}
+
+	errCh := make(chan error, len(s.jobs)+3)
+
+	for _, job := range s.jobs {
+		go func() {
+			if err := job(ctx, s.conf); err != nil {
+				errCh <- fmt.Errorf("error in background job: %w", err)
+			}
+		}()
+	}
+
+	hs := &http.Server{
+		Addr:              s.addr,
+		ReadHeaderTimeout: s.conf.ReadTimeout,
+		ReadTimeout:       s.conf.ReadTimeout,
+		WriteTimeout:      s.conf.WriteTimeout,
+		Handler:           s.handler,
+	}
+
+	var h3 *http3.Server
+	var challenges *http.Server
+	if s.tls != nil {
+		var certs certSource
+		if len(s.tls.AutocertHosts) > 0 {
+			manager := newAutocertManager(s.tls)
+			certs = manager
+			if s.tls.AutocertHTTPAddr != "" {
+				challenges = &http.Server{
+					Addr:              s.tls.AutocertHTTPAddr,
+					ReadHeaderTimeout: s.conf.ReadTimeout,
+					ReadTimeout:       s.conf.ReadTimeout,
+					Handler:           manager.HTTPHandler(nil),
+				}
+			}
+		} else {
+			reloader, err := newCertReloader(s.tls.CertFile, s.tls.KeyFile)
+			if err != nil {
+				return err
+			}
+			certs = reloader
+			go reloader.watch(ctx, CertReloadInterval)
+		}
+		var clientCAs *x509.CertPool
+		if s.tls.ClientCAFile != "" {
+			var err error
+			clientCAs, err = loadClientCAs(s.tls.ClientCAFile)
+			if err != nil {
+				return err
+			}
+		}
+		h3 = configureTLS(hs, s.tls, certs, clientCAs)
+	}
+
+	if challenges != nil {
+		go func() {
+			if err := challenges.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				errCh <- fmt.Errorf("unable to start ACME challenge server: %w", err)
+			}
+		}()
+		log.Printf("Listening for ACME challenges on %s", challenges.Addr)
+	}
+
+	if h3 != nil {
+		go func() {
+			if err := h3.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				errCh <- fmt.Errorf("unable to start HTTP/3 server: %w", err)
+			}
+		}()
+		log.Printf("Listening for HTTP/3 on %s", s.addr)
+	}
+
+	go func() {
+		var err error
+		if s.tls != nil {
+			// The certificate is served by hs.TLSConfig.
+			err = hs.ListenAndServeTLS("", "")
+		} else {
+			err = hs.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			errCh <- fmt.Errorf("unable to start HTTP server: %w", err)
+		}
+	}()
+
+	log.Printf("Listening on %s", s.addr)
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errCh:
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer shutdownCancel()
+	if shutdownErr := hs.Shutdown(shutdownCtx); shutdownErr != nil {
+		log.Printf("Error shutting down HTTP server: %v", shutdownErr)
+	}
+	if h3 != nil {
+		if shutdownErr := h3.Shutdown(shutdownCtx); shutdownErr != nil {
+			log.Printf("Error shutting down HTTP/3 server: %v", shutdownErr)
+		}
+	}
+	if challenges != nil {
+		if shutdownErr := challenges.Shutdown(shutdownCtx); shutdownErr != nil {
+			log.Printf("Error shutting down ACME challenge server: %v", shutdownErr)
+		}
+	}
+
+	if s.conf.SwarmFile != "" {
+		if saveErr := handler.SaveSwarms(shutdownCtx, s.conf, s.conf.SwarmFile); saveErr != nil {
+			log.Printf("Error saving swarms: %v", saveErr)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+	"golang.org/x/net/websocket"
+)
+
+func TestRoutes(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	h := New(ctx, conf, WithoutJobs(), WithFrontendPath(t.TempDir())).Handler()
+
+	data := []struct {
+		name          string
+		method        string
+		request       string
+		authorization string
+		expected      int
+	}{
+		{"stats", "GET", "http://example.com/api/stats", "", http.StatusOK},
+		{"restricted without key", "POST", "http://example.com/api/infohash", "", http.StatusBadRequest},
+		{"restricted with bad key", "POST", "http://example.com/api/infohash", "badapikey", http.StatusForbidden},
+		{"opentracker stats", "GET", "http://example.com/stats?mode=everything", "", http.StatusOK},
+		{"opentracker stats bad mode", "GET", "http://example.com/stats?mode=bogus", "", http.StatusBadRequest},
+		{"debug vars without key", "GET", "http://example.com/debug/vars", "", http.StatusBadRequest},
+		{"debug vars with key", "GET", "http://example.com/debug/vars", testutils.DefaultAPIKey, http.StatusOK},
+		{"pprof without key", "GET", "http://example.com/debug/pprof/", "", http.StatusBadRequest},
+		{"pprof with key", "GET", "http://example.com/debug/pprof/goroutine?debug=1", testutils.DefaultAPIKey, http.StatusOK},
+		{"agent infohashes without key", "GET", "http://example.com/api/agents/infohashes", "", http.StatusBadRequest},
+		{"runtime with key", "GET", "http://example.com/api/debug/runtime", testutils.DefaultAPIKey, http.StatusOK},
+		{"announce with slash", "GET", "http://example.com/" + testutils.AnnounceKeys[0] + "/announce/", "", http.StatusOK},
+		{"scrape with slash", "GET", "http://example.com/" + testutils.AnnounceKeys[0] + "/scrape/", "", http.StatusOK},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			req := httptest.NewRequest(d.method, d.request, nil)
+			if d.authorization != "" {
+				req.Header.Add("Authorization", d.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+			if w.Result().StatusCode != d.expected {
+				t.Errorf("expected %d, got %d", d.expected, w.Result().StatusCode)
+			}
+		})
+	}
+}
+
+func TestOpentrackerStats(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	h := New(ctx, conf, WithoutJobs(), WithFrontendPath(t.TempDir())).Handler()
+
+	// One seeder and two leechers on a.
+	for i := 1; i <= 3; i++ {
+		request := testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[i],
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Left:        (i - 1) * 100,
+		})
+		request.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i)
+		h.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	data := []struct {
+		mode     string
+		expected string
+	}{
+		{"", fmt.Sprintf("3\n1\nopentracker serving %d torrents\nopentracker", len(testutils.AllowedInfoHashes))},
+		{"torr", fmt.Sprintf("%d\n0\nopentracker serving %[1]d torrents\nopentracker", len(testutils.AllowedInfoHashes))},
+		{"version", "etracker"},
+	}
+
+	for _, d := range data {
+		t.Run(d.mode, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/stats?mode="+d.mode, nil))
+			if body := w.Body.String(); body != d.expected {
+				t.Errorf("expected %q, got %q", d.expected, body)
+			}
+		})
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	conf.Quotas = map[string]config.Quota{
+		"GET /api/generate": {Limit: 2, Window: time.Hour},
+	}
+
+	h := New(ctx, conf, WithoutJobs(), WithFrontendPath(t.TempDir())).Handler()
+
+	data := []struct {
+		name       string
+		request    string
+		remoteAddr string
+		expected   int
+	}{
+		{"first key", "http://example.com/api/generate", "10.0.0.1:1234", http.StatusOK},
+		{"second key", "http://example.com/api/generate", "10.0.0.1:1234", http.StatusOK},
+		{"third key", "http://example.com/api/generate", "10.0.0.1:1234", http.StatusTooManyRequests},
+		{"other ip", "http://example.com/api/generate", "10.0.0.2:1234", http.StatusOK},
+		{"other route", "http://example.com/api/stats", "10.0.0.1:1234", http.StatusOK},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", d.request, nil)
+			req.RemoteAddr = d.remoteAddr
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+			if w.Result().StatusCode != d.expected {
+				t.Errorf("expected %d, got %d", d.expected, w.Result().StatusCode)
+			}
+			if d.expected == http.StatusTooManyRequests && w.Result().Header.Get("Retry-After") == "" {
+				t.Errorf("expected Retry-After header on request over quota")
+			}
+		})
+	}
+}
+
+func TestRouteNormalization(t *testing.T) {
+	h := New(context.Background(), config.Config{}, WithoutJobs(), WithFrontendPath(t.TempDir())).Handler()
+
+	data := []struct {
+		name     string
+		method   string
+		request  string
+		expected int
+		location string
+		body     string
+	}{
+		{"announce post", "POST", "http://example.com/key/announce", http.StatusMethodNotAllowed, "", "d14:failure reason34:announces and scrapes must use GETe"},
+		{"announce put with slash", "PUT", "http://example.com/key/announce/", http.StatusMethodNotAllowed, "", "d14:failure reason34:announces and scrapes must use GETe"},
+		{"scrape post", "POST", "http://example.com/key/scrape", http.StatusMethodNotAllowed, "", "d14:failure reason34:announces and scrapes must use GETe"},
+		{"api with slash", "GET", "http://example.com/api/stats/?x=1", http.StatusPermanentRedirect, "/api/stats?x=1", ""},
+		{"api post with slash", "POST", "http://example.com/api/infohash/", http.StatusPermanentRedirect, "/api/infohash", ""},
+		{"unknown api with slash", "GET", "http://example.com/api/nope/", http.StatusNotFound, "", ""},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(d.method, d.request, nil))
+
+			if w.Code != d.expected {
+				t.Errorf("expected %d, got %d", d.expected, w.Code)
+			}
+			if location := w.Header().Get("Location"); location != d.location {
+				t.Errorf("expected location %q, got %q", d.location, location)
+			}
+			if d.body != "" && w.Body.String() != d.body {
+				t.Errorf("expected body %q, got %q", d.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWebTorrentRoute(t *testing.T) {
+	h := New(context.Background(), config.Config{}, WithoutJobs(), WithFrontendPath(t.TempDir())).Handler()
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	// The upgrade must pass through the logging and metrics middleware.
+	url := strings.Replace(server.URL, "http", "ws", 1) + "/key/webtorrent"
+	ws, err := websocket.Dial(url, "", "http://example.com")
+	if err != nil {
+		t.Fatalf("error connecting to tracker: %v", err)
+	}
+	defer ws.Close()
+
+	if err = websocket.JSON.Send(ws, map[string]string{"action": "unknown"}); err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	var reply map[string]string
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err = websocket.JSON.Receive(ws, &reply); err != nil {
+		t.Fatalf("error receiving reply: %v", err)
+	}
+	if reply["failure reason"] != "invalid action" {
+		t.Errorf("expected invalid action failure, got %v", reply)
+	}
+}
+
+func TestWebTorrentRouteDisabled(t *testing.T) {
+	conf := config.Config{Features: config.FeatureFlags{config.FeatureWebTorrent: false}}
+	h := New(context.Background(), conf, WithoutJobs(), WithFrontendPath(t.TempDir())).Handler()
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	url := strings.Replace(server.URL, "http", "ws", 1) + "/key/webtorrent"
+	if ws, err := websocket.Dial(url, "", "http://example.com"); err == nil {
+		ws.Close()
+		t.Errorf("expected no WebSocket tracker with the feature disabled")
+	}
+}
+
+func TestRunReadOnly(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	// Read-only mode was enabled through the admin API before this
+	// instance started, and an announce was buffered.
+	if err := handler.SetReadOnly(ctx, conf, true); err != nil {
+		t.Fatalf("error enabling read-only mode: %v", err)
+	}
+	handler.PeerHandler(ctx, conf)(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Port:        6881,
+	}))
+
+	s := New(ctx, conf, WithoutJobs(), WithFrontendPath(t.TempDir()), WithAddr("127.0.0.1:0"))
+	runCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := s.Run(runCtx); err != nil {
+		t.Fatalf("unexpected error running server: %v", err)
+	}
+
+	buffered, err := handler.BufferedAnnounces(ctx, conf)
+	if err != nil {
+		t.Fatalf("error counting buffered announces: %v", err)
+	}
+	if buffered != 1 {
+		t.Errorf("expected buffered announce to wait for read-only mode to be disabled, got %d buffered", buffered)
+	}
+}
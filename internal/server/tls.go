@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// CertReloadInterval is how often the certificate and key files are checked
+// for changes.
+const CertReloadInterval = time.Minute
+
+// certSource serves the TLS certificate, either a certReloader or an
+// autocert.Manager.
+type certSource interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// certReloader serves a TLS certificate which is reloaded from disk whenever
+// the certificate or key file changes, so that renewals, for example by an
+// ACME client such as certbot, take effect without restarting the listener.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// newCertReloader loads the certificate and key, returning an error if they
+// cannot be loaded.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modTimes returns the modification times of the certificate and key files.
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unable to stat certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unable to stat key: %w", err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// reload loads the certificate and key if either has changed since they
+// were last loaded, and reports whether it did. If loading fails, the
+// previous certificate is kept, and loading is tried again on the next call,
+// since a renewal may have written only one of the files so far.
+func (r *certReloader) reload() (bool, error) {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("unable to load certificate: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certMod = certMod
+	r.keyMod = keyMod
+	r.mu.Unlock()
+
+	return true, nil
+}
+
+// GetCertificate returns the current certificate, for use in tls.Config.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// watch checks for changed certificates every interval until the context is
+// cancelled. Failures are logged rather than returned, since the listener
+// can keep serving the previous certificate.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.reload()
+			if err != nil {
+				log.Printf("Error reloading TLS certificate: %v", err)
+			} else if reloaded {
+				log.Printf("Reloaded TLS certificate from %s", r.certFile)
+			}
+		}
+	}
+}
+
+// loadClientCAs loads the PEM-encoded CA certificates which may sign client
+// certificates.
+func loadClientCAs(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client CAs: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// newAutocertManager returns a manager which obtains certificates for the
+// configured hostnames from Let's Encrypt, and refuses any other hostname.
+func newAutocertManager(conf *config.TLSConfig) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(conf.AutocertHosts...),
+		Cache:      autocert.DirCache(conf.AutocertCacheDir),
+		Email:      conf.AutocertEmail,
+	}
+}
+
+// configureTLS sets up hs to serve TLS with the certificates from certs.
+// HTTP/2 is negotiated unless disabled. If clientCAs is not nil, client
+// certificates signed by them are verified if given. If HTTP/3 is enabled,
+// it returns an HTTP/3 server for the same address and handler, and hs
+// advertises it to clients with an Alt-Svc header; otherwise it returns nil.
+func configureTLS(hs *http.Server, conf *config.TLSConfig, certs certSource, clientCAs *x509.CertPool) *http3.Server {
+	hs.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+	if _, ok := certs.(*autocert.Manager); ok {
+		// Answer the TLS-ALPN-01 challenge, which the manager handles in
+		// GetCertificate. The HTTP protocols are added by hs.
+		hs.TLSConfig.NextProtos = []string{acme.ALPNProto}
+	}
+	if clientCAs != nil {
+		hs.TLSConfig.ClientCAs = clientCAs
+		hs.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if conf.DisableHTTP2 {
+		// A non-nil, empty TLSNextProto turns off automatic HTTP/2.
+		hs.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	if !conf.HTTP3 {
+		return nil
+	}
+
+	h3 := &http3.Server{
+		Addr:      hs.Addr,
+		Handler:   hs.Handler,
+		TLSConfig: http3.ConfigureTLSConfig(hs.TLSConfig.Clone()),
+	}
+	next := hs.Handler
+	hs.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// This fails only until the HTTP/3 listener is up, in which case
+		// HTTP/3 is simply not advertised yet.
+		_ = h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+
+	return h3
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
+)
+
+// writeCert writes a self-signed certificate with the given serial number
+// and its key, with modification times set to modTime.
+func writeCert(t *testing.T, certFile, keyFile string, serial int64, modTime time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err = os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func servedSerial(t *testing.T, r *certReloader) int64 {
+	t.Helper()
+
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	modTime := time.Now().Add(-time.Hour)
+
+	writeCert(t, certFile, keyFile, 1, modTime)
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("error loading certificate: %v", err)
+	}
+
+	reloaded, err := r.reload()
+	if err != nil || reloaded {
+		t.Errorf("expected no reload for unchanged files, got %v (%v)", reloaded, err)
+	}
+
+	// A renewal which has only written the certificate so far keeps the
+	// previous certificate.
+	err = os.WriteFile(keyFile, []byte("not a key"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.reload(); err == nil {
+		t.Errorf("expected error loading a mismatched key")
+	}
+	if serial := servedSerial(t, r); serial != 1 {
+		t.Errorf("expected previous certificate to be served, got serial %d", serial)
+	}
+
+	writeCert(t, certFile, keyFile, 2, modTime.Add(time.Minute))
+
+	reloaded, err = r.reload()
+	if err != nil || !reloaded {
+		t.Fatalf("expected reload for renewed files, got %v (%v)", reloaded, err)
+	}
+	if serial := servedSerial(t, r); serial != 2 {
+		t.Errorf("expected renewed certificate to be served, got serial %d", serial)
+	}
+}
+
+func TestConfigureTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, 1, time.Now())
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("error loading certificate: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		conf      config.TLSConfig
+		wantProto string
+		wantH3    bool
+	}{
+		{"default", config.TLSConfig{}, "HTTP/2.0", false},
+		{"http2 disabled", config.TLSConfig{DisableHTTP2: true}, "HTTP/1.1", false},
+		{"http3", config.TLSConfig{HTTP3: true}, "HTTP/2.0", true},
+	}
+
+	get := func(t *testing.T, client *http.Client, url string) *http.Response {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("error making request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "localhost:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			hs := &http.Server{
+				Addr:    ln.Addr().String(),
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+			}
+			h3 := configureTLS(hs, &tt.conf, certs, nil)
+			if (h3 != nil) != tt.wantH3 {
+				t.Fatalf("expected HTTP/3 server %v, got %v", tt.wantH3, h3 != nil)
+			}
+
+			go func() {
+				if err := hs.ServeTLS(ln, "", ""); !errors.Is(err, http.ErrServerClosed) {
+					t.Errorf("error serving: %v", err)
+				}
+			}()
+			defer hs.Close()
+
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				ForceAttemptHTTP2: true,
+			}}
+			url := "https://" + hs.Addr
+
+			resp := get(t, client, url)
+			if resp.Proto != tt.wantProto {
+				t.Errorf("expected %s, got %s", tt.wantProto, resp.Proto)
+			}
+
+			if h3 == nil {
+				return
+			}
+
+			udp, err := net.ListenPacket("udp", hs.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go h3.Serve(udp)
+			defer h3.Close()
+
+			h3Transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+			defer h3Transport.Close()
+			if resp = get(t, &http.Client{Transport: h3Transport}, url); resp.Proto != "HTTP/3.0" {
+				t.Errorf("expected HTTP/3.0, got %s", resp.Proto)
+			}
+
+			if altSvc := get(t, client, url).Header.Get("Alt-Svc"); altSvc == "" {
+				t.Errorf("expected HTTP/3 to be advertised with Alt-Svc")
+			}
+		})
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, 1, time.Now())
+	clientCertFile := filepath.Join(dir, "client.pem")
+	clientKeyFile := filepath.Join(dir, "client-key.pem")
+	writeCert(t, clientCertFile, clientKeyFile, 2, time.Now())
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("error loading certificate: %v", err)
+	}
+	clientCAs, err := loadClientCAs(clientCertFile)
+	if err != nil {
+		t.Fatalf("error loading client CAs: %v", err)
+	}
+	if _, err = loadClientCAs(keyFile); err == nil {
+		t.Errorf("expected error loading client CAs without certificates")
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := make(chan int64, 1)
+	hs := &http.Server{
+		Addr: ln.Addr().String(),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var serial int64
+			if len(r.TLS.VerifiedChains) > 0 {
+				serial = r.TLS.VerifiedChains[0][0].SerialNumber.Int64()
+			}
+			verified <- serial
+		}),
+	}
+	configureTLS(hs, &config.TLSConfig{}, certs, clientCAs)
+	go func() {
+		if err := hs.ServeTLS(ln, "", ""); !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("error serving: %v", err)
+		}
+	}()
+	defer hs.Close()
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		certs  []tls.Certificate
+		serial int64
+	}{
+		{"without certificate", nil, 0},
+		{"with certificate", []tls.Certificate{clientCert}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: tt.certs},
+			}}
+			resp, err := client.Get("https://" + hs.Addr)
+			if err != nil {
+				t.Fatalf("error making request: %v", err)
+			}
+			resp.Body.Close()
+			if serial := <-verified; serial != tt.serial {
+				t.Errorf("expected verified serial %d, got %d", tt.serial, serial)
+			}
+		})
+	}
+}
+
+func TestAutocert(t *testing.T) {
+	conf := &config.TLSConfig{AutocertHosts: []string{"tracker.example.com"}, AutocertCacheDir: t.TempDir()}
+	manager := newAutocertManager(conf)
+
+	if err := manager.HostPolicy(context.Background(), "tracker.example.com"); err != nil {
+		t.Errorf("expected configured hostname to be allowed, got %v", err)
+	}
+	if err := manager.HostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Errorf("expected other hostname to be refused")
+	}
+	if _, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Errorf("expected no certificate for other hostname")
+	}
+
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	configureTLS(hs, conf, manager, nil)
+	if len(hs.TLSConfig.NextProtos) != 1 || hs.TLSConfig.NextProtos[0] != acme.ALPNProto {
+		t.Errorf("expected the TLS-ALPN-01 challenge to be negotiated, got %v", hs.TLSConfig.NextProtos)
+	}
+
+	// Requests other than challenges on the HTTP listener go to HTTPS.
+	w := httptest.NewRecorder()
+	manager.HTTPHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "http://tracker.example.com/api/stats", nil))
+	if location := w.Header().Get("Location"); location != "https://tracker.example.com/api/stats" {
+		t.Errorf("expected redirect to HTTPS, got %d to %q", w.Code, location)
+	}
+}
@@ -0,0 +1,194 @@
+// Package snapshot periodically writes the public statistics served by
+// /api/stats and /api/infohashes as static JSON files, to a local directory
+// or an S3-compatible bucket. A CDN, a static web server, or the frontend
+// can then serve the files, so that public stats traffic never reaches the
+// tracker. The files have the same contents as the API responses.
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/api"
+	"github.com/dmoerner/etracker/internal/config"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	// DefaultInterval is how often snapshots are written when no interval
+	// is configured.
+	DefaultInterval = time.Minute
+
+	StatsFile      = "stats.json"
+	InfohashesFile = "infohashes.json"
+)
+
+// Store is a destination for snapshot files.
+type Store interface {
+	Put(ctx context.Context, name string, data []byte) error
+}
+
+// dirStore writes files to a local directory.
+type dirStore string
+
+// Put writes the file atomically, so that readers never see a partial
+// snapshot.
+func (d dirStore) Put(_ context.Context, name string, data []byte) error {
+	tmp, err := os.CreateTemp(string(d), "."+name+".*")
+	if err != nil {
+		return fmt.Errorf("error creating snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing snapshot file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("error writing snapshot file: %w", err)
+	}
+	// CreateTemp files are only readable by their owner.
+	if err = os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("error writing snapshot file: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(string(d), name)); err != nil {
+		return fmt.Errorf("error writing snapshot file: %w", err)
+	}
+
+	return nil
+}
+
+// s3Store uploads files to an S3-compatible bucket.
+type s3Store struct {
+	client       *minio.Client
+	bucket       string
+	prefix       string
+	cacheControl string
+}
+
+func (s *s3Store) Put(ctx context.Context, name string, data []byte) error {
+	_, err := s.client.PutObject(ctx, s.bucket, path.Join(s.prefix, name), bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType:  "application/json",
+		CacheControl: s.cacheControl,
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading snapshot to bucket: %w", err)
+	}
+	return nil
+}
+
+// newS3Store returns a Store for the bucket at endpoint, such as
+// https://s3.us-east-1.amazonaws.com. Credentials are read from
+// $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY. Objects may be cached for
+// up to interval.
+func newS3Store(endpoint, region, bucket, prefix string, interval time.Duration) (*s3Store, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid snapshot bucket endpoint %q", endpoint)
+	}
+
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:  credentials.NewEnvAWS(),
+		Secure: u.Scheme != "http",
+		Region: region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating snapshot bucket client: %w", err)
+	}
+
+	return &s3Store{
+		client:       client,
+		bucket:       bucket,
+		prefix:       prefix,
+		cacheControl: fmt.Sprintf("public, max-age=%d", int(interval.Seconds())),
+	}, nil
+}
+
+// Stores returns the destinations configured in conf.
+func Stores(conf config.Config) ([]Store, error) {
+	var stores []Store
+	if conf.SnapshotDir != "" {
+		stores = append(stores, dirStore(conf.SnapshotDir))
+	}
+	if conf.SnapshotBucket != "" {
+		s, err := newS3Store(conf.SnapshotEndpoint, conf.SnapshotRegion, conf.SnapshotBucket, conf.SnapshotPrefix, interval(conf))
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, s)
+	}
+	return stores, nil
+}
+
+// interval returns the configured snapshot interval, or DefaultInterval.
+func interval(conf config.Config) time.Duration {
+	if conf.SnapshotInterval > 0 {
+		return conf.SnapshotInterval
+	}
+	return DefaultInterval
+}
+
+// Write queries the current statistics and writes them to every store.
+func Write(ctx context.Context, conf config.Config, stores []Store) error {
+	stats, err := api.QueryGlobalStats(ctx, conf)
+	if err != nil {
+		return err
+	}
+	infohashes, err := api.QueryInfohashStats(ctx, conf, api.InfohashFilter{})
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string][]byte)
+	if files[StatsFile], err = json.Marshal(stats); err != nil {
+		return fmt.Errorf("error encoding stats: %w", err)
+	}
+	if files[InfohashesFile], err = json.Marshal(infohashes); err != nil {
+		return fmt.Errorf("error encoding infohash stats: %w", err)
+	}
+
+	for _, store := range stores {
+		for name, data := range files {
+			if err = store.Put(ctx, name, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Job writes a snapshot to the configured stores at startup and then every
+// conf.SnapshotInterval. Failures are logged, and the previous snapshot is
+// left in place until the next attempt.
+func Job(ctx context.Context, conf config.Config) error {
+	stores, err := Stores(conf)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval(conf))
+	defer ticker.Stop()
+
+	for {
+		if err := Write(ctx, conf, stores); err != nil && ctx.Err() == nil {
+			log.Printf("Error writing stats snapshot: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/api"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestWrite(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	request := testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[1],
+		Info_hash:   testutils.AllowedInfoHashes["a"],
+		Event:       config.Completed,
+		Left:        0,
+	})
+	handler.PeerHandler(ctx, conf)(httptest.NewRecorder(), request)
+
+	dir := t.TempDir()
+	if err := Write(ctx, conf, []Store{dirStore(dir)}); err != nil {
+		t.Fatalf("error writing snapshot: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, StatsFile))
+	if err != nil {
+		t.Fatalf("error reading stats snapshot: %v", err)
+	}
+	var stats api.GlobalStats
+	if err = json.Unmarshal(data, &stats); err != nil {
+		t.Fatalf("error decoding stats snapshot: %v", err)
+	}
+	expected := api.GlobalStats{Hashcount: len(testutils.AllowedInfoHashes), Seeders: 1}
+	if stats != expected {
+		t.Errorf("expected stats %v, got %v", expected, stats)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, InfohashesFile))
+	if err != nil {
+		t.Fatalf("error reading infohashes snapshot: %v", err)
+	}
+	var infohashes []api.InfohashStats
+	if err = json.Unmarshal(data, &infohashes); err != nil {
+		t.Fatalf("error decoding infohashes snapshot: %v", err)
+	}
+	if len(infohashes) != len(testutils.AllowedInfoHashes) {
+		t.Errorf("expected %d infohashes, got %d", len(testutils.AllowedInfoHashes), len(infohashes))
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	dir := t.TempDir()
+	store := dirStore(dir)
+
+	for _, content := range []string{"first", "second"} {
+		if err := store.Put(context.Background(), StatsFile, []byte(content)); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, StatsFile))
+		if err != nil || string(data) != content {
+			t.Errorf("expected %q, got %q (%v)", content, data, err)
+		}
+	}
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected only the snapshot file, got %v (%v)", entries, err)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	type upload struct {
+		method, path, cacheControl, contentType string
+		body                                    []byte
+	}
+	uploads := make(chan upload, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		uploads <- upload{r.Method, r.URL.Path, r.Header.Get("Cache-Control"), r.Header.Get("Content-Type"), body}
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	defer ts.Close()
+
+	store, err := newS3Store(ts.URL, "us-east-1", "bucket", "tracker", 5*time.Minute)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	if err = store.Put(context.Background(), StatsFile, []byte(`{"hashcount":1}`)); err != nil {
+		t.Fatalf("error uploading: %v", err)
+	}
+
+	u := <-uploads
+	if u.method != "PUT" || u.path != "/bucket/tracker/stats.json" {
+		t.Errorf("unexpected upload %s %s", u.method, u.path)
+	}
+	if u.cacheControl != "public, max-age=300" || u.contentType != "application/json" {
+		t.Errorf("unexpected headers Cache-Control %q, Content-Type %q", u.cacheControl, u.contentType)
+	}
+	// Over plain HTTP, the body is sent with chunk signatures.
+	if !bytes.Contains(u.body, []byte(`{"hashcount":1}`)) {
+		t.Errorf("snapshot missing from upload %q", u.body)
+	}
+}
@@ -0,0 +1,96 @@
+// Package swarms watches for swarms which lose their last seeder. A
+// background job records whether each infohash has a seeder, and publishes
+// events.SwarmDied for each infohash which had one at the last check but
+// no longer does. The state is kept in the seeded column of the infohashes
+// table, so that each death is only published once, by whichever tracker
+// instance notices it first.
+package swarms
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+	"github.com/dmoerner/etracker/internal/events"
+	"github.com/dmoerner/etracker/internal/handler"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Interval is how often swarms are checked.
+const Interval = 5 * time.Minute
+
+// Died is an infohash whose swarm has lost its last seeder.
+type Died struct {
+	Info_hash []byte
+	Name      string
+}
+
+// Check records whether each swarm has a seeder, and returns the swarms
+// which have lost their last seeder since the last check. Merged
+// infohashes are not checked, since their peers join the canonical swarm.
+func Check(ctx context.Context, conf config.Config) ([]Died, error) {
+	rows, _ := conf.Dbpool.Query(ctx, `
+		WITH `+db.RecentAnnounces(1, 2, "amount_left")+`,
+		seeded AS (
+		    SELECT DISTINCT
+			info_hash_id
+		    FROM
+			recent_announces
+		    WHERE
+			amount_left = 0
+		),
+		changed AS (
+		    UPDATE infohashes
+		    SET seeded = NOT infohashes.seeded
+		    WHERE merged_into IS NULL
+			AND infohashes.seeded <> (id IN (SELECT info_hash_id FROM seeded))
+		    RETURNING
+			info_hash,
+			name,
+			seeded
+		)
+		SELECT
+		    info_hash,
+		    name
+		FROM
+		    changed
+		WHERE
+		    NOT seeded
+		`,
+		config.Stopped, conf.StaleCutoff())
+	died, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Died])
+	if err != nil {
+		return nil, fmt.Errorf("error checking swarms: %w", err)
+	}
+	return died, nil
+}
+
+// Job checks swarms at startup and then every Interval, skipping while
+// read-only, and publishes events.SwarmDied for each swarm which lost its
+// last seeder. Failures are logged and retried on the next run.
+func Job(ctx context.Context, conf config.Config) error {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+
+	for {
+		if enabled, err := handler.ReadOnly(ctx, conf); err == nil && !enabled {
+			died, err := Check(ctx, conf)
+			if err != nil && ctx.Err() == nil {
+				log.Print(err)
+			}
+			for _, d := range died {
+				conf.Publish(events.Event{Kind: events.SwarmDied, Info_hash: d.Info_hash, Name: d.Name})
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
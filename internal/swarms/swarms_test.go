@@ -0,0 +1,55 @@
+package swarms
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	peerHandler := handler.PeerHandler(ctx, conf)
+	peer_id := testutils.GeneratePeerID()
+	announce := func(event config.Event) {
+		peerHandler(httptest.NewRecorder(), testutils.CreateTestAnnounce(testutils.Request{
+			AnnounceKey: testutils.AnnounceKeys[1],
+			Info_hash:   testutils.AllowedInfoHashes["a"],
+			Peer_id:     peer_id,
+			Left:        0,
+			Event:       event,
+		}))
+	}
+
+	check := func() []Died {
+		died, err := Check(ctx, conf)
+		if err != nil {
+			t.Fatalf("error checking swarms: %v", err)
+		}
+		return died
+	}
+
+	// A swarm which gains a seeder has not died, and nor has a swarm which
+	// never had one.
+	announce(config.Started)
+	if died := check(); len(died) != 0 {
+		t.Errorf("expected no dead swarms, got %v", died)
+	}
+
+	announce(config.Stopped)
+	died := check()
+	if len(died) != 1 || string(died[0].Info_hash) != testutils.AllowedInfoHashes["a"] {
+		t.Fatalf("expected swarm %q to die, got %v", testutils.AllowedInfoHashes["a"], died)
+	}
+
+	// Each death is only reported once.
+	if died := check(); len(died) != 0 {
+		t.Errorf("expected death to be reported once, got %v", died)
+	}
+}
@@ -0,0 +1,52 @@
+package testutils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// NewFakeRedis starts an in-memory Redis, see miniredis, for the duration of
+// the test and returns a client connected to it. Keys expire by the clock,
+// so tests can advance time instead of sleeping.
+//
+// There is no Postgres equivalent: the tracker's queries are its logic, and
+// tests which touch them still use BuildTestConfig.
+func NewFakeRedis(t testing.TB, clock *FakeClock) *redis.Client {
+	t.Helper()
+
+	m := miniredis.RunT(t)
+	m.SetTime(clock.Now())
+	clock.OnAdvance(func(d time.Duration) {
+		m.FastForward(d)
+		m.SetTime(clock.Now())
+	})
+
+	rdb := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() {
+		rdb.Close()
+	})
+
+	return rdb
+}
+
+// BuildFakeConfig returns a Config backed by a fake Redis and no Postgres,
+// for unit tests of Redis-only logic such as quotas and maintenance mode.
+// Its clock starts at the current time and drives both the Config and the
+// fake Redis.
+func BuildFakeConfig(t testing.TB, algorithm config.PeeringAlgorithm, authorization string, opts ...config.Option) (config.Config, *FakeClock) {
+	t.Helper()
+
+	clock := NewFakeClock(time.Now())
+	conf := config.New(append([]config.Option{
+		config.WithAlgorithm(algorithm),
+		config.WithAuthorization(authorization),
+		config.WithStorage(nil, NewFakeRedis(t, clock)),
+	}, opts...)...)
+	conf.Clock = clock
+
+	return conf, clock
+}
@@ -0,0 +1,70 @@
+package testutils
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestFakeRedis(t *testing.T) {
+	ctx := context.Background()
+	clock := NewFakeClock(time.Now())
+	rdb := NewFakeRedis(t, clock)
+
+	if err := rdb.Set(ctx, "key", "value", time.Minute).Err(); err != nil {
+		t.Fatalf("error setting key: %v", err)
+	}
+	if got, err := rdb.Get(ctx, "key").Result(); err != nil || got != "value" {
+		t.Errorf("expected value, got %q, %v", got, err)
+	}
+	if ttl := rdb.TTL(ctx, "key").Val(); ttl != time.Minute {
+		t.Errorf("expected ttl of a minute, got %v", ttl)
+	}
+
+	clock.Advance(time.Minute)
+	if err := rdb.Get(ctx, "key").Err(); err != redis.Nil {
+		t.Errorf("expected key to expire, got %v", err)
+	}
+
+	for range 3 {
+		rdb.Incr(ctx, "counter")
+	}
+	if got := rdb.MGet(ctx, "counter", "missing").Val(); !slices.Equal(got, []any{"3", nil}) {
+		t.Errorf("expected counter of 3 and a missing key, got %v", got)
+	}
+
+	rdb.RPush(ctx, "list", "b", "c")
+	rdb.LPush(ctx, "list", "a")
+	if got := rdb.LPop(ctx, "list").Val(); got != "a" || rdb.LLen(ctx, "list").Val() != 2 {
+		t.Errorf("expected to pop a from a list of 3, got %q", got)
+	}
+
+	pipe := rdb.Pipeline()
+	for i, member := range []string{"old", "middle", "new"} {
+		pipe.ZAdd(ctx, "zset", redis.Z{Score: float64(i), Member: member})
+	}
+	pipe.ZRemRangeByScore(ctx, "zset", "-inf", "(1")
+	if _, err := pipe.Exec(ctx); err != nil {
+		t.Fatalf("error executing pipeline: %v", err)
+	}
+	got := rdb.ZRangeByScore(ctx, "zset", &redis.ZRangeBy{Min: "-inf", Max: "+inf"}).Val()
+	if !slices.Equal(got, []string{"middle", "new"}) {
+		t.Errorf("expected members middle and new, got %v", got)
+	}
+
+	rdb.SAdd(ctx, "set", "b", "a", "c")
+	rdb.SRem(ctx, "set", "c", "missing")
+	if got := rdb.SMembers(ctx, "set").Val(); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("expected members a and b, got %v", got)
+	}
+	if err := rdb.SAdd(ctx, "zset", "a").Err(); err == nil {
+		t.Errorf("expected adding to a sorted set as a set to fail")
+	}
+
+	if n := rdb.Unlink(ctx, "counter", "list", "zset", "set", "missing").Val(); n != 4 {
+		t.Errorf("expected to unlink 4 keys, got %d", n)
+	}
+}
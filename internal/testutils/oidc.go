@@ -0,0 +1,201 @@
+package testutils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// IdentityProvider is an OpenID Connect identity provider, which signs ID
+// tokens with RS256, or with ES256 if EC is set. KeyFetches counts the
+// requests for its keys.
+type IdentityProvider struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+	EC           bool
+
+	server *httptest.Server
+	mu     sync.Mutex
+	rsaKey *rsa.PrivateKey
+	rsaKid string
+	ecKey  *ecdsa.PrivateKey
+	codes  map[string]authorization
+
+	rotations int
+	fetches   int
+}
+
+// authorization is a login waiting for its code to be redeemed.
+type authorization struct {
+	claims      map[string]any
+	redirectURI string
+	challenge   string
+}
+
+// NewIdentityProvider starts an IdentityProvider for the client, which must
+// be closed.
+func NewIdentityProvider(clientID, clientSecret string) *IdentityProvider {
+	p := &IdentityProvider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		codes:        make(map[string]authorization),
+	}
+	p.RotateKeys()
+	var err error
+	if p.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		log.Fatalf("Unable to generate identity provider key: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.fetches++
+		encode := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": p.rsaKid, "use": "sig", "n": encode(p.rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(p.rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(p.ecKey.X.FillBytes(make([]byte, 32))), "y": encode(p.ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if p.ClientSecret == "" {
+			id = r.FormValue("client_id")
+		}
+		p.mu.Lock()
+		auth, ok := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		p.mu.Unlock()
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || id != p.ClientID || secret != p.ClientSecret || r.FormValue("redirect_uri") != auth.redirectURI ||
+			base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.Token(auth.claims)})
+	})
+	p.server = httptest.NewServer(mux)
+	p.URL = p.server.URL
+	return p
+}
+
+// Close shuts the IdentityProvider down.
+func (p *IdentityProvider) Close() {
+	p.server.Close()
+}
+
+// RotateKeys replaces the RS256 key with one of a new key ID.
+func (p *IdentityProvider) RotateKeys() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Unable to generate identity provider key: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rotations++
+	p.rsaKey = key
+	p.rsaKid = fmt.Sprintf("rsa-%d", p.rotations)
+}
+
+// KeyFetches returns how often the keys have been requested.
+func (p *IdentityProvider) KeyFetches() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.fetches
+}
+
+// Claims returns the claims of a valid ID token for the subject, which
+// expires in an hour.
+func (p *IdentityProvider) Claims(subject, nonce string) map[string]any {
+	return map[string]any{
+		"iss":   p.URL,
+		"aud":   p.ClientID,
+		"sub":   subject,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": nonce,
+	}
+}
+
+// Token signs the claims as an ID token.
+func (p *IdentityProvider) Token(claims map[string]any) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	alg, kid := "RS256", p.rsaKid
+	if p.EC {
+		alg, kid = "ES256", "ec"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	if p.EC {
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, p.ecKey, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	} else {
+		signature, err = rsa.SignPKCS1v15(rand.Reader, p.rsaKey, crypto.SHA256, digest[:])
+	}
+	if err != nil {
+		log.Fatalf("Unable to sign ID token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Authorize logs in the subject at the authorization URL a client sent the
+// user to, and returns the URL of the callback the user is redirected to.
+// The ID token for the code has the subject's Claims, with the extra
+// claims added.
+func (p *IdentityProvider) Authorize(authURL, subject string, extra map[string]any) string {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		log.Fatalf("Unable to parse authorization URL: %v", err)
+	}
+	query := u.Query()
+	claims := p.Claims(subject, query.Get("nonce"))
+	for name, value := range extra {
+		claims[name] = value
+	}
+
+	code := make([]byte, 16)
+	if _, err := rand.Read(code); err != nil {
+		log.Fatalf("Unable to generate authorization code: %v", err)
+	}
+	p.mu.Lock()
+	p.codes[base64.RawURLEncoding.EncodeToString(code)] = authorization{
+		claims:      claims,
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+	}
+	p.mu.Unlock()
+
+	callback := url.Values{"code": {base64.RawURLEncoding.EncodeToString(code)}, "state": {query.Get("state")}}
+	return query.Get("redirect_uri") + "?" + callback.Encode()
+}
@@ -0,0 +1,172 @@
+package testutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"sort"
+)
+
+// Flags of passkey authenticator data.
+const (
+	PasskeyUserPresent  = 0x01
+	PasskeyUserVerified = 0x04
+	PasskeyAttested     = 0x40
+)
+
+// Authenticator is a software passkey, which signs with ES256, or with
+// Ed25519 if it was created for EdDSA. Flags are the flags of its
+// authenticator data, and SignCount is incremented by each login.
+type Authenticator struct {
+	ID        []byte
+	Flags     byte
+	SignCount uint32
+
+	ecdsaKey   *ecdsa.PrivateKey
+	ed25519Key ed25519.PrivateKey
+}
+
+// NewAuthenticator creates an Authenticator with a random credential ID,
+// which verifies its user.
+func NewAuthenticator(eddsa bool) *Authenticator {
+	a := &Authenticator{
+		ID:    make([]byte, 16),
+		Flags: PasskeyUserPresent | PasskeyUserVerified,
+	}
+	if _, err := rand.Read(a.ID); err != nil {
+		log.Fatalf("Unable to generate credential ID: %v", err)
+	}
+	var err error
+	if eddsa {
+		_, a.ed25519Key, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		a.ecdsaKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		log.Fatalf("Unable to generate passkey: %v", err)
+	}
+	return a
+}
+
+// PublicKey returns the public key in COSE format.
+func (a *Authenticator) PublicKey() []byte {
+	if a.ed25519Key != nil {
+		return EncodeCBOR(map[any]any{
+			1:  1,  // kty: OKP
+			3:  -8, // alg: EdDSA
+			-1: 6,  // crv: Ed25519
+			-2: []byte(a.ed25519Key.Public().(ed25519.PublicKey)),
+		})
+	}
+	return EncodeCBOR(map[any]any{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.ecdsaKey.X.FillBytes(make([]byte, 32)),
+		-3: a.ecdsaKey.Y.FillBytes(make([]byte, 32)),
+	})
+}
+
+// AuthenticatorData returns authenticator data for the relying party rpID,
+// with the credential ID and public key if attested.
+func (a *Authenticator) AuthenticatorData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := a.Flags
+	if attested {
+		flags |= PasskeyAttested
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.SignCount)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.ID)))
+		data = append(data, a.ID...)
+		data = append(data, a.PublicKey()...)
+	}
+	return data
+}
+
+// ClientDataJSON returns the client data a browser at origin collects for
+// a ceremony, "webauthn.create" or "webauthn.get", with the challenge.
+func ClientDataJSON(ceremony, challenge, origin string) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    origin,
+	})
+	return data
+}
+
+// Register returns the client data and the attestation object, with the
+// "none" attestation, of a registration answering the challenge.
+func (a *Authenticator) Register(rpID, origin, challenge string) ([]byte, []byte) {
+	attestation := EncodeCBOR(map[any]any{
+		"fmt":      "none",
+		"attStmt":  map[any]any{},
+		"authData": a.AuthenticatorData(rpID, true),
+	})
+	return ClientDataJSON("webauthn.create", challenge, origin), attestation
+}
+
+// Login returns the client data, the authenticator data, and the signature
+// of a login answering the challenge.
+func (a *Authenticator) Login(rpID, origin, challenge string) ([]byte, []byte, []byte) {
+	a.SignCount++
+	clientData := ClientDataJSON("webauthn.get", challenge, origin)
+	authData := a.AuthenticatorData(rpID, false)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(authData, clientDataHash[:]...)
+	if a.ed25519Key != nil {
+		return clientData, authData, ed25519.Sign(a.ed25519Key, signed)
+	}
+	digest := sha256.Sum256(signed)
+	signature, err := ecdsa.SignASN1(rand.Reader, a.ecdsaKey, digest[:])
+	if err != nil {
+		log.Fatalf("Unable to sign passkey login: %v", err)
+	}
+	return clientData, authData, signature
+}
+
+// EncodeCBOR encodes ints, byte strings, text strings, and maps of them as
+// CBOR, with map keys in a deterministic order.
+func EncodeCBOR(v any) []byte {
+	head := func(major byte, arg uint64) []byte {
+		switch {
+		case arg < 24:
+			return []byte{major<<5 | byte(arg)}
+		case arg < 1<<8:
+			return []byte{major<<5 | 24, byte(arg)}
+		case arg < 1<<16:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+		}
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[any]any:
+		var items [][]byte
+		for key, value := range v {
+			items = append(items, append(EncodeCBOR(key), EncodeCBOR(value)...))
+		}
+		sort.Slice(items, func(i, j int) bool { return string(items[i]) < string(items[j]) })
+		out := head(5, uint64(len(v)))
+		for _, item := range items {
+			out = append(out, item...)
+		}
+		return out
+	}
+	panic("unsupported CBOR value")
+}
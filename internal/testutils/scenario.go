@@ -0,0 +1,173 @@
+package testutils
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+)
+
+// LeecherLeft is the amount left announced by leechers in a Scenario.
+const LeecherLeft = 100
+
+// Scenario describes a target swarm state, which Run reaches by sending
+// announces through a handler. It replaces hand-written loops of announces
+// in algorithm tests, benchmarks, and load tests:
+//
+//	Scenario{Seeders: 50, Info_hashes: []string{AllowedInfoHashes["a"]}}
+//
+// is fifty seeders on a, and
+//
+//	Scenario{Torrents: 5, Seeders: 1, Keys: []string{AnnounceKeys[1]}}
+//
+// is one key seeding five new torrents.
+type Scenario struct {
+	// Info_hashes are the swarms. If there are fewer than Torrents, random
+	// infohashes are added to the allowlist for the rest.
+	Info_hashes []string
+	// Torrents is the number of swarms, at least len(Info_hashes).
+	Torrents int
+	// Seeders and Leechers are the number of peers in each swarm.
+	Seeders  int
+	Leechers int
+	// Keys are the announce keys of the peers, in order, seeders first.
+	// Each swarm uses the same keys, so a key seeds every torrent. Peers
+	// beyond the given keys, and peers replaced by churn, get newly
+	// generated keys.
+	Keys []string
+	// Churn is the fraction of each swarm, rounded, which leaves with a
+	// stopped announce and is replaced by a new peer in the same role in
+	// every round after the first.
+	Churn float64
+	// Rounds is the number of times every peer announces, at least one.
+	// If the Config has a FakeClock, it is advanced by the announce
+	// interval between rounds, so that Rounds is the duration of the
+	// scenario.
+	Rounds int
+}
+
+// Swarm is the state reached by a Scenario.
+type Swarm struct {
+	Info_hashes []string
+	// Peers are the peers in each swarm at the end of the scenario, seeders
+	// first. Announcing them again keeps the swarms as they are.
+	Peers map[string][]Request
+}
+
+// Requests returns the announce of every peer in s, swarm by swarm.
+func (s Swarm) Requests() []Request {
+	var requests []Request
+	for _, info_hash := range s.Info_hashes {
+		requests = append(requests, s.Peers[info_hash]...)
+	}
+	return requests
+}
+
+// Run sends the announces of the scenario to handler, which must be backed
+// by conf, and returns the swarms reached. Setup failures are fatal to the
+// test.
+func (sc Scenario) Run(tb testing.TB, ctx context.Context, conf config.Config, handler http.HandlerFunc) Swarm {
+	tb.Helper()
+
+	swarm := Swarm{
+		Info_hashes: append([]string(nil), sc.Info_hashes...),
+		Peers:       make(map[string][]Request),
+	}
+	for i := len(swarm.Info_hashes); i < sc.Torrents; i++ {
+		swarm.Info_hashes = append(swarm.Info_hashes, allowRandomInfoHash(tb, ctx, conf, i))
+	}
+
+	generateKey := func() string {
+		key, err := config.GenerateAnnounceKey(ctx, conf)
+		if err != nil {
+			tb.Fatalf("unable to generate announce key: %v", err)
+		}
+		return key
+	}
+
+	keys := make([]string, sc.Seeders+sc.Leechers)
+	for i := range keys {
+		if i < len(sc.Keys) {
+			keys[i] = sc.Keys[i]
+		} else {
+			keys[i] = generateKey()
+		}
+	}
+	for _, info_hash := range swarm.Info_hashes {
+		for i, key := range keys {
+			peer := Request{AnnounceKey: key, Info_hash: info_hash}
+			if i >= sc.Seeders {
+				peer.Left = LeecherLeft
+			}
+			swarm.Peers[info_hash] = append(swarm.Peers[info_hash], peer)
+		}
+	}
+
+	announce := func(r Request) {
+		handler(httptest.NewRecorder(), CreateTestAnnounce(r))
+	}
+
+	clock, _ := conf.Clock.(*FakeClock)
+	churned := int(math.Round(sc.Churn * float64(len(keys))))
+
+	for round := range max(sc.Rounds, 1) {
+		if round > 0 {
+			if clock != nil {
+				clock.Advance(config.Interval * time.Second)
+			}
+			for _, info_hash := range swarm.Info_hashes {
+				peers := swarm.Peers[info_hash]
+				for _, i := range churnedPeers(round, churned, len(peers)) {
+					stopped := peers[i]
+					stopped.Event = config.Stopped
+					announce(stopped)
+					peers[i].AnnounceKey = generateKey()
+				}
+			}
+		}
+		for _, info_hash := range swarm.Info_hashes {
+			for _, peer := range swarm.Peers[info_hash] {
+				announce(peer)
+			}
+		}
+	}
+
+	return swarm
+}
+
+// churnedPeers returns the indexes of the n peers out of size which leave
+// in a round, rotating through the swarm so that every peer is replaced in
+// turn.
+func churnedPeers(round, n, size int) []int {
+	if size == 0 {
+		return nil
+	}
+	indexes := make([]int, 0, n)
+	for i := range min(n, size) {
+		indexes = append(indexes, ((round-1)*n+i)%size)
+	}
+	return indexes
+}
+
+// allowRandomInfoHash adds a random infohash to the allowlist and returns
+// it.
+func allowRandomInfoHash(tb testing.TB, ctx context.Context, conf config.Config, i int) string {
+	tb.Helper()
+
+	info_hash := make([]byte, 20)
+	_, _ = rand.Read(info_hash)
+	_, err := conf.Dbpool.Exec(ctx, `
+		INSERT INTO infohashes (info_hash, name)
+		    VALUES ($1, $2)
+		`, info_hash, fmt.Sprintf("test infohash %d", i))
+	if err != nil {
+		tb.Fatalf("unable to insert test allowed infohash: %v", err)
+	}
+	return string(info_hash)
+}
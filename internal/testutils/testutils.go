@@ -3,11 +3,14 @@ package testutils
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha1"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/dmoerner/etracker/internal/config"
 	"github.com/dmoerner/etracker/internal/db"
@@ -36,16 +39,26 @@ var AnnounceKeys = map[int]string{
 
 const UntrackedAnnounceKey = "000000000000000000000000000000"
 
+// DefaultRemoteAddr is the RemoteAddr httptest gives every request, used by
+// CreateTestAnnounce unless Request.RemoteAddr is set.
+const DefaultRemoteAddr = "192.0.2.1:1234"
+
 type Request struct {
 	AnnounceKey string
 	Info_hash   string
-	Ip          *string
-	Port        int
-	Numwant     int
-	Uploaded    int
-	Downloaded  int
-	Left        int
-	Event       config.Event
+	Peer_id     string
+	// Key is the optional key parameter of BEP 7.
+	Key string
+	Ip  *string
+	// RemoteAddr is the source address of the announce in host:port form,
+	// with IPv6 hosts in brackets. It defaults to DefaultRemoteAddr.
+	RemoteAddr string
+	Port       int
+	Numwant    int
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Event      config.Event
 }
 
 type TestContainer struct {
@@ -53,17 +66,77 @@ type TestContainer struct {
 	rdb *tcredis.RedisContainer
 }
 
+// FakeClock is a config.Clock which only moves when advanced.
+type FakeClock struct {
+	mu       sync.Mutex
+	now      time.Time
+	advanced []func(time.Duration)
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	advanced := c.advanced
+	c.mu.Unlock()
+
+	for _, f := range advanced {
+		f(d)
+	}
+}
+
+// OnAdvance calls f whenever the clock is advanced, so that fakes which
+// keep their own time, such as NewFakeRedis, can follow it.
+func (c *FakeClock) OnAdvance(f func(d time.Duration)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advanced = append(c.advanced, f)
+}
+
+// IPv4Addr returns a RemoteAddr for host number host in /24 subnet number
+// subnet, so tests can place peers in the same or different subnets.
+func IPv4Addr(subnet, host int) string {
+	return fmt.Sprintf("10.0.%d.%d:1234", subnet, host)
+}
+
+// IPv6Addr returns a RemoteAddr in the documentation prefix for host number
+// host in /64 subnet number subnet.
+func IPv6Addr(subnet, host int) string {
+	return fmt.Sprintf("[2001:db8:0:%x::%x]:1234", subnet, host)
+}
+
 func GeneratePeerID() string {
 	peer_id := make([]byte, 20)
 	_, _ = rand.Read(peer_id)
 	return string(peer_id)
 }
 
+// PeerIDForKey returns a peer_id derived from an announce key, so that
+// repeated test announces with one key come from the same client.
+func PeerIDForKey(announceKey string) string {
+	sum := sha1.Sum([]byte(announceKey))
+	return string(sum[:])
+}
+
 func CreateTestAnnounce(request Request) *http.Request {
+	peer_id := request.Peer_id
+	if peer_id == "" {
+		peer_id = PeerIDForKey(request.AnnounceKey)
+	}
+
 	announce := fmt.Sprintf(
 		"http://example.com/%s/announce?peer_id=%s&info_hash=%s&port=%d&numwant=%d&uploaded=%d&downloaded=%d&left=%d",
 		request.AnnounceKey,
-		url.QueryEscape(GeneratePeerID()),
+		url.QueryEscape(peer_id),
 		url.QueryEscape(request.Info_hash),
 		request.Port,
 		request.Numwant,
@@ -79,19 +152,47 @@ func CreateTestAnnounce(request Request) *http.Request {
 		event = "started"
 	case config.Completed:
 		event = "completed"
+	case config.Paused:
+		event = "paused"
 	}
 
 	if event != "" {
 		announce += fmt.Sprintf("&event=%s", event)
 	}
+	if request.Key != "" {
+		announce += "&key=" + url.QueryEscape(request.Key)
+	}
 
 	newRequest := httptest.NewRequest("GET", announce, nil)
 	newRequest.SetPathValue("id", request.AnnounceKey)
+	if request.RemoteAddr != "" {
+		newRequest.RemoteAddr = request.RemoteAddr
+	}
 
 	return newRequest
 }
 
-func BuildTestConfig(ctx context.Context, algorithm config.PeeringAlgorithm, authorization string) (*TestContainer, config.Config) {
+// CreateDualStackAnnounces returns a pair of announces for request from the
+// same peer, one from the IPv4 RemoteAddr v4 and one from the IPv6
+// RemoteAddr v6, as a dual-stack client sends to a tracker reachable over
+// both families.
+func CreateDualStackAnnounces(request Request, v4, v6 string) []*http.Request {
+	if request.Peer_id == "" {
+		request.Peer_id = PeerIDForKey(request.AnnounceKey)
+	}
+
+	request.RemoteAddr = v4
+	announce4 := CreateTestAnnounce(request)
+	request.RemoteAddr = v6
+	announce6 := CreateTestAnnounce(request)
+
+	return []*http.Request{announce4, announce6}
+}
+
+// BuildTestConfig starts Postgres and Redis containers with the test announce
+// keys and infohashes, and returns a Config for them. Any opts are applied
+// after the algorithm, authorization, and storage.
+func BuildTestConfig(ctx context.Context, algorithm config.PeeringAlgorithm, authorization string, opts ...config.Option) (*TestContainer, config.Config) {
 	dbName := "users"
 	dbUser := "testuser"
 	dbPassword := "testpassword"
@@ -170,12 +271,11 @@ func BuildTestConfig(ctx context.Context, algorithm config.PeeringAlgorithm, aut
 		}
 	}
 
-	conf := config.Config{
-		Algorithm:     algorithm,
-		Authorization: authorization,
-		Dbpool:        dbpool,
-		Rdb:           rdb,
-	}
+	conf := config.New(append([]config.Option{
+		config.WithAlgorithm(algorithm),
+		config.WithAuthorization(authorization),
+		config.WithStorage(dbpool, rdb),
+	}, opts...)...)
 
 	return tc, conf
 }
@@ -2,8 +2,13 @@ package testutils
 
 import (
 	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
 	"testing"
 
+	"github.com/dmoerner/etracker/internal/config"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -56,3 +61,117 @@ func TestTables(t *testing.T) {
 
 	}
 }
+
+func TestCreateTestAnnounce(t *testing.T) {
+	data := []struct {
+		name       string
+		remoteAddr string
+		expected   string
+	}{
+		{"default", "", "192.0.2.1"},
+		{"ipv4", IPv4Addr(2, 7), "10.0.2.7"},
+		{"ipv6", IPv6Addr(2, 7), "2001:db8:0:2::7"},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			request := CreateTestAnnounce(Request{
+				AnnounceKey: AnnounceKeys[1],
+				Info_hash:   AllowedInfoHashes["a"],
+				RemoteAddr:  d.remoteAddr,
+			})
+
+			host, _, err := net.SplitHostPort(request.RemoteAddr)
+			if err != nil {
+				t.Fatalf("invalid RemoteAddr %s: %v", request.RemoteAddr, err)
+			}
+			if host != d.expected {
+				t.Errorf("expected host %s, got %s", d.expected, host)
+			}
+		})
+	}
+}
+
+func TestCreateDualStackAnnounces(t *testing.T) {
+	requests := CreateDualStackAnnounces(Request{
+		AnnounceKey: AnnounceKeys[1],
+		Info_hash:   AllowedInfoHashes["a"],
+	}, IPv4Addr(1, 1), IPv6Addr(1, 1))
+
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 announces, got %d", len(requests))
+	}
+
+	var families []bool
+	for _, r := range requests {
+		addr, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil {
+			t.Fatalf("invalid RemoteAddr %s: %v", r.RemoteAddr, err)
+		}
+		families = append(families, addr.Addr().Is4())
+	}
+	if !families[0] || families[1] {
+		t.Errorf("expected one IPv4 and one IPv6 announce, got %s and %s", requests[0].RemoteAddr, requests[1].RemoteAddr)
+	}
+
+	if requests[0].URL.Query().Get("peer_id") != requests[1].URL.Query().Get("peer_id") {
+		t.Errorf("expected dual-stack announces to share a peer_id")
+	}
+}
+
+func TestScenario(t *testing.T) {
+	var announces []*http.Request
+	record := func(w http.ResponseWriter, r *http.Request) {
+		announces = append(announces, r)
+	}
+
+	swarm := Scenario{
+		Info_hashes: []string{AllowedInfoHashes["a"], AllowedInfoHashes["b"]},
+		Seeders:     2,
+		Leechers:    1,
+		Keys:        []string{AnnounceKeys[1], AnnounceKeys[2], AnnounceKeys[3]},
+		Rounds:      2,
+	}.Run(t, context.Background(), config.Config{}, record)
+
+	if len(announces) != 12 {
+		t.Fatalf("expected 12 announces, got %d", len(announces))
+	}
+
+	requests := swarm.Requests()
+	if len(requests) != 6 {
+		t.Fatalf("expected 6 peers, got %d", len(requests))
+	}
+	for i, r := range requests {
+		expectedLeft := 0
+		if i%3 == 2 {
+			expectedLeft = LeecherLeft
+		}
+		if r.AnnounceKey != AnnounceKeys[i%3+1] || r.Left != expectedLeft {
+			t.Errorf("peer %d: expected key %s with %d left, got %s with %d left", i, AnnounceKeys[i%3+1], expectedLeft, r.AnnounceKey, r.Left)
+		}
+	}
+}
+
+func TestChurnedPeers(t *testing.T) {
+	data := []struct {
+		name     string
+		round    int
+		n        int
+		size     int
+		expected []int
+	}{
+		{"first round", 1, 2, 5, []int{0, 1}},
+		{"second round", 2, 2, 5, []int{2, 3}},
+		{"wraps around", 3, 2, 5, []int{4, 0}},
+		{"whole swarm", 1, 7, 5, []int{0, 1, 2, 3, 4}},
+		{"empty swarm", 1, 2, 0, nil},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			if got := churnedPeers(d.round, d.n, d.size); !slices.Equal(got, d.expected) {
+				t.Errorf("expected %v, got %v", d.expected, got)
+			}
+		})
+	}
+}
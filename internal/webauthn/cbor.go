@@ -0,0 +1,124 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// maxDepth bounds the nesting of CBOR items, which is shallow in every
+// structure authenticators send.
+const maxDepth = 16
+
+var errCBOR = errors.New("malformed CBOR")
+
+// decodeCBOR decodes the first CBOR item in data, and returns it with the
+// bytes which follow it. Only the subset of CBOR used by attestation objects
+// and COSE keys is supported: unsigned and negative integers as int64, byte
+// strings as []byte, text strings as string, arrays as []any, maps with
+// integer or text keys as map[any]any, and the simple values false, true,
+// and null. Indefinite lengths, tags, and floats are rejected.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeItem(data, 0)
+}
+
+func decodeItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxDepth || len(data) == 0 {
+		return nil, nil, errCBOR
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		}
+		return nil, nil, errCBOR
+	}
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(data) >= 1:
+		arg, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		arg, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		arg, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		arg, data = binary.BigEndian.Uint64(data), data[8:]
+	default:
+		return nil, nil, errCBOR
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		if major == 2 {
+			return data[:arg:arg], data[arg:], nil
+		}
+		return string(data[:arg]), data[arg:], nil
+	case 4:
+		// Every item takes at least a byte.
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		items := make([]any, 0, arg)
+		for range arg {
+			var item any
+			var err error
+			item, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data))/2 {
+			return nil, nil, errCBOR
+		}
+		items := make(map[any]any, arg)
+		for range arg {
+			var key, value any
+			var err error
+			key, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+			if _, ok := items[key]; ok {
+				return nil, nil, errCBOR
+			}
+			value, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, data, nil
+	}
+	return nil, nil, errCBOR
+}
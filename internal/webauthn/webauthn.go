@@ -0,0 +1,358 @@
+// Package webauthn verifies passkey registrations and logins, as described
+// by the W3C Web Authentication specification, for user accounts.
+//
+// Only what the tracker needs is implemented. Attestation statements are not
+// checked, since registrations request the "none" attestation conveyance and
+// any authenticator the user holds is accepted. User verification, such as a
+// PIN or biometric, is always required, since passkeys replace passwords.
+// Public keys may be ES256, EdDSA with Ed25519, or RS256.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+)
+
+// COSE algorithm identifiers of the supported public keys.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Algorithms are the supported COSE algorithms, in order of preference.
+var Algorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+const (
+	// ChallengeLength is the number of random bytes in a challenge.
+	ChallengeLength = 32
+
+	// MaxCredentialIDLength is the longest credential ID allowed by the
+	// specification.
+	MaxCredentialIDLength = 1023
+
+	// MinRSABits is the smallest RSA modulus accepted.
+	MinRSABits = 2048
+)
+
+// Flags of the authenticator data.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+var (
+	ErrInvalidResponse = errors.New("invalid passkey response")
+	ErrUnsupportedKey  = errors.New("unsupported passkey public key")
+	ErrSignCount       = errors.New("passkey signature counter did not increase")
+)
+
+// RelyingParty is the site passkeys are registered for. ID is the domain
+// passkeys are scoped to, and Origin the only origin allowed to use them.
+type RelyingParty struct {
+	ID     string
+	Origin string
+}
+
+// NewRelyingParty returns the RelyingParty of a site served at publicURL,
+// such as https://tracker.example.com.
+func NewRelyingParty(publicURL string) (RelyingParty, error) {
+	u, err := url.Parse(publicURL)
+	if err != nil || u.Scheme == "" || u.Hostname() == "" {
+		return RelyingParty{}, fmt.Errorf("invalid public URL %q", publicURL)
+	}
+	return RelyingParty{
+		ID:     u.Hostname(),
+		Origin: u.Scheme + "://" + u.Host,
+	}, nil
+}
+
+// Credential is a registered passkey. PublicKey is in COSE format.
+type Credential struct {
+	ID        []byte
+	PublicKey []byte
+	SignCount uint32
+}
+
+// NewChallenge returns a random challenge, encoded as base64url like the
+// challenge in client data.
+func NewChallenge() (string, error) {
+	challenge := make([]byte, ChallengeLength)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", fmt.Errorf("unable to generate challenge: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(challenge), nil
+}
+
+// clientData is the part of the client data JSON which is checked.
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// Challenge returns the challenge of the client data JSON of a response, so
+// that the challenge can be looked up before the response is verified.
+func Challenge(clientDataJSON []byte) (string, error) {
+	var data clientData
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil || data.Challenge == "" {
+		return "", fmt.Errorf("%w: malformed client data", ErrInvalidResponse)
+	}
+	return data.Challenge, nil
+}
+
+// verifyClientData checks the type, challenge, and origin of the client
+// data JSON of a response.
+func (rp RelyingParty) verifyClientData(clientDataJSON []byte, ceremony, challenge string) error {
+	var data clientData
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return fmt.Errorf("%w: malformed client data", ErrInvalidResponse)
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("%w: client data is for %q", ErrInvalidResponse, data.Type)
+	}
+	if data.Challenge != challenge {
+		return fmt.Errorf("%w: challenge does not match", ErrInvalidResponse)
+	}
+	if data.Origin != rp.Origin || data.CrossOrigin {
+		return fmt.Errorf("%w: unexpected origin %q", ErrInvalidResponse, data.Origin)
+	}
+	return nil
+}
+
+// authenticatorData is the parsed authenticator data of a response.
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthenticatorData parses authenticator data, including the attested
+// credential data if it is present.
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, fmt.Errorf("%w: short authenticator data", ErrInvalidResponse)
+	}
+	auth := authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if auth.flags&flagAttested == 0 {
+		return auth, nil
+	}
+
+	rest := data[37:]
+	// The AAGUID of the authenticator model is not used.
+	if len(rest) < 18 {
+		return authenticatorData{}, fmt.Errorf("%w: short attested credential data", ErrInvalidResponse)
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength == 0 || idLength > MaxCredentialIDLength || idLength > len(rest) {
+		return authenticatorData{}, fmt.Errorf("%w: invalid credential ID", ErrInvalidResponse)
+	}
+	auth.credentialID, rest = rest[:idLength], rest[idLength:]
+
+	// Extensions may follow the public key.
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("%w: malformed public key", ErrInvalidResponse)
+	}
+	auth.publicKey = rest[:len(rest)-len(after)]
+	return auth, nil
+}
+
+// verifyAuthenticatorData checks that authenticator data is scoped to the
+// relying party, and that the user was present and verified.
+func (rp RelyingParty) verifyAuthenticatorData(auth authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(auth.rpIDHash, rpIDHash[:]) {
+		return fmt.Errorf("%w: passkey is for another site", ErrInvalidResponse)
+	}
+	if auth.flags&flagUserPresent == 0 || auth.flags&flagUserVerified == 0 {
+		return fmt.Errorf("%w: user was not verified", ErrInvalidResponse)
+	}
+	return nil
+}
+
+// VerifyRegistration verifies the response to a registration with the
+// challenge, and returns the new Credential.
+func (rp RelyingParty) VerifyRegistration(challenge string, clientDataJSON, attestationObject []byte) (Credential, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return Credential{}, err
+	}
+
+	decoded, rest, err := decodeCBOR(attestationObject)
+	attestation, ok := decoded.(map[any]any)
+	if err != nil || !ok || len(rest) != 0 {
+		return Credential{}, fmt.Errorf("%w: malformed attestation object", ErrInvalidResponse)
+	}
+	authData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return Credential{}, fmt.Errorf("%w: attestation object lacks authenticator data", ErrInvalidResponse)
+	}
+
+	auth, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if err = rp.verifyAuthenticatorData(auth); err != nil {
+		return Credential{}, err
+	}
+	if auth.credentialID == nil {
+		return Credential{}, fmt.Errorf("%w: registration lacks a credential", ErrInvalidResponse)
+	}
+	if _, err = parsePublicKey(auth.publicKey); err != nil {
+		return Credential{}, err
+	}
+
+	return Credential{
+		ID:        bytes.Clone(auth.credentialID),
+		PublicKey: bytes.Clone(auth.publicKey),
+		SignCount: auth.signCount,
+	}, nil
+}
+
+// VerifyLogin verifies the response to a login with the challenge against
+// the registered Credential, and returns the new signature counter, which
+// should be stored for the next login.
+//
+// Authenticators which count signatures must count up, so a counter which
+// does not is a sign of a cloned authenticator, and ErrSignCount is
+// returned. Authenticators which do not count always send zero.
+func (rp RelyingParty) VerifyLogin(challenge string, credential Credential, clientDataJSON, authenticatorDataBytes, signature []byte) (uint32, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	auth, err := parseAuthenticatorData(authenticatorDataBytes)
+	if err != nil {
+		return 0, err
+	}
+	if err = rp.verifyAuthenticatorData(auth); err != nil {
+		return 0, err
+	}
+
+	publicKey, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(bytes.Clone(authenticatorDataBytes), clientDataHash[:]...)
+	if !publicKey.verify(signed, signature) {
+		return 0, fmt.Errorf("%w: invalid signature", ErrInvalidResponse)
+	}
+
+	if (auth.signCount != 0 || credential.SignCount != 0) && auth.signCount <= credential.SignCount {
+		return 0, ErrSignCount
+	}
+	return auth.signCount, nil
+}
+
+// publicKey is a parsed COSE public key.
+type publicKey struct {
+	algorithm int64
+	key       crypto.PublicKey
+}
+
+// verify checks a signature of data.
+func (k publicKey) verify(data, signature []byte) bool {
+	switch k.algorithm {
+	case AlgES256:
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(k.key.(*ecdsa.PublicKey), digest[:], signature)
+	case AlgEdDSA:
+		return ed25519.Verify(k.key.(ed25519.PublicKey), data, signature)
+	case AlgRS256:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(k.key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+// COSE key parameters, see RFC 9053.
+const (
+	coseKty = 1
+	coseAlg = 3
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrv = -1
+	coseX   = -2
+	coseY   = -3
+	coseN   = -1
+	coseE   = -2
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// parsePublicKey parses a COSE public key of a supported algorithm.
+func parsePublicKey(data []byte) (publicKey, error) {
+	decoded, rest, err := decodeCBOR(data)
+	params, ok := decoded.(map[any]any)
+	if err != nil || !ok || len(rest) != 0 {
+		return publicKey{}, fmt.Errorf("%w: malformed public key", ErrInvalidResponse)
+	}
+	kty, _ := params[int64(coseKty)].(int64)
+	alg, _ := params[int64(coseAlg)].(int64)
+	crv, _ := params[int64(coseCrv)].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == AlgES256 && crv == coseCrvP256:
+		x, _ := params[int64(coseX)].([]byte)
+		y, _ := params[int64(coseY)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			break
+		}
+		// crypto/ecdh rejects points which are not on the curve.
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			break
+		}
+		return publicKey{alg, &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}}, nil
+	case kty == coseKtyOKP && alg == AlgEdDSA && crv == coseCrvEd25519:
+		x, _ := params[int64(coseX)].([]byte)
+		if len(x) != ed25519.PublicKeySize {
+			break
+		}
+		return publicKey{alg, ed25519.PublicKey(x)}, nil
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, _ := params[int64(coseN)].([]byte)
+		e, _ := params[int64(coseE)].([]byte)
+		if len(e) == 0 || len(e) > 4 {
+			break
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < MinRSABits || key.E < 3 || key.E%2 == 0 {
+			break
+		}
+		return publicKey{alg, key}, nil
+	}
+	return publicKey{}, fmt.Errorf("%w: key type %d, algorithm %d", ErrUnsupportedKey, kty, alg)
+}
@@ -0,0 +1,127 @@
+package webauthn
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestNewRelyingParty(t *testing.T) {
+	rp, err := NewRelyingParty("https://tracker.example.com:8443/path")
+	if err != nil {
+		t.Fatalf("error parsing public URL: %v", err)
+	}
+	if rp.ID != "tracker.example.com" || rp.Origin != "https://tracker.example.com:8443" {
+		t.Errorf("unexpected relying party %+v", rp)
+	}
+	if _, err := NewRelyingParty("tracker.example.com"); err == nil {
+		t.Errorf("expected error for a public URL without a scheme")
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	rp := RelyingParty{ID: "tracker.example.com", Origin: "https://tracker.example.com"}
+
+	for _, eddsa := range []bool{false, true} {
+		a := testutils.NewAuthenticator(eddsa)
+
+		challenge, err := NewChallenge()
+		if err != nil {
+			t.Fatalf("error generating challenge: %v", err)
+		}
+		clientData, attestation := a.Register(rp.ID, rp.Origin, challenge)
+		if received, err := Challenge(clientData); err != nil || received != challenge {
+			t.Errorf("expected challenge %s, got %s: %v", challenge, received, err)
+		}
+		credential, err := rp.VerifyRegistration(challenge, clientData, attestation)
+		if err != nil {
+			t.Fatalf("eddsa %v: error verifying registration: %v", eddsa, err)
+		}
+		if string(credential.ID) != string(a.ID) || credential.SignCount != 0 {
+			t.Errorf("unexpected credential %+v", credential)
+		}
+
+		if _, err := rp.VerifyRegistration("other", clientData, attestation); !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("expected a registration with another challenge to be invalid, got %v", err)
+		}
+		clientData, attestation = a.Register(rp.ID, "https://evil.example.com", challenge)
+		if _, err := rp.VerifyRegistration(challenge, clientData, attestation); !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("expected a registration from another origin to be invalid, got %v", err)
+		}
+		clientData, attestation = a.Register("evil.example.com", rp.Origin, challenge)
+		if _, err := rp.VerifyRegistration(challenge, clientData, attestation); !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("expected a registration for another site to be invalid, got %v", err)
+		}
+
+		clientData, authData, signature := a.Login(rp.ID, rp.Origin, challenge)
+		count, err := rp.VerifyLogin(challenge, credential, clientData, authData, signature)
+		if err != nil {
+			t.Fatalf("eddsa %v: error verifying login: %v", eddsa, err)
+		}
+		if count != 1 {
+			t.Errorf("expected sign count 1, got %d", count)
+		}
+		credential.SignCount = count
+
+		signature[len(signature)-1] ^= 1
+		if _, err := rp.VerifyLogin(challenge, credential, clientData, authData, signature); !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("expected a login with a bad signature to be invalid, got %v", err)
+		}
+		if _, err := rp.VerifyLogin(challenge, credential, clientData, authData, nil); !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("expected a login without a signature to be invalid, got %v", err)
+		}
+
+		// A cloned authenticator does not increase the counter.
+		a.SignCount = 0
+		clientData, authData, signature = a.Login(rp.ID, rp.Origin, challenge)
+		if _, err := rp.VerifyLogin(challenge, credential, clientData, authData, signature); !errors.Is(err, ErrSignCount) {
+			t.Errorf("expected a login without a higher counter to fail, got %v", err)
+		}
+	}
+}
+
+func TestUserVerificationRequired(t *testing.T) {
+	rp := RelyingParty{ID: "tracker.example.com", Origin: "https://tracker.example.com"}
+	a := testutils.NewAuthenticator(false)
+	a.Flags = testutils.PasskeyUserPresent
+
+	clientData, attestation := a.Register(rp.ID, rp.Origin, "challenge")
+	if _, err := rp.VerifyRegistration("challenge", clientData, attestation); !errors.Is(err, ErrInvalidResponse) {
+		t.Errorf("expected a registration without user verification to be invalid, got %v", err)
+	}
+}
+
+func TestUnsupportedKey(t *testing.T) {
+	key := testutils.EncodeCBOR(map[any]any{coseKty: coseKtyEC2, coseAlg: -35, coseCrv: 2})
+	if _, err := parsePublicKey(key); !errors.Is(err, ErrUnsupportedKey) {
+		t.Errorf("expected ES384 to be unsupported, got %v", err)
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	data := []struct {
+		input []byte
+		ok    bool
+	}{
+		{testutils.EncodeCBOR(map[any]any{1: -2, "a": []byte("b")}), true},
+		{[]byte{0x5a, 0xff, 0xff, 0xff, 0xff}, false},
+		{[]byte{0x9f}, false},
+		{[]byte{0xa2, 0x01, 0x01, 0x01, 0x02}, false},
+		{[]byte{0xc0, 0x01}, false},
+	}
+	for _, d := range data {
+		_, _, err := decodeCBOR(d.input)
+		if (err == nil) != d.ok {
+			t.Errorf("%x: expected ok %v, got %v", d.input, d.ok, err)
+		}
+	}
+
+	nested := make([]byte, maxDepth+2)
+	for i := range nested {
+		nested[i] = 0x81
+	}
+	if _, _, err := decodeCBOR(nested); err == nil {
+		t.Errorf("expected error for deeply nested arrays")
+	}
+}
@@ -0,0 +1,516 @@
+// Package wss implements the WebTorrent tracker protocol, which lets browser
+// peers join swarms over WebSocket. Browsers cannot accept connections, so
+// instead of addresses the tracker relays WebRTC offers and answers between
+// the browser peers connected to it.
+//
+// Announces are checked and recorded like HTTP announces, in the same
+// tables, so browser peers count towards swarm statistics and the peering
+// algorithm decides how many offers each announce may send. Browser peers
+// are marked as WebRTC, and are never given to HTTP clients, which could not
+// connect to them.
+package wss
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/config"
+	"github.com/dmoerner/etracker/internal/db"
+	"github.com/dmoerner/etracker/internal/handler"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// Interval is the announce interval given to browser peers. It is
+	// shorter than the HTTP interval, since offers are only relayed on
+	// announce.
+	Interval = 120
+
+	// IdleTimeout closes connections which have sent nothing for two
+	// intervals.
+	IdleTimeout  = 2 * Interval * time.Second
+	WriteTimeout = 10 * time.Second
+
+	// MaxOffers bounds the offers relayed for one announce.
+	MaxOffers = 20
+
+	// MaxMessageSize bounds messages from peers, which carry an SDP
+	// description for each offer.
+	MaxMessageSize = 256 << 10
+)
+
+// request is a message from a browser peer. Infohashes and peer ids are
+// binary strings, with one character per byte.
+type request struct {
+	Action     string          `json:"action"`
+	Info_hash  json.RawMessage `json:"info_hash"`
+	Peer_id    string          `json:"peer_id"`
+	Numwant    *int            `json:"numwant"`
+	Uploaded   int             `json:"uploaded"`
+	Downloaded int             `json:"downloaded"`
+	Left       *int            `json:"left"`
+	Event      string          `json:"event"`
+	Offers     []offer         `json:"offers"`
+	To_peer_id string          `json:"to_peer_id"`
+	Answer     json.RawMessage `json:"answer"`
+	Offer_id   string          `json:"offer_id"`
+}
+
+type offer struct {
+	Offer    json.RawMessage `json:"offer"`
+	Offer_id string          `json:"offer_id"`
+}
+
+type announceReply struct {
+	Action     string `json:"action"`
+	Info_hash  string `json:"info_hash"`
+	Interval   int    `json:"interval"`
+	Complete   int    `json:"complete"`
+	Incomplete int    `json:"incomplete"`
+}
+
+// relay is an offer or answer forwarded from one peer to another.
+type relay struct {
+	Action    string          `json:"action"`
+	Info_hash string          `json:"info_hash"`
+	Peer_id   string          `json:"peer_id"`
+	Offer     json.RawMessage `json:"offer,omitempty"`
+	Answer    json.RawMessage `json:"answer,omitempty"`
+	Offer_id  string          `json:"offer_id"`
+}
+
+type File struct {
+	Complete   int `json:"complete"`
+	Downloaded int `json:"downloaded"`
+	Incomplete int `json:"incomplete"`
+}
+
+type scrapeReply struct {
+	Action string          `json:"action"`
+	Files  map[string]File `json:"files"`
+}
+
+type failure struct {
+	Action         string `json:"action,omitempty"`
+	Info_hash      string `json:"info_hash,omitempty"`
+	Failure_reason string `json:"failure reason"`
+}
+
+// binaryString converts a binary string, as sent by browser peers, into
+// bytes. It fails if any character is outside one byte.
+func binaryString(s string) ([]byte, bool) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return nil, false
+		}
+		b = append(b, byte(r))
+	}
+	return b, true
+}
+
+// client is a connected browser peer. A client may announce for several
+// infohashes, with a peer id for each.
+type client struct {
+	ws           *websocket.Conn
+	announce_key string
+	ip_port      []byte
+
+	mu     sync.Mutex
+	joined map[string]string
+}
+
+// send writes a message to the client. Relays from other connections may
+// send concurrently, so writes are serialized. Errors are not reported,
+// since the read loop notices a broken connection.
+func (c *client) send(v any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	_ = websocket.JSON.Send(c.ws, v)
+}
+
+// swarms indexes the connected clients by infohash and peer id.
+type swarms struct {
+	mu    sync.Mutex
+	peers map[string]map[string]*client
+}
+
+func (s *swarms) join(info_hash, peer_id string, c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers[info_hash] == nil {
+		s.peers[info_hash] = make(map[string]*client)
+	}
+	s.peers[info_hash][peer_id] = c
+
+	c.mu.Lock()
+	c.joined[info_hash] = peer_id
+	c.mu.Unlock()
+}
+
+func (s *swarms) leave(info_hash, peer_id string, c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers[info_hash][peer_id] == c {
+		delete(s.peers[info_hash], peer_id)
+		if len(s.peers[info_hash]) == 0 {
+			delete(s.peers, info_hash)
+		}
+	}
+}
+
+// leaveAll removes a disconnected client from every swarm it joined.
+func (s *swarms) leaveAll(c *client) {
+	c.mu.Lock()
+	joined := c.joined
+	c.joined = nil
+	c.mu.Unlock()
+
+	for info_hash, peer_id := range joined {
+		s.leave(info_hash, peer_id, c)
+	}
+}
+
+func (s *swarms) get(info_hash, peer_id string) *client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peers[info_hash][peer_id]
+}
+
+// sample returns up to n clients in a swarm other than c, chosen at random.
+func (s *swarms) sample(info_hash string, c *client, n int) []*client {
+	s.mu.Lock()
+	var others []*client
+	for _, other := range s.peers[info_hash] {
+		if other != c {
+			others = append(others, other)
+		}
+	}
+	s.mu.Unlock()
+
+	rand.Shuffle(len(others), func(i, j int) {
+		others[i], others[j] = others[j], others[i]
+	})
+	return others[:min(n, len(others))]
+}
+
+// swarmCounts returns the seeders, leechers, and completed downloads of each
+// infohash, keyed by infohash. If PrivateScrape is configured, only
+// infohashes the announce key has announced are counted.
+func swarmCounts(ctx context.Context, conf config.Config, announce_key string, info_hashes [][]byte) (map[string]File, error) {
+	query := `
+		WITH ` + db.RecentAnnounces(1, 2, "amount_left") + `
+		SELECT
+		    info_hash,
+		    downloaded,
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left = 0) AS seeders,
+		    COUNT(*) FILTER (WHERE recent_announces.amount_left > 0) AS leechers
+		FROM
+		    infohashes
+		    LEFT JOIN recent_announces ON infohashes.id = recent_announces.info_hash_id
+		WHERE
+		    info_hash = ANY ($3)
+		    AND ($4 = ''
+			OR infohashes.id IN (
+			    SELECT
+				info_hash_id
+			    FROM
+				announces
+				JOIN peers ON announces.peers_id = peers.id
+			    WHERE
+				announce_key = $4))
+		GROUP BY
+		    info_hash,
+		    downloaded
+		`
+
+	var private string
+	if conf.Settings().PrivateScrape {
+		private = announce_key
+	}
+
+	rows, err := conf.Dbpool.Query(ctx, query, config.Stopped, conf.StaleCutoff(), info_hashes, private)
+	if err != nil {
+		return nil, fmt.Errorf("error counting swarm: %w", err)
+	}
+
+	counts := make(map[string]File)
+	var info_hash []byte
+	var f File
+	_, err = pgx.ForEachRow(rows, []any{&info_hash, &f.Downloaded, &f.Complete, &f.Incomplete}, func() error {
+		counts[string(info_hash)] = f
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error counting swarm: %w", err)
+	}
+
+	return counts, nil
+}
+
+type tracker struct {
+	ctx    context.Context
+	conf   config.Config
+	swarms swarms
+}
+
+// Handler returns the WebSocket endpoint for browser peers, served under
+// an announce key like HTTP announces. Any origin is accepted, since
+// WebTorrent clients run on other sites.
+func Handler(ctx context.Context, conf config.Config) http.Handler {
+	t := &tracker{
+		ctx:    ctx,
+		conf:   conf,
+		swarms: swarms{peers: make(map[string]map[string]*client)},
+	}
+
+	return websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   t.serve,
+	}
+}
+
+func (t *tracker) serve(ws *websocket.Conn) {
+	ws.MaxPayloadBytes = MaxMessageSize
+
+	r := ws.Request()
+	c := &client{
+		ws:           ws,
+		announce_key: r.PathValue("id"),
+		joined:       make(map[string]string),
+	}
+	// Browser peers have no port to reach them at.
+	if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		c.ip_port = append(addr.Addr().Unmap().AsSlice(), 0, 0)
+	}
+	defer t.swarms.leaveAll(c)
+
+	for {
+		_ = ws.SetReadDeadline(time.Now().Add(IdleTimeout))
+		var msg request
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+
+		switch msg.Action {
+		case "announce":
+			t.announce(c, &msg)
+		case "scrape":
+			t.scrape(c, &msg)
+		default:
+			c.send(failure{Failure_reason: "invalid action"})
+		}
+	}
+}
+
+func (t *tracker) announce(c *client, msg *request) {
+	var info_hash_string string
+	if err := json.Unmarshal(msg.Info_hash, &info_hash_string); err != nil {
+		c.send(failure{Action: "announce", Failure_reason: "invalid info_hash"})
+		return
+	}
+	fail := func(reason string) {
+		c.send(failure{Action: "announce", Info_hash: info_hash_string, Failure_reason: reason})
+	}
+
+	info_hash, ok := binaryString(info_hash_string)
+	if !ok || len(info_hash) != 20 {
+		fail("invalid info_hash")
+		return
+	}
+	peer_id, ok := binaryString(msg.Peer_id)
+	if !ok || len(peer_id) != 20 {
+		fail("invalid peer_id")
+		return
+	}
+
+	// Answers are relayed to the peer which made the offer, and are not
+	// announces.
+	if msg.Answer != nil {
+		if to := t.swarms.get(string(info_hash), msg.To_peer_id); to != nil {
+			to.send(relay{
+				Action:    "announce",
+				Info_hash: info_hash_string,
+				Peer_id:   msg.Peer_id,
+				Answer:    msg.Answer,
+				Offer_id:  msg.Offer_id,
+			})
+		}
+		return
+	}
+
+	if c.ip_port == nil {
+		fail(handler.DefaultTrackerError)
+		return
+	}
+
+	enabled, _, err := handler.Maintenance(t.ctx, t.conf)
+	if err != nil {
+		log.Print(err)
+	}
+	if enabled {
+		fail("tracker under maintenance")
+		return
+	}
+
+	announce := &config.Announce{
+		Announce_key: c.announce_key,
+		Peer_id:      peer_id,
+		Ip_port:      c.ip_port,
+		Remote_ip:    c.ip_port[:len(c.ip_port)-2],
+		Info_hash:    info_hash,
+		Numwant:      len(msg.Offers),
+		Downloaded:   msg.Downloaded,
+		Uploaded:     msg.Uploaded,
+		Compact:      true,
+		Webrtc:       true,
+	}
+	if msg.Numwant != nil {
+		announce.Numwant = min(max(*msg.Numwant, 0), len(msg.Offers))
+	}
+	announce.Numwant = min(announce.Numwant, MaxOffers)
+	// Clients which do not yet have the metadata send no amount left, and
+	// are counted as leechers.
+	announce.Amount_left = 1
+	if msg.Left != nil {
+		announce.Amount_left = max(*msg.Left, 0)
+	}
+	switch msg.Event {
+	case "started":
+		announce.Event = config.Started
+	case "stopped":
+		announce.Event = config.Stopped
+	case "completed":
+		announce.Event = config.Completed
+	}
+
+	err = handler.RecordAnnounce(t.ctx, t.conf, announce)
+	if err != nil {
+		switch {
+		case errors.Is(err, handler.ErrInfoHashNotAllowed):
+			fail("info_hash not in the allowed list")
+		case errors.Is(err, handler.ErrInfoHashRetired):
+			fail(handler.RetiredFailure)
+		case errors.Is(err, handler.ErrUntrackedAnnounce):
+			fail("untracked announce key, generate new announce url")
+		case errors.Is(err, handler.ErrKeyExpired):
+			fail("announce key expired, generate new announce url")
+		case errors.Is(err, handler.ErrUnverifiedKey):
+			fail(handler.UnverifiedFailure)
+		case errors.Is(err, handler.ErrRestricted):
+			fail("access to this torrent is restricted")
+		default:
+			log.Printf("Error recording WebSocket announce: %v", err)
+			fail(handler.DefaultTrackerError)
+		}
+		return
+	}
+
+	counts, err := swarmCounts(t.ctx, t.conf, c.announce_key, [][]byte{info_hash})
+	if err != nil {
+		log.Print(err)
+	}
+	f := counts[string(info_hash)]
+	c.send(announceReply{
+		Action:     "announce",
+		Info_hash:  info_hash_string,
+		Interval:   Interval,
+		Complete:   f.Complete,
+		Incomplete: f.Incomplete,
+	})
+
+	if announce.Event == config.Stopped {
+		t.swarms.leave(string(info_hash), msg.Peer_id, c)
+		return
+	}
+	t.swarms.join(string(info_hash), msg.Peer_id, c)
+
+	if announce.Numwant == 0 {
+		return
+	}
+	numToGive, err := t.conf.Settings().Algorithm(t.ctx, t.conf, announce)
+	if err != nil {
+		log.Printf("Error calculating number of offers to relay: %v", err)
+		return
+	}
+	for i, to := range t.swarms.sample(string(info_hash), c, min(numToGive, announce.Numwant)) {
+		to.send(relay{
+			Action:    "announce",
+			Info_hash: info_hash_string,
+			Peer_id:   msg.Peer_id,
+			Offer:     msg.Offers[i].Offer,
+			Offer_id:  msg.Offers[i].Offer_id,
+		})
+	}
+}
+
+// scrape replies with the counts of one or more infohashes, leaving out
+// those restricted to other keys. Unlike HTTP scrapes, a scrape without
+// infohashes is answered with no files.
+func (t *tracker) scrape(c *client, msg *request) {
+	var info_hash_strings []string
+	if err := json.Unmarshal(msg.Info_hash, &info_hash_strings); err != nil {
+		var info_hash_string string
+		if err := json.Unmarshal(msg.Info_hash, &info_hash_string); err != nil {
+			c.send(failure{Action: "scrape", Failure_reason: "invalid info_hash"})
+			return
+		}
+		info_hash_strings = []string{info_hash_string}
+	}
+
+	tracked, err := handler.KeyTracked(t.ctx, t.conf, c.announce_key)
+	if err != nil {
+		log.Printf("Error validating announce key for scrape: %v", err)
+		c.send(failure{Action: "scrape", Failure_reason: "error validating announce key"})
+		return
+	}
+	if !tracked {
+		c.send(failure{Action: "scrape", Failure_reason: "untracked announce key, generate new announce url"})
+		return
+	}
+
+	var info_hashes [][]byte
+	for _, s := range info_hash_strings {
+		if info_hash, ok := binaryString(s); ok {
+			info_hashes = append(info_hashes, info_hash)
+		}
+	}
+
+	counts, err := swarmCounts(t.ctx, t.conf, c.announce_key, info_hashes)
+	if err != nil {
+		log.Print(err)
+		c.send(failure{Action: "scrape", Failure_reason: "error fetching data for scrape"})
+		return
+	}
+
+	files := make(map[string]File)
+	for _, s := range info_hash_strings {
+		info_hash, _ := binaryString(s)
+		f, ok := counts[string(info_hash)]
+		if !ok {
+			continue
+		}
+		err := handler.CheckACL(t.ctx, t.conf, c.announce_key, info_hash)
+		if errors.Is(err, handler.ErrRestricted) {
+			continue
+		}
+		if err != nil {
+			log.Print(err)
+			c.send(failure{Action: "scrape", Failure_reason: "error fetching data for scrape"})
+			return
+		}
+		files[s] = f
+	}
+	c.send(scrapeReply{Action: "scrape", Files: files})
+}
@@ -0,0 +1,121 @@
+package wss
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/testutils"
+	"golang.org/x/net/websocket"
+)
+
+func TestBinaryString(t *testing.T) {
+	received, ok := binaryString("\x00aÿ")
+	if !ok || !bytes.Equal(received, []byte{0x00, 'a', 0xff}) {
+		t.Errorf("expected bytes 00 61 ff, got %x", received)
+	}
+
+	if _, ok := binaryString("Ā"); ok {
+		t.Errorf("expected characters above one byte to fail")
+	}
+}
+
+// dial connects a browser peer for an announce key to the test server.
+func dial(t *testing.T, server *httptest.Server, announce_key string) *websocket.Conn {
+	t.Helper()
+
+	url := strings.Replace(server.URL, "http", "ws", 1) + "/" + announce_key + "/webtorrent"
+	ws, err := websocket.Dial(url, "", "http://example.com")
+	if err != nil {
+		t.Fatalf("error connecting to tracker: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	return ws
+}
+
+func receive(t *testing.T, ws *websocket.Conn) map[string]any {
+	t.Helper()
+
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg map[string]any
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatalf("error receiving message: %v", err)
+	}
+
+	return msg
+}
+
+func TestWebTorrent(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /{id}/webtorrent", Handler(ctx, conf))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	info_hash := testutils.AllowedInfoHashes["a"]
+	seederID := "-WW0100-aaaaaaaaaaaa"
+	leecherID := "-WW0100-bbbbbbbbbbbb"
+	sdp := json.RawMessage(`{"type":"offer","sdp":"v=0"}`)
+
+	seeder := dial(t, server, testutils.AnnounceKeys[1])
+	leecher := dial(t, server, testutils.AnnounceKeys[2])
+
+	_ = websocket.JSON.Send(seeder, map[string]any{
+		"action": "announce", "info_hash": info_hash, "peer_id": seederID, "left": 0, "event": "started", "offers": []any{},
+	})
+	if reply := receive(t, seeder); reply["complete"] != 1.0 || reply["failure reason"] != nil {
+		t.Fatalf("expected one seeder, got %v", reply)
+	}
+
+	// The leecher's offer is relayed to the seeder.
+	_ = websocket.JSON.Send(leecher, map[string]any{
+		"action": "announce", "info_hash": info_hash, "peer_id": leecherID, "left": 100, "numwant": 5,
+		"offers": []any{map[string]any{"offer": sdp, "offer_id": "offer-1"}},
+	})
+	if reply := receive(t, leecher); reply["complete"] != 1.0 || reply["incomplete"] != 1.0 {
+		t.Errorf("expected one seeder and one leecher, got %v", reply)
+	}
+	relayed := receive(t, seeder)
+	if relayed["peer_id"] != leecherID || relayed["offer_id"] != "offer-1" || relayed["offer"] == nil {
+		t.Fatalf("expected offer from leecher, got %v", relayed)
+	}
+
+	// The seeder's answer is relayed back to the leecher.
+	_ = websocket.JSON.Send(seeder, map[string]any{
+		"action": "announce", "info_hash": info_hash, "peer_id": seederID, "to_peer_id": leecherID,
+		"offer_id": "offer-1", "answer": map[string]any{"type": "answer", "sdp": "v=0"},
+	})
+	if answer := receive(t, leecher); answer["peer_id"] != seederID || answer["answer"] == nil {
+		t.Errorf("expected answer from seeder, got %v", answer)
+	}
+
+	// Browser peers are never given to HTTP clients.
+	w := httptest.NewRecorder()
+	handler.PeerHandler(ctx, conf)(w, testutils.CreateTestAnnounce(testutils.Request{
+		AnnounceKey: testutils.AnnounceKeys[3],
+		Info_hash:   info_hash,
+		Port:        6881,
+		Numwant:     50,
+		Left:        1,
+	}))
+	if body := w.Body.String(); !strings.Contains(body, "5:peers0:") {
+		t.Errorf("expected no peers for HTTP client, got %q", body)
+	}
+
+	_ = websocket.JSON.Send(leecher, map[string]any{"action": "scrape", "info_hash": []string{info_hash}})
+	scrape := receive(t, leecher)
+	files, _ := scrape["files"].(map[string]any)
+	if file, _ := files[info_hash].(map[string]any); file["complete"] != 1.0 || file["incomplete"] != 1.0 {
+		t.Errorf("expected scrape of one seeder and one leecher, got %v", scrape)
+	}
+}
@@ -0,0 +1,1466 @@
+// Package client is a Go client for the etracker REST API, covering both the
+// public frontend endpoints and the restricted admin endpoints:
+//
+//	c := client.New("https://tracker.example.com", client.WithAPIKey(key))
+//	err := c.AddInfohash(ctx, infoHash, "debian.iso")
+//
+// Idempotent requests are retried on network errors, server errors, and
+// quota responses, honoring Retry-After.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/api"
+	"github.com/dmoerner/etracker/internal/debuglog"
+)
+
+// Response types, shared with the server.
+type (
+	GlobalStats    = api.GlobalStats
+	CountryStats   = api.CountryStats
+	AsnStats       = api.AsnStats
+	InfohashStats  = api.InfohashStats
+	KeyUsage       = api.KeyUsage
+	KeyPage        = api.KeyPage
+	KeyStats       = api.KeyStats
+	Challenge      = api.Challenge
+	Wanted         = api.WantedInfohash
+	Maintenance    = api.MaintenanceStatus
+	Algorithm      = api.AlgorithmStatus
+	ReadOnly       = api.ReadOnlyStatus
+	Decision       = debuglog.Decision
+	Runtime        = api.RuntimeStatus
+	Catalog        = api.Catalog
+	CatalogEntry   = api.CatalogEntry
+	Indexer        = api.Indexer
+	Profile        = api.Profile
+	Achievement    = api.Achievement
+	Ban            = api.Ban
+	BanList        = api.BanList
+	Promotion      = api.Promotion
+	Agent          = api.Agent
+	PeerHealth     = api.PeerHealth
+	NewInfohashes  = api.NewInfohashes
+	ClientCert     = api.ClientCert
+	TorrentInfo    = api.TorrentMetadata
+	UserSession    = api.UserSession
+	UserStats      = api.UserStats
+	ACLEntry       = api.ACLEntry
+	UserGroup      = api.UserGroup
+	Invite         = api.Invite
+	UserTier       = api.UserTier
+	TierList       = api.TierList
+	RotationStatus = api.RotationStatus
+	FeatureFlags   = api.FeatureFlags
+	Snatch         = api.Snatch
+	StatsPoint     = api.StatsHistoryPoint
+	TrafficPoint   = api.TrafficPoint
+	Passkey        = api.Passkey
+	InfohashPost   = api.InfohashPost
+	BulkImport     = api.BulkImport
+	InfohashExport = api.InfohashExport
+	TorrentUpload  = api.TorrentUpload
+)
+
+const (
+	DefaultRetries = 3
+	DefaultBackoff = 500 * time.Millisecond
+
+	// MaxRetryAfter caps how long a retry will wait on Retry-After.
+	MaxRetryAfter = time.Minute
+)
+
+// Error is returned for any response with a non-2xx status.
+type Error struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is set from the Retry-After header of quota responses.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("etracker: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client is a client for a single tracker. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	retries    int
+	backoff    time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAPIKey sets the API key sent with restricted requests.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// WithHTTPClient sets the underlying HTTP client. The default is
+// http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithRetries sets how many times an idempotent request is retried, and the
+// initial backoff between attempts, which doubles on each retry.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// New returns a Client for the tracker at baseURL, for example
+// "https://tracker.example.com".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retries:    DefaultRetries,
+		backoff:    DefaultBackoff,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// request describes a single API call. The body is kept as bytes so that it
+// can be resent on retries.
+type request struct {
+	method      string
+	path        string
+	query       url.Values
+	body        []byte
+	contentType string
+	restricted  bool
+	idempotent  bool
+	// token is the session token sent with requests on behalf of a user.
+	token string
+}
+
+// retryable reports whether a failed attempt should be retried.
+func retryable(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// do performs a request, retrying idempotent requests, and returns the body
+// of a successful response.
+func (c *Client) do(ctx context.Context, req request) ([]byte, error) {
+	attempts := 1
+	if req.idempotent {
+		attempts += c.retries
+	}
+
+	backoff := c.backoff
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			wait := backoff
+			backoff *= 2
+
+			var apiErr *Error
+			if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+				wait = min(apiErr.RetryAfter, MaxRetryAfter)
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		var body []byte
+		body, err = c.attempt(ctx, req)
+		if err == nil {
+			return body, nil
+		}
+		if ctx.Err() != nil || !retryable(err) {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+// attempt performs a single HTTP request.
+func (c *Client) attempt(ctx context.Context, req request) ([]byte, error) {
+	u := c.baseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, body)
+	if err != nil {
+		return nil, fmt.Errorf("etracker: unable to build request: %w", err)
+	}
+	if req.contentType != "" {
+		httpReq.Header.Set("Content-Type", req.contentType)
+	}
+	if req.restricted {
+		httpReq.Header.Set("Authorization", c.apiKey)
+	}
+	if req.token != "" {
+		httpReq.Header.Set("Authorization", req.token)
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("etracker: request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("etracker: unable to read response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+
+		var msg api.MessageJSON
+		if json.Unmarshal(respBody, &msg) == nil && msg.Message != "" {
+			apiErr.Message = msg.Message
+		} else {
+			apiErr.Message = strings.TrimSpace(string(respBody))
+		}
+
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+
+		return nil, apiErr
+	}
+
+	return respBody, nil
+}
+
+// getJSON performs an idempotent GET and decodes the JSON response.
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, restricted bool, v any) error {
+	body, err := c.do(ctx, request{method: "GET", path: path, query: query, restricted: restricted, idempotent: true})
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+
+	return nil
+}
+
+// Stats returns the total tracked infohashes, seeders, and leechers.
+func (c *Client) Stats(ctx context.Context) (*GlobalStats, error) {
+	var stats GlobalStats
+	if err := c.getJSON(ctx, "/api/stats", nil, false, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// StatsHistory returns the global statistics over a range such as "24h" or
+// "30d", oldest first, hourly for up to a week and daily beyond. An empty
+// range is a week.
+func (c *Client) StatsHistory(ctx context.Context, historyRange string) ([]StatsPoint, error) {
+	var query url.Values
+	if historyRange != "" {
+		query = url.Values{"range": {historyRange}}
+	}
+
+	var points []StatsPoint
+	if err := c.getJSON(ctx, "/api/stats/history", query, false, &points); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// CountryStats returns aggregate swarm statistics per country.
+func (c *Client) CountryStats(ctx context.Context) ([]CountryStats, error) {
+	var stats []CountryStats
+	if err := c.getJSON(ctx, "/api/stats/countries", nil, false, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// AsnStats returns aggregate swarm statistics per autonomous system.
+func (c *Client) AsnStats(ctx context.Context) ([]AsnStats, error) {
+	var stats []AsnStats
+	if err := c.getJSON(ctx, "/api/stats/asns", nil, false, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Infohashes returns every tracked infohash with its swarm statistics.
+func (c *Client) Infohashes(ctx context.Context) ([]InfohashStats, error) {
+	var infohashes []InfohashStats
+	if err := c.getJSON(ctx, "/api/infohashes", nil, false, &infohashes); err != nil {
+		return nil, err
+	}
+	return infohashes, nil
+}
+
+// Challenge fetches a proof-of-work challenge for key generation. It
+// returns nil if the tracker does not require proof of work.
+func (c *Client) Challenge(ctx context.Context) (*Challenge, error) {
+	var challenge Challenge
+	err := c.getJSON(ctx, "/api/challenge", nil, false, &challenge)
+	if err != nil {
+		var apiErr *Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// GenerateKey generates a new announce key. If the tracker requires proof of
+// work, a challenge is fetched and solved first. Captcha is the CAPTCHA
+// token, and is only needed if the tracker requires one. Key generation is
+// never retried, since each attempt may create a key.
+func (c *Client) GenerateKey(ctx context.Context, captcha string) (string, error) {
+	return c.GenerateUserKey(ctx, "", captcha)
+}
+
+// GenerateUserKey is GenerateKey for a key owned by the user logged in with
+// the session token, or by no one if the token is empty.
+func (c *Client) GenerateUserKey(ctx context.Context, token string, captcha string) (string, error) {
+	return c.GenerateInvitedKey(ctx, token, captcha, "")
+}
+
+// GenerateInvitedKey is GenerateUserKey with an invite code, which is only
+// needed if the tracker requires invites. The invite is used up by a
+// successful attempt.
+func (c *Client) GenerateInvitedKey(ctx context.Context, token string, captcha string, invite string) (string, error) {
+	query := url.Values{}
+	if captcha != "" {
+		query.Set("captcha", captcha)
+	}
+	if invite != "" {
+		query.Set("invite", invite)
+	}
+
+	challenge, err := c.Challenge(ctx)
+	if err != nil {
+		return "", err
+	}
+	if challenge != nil {
+		query.Set("challenge", challenge.Challenge)
+		query.Set("nonce", api.SolveChallenge(*challenge))
+	}
+
+	body, err := c.do(ctx, request{method: "GET", path: "/api/generate", query: query, token: token})
+	if err != nil {
+		return "", err
+	}
+
+	var key api.Key
+	if err = json.Unmarshal(body, &key); err != nil {
+		return "", fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+
+	return key.Announce_key, nil
+}
+
+// Register creates a user and returns a session for them. It is not
+// retried, since the username may already have been taken by an earlier
+// attempt.
+func (c *Client) Register(ctx context.Context, username, password string) (*UserSession, error) {
+	return c.postCredentials(ctx, "/api/user/register", username, password)
+}
+
+// Login returns a new session for a user.
+func (c *Client) Login(ctx context.Context, username, password string) (*UserSession, error) {
+	return c.postCredentials(ctx, "/api/user/login", username, password)
+}
+
+func (c *Client) postCredentials(ctx context.Context, path, username, password string) (*UserSession, error) {
+	body, err := json.Marshal(api.UserCredentials{Username: username, Password: password})
+	if err != nil {
+		return nil, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	respBody, err := c.do(ctx, request{method: "POST", path: path, body: body, contentType: "application/json"})
+	if err != nil {
+		return nil, err
+	}
+
+	var session UserSession
+	if err = json.Unmarshal(respBody, &session); err != nil {
+		return nil, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return &session, nil
+}
+
+// Logout ends the session with the token.
+func (c *Client) Logout(ctx context.Context, token string) error {
+	_, err := c.do(ctx, request{method: "POST", path: "/api/user/logout", token: token, idempotent: true})
+	return err
+}
+
+// UserStats returns the announce keys and aggregate statistics of the user
+// logged in with the session token.
+func (c *Client) UserStats(ctx context.Context, token string) (*UserStats, error) {
+	body, err := c.do(ctx, request{method: "GET", path: "/api/user/stats", token: token, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var stats UserStats
+	if err = json.Unmarshal(body, &stats); err != nil {
+		return nil, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return &stats, nil
+}
+
+// UserTraffic returns the upload and download of the user logged in with
+// the session token over a range such as "24h" or "30d", oldest first,
+// hourly for up to a week and daily beyond. An empty range is a week.
+func (c *Client) UserTraffic(ctx context.Context, token string, trafficRange string) ([]TrafficPoint, error) {
+	var query url.Values
+	if trafficRange != "" {
+		query = url.Values{"range": {trafficRange}}
+	}
+	body, err := c.do(ctx, request{method: "GET", path: "/api/user/traffic", query: query, token: token, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var points []TrafficPoint
+	if err = json.Unmarshal(body, &points); err != nil {
+		return nil, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return points, nil
+}
+
+// Passkeys lists the passkeys of the user logged in with the session token,
+// oldest first. Passkeys are registered and used from a browser.
+func (c *Client) Passkeys(ctx context.Context, token string) ([]Passkey, error) {
+	body, err := c.do(ctx, request{method: "GET", path: "/api/user/passkeys", token: token, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var passkeys []Passkey
+	if err = json.Unmarshal(body, &passkeys); err != nil {
+		return nil, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return passkeys, nil
+}
+
+// DeletePasskey removes a passkey of the user logged in with the session
+// token.
+func (c *Client) DeletePasskey(ctx context.Context, token string, id int) error {
+	_, err := c.do(ctx, request{method: "DELETE", path: "/api/user/passkeys/" + strconv.Itoa(id), token: token, idempotent: true})
+	return err
+}
+
+// TorrentFile downloads the stored torrent file for infoHash, with the
+// announce URL for announceKey.
+func (c *Client) TorrentFile(ctx context.Context, announceKey string, infoHash []byte) ([]byte, error) {
+	query := url.Values{}
+	query.Set("announce_key", announceKey)
+	query.Set("info_hash", hex.EncodeToString(infoHash))
+
+	return c.do(ctx, request{method: "GET", path: "/api/torrentfile", query: query, idempotent: true})
+}
+
+// TorrentInfo fetches the metadata of the torrent file uploaded for
+// infoHash: its files, piece length, and creation date.
+func (c *Client) TorrentInfo(ctx context.Context, infoHash []byte) (*TorrentInfo, error) {
+	query := url.Values{}
+	query.Set("info_hash", hex.EncodeToString(infoHash))
+
+	var info TorrentInfo
+	if err := c.getJSON(ctx, "/api/torrentinfo", query, false, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Features returns whether each known feature is enabled on the tracker.
+func (c *Client) Features(ctx context.Context) (FeatureFlags, error) {
+	var features FeatureFlags
+	if err := c.getJSON(ctx, "/api/features", nil, false, &features); err != nil {
+		return nil, err
+	}
+	return features, nil
+}
+
+// AnnounceURL returns the complete announce URL for announceKey.
+func (c *Client) AnnounceURL(ctx context.Context, announceKey string) (string, error) {
+	query := url.Values{}
+	query.Set("announce_key", announceKey)
+
+	var result api.AnnounceURL
+	if err := c.getJSON(ctx, "/api/announceurl", query, false, &result); err != nil {
+		return "", err
+	}
+	return result.Announce_url, nil
+}
+
+// AnnounceQR returns the announce URL for announceKey as a QR code PNG,
+// size pixels wide. If size is zero, the tracker's default is used.
+func (c *Client) AnnounceQR(ctx context.Context, announceKey string, size int) ([]byte, error) {
+	query := url.Values{}
+	query.Set("announce_key", announceKey)
+	query.Set("qr", "1")
+	if size > 0 {
+		query.Set("size", strconv.Itoa(size))
+	}
+
+	return c.do(ctx, request{method: "GET", path: "/api/announceurl", query: query, idempotent: true})
+}
+
+// ProfileSettings returns whether the announce key has a public profile,
+// and if so its profile id.
+func (c *Client) ProfileSettings(ctx context.Context, announceKey string) (*api.ProfileSettings, error) {
+	query := url.Values{}
+	query.Set("announce_key", announceKey)
+
+	var settings api.ProfileSettings
+	if err := c.getJSON(ctx, "/api/profile", query, false, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// SetProfilePublic makes the profile of the announce key public or
+// private, and returns the new settings.
+func (c *Client) SetProfilePublic(ctx context.Context, announceKey string, public bool) (*api.ProfileSettings, error) {
+	body, err := json.Marshal(api.ProfileSettings{Public: public})
+	if err != nil {
+		return nil, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	query := url.Values{}
+	query.Set("announce_key", announceKey)
+
+	respBody, err := c.do(ctx, request{method: "PUT", path: "/api/profile", query: query, body: body, contentType: "application/json", idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var settings api.ProfileSettings
+	if err = json.Unmarshal(respBody, &settings); err != nil {
+		return nil, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return &settings, nil
+}
+
+// VerifyKey solves a proof-of-work challenge for an announce key which was
+// not generated with one, so that it may announce for the first time. It
+// does nothing if the tracker does not require proof of work.
+func (c *Client) VerifyKey(ctx context.Context, announceKey string) error {
+	challenge, err := c.Challenge(ctx)
+	if err != nil || challenge == nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("announce_key", announceKey)
+	query.Set("challenge", challenge.Challenge)
+	query.Set("nonce", api.SolveChallenge(*challenge))
+
+	_, err = c.do(ctx, request{method: "POST", path: "/api/verify", query: query})
+	return err
+}
+
+// RotateKey replaces a leaked announce key with a new one, keeping its
+// statistics, and returns the new key. The old key stops working. Token is
+// the session token of the key's owner, and is only needed if a user owns
+// the key. Rotation is never retried, since a retry would fail with the old
+// key.
+func (c *Client) RotateKey(ctx context.Context, announceKey string, token string) (string, error) {
+	query := url.Values{}
+	query.Set("announce_key", announceKey)
+
+	body, err := c.do(ctx, request{method: "POST", path: "/api/rotate", query: query, token: token})
+	if err != nil {
+		return "", err
+	}
+
+	var key api.Key
+	if err = json.Unmarshal(body, &key); err != nil {
+		return "", fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return key.Announce_key, nil
+}
+
+// Profile returns the public profile with the given profile id.
+func (c *Client) Profile(ctx context.Context, profileID string) (*Profile, error) {
+	var profile Profile
+	if err := c.getJSON(ctx, "/api/profiles/"+url.PathEscape(profileID), nil, false, &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// Achievements returns every achievement which can be earned. If
+// announceKey is not empty, the achievements it has earned have their
+// earned time set.
+func (c *Client) Achievements(ctx context.Context, announceKey string) ([]Achievement, error) {
+	query := url.Values{}
+	if announceKey != "" {
+		query.Set("announce_key", announceKey)
+	}
+
+	var all []Achievement
+	if err := c.getJSON(ctx, "/api/achievements", query, false, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// AddInfohash adds an infohash to the allowlist. This is a restricted
+// endpoint.
+func (c *Client) AddInfohash(ctx context.Context, infoHash []byte, name string) error {
+	return c.AddInfohashTagged(ctx, infoHash, name, "", nil)
+}
+
+// AddInfohashTagged adds an infohash to the allowlist under a category,
+// which may be empty, and tags. This is a restricted endpoint.
+func (c *Client) AddInfohashTagged(ctx context.Context, infoHash []byte, name string, category string, tags []string) error {
+	body, err := json.Marshal(api.InfohashPost{Info_hash: infoHash, Name: name, Category: category, Tags: tags})
+	if err != nil {
+		return fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	_, err = c.do(ctx, request{method: "POST", path: "/api/infohash", body: body, contentType: "application/json", restricted: true})
+	return err
+}
+
+// AddTorrent uploads a torrent file, adding its infohash to the allowlist
+// and storing the file for download. This is a restricted endpoint.
+func (c *Client) AddTorrent(ctx context.Context, filename string, torrent io.Reader) error {
+	return c.AddTorrentTagged(ctx, filename, torrent, "", nil)
+}
+
+// AddTorrentTagged uploads a torrent file like AddTorrent, under a
+// category, which may be empty, and tags. This is a restricted endpoint.
+func (c *Client) AddTorrentTagged(ctx context.Context, filename string, torrent io.Reader, category string, tags []string) error {
+	_, err := c.postTorrentFile(ctx, filename, torrent, category, tags)
+	return err
+}
+
+// AddTorrentArchive uploads a zip archive of torrent files, under a
+// category, which may be empty, and tags. The torrent files are added
+// together, and the result of each is returned; those which are invalid or
+// already tracked do not stop the others. This is a restricted endpoint.
+func (c *Client) AddTorrentArchive(ctx context.Context, filename string, archive io.Reader, category string, tags []string) ([]TorrentUpload, error) {
+	data, err := c.postTorrentFile(ctx, filename, archive, category, tags)
+	if err != nil {
+		return nil, err
+	}
+	var results []TorrentUpload
+	if err = json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return results, nil
+}
+
+// postTorrentFile posts a torrent file or zip archive as a multipart form.
+func (c *Client) postTorrentFile(ctx context.Context, filename string, file io.Reader, category string, tags []string) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	if err := mw.WriteField("category", category); err != nil {
+		return nil, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+	if err := mw.WriteField("tags", strings.Join(tags, ",")); err != nil {
+		return nil, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	part, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+	if _, err = io.Copy(part, file); err != nil {
+		return nil, fmt.Errorf("etracker: unable to read torrent file: %w", err)
+	}
+	if err = mw.Close(); err != nil {
+		return nil, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	return c.do(ctx, request{method: "POST", path: "/api/torrentfile", body: body.Bytes(), contentType: mw.FormDataContentType(), restricted: true})
+}
+
+// DeleteInfohash removes an infohash from the allowlist. This is a
+// restricted endpoint.
+func (c *Client) DeleteInfohash(ctx context.Context, infoHash []byte) error {
+	body, err := json.Marshal(api.Infohash{Info_hash: infoHash})
+	if err != nil {
+		return fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	_, err = c.do(ctx, request{method: "DELETE", path: "/api/infohash", body: body, contentType: "application/json", restricted: true, idempotent: true})
+	return err
+}
+
+// MergeInfohash merges a deprecated infohash into a canonical infohash for
+// the same content. Announces for the deprecated infohash are then recorded
+// under the canonical one, with a warning to the client. This is a
+// restricted endpoint.
+func (c *Client) MergeInfohash(ctx context.Context, deprecated, canonical []byte) error {
+	body, err := json.Marshal(api.InfohashMerge{Deprecated: deprecated, Canonical: canonical})
+	if err != nil {
+		return fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	_, err = c.do(ctx, request{method: "POST", path: "/api/infohash/merge", body: body, contentType: "application/json", restricted: true})
+	return err
+}
+
+// ImportInfohashes adds infohashes in bulk, skipping those which are
+// already tracked. This is a restricted endpoint.
+func (c *Client) ImportInfohashes(ctx context.Context, infohashes []InfohashPost) (BulkImport, error) {
+	body, err := json.Marshal(infohashes)
+	if err != nil {
+		return BulkImport{}, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+	return c.importInfohashes(ctx, body, "application/json")
+}
+
+// ImportInfohashList adds infohashes in bulk from a newline-delimited list
+// of hex-encoded infohashes, each optionally followed by a space and a name,
+// skipping those which are already tracked. This is a restricted endpoint.
+func (c *Client) ImportInfohashList(ctx context.Context, list io.Reader) (BulkImport, error) {
+	body, err := io.ReadAll(list)
+	if err != nil {
+		return BulkImport{}, fmt.Errorf("etracker: unable to read infohash list: %w", err)
+	}
+	return c.importInfohashes(ctx, body, "text/plain")
+}
+
+// importInfohashes posts a bulk import in either format.
+func (c *Client) importInfohashes(ctx context.Context, body []byte, contentType string) (BulkImport, error) {
+	data, err := c.do(ctx, request{method: "POST", path: "/api/infohashes/bulk", body: body, contentType: contentType, restricted: true, idempotent: true})
+	if err != nil {
+		return BulkImport{}, err
+	}
+	var result BulkImport
+	if err = json.Unmarshal(data, &result); err != nil {
+		return BulkImport{}, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return result, nil
+}
+
+// ExportInfohashes dumps every tracked infohash, oldest first. This is a
+// restricted endpoint.
+func (c *Client) ExportInfohashes(ctx context.Context) ([]InfohashExport, error) {
+	var infohashes []InfohashExport
+	if err := c.getJSON(ctx, "/api/infohashes/export", nil, true, &infohashes); err != nil {
+		return nil, err
+	}
+	return infohashes, nil
+}
+
+// RetireInfohash retires an infohash. Later announces for it are refused,
+// but its stats are kept. This is a restricted endpoint.
+func (c *Client) RetireInfohash(ctx context.Context, infoHash []byte) error {
+	body, err := json.Marshal(api.Infohash{Info_hash: infoHash})
+	if err != nil {
+		return fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	_, err = c.do(ctx, request{method: "POST", path: "/api/infohash/retire", body: body, contentType: "application/json", restricted: true, idempotent: true})
+	return err
+}
+
+// RestoreInfohash restores a retired infohash, so that announces for it are
+// accepted again. This is a restricted endpoint.
+func (c *Client) RestoreInfohash(ctx context.Context, infoHash []byte) error {
+	body, err := json.Marshal(api.Infohash{Info_hash: infoHash})
+	if err != nil {
+		return fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	_, err = c.do(ctx, request{method: "POST", path: "/api/infohash/restore", body: body, contentType: "application/json", restricted: true, idempotent: true})
+	return err
+}
+
+// Snatches lists which announce keys completed an infohash and when, oldest
+// first. This is a restricted endpoint.
+func (c *Client) Snatches(ctx context.Context, infoHash []byte) ([]Snatch, error) {
+	var snatches []Snatch
+	if err := c.getJSON(ctx, "/api/infohash/"+hex.EncodeToString(infoHash)+"/snatches", nil, true, &snatches); err != nil {
+		return nil, err
+	}
+	return snatches, nil
+}
+
+// KeyUsage returns usage analytics for an announce key. This is a
+// restricted endpoint.
+func (c *Client) KeyUsage(ctx context.Context, announceKey string) (*KeyUsage, error) {
+	query := url.Values{}
+	query.Set("announce_key", announceKey)
+
+	var usage KeyUsage
+	if err := c.getJSON(ctx, "/api/keyusage", query, true, &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// Keys returns a page of up to limit announce keys, oldest first, starting
+// at offset. A limit of zero uses the server default. This is a restricted
+// endpoint.
+func (c *Client) Keys(ctx context.Context, limit, offset int) (*KeyPage, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if offset > 0 {
+		query.Set("offset", strconv.Itoa(offset))
+	}
+
+	var page KeyPage
+	if err := c.getJSON(ctx, "/api/keys", query, true, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// KeyStats returns the lifetime totals and current swarms of an announce
+// key. This is a restricted endpoint.
+func (c *Client) KeyStats(ctx context.Context, announceKey string) (*KeyStats, error) {
+	var stats KeyStats
+	if err := c.getJSON(ctx, "/api/keys/"+url.PathEscape(announceKey)+"/stats", nil, true, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// RevokeKey revokes an announce key, erasing all of its data as
+// ErasePeerData does. This is a restricted endpoint.
+func (c *Client) RevokeKey(ctx context.Context, announceKey string) error {
+	_, err := c.do(ctx, request{method: "DELETE", path: "/api/keys/" + url.PathEscape(announceKey), restricted: true})
+	return err
+}
+
+// Wanted returns up to limit of the infohashes most requested by announces
+// but missing from the allowlist. A limit of zero uses the server default.
+// This is a restricted endpoint.
+func (c *Client) Wanted(ctx context.Context, limit int) ([]Wanted, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	var wanted []Wanted
+	if err := c.getJSON(ctx, "/api/wanted", query, true, &wanted); err != nil {
+		return nil, err
+	}
+	return wanted, nil
+}
+
+// RecentAnnounces returns the decisions made for up to limit of the most
+// recent announces handled by the tracker instance, newest first, with the
+// given outcome if it is not empty. A limit of zero returns every decision
+// kept. This is a restricted endpoint.
+func (c *Client) RecentAnnounces(ctx context.Context, outcome string, limit int) ([]Decision, error) {
+	query := url.Values{}
+	if outcome != "" {
+		query.Set("outcome", outcome)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	var decisions []Decision
+	if err := c.getJSON(ctx, "/api/debug/recent", query, true, &decisions); err != nil {
+		return nil, err
+	}
+	return decisions, nil
+}
+
+// Runtime returns the goroutines, memory, connection pools, and cache sizes
+// of the tracker instance. This is a restricted endpoint.
+func (c *Client) Runtime(ctx context.Context) (*Runtime, error) {
+	var status Runtime
+	if err := c.getJSON(ctx, "/api/debug/runtime", nil, true, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Maintenance returns the current maintenance mode. This is a restricted
+// endpoint.
+func (c *Client) Maintenance(ctx context.Context) (*Maintenance, error) {
+	var status Maintenance
+	if err := c.getJSON(ctx, "/api/maintenance", nil, true, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// SetMaintenance enables maintenance mode, asking clients to retry after
+// retry, or disables it if retry is zero. This is a restricted endpoint.
+func (c *Client) SetMaintenance(ctx context.Context, retry time.Duration) (*Maintenance, error) {
+	body, err := json.Marshal(Maintenance{Enabled: retry > 0, Retry_seconds: int(retry.Seconds())})
+	if err != nil {
+		return nil, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	respBody, err := c.do(ctx, request{method: "PUT", path: "/api/maintenance", body: body, contentType: "application/json", restricted: true, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var status Maintenance
+	if err = json.Unmarshal(respBody, &status); err != nil {
+		return nil, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return &status, nil
+}
+
+// Algorithm returns the current peering algorithm and the names of every
+// algorithm available. This is a restricted endpoint.
+func (c *Client) Algorithm(ctx context.Context) (*Algorithm, error) {
+	var status Algorithm
+	if err := c.getJSON(ctx, "/api/algorithm", nil, true, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// SetAlgorithm switches the peering algorithm to the one named, on the
+// tracker instance which serves the request. This is a restricted endpoint.
+func (c *Client) SetAlgorithm(ctx context.Context, name string) (*Algorithm, error) {
+	body, err := json.Marshal(Algorithm{Algorithm: name})
+	if err != nil {
+		return nil, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	respBody, err := c.do(ctx, request{method: "POST", path: "/api/algorithm", body: body, contentType: "application/json", restricted: true, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var status Algorithm
+	if err = json.Unmarshal(respBody, &status); err != nil {
+		return nil, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return &status, nil
+}
+
+// ReadOnly returns the current read-only mode. This is a restricted endpoint.
+func (c *Client) ReadOnly(ctx context.Context) (*ReadOnly, error) {
+	var status ReadOnly
+	if err := c.getJSON(ctx, "/api/readonly", nil, true, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// SetReadOnly enables or disables read-only mode. Disabling replays buffered
+// announces before returning. This is a restricted endpoint.
+func (c *Client) SetReadOnly(ctx context.Context, enabled bool) (*ReadOnly, error) {
+	body, err := json.Marshal(ReadOnly{Enabled: enabled})
+	if err != nil {
+		return nil, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	respBody, err := c.do(ctx, request{method: "PUT", path: "/api/readonly", body: body, contentType: "application/json", restricted: true, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var status ReadOnly
+	if err = json.Unmarshal(respBody, &status); err != nil {
+		return nil, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return &status, nil
+}
+
+// ErasePeerData erases all personal data associated with an announce key,
+// including the key itself. This is a restricted endpoint. It is not retried,
+// since a retry after a successful erasure would fail with not found.
+func (c *Client) ErasePeerData(ctx context.Context, announceKey string) error {
+	query := url.Values{}
+	query.Set("announce_key", announceKey)
+
+	_, err := c.do(ctx, request{method: "DELETE", path: "/api/peerdata", query: query, restricted: true})
+	return err
+}
+
+// CatalogPublicKey returns the public key with which the tracker signs its
+// catalog. Indexers should fetch it once and pin it, rather than trusting a
+// key fetched alongside each catalog.
+func (c *Client) CatalogPublicKey(ctx context.Context) (ed25519.PublicKey, error) {
+	var key api.CatalogPublicKey
+	if err := c.getJSON(ctx, "/api/catalog/publickey", nil, false, &key); err != nil {
+		return nil, err
+	}
+	return ed25519.PublicKey(key.Public_key), nil
+}
+
+// Catalog downloads the catalog of tracked infohashes and verifies its
+// signature against publicKey. The client's API key must be an indexer key
+// rather than the tracker's API key.
+func (c *Client) Catalog(ctx context.Context, publicKey ed25519.PublicKey) (*Catalog, error) {
+	var signed api.SignedCatalog
+	if err := c.getJSON(ctx, "/api/catalog", nil, true, &signed); err != nil {
+		return nil, err
+	}
+
+	catalog, err := api.VerifyCatalog(publicKey, &signed)
+	if err != nil {
+		return nil, fmt.Errorf("etracker: %w", err)
+	}
+	return catalog, nil
+}
+
+// Indexers lists the indexers with catalog keys. This is a restricted
+// endpoint.
+func (c *Client) Indexers(ctx context.Context) ([]Indexer, error) {
+	var indexers []Indexer
+	if err := c.getJSON(ctx, "/api/indexers", nil, true, &indexers); err != nil {
+		return nil, err
+	}
+	return indexers, nil
+}
+
+// AddIndexer adds an indexer and returns its catalog key, which cannot be
+// retrieved again. This is a restricted endpoint. It is not retried, since
+// the name may already have been taken by an earlier attempt.
+func (c *Client) AddIndexer(ctx context.Context, name string) (string, error) {
+	body, err := json.Marshal(Indexer{Name: name})
+	if err != nil {
+		return "", fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	respBody, err := c.do(ctx, request{method: "POST", path: "/api/indexers", body: body, contentType: "application/json", restricted: true})
+	if err != nil {
+		return "", err
+	}
+
+	var key api.IndexerKey
+	if err = json.Unmarshal(respBody, &key); err != nil {
+		return "", fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return key.Key, nil
+}
+
+// DeleteIndexer revokes an indexer's catalog key. This is a restricted
+// endpoint.
+func (c *Client) DeleteIndexer(ctx context.Context, name string) error {
+	query := url.Values{}
+	query.Set("name", name)
+
+	_, err := c.do(ctx, request{method: "DELETE", path: "/api/indexers", query: query, restricted: true})
+	return err
+}
+
+// Agents lists the seedbox agents with keys. This is a restricted endpoint.
+func (c *Client) Agents(ctx context.Context) ([]Agent, error) {
+	var agents []Agent
+	if err := c.getJSON(ctx, "/api/agents", nil, true, &agents); err != nil {
+		return nil, err
+	}
+	return agents, nil
+}
+
+// AddAgent adds a seedbox agent and returns its key, which cannot be
+// retrieved again. This is a restricted endpoint. It is not retried, since
+// the name may already have been taken by an earlier attempt.
+func (c *Client) AddAgent(ctx context.Context, name string) (string, error) {
+	body, err := json.Marshal(Agent{Name: name})
+	if err != nil {
+		return "", fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	respBody, err := c.do(ctx, request{method: "POST", path: "/api/agents", body: body, contentType: "application/json", restricted: true})
+	if err != nil {
+		return "", err
+	}
+
+	var key api.AgentKey
+	if err = json.Unmarshal(respBody, &key); err != nil {
+		return "", fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return key.Key, nil
+}
+
+// DeleteAgent revokes a seedbox agent's key. This is a restricted endpoint.
+func (c *Client) DeleteAgent(ctx context.Context, name string) error {
+	query := url.Values{}
+	query.Set("name", name)
+
+	_, err := c.do(ctx, request{method: "DELETE", path: "/api/agents", query: query, restricted: true})
+	return err
+}
+
+// ReportPeers sends the health of peers observed by a seedbox agent, and
+// returns how many matched a current announce. The client's API key must be
+// an agent key rather than the tracker's API key. Reports are idempotent,
+// so they are retried.
+func (c *Client) ReportPeers(ctx context.Context, peers []PeerHealth) (int, error) {
+	body, err := json.Marshal(api.AgentReport{Peers: peers})
+	if err != nil {
+		return 0, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	respBody, err := c.do(ctx, request{method: "POST", path: "/api/agents/report", body: body, contentType: "application/json", restricted: true, idempotent: true})
+	if err != nil {
+		return 0, err
+	}
+
+	var result api.AgentReportResult
+	if err = json.Unmarshal(respBody, &result); err != nil {
+		return 0, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return result.Updated, nil
+}
+
+// WaitInfohashes long-polls for infohashes added after the id after, for a
+// seedbox agent to seed, waiting up to api.AgentPollTimeout if there are
+// none. Pass the Last id of each result to the next call. A negative after
+// waits only for infohashes added from now on. The client's API key must be
+// an agent key.
+func (c *Client) WaitInfohashes(ctx context.Context, after int) (*NewInfohashes, error) {
+	query := url.Values{}
+	if after >= 0 {
+		query.Set("after", strconv.Itoa(after))
+	}
+
+	var result NewInfohashes
+	if err := c.getJSON(ctx, "/api/agents/infohashes", query, true, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// AgentTorrentFile downloads the stored torrent file for infoHash, with the
+// announce URL of the seedbox agent's own announce key. The client's API key
+// must be an agent key.
+func (c *Client) AgentTorrentFile(ctx context.Context, infoHash []byte) ([]byte, error) {
+	query := url.Values{}
+	query.Set("info_hash", hex.EncodeToString(infoHash))
+
+	return c.do(ctx, request{method: "GET", path: "/api/agents/torrentfile", query: query, restricted: true, idempotent: true})
+}
+
+// Bans exports every ban. This is a restricted endpoint.
+func (c *Client) Bans(ctx context.Context) (*BanList, error) {
+	var bans BanList
+	if err := c.getJSON(ctx, "/api/bans", nil, true, &bans); err != nil {
+		return nil, err
+	}
+	return &bans, nil
+}
+
+// ImportBans imports a ban list, such as one exported from another tracker,
+// and returns how many bans were added and removed. Existing bans are kept,
+// unless replace is set, in which case bans not in the list are removed.
+// This is a restricted endpoint. Imports are idempotent, so they are
+// retried.
+func (c *Client) ImportBans(ctx context.Context, bans *BanList, replace bool) (added, removed int, err error) {
+	body, err := json.Marshal(bans)
+	if err != nil {
+		return 0, 0, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	query := url.Values{}
+	if replace {
+		query.Set("replace", "true")
+	}
+
+	respBody, err := c.do(ctx, request{method: "POST", path: "/api/bans", query: query, body: body, contentType: "application/json", restricted: true, idempotent: true})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var result api.BanImportResult
+	if err = json.Unmarshal(respBody, &result); err != nil {
+		return 0, 0, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return result.Imported, result.Removed, nil
+}
+
+// DeleteBan lifts a single ban. This is a restricted endpoint.
+func (c *Client) DeleteBan(ctx context.Context, kind, value string) error {
+	query := url.Values{}
+	query.Set("kind", kind)
+	query.Set("value", value)
+
+	_, err := c.do(ctx, request{method: "DELETE", path: "/api/bans", query: query, restricted: true, idempotent: true})
+	return err
+}
+
+// ACLs lists every ACL entry. This is a restricted endpoint.
+func (c *Client) ACLs(ctx context.Context) ([]ACLEntry, error) {
+	var entries []ACLEntry
+	if err := c.getJSON(ctx, "/api/acls", nil, true, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// AddACL allows the announce key or group named by value to announce
+// infoHash, restricting it to its ACL entries. kind is "key" or "group".
+// This is a restricted endpoint. Adding an entry is idempotent, so it is
+// retried.
+func (c *Client) AddACL(ctx context.Context, infoHash []byte, kind, value string) error {
+	body, err := json.Marshal(ACLEntry{Info_hash: infoHash, Kind: kind, Value: value})
+	if err != nil {
+		return fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	_, err = c.do(ctx, request{method: "POST", path: "/api/acls", body: body, contentType: "application/json", restricted: true, idempotent: true})
+	return err
+}
+
+// DeleteACL removes an ACL entry. This is a restricted endpoint.
+func (c *Client) DeleteACL(ctx context.Context, infoHash []byte, kind, value string) error {
+	query := url.Values{}
+	query.Set("info_hash", hex.EncodeToString(infoHash))
+	query.Set("kind", kind)
+	query.Set("value", value)
+
+	_, err := c.do(ctx, request{method: "DELETE", path: "/api/acls", query: query, restricted: true, idempotent: true})
+	return err
+}
+
+// Groups lists the group memberships of every user. This is a restricted
+// endpoint.
+func (c *Client) Groups(ctx context.Context) ([]UserGroup, error) {
+	var groups []UserGroup
+	if err := c.getJSON(ctx, "/api/groups", nil, true, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// AddGroupMember adds a user to a group. This is a restricted endpoint.
+// Adding a member is idempotent, so it is retried.
+func (c *Client) AddGroupMember(ctx context.Context, username, group string) error {
+	body, err := json.Marshal(UserGroup{Username: username, Group: group})
+	if err != nil {
+		return fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	_, err = c.do(ctx, request{method: "POST", path: "/api/groups", body: body, contentType: "application/json", restricted: true, idempotent: true})
+	return err
+}
+
+// DeleteGroupMember removes a user from a group. This is a restricted
+// endpoint.
+func (c *Client) DeleteGroupMember(ctx context.Context, username, group string) error {
+	query := url.Values{}
+	query.Set("username", username)
+	query.Set("group", group)
+
+	_, err := c.do(ctx, request{method: "DELETE", path: "/api/groups", query: query, restricted: true, idempotent: true})
+	return err
+}
+
+// Tiers lists the configured account tiers and the users in them. This is
+// a restricted endpoint.
+func (c *Client) Tiers(ctx context.Context) (*TierList, error) {
+	var tiers TierList
+	if err := c.getJSON(ctx, "/api/tiers", nil, true, &tiers); err != nil {
+		return nil, err
+	}
+	return &tiers, nil
+}
+
+// SetTier puts a user in an account tier until expires, or indefinitely if
+// it is nil. An empty tier removes the user from their tier. This is a
+// restricted endpoint. Setting a tier is idempotent, so it is retried.
+func (c *Client) SetTier(ctx context.Context, username, tier string, expires *time.Time) error {
+	body, err := json.Marshal(UserTier{Username: username, Tier: tier, Expires_time: expires})
+	if err != nil {
+		return fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	_, err = c.do(ctx, request{method: "PUT", path: "/api/tiers", body: body, contentType: "application/json", restricted: true, idempotent: true})
+	return err
+}
+
+// Rotation returns the progress of the announce key rotation campaign. This
+// is a restricted endpoint.
+func (c *Client) Rotation(ctx context.Context) (*RotationStatus, error) {
+	var status RotationStatus
+	if err := c.getJSON(ctx, "/api/rotation", nil, true, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// StartRotation marks every announce key to be rotated by the deadline,
+// after which keys which were not rotated are refused, and returns the
+// progress of the campaign. This is a restricted endpoint. Starting a
+// campaign is idempotent, so it is retried.
+func (c *Client) StartRotation(ctx context.Context, deadline time.Time) (*RotationStatus, error) {
+	body, err := json.Marshal(api.RotationCampaign{Deadline: deadline})
+	if err != nil {
+		return nil, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	body, err = c.do(ctx, request{method: "POST", path: "/api/rotation", body: body, contentType: "application/json", restricted: true, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var status RotationStatus
+	if err = json.Unmarshal(body, &status); err != nil {
+		return nil, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return &status, nil
+}
+
+// CancelRotation unmarks every announce key whose rotation deadline has not
+// passed. This is a restricted endpoint.
+func (c *Client) CancelRotation(ctx context.Context) error {
+	_, err := c.do(ctx, request{method: "DELETE", path: "/api/rotation", restricted: true, idempotent: true})
+	return err
+}
+
+// Invites lists every invite, newest first. This is a restricted endpoint.
+func (c *Client) Invites(ctx context.Context) ([]Invite, error) {
+	var invites []Invite
+	if err := c.getJSON(ctx, "/api/invites", nil, true, &invites); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+// AddInvite creates an invite with an optional note, and returns its code,
+// which cannot be retrieved again. This is a restricted endpoint. It is not
+// retried, since each attempt creates an invite.
+func (c *Client) AddInvite(ctx context.Context, note string) (string, error) {
+	body, err := json.Marshal(Invite{Note: note})
+	if err != nil {
+		return "", fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	respBody, err := c.do(ctx, request{method: "POST", path: "/api/invites", body: body, contentType: "application/json", restricted: true})
+	if err != nil {
+		return "", err
+	}
+
+	var code api.InviteCode
+	if err = json.Unmarshal(respBody, &code); err != nil {
+		return "", fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return code.Code, nil
+}
+
+// DeleteInvite revokes an unused invite. This is a restricted endpoint.
+func (c *Client) DeleteInvite(ctx context.Context, id int) error {
+	_, err := c.do(ctx, request{method: "DELETE", path: "/api/invites/" + strconv.Itoa(id), restricted: true, idempotent: true})
+	return err
+}
+
+// Promotions lists the promotions which have not ended. This is a
+// restricted endpoint.
+func (c *Client) Promotions(ctx context.Context) ([]Promotion, error) {
+	var promotions []Promotion
+	if err := c.getJSON(ctx, "/api/promotions", nil, true, &promotions); err != nil {
+		return nil, err
+	}
+	return promotions, nil
+}
+
+// AddPromotion adds a freeleech or upload multiplier promotion, and returns
+// it as stored. Leave Info_hash empty for a promotion of every infohash. An
+// Upload_multiplier of zero is sent as is, so set it to 1 for a freeleech
+// promotion without one. This is a restricted endpoint.
+func (c *Client) AddPromotion(ctx context.Context, promotion Promotion) (*Promotion, error) {
+	body, err := json.Marshal(promotion)
+	if err != nil {
+		return nil, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	respBody, err := c.do(ctx, request{method: "POST", path: "/api/promotions", body: body, contentType: "application/json", restricted: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var added Promotion
+	if err = json.Unmarshal(respBody, &added); err != nil {
+		return nil, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return &added, nil
+}
+
+// DeletePromotion removes a promotion by id. This is a restricted endpoint.
+func (c *Client) DeletePromotion(ctx context.Context, id int) error {
+	_, err := c.do(ctx, request{method: "DELETE", path: "/api/promotions/" + strconv.Itoa(id), restricted: true, idempotent: true})
+	return err
+}
+
+// ClientCerts lists the client certificates mapped to announce keys. This
+// is a restricted endpoint.
+func (c *Client) ClientCerts(ctx context.Context) ([]ClientCert, error) {
+	var certs []ClientCert
+	if err := c.getJSON(ctx, "/api/clientcerts", nil, true, &certs); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// AddClientCert maps a PEM-encoded client certificate to announceKey, so
+// that it can announce without the key in the URL. This is a restricted
+// endpoint.
+func (c *Client) AddClientCert(ctx context.Context, announceKey string, certPEM []byte) (*ClientCert, error) {
+	body, err := json.Marshal(api.ClientCertPost{Announce_key: announceKey, Certificate: string(certPEM)})
+	if err != nil {
+		return nil, fmt.Errorf("etracker: unable to encode request: %w", err)
+	}
+
+	respBody, err := c.do(ctx, request{method: "POST", path: "/api/clientcerts", body: body, contentType: "application/json", restricted: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var added ClientCert
+	if err = json.Unmarshal(respBody, &added); err != nil {
+		return nil, fmt.Errorf("etracker: unable to decode response: %w", err)
+	}
+	return &added, nil
+}
+
+// DeleteClientCert removes the mapping of a client certificate by its
+// hex-encoded fingerprint. This is a restricted endpoint.
+func (c *Client) DeleteClientCert(ctx context.Context, fingerprint string) error {
+	_, err := c.do(ctx, request{method: "DELETE", path: "/api/clientcerts/" + url.PathEscape(fingerprint), restricted: true, idempotent: true})
+	return err
+}
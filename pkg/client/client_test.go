@@ -0,0 +1,157 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dmoerner/etracker/internal/handler"
+	"github.com/dmoerner/etracker/internal/server"
+	"github.com/dmoerner/etracker/internal/testutils"
+)
+
+func TestRetries(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"hashcount":1,"seeders":2,"leechers":3}`))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, WithRetries(3, time.Millisecond))
+
+	stats, err := c.Stats(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Seeders != 2 {
+		t.Errorf("expected 2 seeders, got %d", stats.Seeders)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 calls, got %d", calls.Load())
+	}
+}
+
+func TestNoRetries(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/challenge" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"message":"error: could not generate announce key"}`))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, WithRetries(3, time.Millisecond))
+
+	_, err := c.GenerateKey(context.Background(), "")
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+	if apiErr.Message != "error: could not generate announce key" {
+		t.Errorf("unexpected message %q", apiErr.Message)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected key generation not to be retried, got %d calls", calls.Load())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, WithRetries(3, time.Millisecond))
+
+	// The context expires long before the Retry-After, so the client must
+	// give up rather than retry early.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := c.Infohashes(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 call, got %d", calls.Load())
+	}
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	tc, conf := testutils.BuildTestConfig(ctx, handler.DefaultAlgorithm, testutils.DefaultAPIKey)
+	defer testutils.TeardownTest(ctx, tc, conf)
+
+	conf.PowDifficulty = 4
+
+	ts := httptest.NewServer(server.New(ctx, conf, server.WithoutJobs()).Handler())
+	defer ts.Close()
+
+	c := New(ts.URL, WithAPIKey(testutils.DefaultAPIKey))
+
+	infoHash := []byte("clientclientclientcl")
+
+	err := c.AddInfohash(ctx, infoHash, "client test")
+	if err != nil {
+		t.Fatalf("error adding infohash: %v", err)
+	}
+
+	infohashes, err := c.Infohashes(ctx)
+	if err != nil {
+		t.Fatalf("error listing infohashes: %v", err)
+	}
+	if len(infohashes) != len(testutils.AllowedInfoHashes)+1 {
+		t.Errorf("expected %d infohashes, got %d", len(testutils.AllowedInfoHashes)+1, len(infohashes))
+	}
+
+	err = c.DeleteInfohash(ctx, infoHash)
+	if err != nil {
+		t.Errorf("error deleting infohash: %v", err)
+	}
+
+	key, err := c.GenerateKey(ctx, "")
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	usage, err := c.KeyUsage(ctx, key)
+	if err != nil {
+		t.Fatalf("error fetching key usage: %v", err)
+	}
+	if usage.Announce_key != key {
+		t.Errorf("expected usage for %s, got %s", key, usage.Announce_key)
+	}
+
+	err = c.ErasePeerData(ctx, key)
+	if err != nil {
+		t.Errorf("error erasing peer data: %v", err)
+	}
+
+	_, err = c.KeyUsage(ctx, key)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found after erasure, got %v", err)
+	}
+
+	unauthorized := New(ts.URL, WithAPIKey("wrong"))
+	err = unauthorized.AddInfohash(ctx, infoHash, "client test")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Errorf("expected forbidden with wrong key, got %v", err)
+	}
+}
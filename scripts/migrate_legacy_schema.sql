@@ -0,0 +1,180 @@
+-- migrate_legacy_schema.sql
+--
+-- Converts a database from the legacy layout, in which announce keys were
+-- kept in a peerids table and announces in a peers table, to the layout
+-- etracker creates at startup, in which announce keys are kept in peers and
+-- announces in announces. etracker refuses to start while a peerids table
+-- exists, see ErrLegacySchema in internal/db.
+--
+-- The legacy tables are expected to have at least these columns, with
+-- infohashes in the same form as today:
+--
+--   peerids (id, announce_key)
+--   peers (<a column referencing peerids (id)>, info_hash_id, ip_port,
+--          amount_left, downloaded, uploaded, event, last_announce)
+--
+-- Before changing anything, the script checks for these columns and for the
+-- foreign key, and aborts if any is missing, so a database in another layout
+-- is left alone. Other legacy columns are not converted. If a key announced
+-- an infohash more than once, only its latest announce is kept, and the
+-- lifetime totals of each key start as the sums of its converted announces.
+--
+-- The conversion is a single statement, so it either completes or changes
+-- nothing. The legacy tables are not dropped, but moved to the
+-- etracker_legacy schema, where they can be compared with the result and
+-- dropped by hand afterwards with DROP SCHEMA etracker_legacy CASCADE.
+--
+-- Stop the tracker, back up the database, and run:
+--
+--   psql -v ON_ERROR_STOP=1 -f scripts/migrate_legacy_schema.sql "$DATABASE_URL"
+--
+-- Then start the new version, which migrates the converted tables further.
+
+DO $migrate$
+DECLARE
+    missing text;
+    fk_column name;
+    key_count bigint;
+    announce_count bigint;
+BEGIN
+    IF to_regclass('peerids') IS NULL THEN
+        RAISE EXCEPTION 'no legacy peerids table, nothing to migrate';
+    END IF;
+    IF to_regclass('announces') IS NOT NULL THEN
+        RAISE EXCEPTION 'an announces table already exists alongside the legacy tables';
+    END IF;
+    IF EXISTS (SELECT FROM pg_namespace WHERE nspname = 'etracker_legacy') THEN
+        RAISE EXCEPTION 'the etracker_legacy schema already exists';
+    END IF;
+
+    SELECT
+        string_agg(required.table_name || '.' || required.column_name, ', ')
+    INTO missing
+    FROM (
+        VALUES ('peerids', 'id'),
+            ('peerids', 'announce_key'),
+            ('peers', 'info_hash_id'),
+            ('peers', 'ip_port'),
+            ('peers', 'amount_left'),
+            ('peers', 'downloaded'),
+            ('peers', 'uploaded'),
+            ('peers', 'event'),
+            ('peers', 'last_announce')) AS required (table_name, column_name)
+    WHERE
+        NOT EXISTS (
+            SELECT
+            FROM
+                information_schema.columns
+            WHERE
+                columns.table_schema = current_schema()
+                AND columns.table_name = required.table_name
+                AND columns.column_name = required.column_name);
+    IF missing IS NOT NULL THEN
+        RAISE EXCEPTION 'legacy tables lack expected columns: %', missing;
+    END IF;
+
+    -- The column of peers referencing peerids, whatever its name.
+    BEGIN
+        SELECT
+            attname INTO STRICT fk_column
+        FROM
+            pg_constraint
+            JOIN pg_attribute ON attrelid = conrelid
+                AND attnum = conkey[1]
+        WHERE
+            contype = 'f'
+            AND conrelid = 'peers'::regclass
+            AND confrelid = 'peerids'::regclass
+            AND cardinality(conkey) = 1;
+    EXCEPTION
+        WHEN no_data_found THEN
+            RAISE EXCEPTION 'legacy peers table has no foreign key to peerids';
+        WHEN too_many_rows THEN
+            RAISE EXCEPTION 'legacy peers table has several foreign keys to peerids';
+    END;
+
+    -- Moving the legacy tables out of the way keeps their indexes and
+    -- sequences from clashing with the names of the new ones.
+    CREATE SCHEMA etracker_legacy;
+    ALTER TABLE peers SET SCHEMA etracker_legacy;
+    ALTER TABLE peerids SET SCHEMA etracker_legacy;
+
+    -- As created by DbInitialize, which adds the later columns at startup.
+    CREATE TABLE peers (
+        id SERIAL PRIMARY KEY,
+        announce_key TEXT NOT NULL UNIQUE,
+        snatched INTEGER DEFAULT 0 NOT NULL,
+        downloaded BIGINT DEFAULT 0 NOT NULL,
+        uploaded BIGINT DEFAULT 0 NOT NULL,
+        created_time TIMESTAMPTZ NOT NULL DEFAULT NOW()
+    );
+
+    CREATE TABLE announces (
+        id SERIAL PRIMARY KEY,
+        peers_id INTEGER,
+        info_hash_id INTEGER,
+        ip_port BYTEA NOT NULL,
+        amount_left BIGINT NOT NULL,
+        downloaded BIGINT NOT NULL,
+        uploaded BIGINT NOT NULL,
+        event INTEGER,
+        last_announce TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+        CONSTRAINT fk_peers FOREIGN KEY (peers_id) REFERENCES peers (id) ON DELETE CASCADE,
+        CONSTRAINT fk_infohashes FOREIGN KEY (info_hash_id) REFERENCES infohashes (id) ON DELETE CASCADE
+    );
+
+    -- Keys keep their ids, so that the announces keep pointing at them.
+    INSERT INTO peers (id, announce_key)
+    SELECT
+        id,
+        announce_key
+    FROM
+        etracker_legacy.peerids;
+    PERFORM
+        setval(pg_get_serial_sequence('peers', 'id'), COALESCE(MAX(id), 0) + 1, FALSE)
+    FROM
+        peers;
+
+    EXECUTE format($insert$
+        INSERT INTO announces (peers_id, info_hash_id, ip_port, amount_left, downloaded, uploaded, event, last_announce)
+        SELECT DISTINCT ON (%1$I, info_hash_id)
+            %1$I,
+            info_hash_id,
+            ip_port,
+            amount_left,
+            downloaded,
+            uploaded,
+            event,
+            last_announce
+        FROM
+            etracker_legacy.peers
+        WHERE
+            %1$I IS NOT NULL
+        ORDER BY
+            %1$I,
+            info_hash_id,
+            last_announce DESC
+        $insert$, fk_column);
+
+    UPDATE
+        peers
+    SET
+        downloaded = totals.downloaded,
+        uploaded = totals.uploaded
+    FROM (
+        SELECT
+            peers_id,
+            SUM(downloaded) AS downloaded,
+            SUM(uploaded) AS uploaded
+        FROM
+            announces
+        GROUP BY
+            peers_id) AS totals
+    WHERE
+        peers.id = totals.peers_id;
+
+    SELECT COUNT(*) INTO key_count FROM peers;
+    SELECT COUNT(*) INTO announce_count FROM announces;
+    RAISE NOTICE 'migrated % announce keys and % announces, legacy tables kept in etracker_legacy', key_count, announce_count;
+END
+$migrate$;